@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+)
+
+var accessLogBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// clfLogger writes access log lines in the Apache Common or Combined Log
+// Format. Lines are assembled in pooled buffers and written with a single
+// Write each.
+type clfLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+func newCLFLogger(w io.Writer, format string) *clfLogger {
+	return &clfLogger{w: w, combined: format == accessLogCombined}
+}
+
+// Log skips requests for debug-level paths, which the JSON log hides by
+// default as well.
+func (l *clfLogger) Log(r *http.Request, level slog.Level, e accessEntry) {
+	if level < slog.LevelInfo {
+		return
+	}
+
+	bp := accessLogBuffers.Get().(*[]byte)
+	line := l.appendLine((*bp)[:0], r, e)
+
+	l.mu.Lock()
+	l.w.Write(line)
+	l.mu.Unlock()
+
+	*bp = line
+	accessLogBuffers.Put(bp)
+}
+
+// appendRequestURI writes the request target as sent, with the redacted
+// query in place of the original one.
+func appendRequestURI(b []byte, r *http.Request, query string) []byte {
+	uri := r.RequestURI
+	if r.URL.RawQuery == "" {
+		return appendEscaped(b, uri)
+	}
+	uri, _, _ = strings.Cut(uri, "?")
+	b = appendEscaped(b, uri)
+	b = append(b, '?')
+	return appendEscaped(b, query)
+}
+
+// appendLine formats %h %l %u %t "%r" %>s %b, followed by "%{Referer}i"
+// "%{User-agent}i" in the combined format.
+func (l *clfLogger) appendLine(b []byte, r *http.Request, e accessEntry) []byte {
+	if addr, ok := clientIP(r); ok {
+		b = addr.AppendTo(b)
+	} else {
+		b = append(b, '-')
+	}
+
+	b = append(b, " - "...)
+	b = appendField(b, e.user)
+
+	b = append(b, " ["...)
+	b = e.start.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, `] "`...)
+	b = appendEscaped(b, r.Method)
+	b = append(b, ' ')
+	b = appendRequestURI(b, r, e.query)
+	b = append(b, ' ')
+	b = appendEscaped(b, r.Proto)
+	b = append(b, `" `...)
+
+	b = strconv.AppendInt(b, int64(e.status), 10)
+	b = append(b, ' ')
+	if e.size > 0 {
+		b = strconv.AppendInt(b, e.size, 10)
+	} else {
+		b = append(b, '-')
+	}
+
+	if l.combined {
+		b = append(b, ` "`...)
+		b = appendField(b, r.Referer())
+		b = append(b, `" "`...)
+		b = appendField(b, r.UserAgent())
+		b = append(b, '"')
+	}
+	return append(b, '\n')
+}
+
+// appendField appends "-" for an empty value, as Apache does.
+func appendField(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	return appendEscaped(b, s)
+}
+
+// appendEscaped appends s with quotes, backslashes and non-printable bytes
+// escaped the way Apache does, so a client cannot forge log lines.
+func appendEscaped(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c == 0x7f || c >= utf8.RuneSelf:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// openAccessLog opens ACCESS_LOG_FILE: stdout when it is empty, "-" or
+// "stdout", stderr for "stderr", otherwise the file in append mode, rotated
+// by the ACCESS_LOG_MAX_* settings independently of the application log.
+func openAccessLog(cfg *Config) (io.WriteCloser, error) {
+	switch cfg.AccessLogFile {
+	case "", "-", "stdout":
+		return nopWriteCloser{os.Stdout}, nil
+	case "stderr":
+		return nopWriteCloser{os.Stderr}, nil
+	}
+	return openRotatingFile(cfg.AccessLogFile, int64(cfg.AccessLogMaxSize),
+		time.Duration(cfg.AccessLogMaxAgeDays)*24*time.Hour, cfg.AccessLogMaxBackups, cfg.AccessLogCompress)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLFLoggerGolden(t *testing.T) {
+	start := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", 3*60*60))
+
+	tests := []struct {
+		name   string
+		format string
+		req    func() *http.Request
+		entry  accessEntry
+		want   string
+	}{
+		{
+			name:   "common",
+			format: accessLogCommon,
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/index.html", nil)
+			},
+			entry: accessEntry{start: start, status: http.StatusOK, size: 2326},
+			want:  `192.0.2.1 - - [05/Mar/2024:14:07:09 +0300] "GET /index.html HTTP/1.1" 200 2326` + "\n",
+		},
+		{
+			name:   "common with user and no body",
+			format: accessLogCommon,
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodDelete, "/api/x", nil)
+			},
+			entry: accessEntry{start: start, status: http.StatusNoContent, user: "alice"},
+			want:  `192.0.2.1 - alice [05/Mar/2024:14:07:09 +0300] "DELETE /api/x HTTP/1.1" 204 -` + "\n",
+		},
+		{
+			name:   "combined",
+			format: accessLogCombined,
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+				r.Header.Set("Referer", "https://example.com/")
+				r.Header.Set("User-Agent", "Mozilla/5.0")
+				return r
+			},
+			entry: accessEntry{start: start, status: http.StatusNotFound, size: 19},
+			want:  `192.0.2.1 - - [05/Mar/2024:14:07:09 +0300] "GET /app.js HTTP/1.1" 404 19 "https://example.com/" "Mozilla/5.0"` + "\n",
+		},
+		{
+			name:   "combined without referer and user agent",
+			format: accessLogCombined,
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/", nil)
+			},
+			entry: accessEntry{start: start, status: http.StatusOK, size: 1},
+			want:  `192.0.2.1 - - [05/Mar/2024:14:07:09 +0300] "GET / HTTP/1.1" 200 1 "-" "-"` + "\n",
+		},
+		{
+			name:   "redacted query",
+			format: accessLogCommon,
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/x?token=secret&a=1", nil)
+			},
+			entry: accessEntry{start: start, status: http.StatusOK, size: 2, query: "token=REDACTED&a=1"},
+			want:  `192.0.2.1 - - [05/Mar/2024:14:07:09 +0300] "GET /api/x?token=REDACTED&a=1 HTTP/1.1" 200 2` + "\n",
+		},
+		{
+			name:   "escaped fields",
+			format: accessLogCombined,
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("User-Agent", "evil\" \\ \n200 -")
+				return r
+			},
+			entry: accessEntry{start: start, status: http.StatusOK, size: 1, user: "bób"},
+			want:  `192.0.2.1 - b\xc3\xb3b [05/Mar/2024:14:07:09 +0300] "GET / HTTP/1.1" 200 1 "-" "evil\" \\ \x0a200 -"` + "\n",
+		},
+		{
+			name:   "IPv6 client",
+			format: accessLogCommon,
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "[2001:db8::1]:443"
+				return r
+			},
+			entry: accessEntry{start: start, status: http.StatusOK, size: 1},
+			want:  `2001:db8::1 - - [05/Mar/2024:14:07:09 +0300] "GET / HTTP/1.1" 200 1` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			newCLFLogger(&out, tt.format).Log(tt.req(), slog.LevelInfo, tt.entry)
+			if out.String() != tt.want {
+				t.Errorf("got  %s\nwant %s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCLFLoggerSkipsDebug(t *testing.T) {
+	var out bytes.Buffer
+	newCLFLogger(&out, accessLogCommon).Log(httptest.NewRequest(http.MethodGet, "/", nil), slog.LevelDebug, accessEntry{status: http.StatusOK})
+	if out.Len() != 0 {
+		t.Errorf("a debug-level request was written: %q", out.String())
+	}
+}
+
+// TestCLFLoggerThroughMiddleware checks that the line carries the address
+// RealIP resolved and what the handler actually sent.
+func TestCLFLoggerThroughMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	clf := newCLFLogger(&out, accessLogCombined)
+	trusted := IPNets{netip.MustParsePrefix("10.0.0.0/8")}
+	h := RealIP(trusted, AccessLog(defaultLogRules, clf.Log, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "queued")
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sendMessage", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("User-Agent", "curl/8.0")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := regexp.MustCompile(`^198\.51\.100\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /api/sendMessage HTTP/1\.1" 202 6 "-" "curl/8\.0"\n$`)
+	if !want.MatchString(out.String()) {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestSeparateAccessLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		file       bool
+		wantInFile string
+		wantInApp  bool
+	}{
+		{"json in the application log", accessLogJSON, false, "", true},
+		{"json in its own file", accessLogJSON, true, `"msg":"HTTP Request"`, false},
+		{"common in its own file", accessLogCommon, true, `"GET /?x=1 HTTP/1.1" 200`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "access.log")
+			s, logs := newTestServer(t, func(cfg *Config) {
+				cfg.AccessLogFormat = tt.format
+				if tt.file {
+					cfg.AccessLogFile = file
+				}
+			})
+			serve(s, http.MethodGet, "/?x=1", nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			app := logs.String()
+			if got := strings.Contains(app, `"msg":"HTTP Request"`); got != tt.wantInApp {
+				t.Errorf("request in the application log = %t, want %t:\n%s", got, tt.wantInApp, app)
+			}
+			// Application messages stay in the application log either way.
+			if !strings.Contains(app, `"msg":"Shutdown hook finished"`) {
+				t.Errorf("shutdown was not logged in the application log:\n%s", app)
+			}
+			if !tt.file {
+				return
+			}
+			written, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := strings.Count(string(written), "\n"); lines != 1 || !strings.Contains(string(written), tt.wantInFile) {
+				t.Errorf("access log holds %d lines, want one with %s:\n%s", lines, tt.wantInFile, written)
+			}
+			if strings.Contains(string(written), "Shutdown") {
+				t.Errorf("application messages reached the access log:\n%s", written)
+			}
+		})
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.AccessLogFile = filepath.Join(dir, "access.log")
+		cfg.AccessLogMaxSize = 200
+		cfg.AccessLogMaxBackups = 0
+	})
+	for range 5 {
+		serve(s, http.MethodGet, "/", nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "access-*.log"))
+	if len(backups) == 0 {
+		t.Error("the access log was not rotated")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "access.log")); err != nil || info.Size() == 0 {
+		t.Errorf("no fresh access log after rotating: %v", err)
+	}
+}
+
+func BenchmarkCLFLogger(b *testing.B) {
+	clf := newCLFLogger(io.Discard, accessLogCombined)
+	r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	e := accessEntry{start: time.Now(), status: http.StatusOK, size: 2326}
+	b.ReportAllocs()
+	for b.Loop() {
+		clf.Log(r, slog.LevelInfo, e)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminPrefix = "/admin/"
+
+// runtimeNote is sent with every /admin/ response, as nothing changed
+// there is written back to the configuration.
+const runtimeNote = "runtime changes are kept in memory only and are lost on restart"
+
+// maxMaintenanceMessage bounds the message answered in maintenance mode.
+const maxMaintenanceMessage = 500
+
+// adminAPI changes operational settings at runtime, without a redeploy.
+type adminAPI struct {
+	cfg           *Config
+	logLevel      *slog.LevelVar
+	accessLogMode *accessLogModeVar
+	maintenance   *maintenanceMode
+	capture       *debugCapture
+}
+
+// Handler serves the /admin/ endpoints behind the bearer token.
+func (a *adminAPI) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+adminPrefix+"config", a.Config)
+	mux.HandleFunc("PUT "+adminPrefix+"loglevel", a.SetLogLevel)
+	mux.HandleFunc("PUT "+adminPrefix+"accesslog", a.SetAccessLogMode)
+	mux.HandleFunc("PUT "+adminPrefix+"maintenance", a.SetMaintenance)
+	mux.HandleFunc("PUT "+adminPrefix+"capture", a.SetCapture)
+	mux.HandleFunc(adminPrefix, apiNotFound(mux, adminPrefix))
+	return AdminAuth(token, mux)
+}
+
+// AdminAuth lets through requests carrying token as a bearer token.
+func AdminAuth(token string, next http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, present := checkBearerToken(r, want); !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			WriteError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "invalid admin token", nil,
+				slog.Bool("token_present", present))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminRuntime struct {
+	LogLevel      string           `json:"log_level"`
+	AccessLogMode string           `json:"access_log_mode"`
+	Maintenance   maintenanceState `json:"maintenance"`
+	DebugCapture  captureState     `json:"debug_capture"`
+}
+
+func (a *adminAPI) runtime() adminRuntime {
+	return adminRuntime{
+		LogLevel:      levelName(a.logLevel.Level()),
+		AccessLogMode: a.accessLogMode.Load(),
+		Maintenance:   a.maintenance.get(),
+		DebugCapture:  a.capture.get(time.Now()),
+	}
+}
+
+// Config returns the configuration the server started with, secrets
+// redacted, and the settings changed since.
+func (a *adminAPI) Config(w http.ResponseWriter, r *http.Request) {
+	config := make(map[string]string)
+	for _, f := range a.cfg.fields() {
+		config[f.key] = configValue(f)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"config":  config,
+		"runtime": a.runtime(),
+		"note":    runtimeNote,
+	})
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+
+	level slog.Level
+}
+
+func (req *logLevelRequest) validate(_ context.Context, v *validation) {
+	if !v.required("level", req.Level) {
+		return
+	}
+	if err := req.level.UnmarshalText([]byte(req.Level)); err != nil {
+		v.add("level", "log_level", "must be debug, info, warn or error")
+	}
+}
+
+// SetLogLevel changes the log level until the next restart or SIGUSR1.
+func (a *adminAPI) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	previous := a.logLevel.Level()
+	a.logLevel.Set(req.level)
+	a.audit(r, "log_level", levelName(previous), levelName(req.level))
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"log_level": levelName(req.level),
+		"previous":  levelName(previous),
+		"note":      runtimeNote,
+	})
+}
+
+// levelName is level as LOG_LEVEL takes it.
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+type accessLogModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+func (req *accessLogModeRequest) validate(_ context.Context, v *validation) {
+	if !v.required("mode", req.Mode) {
+		return
+	}
+	switch req.Mode {
+	case accessLogModeAll, accessLogModeErrors, accessLogModeNone:
+	default:
+		v.add("mode", "access_log_mode", "must be all, errors or none")
+	}
+}
+
+// SetAccessLogMode changes ACCESS_LOG_MODE until the next restart, or a
+// reload that changes it in the configuration.
+func (a *adminAPI) SetAccessLogMode(w http.ResponseWriter, r *http.Request) {
+	var req accessLogModeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	previous := a.accessLogMode.Load()
+	a.accessLogMode.Set(req.Mode)
+	a.audit(r, "access_log_mode", previous, req.Mode)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_log_mode": req.Mode,
+		"previous":        previous,
+		"note":            runtimeNote,
+	})
+}
+
+type maintenanceRequest struct {
+	Enabled *bool  `json:"enabled"`
+	Message string `json:"message"`
+}
+
+func (req *maintenanceRequest) validate(_ context.Context, v *validation) {
+	if req.Enabled == nil {
+		v.add("enabled", "required", "must be true or false")
+	}
+	v.maxLength("message", req.Message, maxMaintenanceMessage)
+}
+
+// SetMaintenance switches maintenance mode, in which /api/ answers 503.
+func (a *adminAPI) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	previous := a.maintenance.set(*req.Enabled, req.Message, time.Now())
+	current := a.maintenance.get()
+	a.audit(r, "maintenance", fmt.Sprint(previous.Enabled), fmt.Sprint(current.Enabled),
+		slog.String("message", current.Message))
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"maintenance": current,
+		"previous":    previous,
+		"note":        runtimeNote,
+	})
+}
+
+// SetCapture turns debug capture of /api/ bodies on for the duration given,
+// DEBUG_CAPTURE_TTL by default, or off. As the bodies are logged at debug
+// level, the response says so while the log level is above it.
+func (a *adminAPI) SetCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	ttl := req.duration
+	if ttl == 0 {
+		ttl = a.cfg.DebugCaptureTTL
+	}
+	now := time.Now()
+	previous := a.capture.set(*req.Enabled, ttl, now)
+	current := a.capture.get(now)
+	attrs := []any{}
+	if current.Until != nil {
+		attrs = append(attrs, slog.Time("until", *current.Until))
+	}
+	a.audit(r, "debug_capture", fmt.Sprint(previous.Enabled), fmt.Sprint(current.Enabled), attrs...)
+
+	resp := map[string]any{
+		"debug_capture": current,
+		"previous":      previous,
+		"note":          runtimeNote,
+	}
+	if current.Enabled && a.logLevel.Level() > slog.LevelDebug {
+		resp["warning"] = "captured bodies are logged at debug level, which the log level " + levelName(a.logLevel.Level()) + " leaves out"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// audit logs a setting change with where it came from, at info level or
+// above so that it gets through whatever the log level is now.
+func (a *adminAPI) audit(r *http.Request, setting, previous, value string, attrs ...any) {
+	client := r.RemoteAddr
+	if addr, ok := clientIP(r); ok {
+		client = addr.String()
+	}
+	level := max(a.logLevel.Level(), slog.LevelInfo)
+	LoggerFromContext(r.Context()).Log(r.Context(), level, "Runtime setting changed",
+		append([]any{
+			slog.String("setting", setting),
+			slog.String("value", value),
+			slog.String("previous", previous),
+			slog.String("client_ip", client),
+			slog.String("user_agent", r.UserAgent()),
+		}, attrs...)...)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiCacheKey identifies a cached GREEN-API result. The token digest keeps
+// a request with a wrong token from reading what the right one fetched.
+type apiCacheKey struct {
+	method     string
+	idInstance string
+	token      [sha256.Size]byte
+	// arg tells apart the results of a method taking an argument, such as
+	// the number checked by checkWhatsapp.
+	arg string
+}
+
+func newAPICacheKey(method, idInstance, apiToken string) apiCacheKey {
+	return apiCacheKey{method: method, idInstance: idInstance, token: sha256.Sum256([]byte(apiToken))}
+}
+
+type apiCacheEntry struct {
+	value    any
+	storedAt time.Time
+}
+
+// apiCall is a fetch in progress that concurrent requests for the same key
+// wait for instead of calling GREEN-API themselves.
+type apiCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// apiCache keeps successful results of idempotent GREEN-API methods for ttl
+// and coalesces concurrent fetches of the same result.
+type apiCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[apiCacheKey]apiCacheEntry
+	inflight map[apiCacheKey]*apiCall
+}
+
+func newAPICache(ttl time.Duration) *apiCache {
+	return &apiCache{
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[apiCacheKey]apiCacheEntry),
+		inflight: make(map[apiCacheKey]*apiCall),
+	}
+}
+
+// get returns the cached value for key or fetches it. With revalidate the
+// cached value is ignored. age is how old a hit is; hit is false for values
+// fetched by this call or by one it joined.
+func (c *apiCache) get(key apiCacheKey, revalidate bool, fetch func() (any, error)) (value any, age time.Duration, hit bool, err error) {
+	c.mu.Lock()
+	now := c.now()
+	if entry, ok := c.entries[key]; ok && !revalidate {
+		if age := now.Sub(entry.storedAt); age < c.ttl {
+			c.mu.Unlock()
+			return entry.value, age, true, nil
+		}
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, 0, false, call.err
+	}
+
+	call := &apiCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.value, call.err = fetch()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.sweep(now)
+		c.entries[key] = apiCacheEntry{value: call.value, storedAt: c.now()}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.value, 0, false, call.err
+}
+
+// invalidate drops the cached results of method for an instance, whatever
+// token fetched them.
+func (c *apiCache) invalidate(method, idInstance string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.method == method && key.idInstance == idInstance {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// sweep drops expired entries; c.mu must be held.
+func (c *apiCache) sweep(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.storedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// wantsRevalidation reports whether the client asked to bypass caches.
+func wantsRevalidation(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "no-store", "max-age=0":
+			return true
+		}
+	}
+	return r.Header.Get("Pragma") == "no-cache"
+}
+
+func setAgeHeader(w http.ResponseWriter, age time.Duration) {
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+}
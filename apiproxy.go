@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyHeaders are the request headers passed on to GREEN-API. Everything
+// else, cookies and the credential headers included, stays here.
+var proxyHeaders = []string{"Accept", "Content-Type"}
+
+// apiProxy passes allowed GREEN-API methods through under
+// /api/proxy/{method} without a handler of their own. The body goes upstream
+// as is, the answer comes back with its status, and the credentials are
+// added to the upstream URL the same way the typed client does it, on the
+// API or the media host as the method needs. Calls share the outbound
+// budgets of the typed client but are not retried and bypass the circuit
+// breaker. Sending methods get the 409 of an instance that is not
+// authorized, and the urlFile of sendFileByUrl is checked, as the typed
+// endpoints do it.
+type apiProxy struct {
+	api     *greenAPI
+	methods map[string]bool
+	proxy   *httputil.ReverseProxy
+}
+
+// proxyCall is what rewrite needs to know about a request; ServeHTTP puts
+// it in the request context.
+type proxyCall struct {
+	method string
+	// target carries the token and must not be logged.
+	target *url.URL
+	start  time.Time
+}
+
+type proxyCallKey struct{}
+
+func newAPIProxy(api *greenAPI, methods []string) (*apiProxy, error) {
+	for _, base := range []string{api.endpoints.API, api.endpoints.Media} {
+		if _, err := url.Parse(base); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &apiProxy{
+		api:     api,
+		methods: make(map[string]bool, len(methods)),
+	}
+	for _, method := range methods {
+		p.methods[method] = true
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      api.http.Transport,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+	}
+	return p, nil
+}
+
+func (p *apiProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.PathValue("method")
+	if !p.methods[method] {
+		WriteError(w, r, http.StatusForbidden, errCodeForbidden, "GREEN-API method is not allowed through the proxy",
+			map[string]string{"method": method})
+		return
+	}
+	setLogAPIMethod(r, method)
+
+	idInstance, apiToken, err := p.api.credentials(r)
+	if err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+
+	if sendsMessages(method) {
+		if err := p.api.requireAuthorized(idInstance); err != nil {
+			writeHTTPError(w, r, err)
+			return
+		}
+	}
+	if method == "sendFileByUrl" && !p.checkFileURL(w, r) {
+		return
+	}
+
+	// The base URLs were checked by newAPIProxy and the segments are
+	// escaped, so this cannot fail in practice; its error would show the
+	// token.
+	target, err := url.Parse(p.api.endpoints.MethodURL(method, idInstance, apiToken))
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, errCodeInternal, "could not build the GREEN-API URL", nil)
+		return
+	}
+
+	ctx, cancel := p.api.callContext(r)
+	defer cancel()
+	if p.api.limiter != nil {
+		if err := p.api.limiter.Wait(ctx, idInstance, method); err != nil {
+			writeHTTPError(w, r, p.api.upstreamError(r, method, err))
+			return
+		}
+	}
+	ctx = context.WithValue(ctx, proxyCallKey{}, &proxyCall{
+		method: method,
+		target: target,
+		start:  time.Now(),
+	})
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// sendsMessages reports whether method sends something on WhatsApp, which
+// waits for the instance to be authorized as the typed send endpoints do.
+func sendsMessages(method string) bool {
+	return strings.HasPrefix(method, "send") || method == "forwardMessages"
+}
+
+// checkFileURL runs the checks of /api/sendFileByUrl on the urlFile of a
+// proxied call, PRIVATE_URL_BLOCK and, unless validate=false is given, the
+// probe of the file, and answers when they fail. The body is read up front
+// and put back for the proxy.
+func (p *apiProxy) checkFileURL(w http.ResponseWriter, r *http.Request) bool {
+	var v validation
+	probe := v.queryBool(r, "validate", true)
+	if len(v.errs) > 0 {
+		writeValidationError(w, r, v.errs)
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if !errors.As(err, &maxBytes) {
+			WriteError(w, r, http.StatusBadRequest, errCodeInvalidBody, "could not read the body", nil)
+		}
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		URLFile string `json:"urlFile"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		WriteError(w, r, http.StatusBadRequest, errCodeInvalidBody, "invalid JSON body", nil)
+		return false
+	}
+	if p.api.blockPrivateURLs {
+		v.check("urlFile", checkFileURL(r.Context(), req.URLFile, true))
+		if len(v.errs) > 0 {
+			writeValidationError(w, r, v.errs)
+			return false
+		}
+	}
+	if probe && p.api.fileProbe != nil {
+		if err := p.api.fileProbe.check(r.Context(), req.URLFile); err != nil {
+			writeHTTPError(w, r, err)
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite points the request at the method URL of the instance.
+func (p *apiProxy) rewrite(pr *httputil.ProxyRequest) {
+	call := pr.In.Context().Value(proxyCallKey{}).(*proxyCall)
+
+	pr.Out.URL = call.target
+	pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+	// validate is ours, not a parameter of GREEN-API.
+	if call.method == "sendFileByUrl" && pr.In.URL.Query().Has("validate") {
+		query := pr.In.URL.Query()
+		query.Del("validate")
+		pr.Out.URL.RawQuery = query.Encode()
+	}
+	pr.Out.Host = ""
+
+	pr.Out.Header = make(http.Header, len(proxyHeaders))
+	for _, key := range proxyHeaders {
+		if values := pr.In.Header.Values(key); len(values) > 0 {
+			pr.Out.Header[key] = values
+		}
+	}
+}
+
+func (p *apiProxy) modifyResponse(resp *http.Response) error {
+	p.recordCall(resp.Request, resp.StatusCode, nil)
+	return nil
+}
+
+// errorHandler answers failed calls like the typed endpoints do. A body over
+// the limit is left to BodyLimit, which answers 413.
+func (p *apiProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// The URL carries the token.
+		err = urlErr.Err
+	}
+	p.recordCall(r, 0, err)
+
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return
+	}
+	writeHTTPError(w, r, p.api.upstreamError(r, r.PathValue("method"), err))
+}
+
+// recordCall logs the call like the typed client does, bodies aside, and
+// puts its latency in the request log.
+func (p *apiProxy) recordCall(r *http.Request, status int, err error) {
+	call, ok := r.Context().Value(proxyCallKey{}).(*proxyCall)
+	if !ok {
+		return
+	}
+	latency := time.Since(call.start)
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.upstream.Attempts = 1
+		fields.upstream.Latency = latency
+		if err != nil || status < 200 || status > 299 {
+			fields.upstream.Failures = 1
+		}
+	}
+
+	level := slog.LevelInfo
+	attrs := []slog.Attr{
+		slog.String("api_method", call.method),
+		slog.String("host", p.api.endpoints.Host(call.method)),
+		slog.Int("attempt", 1),
+		slog.Duration("duration", latency),
+	}
+	if status != 0 {
+		attrs = append(attrs, slog.Int("upstream_status", status))
+	}
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelWarn
+	}
+	LoggerFromContext(r.Context()).LogAttrs(r.Context(), level, "GREEN-API call", attrs...)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// proxyUpstream records the calls that get through the proxy.
+type proxyUpstream struct {
+	mu    sync.Mutex
+	calls []string
+	body  string
+}
+
+func (u *proxyUpstream) handler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	u.mu.Lock()
+	u.calls = append(u.calls, r.URL.Path+"?"+r.URL.RawQuery)
+	u.body = string(body)
+	u.mu.Unlock()
+	io.WriteString(w, `{"idMessage":"BAE9"}`)
+}
+
+func (u *proxyUpstream) Calls() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.calls...)
+}
+
+// newTestProxy serves /api/proxy/{method} for instance 1101 of upstream,
+// with the file probe dialing host.
+func newTestProxy(t *testing.T, upstream, host *httptest.Server, mutate func(*Config)) (http.Handler, *greenAPI) {
+	t.Helper()
+	cfg := testConfig(t, withConfig(withUpstream(upstream), singleAttempt, mutate))
+	api := newGreenAPI(cfg, http.DefaultTransport, nil, nil, nil)
+	if host != nil {
+		api.fileProbe = newTestFileProbe(t, cfg, host)
+	}
+	proxy, err := newAPIProxy(api, cfg.GreenAPIProxyMethods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/proxy/{method}", proxy)
+	return mux, api
+}
+
+func postProxy(h http.Handler, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProxySendFileByURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		body         string
+		blockPrivate bool
+		wantStatus   int
+		wantCode     string
+		wantReason   string
+		wantQuery    string
+	}{
+		{name: "file passes", body: urlFileBody("http://files.example.com/photo.png"), wantStatus: http.StatusOK},
+		{name: "query passed on", query: "?x=1", body: urlFileBody("http://files.example.com/photo.png"), wantStatus: http.StatusOK, wantQuery: "x=1"},
+		{name: "not found", body: urlFileBody("http://files.example.com/missing.png"), wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeURLFileRejected, wantReason: fileRejectNotFound},
+		{name: "too large", body: urlFileBody("http://files.example.com/big.mp4"), wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeURLFileRejected, wantReason: fileRejectTooLarge},
+		{name: "type not allowed", body: urlFileBody("http://files.example.com/page.html"), wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeURLFileRejected, wantReason: fileRejectContentType},
+		{name: "private host", body: urlFileBody("http://10.0.0.1/photo.png"), wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeURLFileRejected, wantReason: fileRejectPrivateHost},
+		{name: "check skipped", query: "?validate=false&x=1", body: urlFileBody("http://files.example.com/big.mp4"), wantStatus: http.StatusOK, wantQuery: "x=1"},
+		{name: "PRIVATE_URL_BLOCK without the check", query: "?validate=false", body: urlFileBody("http://10.0.0.1/photo.png"), blockPrivate: true, wantStatus: http.StatusBadRequest, wantCode: errCodeValidation},
+		{name: "bad validate", query: "?validate=perhaps", body: urlFileBody("http://files.example.com/photo.png"), wantStatus: http.StatusBadRequest, wantCode: errCodeValidation},
+		{name: "invalid JSON", body: `{"urlFile":`, wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureDefaultLog(t)
+			u := &proxyUpstream{}
+			upstream := fakeGreenAPI(t, u.handler)
+			var probed atomic.Int32
+			host := fileHost(t, &probed)
+			h, _ := newTestProxy(t, upstream, host, func(cfg *Config) { cfg.PrivateURLBlock = tt.blockPrivate })
+
+			rec := postProxy(h, "/api/proxy/sendFileByUrl"+tt.query, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			calls := u.Calls()
+			if tt.wantStatus != http.StatusOK {
+				if len(calls) != 0 {
+					t.Errorf("a rejected file reached GREEN-API: %v", calls)
+				}
+				var envelope struct {
+					Error struct {
+						Code    string `json:"code"`
+						Details struct {
+							Reason string `json:"reason"`
+						} `json:"details"`
+					} `json:"error"`
+				}
+				json.Unmarshal(rec.Body.Bytes(), &envelope)
+				if envelope.Error.Code != tt.wantCode || envelope.Error.Details.Reason != tt.wantReason {
+					t.Errorf("error %s with reason %q, want %s with %q", envelope.Error.Code, envelope.Error.Details.Reason, tt.wantCode, tt.wantReason)
+				}
+				return
+			}
+			if want := "/waInstance1101/sendFileByUrl/secret?" + tt.wantQuery; len(calls) != 1 || calls[0] != want {
+				t.Errorf("GREEN-API got %v, want %s", calls, want)
+			}
+			if u.body != tt.body {
+				t.Errorf("GREEN-API got body %s, want %s", u.body, tt.body)
+			}
+		})
+	}
+}
+
+func urlFileBody(urlFile string) string {
+	return fmt.Sprintf(`{"chatId":"79001234567@c.us","urlFile":%q,"fileName":"file.bin"}`, urlFile)
+}
+
+// TestServerProxySendFileByURL goes through the server, whose probe keeps
+// its own dialer: a file on loopback is refused.
+func TestServerProxySendFileByURL(t *testing.T) {
+	u := &proxyUpstream{}
+	upstream := fakeGreenAPI(t, u.handler)
+	var probed atomic.Int32
+	host := fileHost(t, &probed)
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+	rec, envelope := callAPI(t, s, http.MethodPost, "/api/proxy/sendFileByUrl", urlFileBody(host.URL+"/photo.png"), nil)
+	if rec.Code != http.StatusUnprocessableEntity || envelope.Error.Code != errCodeURLFileRejected {
+		t.Errorf("loopback file = %d %s", rec.Code, rec.Body)
+	}
+	if probed.Load() != 0 || len(u.Calls()) != 0 {
+		t.Errorf("file host got %d requests, GREEN-API %v", probed.Load(), u.Calls())
+	}
+}
+
+func TestProxyInstanceNotAuthorized(t *testing.T) {
+	tests := []struct {
+		method     string
+		state      string
+		wantStatus int
+	}{
+		{"sendMessage", greenapi.StateNotAuthorized, http.StatusConflict},
+		{"sendPoll", greenapi.StateBlocked, http.StatusConflict},
+		{"forwardMessages", greenapi.StateNotAuthorized, http.StatusConflict},
+		{"sendFileByUrl", greenapi.StateNotAuthorized, http.StatusConflict},
+		{"getContacts", greenapi.StateNotAuthorized, http.StatusOK},
+		{"sendMessage", greenapi.StateAuthorized, http.StatusOK},
+		{"sendMessage", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.state, func(t *testing.T) {
+			captureDefaultLog(t)
+			u := &proxyUpstream{}
+			upstream := fakeGreenAPI(t, u.handler)
+			h, api := newTestProxy(t, upstream, nil, func(cfg *Config) { cfg.FileProbeTimeout = 0 })
+			if tt.state != "" {
+				api.states.observe("1101", tt.state, time.Now())
+			}
+			rec := postProxy(h, "/api/proxy/"+tt.method, urlFileBody("https://example.com/a.png"))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusConflict {
+				return
+			}
+			var envelope apiError
+			json.Unmarshal(rec.Body.Bytes(), &envelope)
+			if envelope.Error.Code != errCodeInstanceNotAuthorized {
+				t.Errorf("error code = %s, want %s", envelope.Error.Code, errCodeInstanceNotAuthorized)
+			}
+			if calls := u.Calls(); len(calls) != 0 {
+				t.Errorf("GREEN-API was called: %v", calls)
+			}
+		})
+	}
+}
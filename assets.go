@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	assetsPrefix      = "/assets"
+	assetManifestPath = assetsPrefix + "/manifest.json"
+
+	// assetHashLen is the number of hex digits of the content hash in a
+	// fingerprinted URL.
+	assetHashLen = 8
+
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// assetPipeline serves the files of ASSET_DIRS under fingerprinted URLs,
+// /assets/js/app.3f2a91c0.js for /js/app.js, that can be cached forever
+// because any change to the file changes the URL. The hashes are computed
+// at startup and again after fsnotify reports a change.
+type assetPipeline struct {
+	// root is read for hashing; files serves the hashed URLs from the
+	// same files, and next everything else under /assets/.
+	root  http.FileSystem
+	dirs  []string
+	files http.Handler
+	next  http.Handler
+
+	logger *slog.Logger
+	// diskDir is the directory root reads from, and watcher watches it;
+	// both are empty for the embedded frontend, which never changes.
+	diskDir string
+	watcher *fsnotify.Watcher
+
+	mu     sync.Mutex
+	dirty  bool
+	hashes map[string]string
+}
+
+// normalizeAssetDirs turns ASSET_DIRS into clean URL paths, so that "js",
+// "/js" and "/js/" are all "/js".
+func normalizeAssetDirs(dirs []string) []string {
+	normalized := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		normalized = append(normalized, path.Clean("/"+dir))
+	}
+	return normalized
+}
+
+// assetCacheRules puts no-cache in front of rules for the unhashed paths of
+// the asset directories, which change whenever the files do.
+func assetCacheRules(dirs []string, rules func(*http.Request) CacheRules) func(*http.Request) CacheRules {
+	var noCache CacheRules
+	for _, dir := range dirs {
+		noCache = append(noCache, CacheRule{Pattern: strings.TrimSuffix(dir, "/") + "/", Value: "no-cache"})
+	}
+	return func(r *http.Request) CacheRules {
+		return append(slices.Clip(noCache), rules(r)...)
+	}
+}
+
+func newAssetPipeline(root http.FileSystem, diskDir string, dirs []string, files, next http.Handler, logger *slog.Logger) (*assetPipeline, error) {
+	p := &assetPipeline{
+		root:    root,
+		dirs:    dirs,
+		files:   files,
+		next:    next,
+		logger:  logger,
+		diskDir: diskDir,
+	}
+	if diskDir != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		p.watcher = watcher
+		go p.watch()
+	}
+
+	hashes, err := p.scan()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.hashes = hashes
+	return p, nil
+}
+
+func (p *assetPipeline) Close() error {
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.Close()
+}
+
+// Len returns the number of fingerprinted files.
+func (p *assetPipeline) Len() int {
+	return len(p.current())
+}
+
+// scan hashes every file below the asset directories and watches the
+// directories it went through. Dot files and precompressed sidecars of
+// other assets are left out; the sidecars are served along with them.
+func (p *assetPipeline) scan() (map[string]string, error) {
+	hashes := make(map[string]string)
+	var dirs []string
+	for _, dir := range p.dirs {
+		if err := p.walk(dir, hashes, &dirs); err != nil {
+			return nil, err
+		}
+	}
+	for name := range hashes {
+		for _, enc := range sidecarEncodings {
+			if original, ok := strings.CutSuffix(name, enc.ext); ok && hashes[original] != "" {
+				delete(hashes, name)
+			}
+		}
+	}
+
+	if p.watcher != nil {
+		for _, dir := range dirs {
+			diskPath := filepath.Join(p.diskDir, filepath.FromSlash(dir))
+			if err := p.watcher.Add(diskPath); err != nil {
+				p.logger.Warn("Could not watch asset directory, hashes may go stale",
+					slog.String("dir", diskPath),
+					slog.Any("error", err),
+				)
+			}
+		}
+	}
+	return hashes, nil
+}
+
+func (p *assetPipeline) walk(dir string, hashes map[string]string, dirs *[]string) error {
+	f, err := p.root.Open(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	*dirs = append(*dirs, dir)
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := p.walk(name, hashes, dirs); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		hash, err := p.hash(name)
+		if err != nil {
+			// The file may have been removed since Readdir; the next
+			// event rescans.
+			p.logger.Warn("Could not hash asset", slog.String("name", name), slog.Any("error", err))
+			continue
+		}
+		hashes[name] = hash
+	}
+	return nil
+}
+
+func (p *assetPipeline) hash(name string) (string, error) {
+	f, err := p.root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:assetHashLen], nil
+}
+
+// current returns the hashes, computing them again first when a file has
+// changed since the last scan. A failed scan keeps the previous hashes.
+func (p *assetPipeline) current() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dirty {
+		p.dirty = false
+		hashes, err := p.scan()
+		if err != nil {
+			p.logger.Warn("Could not hash assets, keeping the previous hashes", slog.Any("error", err))
+		} else {
+			p.hashes = hashes
+		}
+	}
+	return p.hashes
+}
+
+func (p *assetPipeline) watch() {
+	for {
+		select {
+		case event, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been dropped, so rescan to be sure.
+			p.logger.Warn("Asset watcher failed, rehashing", slog.Any("error", err))
+		}
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+	}
+}
+
+func assetURL(name, hash string) string {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	return assetsPrefix + dir + strings.TrimSuffix(base, ext) + "." + hash + ext
+}
+
+// Manifest maps the name of every asset, without the leading slash, to its
+// fingerprinted URL.
+func (p *assetPipeline) Manifest() map[string]string {
+	hashes := p.current()
+	manifest := make(map[string]string, len(hashes))
+	for name, hash := range hashes {
+		manifest[strings.TrimPrefix(name, "/")] = assetURL(name, hash)
+	}
+	return manifest
+}
+
+// parseAssetURL returns the asset names and hashes urlPath may stand for:
+// /assets/js/app.3f2a91c0.js is /js/app.js, and /assets/LICENSE.3f2a91c0
+// is /LICENSE.
+func parseAssetURL(urlPath string) (names, hashes []string) {
+	rest, ok := strings.CutPrefix(urlPath, assetsPrefix)
+	if !ok {
+		return nil, nil
+	}
+	dir, base := path.Split(rest)
+
+	ext := path.Ext(base)
+	for _, stem := range []string{strings.TrimSuffix(base, ext), base} {
+		hash := path.Ext(stem)
+		if !isAssetHash(strings.TrimPrefix(hash, ".")) {
+			continue
+		}
+		name := dir + strings.TrimSuffix(stem, hash)
+		if stem != base {
+			name += ext
+		}
+		names = append(names, name)
+		hashes = append(hashes, hash[1:])
+	}
+	return names, hashes
+}
+
+func isAssetHash(s string) bool {
+	if len(s) != assetHashLen {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// ServeHTTP serves the manifest and the fingerprinted URLs. A URL with an
+// outdated hash is redirected to the current one, so that a page cached
+// from before a deploy still gets its assets. Anything else under /assets/
+// goes to next.
+func (p *assetPipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == assetManifestPath {
+		writeJSON(w, http.StatusOK, p.Manifest())
+		return
+	}
+
+	names, hashes := parseAssetURL(r.URL.Path)
+	current := p.current()
+	for i, name := range names {
+		hash, ok := current[name]
+		if !ok {
+			continue
+		}
+		if hashes[i] != hash {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.Redirect(w, r, assetURL(name, hash), http.StatusFound)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = name
+		r2.URL.RawPath = ""
+		p.files.ServeHTTP(w, r2)
+		return
+	}
+	p.next.ServeHTTP(w, r)
+}
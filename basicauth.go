@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// BasicAuthUsers maps usernames to bcrypt password hashes. In the environment
+// pairs are written as "user:hash" separated by ",".
+type BasicAuthUsers map[string]string
+
+func (u *BasicAuthUsers) UnmarshalText(text []byte) error {
+	users := make(BasicAuthUsers)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, hash, ok := strings.Cut(item, ":")
+		if !ok {
+			return fmt.Errorf("invalid basic auth user %q, want user:bcrypt-hash", name)
+		}
+		if err := users.add(name, hash); err != nil {
+			return err
+		}
+	}
+	*u = users
+	return nil
+}
+
+func (u *BasicAuthUsers) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	users := make(BasicAuthUsers, len(raw))
+	for name, hash := range raw {
+		if err := users.add(name, hash); err != nil {
+			return err
+		}
+	}
+	*u = users
+	return nil
+}
+
+func (u BasicAuthUsers) add(name, hash string) error {
+	name, hash = strings.TrimSpace(name), strings.TrimSpace(hash)
+	if name == "" {
+		return fmt.Errorf("basic auth user has an empty name")
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("basic auth user %s: password must be a bcrypt hash: %w", name, err)
+	}
+	u[name] = hash
+	return nil
+}
+
+// String lists the usernames only, so hashes never end up in usage output.
+func (u BasicAuthUsers) String() string {
+	names := make([]string, 0, len(u))
+	for name := range u {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// dummyHash is compared against for unknown users so that a missing user
+// takes as long to reject as a wrong password.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// authenticate checks the password of name in constant time with respect to
+// both the username and the password.
+func (u BasicAuthUsers) authenticate(name, password string) bool {
+	hash := dummyHash()
+	found := 0
+	for user, h := range u {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(name)) == 1 {
+			hash = []byte(h)
+			found = 1
+		}
+	}
+
+	ok := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	return ok && found == 1
+}
+
+type basicAuthPolicy struct {
+	users    BasicAuthUsers
+	prefixes []string
+	exclude  []string
+	realm    string
+}
+
+func (p *basicAuthPolicy) protects(urlPath string) bool {
+	for _, prefix := range p.exclude {
+		if strings.HasPrefix(urlPath, prefix) {
+			return false
+		}
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuth requires HTTP Basic credentials for paths under the protected
+// prefixes. The username is recorded in the request log; the password is
+// never logged.
+func BasicAuth(policy *basicAuthPolicy, next http.Handler) http.Handler {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", policy.realm)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !matchRequestPath(r, policy.protects) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if ok {
+			setLogUser(r, user)
+		}
+		if !ok || !policy.users.authenticate(user, password) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			renderError(w, r, http.StatusUnauthorized, errCodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse"
+
+// testBasicAuthUsers has the user alice with testPassword.
+func testBasicAuthUsers(t *testing.T) BasicAuthUsers {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users BasicAuthUsers
+	if err := users.UnmarshalText([]byte("alice:" + string(hash))); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestBasicAuth(t *testing.T) {
+	policy := &basicAuthPolicy{
+		users:    testBasicAuthUsers(t),
+		prefixes: []string{"/"},
+		exclude:  []string{"/healthz", "/metrics"},
+		realm:    "staging",
+	}
+	tests := []struct {
+		name       string
+		path       string
+		user       string
+		password   string
+		noHeader   bool
+		wantStatus int
+		wantUser   string
+	}{
+		{"right password", "/", "alice", testPassword, false, http.StatusOK, "alice"},
+		{"wrong password", "/", "alice", "wrong", false, http.StatusUnauthorized, "alice"},
+		{"unknown user", "/", "mallory", testPassword, false, http.StatusUnauthorized, "mallory"},
+		{"empty password", "/", "alice", "", false, http.StatusUnauthorized, "alice"},
+		{"missing header", "/", "", "", true, http.StatusUnauthorized, ""},
+		{"health excluded", "/healthz", "", "", true, http.StatusOK, ""},
+		{"metrics excluded", "/metrics", "", "", true, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestLogger(logger, defaultLogRules, BasicAuth(policy, noContent))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if !tt.noHeader {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			wantStatus := tt.wantStatus
+			if wantStatus == http.StatusOK {
+				wantStatus = http.StatusNoContent
+			}
+			if rec.Code != wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, wantStatus)
+			}
+			challenge := rec.Header().Get("WWW-Authenticate")
+			if tt.wantStatus == http.StatusUnauthorized && challenge != `Basic realm="staging", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+			if tt.wantStatus == http.StatusOK && challenge != "" {
+				t.Errorf("WWW-Authenticate = %q on an allowed request", challenge)
+			}
+
+			if logs.String() == "" {
+				// Health checks are not logged by default.
+				return
+			}
+			var entry struct {
+				User string `json:"user"`
+			}
+			if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+				t.Fatalf("access log %q: %v", logs, err)
+			}
+			if entry.User != tt.wantUser {
+				t.Errorf("logged user %q, want %q", entry.User, tt.wantUser)
+			}
+			if tt.password != "" && strings.Contains(logs.String(), tt.password) {
+				t.Error("the password is logged")
+			}
+		})
+	}
+}
+
+func TestBasicAuthPrefixes(t *testing.T) {
+	policy := &basicAuthPolicy{prefixes: []string{"/admin/", "/api/"}, exclude: []string{"/api/config"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/admin/log-level", true},
+		{"/api/sendMessage", true},
+		{"/api/config", false},
+		{"/", false},
+		{"/administrator", false},
+	}
+	for _, tt := range tests {
+		if got := policy.protects(tt.path); got != tt.want {
+			t.Errorf("protects(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBasicAuthUsersUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"plain password", "alice:secret", "must be a bcrypt hash"},
+		{"no separator", "alice", "want user:bcrypt-hash"},
+		{"empty name", ":$2a$10$abcdefghijklmnopqrstuuJ0pYB7bO1GqYkHkA7jQb8Xb0bZ0vE2", "empty name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var users BasicAuthUsers
+			err := users.UnmarshalText([]byte(tt.raw))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("UnmarshalText = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Error("the password is in the error")
+			}
+		})
+	}
+}
+
+func TestBasicAuthUsersString(t *testing.T) {
+	users := testBasicAuthUsers(t)
+	users["bob"] = users["alice"]
+	if got := users.String(); got != "alice,bob" {
+		t.Errorf("String = %q, want the names only", got)
+	}
+}
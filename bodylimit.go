@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BodyLimits overrides MAX_BODY_BYTES per path prefix; the longest matching
+// prefix wins. In the environment pairs are written as "prefix=size"
+// separated by ",", e.g. "/upload/=100MB,/api/=64KB".
+type BodyLimits map[string]ByteSize
+
+func (b *BodyLimits) UnmarshalText(text []byte) error {
+	limits := make(BodyLimits)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, size, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid body limit %q, want prefix=size", item)
+		}
+		if err := limits.add(prefix, size); err != nil {
+			return err
+		}
+	}
+	*b = limits
+	return nil
+}
+
+func (b *BodyLimits) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	limits := make(BodyLimits, len(raw))
+	for prefix, size := range raw {
+		if err := limits.add(prefix, size); err != nil {
+			return err
+		}
+	}
+	*b = limits
+	return nil
+}
+
+func (b BodyLimits) add(prefix, size string) error {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid body limit prefix %q, want /prefix", prefix)
+	}
+
+	var limit ByteSize
+	if err := limit.UnmarshalText([]byte(strings.TrimSpace(size))); err != nil {
+		return fmt.Errorf("body limit for %s: %w", prefix, err)
+	}
+	b[prefix] = limit
+	return nil
+}
+
+func (b BodyLimits) String() string {
+	items := make([]string, 0, len(b))
+	for prefix, limit := range b {
+		items = append(items, prefix+"="+limit.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// lookup returns the limit for urlPath, falling back to def.
+func (b BodyLimits) lookup(urlPath string, def int64) int64 {
+	best, limit := -1, def
+	for prefix, size := range b {
+		if len(prefix) > best && strings.HasPrefix(urlPath, prefix) {
+			best, limit = len(prefix), int64(size)
+		}
+	}
+	return limit
+}
+
+// BodyLimit caps request bodies at the limit for the path; 0 means
+// unlimited. Requests declaring a larger Content-Length are rejected
+// up front. Otherwise the body is read through http.MaxBytesReader, and once
+// a handler runs into the limit its response is replaced by the 413.
+func BodyLimit(def int64, overrides BodyLimits, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := overrides.lookup(r.URL.Path, def)
+		if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			setLogBodyBytes(r, 0)
+			writeBodyTooLarge(w, r, limit)
+			return
+		}
+
+		bw := &bodyLimitWriter{responseWriter: responseWriter{ResponseWriter: w}, r: r, limit: limit}
+		body := &countingBody{ReadCloser: http.MaxBytesReader(bw, r.Body, limit)}
+		bw.body = body
+		r.Body = body
+
+		next.ServeHTTP(bw, r)
+
+		if body.exceeded {
+			if bw.status == 0 {
+				bw.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+			setLogBodyBytes(r, body.n)
+		}
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	w.Header().Set("Connection", "close")
+	WriteError(w, r, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large",
+		map[string]int64{"limit_bytes": limit})
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n        int64
+	exceeded bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitWriter swaps whatever the handler responds with for the 413 once
+// the body went over the limit.
+type bodyLimitWriter struct {
+	responseWriter
+	r        *http.Request
+	body     *countingBody
+	limit    int64
+	replaced bool
+}
+
+func (bw *bodyLimitWriter) WriteHeader(status int) {
+	if bw.status != 0 {
+		bw.responseWriter.WriteHeader(status)
+		return
+	}
+	if !bw.body.exceeded {
+		bw.responseWriter.WriteHeader(status)
+		return
+	}
+
+	bw.replaced = true
+	for _, key := range []string{"Content-Length", "Content-Encoding", "Content-Disposition", "ETag", "Last-Modified"} {
+		bw.Header().Del(key)
+	}
+	bw.status = http.StatusRequestEntityTooLarge
+	writeBodyTooLarge(bw.ResponseWriter, bw.r, bw.limit)
+}
+
+func (bw *bodyLimitWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.replaced {
+		return len(b), nil
+	}
+	return bw.responseWriter.Write(b)
+}
+
+func (bw *bodyLimitWriter) ReadFrom(src io.Reader) (int64, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.replaced {
+		return io.Copy(io.Discard, src)
+	}
+	return bw.responseWriter.ReadFrom(src)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// onlyReader hides the length of a body, so that the request goes out
+// chunked without Content-Length.
+type onlyReader struct{ io.Reader }
+
+func TestBodyLimit(t *testing.T) {
+	const limit = 1024
+	overrides := BodyLimits{"/upload/": 4096, "/upload/small/": 16}
+
+	tests := []struct {
+		name       string
+		path       string
+		size       int
+		chunked    bool
+		wantStatus int
+		wantLogged int64
+	}{
+		{"just under", "/api/sendMessage", limit - 1, false, http.StatusOK, -1},
+		{"at the limit", "/api/sendMessage", limit, false, http.StatusOK, -1},
+		{"just over", "/api/sendMessage", limit + 1, false, http.StatusRequestEntityTooLarge, 0},
+		{"chunked just under", "/api/sendMessage", limit - 1, true, http.StatusOK, -1},
+		{"chunked at the limit", "/api/sendMessage", limit, true, http.StatusOK, -1},
+		{"chunked just over", "/api/sendMessage", limit + 1, true, http.StatusRequestEntityTooLarge, limit},
+		{"chunked far over", "/api/sendMessage", 10 * limit, true, http.StatusRequestEntityTooLarge, limit},
+		{"route override", "/upload/file", 4000, false, http.StatusOK, -1},
+		{"route override over", "/upload/file", 4097, true, http.StatusRequestEntityTooLarge, 4096},
+		{"longest prefix", "/upload/small/x", 17, false, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestLogger(logger, defaultLogRules, BodyLimit(limit, overrides, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				io.WriteString(w, strconv.Itoa(len(body)))
+			})))
+
+			var body io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+			if tt.chunked {
+				body = onlyReader{body}
+			}
+			req := httptest.NewRequest(http.MethodPost, tt.path, body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if rec.Body.String() != strconv.Itoa(tt.size) {
+					t.Errorf("handler read %s bytes, want %d", rec.Body, tt.size)
+				}
+			} else {
+				var envelope struct {
+					Error struct {
+						Code    string           `json:"code"`
+						Details map[string]int64 `json:"details"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+					t.Fatalf("body %q: %v", rec.Body, err)
+				}
+				if envelope.Error.Code != errCodeBodyTooLarge || envelope.Error.Details["limit_bytes"] == 0 {
+					t.Errorf("error = %+v", envelope.Error)
+				}
+			}
+
+			var entry struct {
+				BodyBytes *int64 `json:"body_bytes"`
+			}
+			if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+				t.Fatalf("access log %q: %v", logs, err)
+			}
+			switch {
+			case tt.wantLogged < 0 && entry.BodyBytes != nil:
+				t.Errorf("body_bytes = %d logged for an accepted request", *entry.BodyBytes)
+			case tt.wantLogged >= 0 && (entry.BodyBytes == nil || *entry.BodyBytes != tt.wantLogged):
+				t.Errorf("body_bytes = %v, want %d", entry.BodyBytes, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestBodyLimitUnlimited(t *testing.T) {
+	h := BodyLimit(0, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strconv.FormatInt(n, 10))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 1<<20))))
+	if rec.Code != http.StatusOK || rec.Body.String() != strconv.Itoa(1<<20) {
+		t.Errorf("got %d %s, want the whole body with MAX_BODY_BYTES=0", rec.Code, rec.Body)
+	}
+}
+
+func TestBodyLimitsUnmarshal(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{"/upload/=100MB, /api/=64KB", "/api/=64KB,/upload/=100MB", ""},
+		{"/upload/", "", "want prefix=size"},
+		{"upload=1MB", "", "want /prefix"},
+		{"/upload/=lots", "", "body limit for /upload/"},
+	}
+	for _, tt := range tests {
+		var limits BodyLimits
+		err := limits.UnmarshalText([]byte(tt.raw))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("UnmarshalText(%q) = %v, want an error containing %q", tt.raw, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || limits.String() != tt.want {
+			t.Errorf("UnmarshalText(%q) = %v, %q; want %q", tt.raw, err, limits, tt.want)
+		}
+	}
+}
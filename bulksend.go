@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// bulkSendPath has no REQUEST_TIMEOUT unless REQUEST_TIMEOUT_ROUTES sets
+// one: BULK_SEND_TIMEOUT bounds it instead, and the results are only
+// written once it is over.
+const bulkSendPath = "/api/sendMessages"
+
+// bulkSendProgressEvery is how many finished recipients apart the progress
+// of a batch is logged.
+const bulkSendProgressEvery = 10
+
+// bulkSendWriteGrace is added to the batch deadline for writing the
+// results, in place of WRITE_TIMEOUT.
+const bulkSendWriteGrace = 10 * time.Second
+
+// Statuses of a recipient of /api/sendMessages.
+const (
+	bulkStatusSent   = "sent"
+	bulkStatusFailed = "failed"
+)
+
+// Error codes of recipients that were not sent to, besides those of
+// upstreamError.
+const (
+	errCodeInvalidRecipient = "invalid_recipient"
+	errCodeNotOnWhatsapp    = "not_on_whatsapp"
+	errCodeBatchDeadline    = "batch_deadline_exceeded"
+)
+
+// bulkSendLimits are BULK_SEND_MAX_RECIPIENTS, BULK_SEND_CONCURRENCY and
+// BULK_SEND_TIMEOUT.
+type bulkSendLimits struct {
+	maxRecipients int
+	concurrency   int
+	timeout       time.Duration
+}
+
+type sendMessagesRequest struct {
+	// Recipients are chat IDs or phone numbers, as chatId and phone of
+	// sendMessage.
+	Recipients []string `json:"recipients"`
+	Message    string   `json:"message"`
+	// CheckWhatsapp checks every phone number with checkWhatsapp first, so
+	// that numbers without WhatsApp are reported rather than sent to.
+	CheckWhatsapp bool `json:"checkWhatsapp"`
+
+	maxRecipients int
+}
+
+// validate checks the batch as a whole; a recipient that is not a valid
+// chat ID or phone number fails on its own and does not fail the request.
+func (req *sendMessagesRequest) validate(_ context.Context, v *validation) {
+	switch {
+	case len(req.Recipients) == 0:
+		v.add("recipients", "required", "must not be empty")
+	case len(req.Recipients) > req.maxRecipients:
+		v.add("recipients", "max_items", fmt.Sprintf("must have at most %d items, got %d", req.maxRecipients, len(req.Recipients)))
+	}
+	if v.required("message", req.Message) {
+		v.maxLength("message", req.Message, maxMessageLength)
+	}
+}
+
+// sendError is why a message was not sent, to a recipient of
+// /api/sendMessages or from the send queue.
+type sendError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// bulkResult is the outcome for one recipient, at the index it had in the
+// request.
+type bulkResult struct {
+	Index     int        `json:"index"`
+	Recipient string     `json:"recipient"`
+	ChatID    string     `json:"chatId,omitempty"`
+	Status    string     `json:"status"`
+	IDMessage string     `json:"idMessage,omitempty"`
+	Error     *sendError `json:"error,omitempty"`
+}
+
+type bulkSummary struct {
+	Total  int `json:"total"`
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+type sendMessagesResponse struct {
+	Results []bulkResult `json:"results"`
+	Summary bulkSummary  `json:"summary"`
+}
+
+// SendMessages serves POST /api/sendMessages: the same message to up to
+// BULK_SEND_MAX_RECIPIENTS recipients, BULK_SEND_CONCURRENCY at a time.
+// Every send waits for its turn in the outbound budget of sendMessage for as
+// long as BULK_SEND_TIMEOUT leaves, and a failed recipient does not stop
+// the others. The answer is 200 with one result per recipient, in the
+// order of the request, and counts of what was sent.
+func (g *greenAPI) SendMessages(w http.ResponseWriter, r *http.Request) error {
+	req := sendMessagesRequest{maxRecipients: g.bulk.maxRecipients}
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c, err := g.authorizedClient(r)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(g.bulk.timeout)
+	_ = setWriteDeadline(w, r, deadline.Add(bulkSendWriteGrace))
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+
+	logger := LoggerFromContext(r.Context())
+	logger.Info("Bulk send started",
+		slog.Int("recipients", len(req.Recipients)),
+		slog.Int("concurrency", g.bulk.concurrency),
+		slog.Duration("timeout", g.bulk.timeout),
+	)
+	start := time.Now()
+	resp := g.sendBatch(ctx, r, c, &req, logger)
+	logger.Info("Bulk send finished",
+		slog.Int("recipients", resp.Summary.Total),
+		slog.Int("sent", resp.Summary.Sent),
+		slog.Int("failed", resp.Summary.Failed),
+		slog.Duration("duration", time.Since(start)),
+	)
+	if r.Context().Err() != nil {
+		return g.upstreamError(r, "sendMessage", r.Context().Err())
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// sendBatch sends to every recipient of req and returns the results in the
+// order of the request.
+func (g *greenAPI) sendBatch(ctx context.Context, r *http.Request, c *greenapi.Client, req *sendMessagesRequest, logger *slog.Logger) sendMessagesResponse {
+	results := make([]bulkResult, len(req.Recipients))
+	// CallStats may not be shared between concurrent calls, so every send
+	// has its own, added to the request log at the end.
+	stats := make([]greenapi.CallStats, len(req.Recipients))
+
+	var mu sync.Mutex
+	var summary bulkSummary
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(g.bulk.concurrency, len(req.Recipients)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = g.sendOne(greenapi.WithCallStats(ctx, &stats[i]), r, c, req, i)
+
+				mu.Lock()
+				summary.Total++
+				if results[i].Status == bulkStatusSent {
+					summary.Sent++
+				} else {
+					summary.Failed++
+				}
+				if summary.Total%bulkSendProgressEvery == 0 && summary.Total < len(req.Recipients) {
+					logger.Info("Bulk send progress",
+						slog.Int("done", summary.Total),
+						slog.Int("recipients", len(req.Recipients)),
+						slog.Int("sent", summary.Sent),
+						slog.Int("failed", summary.Failed),
+					)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range req.Recipients {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		for _, s := range stats {
+			fields.upstream.Attempts += s.Attempts
+			fields.upstream.Failures += s.Failures
+			fields.upstream.Latency += s.Latency
+			fields.upstream.Throttled += s.Throttled
+		}
+	}
+	return sendMessagesResponse{Results: results, Summary: summary}
+}
+
+// sendOne sends the message to recipient i of req.
+func (g *greenAPI) sendOne(ctx context.Context, r *http.Request, c *greenapi.Client, req *sendMessagesRequest, i int) bulkResult {
+	result := bulkResult{Index: i, Recipient: req.Recipients[i], Status: bulkStatusFailed}
+	chatID, err := normalizeChatID(req.Recipients[i], "")
+	if err != nil {
+		result.Error = &sendError{Code: errCodeInvalidRecipient, Message: err.Error()}
+		return result
+	}
+	result.ChatID = chatID
+	if ctx.Err() != nil {
+		result.Error = g.bulkFailure(ctx, r, "sendMessage", ctx.Err())
+		return result
+	}
+
+	if req.CheckWhatsapp && strings.HasSuffix(chatID, "@c.us") {
+		exists, err := g.existsWhatsapp(ctx, r, c, strings.TrimSuffix(chatID, "@c.us"))
+		if err != nil {
+			result.Error = g.bulkFailure(ctx, r, "checkWhatsapp", err)
+			return result
+		}
+		if !exists {
+			result.Error = &sendError{Code: errCodeNotOnWhatsapp, Message: "the number has no WhatsApp account"}
+			return result
+		}
+	}
+
+	// A turn in the outbound budget after the deadline is refused rather
+	// than taken for nothing.
+	if deadline, ok := ctx.Deadline(); ok {
+		ctx = greenapi.WithLimiterWait(ctx, time.Until(deadline))
+	}
+	sent, err := c.SendMessage(ctx, greenapi.SendMessageRequest{ChatID: chatID, Message: req.Message})
+	if err != nil {
+		result.Error = g.bulkFailure(ctx, r, "sendMessage", err)
+		return result
+	}
+	result.Status = bulkStatusSent
+	result.IDMessage = sent.IDMessage
+	return result
+}
+
+// existsWhatsapp calls checkWhatsapp for digits through the cache of
+// /api/checkWhatsapp.
+func (g *greenAPI) existsWhatsapp(ctx context.Context, r *http.Request, c *greenapi.Client, digits string) (bool, error) {
+	// normalizeChatID leaves 10 to 15 digits, which always fit.
+	number, _ := strconv.ParseInt(digits, 10, 64)
+	var result any
+	var err error
+	if g.whatsappCache == nil {
+		result, err = c.CheckWhatsapp(ctx, number)
+	} else {
+		idInstance, apiToken, _ := g.credentials(r)
+		key := newAPICacheKey("checkWhatsapp", idInstance, apiToken)
+		key.arg = digits
+		// Other requests may be waiting for the same fetch, so it does not
+		// end with the batch.
+		result, _, _, err = g.whatsappCache.get(key, false, func() (any, error) {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), g.timeout)
+			defer cancel()
+			return c.CheckWhatsapp(ctx, number)
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.(*greenapi.CheckWhatsappResult).ExistsWhatsapp, nil
+}
+
+// bulkFailure maps a failed call for one recipient like upstreamError
+// would for a whole request. A recipient the batch deadline left no time
+// for gets errCodeBatchDeadline.
+func (g *greenAPI) bulkFailure(ctx context.Context, r *http.Request, method string, err error) *sendError {
+	var throttled *greenapi.ThrottledError
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && r.Context().Err() == nil || errors.As(err, &throttled) {
+		return &sendError{Code: errCodeBatchDeadline, Message: "BULK_SEND_TIMEOUT passed before GREEN-API confirmed the message"}
+	}
+	httpErr := g.upstreamError(r, method, err)
+	LoggerFromContext(r.Context()).Warn("Bulk send recipient failed",
+		slog.String("api_method", method),
+		slog.String("code", httpErr.Code),
+		slog.Any("error", err),
+	)
+	return &sendError{Code: httpErr.Code, Message: httpErr.Message, Details: httpErr.Details}
+}
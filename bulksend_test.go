@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestSendMessagesRequestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        sendMessagesRequest
+		wantFields string
+	}{
+		{"valid", sendMessagesRequest{Recipients: []string{"79001234567", "not a number"}, Message: "hi"}, ""},
+		{"no recipients", sendMessagesRequest{Message: "hi"}, "recipients"},
+		{"too many recipients", sendMessagesRequest{Recipients: []string{"1", "2", "3", "4"}, Message: "hi"}, "recipients"},
+		{"no message", sendMessagesRequest{Recipients: []string{"79001234567"}}, "message"},
+		{"message too long", sendMessagesRequest{Recipients: []string{"79001234567"}, Message: strings.Repeat("x", maxMessageLength+1)}, "message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.maxRecipients = 3
+			var v validation
+			tt.req.validate(context.Background(), &v)
+			fields := make([]string, 0, len(v.errs))
+			for _, e := range v.errs {
+				fields = append(fields, e.Field)
+			}
+			if got := strings.Join(fields, ","); got != tt.wantFields {
+				t.Errorf("invalid fields %q, want %q", got, tt.wantFields)
+			}
+		})
+	}
+}
+
+// bulkUpstream answers sendMessage by the last digit of the chat ID: 2 is a
+// 500, 3 a 400, 5 never answers, and anything else is sent as
+// "id-<chatId>" after a random delay, so that sends finish out of order.
+// checkWhatsapp says numbers ending in 4 have no WhatsApp.
+func bulkUpstream(t *testing.T) (http.HandlerFunc, *atomic.Int32) {
+	var inFlight, peak atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		var req struct {
+			ChatID      string      `json:"chatId"`
+			PhoneNumber json.Number `json:"phoneNumber"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(r.URL.Path, "/checkWhatsapp/") {
+			fmt.Fprintf(w, `{"existsWhatsapp":%t}`, !strings.HasSuffix(req.PhoneNumber.String(), "4"))
+			return
+		}
+		if !strings.Contains(r.URL.Path, "/sendMessage/") {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		id, _, _ := strings.Cut(req.ChatID, "@")
+		switch id[len(id)-1] {
+		case '2':
+			w.WriteHeader(http.StatusInternalServerError)
+		case '3':
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"message":"chatId is invalid"}`)
+		case '5':
+			<-r.Context().Done()
+		default:
+			time.Sleep(rand.N(5 * time.Millisecond))
+			fmt.Fprintf(w, `{"idMessage":"id-%s"}`, req.ChatID)
+		}
+	}, &peak
+}
+
+func TestServerSendMessages(t *testing.T) {
+	handler, peak := bulkUpstream(t)
+	upstream := fakeGreenAPI(t, handler)
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.BulkSendConcurrency = 4
+		cfg.BulkSendMaxRecipients = 20
+		// One send every 2ms: the batch waits for its turns rather than
+		// being refused.
+		cfg.GreenAPILimits = MethodLimits{"sendMessage": greenapi.Budget{Calls: 1000, Per: time.Minute, MinInterval: 2 * time.Millisecond}}
+		cfg.GreenAPILimitMaxWait = 0
+	}))
+
+	type want struct {
+		recipient, chatID, status, code string
+	}
+	wants := []want{
+		{"79000000010", "79000000010@c.us", bulkStatusSent, ""},
+		{"abc", "", bulkStatusFailed, errCodeInvalidRecipient},
+		{"79000000012", "79000000012@c.us", bulkStatusFailed, errCodeUpstreamError},
+		{"79000000013@c.us", "79000000013@c.us", bulkStatusFailed, errCodeUpstreamRejected},
+		{"79000000014", "79000000014@c.us", bulkStatusFailed, errCodeNotOnWhatsapp},
+		{"120363043968066561@g.us", "120363043968066561@g.us", bulkStatusSent, ""},
+	}
+	for i := range 8 {
+		phone := fmt.Sprintf("790000001%d%d", i, i%2*7)
+		wants = append(wants, want{phone, phone + "@c.us", bulkStatusSent, ""})
+	}
+	recipients := make([]string, len(wants))
+	for i, w := range wants {
+		recipients[i] = w.recipient
+	}
+	body, _ := json.Marshal(map[string]any{"recipients": recipients, "message": "hello", "checkWhatsapp": true})
+
+	rec, _ := callAPI(t, s, http.MethodPost, bulkSendPath, string(body), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sendMessages = %d: %s", rec.Code, rec.Body)
+	}
+	var resp sendMessagesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != len(wants) {
+		t.Fatalf("%d results for %d recipients", len(resp.Results), len(wants))
+	}
+	for i, w := range wants {
+		got := resp.Results[i]
+		if got.Index != i || got.Recipient != w.recipient || got.ChatID != w.chatID || got.Status != w.status {
+			t.Errorf("result %d = %+v, want %+v", i, got, w)
+		}
+		switch {
+		case w.code == "" && (got.Error != nil || got.IDMessage != "id-"+w.chatID):
+			t.Errorf("result %d: idMessage %q, error %+v", i, got.IDMessage, got.Error)
+		case w.code != "" && (got.Error == nil || got.Error.Code != w.code || got.IDMessage != ""):
+			t.Errorf("result %d: error %+v, want code %s", i, got.Error, w.code)
+		}
+	}
+	if resp.Summary != (bulkSummary{Total: 14, Sent: 10, Failed: 4}) {
+		t.Errorf("summary = %+v", resp.Summary)
+	}
+	if p := peak.Load(); p > 4 {
+		t.Errorf("%d calls at once, want at most 4", p)
+	}
+
+	out := logs.String()
+	for _, msg := range []string{"Bulk send started", "Bulk send progress", "Bulk send finished", "Bulk send recipient failed"} {
+		if !strings.Contains(out, `"msg":"`+msg+`"`) {
+			t.Errorf("%q not logged", msg)
+		}
+	}
+	if !strings.Contains(out, `"sent":10,"failed":4`) {
+		t.Errorf("the summary was not logged:\n%s", out)
+	}
+}
+
+func TestServerSendMessagesDeadline(t *testing.T) {
+	handler, _ := bulkUpstream(t)
+	upstream := fakeGreenAPI(t, handler)
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.BulkSendConcurrency = 1
+		cfg.BulkSendTimeout = 100 * time.Millisecond
+	}))
+
+	start := time.Now()
+	rec, _ := callAPI(t, s, http.MethodPost, bulkSendPath,
+		`{"recipients":["79000000010","79000000015","79000000011","abc"],"message":"hello"}`, nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("answered after %s", elapsed)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sendMessages = %d: %s", rec.Code, rec.Body)
+	}
+	var resp sendMessagesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]string, len(resp.Results))
+	for i, r := range resp.Results {
+		codes[i] = r.Status
+		if r.Error != nil {
+			codes[i] = r.Error.Code
+		}
+	}
+	want := []string{bulkStatusSent, errCodeBatchDeadline, errCodeBatchDeadline, errCodeInvalidRecipient}
+	if strings.Join(codes, " ") != strings.Join(want, " ") {
+		t.Errorf("results = %v, want %v", codes, want)
+	}
+	if resp.Summary != (bulkSummary{Total: 4, Sent: 1, Failed: 3}) {
+		t.Errorf("summary = %+v", resp.Summary)
+	}
+}
+
+func TestServerSendMessagesInvalid(t *testing.T) {
+	s, _ := newTestServer(t, withConfig(func(cfg *Config) { cfg.BulkSendMaxRecipients = 2 }))
+	tests := []struct {
+		name, body string
+		wantStatus int
+		wantCode   string
+	}{
+		{"too many recipients", `{"recipients":["79000000010","79000000011","79000000012"],"message":"hi"}`, http.StatusBadRequest, errCodeValidation},
+		{"no message", `{"recipients":["79000000010"]}`, http.StatusBadRequest, errCodeValidation},
+		{"no credentials", `{"recipients":["79000000010"],"message":"hi"}`, http.StatusUnauthorized, errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, envelope := callAPI(t, s, http.MethodPost, bulkSendPath, tt.body, nil)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
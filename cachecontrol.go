@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CacheRule maps a path pattern to a Cache-Control value. Patterns starting
+// with "/" match a path prefix, patterns like "*.html" match the extension.
+type CacheRule struct {
+	Pattern string
+	Value   string
+}
+
+func (c CacheRule) matches(name string) bool {
+	if ext, ok := strings.CutPrefix(c.Pattern, "*"); ok {
+		return strings.HasSuffix(name, ext)
+	}
+	return strings.HasPrefix(name, c.Pattern)
+}
+
+// CacheRules is an ordered list of rules; the first match wins. In the
+// environment rules are written as "pattern=value" separated by ";", e.g.
+// "/assets/=public, max-age=31536000, immutable;*.html=no-cache".
+type CacheRules []CacheRule
+
+func (c *CacheRules) UnmarshalText(text []byte) error {
+	var rules CacheRules
+	for _, item := range strings.Split(string(text), ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		rule, err := parseCacheRule(item)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	*c = rules
+	return nil
+}
+
+func (c *CacheRules) UnmarshalYAML(node *yaml.Node) error {
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+
+	rules := make(CacheRules, 0, len(items))
+	for _, item := range items {
+		rule, err := parseCacheRule(item)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	*c = rules
+	return nil
+}
+
+func (c CacheRules) String() string {
+	items := make([]string, len(c))
+	for i, rule := range c {
+		items[i] = rule.Pattern + "=" + rule.Value
+	}
+	return strings.Join(items, ";")
+}
+
+func parseCacheRule(item string) (CacheRule, error) {
+	pattern, value, ok := strings.Cut(item, "=")
+	pattern, value = strings.TrimSpace(pattern), strings.TrimSpace(value)
+	if !ok || pattern == "" || value == "" {
+		return CacheRule{}, fmt.Errorf("invalid cache rule %q, want pattern=value", item)
+	}
+	if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "*.") {
+		return CacheRule{}, fmt.Errorf("invalid cache rule pattern %q, want /prefix or *.ext", pattern)
+	}
+	return CacheRule{Pattern: pattern, Value: value}, nil
+}
+
+// Lookup returns the Cache-Control value for the file name, or "" when no
+// rule matches.
+func (c CacheRules) Lookup(name string) string {
+	for _, rule := range c {
+		if rule.matches(name) {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	tag     string
+}
+
+// etagCache keeps content-hash ETags per file, recomputing them only when
+// the file's size or modification time changes.
+type etagCache struct {
+	mu      sync.RWMutex
+	entries map[string]etagEntry
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: make(map[string]etagEntry)}
+}
+
+func (c *etagCache) get(name string, f http.File, modTime time.Time, size int64) (string, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[name]
+	c.mu.RUnlock()
+	if ok && entry.size == size && entry.modTime.Equal(modTime) {
+		return entry.tag, nil
+	}
+
+	tag, err := hashETag(f)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[name] = etagEntry{modTime: modTime, size: size, tag: tag}
+	c.mu.Unlock()
+
+	return tag, nil
+}
+
+func hashETag(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+func cacheName(urlPath string) string {
+	if strings.HasSuffix(urlPath, "/") {
+		return path.Join(urlPath, "index.html")
+	}
+	return urlPath
+}
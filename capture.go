@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Sources of debug capture.
+const (
+	captureFromConfig = "config"
+	captureFromAdmin  = "admin"
+)
+
+// captureState is whether /api/ bodies are captured, until when and what
+// turned capture on.
+type captureState struct {
+	Enabled bool `json:"enabled"`
+	// Until is when capture turned on through /admin/capture ends; it is
+	// nil for DEBUG_CAPTURE, which lasts until switched off.
+	Until  *time.Time `json:"until,omitempty"`
+	Source string     `json:"source,omitempty"`
+}
+
+// debugCapture decides whether the bodies of /api/ requests and responses
+// are logged, and how they are cut and redacted. It starts as DEBUG_CAPTURE
+// says; /admin/capture turns it on for a while or off.
+type debugCapture struct {
+	logger   *slog.Logger
+	maxBytes int
+	// unsafe logs bodies as they are, UNSAFE_FULL_BODIES.
+	unsafe bool
+
+	mu    sync.Mutex
+	state captureState
+	timer *time.Timer
+}
+
+func newDebugCapture(logger *slog.Logger, cfg *Config) *debugCapture {
+	c := &debugCapture{logger: logger, maxBytes: int(cfg.DebugCaptureMaxBytes), unsafe: cfg.UnsafeFullBodies}
+	if cfg.DebugCapture {
+		c.state = captureState{Enabled: true, Source: captureFromConfig}
+	}
+	return c
+}
+
+// get returns the state in effect at now.
+func (c *debugCapture) get(now time.Time) captureState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current(now)
+}
+
+// current must be called with mu held.
+func (c *debugCapture) current(now time.Time) captureState {
+	if c.state.Until != nil && !now.Before(*c.state.Until) {
+		return captureState{}
+	}
+	return c.state
+}
+
+// set turns capture on for ttl, or off, and returns the state it replaced.
+// Capture turned on expires by itself, so that it cannot be left on by
+// mistake.
+func (c *debugCapture) set(enabled bool, ttl time.Duration, now time.Time) captureState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.current(now)
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !enabled {
+		c.state = captureState{}
+		return previous
+	}
+	until := now.Add(ttl)
+	c.state = captureState{Enabled: true, Until: &until, Source: captureFromAdmin}
+	c.timer = time.AfterFunc(ttl, func() { c.expire(until) })
+	return previous
+}
+
+// expire ends capture that was to last until until, unless it has been
+// switched since.
+func (c *debugCapture) expire(until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Until == nil || !c.state.Until.Equal(until) {
+		return
+	}
+	c.state = captureState{}
+	c.timer = nil
+	c.logger.Info("Debug capture expired", slog.Time("until", until))
+}
+
+// captureBuffer keeps the first max bytes written to it and counts the
+// rest.
+type captureBuffer struct {
+	max   int
+	buf   []byte
+	total int64
+}
+
+func (b *captureBuffer) write(p []byte) {
+	b.total += int64(len(p))
+	if room := b.max - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+}
+
+func (b *captureBuffer) truncated() bool {
+	return b.total > int64(len(b.buf))
+}
+
+// captureReader copies what the handler reads of the request body into a
+// captureBuffer.
+type captureReader struct {
+	io.ReadCloser
+	buf *captureBuffer
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.write(p[:n])
+	return n, err
+}
+
+// captureWriter copies the response body into a captureBuffer on its way
+// out. Flushes and hijacks go straight through, so streaming responses
+// behave as without it.
+type captureWriter struct {
+	http.ResponseWriter
+	buf *captureBuffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.buf.write(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// DebugCapture logs the bodies of /api/ requests and responses at debug
+// level while capture is on: at most DEBUG_CAPTURE_MAX_BYTES of each, teed
+// off as the handler reads and writes them, so uploads and streams are not
+// held up. Unless UNSAFE_FULL_BODIES is set, tokens are masked and phone
+// numbers and message text are replaced by their length.
+func DebugCapture(capture *debugCapture, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := LoggerFromContext(r.Context())
+		if !strings.HasPrefix(r.URL.Path, "/api/") || !capture.get(time.Now()).Enabled || !logger.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqBuf := &captureBuffer{max: capture.maxBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &captureReader{ReadCloser: r.Body, buf: reqBuf}
+		}
+		respBuf := &captureBuffer{max: capture.maxBytes}
+		next.ServeHTTP(&captureWriter{ResponseWriter: w, buf: respBuf}, r)
+
+		logger.LogAttrs(r.Context(), slog.LevelDebug, "API body capture",
+			capture.bodyAttr("request", r.Header.Get("Content-Type"), reqBuf),
+			capture.bodyAttr("response", w.Header().Get("Content-Type"), respBuf),
+		)
+	})
+}
+
+// bodyAttr groups what was captured of one body.
+func (c *debugCapture) bodyAttr(name, contentType string, buf *captureBuffer) slog.Attr {
+	attrs := []any{slog.Int64("bytes", buf.total)}
+	if contentType != "" {
+		attrs = append(attrs, slog.String("content_type", contentType))
+	}
+	if buf.total > 0 {
+		attrs = append(attrs, slog.String("body", c.body(contentType, buf)))
+	}
+	if buf.truncated() {
+		attrs = append(attrs, slog.Bool("truncated", true))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// body returns the captured body for the log. Only JSON and plain text can
+// be redacted; anything else, such as a file upload, is logged as its size
+// and type unless UNSAFE_FULL_BODIES is set.
+func (c *debugCapture) body(contentType string, buf *captureBuffer) string {
+	s := string(buf.buf)
+	for !utf8.ValidString(s) && buf.truncated() && s != "" {
+		s = s[:len(s)-1]
+	}
+	if c.unsafe {
+		return s
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"), mediaType == "text/plain":
+		return redactCapture(s)
+	case mediaType == "":
+		mediaType = "unknown type"
+	}
+	return "[" + strconv.FormatInt(buf.total, 10) + " bytes of " + mediaType + "]"
+}
+
+var (
+	// captureSecretField matches JSON string fields holding credentials; a
+	// value cut off by the capture limit is matched up to the end.
+	captureSecretField = regexp.MustCompile(`(?i)("(?:apiTokenInstance|apiToken|token|password|authorization|webhookUrlToken)"\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+	// captureTextField matches JSON string fields holding message text. A
+	// message right after a code is that of an error envelope, which is
+	// kept as it is.
+	captureTextField = regexp.MustCompile(`(?i)("code"\s*:\s*"[^"\\]*"\s*,\s*)?("(?:message|text|textMessage|caption|quotedMessage|description|title)"\s*:\s*)"((?:[^"\\]|\\.)*)(?:"|\\?$)`)
+	// capturePhoneField matches JSON fields holding a bare phone number,
+	// as a string or a number.
+	capturePhoneField = regexp.MustCompile(`(?i)("(?:phoneNumber|phoneContact|phone)"\s*:\s*)("?)(\+?\d+)"?`)
+	// captureChatID matches personal and group chat IDs anywhere.
+	captureChatID = regexp.MustCompile(`\+?\d{5,20}(@[cg]\.us)`)
+)
+
+// redactCapture masks the credentials in a JSON or text body and replaces
+// phone numbers and message text by placeholders giving their length, so
+// that the shape of a payload can be checked without its content.
+func redactCapture(s string) string {
+	s = captureSecretField.ReplaceAllString(s, `$1"`+redacted+`"`)
+	s = captureTextField.ReplaceAllStringFunc(s, func(field string) string {
+		m := captureTextField.FindStringSubmatch(field)
+		if m[1] != "" {
+			return field
+		}
+		return m[2] + `"[text: ` + strconv.Itoa(utf8.RuneCountInString(m[3])) + ` chars]"`
+	})
+	s = capturePhoneField.ReplaceAllStringFunc(s, func(field string) string {
+		m := capturePhoneField.FindStringSubmatch(field)
+		return m[1] + `"` + phonePlaceholder(m[3]) + `"`
+	})
+	return captureChatID.ReplaceAllStringFunc(s, func(chatID string) string {
+		at := strings.IndexByte(chatID, '@')
+		return phonePlaceholder(chatID[:at]) + chatID[at:]
+	})
+}
+
+func phonePlaceholder(number string) string {
+	return "[phone: " + strconv.Itoa(len(strings.TrimPrefix(number, "+"))) + " digits]"
+}
+
+type captureRequest struct {
+	Enabled *bool `json:"enabled"`
+	// Duration is how long capture stays on, DEBUG_CAPTURE_TTL when empty.
+	Duration string `json:"duration"`
+
+	duration time.Duration
+}
+
+func (req *captureRequest) validate(_ context.Context, v *validation) {
+	if req.Enabled == nil {
+		v.add("enabled", "required", "must be true or false")
+	}
+	if req.Duration == "" {
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d < time.Second || d > maxCaptureDuration {
+		v.add("duration", "duration", "must be a duration from 1s to "+maxCaptureDuration.String())
+		return
+	}
+	req.duration = d
+}
+
+// maxCaptureDuration bounds how long /admin/capture turns capture on.
+const maxCaptureDuration = 24 * time.Hour
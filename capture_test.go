@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		max           int
+		writes        []string
+		want          string
+		wantTotal     int64
+		wantTruncated bool
+	}{
+		{"empty", 4, nil, "", 0, false},
+		{"under the cap", 4, []string{"ab"}, "ab", 2, false},
+		{"at the cap", 4, []string{"ab", "cd"}, "abcd", 4, false},
+		{"over the cap in one write", 4, []string{"abcdef"}, "abcd", 6, true},
+		{"over the cap across writes", 4, []string{"abc", "def", "gh"}, "abcd", 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &captureBuffer{max: tt.max}
+			for _, w := range tt.writes {
+				b.write([]byte(w))
+			}
+			if string(b.buf) != tt.want || b.total != tt.wantTotal || b.truncated() != tt.wantTruncated {
+				t.Errorf("buf %q, total %d, truncated %t; want %q, %d, %t", b.buf, b.total, b.truncated(), tt.want, tt.wantTotal, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestRedactCapture(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"token", `{"apiTokenInstance":"d75b3a66374942c5b3c019c698abc2067e151558acbd412a9e"}`, `{"apiTokenInstance":"[REDACTED]"}`},
+		{"password with escapes", `{"password": "a\"b"}`, `{"password": "[REDACTED]"}`},
+		{"token cut off by the cap", `{"token":"abc`, `{"token":"[REDACTED]"`},
+		{"message text", `{"message":"привет мир"}`, `{"message":"[text: 10 chars]"}`},
+		{"caption", `{"caption":"photo"}`, `{"caption":"[text: 5 chars]"}`},
+		{"message cut off by the cap", `{"message":"hel`, `{"message":"[text: 3 chars]"`},
+		{"error envelope kept", `{"error":{"code":"not_found","message":"no such route"}}`, `{"error":{"code":"not_found","message":"no such route"}}`},
+		{"personal chat ID", `{"chatId":"79001234567@c.us"}`, `{"chatId":"[phone: 11 digits]@c.us"}`},
+		{"group chat ID", `{"chatId":"120363043968066561@g.us"}`, `{"chatId":"[phone: 18 digits]@g.us"}`},
+		{"phone number string", `{"phoneNumber":"+79001234567"}`, `{"phoneNumber":"[phone: 11 digits]"}`},
+		{"phone number number", `{"phoneNumber":79001234567}`, `{"phoneNumber":"[phone: 11 digits]"}`},
+		{"plain text", `send 79001234567@c.us now`, `send [phone: 11 digits]@c.us now`},
+		{"other fields kept", `{"idMessage":"BAE5F4886F6F2D05","type":"outgoing"}`, `{"idMessage":"BAE5F4886F6F2D05","type":"outgoing"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactCapture(tt.in); got != tt.want {
+				t.Errorf("redactCapture(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebugCaptureBody(t *testing.T) {
+	const body = `{"chatId":"79001234567@c.us","message":"hi"}`
+	tests := []struct {
+		name        string
+		unsafe      bool
+		contentType string
+		body        string
+		max         int
+		want        string
+	}{
+		{"JSON", false, "application/json", body, 100, `{"chatId":"[phone: 11 digits]@c.us","message":"[text: 2 chars]"}`},
+		{"JSON with parameters", false, "application/json; charset=utf-8", body, 100, `{"chatId":"[phone: 11 digits]@c.us","message":"[text: 2 chars]"}`},
+		{"suffixed JSON", false, "application/problem+json", `{"token":"t"}`, 100, `{"token":"[REDACTED]"}`},
+		{"plain text", false, "text/plain", "79001234567@c.us", 100, "[phone: 11 digits]@c.us"},
+		{"upload", false, "image/png", "\x89PNG\r\n", 100, "[6 bytes of image/png]"},
+		{"unknown type", false, "", "abc", 100, "[3 bytes of unknown type]"},
+		{"unsafe", true, "application/json", body, 100, body},
+		{"unsafe upload", true, "image/png", "PNG", 100, "PNG"},
+		{"cut inside a rune", true, "text/plain", "aé", 2, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &debugCapture{maxBytes: tt.max, unsafe: tt.unsafe}
+			buf := &captureBuffer{max: tt.max}
+			buf.write([]byte(tt.body))
+			if got := c.body(tt.contentType, buf); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// captureLog is what DebugCapture logs of one request.
+type captureLog struct {
+	Request, Response struct {
+		Bytes       int64  `json:"bytes"`
+		ContentType string `json:"content_type"`
+		Body        string `json:"body"`
+		Truncated   bool   `json:"truncated"`
+	}
+}
+
+func TestDebugCapture(t *testing.T) {
+	upload := strings.Repeat("x", 10000)
+	tests := []struct {
+		name      string
+		enabled   bool
+		level     slog.Level
+		path      string
+		body      string
+		handler   http.HandlerFunc
+		wantLog   bool
+		check     func(t *testing.T, got captureLog)
+		checkResp func(t *testing.T, rec *httptest.ResponseRecorder)
+	}{
+		{
+			name: "request and response", enabled: true, level: slog.LevelDebug,
+			path: "/api/sendMessage", body: `{"chatId":"79001234567@c.us","message":"hello"}`,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"idMessage":"BAE5"}`)
+			},
+			wantLog: true,
+			check: func(t *testing.T, got captureLog) {
+				if got.Request.Body != `{"chatId":"[phone: 11 digits]@c.us","message":"[text: 5 chars]"}` || got.Request.Truncated {
+					t.Errorf("request = %+v", got.Request)
+				}
+				if got.Response.Body != `{"idMessage":"BAE5"}` || got.Response.Bytes != 20 {
+					t.Errorf("response = %+v", got.Response)
+				}
+			},
+		},
+		{
+			name: "upload over the cap", enabled: true, level: slog.LevelDebug,
+			path: "/api/uploadFile", body: upload,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				if string(b) != upload {
+					t.Errorf("the handler read %d bytes, want all %d", len(b), len(upload))
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+			wantLog: true,
+			check: func(t *testing.T, got captureLog) {
+				if got.Request.Bytes != 10000 || !got.Request.Truncated || got.Request.Body != strings.Repeat("x", 64) {
+					t.Errorf("request = %+v, want the first 64 of 10000 bytes", got.Request)
+				}
+				if got.Response.Bytes != 0 || got.Response.Body != "" {
+					t.Errorf("response = %+v", got.Response)
+				}
+			},
+		},
+		{
+			name: "streamed response", enabled: true, level: slog.LevelDebug,
+			path: "/api/export",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				for range 3 {
+					io.WriteString(w, strings.Repeat("y", 40))
+					if err := http.NewResponseController(w).Flush(); err != nil {
+						t.Errorf("Flush = %v", err)
+					}
+				}
+			},
+			wantLog: true,
+			check: func(t *testing.T, got captureLog) {
+				if got.Response.Bytes != 120 || !got.Response.Truncated || len(got.Response.Body) != 64 {
+					t.Errorf("response = %+v", got.Response)
+				}
+			},
+			checkResp: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !rec.Flushed || rec.Body.Len() != 120 {
+					t.Errorf("flushed %t, %d bytes sent", rec.Flushed, rec.Body.Len())
+				}
+			},
+		},
+		{
+			name: "off", enabled: false, level: slog.LevelDebug, path: "/api/sendMessage", body: `{}`,
+			handler: func(w http.ResponseWriter, r *http.Request) { io.Copy(io.Discard, r.Body) },
+		},
+		{
+			name: "outside /api/", enabled: true, level: slog.LevelDebug, path: "/app.js",
+			handler: func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "js") },
+		},
+		{
+			name: "debug level off", enabled: true, level: slog.LevelInfo, path: "/api/sendMessage", body: `{}`,
+			handler: func(w http.ResponseWriter, r *http.Request) { io.Copy(io.Discard, r.Body) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: tt.level}))
+			capture := newDebugCapture(logger, &Config{DebugCapture: tt.enabled, DebugCaptureMaxBytes: 64})
+			h := ContextLogger(logger, DebugCapture(capture, tt.handler))
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(http.MethodPost, tt.path, body)
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if tt.checkResp != nil {
+				tt.checkResp(t, rec)
+			}
+
+			var got captureLog
+			logged := false
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if strings.Contains(line, `"msg":"API body capture"`) {
+					logged = true
+					if err := json.Unmarshal([]byte(line), &got); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if logged != tt.wantLog {
+				t.Fatalf("logged the capture %t, want %t:\n%s", logged, tt.wantLog, logs.String())
+			}
+			if tt.check != nil {
+				tt.check(t, got)
+			}
+		})
+	}
+}
+
+func TestDebugCaptureExpiry(t *testing.T) {
+	var logs logBuffer
+	c := newDebugCapture(slog.New(slog.NewJSONHandler(&logs, nil)), &Config{})
+	now := time.Now()
+	if state := c.get(now); state.Enabled {
+		t.Fatalf("on without DEBUG_CAPTURE: %+v", state)
+	}
+
+	c.set(true, 50*time.Millisecond, now)
+	state := c.get(now)
+	if !state.Enabled || state.Source != captureFromAdmin || state.Until == nil || !state.Until.Equal(now.Add(50*time.Millisecond)) {
+		t.Fatalf("state = %+v", state)
+	}
+	if c.get(now.Add(50 * time.Millisecond)).Enabled {
+		t.Error("on at its expiry time")
+	}
+	waitFor(t, "the capture to expire", func() bool { return strings.Contains(logs.String(), `"msg":"Debug capture expired"`) })
+	if state := c.get(time.Now()); state.Enabled || state.Until != nil {
+		t.Errorf("after expiry the state is %+v", state)
+	}
+
+	// A timer from an earlier switch must not end capture turned on again.
+	c.set(true, 30*time.Millisecond, time.Now())
+	c.set(true, time.Hour, time.Now())
+	time.Sleep(60 * time.Millisecond)
+	if !c.get(time.Now()).Enabled {
+		t.Error("the first timer ended the second capture")
+	}
+	if previous := c.set(false, 0, time.Now()); !previous.Enabled {
+		t.Errorf("set(false) returned %+v as the previous state", previous)
+	}
+	if c.get(time.Now()).Enabled {
+		t.Error("still on after set(false)")
+	}
+
+	fromConfig := newDebugCapture(slog.New(slog.DiscardHandler), &Config{DebugCapture: true})
+	if state := fromConfig.get(time.Now().Add(24 * time.Hour)); !state.Enabled || state.Source != captureFromConfig || state.Until != nil {
+		t.Errorf("DEBUG_CAPTURE gave %+v, want on without an end", state)
+	}
+}
+
+func TestCaptureRequestValidate(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name      string
+		req       captureRequest
+		wantField string
+		want      time.Duration
+	}{
+		{"on with the default", captureRequest{Enabled: &yes}, "", 0},
+		{"on for a minute", captureRequest{Enabled: &yes, Duration: "1m"}, "", time.Minute},
+		{"off", captureRequest{Enabled: &no}, "", 0},
+		{"enabled missing", captureRequest{Duration: "1m"}, "enabled", time.Minute},
+		{"too short", captureRequest{Enabled: &yes, Duration: "500ms"}, "duration", 0},
+		{"too long", captureRequest{Enabled: &yes, Duration: "25h"}, "duration", 0},
+		{"not a duration", captureRequest{Enabled: &yes, Duration: "soon"}, "duration", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v validation
+			tt.req.validate(context.Background(), &v)
+			fields := make([]string, 0, len(v.errs))
+			for _, e := range v.errs {
+				fields = append(fields, e.Field)
+			}
+			if got := strings.Join(fields, ","); got != tt.wantField {
+				t.Errorf("invalid fields %q, want %q", got, tt.wantField)
+			}
+			if tt.req.duration != tt.want {
+				t.Errorf("duration = %s, want %s", tt.req.duration, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerDebugCapture(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"idMessage":"BAE5"}`)
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.AdminToken = adminToken
+	}))
+	admin := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/capture", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	send := func() string {
+		seen := len(logs.String())
+		if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"secret text"}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("sendMessage = %d: %s", rec.Code, rec.Body)
+		}
+		return logs.String()[seen:]
+	}
+
+	if out := send(); strings.Contains(out, "API body capture") {
+		t.Errorf("captured while off:\n%s", out)
+	}
+	if rec := admin(`{"enabled":true,"duration":"48h"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("a 48h capture = %d, want 400", rec.Code)
+	}
+
+	rec := admin(`{"enabled":true,"duration":"1m"}`)
+	var resp struct {
+		DebugCapture captureState `json:"debug_capture"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/capture = %d: %s", rec.Code, rec.Body)
+	}
+	if !resp.DebugCapture.Enabled || resp.DebugCapture.Until == nil || time.Until(*resp.DebugCapture.Until) > time.Minute {
+		t.Errorf("state = %+v", resp.DebugCapture)
+	}
+	out := send()
+	if !strings.Contains(out, `"msg":"API body capture"`) || !strings.Contains(out, `[text: 11 chars]`) || !strings.Contains(out, `BAE5`) {
+		t.Errorf("the capture is missing:\n%s", out)
+	}
+	if strings.Contains(out, "secret text") || strings.Contains(out, "79001234567") {
+		t.Errorf("the capture was not redacted:\n%s", out)
+	}
+
+	admin(`{"enabled":false}`)
+	if out := send(); strings.Contains(out, "API body capture") {
+		t.Errorf("captured after switching off:\n%s", out)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "net/http"
+
+// Middleware wraps a handler in another one that runs around it.
+type Middleware func(next http.Handler) http.Handler
+
+// Stack is an ordered list of middleware. The first one is the outermost:
+// it sees the request first and the response last, so
+// Chain(a, b).Then(h) serves like a(b(h)).
+type Stack []Middleware
+
+// Chain returns a stack of middleware in the order given.
+func Chain(middleware ...Middleware) Stack {
+	return append(Stack(nil), middleware...)
+}
+
+// Use returns a copy of s with middleware added inside the ones already
+// there, so that s itself can still be used as the base of other stacks.
+func (s Stack) Use(middleware ...Middleware) Stack {
+	return append(s[:len(s):len(s)], middleware...)
+}
+
+// Then wraps h in the stack.
+func (s Stack) Then(h http.Handler) http.Handler {
+	for i := len(s) - 1; i >= 0; i-- {
+		h = s[i](h)
+	}
+	return h
+}
+
+// Group returns routes on mux that all go through s, such as the static
+// files sharing their method and path checks.
+func (s Stack) Group(mux *http.ServeMux) *Group {
+	return &Group{mux: mux, stack: s}
+}
+
+// Group registers handlers on a mux behind a shared stack of middleware.
+type Group struct {
+	mux   *http.ServeMux
+	stack Stack
+}
+
+// Handle registers h for pattern behind the group's middleware.
+func (g *Group) Handle(pattern string, h http.Handler) {
+	g.mux.Handle(pattern, g.stack.Then(h))
+}
+
+// HandleFunc registers f for pattern behind the group's middleware.
+func (g *Group) HandleFunc(pattern string, f func(http.ResponseWriter, *http.Request)) {
+	g.Handle(pattern, http.HandlerFunc(f))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recorder returns middleware that note when the request reaches them and
+// when the response comes back through them.
+func recorder(log *[]string) func(name string) Middleware {
+	return func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				*log = append(*log, name+">")
+				next.ServeHTTP(w, r)
+				*log = append(*log, "<"+name)
+			})
+		}
+	}
+}
+
+func TestStackOrder(t *testing.T) {
+	var log []string
+	mw := recorder(&log)
+	tests := []struct {
+		name  string
+		stack Stack
+		want  string
+	}{
+		{"empty", Chain(), "h"},
+		{"one", Chain(mw("a")), "a> h <a"},
+		{"first is outermost", Chain(mw("a"), mw("b"), mw("c")), "a> b> c> h <c <b <a"},
+		{"Use adds inside", Chain(mw("a")).Use(mw("b")).Use(mw("c")), "a> b> c> h <c <b <a"},
+		{"Use on an empty stack", Stack(nil).Use(mw("a"), mw("b")), "a> b> h <b <a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log = nil
+			h := tt.stack.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log = append(log, "h")
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			if got := strings.Join(log, " "); got != tt.want {
+				t.Errorf("ran %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStackUseCopies builds two stacks on one base with room to spare: the
+// second must not overwrite the first.
+func TestStackUseCopies(t *testing.T) {
+	var log []string
+	mw := recorder(&log)
+	base := append(make(Stack, 0, 8), mw("base"))
+	api := base.Use(mw("api"))
+	static := base.Use(mw("static"))
+
+	for _, tt := range []struct {
+		stack Stack
+		want  string
+	}{
+		{base, "base> h <base"},
+		{api, "base> api> h <api <base"},
+		{static, "base> static> h <static <base"},
+	} {
+		log = nil
+		tt.stack.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log = append(log, "h")
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := strings.Join(log, " "); got != tt.want {
+			t.Errorf("ran %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var log []string
+	mw := recorder(&log)
+	mux := http.NewServeMux()
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { log = append(log, name) }
+	}
+	api := Chain(mw("cors"), mw("auth")).Group(mux)
+	api.HandleFunc("/api/", handler("api"))
+	static := Chain(mw("cache")).Group(mux)
+	static.Handle("/", handler("static"))
+	mux.HandleFunc("/healthz", handler("health"))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/sendMessage", "cors> auth> api <auth <cors"},
+		{"/app.js", "cache> static <cache"},
+		{"/healthz", "health"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			log = nil
+			Chain(mw("outer")).Then(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := strings.Join(log, " "); got != "outer> "+tt.want+" <outer" {
+				t.Errorf("ran %s, want the group's middleware around %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+const (
+	// defaultChatHistoryCount is how many messages /api/chatHistory returns
+	// without count.
+	defaultChatHistoryCount = 50
+	// maxChatHistoryCount keeps a single request from asking GREEN-API for
+	// the whole chat.
+	maxChatHistoryCount = 500
+)
+
+// chatMessage is a message of /api/chatHistory, the same for every message
+// type. Types it does not know are passed through in Raw.
+type chatMessage struct {
+	ID          string          `json:"id"`
+	Direction   string          `json:"direction"`
+	Timestamp   string          `json:"timestamp"`
+	Type        string          `json:"type"`
+	Text        string          `json:"text,omitempty"`
+	DownloadURL string          `json:"downloadUrl,omitempty"`
+	Caption     string          `json:"caption,omitempty"`
+	FileName    string          `json:"fileName,omitempty"`
+	Raw         json.RawMessage `json:"raw,omitempty"`
+}
+
+func newChatMessage(m *greenapi.HistoryMessage) chatMessage {
+	msg := chatMessage{
+		ID:        m.IDMessage,
+		Direction: m.Type,
+		Timestamp: time.Unix(m.Timestamp, 0).UTC().Format(time.RFC3339),
+		Type:      m.TypeMessage,
+	}
+	switch m.TypeMessage {
+	case "textMessage":
+		msg.Text = m.TextMessage
+	case "extendedTextMessage", "quotedMessage":
+		msg.Text = m.TextMessage
+		if msg.Text == "" && m.ExtendedTextMessage != nil {
+			msg.Text = m.ExtendedTextMessage.Text
+		}
+	case "imageMessage", "videoMessage", "documentMessage", "audioMessage", "stickerMessage":
+		msg.DownloadURL = m.DownloadURL
+		msg.Caption = m.Caption
+		msg.FileName = m.FileName
+	default:
+		msg.Raw = m.Raw
+	}
+	return msg
+}
+
+// ChatHistory returns the latest messages of the chat in the chatId query
+// parameter, newest first. count defaults to 50 and may be up to 500.
+func (g *greenAPI) ChatHistory(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	var v validation
+	chatID, err := normalizeChatID(query.Get("chatId"), "")
+	v.check("chatId", err)
+	count := defaultChatHistoryCount
+	if raw := query.Get("count"); raw != "" {
+		count, err = strconv.Atoi(raw)
+		if err != nil || count < 1 || count > maxChatHistoryCount {
+			v.add("count", "range", fmt.Sprintf("must be a whole number from 1 to %d", maxChatHistoryCount))
+		}
+	}
+	if len(v.errs) > 0 {
+		return validationError(v.errs)
+	}
+
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	history, err := c.GetChatHistory(ctx, greenapi.GetChatHistoryRequest{ChatID: chatID, Count: count})
+	if err != nil {
+		return g.upstreamError(r, "getChatHistory", err)
+	}
+	messages := make([]chatMessage, 0, len(history))
+	for i := range history {
+		messages = append(messages, newChatMessage(&history[i]))
+	}
+	writeJSON(w, http.StatusOK, messages)
+	return nil
+}
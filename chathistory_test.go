@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChatHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    chatMessage
+	}{
+		{
+			"text",
+			`{"type":"incoming","idMessage":"BAE1","timestamp":1700000000,"typeMessage":"textMessage","chatId":"79001234567@c.us","textMessage":"hello"}`,
+			chatMessage{ID: "BAE1", Direction: "incoming", Timestamp: "2023-11-14T22:13:20Z", Type: "textMessage", Text: "hello"},
+		},
+		{
+			"extended text",
+			`{"type":"outgoing","idMessage":"BAE2","timestamp":1700000060,"typeMessage":"extendedTextMessage","extendedTextMessage":{"text":"see https://example.com"}}`,
+			chatMessage{ID: "BAE2", Direction: "outgoing", Timestamp: "2023-11-14T22:14:20Z", Type: "extendedTextMessage", Text: "see https://example.com"},
+		},
+		{
+			"image",
+			`{"type":"incoming","idMessage":"BAE3","timestamp":1700000120,"typeMessage":"imageMessage","downloadUrl":"https://media.example.com/a.jpg","caption":"a cat","fileName":"a.jpg"}`,
+			chatMessage{ID: "BAE3", Direction: "incoming", Timestamp: "2023-11-14T22:15:20Z", Type: "imageMessage",
+				DownloadURL: "https://media.example.com/a.jpg", Caption: "a cat", FileName: "a.jpg"},
+		},
+		{
+			"unknown type",
+			`{"type":"incoming","idMessage":"BAE4","timestamp":1700000180,"typeMessage":"pollMessage","pollMessageData":{"name":"lunch?"}}`,
+			chatMessage{ID: "BAE4", Direction: "incoming", Timestamp: "2023-11-14T22:16:20Z", Type: "pollMessage",
+				Raw: json.RawMessage(`{"type":"incoming","idMessage":"BAE4","timestamp":1700000180,"typeMessage":"pollMessage","pollMessageData":{"name":"lunch?"}}`)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request string
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/getChatHistory/secret") {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				body, _ := io.ReadAll(r.Body)
+				request = string(body)
+				io.WriteString(w, "["+tt.message+"]")
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, _ := callAPI(t, s, http.MethodGet, "/api/chatHistory?chatId=79001234567", "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if request != `{"chatId":"79001234567@c.us","count":50}` {
+				t.Errorf("upstream got %s", request)
+			}
+			var got []chatMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := json.Marshal([]chatMessage{tt.want})
+			if have, _ := json.Marshal(got); string(have) != string(want) {
+				t.Errorf("got %s\nwant %s", have, want)
+			}
+		})
+	}
+}
+
+func TestChatHistoryEmpty(t *testing.T) {
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[]")
+	})
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+	rec, _ := callAPI(t, s, http.MethodGet, "/api/chatHistory?chatId=79001234567@c.us&count=500", "", nil)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("got %d %q, want an empty array", rec.Code, rec.Body)
+	}
+}
+
+func TestChatHistoryErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		upstream     int
+		wantStatus   int
+		wantCode     string
+		wantProblems string
+	}{
+		{"no chat", "", http.StatusOK, http.StatusBadRequest, errCodeValidation, "chatId:required"},
+		{"invalid chat", "chatId=abc", http.StatusOK, http.StatusBadRequest, errCodeValidation, "chatId:phone_numeric"},
+		{"count zero", "chatId=79001234567&count=0", http.StatusOK, http.StatusBadRequest, errCodeValidation, "count:range"},
+		{"count too large", "chatId=79001234567&count=501", http.StatusOK, http.StatusBadRequest, errCodeValidation, "count:range"},
+		{"count not a number", "chatId=79001234567&count=ten", http.StatusOK, http.StatusBadRequest, errCodeValidation, "count:range"},
+		{"both invalid", "chatId=abc&count=-1", http.StatusOK, http.StatusBadRequest, errCodeValidation, "chatId:phone_numeric count:range"},
+		{"wrong token", "chatId=79001234567", http.StatusUnauthorized, http.StatusUnauthorized, errCodeUpstreamUnauthorized, ""},
+		{"upstream failure", "chatId=79001234567", http.StatusInternalServerError, http.StatusBadGateway, errCodeUpstreamError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.upstream)
+				io.WriteString(w, "[]")
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, envelope := callAPI(t, s, http.MethodGet, "/api/chatHistory?"+tt.query, "", nil)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+				t.Fatalf("got %d %s, want %d %s: %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode, rec.Body)
+			}
+			if tt.wantProblems != "" {
+				var details struct{ Fields []fieldError }
+				json.Unmarshal(envelope.Error.Details, &details)
+				if got := problems(details.Fields); got != tt.wantProblems {
+					t.Errorf("problems = %s, want %s", got, tt.wantProblems)
+				}
+				if calls.Load() != 0 {
+					t.Error("an invalid request reached GREEN-API")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type checkWhatsappRequest struct {
+	Phone string `json:"phone"`
+
+	// digits is Phone normalized by validate, and number the same as an
+	// integer.
+	digits string
+	number int64
+}
+
+func (req *checkWhatsappRequest) validate(_ context.Context, v *validation) {
+	if !v.required("phone", req.Phone) {
+		return
+	}
+	chatID, err := normalizeChatID("", req.Phone)
+	if err == nil && strings.HasSuffix(chatID, "@g.us") {
+		err = newRuleError("phone_numeric", "invalid phone number %q", req.Phone)
+	}
+	if err != nil {
+		v.check("phone", err)
+		return
+	}
+	// normalizeChatID leaves 10 to 15 digits, which always fit.
+	req.digits = strings.TrimSuffix(chatID, "@c.us")
+	req.number, _ = strconv.ParseInt(req.digits, 10, 64)
+}
+
+// CheckWhatsapp reports whether a phone number has a WhatsApp account.
+// Results are kept for CHECK_WHATSAPP_CACHE_TTL per instance and number, as
+// checkWhatsapp is slow and the answer rarely changes.
+func (g *greenAPI) CheckWhatsapp(w http.ResponseWriter, r *http.Request) error {
+	var req checkWhatsappRequest
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	idInstance, apiToken, _ := g.credentials(r)
+	key := newAPICacheKey("checkWhatsapp", idInstance, apiToken)
+	key.arg = req.digits
+	result, err := g.cachedFetch(w, r, g.whatsappCache, key, func(ctx context.Context) (any, error) {
+		return c.CheckWhatsapp(ctx, req.number)
+	})
+	if err != nil {
+		return g.upstreamError(r, "checkWhatsapp", err)
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
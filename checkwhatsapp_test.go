@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// whatsappUpstream answers checkWhatsapp for numbers ending in an even
+// digit with true and records the numbers it was asked about.
+func whatsappUpstream(t *testing.T, status int) (*[]string, func(w http.ResponseWriter, r *http.Request)) {
+	var mu sync.Mutex
+	var asked []string
+	return &asked, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/checkWhatsapp/secret") {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		var req struct {
+			PhoneNumber json.Number `json:"phoneNumber"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		asked = append(asked, req.PhoneNumber.String())
+		mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			io.WriteString(w, `{"message":"failed"}`)
+			return
+		}
+		digits := req.PhoneNumber.String()
+		fmt.Fprintf(w, `{"existsWhatsapp":%t}`, (digits[len(digits)-1]-'0')%2 == 0)
+	}
+}
+
+func TestCheckWhatsapp(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		pause     time.Duration
+		phones    []string
+		want      []bool
+		wantAsked string
+	}{
+		{"answer", time.Hour, 0, []string{"79001234568"}, []bool{true}, "79001234568"},
+		{"not registered", time.Hour, 0, []string{"79001234567"}, []bool{false}, "79001234567"},
+		{"cache hit", time.Hour, 0, []string{"79001234568", "79001234568"}, []bool{true, true}, "79001234568"},
+		{"normalized before the cache", time.Hour, 0,
+			[]string{"+7 (900) 123-45-68", "89001234568", "79001234568@c.us"}, []bool{true, true, true}, "79001234568"},
+		{"numbers cached apart", time.Hour, 0,
+			[]string{"79001234568", "79001234567", "79001234568"}, []bool{true, false, true}, "79001234568 79001234567"},
+		{"cache disabled", 0, 0, []string{"79001234568", "79001234568"}, []bool{true, true}, "79001234568 79001234568"},
+		{"entry expired", 20 * time.Millisecond, 50 * time.Millisecond,
+			[]string{"79001234568", "79001234568"}, []bool{true, true}, "79001234568 79001234568"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked, handler := whatsappUpstream(t, http.StatusOK)
+			upstream := fakeGreenAPI(t, handler)
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.CheckWhatsappCacheTTL = tt.ttl
+			}))
+
+			for i, phone := range tt.phones {
+				if i > 0 {
+					time.Sleep(tt.pause)
+				}
+				rec, _ := callAPI(t, s, http.MethodPost, "/api/checkWhatsapp", fmt.Sprintf(`{"phone":%q}`, phone), nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status = %d: %s", phone, rec.Code, rec.Body)
+				}
+				if want := fmt.Sprintf(`{"existsWhatsapp":%t}`, tt.want[i]); strings.TrimSpace(rec.Body.String()) != want {
+					t.Errorf("%s: body = %s, want %s", phone, rec.Body, want)
+				}
+			}
+			if got := strings.Join(*asked, " "); got != tt.wantAsked {
+				t.Errorf("GREEN-API was asked about %q, want %q", got, tt.wantAsked)
+			}
+		})
+	}
+}
+
+func TestCheckWhatsappErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		upstream     int
+		wantStatus   int
+		wantCode     string
+		wantProblems string
+	}{
+		{"no phone", `{}`, http.StatusOK, http.StatusBadRequest, errCodeValidation, "phone:required"},
+		{"letters", `{"phone":"call me"}`, http.StatusOK, http.StatusBadRequest, errCodeValidation, "phone:phone_numeric"},
+		{"too short", `{"phone":"12345"}`, http.StatusOK, http.StatusBadRequest, errCodeValidation, "phone:phone_length"},
+		{"group chat", `{"phone":"120363043968066561@g.us"}`, http.StatusOK, http.StatusBadRequest, errCodeValidation, "phone:phone_numeric"},
+		{"not JSON", `phone=79001234567`, http.StatusOK, http.StatusBadRequest, errCodeInvalidBody, ""},
+		{"wrong token", `{"phone":"79001234567"}`, http.StatusUnauthorized, http.StatusUnauthorized, errCodeUpstreamUnauthorized, ""},
+		{"upstream failure", `{"phone":"79001234567"}`, http.StatusInternalServerError, http.StatusBadGateway, errCodeUpstreamError, ""},
+		{"upstream throttles", `{"phone":"79001234567"}`, http.StatusTooManyRequests, http.StatusTooManyRequests, errCodeUpstreamRateLimited, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked, handler := whatsappUpstream(t, tt.upstream)
+			upstream := fakeGreenAPI(t, handler)
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			// A failure is not cached: the second attempt asks again.
+			for range 2 {
+				rec, envelope := callAPI(t, s, http.MethodPost, "/api/checkWhatsapp", tt.body, nil)
+				if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+					t.Fatalf("got %d %s, want %d %s: %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode, rec.Body)
+				}
+				if tt.wantProblems != "" {
+					var details struct{ Fields []fieldError }
+					json.Unmarshal(envelope.Error.Details, &details)
+					if got := problems(details.Fields); got != tt.wantProblems {
+						t.Errorf("problems = %s, want %s", got, tt.wantProblems)
+					}
+				}
+			}
+			wantAsked := 0
+			if tt.wantStatus != http.StatusBadRequest {
+				wantAsked = 2
+			}
+			if len(*asked) != wantAsked {
+				t.Errorf("GREEN-API was asked %d times, want %d", len(*asked), wantAsked)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// Compress gzips responses for clients that accept it. The decision is made
+// lazily: the body is buffered until minSize bytes have been written (or the
+// handler returns), so small responses and incompressible content types are
+// passed through untouched, as are those marked Cache-Control: no-transform.
+// Compressible responses carry Vary: Accept-Encoding for every client so
+// shared caches keep both representations apart.
+func Compress(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{
+			ResponseWriter: w,
+			minSize:        minSize,
+			accepted:       r.Method != http.MethodHead && acceptsEncoding(r, "gzip"),
+		}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	minSize  int
+	accepted bool
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+	// closed is set by closeResponse, as on responseWriter.
+	closed bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < 200 && cw.status == 0 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status != 0 || cw.decided {
+		reportResponseConflict(cw, "Superfluous WriteHeader call",
+			slog.Int("status", status),
+			slog.Int("sent_status", cw.status),
+		)
+		return
+	}
+	cw.status = status
+
+	if cl := cw.Header().Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		cw.decide(err == nil && n >= cw.minSize)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.closed {
+		reportResponseConflict(cw, "Write after the response was complete", slog.Int("bytes", len(b)))
+		return 0, errResponseClosed
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// ReadFrom hands the copy to the underlying writer once the response is known
+// to go out uncompressed, so large static files still use sendfile.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.closed {
+		reportResponseConflict(cw, "Write after the response was complete")
+		return 0, errResponseClosed
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok && cw.decided && cw.gz == nil {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{cw}, src)
+}
+
+// Flush sends what has been buffered so far, deciding on compression early
+// since streaming responses cannot wait for minSize bytes.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Committed reports whether the handler has set the status, which the
+// buffered response is then sent with.
+func (cw *compressWriter) Committed() bool {
+	return cw.status != 0
+}
+
+func (cw *compressWriter) close() {
+	cw.closed = true
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide commits the headers and flushes anything buffered so far. large
+// reports whether the body is big enough to be worth compressing.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	h := cw.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	eligible := h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		cw.status != http.StatusNoContent &&
+		cw.status != http.StatusNotModified &&
+		cw.status != http.StatusPartialContent &&
+		!noTransform(h) &&
+		compressible(h.Get("Content-Type"))
+
+	if eligible {
+		addVary(h, "Accept-Encoding")
+	}
+
+	if eligible && large && cw.accepted {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.gz != nil {
+		_, err := cw.gz.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.status == 0 {
+		return nil
+	}
+	if !cw.decided {
+		if err := cw.decide(len(cw.buf) >= cw.minSize); err != nil {
+			return err
+		}
+	}
+	if cw.gz == nil {
+		return nil
+	}
+
+	err := cw.gz.Close()
+	cw.gz.Reset(nil)
+	gzipWriters.Put(cw.gz)
+	cw.gz = nil
+	return err
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/javascript", "application/x-javascript", "application/json",
+		"application/xml", "application/wasm", "image/svg+xml", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// noTransform reports whether the Cache-Control of h asks for the body to be
+// sent as it is.
+func noTransform(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
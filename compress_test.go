@@ -0,0 +1,189 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	const minSize = 64
+	large := strings.Repeat("console.log('compress me');\n", 20)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		method         string
+		contentType    string
+		header         http.Header
+		status         int
+		body           string
+		// unsized leaves out Content-Length, so that the body is buffered
+		// up to minSize before the decision.
+		unsized  bool
+		wantGzip bool
+		wantVary bool
+	}{
+		{name: "gzip client", acceptEncoding: "gzip, deflate, br", contentType: "application/javascript", body: large, wantGzip: true, wantVary: true},
+		{name: "plain client", contentType: "application/javascript", body: large, wantVary: true},
+		{name: "gzip refused by q=0", acceptEncoding: "gzip;q=0, br", contentType: "text/css", body: large, wantVary: true},
+		{name: "uppercase coding", acceptEncoding: "GZIP", contentType: "text/html; charset=utf-8", body: large, wantGzip: true, wantVary: true},
+		{name: "below the threshold", acceptEncoding: "gzip", contentType: "text/css", body: "body{}", wantVary: true},
+		{name: "incompressible type", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "already encoded", acceptEncoding: "gzip", contentType: "text/css", header: http.Header{"Content-Encoding": {"br"}}, body: large},
+		{name: "no-transform", acceptEncoding: "gzip", contentType: "text/css", header: http.Header{"Cache-Control": {"private, no-transform"}}, body: large},
+		{name: "partial content", acceptEncoding: "gzip", contentType: "text/css", header: http.Header{"Content-Range": {"bytes 0-9/100"}}, status: http.StatusPartialContent, body: large},
+		{name: "HEAD", acceptEncoding: "gzip", method: http.MethodHead, contentType: "text/css", body: large, wantVary: true},
+		{name: "unsized", acceptEncoding: "gzip", contentType: "text/css", body: large, unsized: true, wantGzip: true, wantVary: true},
+		{name: "unsized below the threshold", acceptEncoding: "gzip", contentType: "text/css", body: "body{}", unsized: true, wantVary: true},
+		{name: "detected type", acceptEncoding: "gzip", body: "<!doctype html>" + large, unsized: true, wantGzip: true, wantVary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(minSize, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if !tt.unsized {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				io.WriteString(w, tt.body)
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/app.js", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip: %t", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			if vary := rec.Header().Get("Vary") == "Accept-Encoding"; vary != tt.wantVary {
+				t.Errorf("Vary = %q, want Accept-Encoding: %t", rec.Header().Get("Vary"), tt.wantVary)
+			}
+			body := rec.Body.String()
+			if gzipped {
+				if cl := rec.Header().Get("Content-Length"); cl != "" {
+					t.Errorf("Content-Length %s kept on a gzipped body", cl)
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				plain, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(plain)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestCompressLogsCompressedBytes(t *testing.T) {
+	body := strings.Repeat("a", 10000)
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	h := RequestLogger(logger, defaultLogRules, Compress(64, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/big.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var entry struct {
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+		t.Fatalf("access log %q: %v", logs, err)
+	}
+	if entry.Bytes != int64(rec.Body.Len()) || entry.Bytes >= int64(len(body)) {
+		t.Errorf("logged %d bytes, sent %d compressed from %d", entry.Bytes, rec.Body.Len(), len(body))
+	}
+}
+
+func TestCompressPoolsWriters(t *testing.T) {
+	h := Compress(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	// A fresh gzip.Writer alone allocates well over a hundred times.
+	if allocs > 60 {
+		t.Errorf("%.0f allocations per request, want the gzip writer reused", allocs)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"br, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"deflate", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsEncoding(req, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q) = %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/javascript", true},
+		{"application/problem+json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/octet-stream", false},
+		{"video/mp4", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := compressible(tt.contentType); got != tt.want {
+			t.Errorf("compressible(%q) = %t, want %t", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of requests served at once. Requests
+// over the limit wait up to timeout for a slot.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	queued atomic.Int64
+	shed   atomic.Int64
+}
+
+func newConcurrencyLimiter(limit int, timeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:   make(chan struct{}, limit),
+		timeout: timeout,
+	}
+}
+
+// acquire reports whether a slot was obtained; the caller must release it.
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	l.shed.Add(1)
+	return false
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// concurrencyExempt paths bypass the limit: an overloaded instance should not
+// be restarted for being busy or disappear from monitoring, and an event
+// stream would hold its slot for as long as it is open.
+var concurrencyExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+	eventsPath: true,
+}
+
+// ConcurrencyLimit sheds requests with 503 once they have waited too long
+// for a slot.
+func ConcurrencyLimit(logger *slog.Logger, limiter *concurrencyLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if concurrencyExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !limiter.acquire(r) {
+			logger.Warn("Request shed, concurrency limit reached",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("limit", cap(limiter.slots)),
+				slog.Int64("queued", limiter.queued.Load()),
+				slog.String("request_id", RequestIDFromContext(r.Context())),
+			)
+			w.Header().Set("Retry-After", "1")
+			renderError(w, r, http.StatusServiceUnavailable, errCodeOverloaded, "server is overloaded, try again later", nil)
+			return
+		}
+		defer limiter.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingHandler signals on entered and then waits for release.
+type blockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{entered: make(chan struct{}, 8), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.entered <- struct{}{}
+	<-h.release
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveAsync serves target in a goroutine and returns the recorder once done
+// is closed.
+func serveAsync(h http.Handler, ctx context.Context, target string) (*httptest.ResponseRecorder, <-chan struct{}) {
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+	}()
+	return rec, done
+}
+
+func TestConcurrencyLimitQueues(t *testing.T) {
+	slow := newBlockingHandler()
+	limiter := newConcurrencyLimiter(1, 5*time.Second)
+	h := ConcurrencyLimit(slog.New(slog.NewJSONHandler(&logBuffer{}, nil)), limiter, slow)
+
+	first, firstDone := serveAsync(h, context.Background(), "/api/getSettings")
+	<-slow.entered
+	second, secondDone := serveAsync(h, context.Background(), "/api/getSettings")
+	for limiter.queued.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-slow.entered:
+		t.Fatal("the second request ran while the slot was held")
+	default:
+	}
+
+	slow.release <- struct{}{}
+	<-firstDone
+	<-slow.entered
+	slow.release <- struct{}{}
+	<-secondDone
+
+	if first.Code != http.StatusNoContent || second.Code != http.StatusNoContent {
+		t.Errorf("got %d and %d, want both served", first.Code, second.Code)
+	}
+	if limiter.shed.Load() != 0 || len(limiter.slots) != 0 {
+		t.Errorf("shed %d, slots held %d; want none", limiter.shed.Load(), len(limiter.slots))
+	}
+}
+
+func TestConcurrencyLimitSheds(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"queue timeout", context.Background()},
+		{"client gone", canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := newBlockingHandler()
+			logs := &logBuffer{}
+			limiter := newConcurrencyLimiter(1, 20*time.Millisecond)
+			h := ConcurrencyLimit(slog.New(slog.NewJSONHandler(logs, nil)), limiter, slow)
+
+			_, firstDone := serveAsync(h, context.Background(), "/api/getSettings")
+			<-slow.entered
+			shed, shedDone := serveAsync(h, tt.ctx, "/api/getSettings")
+			<-shedDone
+
+			if shed.Code != http.StatusServiceUnavailable || shed.Header().Get("Retry-After") != "1" {
+				t.Errorf("got %d with Retry-After %q, want 503 with 1", shed.Code, shed.Header().Get("Retry-After"))
+			}
+			if !strings.Contains(shed.Body.String(), errCodeOverloaded) {
+				t.Errorf("body = %q, want %s", shed.Body, errCodeOverloaded)
+			}
+			if !strings.Contains(logs.String(), `"msg":"Request shed, concurrency limit reached"`) || !strings.Contains(logs.String(), `"limit":1`) {
+				t.Errorf("the rejection is not logged:\n%s", logs)
+			}
+			if limiter.shed.Load() != 1 {
+				t.Errorf("shed = %d, want 1", limiter.shed.Load())
+			}
+
+			// Health checks get through while the slot is held.
+			health, healthDone := serveAsync(h, context.Background(), "/healthz")
+			<-slow.entered
+			close(slow.release)
+			<-firstDone
+			<-healthDone
+			if health.Code != http.StatusNoContent {
+				t.Errorf("/healthz = %d, want it to bypass the limit", health.Code)
+			}
+			if len(limiter.slots) != 0 {
+				t.Errorf("%d slots still held", len(limiter.slots))
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimitReleasesOnPanic(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, time.Millisecond)
+	h := ConcurrencyLimit(slog.New(slog.NewJSONHandler(&logBuffer{}, nil)), limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	func() {
+		defer func() { recover() }()
+		get(h, "/api/getSettings")
+	}()
+	if len(limiter.slots) != 0 {
+		t.Error("a panicking handler kept its slot")
+	}
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// Config is populated from defaults, an optional config file, the
+// environment and command-line flags, in increasing order of precedence. The
+// struct tags drive the loader: yaml is the key in the config file, env the
+// environment variable, flag the command-line flag (derived from the yaml key
+// when omitted) and default the fallback value. secret fields are redacted
+// wherever the configuration is shown.
+type Config struct {
+	Port                 string        `yaml:"port" env:"PORT" default:"8080" usage:"TCP port to listen on"`
+	ListenAddr           string        `yaml:"listen_addr" env:"LISTEN_ADDR" usage:"address to listen on: port, host:port or unix:/path/to.sock; overrides -port"`
+	SocketMode           FileMode      `yaml:"socket_mode" env:"SOCKET_MODE" default:"0660" usage:"permissions of the unix socket file"`
+	PortFile             string        `yaml:"port_file" env:"PORT_FILE" usage:"file the bound address of the main listener is written to, for PORT=0"`
+	StaticDir            string        `yaml:"static_dir" env:"STATIC_DIR" flag:"static" default:"./static" usage:"directory with static files"`
+	EmbedStatic          bool          `yaml:"embed_static" env:"EMBED_STATIC" usage:"serve the frontend compiled into the binary instead of -static"`
+	StaticMounts         StaticMounts  `yaml:"static_mounts" env:"STATIC_MOUNTS" usage:"additional directories served under URL prefixes as prefix=dir pairs, e.g. /assets=./assets,/docs=./docs"`
+	ReadTimeout          time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT" default:"10s" validate:"positive" usage:"maximum duration for reading the entire request"`
+	WriteTimeout         time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" default:"10s" validate:"positive" usage:"maximum duration before timing out writes of the response"`
+	ReadHeaderTimeout    time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" default:"5s" validate:"positive" usage:"maximum duration for reading request headers, against slowloris clients"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" default:"120s" validate:"positive" usage:"how long a keep-alive connection may stay idle before it is closed"`
+	MaxConnections       int           `yaml:"max_connections" env:"MAX_CONNECTIONS" usage:"connections the main listener keeps open at once, further ones wait to be accepted; 0 means unlimited"`
+	MaxHeaderBytes       ByteSize      `yaml:"max_header_bytes" env:"MAX_HEADER_BYTES" default:"1MB" validate:"positive" usage:"maximum size of request headers, e.g. 64KB or 1MB"`
+	RequestTimeout       time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT" default:"0s" usage:"time a handler has to start its response before 503 is answered instead; 0 disables it, keep it below -write-timeout"`
+	RequestTimeoutRoutes RouteTimeouts `yaml:"request_timeout_routes" env:"REQUEST_TIMEOUT_ROUTES" usage:"per-prefix timeouts overriding -request-timeout, e.g. /upload/=2m,/api/=5s; 0 disables it for the prefix"`
+	ShutdownTimeout      time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"5s" validate:"positive" usage:"time to wait for in-flight requests to finish on shutdown"`
+	ShutdownDelay        time.Duration `yaml:"shutdown_delay" env:"SHUTDOWN_DELAY" default:"0s" usage:"time to keep serving with /readyz failing before shutdown starts, so load balancers stop routing here"`
+	RetryBindFor         time.Duration `yaml:"retry_bind_for" env:"RETRY_BIND_FOR" default:"0s" usage:"how long to keep trying a port that is in use, e.g. while the previous instance drains; 0 fails at once"`
+	TLSCertFile          string        `yaml:"tls_cert_file" env:"TLS_CERT_FILE" usage:"PEM certificate file; enables HTTPS together with -tls-key-file"`
+	TLSKeyFile           string        `yaml:"tls_key_file" env:"TLS_KEY_FILE" usage:"PEM private key file; enables HTTPS together with -tls-cert-file"`
+	HTTPSPort            string        `yaml:"https_port" env:"HTTPS_PORT" usage:"port of the HTTPS listener; when empty -port is used"`
+	HTTPPort             string        `yaml:"http_port" env:"HTTP_PORT" usage:"port of a plain HTTP listener next to HTTPS for health checks, ACME challenges and redirects"`
+	RedirectHTTP         bool          `yaml:"redirect_http" env:"REDIRECT_HTTP" usage:"redirect plain HTTP to HTTPS from -http-port, port 80 when it is empty"`
+
+	ContentTypeOptions      string `yaml:"x_content_type_options" env:"X_CONTENT_TYPE_OPTIONS" default:"nosniff" usage:"X-Content-Type-Options header, off disables it"`
+	FrameOptions            string `yaml:"x_frame_options" env:"X_FRAME_OPTIONS" default:"DENY" usage:"X-Frame-Options header, off disables it"`
+	ReferrerPolicy          string `yaml:"referrer_policy" env:"REFERRER_POLICY" default:"strict-origin-when-cross-origin" usage:"Referrer-Policy header, off disables it"`
+	ContentSecurityPolicy   string `yaml:"content_security_policy" env:"CONTENT_SECURITY_POLICY" usage:"Content-Security-Policy header, not sent when empty"`
+	StrictTransportSecurity string `yaml:"strict_transport_security" env:"STRICT_TRANSPORT_SECURITY" default:"max-age=63072000; includeSubDomains" usage:"Strict-Transport-Security header for HTTPS requests, off disables it"`
+
+	CORSAllowedOrigins   []string      `yaml:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS" usage:"origins allowed to make cross-origin requests, e.g. https://app.example.com,https://*.example.com; empty disables CORS"`
+	CORSAllowedMethods   []string      `yaml:"cors_allowed_methods" env:"CORS_ALLOWED_METHODS" default:"GET,HEAD,POST,PUT,PATCH,DELETE" usage:"methods allowed in cross-origin requests"`
+	CORSAllowedHeaders   []string      `yaml:"cors_allowed_headers" env:"CORS_ALLOWED_HEADERS" default:"Content-Type,Authorization,X-Request-ID" usage:"request headers allowed in cross-origin requests"`
+	CORSMaxAge           time.Duration `yaml:"cors_max_age" env:"CORS_MAX_AGE" default:"10m" usage:"how long browsers may cache a preflight response"`
+	CORSAllowCredentials bool          `yaml:"cors_allow_credentials" env:"CORS_ALLOW_CREDENTIALS" usage:"allow cookies and HTTP auth in cross-origin requests"`
+
+	CSRFMode        string   `yaml:"csrf_mode" env:"CSRF_MODE" default:"origin" usage:"CSRF protection of unsafe requests under CSRF_PATHS: origin (same-origin check), token (plus a double-submit token from /api/csrf) or off"`
+	CSRFPaths       []string `yaml:"csrf_paths" env:"CSRF_PATHS" default:"/api/" usage:"path prefixes (or =exact paths) protected against CSRF"`
+	CSRFExemptPaths []string `yaml:"csrf_exempt_paths" env:"CSRF_EXEMPT_PATHS" default:"/webhook" usage:"path prefixes (or =exact paths) never checked for CSRF, such as server-to-server callbacks"`
+
+	SessionKey string        `yaml:"session_key" env:"SESSION_KEY" secret:"true" usage:"32-byte key, hex or base64, encrypting the credentials cookie of /api/session; empty disables sessions"`
+	SessionTTL time.Duration `yaml:"session_ttl" env:"SESSION_TTL" default:"24h" validate:"positive" usage:"how long a session from /api/session lasts"`
+
+	BasicAuthUsers    BasicAuthUsers `yaml:"basic_auth_users" env:"BASIC_AUTH_USERS" secret:"true" usage:"user:bcrypt-hash pairs allowed through basic auth; empty disables it"`
+	BasicAuthPrefixes []string       `yaml:"basic_auth_prefixes" env:"BASIC_AUTH_PREFIXES" default:"/" usage:"path prefixes protected by basic auth"`
+	BasicAuthExclude  []string       `yaml:"basic_auth_exclude" env:"BASIC_AUTH_EXCLUDE" default:"/healthz,/readyz,/metrics" usage:"path prefixes left open even when under a protected prefix"`
+	BasicAuthRealm    string         `yaml:"basic_auth_realm" env:"BASIC_AUTH_REALM" default:"Restricted" usage:"realm sent in the WWW-Authenticate challenge"`
+
+	TrustedProxies   IPNets   `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" usage:"proxy IPs or CIDRs whose X-Forwarded-For and X-Real-IP headers are trusted"`
+	IPAllow          IPNets   `yaml:"ip_allow" env:"IP_ALLOW" usage:"client IPs or CIDRs allowed on -ip-filter-prefixes; empty allows everyone not denied"`
+	IPDeny           IPNets   `yaml:"ip_deny" env:"IP_DENY" usage:"client IPs or CIDRs rejected with 403; deny wins over allow"`
+	IPFilterPrefixes []string `yaml:"ip_filter_prefixes" env:"IP_FILTER_PREFIXES" default:"/" usage:"path prefixes the IP allow and deny lists apply to"`
+
+	AllowedHosts     []string `yaml:"allowed_hosts" env:"ALLOWED_HOSTS" usage:"host names requests may be addressed to, e.g. example.com,*.example.com; empty allows any"`
+	HostRejectStatus int      `yaml:"host_reject_status" env:"HOST_REJECT_STATUS" default:"421" usage:"status answered to a Host outside -allowed-hosts: 421 or 400"`
+
+	RateLimitRPS    float64  `yaml:"rate_limit_rps" env:"RATE_LIMIT_RPS" usage:"requests per second allowed per client IP; 0 disables rate limiting"`
+	RateLimitBurst  int      `yaml:"rate_limit_burst" env:"RATE_LIMIT_BURST" default:"20" validate:"positive" usage:"requests a client may make in a burst above the rate"`
+	RateLimitExempt []string `yaml:"rate_limit_exempt" env:"RATE_LIMIT_EXEMPT" default:"/healthz,/readyz,/metrics" usage:"path prefixes not subject to rate limiting"`
+
+	MaxConcurrentRequests int           `yaml:"max_concurrent_requests" env:"MAX_CONCURRENT_REQUESTS" usage:"requests served at once before new ones are queued; 0 means unlimited"`
+	QueueTimeout          time.Duration `yaml:"queue_timeout" env:"QUEUE_TIMEOUT" default:"1s" validate:"positive" usage:"how long a request waits for a free slot before 503"`
+
+	MaxBodyBytes  ByteSize   `yaml:"max_body_bytes" env:"MAX_BODY_BYTES" default:"1MB" usage:"largest request body accepted, 0 means unlimited"`
+	MaxBodyRoutes BodyLimits `yaml:"max_body_routes" env:"MAX_BODY_ROUTES" usage:"per-prefix body limits overriding -max-body-bytes, e.g. /upload/=100MB,/api/=64KB"`
+
+	AccessLogFormat     string   `yaml:"access_log_format" env:"ACCESS_LOG_FORMAT" default:"json" usage:"access log format: json, common or combined"`
+	AccessLogFile       string   `yaml:"access_log_file" env:"ACCESS_LOG_FILE" usage:"destination of the access log: a file, stdout or stderr; with json, empty keeps it in the application log, otherwise empty means stdout"`
+	AccessLogMaxSize    ByteSize `yaml:"access_log_max_size" env:"ACCESS_LOG_MAX_SIZE" default:"0" usage:"size at which the access log file is rotated, 0 disables rotation"`
+	AccessLogMaxAgeDays int      `yaml:"access_log_max_age_days" env:"ACCESS_LOG_MAX_AGE_DAYS" default:"30" usage:"days rotated access log files are kept, 0 keeps them forever"`
+	AccessLogMaxBackups int      `yaml:"access_log_max_backups" env:"ACCESS_LOG_MAX_BACKUPS" default:"5" usage:"number of rotated access log files kept, 0 keeps all"`
+	AccessLogCompress   bool     `yaml:"access_log_compress" env:"ACCESS_LOG_COMPRESS" usage:"gzip rotated access log files"`
+	AccessLogMode       string   `yaml:"access_log_mode" env:"ACCESS_LOG_MODE" default:"all" usage:"requests written to the access log: all, errors (4xx, 5xx, slow and interrupted requests) or none"`
+
+	LogLevel             slog.Level     `yaml:"log_level" env:"LOG_LEVEL" default:"info" usage:"minimum log level: debug, info, warn or error"`
+	LogFormat            string         `yaml:"log_format" env:"LOG_FORMAT" usage:"log output format: json, text or dev; text on a terminal and json otherwise when empty"`
+	LogFile              string         `yaml:"log_file" env:"LOG_FILE" usage:"file the log is written to instead of stdout; reopened on SIGHUP"`
+	LogMaxSize           ByteSize       `yaml:"log_max_size" env:"LOG_MAX_SIZE" default:"100MB" usage:"size at which the log file is rotated, 0 disables rotation"`
+	LogMaxAgeDays        int            `yaml:"log_max_age_days" env:"LOG_MAX_AGE_DAYS" default:"30" usage:"days rotated log files are kept, 0 keeps them forever"`
+	LogMaxBackups        int            `yaml:"log_max_backups" env:"LOG_MAX_BACKUPS" default:"5" usage:"number of rotated log files kept, 0 keeps all"`
+	LogCompress          bool           `yaml:"log_compress" env:"LOG_COMPRESS" usage:"gzip rotated log files"`
+	TracesExporter       string         `yaml:"traces_exporter" env:"OTEL_TRACES_EXPORTER" default:"none" usage:"trace exporter: none or otlp; the OTLP endpoint and sampler come from the standard OTEL_* variables"`
+	SlowRequestThreshold time.Duration  `yaml:"slow_request_threshold" env:"SLOW_REQUEST_THRESHOLD" usage:"requests taking longer are logged at warn level with slow=true; 0 disables"`
+	LogSkipPaths         []string       `yaml:"log_skip_paths" env:"LOG_SKIP_PATHS" usage:"path prefixes (or =exact paths) left out of the access log"`
+	LogDebugPaths        []string       `yaml:"log_debug_paths" env:"LOG_DEBUG_PATHS" default:"=/healthz,=/readyz" usage:"path prefixes (or =exact paths) logged at debug level"`
+	LogAlwaysErrors      bool           `yaml:"log_always_errors" env:"LOG_ALWAYS_ERRORS" default:"true" usage:"log error responses even on skipped and debug paths"`
+	LogSampleRules       LogSampleRules `yaml:"log_sample_rules" env:"LOG_SAMPLE_RULES" usage:"log one in N successful requests per path prefix, e.g. /assets/=100,/=10"`
+	LogRedactParams      []string       `yaml:"log_redact_params" env:"LOG_REDACT_PARAMS" default:"token,apiTokenInstance,password,authorization" usage:"query parameters whose values are redacted in the access log"`
+
+	GreenAPIURL              string        `yaml:"greenapi_url" env:"GREENAPI_URL" default:"https://api.green-api.com" usage:"GREEN-API base URL"`
+	GreenAPIMediaURL         string        `yaml:"greenapi_media_url" env:"GREENAPI_MEDIA_URL" default:"https://media.green-api.com" usage:"GREEN-API base URL for file uploads"`
+	GreenAPIIDInstance       string        `yaml:"greenapi_id_instance" env:"GREENAPI_ID_INSTANCE" usage:"idInstance used when a request does not supply X-Id-Instance"`
+	GreenAPIToken            string        `yaml:"greenapi_api_token" env:"GREENAPI_API_TOKEN" secret:"true" usage:"apiTokenInstance used when a request does not supply X-Api-Token"`
+	GreenAPITimeout          time.Duration `yaml:"greenapi_timeout" env:"GREENAPI_TIMEOUT" default:"10s" validate:"positive" usage:"timeout for a single attempt of a GREEN-API call"`
+	UpstreamTimeout          time.Duration `yaml:"upstream_timeout" env:"UPSTREAM_TIMEOUT" default:"30s" validate:"positive" usage:"overall timeout for a GREEN-API call, retries included"`
+	GreenAPIUploadTimeout    time.Duration `yaml:"greenapi_upload_timeout" env:"GREENAPI_UPLOAD_TIMEOUT" default:"5m" validate:"positive" usage:"overall timeout for uploading a file to GREEN-API"`
+	GreenAPIUploadMaxBytes   ByteSize      `yaml:"greenapi_upload_max_bytes" env:"GREENAPI_UPLOAD_MAX_BYTES" default:"100MB" validate:"positive" usage:"largest request body accepted by /api/sendFileByUpload"`
+	GreenAPIRetryAttempts    int           `yaml:"greenapi_retry_attempts" env:"GREENAPI_RETRY_ATTEMPTS" default:"3" validate:"positive" usage:"attempts per GREEN-API call, including the first"`
+	GreenAPIRetryDelay       time.Duration `yaml:"greenapi_retry_delay" env:"GREENAPI_RETRY_DELAY" default:"200ms" validate:"positive" usage:"delay before the first retry, doubled with jitter for each further one"`
+	GreenAPIRetryMaxDelay    time.Duration `yaml:"greenapi_retry_max_delay" env:"GREENAPI_RETRY_MAX_DELAY" default:"5s" validate:"positive" usage:"upper bound for a retry delay, including Retry-After"`
+	GreenAPIBreakerThreshold int           `yaml:"greenapi_breaker_threshold" env:"GREENAPI_BREAKER_THRESHOLD" default:"5" usage:"consecutive failed GREEN-API calls that open the circuit breaker; 0 disables it"`
+	GreenAPIBreakerCooldown  time.Duration `yaml:"greenapi_breaker_cooldown" env:"GREENAPI_BREAKER_COOLDOWN" default:"30s" validate:"positive" usage:"how long an open circuit breaker rejects calls before letting a probe through"`
+	GreenAPIStateTTL         time.Duration `yaml:"greenapi_state_ttl" env:"GREENAPI_STATE_TTL" default:"30s" validate:"positive" usage:"how long the last getStateInstance result blocks sending while the instance is not authorized"`
+	GreenAPICacheTTL         time.Duration `yaml:"greenapi_cache_ttl" env:"GREENAPI_CACHE_TTL" default:"5s" usage:"how long getSettings and getStateInstance results are cached; 0 disables the cache"`
+	CheckWhatsappCacheTTL    time.Duration `yaml:"check_whatsapp_cache_ttl" env:"CHECK_WHATSAPP_CACHE_TTL" default:"1h" usage:"how long checkWhatsapp results are cached per number; 0 disables the cache"`
+	GreenAPIProxyMethods     []string      `yaml:"greenapi_proxy_methods" env:"GREENAPI_PROXY_METHODS" default:"getSettings,getStateInstance,getWaSettings,checkWhatsapp,getAvatar,getContacts,getContactInfo,getChatHistory,getMessage,lastIncomingMessages,lastOutgoingMessages,showMessagesQueue,sendMessage,sendFileByUrl,sendLocation,sendContact,sendPoll,forwardMessages,readChat" usage:"GREEN-API methods allowed through /api/proxy/; empty disables the proxy"`
+	GreenAPILimits           MethodLimits  `yaml:"greenapi_limits" env:"GREENAPI_LIMITS" default:"sendMessage=20/1m/3s,sendFileByUrl=10/1m/3s,sendFileByUpload=10/1m/3s,sendLocation=10/1m/3s,sendContact=10/1m/3s,sendPoll=10/1m/3s,forwardMessages=10/1m/3s,*=300/1m" usage:"outbound budgets of GREEN-API methods per instance as method=calls/period[/interval]; * covers the other methods, 0 calls leaves a method unlimited"`
+	GreenAPILimitMaxWait     time.Duration `yaml:"greenapi_limit_max_wait" env:"GREENAPI_LIMIT_MAX_WAIT" default:"5s" usage:"longest a GREEN-API call waits for its outbound budget; calls that would wait longer get 429"`
+	GreenAPILogBodyBytes     ByteSize      `yaml:"greenapi_log_body_bytes" env:"GREENAPI_LOG_BODY_BYTES" default:"1KB" usage:"how much of GREEN-API request and response bodies is logged at debug level; 0 logs them whole"`
+	IdempotencyTTL           time.Duration `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL" default:"24h" usage:"how long responses to sendMessage requests with an Idempotency-Key are kept for replay; 0 disables Idempotency-Key"`
+	PrivateURLBlock          bool          `yaml:"private_url_block" env:"PRIVATE_URL_BLOCK" usage:"reject sendFileByUrl URLs whose host is or resolves to a private, loopback or link-local address"`
+	FileProbeTimeout         time.Duration `yaml:"file_probe_timeout" env:"FILE_PROBE_TIMEOUT" default:"5s" usage:"timeout of the request checking the urlFile of sendFileByUrl before it is sent; 0 disables the check"`
+	FileProbeMaxBytes        ByteSize      `yaml:"file_probe_max_bytes" env:"FILE_PROBE_MAX_BYTES" default:"100MB" validate:"positive" usage:"largest file sendFileByUrl accepts, by the Content-Length of urlFile"`
+	FileProbeTypes           []string      `yaml:"file_probe_types" env:"FILE_PROBE_TYPES" default:"image/*,video/*,audio/*,application/*,text/plain,text/csv" usage:"Content-Types urlFile of sendFileByUrl may have, as type/subtype or type/*; empty allows any"`
+	MediaMaxBytes            ByteSize      `yaml:"media_max_bytes" env:"MEDIA_MAX_BYTES" default:"100MB" validate:"positive" usage:"largest file /api/media streams; larger files are refused, or cut off when their size is not known in advance"`
+	MediaTimeout             time.Duration `yaml:"media_timeout" env:"MEDIA_TIMEOUT" default:"5m" validate:"positive" usage:"overall deadline of one /api/media download, in place of REQUEST_TIMEOUT"`
+	MediaCacheTTL            time.Duration `yaml:"media_cache_ttl" env:"MEDIA_CACHE_TTL" default:"5m" usage:"how long download links are kept per message and /api/media responses may be cached by the browser; 0 disables both"`
+	WebhookWorkers           int           `yaml:"webhook_workers" env:"WEBHOOK_WORKERS" default:"4" validate:"positive" usage:"workers processing GREEN-API notifications"`
+	WebhookQueueSize         int           `yaml:"webhook_queue_size" env:"WEBHOOK_QUEUE_SIZE" default:"100" validate:"positive" usage:"notifications queued before /webhook answers 503"`
+	WebhookAuthToken         string        `yaml:"webhook_auth_token" env:"WEBHOOK_AUTH_TOKEN" secret:"true" usage:"bearer token GREEN-API must send to /webhook (webhookUrlToken in the instance settings)"`
+	WebhookAllow             IPNets        `yaml:"webhook_allow" env:"WEBHOOK_ALLOW" usage:"IPs or CIDRs allowed to call /webhook; empty allows any address"`
+	PublicURL                string        `yaml:"public_url" env:"PUBLIC_URL" usage:"https URL this server is reached at from the internet, e.g. https://wa.example.com; POST /api/settings points webhookUrl at its /webhook by default"`
+	WSSendBuffer             int           `yaml:"ws_send_buffer" env:"WS_SEND_BUFFER" default:"64" validate:"positive" usage:"notifications queued per /ws or /events client before it is disconnected as too slow"`
+	WSPingInterval           time.Duration `yaml:"ws_ping_interval" env:"WS_PING_INTERVAL" default:"30s" validate:"positive" usage:"how often /ws clients are pinged"`
+	WSPongTimeout            time.Duration `yaml:"ws_pong_timeout" env:"WS_PONG_TIMEOUT" default:"10s" validate:"positive" usage:"how long after a missed ping a /ws client is disconnected"`
+	EventsHeartbeat          time.Duration `yaml:"events_heartbeat" env:"EVENTS_HEARTBEAT" default:"15s" validate:"positive" usage:"how often /events sends a comment to keep idle connections open"`
+	EventsReplaySize         int           `yaml:"events_replay_size" env:"EVENTS_REPLAY_SIZE" default:"256" usage:"latest notifications kept for /events clients reconnecting with Last-Event-ID; 0 disables replay"`
+	GreenAPIPoll             bool          `yaml:"greenapi_poll" env:"GREENAPI_POLL" usage:"fetch notifications with ReceiveNotification instead of waiting for /webhook"`
+	GreenAPIPollTimeout      time.Duration `yaml:"greenapi_poll_timeout" env:"GREENAPI_POLL_TIMEOUT" default:"20s" usage:"long-poll timeout for ReceiveNotification, 5s to 60s"`
+
+	GreenAPIInstances       GreenAPIInstances `yaml:"greenapi_instances" env:"GREENAPI_INSTANCES" usage:"named instances served under /api/instances/{name}/ as name=idInstance:apiToken pairs; a token written as $VAR is read from that environment variable"`
+	GreenAPIDefaultInstance string            `yaml:"greenapi_default_instance" env:"GREENAPI_DEFAULT_INSTANCE" usage:"name in GREENAPI_INSTANCES used by the unprefixed /api/ routes instead of GREENAPI_ID_INSTANCE"`
+
+	BulkSendMaxRecipients int           `yaml:"bulk_send_max_recipients" env:"BULK_SEND_MAX_RECIPIENTS" default:"100" validate:"positive" usage:"most recipients of one /api/sendMessages request"`
+	BulkSendConcurrency   int           `yaml:"bulk_send_concurrency" env:"BULK_SEND_CONCURRENCY" default:"4" validate:"positive" usage:"messages of one /api/sendMessages request sent at the same time"`
+	BulkSendTimeout       time.Duration `yaml:"bulk_send_timeout" env:"BULK_SEND_TIMEOUT" default:"5m" validate:"positive" usage:"overall deadline of one /api/sendMessages request; recipients not reached by then are reported as not sent"`
+
+	SendQueueSize      int           `yaml:"send_queue_size" env:"SEND_QUEUE_SIZE" default:"100" usage:"messages /api/sendMessage?async=true keeps waiting to be sent before it answers 429; 0 disables async sending"`
+	SendQueueInterval  time.Duration `yaml:"send_queue_interval" env:"SEND_QUEUE_INTERVAL" default:"3s" usage:"pause between two messages sent from the queue"`
+	SendQueueAttempts  int           `yaml:"send_queue_attempts" env:"SEND_QUEUE_ATTEMPTS" default:"5" validate:"positive" usage:"times a queued message is sent before it is marked failed, when GREEN-API fails in a way that may pass"`
+	SendQueueStatusTTL time.Duration `yaml:"send_queue_status_ttl" env:"SEND_QUEUE_STATUS_TTL" default:"1h" validate:"positive" usage:"how long the status of a sent or failed message stays available from /api/queue/{id}"`
+	SendQueueDumpFile  string        `yaml:"send_queue_dump_file" env:"SEND_QUEUE_DUMP_FILE" usage:"file the messages still queued at shutdown are appended to, one JSON object per line; empty only logs them"`
+
+	GreenAPIHealthInterval time.Duration `yaml:"greenapi_health_interval" env:"GREENAPI_HEALTH_INTERVAL" usage:"how often the state of the default and the named instances is checked in the background, for /readyz and /stats; 0 disables the check"`
+	GreenAPIHealthRequired bool          `yaml:"greenapi_health_required" env:"GREENAPI_HEALTH_REQUIRED" usage:"fail /readyz while the background checks cannot reach GREEN-API for any instance"`
+
+	OutboundProxyURL            string        `yaml:"outbound_proxy_url" env:"OUTBOUND_PROXY_URL" secret:"true" usage:"proxy for GREEN-API calls, an http, https or socks5 URL; empty uses HTTPS_PROXY, HTTP_PROXY and NO_PROXY"`
+	OutboundMaxIdleConnsPerHost int           `yaml:"outbound_max_idle_conns_per_host" env:"OUTBOUND_MAX_IDLE_CONNS_PER_HOST" default:"16" validate:"positive" usage:"idle connections kept open to each GREEN-API host for reuse"`
+	OutboundIdleConnTimeout     time.Duration `yaml:"outbound_idle_conn_timeout" env:"OUTBOUND_IDLE_CONN_TIMEOUT" default:"90s" validate:"positive" usage:"how long an idle connection to GREEN-API is kept open"`
+	OutboundTLSHandshakeTimeout time.Duration `yaml:"outbound_tls_handshake_timeout" env:"OUTBOUND_TLS_HANDSHAKE_TIMEOUT" default:"10s" validate:"positive" usage:"timeout for the TLS handshake with GREEN-API or the proxy"`
+	OutboundDialTimeout         time.Duration `yaml:"outbound_dial_timeout" env:"OUTBOUND_DIAL_TIMEOUT" default:"10s" validate:"positive" usage:"timeout for opening a connection to GREEN-API or the proxy"`
+	OutboundHTTP1               bool          `yaml:"outbound_http1" env:"OUTBOUND_HTTP1" usage:"talk HTTP/1.1 to GREEN-API, for proxies that break HTTP/2"`
+
+	AppVersion string `yaml:"app_version" env:"APP_VERSION" usage:"version reported by /version instead of the module version"`
+
+	FrontendAPIBase      string        `yaml:"frontend_api_base" env:"FRONTEND_API_BASE" default:"/api" usage:"API base URL the browser app is told in /config.js, a path or an http(s) URL"`
+	FrontendPollInterval time.Duration `yaml:"frontend_poll_interval" env:"FRONTEND_POLL_INTERVAL" default:"5s" validate:"positive" usage:"how often the browser app is told to poll, in /config.js"`
+	FrontendFeatures     []string      `yaml:"frontend_features" env:"FRONTEND_FEATURES" usage:"feature flags the browser app is told are on, in /config.js"`
+
+	CacheControl           CacheRules `yaml:"cache_control" env:"CACHE_CONTROL_RULES" default:"*.html=no-cache" usage:"Cache-Control rules for static files as pattern=value pairs separated by ';'"`
+	SPAMode                bool       `yaml:"spa_mode" env:"SPA_MODE" usage:"serve index.html for unknown paths without a file extension"`
+	DisableDirListing      bool       `yaml:"disable_dir_listing" env:"DISABLE_DIR_LISTING" default:"true" usage:"answer 404 for directories without an index.html"`
+	NotFoundPage           string     `yaml:"not_found_page" env:"NOT_FOUND_PAGE" usage:"page inside the static dir served for missing paths, e.g. 404.html"`
+	ErrorPagesDir          string     `yaml:"error_pages_dir" env:"ERROR_PAGES_DIR" usage:"directory with <status>.html and error.html templates for error responses"`
+	HiddenAllowlist        []string   `yaml:"hidden_allowlist" env:"HIDDEN_ALLOWLIST" default:"/.well-known/" usage:"path prefixes where dot-prefixed segments may be served"`
+	StaticPrecompressed    bool       `yaml:"static_precompressed" env:"STATIC_PRECOMPRESSED" default:"true" usage:"serve .br and .gz sidecar files to clients that accept them"`
+	StaticCacheMaxBytes    ByteSize   `yaml:"static_cache_max_bytes" env:"STATIC_CACHE_MAX_BYTES" usage:"memory budget for caching static files, 0 disables the cache"`
+	StaticCacheMaxFileSize ByteSize   `yaml:"static_cache_max_file_size" env:"STATIC_CACHE_MAX_FILE_SIZE" default:"256KB" usage:"largest static file kept in the memory cache"`
+	MIMETypes              MIMETypes  `yaml:"mime_types" env:"MIME_TYPES" usage:"Content-Type overrides by file extension, e.g. .webmanifest=application/manifest+json"`
+	AssetDirs              []string   `yaml:"asset_dirs" env:"ASSET_DIRS" usage:"static directories whose files are also served under content-hashed /assets/ URLs, e.g. /js,/css"`
+
+	IndexTemplate bool         `yaml:"index_template" env:"INDEX_TEMPLATE" usage:"render index.html with html/template and -template-vars at startup"`
+	TemplateVars  TemplateVars `yaml:"template_vars" env:"TEMPLATE_VARS" usage:"JSON object index.html is rendered with under -index-template, e.g. {\"apiBase\":\"/api\"}"`
+
+	Compression        bool     `yaml:"compression" env:"COMPRESSION" default:"true" usage:"gzip compressible responses for clients that accept it"`
+	CompressionMinSize ByteSize `yaml:"compression_min_size" env:"COMPRESSION_MIN_SIZE" default:"1KB" usage:"smallest response body worth compressing"`
+
+	EnableH2C bool `yaml:"enable_h2c" env:"ENABLE_H2C" usage:"accept HTTP/2 without TLS (h2c) on the plain listener"`
+
+	EnablePprof bool   `yaml:"enable_pprof" env:"ENABLE_PPROF" usage:"serve net/http/pprof under /debug/pprof/"`
+	DebugPort   string `yaml:"debug_port" env:"DEBUG_PORT" usage:"separate port for debug endpoints; when empty they are mounted on the main port"`
+	DebugToken  string `yaml:"debug_token" env:"DEBUG_TOKEN" secret:"true" usage:"shared secret required for debug endpoints on the main port"`
+	AdminToken  string `yaml:"admin_token" env:"ADMIN_TOKEN" secret:"true" usage:"bearer token for the /admin/ endpoints; empty leaves them out"`
+
+	DebugCapture         bool          `yaml:"debug_capture" env:"DEBUG_CAPTURE" usage:"log the bodies of /api/ requests and responses at debug level from the start; /admin/capture turns it on for a while instead"`
+	DebugCaptureMaxBytes ByteSize      `yaml:"debug_capture_max_bytes" env:"DEBUG_CAPTURE_MAX_BYTES" default:"4KB" validate:"positive" usage:"how much of each body debug capture logs"`
+	DebugCaptureTTL      time.Duration `yaml:"debug_capture_ttl" env:"DEBUG_CAPTURE_TTL" default:"15m" validate:"positive" usage:"how long debug capture turned on through /admin/capture lasts when no duration is given"`
+	UnsafeFullBodies     bool          `yaml:"unsafe_full_bodies" env:"UNSAFE_FULL_BODIES" usage:"log captured bodies without masking tokens, phone numbers and message text"`
+
+	MaintenanceFile string `yaml:"maintenance_file" env:"MAINTENANCE_FILE" usage:"file whose existence turns maintenance mode on, with its content as the message"`
+	MaintenancePage string `yaml:"maintenance_page" env:"MAINTENANCE_PAGE" default:"maintenance.html" usage:"page inside the static dir answered to browsers in maintenance mode"`
+
+	AutocertDomains  []string `yaml:"autocert_domains" env:"AUTOCERT_DOMAINS" usage:"comma-separated hosts to obtain Let's Encrypt certificates for"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir" env:"AUTOCERT_CACHE_DIR" default:"./autocert-cache" usage:"directory where Let's Encrypt certificates are stored"`
+	AutocertHTTPPort string   `yaml:"autocert_http_port" env:"AUTOCERT_HTTP_PORT" default:"80" usage:"port serving the ACME HTTP-01 challenge"`
+
+	MTLSClientCA string   `yaml:"mtls_client_ca" env:"MTLS_CLIENT_CA" usage:"PEM file of the CAs whose client certificates are accepted; with it, paths under MTLS_PATHS need one"`
+	MTLSPaths    []string `yaml:"mtls_paths" env:"MTLS_PATHS" default:"/admin/,/webhook" usage:"path prefixes (or =exact paths) that need a client certificate from MTLS_CLIENT_CA"`
+
+	File string `yaml:"-"`
+	// Validate is the -validate mode: empty to serve, validateShallow or
+	// validateDeep to only check the configuration.
+	Validate string            `yaml:"-"`
+	sources  map[string]string `yaml:"-"`
+	// args are the command-line arguments the configuration was loaded
+	// from, which a reload parses again.
+	args []string
+}
+
+// Source reports where the value for the given config key came from.
+func (c *Config) Source(key string) string {
+	return c.sources[key]
+}
+
+// loadConfig builds the configuration from all sources. args are the
+// command-line arguments without the program name. flag.ErrHelp is returned
+// when -h was requested, after the usage has been printed. When the values
+// themselves are invalid the configuration is returned along with the
+// error, so that -validate can still report what was resolved.
+func loadConfig(args []string) (*Config, error) {
+	cfg := &Config{sources: make(map[string]string), args: args}
+
+	if err := cfg.applyDefaults(); err != nil {
+		return nil, err
+	}
+
+	flags, err := cfg.parseFlags(args, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	if flags.config != "" {
+		path = flags.config
+	}
+	cfg.Validate = flags.validate
+	var fileErr error
+	if path != "" {
+		fileErr = cfg.applyFile(path)
+		cfg.File = path
+	}
+
+	// Every value is applied and checked before giving up, so that all
+	// problems are reported at once.
+	err = errors.Join(
+		fileErr,
+		cfg.applyEnv(os.LookupEnv),
+		cfg.applyFlags(flags),
+		cfg.validate(),
+	)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// validate checks the configuration as a whole and the files and
+// directories it names, returning every problem found joined into one
+// error.
+func (c *Config) validate() error {
+	var errs []error
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	} else if c.TLSEnabled() {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE: %w", err))
+		}
+	}
+	if c.EnablePprof && c.DebugPort == "" && c.DebugToken == "" {
+		errs = append(errs, errors.New("DEBUG_TOKEN is required when ENABLE_PPROF is set without DEBUG_PORT"))
+	}
+	switch c.LogFormat {
+	case "", logFormatJSON, logFormatText, logFormatDev:
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be json, text or dev, got %q", c.LogFormat))
+	}
+	switch c.AccessLogFormat {
+	case accessLogJSON, accessLogCommon, accessLogCombined:
+	default:
+		errs = append(errs, fmt.Errorf("ACCESS_LOG_FORMAT must be json, common or combined, got %q", c.AccessLogFormat))
+	}
+	if c.MTLSClientCA != "" {
+		if !c.TLSEnabled() && !c.AutocertEnabled() {
+			errs = append(errs, errors.New("MTLS_CLIENT_CA needs TLS: set TLS_CERT_FILE and TLS_KEY_FILE or AUTOCERT_DOMAINS"))
+		}
+		if _, err := loadClientCAs(c.MTLSClientCA); err != nil {
+			errs = append(errs, fmt.Errorf("MTLS_CLIENT_CA: %w", err))
+		}
+	}
+	switch c.AccessLogMode {
+	case accessLogModeAll, accessLogModeErrors, accessLogModeNone:
+	default:
+		errs = append(errs, fmt.Errorf("ACCESS_LOG_MODE must be all, errors or none, got %q", c.AccessLogMode))
+	}
+	if c.SessionKey != "" {
+		if _, err := parseSessionKey(c.SessionKey); err != nil {
+			errs = append(errs, fmt.Errorf("SESSION_KEY: %w", err))
+		}
+	}
+	switch c.CSRFMode {
+	case csrfModeOrigin, csrfModeToken, csrfModeOff:
+	default:
+		errs = append(errs, fmt.Errorf("CSRF_MODE must be origin, token or off, got %q", c.CSRFMode))
+	}
+	if u, err := url.Parse(c.GreenAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("GREENAPI_URL must be an http or https URL, got %q", c.GreenAPIURL))
+	}
+	if u, err := url.Parse(c.GreenAPIMediaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("GREENAPI_MEDIA_URL must be an http or https URL, got %q", c.GreenAPIMediaURL))
+	}
+	if !strings.HasPrefix(c.FrontendAPIBase, "/") {
+		if u, err := url.Parse(c.FrontendAPIBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("FRONTEND_API_BASE must be a path or an http or https URL, got %q", c.FrontendAPIBase))
+		}
+	}
+	if c.GreenAPIDefaultInstance != "" {
+		if _, ok := c.GreenAPIInstances[c.GreenAPIDefaultInstance]; !ok {
+			errs = append(errs, fmt.Errorf("GREENAPI_DEFAULT_INSTANCE %q is not in GREENAPI_INSTANCES", c.GreenAPIDefaultInstance))
+		}
+		if c.GreenAPIIDInstance != "" {
+			errs = append(errs, errors.New("GREENAPI_DEFAULT_INSTANCE and GREENAPI_ID_INSTANCE cannot both be set"))
+		}
+	}
+	if _, ok := c.GreenAPIInstances[defaultInstanceName]; ok && c.GreenAPIIDInstance != "" {
+		errs = append(errs, fmt.Errorf("GREENAPI_INSTANCES cannot name an instance %q while GREENAPI_ID_INSTANCE is set", defaultInstanceName))
+	}
+	defaultID, defaultToken := c.DefaultInstance()
+	if c.GreenAPIPoll && (defaultID == "" || defaultToken == "") {
+		errs = append(errs, errors.New("GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN, or GREENAPI_DEFAULT_INSTANCE, are required when GREENAPI_POLL is set"))
+	} else if (c.GreenAPIIDInstance == "") != (c.GreenAPIToken == "") {
+		errs = append(errs, errors.New("GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN must be set together"))
+	}
+	if c.GreenAPIHealthInterval < 0 {
+		errs = append(errs, fmt.Errorf("GREENAPI_HEALTH_INTERVAL must not be negative, got %s", c.GreenAPIHealthInterval))
+	} else if c.GreenAPIHealthInterval > 0 && (defaultID == "" || defaultToken == "") && len(c.GreenAPIInstances) == 0 {
+		errs = append(errs, errors.New("GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN, or GREENAPI_INSTANCES, are required when GREENAPI_HEALTH_INTERVAL is set"))
+	}
+	if c.OutboundProxyURL != "" {
+		if _, err := parseProxyURL(c.OutboundProxyURL, false); err != nil {
+			errs = append(errs, fmt.Errorf("OUTBOUND_PROXY_URL: %w", err))
+		}
+	} else if err := checkProxyEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DebugCaptureTTL > maxCaptureDuration {
+		errs = append(errs, fmt.Errorf("DEBUG_CAPTURE_TTL must be at most %s, got %s", maxCaptureDuration, c.DebugCaptureTTL))
+	}
+	if c.GreenAPIHealthRequired && c.GreenAPIHealthInterval == 0 {
+		errs = append(errs, errors.New("GREENAPI_HEALTH_REQUIRED needs GREENAPI_HEALTH_INTERVAL"))
+	}
+	if c.GreenAPIPollTimeout < 5*time.Second || c.GreenAPIPollTimeout > time.Minute {
+		errs = append(errs, fmt.Errorf("GREENAPI_POLL_TIMEOUT must be between 5s and 60s, got %s", c.GreenAPIPollTimeout))
+	}
+	for _, pattern := range c.AllowedHosts {
+		if err := checkHostPattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("ALLOWED_HOSTS: %w", err))
+		}
+	}
+	if c.HostRejectStatus != http.StatusMisdirectedRequest && c.HostRejectStatus != http.StatusBadRequest {
+		errs = append(errs, fmt.Errorf("HOST_REJECT_STATUS must be 421 or 400, got %d", c.HostRejectStatus))
+	}
+	if c.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("MAX_CONNECTIONS must not be negative, got %d", c.MaxConnections))
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, errors.New("REQUEST_TIMEOUT must not be negative"))
+	}
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("SHUTDOWN_DELAY must not be negative"))
+	}
+	if c.RetryBindFor < 0 {
+		errs = append(errs, errors.New("RETRY_BIND_FOR must not be negative"))
+	}
+	if c.GreenAPICacheTTL < 0 {
+		errs = append(errs, errors.New("GREENAPI_CACHE_TTL must not be negative"))
+	}
+	if c.CheckWhatsappCacheTTL < 0 {
+		errs = append(errs, errors.New("CHECK_WHATSAPP_CACHE_TTL must not be negative"))
+	}
+	if c.GreenAPILimitMaxWait < 0 {
+		errs = append(errs, errors.New("GREENAPI_LIMIT_MAX_WAIT must not be negative"))
+	}
+	if c.GreenAPILogBodyBytes < 0 {
+		errs = append(errs, errors.New("GREENAPI_LOG_BODY_BYTES must not be negative"))
+	}
+	if c.EventsReplaySize < 0 {
+		errs = append(errs, errors.New("EVENTS_REPLAY_SIZE must not be negative"))
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			errs = append(errs, fmt.Errorf("PUBLIC_URL must be an https URL without query or fragment, got %q", c.PublicURL))
+		}
+	}
+	if c.FileProbeTimeout < 0 {
+		errs = append(errs, errors.New("FILE_PROBE_TIMEOUT must not be negative"))
+	}
+	for _, t := range c.FileProbeTypes {
+		if major, minor, ok := strings.Cut(t, "/"); !ok || major == "" || major == "*" || minor == "" || strings.ContainsAny(minor, "/;") {
+			errs = append(errs, fmt.Errorf("FILE_PROBE_TYPES: invalid media type %q, want type/subtype or type/*", t))
+		}
+	}
+	if c.MediaCacheTTL < 0 {
+		errs = append(errs, errors.New("MEDIA_CACHE_TTL must not be negative"))
+	}
+	if c.SendQueueSize < 0 {
+		errs = append(errs, errors.New("SEND_QUEUE_SIZE must not be negative"))
+	}
+	if c.SendQueueInterval < 0 {
+		errs = append(errs, errors.New("SEND_QUEUE_INTERVAL must not be negative"))
+	}
+	if c.IdempotencyTTL < 0 {
+		errs = append(errs, errors.New("IDEMPOTENCY_TTL must not be negative"))
+	}
+	if c.GreenAPIBreakerThreshold < 0 {
+		errs = append(errs, errors.New("GREENAPI_BREAKER_THRESHOLD must not be negative"))
+	}
+	switch c.TracesExporter {
+	case tracesExporterNone, tracesExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER must be none or otlp, got %q", c.TracesExporter))
+	}
+	if c.LogMaxAgeDays < 0 || c.LogMaxBackups < 0 {
+		errs = append(errs, errors.New("LOG_MAX_AGE_DAYS and LOG_MAX_BACKUPS must not be negative"))
+	}
+	if c.AccessLogMaxAgeDays < 0 || c.AccessLogMaxBackups < 0 {
+		errs = append(errs, errors.New("ACCESS_LOG_MAX_AGE_DAYS and ACCESS_LOG_MAX_BACKUPS must not be negative"))
+	}
+	if c.MaxConcurrentRequests < 0 {
+		errs = append(errs, fmt.Errorf("MAX_CONCURRENT_REQUESTS must not be negative, got %d", c.MaxConcurrentRequests))
+	}
+	if c.RateLimitRPS < 0 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_RPS must not be negative, got %v", c.RateLimitRPS))
+	}
+	if c.SlowRequestThreshold < 0 {
+		errs = append(errs, errors.New("SLOW_REQUEST_THRESHOLD must not be negative"))
+	}
+	if c.CORSMaxAge < 0 {
+		errs = append(errs, errors.New("CORS_MAX_AGE must not be negative"))
+	}
+	if !c.EmbedStatic {
+		if err := checkDir(c.StaticDir); err != nil {
+			errs = append(errs, fmt.Errorf("STATIC_DIR: %w", err))
+		}
+	}
+	for _, mount := range c.StaticMounts {
+		if err := checkDir(mount.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("STATIC_MOUNTS: %s: %w", mount.Prefix, err))
+		}
+		if len(c.AssetDirs) > 0 && mount.Prefix == assetsPrefix {
+			errs = append(errs, fmt.Errorf("ASSET_DIRS: %s is taken by STATIC_MOUNTS", assetsPrefix))
+		}
+	}
+	if !c.EmbedStatic {
+		for _, dir := range normalizeAssetDirs(c.AssetDirs) {
+			if err := checkDir(filepath.Join(c.StaticDir, filepath.FromSlash(dir))); err != nil {
+				errs = append(errs, fmt.Errorf("ASSET_DIRS: %s: %w", dir, err))
+			}
+		}
+	}
+	network, address := c.Listen()
+	var mainPort string
+	switch {
+	case network == "unix" && address == "":
+		errs = append(errs, errors.New("LISTEN_ADDR: unix socket path is empty"))
+	case network == "tcp":
+		name := "PORT"
+		switch {
+		case c.ListenAddr != "":
+			name = "LISTEN_ADDR"
+		case c.HTTPSPort != "" && c.HTTPSEnabled():
+			name = "HTTPS_PORT"
+		}
+		// Port 0 lets the system pick a free port, see PORT_FILE.
+		_, port, err := net.SplitHostPort(address)
+		if err == nil && port != "0" {
+			err = checkPort(port)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		mainPort = port
+	}
+	if len(c.TemplateVars) > 0 && !c.IndexTemplate {
+		errs = append(errs, errors.New("TEMPLATE_VARS needs INDEX_TEMPLATE"))
+	}
+	if (c.HTTPPort != "" || c.HTTPSPort != "" || c.RedirectHTTP) && !c.HTTPSEnabled() {
+		errs = append(errs, errors.New("HTTP_PORT, HTTPS_PORT and REDIRECT_HTTP need HTTPS: set TLS_CERT_FILE and TLS_KEY_FILE, or AUTOCERT_DOMAINS"))
+	}
+	if c.DebugPort != "" {
+		if err := checkPort(c.DebugPort); err != nil {
+			errs = append(errs, fmt.Errorf("DEBUG_PORT: %w", err))
+		}
+	}
+	if port := c.PlainHTTPPort(); port != "" {
+		name := "HTTP_PORT"
+		switch {
+		case c.HTTPPort != "":
+		case c.AutocertEnabled():
+			name = "AUTOCERT_HTTP_PORT"
+		default:
+			name = "REDIRECT_HTTP"
+		}
+		if err := checkPort(port); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		} else if port == mainPort && port != "0" {
+			errs = append(errs, fmt.Errorf("%s: port %s is already taken by the HTTPS listener", name, port))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkDir reports why dir cannot be served: it is missing, not a
+// directory or cannot be listed.
+func checkDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err := f.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// checkPort accepts a TCP port number from 1 to 65535.
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port must be a number from 1 to 65535, got %q", port)
+	}
+	return nil
+}
+
+// configProblems lists the problems in an error from loadConfig, one per
+// joined error.
+func configProblems(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var problems []string
+		for _, err := range joined.Unwrap() {
+			problems = append(problems, configProblems(err)...)
+		}
+		return problems
+	}
+	return []string{err.Error()}
+}
+
+// Listen returns the network and address the main listener binds to.
+// LISTEN_ADDR takes precedence over HTTPS_PORT, which is only used with
+// HTTPS, and PORT; a value prefixed with "unix:" is a unix domain socket
+// path.
+func (c *Config) Listen() (network, address string) {
+	if path, ok := strings.CutPrefix(c.ListenAddr, "unix:"); ok {
+		return "unix", path
+	}
+
+	address = c.ListenAddr
+	if address == "" && c.HTTPSPort != "" && c.HTTPSEnabled() {
+		address = c.HTTPSPort
+	}
+	if address == "" {
+		address = c.Port
+	}
+	if !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+	return "tcp", address
+}
+
+// TLSEnabled reports whether the server should terminate TLS with the
+// configured certificate files.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// AutocertEnabled reports whether certificates should be obtained from Let's
+// Encrypt. Manually configured certificate files take precedence.
+func (c *Config) AutocertEnabled() bool {
+	return len(c.AutocertDomains) > 0 && !c.TLSEnabled()
+}
+
+// HTTPSEnabled reports whether the main listener serves HTTPS.
+func (c *Config) HTTPSEnabled() bool {
+	return c.TLSEnabled() || c.AutocertEnabled()
+}
+
+// PlainHTTPPort returns the port of the plain HTTP listener that runs next
+// to HTTPS, or "" when there is none. With Let's Encrypt there always is
+// one, as the HTTP-01 challenge needs it; HTTP_PORT then takes precedence
+// over AUTOCERT_HTTP_PORT. REDIRECT_HTTP alone listens on port 80.
+func (c *Config) PlainHTTPPort() string {
+	switch {
+	case !c.HTTPSEnabled():
+		return ""
+	case c.HTTPPort != "":
+		return c.HTTPPort
+	case c.AutocertEnabled():
+		return c.AutocertHTTPPort
+	case c.RedirectHTTP:
+		return "80"
+	}
+	return ""
+}
+
+// configValue is f as it would be written in the environment. A secret
+// that is set is redacted down to its length, so that it can be told apart
+// from an empty or truncated one without being shown.
+func configValue(f configField) string {
+	var text string
+	switch v := f.value.Interface().(type) {
+	case slog.Level:
+		text = levelName(v)
+	case fmt.Stringer:
+		text = v.String()
+	case []string:
+		text = strings.Join(v, ",")
+	default:
+		text = fmt.Sprint(v)
+	}
+	if f.secret && !f.value.IsZero() {
+		return fmt.Sprintf("[REDACTED:len=%d]", len(text))
+	}
+	return text
+}
+
+type configField struct {
+	key      string
+	env      string
+	flag     string
+	def      string
+	usage    string
+	validate string
+	secret   bool
+	value    reflect.Value
+}
+
+func (f configField) set(raw string) error {
+	if err := setField(f.value, raw); err != nil {
+		return err
+	}
+	if f.validate == "positive" && f.value.Int() <= 0 {
+		return fmt.Errorf("must be positive, got %q", raw)
+	}
+	return nil
+}
+
+func (c *Config) fields() []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("yaml")
+		if !f.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := f.Tag.Get("flag")
+		if name == "" {
+			name = strings.ReplaceAll(key, "_", "-")
+		}
+		fields = append(fields, configField{
+			key:      key,
+			env:      f.Tag.Get("env"),
+			flag:     name,
+			def:      f.Tag.Get("default"),
+			usage:    f.Tag.Get("usage"),
+			validate: f.Tag.Get("validate"),
+			secret:   f.Tag.Get("secret") == "true",
+			value:    v.Field(i),
+		})
+	}
+	return fields
+}
+
+func (c *Config) applyDefaults() error {
+	for _, f := range c.fields() {
+		if f.def == "" {
+			continue
+		}
+		if err := f.set(f.def); err != nil {
+			return fmt.Errorf("default for %s: %w", f.key, err)
+		}
+		c.sources[f.key] = sourceDefault
+	}
+	return nil
+}
+
+func (c *Config) applyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config file %s: top level must be a mapping", path)
+	}
+
+	byKey := make(map[string]configField)
+	for _, f := range c.fields() {
+		byKey[f.key] = f
+	}
+
+	var errs []error
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+
+		f, ok := byKey[keyNode.Value]
+		if !ok {
+			errs = append(errs, fmt.Errorf("config file %s: line %d: unknown key %q", path, keyNode.Line, keyNode.Value))
+			continue
+		}
+
+		if valueNode.Kind == yaml.ScalarNode {
+			err = f.set(valueNode.Value)
+		} else {
+			err = valueNode.Decode(f.value.Addr().Interface())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: line %d: %s: %w", path, keyNode.Line, f.key, err))
+			continue
+		}
+		c.sources[f.key] = sourceFile
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, f := range c.fields() {
+		if f.env == "" {
+			continue
+		}
+		raw, ok := lookup(f.env)
+		if !ok || raw == "" {
+			continue
+		}
+		if err := f.set(raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			continue
+		}
+		c.sources[f.key] = sourceEnv
+	}
+	return errors.Join(errs...)
+}
+
+type parsedFlags struct {
+	config   string
+	validate string
+	set      map[string]string
+}
+
+// flagValue validates a flag against the type of its config field but only
+// records the raw value, so it can be applied after the file and env sources.
+type flagValue struct {
+	field configField
+	raw   *string
+}
+
+func (f *flagValue) String() string {
+	if f.raw == nil {
+		return ""
+	}
+	return *f.raw
+}
+
+func (f *flagValue) Set(s string) error {
+	scratch := f.field
+	scratch.value = reflect.New(f.field.value.Type()).Elem()
+	if err := scratch.set(s); err != nil {
+		return err
+	}
+	*f.raw = s
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
+
+func (f *flagValue) typeName() string {
+	t := f.field.value.Type()
+	switch {
+	case t == durationType:
+		return "duration"
+	case t == byteSizeType:
+		return "size"
+	case t == levelType:
+		return "level"
+	case t.Kind() == reflect.Bool:
+		return ""
+	case t.Kind() == reflect.Slice:
+		return "list"
+	case t.Kind() == reflect.Map:
+		return "map"
+	case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+		return "int"
+	case t.Kind() == reflect.Float64:
+		return "float"
+	default:
+		return "string"
+	}
+}
+
+func (c *Config) parseFlags(args []string, output io.Writer) (*parsedFlags, error) {
+	fields := c.fields()
+	raw := make(map[string]*string, len(fields))
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	var configPath string
+	fs.StringVar(&configPath, "config", "", "path to a YAML or JSON config file (env CONFIG_FILE)")
+	var validate validateFlag
+	fs.Var(&validate, "validate", "check the configuration, print a report and exit without serving; -validate=deep also calls GREEN-API")
+
+	for _, f := range fields {
+		value := new(string)
+		raw[f.flag] = value
+		usage := f.usage
+		if f.env != "" {
+			usage += " (env " + f.env + ")"
+		}
+		fs.Var(&flagValue{field: f, raw: value}, f.flag, usage)
+		fs.Lookup(f.flag).DefValue = f.def
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage: %s [flags]\n\nFlags take precedence over environment variables, which take precedence over the config file.\n\n", fs.Name())
+		fs.VisitAll(func(f *flag.Flag) {
+			typeName := "string"
+			switch v := f.Value.(type) {
+			case *flagValue:
+				typeName = v.typeName()
+			case *validateFlag:
+				typeName = ""
+			}
+			if typeName == "" {
+				fmt.Fprintf(output, "  -%s\n    \t%s", f.Name, f.Usage)
+			} else {
+				fmt.Fprintf(output, "  -%s %s\n    \t%s", f.Name, typeName, f.Usage)
+			}
+			if f.DefValue != "" {
+				fmt.Fprintf(output, " (default %q)", f.DefValue)
+			}
+			fmt.Fprintln(output)
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	parsed := &parsedFlags{config: configPath, validate: string(validate), set: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		if value, ok := raw[f.Name]; ok {
+			parsed.set[f.Name] = *value
+		}
+	})
+	return parsed, nil
+}
+
+func (c *Config) applyFlags(flags *parsedFlags) error {
+	var errs []error
+	for _, f := range c.fields() {
+		raw, ok := flags.set[f.flag]
+		if !ok {
+			continue
+		}
+		if err := f.set(raw); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", f.flag, err))
+			continue
+		}
+		c.sources[f.key] = sourceFlag
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	byteSizeType = reflect.TypeOf(ByteSize(0))
+	levelType    = reflect.TypeOf(slog.Level(0))
+)
+
+// ByteSize is a size in bytes that can be written with a binary unit suffix
+// such as "512KB" or "1MB". Negative sizes are rejected.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	raw := strings.TrimSpace(string(text))
+	upper := strings.ToUpper(raw)
+
+	multiplier := ByteSize(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(upper, unit.suffix) {
+			multiplier = unit.size
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 || n > int64(math.MaxInt64/multiplier) {
+		return fmt.Errorf("invalid size %q", raw)
+	}
+	*b = ByteSize(n) * multiplier
+	return nil
+}
+
+// FileMode is a permission mask written in octal, e.g. "0660".
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("invalid file mode %q", text)
+	}
+	*m = FileMode(n)
+	return nil
+}
+
+func (m FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+func (b ByteSize) String() string {
+	switch {
+	case b != 0 && b%(1<<30) == 0:
+		return strconv.FormatInt(int64(b>>30), 10) + "GB"
+	case b != 0 && b%(1<<20) == 0:
+		return strconv.FormatInt(int64(b>>20), 10) + "MB"
+	case b != 0 && b%(1<<10) == 0:
+		return strconv.FormatInt(int64(b>>10), 10) + "KB"
+	default:
+		return strconv.FormatInt(int64(b), 10) + "B"
+	}
+}
+
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == levelType {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			return fmt.Errorf("invalid log level %q, want debug, info, warn or error", raw)
+		}
+		v.SetInt(int64(level))
+		return nil
+	}
+
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
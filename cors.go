@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type corsPolicy struct {
+	origins     []string
+	methods     string
+	headers     string
+	maxAge      string
+	credentials bool
+}
+
+func newCORSPolicy(cfg *Config) *corsPolicy {
+	origins := make([]string, 0, len(cfg.CORSAllowedOrigins))
+	for _, origin := range cfg.CORSAllowedOrigins {
+		origins = append(origins, strings.ToLower(strings.TrimRight(origin, "/")))
+	}
+
+	return &corsPolicy{
+		origins:     origins,
+		methods:     strings.Join(cfg.CORSAllowedMethods, ", "),
+		headers:     strings.Join(cfg.CORSAllowedHeaders, ", "),
+		maxAge:      strconv.Itoa(int(cfg.CORSMaxAge / time.Second)),
+		credentials: cfg.CORSAllowCredentials,
+	}
+}
+
+// allowed reports whether origin matches one of the configured origins:
+// "*", an exact origin or a wildcard subdomain such as https://*.example.com.
+func (p *corsPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.origins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+
+		prefix, suffix, ok := strings.Cut(pattern, "*.")
+		if !ok {
+			continue
+		}
+		suffix = "." + suffix
+		if len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.Contains(origin[len(prefix):len(origin)-len(suffix)], "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS adds CORS headers for allowed origins and answers preflight requests
+// itself. The origin is always echoed back rather than "*", so the response
+// stays valid with credentials. Requests from other origins get no CORS
+// headers and are left for the browser to block.
+func CORS(policy *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		addVary(header, "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			addVary(header, "Access-Control-Request-Method")
+			addVary(header, "Access-Control-Request-Headers")
+		}
+
+		allowed := policy.allowed(origin)
+		if allowed {
+			header.Set("Access-Control-Allow-Origin", origin)
+			if policy.credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed {
+			header.Set("Access-Control-Allow-Methods", policy.methods)
+			if policy.headers != "" {
+				header.Set("Access-Control-Allow-Headers", policy.headers)
+			}
+			if policy.maxAge != "0" {
+				header.Set("Access-Control-Max-Age", policy.maxAge)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
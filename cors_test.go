@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testCORSPolicy allows https://app.example.com and the subdomains of
+// example.org, with credentials.
+func testCORSPolicy(t *testing.T) *corsPolicy {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.CORSAllowedOrigins = []string{"https://app.example.com/", "https://*.example.org"}
+	cfg.CORSAllowCredentials = true
+	return newCORSPolicy(cfg)
+}
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      string
+		wantAllowed bool
+	}{
+		{"exact origin", "https://app.example.com", true},
+		{"exact origin in other case", "https://APP.example.com", true},
+		{"wildcard subdomain", "https://chat.example.org", true},
+		{"nested subdomain", "https://a.b.example.org", true},
+		{"bare wildcard domain", "https://example.org", false},
+		{"other scheme", "http://chat.example.org", false},
+		{"lookalike domain", "https://evilexample.org", false},
+		{"suffix attack", "https://app.example.com.evil.com", false},
+		{"other origin", "https://evil.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			h := CORS(testCORSPolicy(t), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+			req := httptest.NewRequest(http.MethodOptions, "/api/sendMessage", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			req.Header.Set("Access-Control-Request-Headers", "content-type")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNoContent || reached {
+				t.Errorf("preflight = %d, reached the handler: %t; want 204 answered by CORS", rec.Code, reached)
+			}
+			if got := rec.Header().Values("Vary"); len(got) != 3 || got[0] != "Origin" {
+				t.Errorf("Vary = %q, want Origin and the request headers", got)
+			}
+			want := map[string]string{
+				"Access-Control-Allow-Origin":      tt.origin,
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, HEAD, POST, PUT, PATCH, DELETE",
+				"Access-Control-Allow-Headers":     "Content-Type, Authorization, X-Request-ID",
+				"Access-Control-Max-Age":           "600",
+			}
+			for name, value := range want {
+				got := rec.Header().Get(name)
+				if tt.wantAllowed && got != value || !tt.wantAllowed && got != "" {
+					t.Errorf("%s = %q, want %q sent: %t", name, got, value, tt.wantAllowed)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantOrigin string
+	}{
+		{"allowed", http.MethodGet, "https://app.example.com", "https://app.example.com"},
+		{"disallowed", http.MethodPost, "https://evil.com", ""},
+		{"no origin", http.MethodGet, "", ""},
+		{"OPTIONS without preflight", http.MethodOptions, "https://app.example.com", "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := CORS(testCORSPolicy(t), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			req := httptest.NewRequest(tt.method, "/api/getSettings", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("status = %d, want the handler's", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if rec.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", rec.Header().Get("Vary"))
+			}
+			if rec.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Error("a simple request got preflight headers")
+			}
+		})
+	}
+}
+
+func TestCORSNeverStarWithCredentials(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.CORSAllowedOrigins = []string{"*"}
+	cfg.CORSAllowCredentials = true
+	h := CORS(newCORSPolicy(cfg), noContent)
+	req := httptest.NewRequest(http.MethodGet, "/api/getSettings", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://anywhere.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin reflected", got)
+	}
+}
+
+func TestCORSMaxAgeZero(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.CORSAllowedOrigins = []string{"https://app.example.com"}
+	cfg.CORSMaxAge = 0
+	h := CORS(newCORSPolicy(cfg), noContent)
+	req := httptest.NewRequest(http.MethodOptions, "/api/sendMessage", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if _, ok := rec.Header()["Access-Control-Max-Age"]; ok {
+		t.Error("Access-Control-Max-Age sent with CORS_MAX_AGE=0")
+	}
+}
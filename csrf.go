@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRF modes.
+const (
+	csrfModeOrigin = "origin"
+	csrfModeToken  = "token"
+	csrfModeOff    = "off"
+)
+
+const (
+	// csrfHeader carries the token in token mode.
+	csrfHeader = "X-CSRF-Token"
+	// csrfCookie holds the token to compare the header with. Over HTTPS it
+	// gets the __Host- prefix, so that a sibling subdomain cannot set it.
+	csrfCookie       = "csrf_token"
+	csrfSecureCookie = "__Host-csrf_token"
+	csrfTokenBytes   = 32
+)
+
+// csrfPolicy decides which requests CSRF checks. Origins allowed by CORS
+// count as trusted, since cross-origin calls from them are wanted.
+type csrfPolicy struct {
+	mode   string
+	paths  pathMatcher
+	exempt pathMatcher
+	cors   *corsPolicy
+}
+
+func newCSRFPolicy(cfg *Config, cors *corsPolicy) *csrfPolicy {
+	policy := &csrfPolicy{
+		mode:   cfg.CSRFMode,
+		paths:  newPathMatcher(cfg.CSRFPaths),
+		exempt: newPathMatcher(cfg.CSRFExemptPaths),
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		policy.cors = cors
+	}
+	return policy
+}
+
+// csrfSafeMethod reports whether method cannot change state, so a forged
+// request with it does no harm.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// sameOrigin reports whether a browser sent r from the page's own origin, or
+// from one trusted through CORS. Sec-Fetch-Site is preferred; browsers
+// without it are judged by Origin against the Host of the request. Without
+// either header the request did not come from a browser and is let through.
+func (p *csrfPolicy) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return p.trusted(origin)
+	}
+
+	if origin == "" {
+		return true
+	}
+	if origin == "null" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) || p.trusted(origin)
+}
+
+func (p *csrfPolicy) trusted(origin string) bool {
+	return origin != "" && origin != "null" && p.cors != nil && p.cors.allowed(origin)
+}
+
+// csrfCookieName returns the token cookie name for r.
+func csrfCookieName(r *http.Request) string {
+	if isHTTPS(r) {
+		return csrfSecureCookie
+	}
+	return csrfCookie
+}
+
+// validToken reports whether the X-CSRF-Token header matches the token
+// cookie.
+func validToken(r *http.Request) bool {
+	header := r.Header.Get(csrfHeader)
+	cookie, err := r.Cookie(csrfCookieName(r))
+	if header == "" || err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// checks reports whether CSRF applies to urlPath.
+func (p *csrfPolicy) checks(urlPath string) bool {
+	return p.paths.match(urlPath) && !p.exempt.match(urlPath)
+}
+
+// CSRF answers 403 to unsafe requests under CSRF_PATHS that fail the check
+// of the mode: a cross-origin browser request, or in token mode also a
+// missing or wrong X-CSRF-Token. Paths under CSRF_EXEMPT_PATHS, such as
+// /webhook, are called server to server and never checked.
+func CSRF(policy *csrfPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csrfSafeMethod(r.Method) || !matchRequestPath(r, policy.checks) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !policy.sameOrigin(r) {
+			WriteError(w, r, http.StatusForbidden, errCodeCSRFRejected, "cross-origin request rejected", nil)
+			return
+		}
+		if policy.mode == csrfModeToken && !validToken(r) {
+			WriteError(w, r, http.StatusForbidden, errCodeCSRFRejected, "missing or invalid CSRF token", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type csrfTokenResponse struct {
+	Token  string `json:"token"`
+	Header string `json:"header"`
+}
+
+// CSRFToken serves GET /api/csrf in token mode: the token to send in
+// X-CSRF-Token, set as a cookie too. A token already in the cookie is kept,
+// so that tabs open at the same time do not invalidate each other.
+func CSRFToken(w http.ResponseWriter, r *http.Request) {
+	name := csrfCookieName(r)
+	token := ""
+	if cookie, err := r.Cookie(name); err == nil && len(cookie.Value) == base64.RawURLEncoding.EncodedLen(csrfTokenBytes) {
+		token = cookie.Value
+	} else {
+		b := make([]byte, csrfTokenBytes)
+		rand.Read(b)
+		token = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		Secure:   name == csrfSecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, http.StatusOK, csrfTokenResponse{Token: token, Header: csrfHeader})
+}
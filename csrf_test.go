@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	const token = "0123456789abcdef0123456789abcdef0123456789a"
+	tests := []struct {
+		name    string
+		mode    string
+		cors    []string
+		method  string
+		path    string
+		header  map[string]string
+		cookie  string
+		https   bool
+		wantErr string
+	}{
+		{name: "safe method", mode: csrfModeOrigin, method: http.MethodGet, path: "/api/getSettings", header: map[string]string{"Origin": "https://evil.example"}},
+		{name: "no browser headers", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage"},
+		{name: "same origin by Origin", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Origin": "http://example.com"}},
+		{name: "same origin by Sec-Fetch-Site", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://evil.example"}},
+		{name: "typed into the address bar", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Sec-Fetch-Site": "none"}},
+		{name: "cross-site Sec-Fetch-Site", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, wantErr: "cross-origin"},
+		{name: "cross-site Origin", mode: csrfModeOrigin, method: http.MethodDelete, path: "/api/deleteMessage", header: map[string]string{"Origin": "https://evil.example"}, wantErr: "cross-origin"},
+		{name: "null Origin", mode: csrfModeOrigin, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Origin": "null"}, wantErr: "cross-origin"},
+		{name: "Origin allowed by CORS", mode: csrfModeOrigin, cors: []string{"https://app.example"}, method: http.MethodPut, path: "/api/setSettings", header: map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://app.example"}},
+		{name: "Origin not allowed by CORS", mode: csrfModeOrigin, cors: []string{"https://app.example"}, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{"Origin": "https://evil.example"}, wantErr: "cross-origin"},
+		{name: "path not protected", mode: csrfModeOrigin, method: http.MethodPost, path: "/upload", header: map[string]string{"Origin": "https://evil.example"}},
+		{name: "webhook exempt", mode: csrfModeOrigin, method: http.MethodPost, path: "/webhook", header: map[string]string{"Origin": "https://evil.example"}},
+		{name: "token missing", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", wantErr: "CSRF token"},
+		{name: "token without the cookie", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token}, wantErr: "CSRF token"},
+		{name: "token mismatch", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token}, cookie: csrfCookie + "=other", wantErr: "CSRF token"},
+		{name: "token matches", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token}, cookie: csrfCookie + "=" + token},
+		{name: "token in the plain cookie over HTTPS", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token}, cookie: csrfCookie + "=" + token, https: true, wantErr: "CSRF token"},
+		{name: "token in the __Host- cookie over HTTPS", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token}, cookie: csrfSecureCookie + "=" + token, https: true},
+		{name: "token mode checks the origin too", mode: csrfModeToken, method: http.MethodPost, path: "/api/sendMessage", header: map[string]string{csrfHeader: token, "Origin": "https://evil.example"}, cookie: csrfCookie + "=" + token, wantErr: "cross-origin"},
+		{name: "token mode safe method", mode: csrfModeToken, method: http.MethodGet, path: "/api/getSettings"},
+		{name: "token mode webhook exempt", mode: csrfModeToken, method: http.MethodPost, path: "/webhook"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureDefaultLog(t)
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.CSRFMode = tt.mode
+				cfg.CORSAllowedOrigins = tt.cors
+			})
+			reached := false
+			h := CSRF(newCSRFPolicy(cfg, newCORSPolicy(cfg)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			if tt.https {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if tt.wantErr == "" {
+				if !reached || rec.Code != http.StatusOK {
+					t.Errorf("rejected with %d: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			if reached {
+				t.Error("the handler ran")
+			}
+			var envelope apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil || rec.Code != http.StatusForbidden || envelope.Error.Code != errCodeCSRFRejected {
+				t.Fatalf("got %d %s, want 403 %s", rec.Code, rec.Body, errCodeCSRFRejected)
+			}
+			if !strings.Contains(envelope.Error.Message, tt.wantErr) {
+				t.Errorf("message = %q, want %q", envelope.Error.Message, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	issue := func(cookie string, https bool) *http.Cookie {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/csrf", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		if https {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		rec := httptest.NewRecorder()
+		CSRFToken(rec, req)
+		var body csrfTokenResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("body %q: %v", rec.Body, err)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("set %d cookies, want 1", len(cookies))
+		}
+		if body.Header != csrfHeader || body.Token != cookies[0].Value {
+			t.Errorf("body = %+v, cookie = %q", body, cookies[0].Value)
+		}
+		c := cookies[0]
+		if !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Path != "/" {
+			t.Errorf("cookie %s lacks HttpOnly, SameSite=Strict or Path=/", c)
+		}
+		return c
+	}
+
+	first := issue("", false)
+	if first.Name != csrfCookie || first.Secure || len(first.Value) != 43 {
+		t.Errorf("cookie = %s, want a 43 character %s", first, csrfCookie)
+	}
+	if second := issue("", false); second.Value == first.Value {
+		t.Error("two clients got the same token")
+	}
+	if kept := issue(csrfCookie+"="+first.Value, false); kept.Value != first.Value {
+		t.Errorf("token %q replaced by %q", first.Value, kept.Value)
+	}
+	if replaced := issue(csrfCookie+"=short", false); replaced.Value == "short" {
+		t.Error("a malformed token was kept")
+	}
+	if secure := issue("", true); secure.Name != csrfSecureCookie || !secure.Secure {
+		t.Errorf("over HTTPS the cookie is %s", secure)
+	}
+}
+
+func TestServerCSRF(t *testing.T) {
+	const send = `{"chatId":"79001234567@c.us","message":"hi"}`
+	crossSite := http.Header{"Origin": {"https://evil.example"}, "Sec-Fetch-Site": {"cross-site"}}
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"idMessage":"BAE5"}`))
+	})
+
+	tests := []struct {
+		mode          string
+		wantCrossSite int
+		wantCSRFRoute int
+	}{
+		{csrfModeOrigin, http.StatusForbidden, http.StatusNotFound},
+		{csrfModeToken, http.StatusForbidden, http.StatusOK},
+		{csrfModeOff, http.StatusOK, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) { cfg.CSRFMode = tt.mode }))
+
+			rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage", send, crossSite)
+			if rec.Code != tt.wantCrossSite {
+				t.Errorf("cross-site sendMessage = %d, want %d: %s", rec.Code, tt.wantCrossSite, rec.Body)
+			}
+			if tt.wantCrossSite == http.StatusForbidden && envelope.Error.Code != errCodeCSRFRejected {
+				t.Errorf("code = %q, want %s", envelope.Error.Code, errCodeCSRFRejected)
+			}
+			if rec, envelope := callAPI(t, s, http.MethodPost, "/webhook", `{}`, crossSite); envelope.Error.Code == errCodeCSRFRejected {
+				t.Errorf("the webhook was checked: %d %s", rec.Code, rec.Body)
+			}
+
+			rec, _ = callAPI(t, s, http.MethodGet, "/api/csrf", "", nil)
+			if rec.Code != tt.wantCSRFRoute {
+				t.Fatalf("/api/csrf = %d, want %d", rec.Code, tt.wantCSRFRoute)
+			}
+			if tt.mode != csrfModeToken {
+				if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", send, nil); rec.Code != http.StatusOK {
+					t.Errorf("same-site sendMessage = %d: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+
+			var issued csrfTokenResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil {
+				t.Fatal(err)
+			}
+			if rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage", send, nil); rec.Code != http.StatusForbidden || envelope.Error.Code != errCodeCSRFRejected {
+				t.Errorf("without the token sendMessage = %d %s", rec.Code, rec.Body)
+			}
+			withToken := http.Header{"Cookie": {csrfCookie + "=" + issued.Token}}
+			withToken.Set(csrfHeader, issued.Token)
+			if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", send, withToken); rec.Code != http.StatusOK {
+				t.Errorf("with the token sendMessage = %d: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+)
+
+func newDebugMux(vars *debugVars) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", vars)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// RequireDebugToken protects debug endpoints exposed on the public port. The
+// token is accepted either in the X-Debug-Token header or as the basic auth
+// password.
+func RequireDebugToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-Debug-Token")
+		if got == "" {
+			_, got, _ = r.BasicAuth()
+		}
+
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+			renderError(w, r, http.StatusUnauthorized, errCodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// debugVars serves /debug/vars: the standard memstats and cmdline of expvar
+// plus the request counters, read from the same requestStats as /stats so
+// that the two always agree. The variables are not published in the global
+// expvar registry, which panics on a second NewServer.
+type debugVars struct {
+	stats    *requestStats
+	inFlight *atomic.Int64
+	// fileCache is set once the static file cache exists; nil without it.
+	fileCache *fileCache
+}
+
+func newDebugVars(stats *requestStats, inFlight *atomic.Int64) *debugVars {
+	return &debugVars{stats: stats, inFlight: inFlight}
+}
+
+// hitRate is hits over all lookups, 0 before the first.
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// debugVar is one of the variables added to those of expvar.
+type debugVar struct {
+	key   string
+	value any
+}
+
+func (v *debugVars) vars() []debugVar {
+	t := v.stats.totals()
+	status := make(map[string]int64, len(t.status))
+	for i, n := range t.status {
+		status[string(rune('1'+i))+"xx"] = n
+	}
+	cache := map[string]any{
+		"api_hits":     t.apiCacheHits,
+		"api_misses":   t.apiCacheMisses,
+		"api_hit_rate": hitRate(t.apiCacheHits, t.apiCacheMisses),
+	}
+	if v.fileCache != nil {
+		hits, misses := v.fileCache.hits.Load(), v.fileCache.misses.Load()
+		cache["static_hits"] = hits
+		cache["static_misses"] = misses
+		cache["static_hit_rate"] = hitRate(hits, misses)
+	}
+
+	return []debugVar{
+		{"requests", map[string]any{"total": t.requests, "status": status}},
+		{"requests_in_flight", v.inFlight.Load()},
+		{"bytes_served", t.bytes},
+		{"upstream", map[string]int64{"calls": t.upstreamCalls, "errors": t.upstreamErrors}},
+		{"cache", cache},
+	}
+}
+
+// ServeHTTP writes the variables in the format of expvar.Handler.
+func (v *debugVars) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	write := func(key, value string) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		name, _ := json.Marshal(key)
+		fmt.Fprintf(w, "%s: %s", name, value)
+	}
+	expvar.Do(func(kv expvar.KeyValue) { write(kv.Key, kv.Value.String()) })
+	for _, dv := range v.vars() {
+		value, err := json.Marshal(dv.value)
+		if err != nil {
+			continue
+		}
+		write(dv.key, string(value))
+	}
+	fmt.Fprintf(w, "\n}\n")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestHitRate(t *testing.T) {
+	tests := []struct {
+		hits, misses int64
+		want         float64
+	}{
+		{0, 0, 0},
+		{3, 0, 1},
+		{0, 3, 0},
+		{3, 1, 0.75},
+	}
+	for _, tt := range tests {
+		if got := hitRate(tt.hits, tt.misses); got != tt.want {
+			t.Errorf("hitRate(%d, %d) = %g, want %g", tt.hits, tt.misses, got, tt.want)
+		}
+	}
+}
+
+// TestDebugVarsMatchStats checks the variables are read from the counters
+// behind /stats, so that the two agree.
+func TestDebugVarsMatchStats(t *testing.T) {
+	stats := newRequestStats()
+	entries := []accessEntry{
+		{status: http.StatusOK, size: 100, cache: "hit"},
+		{status: http.StatusOK, size: 50, cache: "miss", upstream: greenapi.CallStats{Attempts: 2, Failures: 1}},
+		{status: http.StatusNotFound, size: 9},
+		{status: http.StatusBadGateway, upstream: greenapi.CallStats{Attempts: 1, Failures: 1}},
+	}
+	for _, e := range entries {
+		stats.observe("/api/getSettings", &e)
+	}
+	var inFlight atomic.Int64
+	inFlight.Store(2)
+
+	rec := httptest.NewRecorder()
+	newDebugVars(stats, &inFlight).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars struct {
+		Requests struct {
+			Total  int64            `json:"total"`
+			Status map[string]int64 `json:"status"`
+		} `json:"requests"`
+		InFlight int64            `json:"requests_in_flight"`
+		Bytes    int64            `json:"bytes_served"`
+		Upstream map[string]int64 `json:"upstream"`
+		Cache    map[string]any   `json:"cache"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("%s: %v", rec.Body, err)
+	}
+
+	totals := stats.totals()
+	report := totals.report(nil)
+	if vars.Requests.Total != report.Requests || vars.Bytes != report.Bytes || vars.InFlight != 2 {
+		t.Errorf("requests %d, bytes %d, in flight %d; /stats has %d and %d", vars.Requests.Total, vars.Bytes, vars.InFlight, report.Requests, report.Bytes)
+	}
+	for class, n := range report.Status {
+		if vars.Requests.Status[class] != n {
+			t.Errorf("status %s = %d, /stats has %d", class, vars.Requests.Status[class], n)
+		}
+	}
+	if vars.Upstream["calls"] != report.UpstreamCalls || vars.Upstream["errors"] != report.UpstreamErrors || report.UpstreamCalls != 3 {
+		t.Errorf("upstream = %v, /stats has %d calls and %d errors", vars.Upstream, report.UpstreamCalls, report.UpstreamErrors)
+	}
+	if vars.Cache["api_hits"] != float64(1) || vars.Cache["api_misses"] != float64(1) || vars.Cache["api_hit_rate"] != 0.5 {
+		t.Errorf("cache = %v", vars.Cache)
+	}
+	if _, ok := vars.Cache["static_hits"]; ok {
+		t.Error("static cache counters without a static cache")
+	}
+}
+
+func TestServerDebugVars(t *testing.T) {
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"stateInstance":"authorized"}`)
+	})
+	debugPort := freePort(t)
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+		url    func(t *testing.T, s *Server) string
+		token  string
+	}{
+		{
+			"main port behind the token",
+			func(cfg *Config) { cfg.DebugToken = "debug-secret" },
+			func(t *testing.T, s *Server) string { return serverURL(t, s, "http", "/debug/vars") },
+			"debug-secret",
+		},
+		{
+			"debug port",
+			func(cfg *Config) { cfg.DebugPort = debugPort },
+			func(t *testing.T, s *Server) string { return "http://127.0.0.1:" + debugPort + "/debug/vars" },
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := startTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.EnablePprof = true
+				cfg.StaticCacheMaxBytes = 1 << 20
+				cfg.GreenAPICacheTTL = time.Minute
+			}, tt.mutate))
+			for _, path := range []string{"/", "/", "/missing.js", "/api/getStateInstance", "/api/getStateInstance"} {
+				resp, err := http.Get(serverURL(t, s, "http", path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			get := func(token string) *http.Response {
+				req, _ := http.NewRequest(http.MethodGet, tt.url(t, s), nil)
+				if token != "" {
+					req.Header.Set("X-Debug-Token", token)
+				}
+				var resp *http.Response
+				waitFor(t, "the debug listener", func() bool {
+					var err error
+					resp, err = http.DefaultClient.Do(req)
+					return err == nil
+				})
+				return resp
+			}
+			if tt.token != "" {
+				resp := get("wrong")
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("/debug/vars with a wrong token = %d, want 401", resp.StatusCode)
+				}
+			}
+			resp := get(tt.token)
+			defer resp.Body.Close()
+			var vars map[string]json.RawMessage
+			if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("/debug/vars = %d: %v", resp.StatusCode, err)
+			}
+			for _, key := range []string{"cmdline", "memstats", "requests_in_flight"} {
+				if _, ok := vars[key]; !ok {
+					t.Errorf("/debug/vars lacks %s", key)
+				}
+			}
+			var got struct {
+				Requests struct {
+					Total  int64            `json:"total"`
+					Status map[string]int64 `json:"status"`
+				} `json:"requests"`
+				Bytes    int64              `json:"bytes_served"`
+				Upstream map[string]int64   `json:"upstream"`
+				Cache    map[string]float64 `json:"cache"`
+			}
+			raw, _ := json.Marshal(vars)
+			json.Unmarshal(raw, &got)
+			nonzero := map[string]float64{
+				"requests.total":        float64(got.Requests.Total),
+				"requests.status.2xx":   float64(got.Requests.Status["2xx"]),
+				"requests.status.4xx":   float64(got.Requests.Status["4xx"]),
+				"bytes_served":          float64(got.Bytes),
+				"upstream.calls":        float64(got.Upstream["calls"]),
+				"cache.api_hits":        got.Cache["api_hits"],
+				"cache.api_misses":      got.Cache["api_misses"],
+				"cache.api_hit_rate":    got.Cache["api_hit_rate"],
+				"cache.static_hits":     got.Cache["static_hits"],
+				"cache.static_hit_rate": got.Cache["static_hit_rate"],
+			}
+			for key, value := range nonzero {
+				if value == 0 {
+					t.Errorf("%s is 0 after the traffic", key)
+				}
+			}
+			http.DefaultClient.CloseIdleConnections()
+		})
+	}
+}
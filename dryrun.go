@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// -validate modes.
+const (
+	validateShallow = "shallow"
+	validateDeep    = "deep"
+)
+
+// validateDeepTimeout bounds the GREEN-API call of -validate=deep, so that an
+// unreachable upstream fails the check instead of hanging a deploy script.
+const validateDeepTimeout = 5 * time.Second
+
+// validateFlag is -validate: given alone it is the shallow mode, and
+// -validate=deep adds the GREEN-API check.
+type validateFlag string
+
+func (v *validateFlag) String() string { return string(*v) }
+
+func (v *validateFlag) Set(s string) error {
+	switch s {
+	case "true", validateShallow:
+		*v = validateShallow
+	case validateDeep:
+		*v = validateDeep
+	case "false":
+		*v = ""
+	default:
+		return fmt.Errorf("want %s or %s, got %q", validateShallow, validateDeep, s)
+	}
+	return nil
+}
+
+func (v *validateFlag) IsBoolFlag() bool { return true }
+
+// runValidate writes a report of the resolved configuration and of every
+// problem found in it to w and returns the exit status: 0 when the
+// configuration is good to start with, 1 otherwise. loadErr is the error
+// loadConfig returned along with cfg. Nothing is bound or started; the deep
+// mode only makes one getStateInstance call.
+func runValidate(ctx context.Context, w io.Writer, cfg *Config, loadErr error) int {
+	file := cfg.File
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(w, "Config file: %s\n\nResolved values:\n", file)
+	for _, f := range cfg.fields() {
+		src := cfg.Source(f.key)
+		if src == "" {
+			src = sourceDefault
+		}
+		fmt.Fprintf(w, "  %s = %s (%s)\n", f.key, configValue(f), src)
+	}
+
+	var problems []string
+	if loadErr != nil {
+		problems = configProblems(loadErr)
+	}
+	if err := checkStartup(cfg); err != nil {
+		problems = append(problems, configProblems(err)...)
+	}
+
+	if cfg.Validate == validateDeep {
+		fmt.Fprintf(w, "\nGREEN-API check:\n")
+		state, err := checkGreenAPI(ctx, cfg)
+		if err != nil {
+			fmt.Fprintf(w, "  failed: %v\n", err)
+			problems = append(problems, "GREEN-API: "+err.Error())
+		} else {
+			fmt.Fprintf(w, "  %s answered, instance state %s\n", cfg.GreenAPIURL, state)
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "\nConfiguration is valid.\n")
+		return 0
+	}
+	fmt.Fprintf(w, "\nProblems (%d):\n", len(problems))
+	for _, p := range problems {
+		fmt.Fprintf(w, "  - %s\n", p)
+	}
+	return 1
+}
+
+// checkStartup reports what would stop the server after the configuration
+// is loaded: error page and index templates that do not render, and log
+// and port files whose directory is missing. Unlike startup it creates no files.
+func checkStartup(cfg *Config) error {
+	var errs []error
+	if cfg.ErrorPagesDir != "" {
+		if _, err := loadErrorPages(cfg.ErrorPagesDir); err != nil {
+			errs = append(errs, fmt.Errorf("ERROR_PAGES_DIR: %w", err))
+		}
+	}
+	if cfg.IndexTemplate {
+		if err := checkIndexTemplate(cfg); err != nil {
+			errs = append(errs, fmt.Errorf("INDEX_TEMPLATE: %w", err))
+		}
+	}
+	if cfg.LogFile != "" {
+		if err := checkDir(filepath.Dir(cfg.LogFile)); err != nil {
+			errs = append(errs, fmt.Errorf("LOG_FILE: %w", err))
+		}
+	}
+	if cfg.PortFile != "" {
+		if err := checkDir(filepath.Dir(cfg.PortFile)); err != nil {
+			errs = append(errs, fmt.Errorf("PORT_FILE: %w", err))
+		}
+	}
+	switch cfg.AccessLogFile {
+	case "", "-", "stdout", "stderr":
+	default:
+		if err := checkDir(filepath.Dir(cfg.AccessLogFile)); err != nil {
+			errs = append(errs, fmt.Errorf("ACCESS_LOG_FILE: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkIndexTemplate(cfg *Config) error {
+	root, err := staticFileSystem(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = newIndexPage(root, newIndexData(cfg))
+	return err
+}
+
+// checkGreenAPI asks GREEN-API for the state of the default instance,
+// which proves the URL is reachable and the credentials are accepted.
+func checkGreenAPI(ctx context.Context, cfg *Config) (string, error) {
+	idInstance, apiToken := cfg.DefaultInstance()
+	if idInstance == "" || apiToken == "" {
+		return "", errors.New("GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN, or GREENAPI_DEFAULT_INSTANCE, are required for -validate=deep")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, validateDeepTimeout)
+	defer cancel()
+	transport, err := newOutboundTransport(cfg)
+	if err != nil {
+		return "", err
+	}
+	client := greenapi.NewClient(greenapi.Endpoints{API: cfg.GreenAPIURL, Media: cfg.GreenAPIMediaURL},
+		idInstance, apiToken, &http.Client{Timeout: validateDeepTimeout, Transport: transport})
+	state, err := client.GetStateInstance(ctx)
+	if err != nil {
+		return "", err
+	}
+	return state.StateInstance, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateFlag(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{nil, "", false},
+		{[]string{"-validate"}, validateShallow, false},
+		{[]string{"-validate=shallow"}, validateShallow, false},
+		{[]string{"-validate=deep"}, validateDeep, false},
+		{[]string{"-validate=false"}, "", false},
+		{[]string{"-validate=full"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			t.Setenv("STATIC_DIR", t.TempDir())
+			cfg, err := loadConfig(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && cfg.Validate != tt.want {
+				t.Errorf("Validate = %q, want %q", cfg.Validate, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(*Config)
+		want     int
+		wantText []string
+	}{
+		{
+			"valid",
+			func(cfg *Config) { cfg.AdminToken = "admin-secret-51d0" },
+			0,
+			[]string{"Config file: none", "  port = 0 (default)", "  admin_token = [REDACTED:len=17] (default)", "Configuration is valid."},
+		},
+		{
+			"missing log directory",
+			func(cfg *Config) { cfg.LogFile = filepath.Join(t.TempDir(), "missing", "app.log") },
+			1,
+			[]string{"Problems (1):", "  - LOG_FILE: "},
+		},
+		{
+			"every startup problem",
+			func(cfg *Config) {
+				missing := filepath.Join(t.TempDir(), "missing")
+				cfg.PortFile = filepath.Join(missing, "port")
+				cfg.AccessLogFile = filepath.Join(missing, "access.log")
+				cfg.ErrorPagesDir = filepath.Dir(writeFile(t, "404.html", "{{ .Status "))
+			},
+			1,
+			[]string{"Problems (3):", "  - ERROR_PAGES_DIR: ", "  - PORT_FILE: ", "  - ACCESS_LOG_FILE: "},
+		},
+		{
+			"deep without credentials",
+			func(cfg *Config) { cfg.Validate = validateDeep },
+			1,
+			[]string{"GREEN-API check:", "  failed: GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.mutate)
+			var out strings.Builder
+			if got := runValidate(context.Background(), &out, cfg, nil); got != tt.want {
+				t.Errorf("exit status = %d, want %d", got, tt.want)
+			}
+			for _, want := range tt.wantText {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("report lacks %q:\n%s", want, out.String())
+				}
+			}
+			if strings.Contains(out.String(), "admin-secret") {
+				t.Errorf("the report shows a secret:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestRunValidateLoadErrors(t *testing.T) {
+	t.Setenv("STATIC_DIR", t.TempDir())
+	t.Setenv("PORT", "http")
+	t.Setenv("WRITE_TIMEOUT", "soon")
+	cfg, err := loadConfig([]string{"-validate"})
+	if err == nil || cfg == nil {
+		t.Fatalf("loadConfig = %v, %v; want the configuration along with the error", cfg, err)
+	}
+	var out strings.Builder
+	if got := runValidate(context.Background(), &out, cfg, err); got != 1 {
+		t.Errorf("exit status = %d, want 1", got)
+	}
+	for _, want := range []string{"Problems (2):", `PORT: port must be a number`, `WRITE_TIMEOUT: invalid duration "soon"`, "  static_dir = "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestRunValidateBindsNothing validates a port another process holds,
+// which serving would fail on.
+func TestRunValidateBindsNothing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	cfg := testConfig(t, func(cfg *Config) { cfg.Port = port })
+	if got := runValidate(context.Background(), io.Discard, cfg, nil); got != 0 {
+		t.Errorf("exit status = %d, want 0", got)
+	}
+}
+
+func TestRunValidateDeep(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		hang     bool
+		want     int
+		wantText string
+	}{
+		{"authorized", http.StatusOK, `{"stateInstance":"authorized"}`, false, 0, "answered, instance state authorized"},
+		{"not authorized yet", http.StatusOK, `{"stateInstance":"notAuthorized"}`, false, 0, "answered, instance state notAuthorized"},
+		{"wrong token", http.StatusUnauthorized, `{}`, false, 1, "  failed: "},
+		{"upstream failure", http.StatusInternalServerError, `{}`, false, 1, "  - GREEN-API: "},
+		{"upstream hangs", http.StatusOK, "", true, 1, "  failed: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if !strings.HasSuffix(r.URL.Path, "/waInstance1101/getStateInstance/secret") {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				if tt.hang {
+					<-r.Context().Done()
+					return
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			cfg := testConfig(t, withConfig(withUpstream(upstream), func(cfg *Config) { cfg.Validate = validateDeep }))
+
+			// The check gives up at the deadline of ctx, or validateDeepTimeout.
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			var out strings.Builder
+			start := time.Now()
+			if got := runValidate(ctx, &out, cfg, nil); got != tt.want {
+				t.Errorf("exit status = %d, want %d:\n%s", got, tt.want, out.String())
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			if !strings.Contains(out.String(), tt.wantText) {
+				t.Errorf("report lacks %q:\n%s", tt.wantText, out.String())
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("GREEN-API was called %d times, want once", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+func staticFileSystem(cfg *Config) (http.FileSystem, error) {
+	if !cfg.EmbedStatic {
+		return http.Dir(cfg.StaticDir), nil
+	}
+
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		return nil, err
+	}
+	return http.FS(sub), nil
+}
+
+func (c *Config) StaticMode() string {
+	if c.EmbedStatic {
+		return "embed"
+	}
+	return "disk"
+}
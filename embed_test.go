@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// staticBackends returns staticFiles on disk, as STATIC_DIR serves them,
+// and in memory through http.FS, as EMBED_STATIC does.
+func staticBackends(t *testing.T) map[string]http.FileSystem {
+	t.Helper()
+	mem := make(fstest.MapFS, len(staticFiles))
+	for name, content := range staticFiles {
+		mem[name] = &fstest.MapFile{Data: []byte(content), Mode: 0o644}
+	}
+	return map[string]http.FileSystem{
+		"disk":  http.Dir(writeStaticTree(t, staticFiles)),
+		"embed": http.FS(mem),
+	}
+}
+
+func TestStaticBackends(t *testing.T) {
+	rules := CacheRules{{Pattern: "*.html", Value: "no-cache"}, {Pattern: "/css/", Value: "public, max-age=3600"}}
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantBody   string
+		wantCache  string
+		wantType   string
+	}{
+		{"root", "/", http.StatusOK, "<h1>app</h1>", "no-cache", "text/html"},
+		{"asset", "/app.js", http.StatusOK, "console.log('app');", "", "text/javascript"},
+		{"cache rule", "/css/site.css", http.StatusOK, "body{}", "public, max-age=3600", "text/css"},
+		{"directory index", "/docs/", http.StatusOK, "<h1>docs</h1>", "no-cache", "text/html"},
+		{"SPA fallback", "/chat/12345", http.StatusOK, "<h1>app</h1>", "no-cache", "text/html"},
+		{"missing asset", "/missing.js", http.StatusNotFound, "", "", ""},
+	}
+	for backend, root := range staticBackends(t) {
+		h := newStaticHandler(root, staticOptions{CacheRules: func(*http.Request) CacheRules { return rules }, SPA: true})
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				rec := get(h, tt.target)
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+				}
+				if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+					t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+				}
+				if got := rec.Header().Get("Cache-Control"); got != tt.wantCache {
+					t.Errorf("Cache-Control = %q, want %q", got, tt.wantCache)
+				}
+				if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+					t.Errorf("Content-Type = %q, want %s", got, tt.wantType)
+				}
+			})
+		}
+
+		t.Run(backend+"/conditional", func(t *testing.T) {
+			etag := get(h, "/app.js").Header().Get("ETag")
+			if etag == "" {
+				t.Fatal("no ETag")
+			}
+			req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+			req.Header.Set("If-None-Match", etag)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotModified {
+				t.Errorf("If-None-Match = %d, want 304", rec.Code)
+			}
+		})
+	}
+}
+
+func TestStaticFileSystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		embed    bool
+		wantMode string
+		wantBody string
+	}{
+		{"disk", false, "disk", "<h1>app</h1>"},
+		{"embed", true, "embed", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.StaticDir = writeStaticTree(t, map[string]string{"index.html": "<h1>app</h1>"})
+			cfg.EmbedStatic = tt.embed
+			if got := cfg.StaticMode(); got != tt.wantMode {
+				t.Errorf("StaticMode = %q, want %q", got, tt.wantMode)
+			}
+			root, err := staticFileSystem(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.wantBody
+			if tt.embed {
+				embedded, err := embeddedStatic.ReadFile("static/index.html")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = string(embedded)
+			}
+			page, err := readStaticPage(root, "index.html")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(page) != want {
+				t.Errorf("index.html is not served from the %s backend", tt.wantMode)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errorPageData is what an error page template is executed with. Message
+// is empty when it would only repeat StatusText.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// errorPages holds templates named <status>.html plus an optional generic
+// error.html used for every other error status.
+type errorPages struct {
+	pages    map[int]*template.Template
+	fallback *template.Template
+}
+
+func loadErrorPages(dir string) (*errorPages, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &errorPages{pages: make(map[int]*template.Template)}
+	for _, file := range files {
+		base := strings.TrimSuffix(filepath.Base(file), ".html")
+
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", file, err)
+		}
+
+		if base == "error" {
+			p.fallback = tmpl
+			continue
+		}
+		if status, err := strconv.Atoi(base); err == nil && status >= 400 && status <= 599 {
+			p.pages[status] = tmpl
+		}
+	}
+
+	return p, nil
+}
+
+func (p *errorPages) lookup(status int) *template.Template {
+	if tmpl, ok := p.pages[status]; ok {
+		return tmpl
+	}
+	return p.fallback
+}
+
+// ErrorPages renders the bodies of error responses that a handler left to
+// net/http, such as those of http.Error and http.FileServer, with
+// renderError, so that they follow Accept like any other error. Responses
+// whose body the handler chose itself, anything that is not text/plain or
+// has a Content-Length, are left alone.
+func ErrorPages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorPageWriter{
+			responseWriter: responseWriter{ResponseWriter: w},
+			r:              r,
+		}, r)
+	})
+}
+
+type errorPageWriter struct {
+	responseWriter
+	r           *http.Request
+	intercepted bool
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.status != 0 || status < 400 || !defaultErrorBody(ew.Header()) {
+		ew.responseWriter.WriteHeader(status)
+		return
+	}
+
+	ew.intercepted = true
+	renderError(&ew.responseWriter, ew.r, status, errorCodeForStatus(status), http.StatusText(status), nil)
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.intercepted {
+		return len(b), nil
+	}
+	return ew.responseWriter.Write(b)
+}
+
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.intercepted {
+		return io.Copy(io.Discard, src)
+	}
+	return ew.responseWriter.ReadFrom(src)
+}
+
+// defaultErrorBody reports whether a response with h has the body net/http
+// gives errors: plain text or no type, and no Content-Length, which
+// http.Error removes and renderError sets.
+func defaultErrorBody(h http.Header) bool {
+	ctype := h.Get("Content-Type")
+	return h.Get("Content-Length") == "" && (ctype == "" || strings.HasPrefix(ctype, "text/plain"))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats error responses are rendered in.
+const (
+	errorFormatJSON = "json"
+	errorFormatHTML = "html"
+	errorFormatText = "text"
+)
+
+// errorFormatTypes are the media types of the formats, in the order a tie
+// between them is broken in on API paths.
+var errorFormatTypes = []struct{ format, mediaType string }{
+	{errorFormatJSON, "application/json"},
+	{errorFormatHTML, "text/html"},
+	{errorFormatText, "text/plain"},
+}
+
+// errorFormat picks the format of an error response to r: the one Accept
+// gives the highest quality. A missing Accept, one that only has */*, or
+// one that accepts none of the formats leaves the choice to the route:
+// JSON on API paths, plain text elsewhere, as browsers ask for text/html
+// explicitly while curl and scripts do not.
+func errorFormat(r *http.Request) string {
+	fallback := errorFormatText
+	if isAPIPath(r.URL.Path) {
+		fallback = errorFormatJSON
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return fallback
+	}
+
+	best, bestQ := fallback, 0.0
+	for _, t := range errorFormatTypes {
+		q := acceptQuality(accept, t.mediaType)
+		if q > bestQ || q == bestQ && q > 0 && t.format == fallback {
+			best, bestQ = t.format, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality Accept gives mediaType, from its most
+// specific matching range.
+func acceptQuality(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		rng = strings.ToLower(strings.TrimSpace(rng))
+		s := -1
+		switch rng {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
+}
+
+// renderError answers with an error in the format errorFormat picks: the
+// JSON envelope, the error page for the status or a single line of plain
+// text, each with status and the request ID. Nothing is written, and the
+// conflict is logged, when the response has already started.
+func renderError(w http.ResponseWriter, r *http.Request, status int, code, message string, details any) {
+	if responseCommitted(w) {
+		LoggerFromContext(r.Context()).Warn("Error response dropped, response already started",
+			slog.Int("status", status),
+			slog.String("code", code),
+			slog.String("caller", conflictCaller()),
+		)
+		markResponseConflict(w)
+		return
+	}
+
+	h := w.Header()
+	addVary(h, "Accept")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	requestID := RequestIDFromContext(r.Context())
+	switch errorFormat(r) {
+	case errorFormatJSON:
+		writeJSON(w, status, errorEnvelope{Error: errorBody{
+			Code:      code,
+			Message:   message,
+			RequestID: requestID,
+			Details:   details,
+		}})
+	case errorFormatHTML:
+		writeErrorBody(w, r, status, "text/html; charset=utf-8", errorPage(r.Context(), status, code, message, requestID))
+	default:
+		line := strconv.Itoa(status) + " " + http.StatusText(status)
+		if message != "" && !strings.EqualFold(message, http.StatusText(status)) {
+			line += ": " + message
+		}
+		if requestID != "" {
+			line += " (request_id " + requestID + ")"
+		}
+		writeErrorBody(w, r, status, "text/plain; charset=utf-8", []byte(line+"\n"))
+	}
+	closeResponse(w)
+}
+
+func writeErrorBody(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+type errorPagesKey struct{}
+
+// WithErrorPages makes the ERROR_PAGES_DIR templates the HTML errors of
+// renderError. It goes ahead of every middleware that may answer with an
+// error, Recover included.
+func WithErrorPages(pages *errorPages, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorPagesKey{}, pages)))
+	})
+}
+
+// defaultErrorPage is the HTML error without a template for the status in
+// ERROR_PAGES_DIR.
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+{{if .Message}}<p>{{.Message}}</p>
+{{end}}{{if .RequestID}}<p><small>Request ID: <code>{{.RequestID}}</code></small></p>
+{{end}}</body>
+</html>
+`))
+
+// errorPage renders the error page for status, from ERROR_PAGES_DIR when it
+// has one.
+func errorPage(ctx context.Context, status int, code, message, requestID string) []byte {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		RequestID:  requestID,
+	}
+	if !strings.EqualFold(message, data.StatusText) {
+		data.Message = message
+	}
+
+	var body bytes.Buffer
+	if pages, ok := ctx.Value(errorPagesKey{}).(*errorPages); ok && pages != nil {
+		if tmpl := pages.lookup(status); tmpl != nil {
+			if err := tmpl.Execute(&body, data); err == nil {
+				return body.Bytes()
+			}
+			LoggerFromContext(ctx).Warn("Could not render the error page, using the default", slog.Int("status", status))
+			body.Reset()
+		}
+	}
+	defaultErrorPage.Execute(&body, data)
+	return body.Bytes()
+}
+
+// errorCodeForStatus is the code of an error answered with only a status,
+// such as one from http.Error.
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return errCodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return errCodeBodyTooLarge
+	case http.StatusInternalServerError:
+		return errCodeInternal
+	}
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		case c == ' ' || c == '-':
+			return '_'
+		}
+		return -1
+	}, http.StatusText(status))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorFormat(t *testing.T) {
+	tests := []struct {
+		path   string
+		accept string
+		want   string
+	}{
+		{"/api/sendMessage", "", errorFormatJSON},
+		{"/app.js", "", errorFormatText},
+		{"/admin/config", "", errorFormatJSON},
+		{"/webhook", "", errorFormatJSON},
+		{"/api/sendMessage", "*/*", errorFormatJSON},
+		{"/app.js", "*/*", errorFormatText},
+		{"/app.js", "application/json", errorFormatJSON},
+		{"/api/sendMessage", "text/html", errorFormatHTML},
+		{"/api/sendMessage", "text/plain", errorFormatText},
+		{"/app.js", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", errorFormatHTML},
+		{"/api/sendMessage", "text/html;q=0.5, application/json", errorFormatJSON},
+		{"/api/sendMessage", "application/json;q=0.2, text/plain;q=0.9", errorFormatText},
+		{"/app.js", "text/*", errorFormatText},
+		{"/api/sendMessage", "text/*", errorFormatHTML},
+		{"/api/sendMessage", "TEXT/HTML", errorFormatHTML},
+		{"/api/sendMessage", "image/png", errorFormatJSON},
+		{"/app.js", "image/png", errorFormatText},
+		{"/app.js", "text/html;q=0", errorFormatText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if got := errorFormat(req); got != tt.want {
+				t.Errorf("errorFormat = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkErrorShape checks that rec is the error status in the format the
+// media type names, carrying the request ID.
+func checkErrorShape(t *testing.T, rec *httptest.ResponseRecorder, status int, mediaType, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d", rec.Code, status)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, mediaType) {
+		t.Errorf("Content-Type = %q, want %s", ct, mediaType)
+	}
+	requestID := rec.Header().Get(requestIDHeader)
+	if requestID == "" {
+		t.Fatal("no request ID")
+	}
+	body := rec.Body.String()
+	switch mediaType {
+	case "application/json":
+		var env errorEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+			t.Fatalf("body %q: %v", body, err)
+		}
+		if env.Error.Code != code || env.Error.RequestID != requestID {
+			t.Errorf("envelope = %+v, want code %s and request ID %s", env.Error, code, requestID)
+		}
+	case "text/html":
+		if !strings.HasPrefix(body, "<!doctype html>") || !strings.Contains(body, "<code>"+requestID+"</code>") {
+			t.Errorf("body is not the error page with the request ID: %q", body)
+		}
+	case "text/plain":
+		if !strings.HasPrefix(body, strconv.Itoa(status)+" "+http.StatusText(status)) ||
+			!strings.HasSuffix(body, " (request_id "+requestID+")\n") || strings.Count(body, "\n") != 1 {
+			t.Errorf("body is not a single line with the request ID: %q", body)
+		}
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		accept   string
+		message  string
+		wantType string
+		wantBody string
+	}{
+		{"JSON", http.MethodGet, "application/json", "no such chat", "application/json", `"message":"no such chat"`},
+		{"HTML", http.MethodGet, "text/html", "no such chat", "text/html", "<p>no such chat</p>"},
+		{"HTML escapes the message", http.MethodGet, "text/html", "<script>", "text/html", "<p>&lt;script&gt;</p>"},
+		{"HTML without a message", http.MethodGet, "text/html", "Not Found", "text/html", "<h1>404 Not Found</h1>\n<p><small>"},
+		{"text", http.MethodGet, "text/plain", "no such chat", "text/plain", "404 Not Found: no such chat (request_id "},
+		{"text without a message", http.MethodGet, "text/plain", "not found", "text/plain", "404 Not Found (request_id "},
+		{"HEAD", http.MethodHead, "text/plain", "no such chat", "text/plain", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Length", "99")
+				renderError(w, r, http.StatusNotFound, errCodeNotFound, tt.message, nil)
+			}))
+			req := httptest.NewRequest(tt.method, "/api/chats/1", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if tt.method == http.MethodHead {
+				if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") == "" {
+					t.Errorf("HEAD got %d bytes, Content-Length %q", rec.Body.Len(), rec.Header().Get("Content-Length"))
+				}
+			} else {
+				checkErrorShape(t, rec, http.StatusNotFound, tt.wantType, errCodeNotFound)
+				if !strings.Contains(rec.Body.String(), tt.wantBody) {
+					t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+				}
+			}
+			if rec.Header().Get("Content-Encoding") != "" {
+				t.Error("the handler's Content-Encoding was kept")
+			}
+			if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Accept") {
+				t.Errorf("Vary = %q, want Accept", vary)
+			}
+		})
+	}
+}
+
+func TestErrorCodeForStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusUnauthorized, errCodeUnauthorized},
+		{http.StatusNotFound, errCodeNotFound},
+		{http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{http.StatusRequestEntityTooLarge, errCodeBodyTooLarge},
+		{http.StatusInternalServerError, errCodeInternal},
+		{http.StatusTeapot, "im_a_teapot"},
+		{http.StatusServiceUnavailable, "service_unavailable"},
+		{http.StatusRequestURITooLong, "request_uri_too_long"},
+	}
+	for _, tt := range tests {
+		if got := errorCodeForStatus(tt.status); got != tt.want {
+			t.Errorf("errorCodeForStatus(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestMiddlewareErrorNegotiation answers the same failure from each
+// middleware that renders errors, for each Accept.
+func TestMiddlewareErrorNegotiation(t *testing.T) {
+	captureDefaultLog(t)
+	discard := slog.New(slog.DiscardHandler)
+	failures := []struct {
+		name    string
+		handler http.Handler
+		status  int
+		code    string
+	}{
+		{"Recover", Recover(discard, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})), http.StatusInternalServerError, errCodeInternal},
+		{"Timeout", Timeout(10*time.Millisecond, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})), http.StatusServiceUnavailable, errCodeRequestTimeout},
+		{"AllowMethods", AllowMethods(staticMethods, http.NotFoundHandler()), http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+	}
+	accepts := []struct{ accept, mediaType string }{
+		{"application/json", "application/json"},
+		{"text/html", "text/html"},
+		{"text/plain", "text/plain"},
+		{"", "text/plain"},
+	}
+	for _, f := range failures {
+		for _, a := range accepts {
+			t.Run(f.name+" "+a.accept, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, "/app.js", nil)
+				if a.accept != "" {
+					req.Header.Set("Accept", a.accept)
+				}
+				rec := httptest.NewRecorder()
+				RequestID(f.handler).ServeHTTP(rec, req)
+				checkErrorShape(t, rec, f.status, a.mediaType, f.code)
+			})
+		}
+	}
+}
+
+func TestServerErrorNegotiation(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	targets := []struct {
+		method, path string
+		status       int
+		code         string
+		fallback     string
+	}{
+		{http.MethodGet, "/missing.js", http.StatusNotFound, errCodeNotFound, "text/plain"},
+		{http.MethodGet, "/api/nothing/here", http.StatusNotFound, errCodeNotFound, "application/json"},
+		{http.MethodPost, "/app.js", http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "text/plain"},
+		{http.MethodGet, "/api/getSettings", http.StatusUnauthorized, errCodeUnauthorized, "application/json"},
+	}
+	accepts := []string{"application/json", "text/html", "text/plain", "", "*/*"}
+	for _, target := range targets {
+		for _, accept := range accepts {
+			t.Run(target.method+" "+target.path+" "+accept, func(t *testing.T) {
+				req := httptest.NewRequestWithContext(context.Background(), target.method, target.path, nil)
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				rec := httptest.NewRecorder()
+				s.Handler().ServeHTTP(rec, req)
+				mediaType := accept
+				if accept == "" || accept == "*/*" {
+					mediaType = target.fallback
+				}
+				checkErrorShape(t, rec, target.status, mediaType, target.code)
+			})
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// eventsPath streams notifications as Server-Sent Events.
+const eventsPath = "/events"
+
+// Events streams notifications as Server-Sent Events, for clients that
+// cannot use the WebSocket: one event per notification, its ID counting up,
+// and a comment every heartbeat so proxies keep the connection open. A
+// client reconnecting with Last-Event-ID first gets the kept events it
+// missed. Like /ws it takes a chatId query parameter.
+func (h *notificationHub) Events(w http.ResponseWriter, r *http.Request) {
+	var chatID string
+	if raw := r.URL.Query().Get("chatId"); raw != "" {
+		var err error
+		if chatID, err = normalizeChatID(raw, ""); err != nil {
+			var v validation
+			v.check("chatId", err)
+			writeValidationError(w, r, v.errs)
+			return
+		}
+	}
+	var lastID uint64
+	replay := false
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			var v validation
+			v.add("Last-Event-ID", "event_id", "must be an event ID from this stream")
+			writeValidationError(w, r, v.errs)
+			return
+		}
+		lastID, replay = id, true
+	}
+
+	c, missed, ok := h.subscribe(chatID, lastID, replay)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		WriteError(w, r, http.StatusServiceUnavailable, errCodeShuttingDown, "server is shutting down", nil)
+		return
+	}
+	defer h.unsubscribe(c)
+
+	rc := http.NewResponseController(w)
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	logger := LoggerFromContext(r.Context()).With(slog.String("chat_id", chatID))
+	logger.Debug("Event stream opened", slog.Int("replayed", len(missed)))
+
+	bw := bufio.NewWriter(w)
+	// WRITE_TIMEOUT is meant for ordinary requests; each write to the stream
+	// gets its own deadline instead.
+	send := func(write func()) bool {
+		_ = setWriteDeadline(w, r, time.Now().Add(wsWriteTimeout))
+		write()
+		if bw.Flush() != nil || rc.Flush() != nil {
+			return false
+		}
+		return true
+	}
+
+	// The first line tells EventSource how long to wait before
+	// reconnecting.
+	if !send(func() {
+		bw.WriteString("retry: 1000\n\n")
+		for _, ev := range missed {
+			writeEvent(bw, ev)
+		}
+	}) {
+		return
+	}
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-c.send:
+			if !ok {
+				if c.closeCode == wsClosePolicy {
+					logger.Warn("Event stream client too slow, disconnected", slog.Int("buffer", h.bufferSize))
+				}
+				logger.Debug("Event stream closed by the server")
+				return
+			}
+			if !send(func() { writeEvent(bw, ev) }) {
+				return
+			}
+		case <-ticker.C:
+			if !send(func() { bw.WriteString(":\n\n") }) {
+				return
+			}
+		case <-r.Context().Done():
+			logger.Debug("Event stream closed")
+			return
+		}
+	}
+}
+
+func writeEvent(bw *bufio.Writer, ev streamEvent) {
+	bw.WriteString("id: ")
+	bw.WriteString(strconv.FormatUint(ev.id, 10))
+	bw.WriteString("\ndata: ")
+	bw.Write(ev.data)
+	bw.WriteString("\n\n")
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one block of an event stream: an event, a comment or the
+// retry line.
+type sseEvent struct {
+	id, data, comment, retry string
+}
+
+// sseStream reads an event stream incrementally.
+type sseStream struct {
+	resp   *http.Response
+	events chan sseEvent
+	err    chan error
+}
+
+// openEvents opens url as an event stream, sending Last-Event-ID when
+// lastID is not empty.
+func openEvents(t *testing.T, url, lastID string) (*sseStream, *http.Response) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp
+	}
+
+	s := &sseStream{resp: resp, events: make(chan sseEvent), err: make(chan error, 1)}
+	go func() {
+		br := bufio.NewReader(resp.Body)
+		var ev sseEvent
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				s.err <- err
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "":
+				if line == "" {
+					select {
+					case s.events <- ev:
+					case <-ctx.Done():
+						return
+					}
+					ev = sseEvent{}
+					continue
+				}
+				ev.comment = value
+				if ev.comment == "" {
+					ev.comment = ":"
+				}
+			case "id":
+				ev.id = value
+			case "data":
+				ev.data = value
+			case "retry":
+				ev.retry = value
+			}
+		}
+	}()
+	return s, resp
+}
+
+// next returns the next block of the stream, failing the test after 5s.
+func (s *sseStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case ev := <-s.events:
+		return ev
+	case err := <-s.err:
+		t.Fatalf("stream ended: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5s")
+	}
+	return sseEvent{}
+}
+
+// nextEvent skips comments up to the next event and returns its ID and the
+// idMessage of its notification.
+func (s *sseStream) nextEvent(t *testing.T) (string, string) {
+	t.Helper()
+	for {
+		ev := s.next(t)
+		if ev.data == "" {
+			continue
+		}
+		var msg struct {
+			IDMessage string `json:"idMessage"`
+		}
+		if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+			t.Fatalf("data %q: %v", ev.data, err)
+		}
+		return ev.id, msg.IDMessage
+	}
+}
+
+// openEventStream opens url and reads past the retry line.
+func openEventStream(t *testing.T, url, lastID string) *sseStream {
+	t.Helper()
+	s, resp := openEvents(t, url, lastID)
+	if s == nil {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if ev := s.next(t); ev.retry != "1000" {
+		t.Fatalf("first block = %+v, want the retry line", ev)
+	}
+	return s
+}
+
+func TestEvents(t *testing.T) {
+	const alice, bob = "79001234567@c.us", "79007654321@c.us"
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"every chat", "", "1:A1 2:B1 3:A2"},
+		{"one chat", "?chatId=" + alice, "1:A1 3:A2"},
+		{"phone number", "?chatId=79007654321", "2:B1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, srv := newTestHub(t, nil)
+			s := openEventStream(t, srv.URL+eventsPath+tt.query, "")
+			if ct := s.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			if cc := s.resp.Header.Get("Cache-Control"); cc != "no-cache" {
+				t.Errorf("Cache-Control = %q", cc)
+			}
+			waitConnections(t, hub, 1)
+
+			hub.publish(chatNotification(alice, "A1"))
+			hub.publish(chatNotification(bob, "B1"))
+			hub.publish(chatNotification(alice, "A2"))
+			var got []string
+			for range strings.Fields(tt.want) {
+				id, msg := s.nextEvent(t)
+				got = append(got, id+":"+msg)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventsReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		lastID string
+		query  string
+		want   string
+	}{
+		{"after a brief disconnect", "3", "", "4:M4 5:M5 6:LIVE"},
+		{"up to date", "5", "", "6:LIVE"},
+		{"older than the buffer", "0", "", "3:M3 4:M4 5:M5 6:LIVE"},
+		{"filtered", "2", "?chatId=79007654321@c.us", "3:M3 5:M5 6:LIVE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, srv := newTestHub(t, func(o *hubOptions) { o.ReplaySize = 3 })
+			url := srv.URL + eventsPath + tt.query
+
+			// Read the first events, then miss some while disconnected.
+			first := openEventStream(t, srv.URL+eventsPath, "")
+			waitConnections(t, hub, 1)
+			chats := []string{"79001234567@c.us", "79007654321@c.us"}
+			for i := 1; i <= 2; i++ {
+				hub.publish(chatNotification(chats[i%2], "M"+string(rune('0'+i))))
+			}
+			for range 2 {
+				first.nextEvent(t)
+			}
+			first.resp.Body.Close()
+			waitConnections(t, hub, 0)
+			for i := 3; i <= 5; i++ {
+				hub.publish(chatNotification(chats[i%2], "M"+string(rune('0'+i))))
+			}
+
+			s := openEventStream(t, url, tt.lastID)
+			waitConnections(t, hub, 1)
+			hub.publish(chatNotification(chats[1], "LIVE"))
+			var got []string
+			for range strings.Fields(tt.want) {
+				id, msg := s.nextEvent(t)
+				got = append(got, id+":"+msg)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventsRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		lastID string
+		want   string
+	}{
+		{"invalid Last-Event-ID", "", "abc", "Last-Event-ID:event_id"},
+		{"invalid chatId", "?chatId=abc", "", "chatId:phone_numeric"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newTestHub(t, nil)
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+eventsPath+tt.query, nil)
+			req.Header.Set("Accept", "application/json")
+			if tt.lastID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", resp.StatusCode)
+			}
+			var env apiError
+			json.NewDecoder(resp.Body).Decode(&env)
+			var details struct{ Fields []fieldError }
+			json.Unmarshal(env.Error.Details, &details)
+			if problems(details.Fields) != tt.want {
+				t.Errorf("details = %s, want %s", env.Error.Details, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	_, srv := newTestHub(t, func(o *hubOptions) { o.Heartbeat = 20 * time.Millisecond })
+	s := openEventStream(t, srv.URL+eventsPath, "")
+	for range 3 {
+		if ev := s.next(t); ev.comment != ":" || ev.data != "" {
+			t.Fatalf("got %+v, want a heartbeat comment", ev)
+		}
+	}
+}
+
+func TestEventsEndOnShutdown(t *testing.T) {
+	hub, srv := newTestHub(t, nil)
+	s := openEventStream(t, srv.URL+eventsPath, "")
+	waitConnections(t, hub, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := hub.Close(ctx); err != nil {
+		t.Fatalf("Close = %v, the stream did not end", err)
+	}
+	select {
+	case err := <-s.err:
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("stream ended with %v, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stream is still open after Close")
+	}
+
+	_, resp := openEvents(t, srv.URL+eventsPath, "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("after Close: %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestEventsThroughServer(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	// The logging, timeout and compression wrappers have to flush each event.
+	stream := openEventStream(t, serverURL(t, s, "http", eventsPath), "")
+	waitFor(t, "the event stream", func() bool {
+		return strings.Contains(serve(s, http.MethodGet, "/metrics", nil).Body.String(), "\nws_connections 1\n")
+	})
+
+	body := `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":1700000000,"idMessage":"BAE5","senderData":{"chatId":"79007654321@c.us","sender":"79007654321@c.us"}}`
+	post, err := http.Post(serverURL(t, s, "http", "/webhook"), "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if id, msg := stream.nextEvent(t); id != "1" || msg != "BAE5" {
+		t.Errorf("got event %s %s", id, msg)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileCache keeps the contents of small static files in memory, evicting the
+// least recently used ones once maxBytes is exceeded. Files served from disk
+// are invalidated through fsnotify as soon as they change.
+type fileCache struct {
+	maxBytes    int64
+	maxFileSize int64
+	logger      *slog.Logger
+	watcher     *fsnotify.Watcher
+
+	mu         sync.Mutex
+	roots      int
+	entries    map[string]*list.Element
+	lru        *list.List
+	size       int64
+	watched    map[string]bool
+	generation uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type fileCacheEntry struct {
+	key     string
+	content []byte
+	info    fs.FileInfo
+	etag    string
+}
+
+func newFileCache(maxBytes, maxFileSize int64, logger *slog.Logger) (*fileCache, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCache{
+		maxBytes:    maxBytes,
+		maxFileSize: min(maxFileSize, maxBytes),
+		logger:      logger,
+		watcher:     watcher,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		watched:     make(map[string]bool),
+	}
+	go c.watch()
+	return c, nil
+}
+
+func (c *fileCache) Close() error {
+	return c.watcher.Close()
+}
+
+// FileSystem wraps root so that small regular files are served from the
+// cache. dir is the directory root reads from and is used to watch for
+// changes; it is empty for file systems that never change, such as embed.FS.
+func (c *fileCache) FileSystem(root http.FileSystem, dir string) (http.FileSystem, error) {
+	fsys := &cachedFileSystem{cache: c, root: root}
+	if dir == "" {
+		c.mu.Lock()
+		c.roots++
+		fsys.id = "fs" + strconv.Itoa(c.roots) + ":"
+		c.mu.Unlock()
+		return fsys, nil
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fsys.dir = abs
+	return fsys, nil
+}
+
+func (c *fileCache) get(key string) *fileCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*fileCacheEntry)
+}
+
+func (c *fileCache) put(entry *fileCacheEntry, generation uint64, watchDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The file changed while it was being read.
+	if generation != c.generation {
+		return
+	}
+
+	if watchDir != "" && !c.watched[watchDir] {
+		if err := c.watcher.Add(watchDir); err != nil {
+			c.logger.Warn("Could not watch static directory, not caching",
+				slog.String("dir", watchDir),
+				slog.Any("error", err),
+			)
+			return
+		}
+		c.watched[watchDir] = true
+	}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.content))
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *fileCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*fileCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.content))
+}
+
+// invalidate drops the entry for name and, in case name was a directory,
+// every entry below it.
+func (c *fileCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	prefix := name + string(filepath.Separator)
+	for key, elem := range c.entries {
+		if key == name || strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+		}
+	}
+	for dir := range c.watched {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(c.watched, dir)
+		}
+	}
+}
+
+func (c *fileCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *fileCache) snapshot() (generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *fileCache) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			c.invalidate(event.Name)
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been dropped, so nothing cached can be trusted.
+			c.logger.Warn("Static file watcher failed, flushing cache", slog.Any("error", err))
+			c.flush()
+		}
+	}
+}
+
+// Usage returns the number of cached files and their total size.
+func (c *fileCache) Usage() (entries int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
+
+type cachedFileSystem struct {
+	cache *fileCache
+	root  http.FileSystem
+	dir   string
+	id    string
+}
+
+func (fsys *cachedFileSystem) Open(name string) (http.File, error) {
+	key, watchDir := fsys.key(name)
+	if entry := fsys.cache.get(key); entry != nil {
+		fsys.cache.hits.Add(1)
+		return &cachedFile{Reader: bytes.NewReader(entry.content), entry: entry}, nil
+	}
+
+	generation := fsys.cache.snapshot()
+
+	f, err := fsys.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() > fsys.cache.maxFileSize {
+		return f, nil
+	}
+	defer f.Close()
+	fsys.cache.misses.Add(1)
+
+	content, err := io.ReadAll(io.LimitReader(f, fsys.cache.maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > fsys.cache.maxFileSize {
+		// The file grew after Stat; serve it without caching.
+		return fsys.root.Open(name)
+	}
+
+	tag, err := hashETag(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &fileCacheEntry{key: key, content: content, info: info, etag: tag}
+	fsys.cache.put(entry, generation, watchDir)
+
+	return &cachedFile{Reader: bytes.NewReader(content), entry: entry}, nil
+}
+
+// key identifies name across all cached file systems: the absolute path on
+// disk, which is also what fsnotify reports, or a per-root key otherwise.
+func (fsys *cachedFileSystem) key(name string) (key, watchDir string) {
+	if fsys.dir == "" {
+		return fsys.id + name, ""
+	}
+	key = filepath.Join(fsys.dir, filepath.FromSlash(name))
+	return key, filepath.Dir(key)
+}
+
+type cachedFile struct {
+	*bytes.Reader
+	entry *fileCacheEntry
+}
+
+func (f *cachedFile) Close() error { return nil }
+
+func (f *cachedFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fileProbeMaxRedirects is how many redirects the check of urlFile
+// follows.
+const fileProbeMaxRedirects = 2
+
+// Reasons a urlFile is rejected, given as details.reason.
+const (
+	fileRejectNotFound    = "not_found"
+	fileRejectUnavailable = "unavailable"
+	fileRejectUnreachable = "unreachable"
+	fileRejectTimeout     = "timeout"
+	fileRejectTooLarge    = "too_large"
+	fileRejectContentType = "content_type"
+	fileRejectPrivateHost = "private_host"
+	fileRejectRedirects   = "too_many_redirects"
+	fileRejectBadRedirect = "invalid_redirect"
+)
+
+var (
+	errProbePrivateAddr = errors.New("address is private")
+	errProbeRedirects   = errors.New("too many redirects")
+	errProbeScheme      = errors.New("redirect to a scheme other than http or https")
+)
+
+// fileProbe checks the urlFile of sendFileByUrl before GREEN-API is asked
+// to fetch it, as GREEN-API answers a missing, oversized or mistyped file
+// with an error that does not say which. It sends HEAD, or a GET of the
+// first byte when HEAD is not allowed, and reads only the headers.
+type fileProbe struct {
+	client   *http.Client
+	timeout  time.Duration
+	maxBytes ByteSize
+	// types are FILE_PROBE_TYPES; empty allows any.
+	types []string
+}
+
+// newFileProbe returns nil when FILE_PROBE_TIMEOUT is 0. Whatever
+// PRIVATE_URL_BLOCK says, every address dialed, those of redirects
+// included, is checked, so that a caller cannot make the server itself
+// reach loopback, private or link-local hosts. The check does not go
+// through a proxy, which would hide them.
+func newFileProbe(cfg *Config) *fileProbe {
+	if cfg.FileProbeTimeout <= 0 {
+		return nil
+	}
+	dialer := &net.Dialer{
+		Timeout: cfg.FileProbeTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			if addr, err := netip.ParseAddr(host); err == nil && privateAddr(addr.Unmap()) {
+				return errProbePrivateAddr
+			}
+			return nil
+		},
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+
+	types := make([]string, 0, len(cfg.FileProbeTypes))
+	for _, mediaType := range cfg.FileProbeTypes {
+		types = append(types, strings.ToLower(mediaType))
+	}
+	return &fileProbe{
+		client: &http.Client{
+			Transport: t,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > fileProbeMaxRedirects {
+					return errProbeRedirects
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return errProbeScheme
+				}
+				return nil
+			},
+		},
+		timeout:  cfg.FileProbeTimeout,
+		maxBytes: cfg.FileProbeMaxBytes,
+		types:    types,
+	}
+}
+
+// check returns a 422 error saying what is wrong with the file at rawURL,
+// or nil when nothing is.
+func (p *fileProbe) check(ctx context.Context, rawURL string) *HTTPError {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := p.do(ctx, http.MethodHead, rawURL)
+	if err == nil && headRefused(resp.StatusCode) {
+		resp.Body.Close()
+		resp, err = p.do(ctx, http.MethodGet, rawURL)
+	}
+	if err != nil {
+		return p.unreachable(ctx, rawURL, err)
+	}
+	// Only the headers are needed; the body of a GET that ignored Range is
+	// dropped with the connection.
+	resp.Body.Close()
+
+	// The status is only logged: the client is told what it means, not
+	// what a host it may not reach itself answered.
+	status := resp.StatusCode
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		rejected := fileRejected(fileRejectNotFound, "urlFile was not found", nil)
+		rejected.Attrs = append(rejected.Attrs, slog.Int("url_status", status))
+		return rejected
+	case status >= http.StatusBadRequest:
+		rejected := fileRejected(fileRejectUnavailable, "urlFile cannot be downloaded", nil)
+		rejected.Attrs = append(rejected.Attrs, slog.Int("url_status", status))
+		return rejected
+	}
+
+	if size := responseSize(resp); size > int64(p.maxBytes) {
+		return fileRejected(fileRejectTooLarge, fmt.Sprintf("file is %s, limit is %s", formatFileSize(size), formatFileSize(int64(p.maxBytes))),
+			map[string]any{"size": size, "limit": int64(p.maxBytes)})
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !p.allowed(contentType) {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if mediaType == "" {
+			mediaType = contentType
+		}
+		return fileRejected(fileRejectContentType, fmt.Sprintf("file type %s is not allowed", mediaType),
+			map[string]any{"content_type": mediaType, "allowed": p.types})
+	}
+	return nil
+}
+
+// do sends method for rawURL; a GET asks for the first byte only.
+func (p *fileProbe) do(ctx context.Context, method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return p.client.Do(req)
+}
+
+// headRefused reports whether a server answering HEAD with status may well
+// serve GET; some, such as signed storage URLs, only sign GET.
+func headRefused(status int) bool {
+	return status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented || status == http.StatusForbidden
+}
+
+// responseSize is the size of the whole file, from Content-Range for a
+// ranged answer; -1 when unknown.
+func responseSize(resp *http.Response) int64 {
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.ContentLength
+	}
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (p *fileProbe) allowed(contentType string) bool {
+	if len(p.types) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	major, _, ok := strings.Cut(mediaType, "/")
+	if !ok {
+		return false
+	}
+	for _, t := range p.types {
+		if t == mediaType || t == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// unreachable maps a request that got no answer.
+func (p *fileProbe) unreachable(ctx context.Context, rawURL string, err error) *HTTPError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errProbePrivateAddr):
+		return fileRejected(fileRejectPrivateHost, "urlFile points to a private address", nil)
+	case errors.Is(err, errProbeRedirects):
+		return fileRejected(fileRejectRedirects, fmt.Sprintf("urlFile redirects more than %d times", fileProbeMaxRedirects), nil)
+	case errors.Is(err, errProbeScheme):
+		return fileRejected(fileRejectBadRedirect, "urlFile redirects to a URL other than http or https", nil)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return fileRejected(fileRejectTimeout, fmt.Sprintf("urlFile did not answer within %s", p.timeout), nil)
+	}
+	rejected := fileRejected(fileRejectUnreachable, "urlFile cannot be reached", nil)
+	if u, parseErr := url.Parse(rawURL); parseErr == nil {
+		rejected.Attrs = append(rejected.Attrs, slog.String("url_host", u.Host))
+	}
+	rejected.Err = err
+	return rejected
+}
+
+func fileRejected(reason, message string, details map[string]any) *HTTPError {
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["reason"] = reason
+	return &HTTPError{Status: http.StatusUnprocessableEntity, Code: errCodeURLFileRejected, Message: message,
+		Details: details, Attrs: []slog.Attr{slog.String("reason", reason)}}
+}
+
+// formatFileSize writes n bytes in the largest unit that leaves at least 1,
+// with one decimal at most: 210MB, 1.5GB.
+func formatFileSize(n int64) string {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}}
+	for _, unit := range units {
+		if n >= unit.size {
+			return strconv.FormatFloat(math.Floor(float64(n)/float64(unit.size)*10)/10, 'f', -1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFormatFileSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1 << 10, "1KB"},
+		{1536, "1.5KB"},
+		{210 << 20, "210MB"},
+		{100 << 20, "100MB"},
+		{(1 << 30) + (1 << 29), "1.5GB"},
+		{(1 << 20) - 1, "1023.9KB"},
+	}
+	for _, tt := range tests {
+		if got := formatFileSize(tt.n); got != tt.want {
+			t.Errorf("formatFileSize(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+// fileHost serves files of every kind the probe rejects, and some it does
+// not. It stands for a public host: newTestFileProbe dials it for any name
+// but unreachable.test, and refuses private addresses as the probe does.
+func fileHost(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var host *httptest.Server
+	file := func(contentType string, size int64) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+		}
+	}
+	// signed answers HEAD with status, and a GET only when it asks for the
+	// first byte.
+	signed := func(status int, contentType string, size int64) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(status)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("GET asked for Range %q", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", size))
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "x")
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/photo.png", file("image/png", 1000))
+	mux.HandleFunc("/report.pdf", file("application/pdf; name=report.pdf", 1<<20))
+	mux.HandleFunc("/big.mp4", file("video/mp4", 210<<20))
+	mux.HandleFunc("/page.html", file("text/html; charset=utf-8", 10))
+	mux.HandleFunc("/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		w.Header().Set("Content-Length", "10")
+	})
+	mux.HandleFunc("/missing.png", http.NotFound)
+	mux.HandleFunc("/gone.png", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusGone) })
+	mux.HandleFunc("/broken.png", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+	mux.HandleFunc("/signed.png", signed(http.StatusForbidden, "image/png", 2000))
+	mux.HandleFunc("/signed.mp4", signed(http.StatusMethodNotAllowed, "video/mp4", 210<<20))
+	mux.HandleFunc("/nohead.png", signed(http.StatusNotImplemented, "image/png", 2000))
+	mux.HandleFunc("/signed-missing.png", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/hop/{n}", func(w http.ResponseWriter, r *http.Request) {
+		next := "/photo.png"
+		if n := r.PathValue("n"); n != "1" {
+			next = fmt.Sprintf("/hop/%d", n[0]-'0'-1)
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	})
+	mux.HandleFunc("/to-ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://files.example.com/photo.png", http.StatusFound)
+	})
+	mux.HandleFunc("/to-private", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, host.URL+"/photo.png", http.StatusFound)
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	host = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(host.Close)
+	return host
+}
+
+// newTestFileProbe returns the probe of cfg with its dials sent to host.
+func newTestFileProbe(t *testing.T, cfg *Config, host *httptest.Server) *fileProbe {
+	t.Helper()
+	p := newFileProbe(cfg)
+	p.client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		name, _, _ := net.SplitHostPort(address)
+		if addr, err := netip.ParseAddr(name); err == nil && privateAddr(addr.Unmap()) {
+			return nil, errProbePrivateAddr
+		}
+		if name == "unreachable.test" {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, host.Listener.Addr().String())
+	}
+	return p
+}
+
+func TestFileProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		wantReason  string
+		wantMessage string
+	}{
+		{"file", "http://files.example.com/photo.png", "", ""},
+		{"type with parameters", "http://files.example.com/report.pdf", "", ""},
+		{"no Content-Type", "http://files.example.com/untyped", "", ""},
+		{"HEAD refused, GET allowed", "http://files.example.com/signed.png", "", ""},
+		{"HEAD not implemented", "http://files.example.com/nohead.png", "", ""},
+		{"two redirects", "http://files.example.com/hop/2", "", ""},
+		{"missing", "http://files.example.com/missing.png", fileRejectNotFound, "urlFile was not found"},
+		{"gone", "http://files.example.com/gone.png", fileRejectNotFound, "urlFile was not found"},
+		{"missing behind a refused HEAD", "http://files.example.com/signed-missing.png", fileRejectNotFound, "urlFile was not found"},
+		{"error status", "http://files.example.com/broken.png", fileRejectUnavailable, "urlFile cannot be downloaded"},
+		{"too large", "http://files.example.com/big.mp4", fileRejectTooLarge, "file is 210MB, limit is 100MB"},
+		{"too large by Content-Range", "http://files.example.com/signed.mp4", fileRejectTooLarge, "file is 210MB, limit is 100MB"},
+		{"type not allowed", "http://files.example.com/page.html", fileRejectContentType, "file type text/html is not allowed"},
+		{"three redirects", "http://files.example.com/hop/3", fileRejectRedirects, "urlFile redirects more than 2 times"},
+		{"redirect to another scheme", "http://files.example.com/to-ftp", fileRejectBadRedirect, "urlFile redirects to a URL other than http or https"},
+		{"redirect to a private host", "http://files.example.com/to-private", fileRejectPrivateHost, "urlFile points to a private address"},
+		{"private host", "http://127.0.0.1/photo.png", fileRejectPrivateHost, "urlFile points to a private address"},
+		{"link-local host", "http://169.254.169.254/latest/meta-data", fileRejectPrivateHost, "urlFile points to a private address"},
+		{"unreachable", "http://unreachable.test/photo.png", fileRejectUnreachable, "urlFile cannot be reached"},
+		{"timeout", "http://files.example.com/slow.png", fileRejectTimeout, "urlFile did not answer within 200ms"},
+	}
+	var requests atomic.Int32
+	host := fileHost(t, &requests)
+	p := newTestFileProbe(t, testConfig(t, func(cfg *Config) { cfg.FileProbeTimeout = 200 * time.Millisecond }), host)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.check(context.Background(), tt.url)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("check = %d %s: %s", err.Status, err.Code, err.Message)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("check passed, want %s", tt.wantReason)
+			}
+			if err.Status != http.StatusUnprocessableEntity || err.Code != errCodeURLFileRejected || err.Message != tt.wantMessage {
+				t.Errorf("check = %d %s %q, want 422 %s %q", err.Status, err.Code, err.Message, errCodeURLFileRejected, tt.wantMessage)
+			}
+			if details, _ := err.Details.(map[string]any); details["reason"] != tt.wantReason {
+				t.Errorf("details = %v, want reason %s", err.Details, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestFileProbeTypes(t *testing.T) {
+	tests := []struct {
+		types       []string
+		contentType string
+		want        bool
+	}{
+		{nil, "text/html", true},
+		{[]string{"image/*"}, "image/webp", true},
+		{[]string{"image/*"}, "video/mp4", false},
+		{[]string{"Text/Plain"}, "text/plain; charset=utf-8", true},
+		{[]string{"text/plain"}, "text/csv", false},
+		{[]string{"image/*"}, "image", false},
+	}
+	for _, tt := range tests {
+		p := newFileProbe(testConfig(t, func(cfg *Config) { cfg.FileProbeTypes = tt.types }))
+		if got := p.allowed(tt.contentType); got != tt.want {
+			t.Errorf("%v allows %s: %t, want %t", tt.types, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+// TestFileProbeDialsNoPrivateAddress checks the probe as built, without
+// the dial of newTestFileProbe: it must not reach a host on loopback.
+func TestFileProbeDialsNoPrivateAddress(t *testing.T) {
+	var requests atomic.Int32
+	host := fileHost(t, &requests)
+	p := newFileProbe(testConfig(t, nil))
+	for _, url := range []string{host.URL + "/photo.png", strings.Replace(host.URL, "127.0.0.1", "localhost", 1) + "/photo.png"} {
+		err := p.check(context.Background(), url)
+		if err == nil || err.Details.(map[string]any)["reason"] != fileRejectPrivateHost {
+			t.Errorf("check(%s) = %v, want %s", url, err, fileRejectPrivateHost)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("the file host got %d requests", n)
+	}
+	if p := newFileProbe(testConfig(t, func(cfg *Config) { cfg.FileProbeTimeout = 0 })); p != nil {
+		t.Error("FILE_PROBE_TIMEOUT=0 built a probe")
+	}
+}
+
+func TestSendFileByURLProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		urlFile    string
+		wantStatus int
+		wantCode   string
+		wantReason string
+		wantProbe  bool
+	}{
+		{"file passes", "", "http://files.example.com/photo.png", http.StatusOK, "", "", true},
+		{"too large", "", "http://files.example.com/big.mp4", http.StatusUnprocessableEntity, errCodeURLFileRejected, fileRejectTooLarge, true},
+		{"missing", "?validate=true", "http://files.example.com/missing.png", http.StatusUnprocessableEntity, errCodeURLFileRejected, fileRejectNotFound, true},
+		{"check skipped", "?validate=false", "http://files.example.com/big.mp4", http.StatusOK, "", "", false},
+		{"bad validate", "?validate=perhaps", "http://files.example.com/photo.png", http.StatusBadRequest, errCodeValidation, "", false},
+		{"invalid body is not probed", "", "ftp://files.example.com/photo.png", http.StatusBadRequest, errCodeValidation, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureDefaultLog(t)
+			var sent atomic.Int32
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				sent.Add(1)
+				io.WriteString(w, `{"idMessage":"BAE7"}`)
+			})
+			var probed atomic.Int32
+			host := fileHost(t, &probed)
+			cfg := testConfig(t, withConfig(withUpstream(upstream), singleAttempt))
+			api := newGreenAPI(cfg, http.DefaultTransport, nil, nil, nil)
+			api.fileProbe = newTestFileProbe(t, cfg, host)
+
+			body := fmt.Sprintf(`{"chatId":"79001234567@c.us","urlFile":%q,"fileName":"file.bin"}`, tt.urlFile)
+			req := httptest.NewRequest(http.MethodPost, "/api/sendFileByUrl"+tt.query, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			HandlerE(api.SendFileByURL).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if (probed.Load() > 0) != tt.wantProbe {
+				t.Errorf("the file host got %d requests, want a probe %t", probed.Load(), tt.wantProbe)
+			}
+			if wantSent := int32(0); tt.wantStatus == http.StatusOK {
+				wantSent = 1
+				if sent.Load() != wantSent {
+					t.Errorf("GREEN-API got %d calls, want %d", sent.Load(), wantSent)
+				}
+				return
+			} else if sent.Load() != wantSent {
+				t.Errorf("a rejected file reached GREEN-API")
+			}
+			var envelope struct {
+				Error struct {
+					Code    string `json:"code"`
+					Details struct {
+						Reason string `json:"reason"`
+					} `json:"details"`
+				} `json:"error"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &envelope)
+			if envelope.Error.Code != tt.wantCode || envelope.Error.Details.Reason != tt.wantReason {
+				t.Errorf("error %s with reason %q, want %s with %q", envelope.Error.Code, envelope.Error.Details.Reason, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+// TestServerSendFileByURLProbe goes through the server, whose probe keeps
+// its own dialer: a file on loopback is refused unless validate=false.
+func TestServerSendFileByURLProbe(t *testing.T) {
+	var sent atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		io.WriteString(w, `{"idMessage":"BAE7"}`)
+	})
+	var probed atomic.Int32
+	host := fileHost(t, &probed)
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+	body := fmt.Sprintf(`{"chatId":"79001234567@c.us","urlFile":%q,"fileName":"photo.png"}`, host.URL+"/photo.png")
+
+	rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendFileByUrl", body, nil)
+	if rec.Code != http.StatusUnprocessableEntity || envelope.Error.Code != errCodeURLFileRejected {
+		t.Errorf("loopback file = %d %s", rec.Code, rec.Body)
+	}
+	if probed.Load() != 0 || sent.Load() != 0 {
+		t.Errorf("file host got %d requests, GREEN-API %d", probed.Load(), sent.Load())
+	}
+	if !strings.Contains(logs.String(), `"reason":"private_host"`) {
+		t.Errorf("the reason was not logged:\n%s", logs)
+	}
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendFileByUrl?validate=false", body, nil); rec.Code != http.StatusOK || sent.Load() != 1 {
+		t.Errorf("validate=false = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// FrontendConfig is what the browser app is told about the deployment, from
+// /config.js and /api/config. It is built field by field from Config rather
+// than by filtering it, so a setting only reaches the browser once it is
+// added here: tokens and passwords have no field to end up in.
+type FrontendConfig struct {
+	APIBase        string `json:"apiBase"`
+	PollIntervalMs int64  `json:"pollIntervalMs"`
+	Version        string `json:"version"`
+	// Instances are the names of GREENAPI_INSTANCES, served under
+	// /api/instances/{name}/.
+	Instances []string `json:"instances,omitempty"`
+	// Features holds FRONTEND_FEATURES plus what the server itself
+	// provides: "proxy" with GREENAPI_PROXY_METHODS, "sharedInstance"
+	// when a default instance is configured, so the app
+	// need not ask for credentials, "session" when they can be kept in the
+	// session cookie of /api/session, and "csrfToken" when unsafe API calls
+	// need X-CSRF-Token from /api/csrf.
+	Features map[string]bool `json:"features"`
+}
+
+func newFrontendConfig(cfg *Config, version string) FrontendConfig {
+	features := make(map[string]bool, len(cfg.FrontendFeatures)+4)
+	for _, name := range cfg.FrontendFeatures {
+		features[name] = true
+	}
+	features["proxy"] = len(cfg.GreenAPIProxyMethods) > 0
+	idInstance, apiToken := cfg.DefaultInstance()
+	features["sharedInstance"] = idInstance != "" && apiToken != ""
+	features["session"] = cfg.SessionKey != ""
+	features["csrfToken"] = cfg.CSRFMode == csrfModeToken
+
+	return FrontendConfig{
+		APIBase:        cfg.FrontendAPIBase,
+		PollIntervalMs: cfg.FrontendPollInterval.Milliseconds(),
+		Version:        version,
+		Instances:      cfg.GreenAPIInstances.names(),
+		Features:       features,
+	}
+}
+
+// frontendConfigPrefix and frontendConfigSuffix wrap the JSON in
+// /config.js.
+const (
+	frontendConfigPrefix = "window.__APP_CONFIG__ = "
+	frontendConfigSuffix = ";\n"
+)
+
+// Script serves the config as a script that sets window.__APP_CONFIG__,
+// for a <script src="/config.js"> ahead of the bundle. json.Marshal
+// escapes <, > and &, so no value can close the script.
+func (c FrontendConfig) Script(w http.ResponseWriter, r *http.Request) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body := frontendConfigPrefix + string(payload) + frontendConfigSuffix
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body))
+	}
+}
+
+// JSON serves the config as JSON, for apps that fetch it instead.
+func (c FrontendConfig) JSON(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c)
+}
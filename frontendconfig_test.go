@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFrontendConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+		check  func(t *testing.T, fc FrontendConfig)
+	}{
+		{"defaults", nil, func(t *testing.T, fc FrontendConfig) {
+			if fc.APIBase != "/api" || fc.PollIntervalMs != 5000 || fc.Version != "1.2.3" {
+				t.Errorf("got %+v", fc)
+			}
+			want := map[string]bool{"proxy": true, "sharedInstance": false, "session": false, "csrfToken": false}
+			if !reflect.DeepEqual(fc.Features, want) {
+				t.Errorf("features = %v, want %v", fc.Features, want)
+			}
+		}},
+		{"settings", func(cfg *Config) {
+			cfg.FrontendAPIBase = "https://api.example.com"
+			cfg.FrontendPollInterval = 1500 * time.Millisecond
+			cfg.FrontendFeatures = []string{"chat", "files"}
+		}, func(t *testing.T, fc FrontendConfig) {
+			if fc.APIBase != "https://api.example.com" || fc.PollIntervalMs != 1500 || !fc.Features["chat"] || !fc.Features["files"] {
+				t.Errorf("got %+v", fc)
+			}
+		}},
+		{"shared instance", func(cfg *Config) {
+			cfg.GreenAPIIDInstance = "1101"
+			cfg.GreenAPIToken = "secret"
+		}, func(t *testing.T, fc FrontendConfig) {
+			if !fc.Features["sharedInstance"] {
+				t.Error("sharedInstance is off")
+			}
+		}},
+		{"no proxy", func(cfg *Config) { cfg.GreenAPIProxyMethods = nil }, func(t *testing.T, fc FrontendConfig) {
+			if fc.Features["proxy"] {
+				t.Error("proxy is on")
+			}
+		}},
+		{"csrf token", func(cfg *Config) { cfg.CSRFMode = csrfModeToken }, func(t *testing.T, fc FrontendConfig) {
+			if !fc.Features["csrfToken"] {
+				t.Error("csrfToken is off")
+			}
+		}},
+		{"instances by name only", func(cfg *Config) {
+			cfg.GreenAPIInstances.UnmarshalText([]byte("sales=1101:sales-token,support=1102:support-token"))
+		}, func(t *testing.T, fc FrontendConfig) {
+			if !reflect.DeepEqual(fc.Instances, []string{"sales", "support"}) {
+				t.Errorf("instances = %v", fc.Instances)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, newFrontendConfig(testConfig(t, tt.mutate), "1.2.3"))
+		})
+	}
+}
+
+// TestFrontendConfigHoldsNoSecrets checks the shape of FrontendConfig: only
+// plain values, none of them named like a credential, so nothing from Config
+// can be copied in wholesale.
+func TestFrontendConfigHoldsNoSecrets(t *testing.T) {
+	allowed := map[reflect.Type]bool{
+		reflect.TypeFor[string]():          true,
+		reflect.TypeFor[int64]():           true,
+		reflect.TypeFor[[]string]():        true,
+		reflect.TypeFor[map[string]bool](): true,
+	}
+	typ := reflect.TypeFor[FrontendConfig]()
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if !allowed[field.Type] {
+			t.Errorf("field %s has type %s", field.Name, field.Type)
+		}
+		for _, word := range []string{"token", "key", "secret", "password", "user", "proxyurl"} {
+			if strings.Contains(strings.ToLower(field.Name), word) {
+				t.Errorf("field %s looks like a credential", field.Name)
+			}
+		}
+	}
+}
+
+func TestServerFrontendConfig(t *testing.T) {
+	secrets := []string{"greenapi-secret-token", "admin-secret-token", "webhook-secret-token", "sales-secret-token"}
+	s, _ := newTestServer(t, func(cfg *Config) {
+		cfg.GreenAPIIDInstance = "1101"
+		cfg.GreenAPIToken = secrets[0]
+		cfg.AdminToken = secrets[1]
+		cfg.WebhookAuthToken = secrets[2]
+		cfg.GreenAPIInstances.UnmarshalText([]byte("sales=1102:" + secrets[3]))
+	})
+	tests := []struct {
+		path     string
+		wantType string
+		decode   func(body string) (string, bool)
+	}{
+		{"/config.js", "application/javascript", func(body string) (string, bool) {
+			if !strings.HasPrefix(body, frontendConfigPrefix) || !strings.HasSuffix(body, frontendConfigSuffix) {
+				return "", false
+			}
+			return strings.TrimSuffix(strings.TrimPrefix(body, frontendConfigPrefix), frontendConfigSuffix), true
+		}},
+		{"/api/config", "application/json", func(body string) (string, bool) { return body, true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, tt.path, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+			if tt.path == "/config.js" && rec.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+			}
+			payload, ok := tt.decode(rec.Body.String())
+			if !ok {
+				t.Fatalf("body = %q, want window.__APP_CONFIG__ = {...};", rec.Body)
+			}
+			var got map[string]any
+			if err := json.Unmarshal([]byte(payload), &got); err != nil {
+				t.Fatalf("payload %q: %v", payload, err)
+			}
+			var keys []string
+			for key := range got {
+				keys = append(keys, key)
+			}
+			for _, key := range []string{"apiBase", "pollIntervalMs", "version", "instances", "features"} {
+				if _, ok := got[key]; !ok {
+					t.Errorf("payload lacks %s: %v", key, keys)
+				}
+			}
+			if len(got) != 5 {
+				t.Errorf("payload keys = %v, want only the frontend settings", keys)
+			}
+			for _, secret := range secrets {
+				if strings.Contains(rec.Body.String(), secret) {
+					t.Errorf("the payload shows %s", secret)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+const (
+	idInstanceHeader = "X-Id-Instance"
+	apiTokenHeader   = "X-Api-Token"
+)
+
+// greenAPI serves the /api/ endpoints by calling GREEN-API on behalf of the
+// browser, so the instance token never has to appear in a browser URL.
+type greenAPI struct {
+	endpoints  greenapi.Endpoints
+	idInstance string
+	apiToken   string
+	http       *http.Client
+	retry      greenapi.RetryPolicy
+	breakers   *greenapi.Breakers
+	// limiter paces the calls of each instance; nil disables it.
+	limiter *greenapi.Limiter
+	// recorder is told about every call, for metrics.
+	recorder greenapi.Recorder
+	states   *instanceStates
+	timeout  time.Duration
+	// upload has no client timeout: uploads are bounded by uploadTimeout
+	// through the context instead.
+	upload        *http.Client
+	uploadTimeout time.Duration
+	// logBodyBytes bounds the bodies of GREEN-API calls logged at debug
+	// level.
+	logBodyBytes int
+	// cache holds getSettings and getStateInstance results; nil disables it.
+	cache *apiCache
+	// whatsappCache holds checkWhatsapp results per number; nil disables
+	// it.
+	whatsappCache *apiCache
+	// sessions reads credentials from the session cookie; nil disables
+	// sessions.
+	sessions *sessionCodec
+	bulk     bulkSendLimits
+	media    mediaLimits
+	// mediaCache holds downloadFile links per message for /api/media; nil
+	// disables it.
+	mediaCache *apiCache
+	// queue sends the messages of /api/sendMessage?async=true; nil
+	// disables async sending.
+	queue *sendQueue
+
+	blockPrivateURLs bool
+	// fileProbe checks urlFile before sendFileByUrl; nil disables the
+	// check.
+	fileProbe *fileProbe
+	// ownWebhook is the /webhook of PUBLIC_URL and webhookToken
+	// WEBHOOK_AUTH_TOKEN, the defaults of POST /api/settings.
+	ownWebhook   string
+	webhookToken string
+}
+
+func newGreenAPI(cfg *Config, transport http.RoundTripper, breakers *greenapi.Breakers, limiter *greenapi.Limiter, recorder greenapi.Recorder) *greenAPI {
+	idInstance, apiToken := cfg.DefaultInstance()
+	g := &greenAPI{
+		endpoints:  greenapi.Endpoints{API: cfg.GreenAPIURL, Media: cfg.GreenAPIMediaURL},
+		idInstance: idInstance,
+		apiToken:   apiToken,
+		http: &http.Client{
+			Timeout:   cfg.GreenAPITimeout,
+			Transport: tracingTransport{base: transport},
+		},
+		retry: greenapi.RetryPolicy{
+			MaxAttempts: cfg.GreenAPIRetryAttempts,
+			BaseDelay:   cfg.GreenAPIRetryDelay,
+			MaxDelay:    cfg.GreenAPIRetryMaxDelay,
+		},
+		breakers: breakers,
+		limiter:  limiter,
+		recorder: recorder,
+		states:   newInstanceStates(cfg.GreenAPIStateTTL),
+		timeout:  cfg.UpstreamTimeout,
+		upload: &http.Client{
+			Transport: tracingTransport{base: transport},
+		},
+		uploadTimeout: cfg.GreenAPIUploadTimeout,
+		logBodyBytes:  int(cfg.GreenAPILogBodyBytes),
+
+		bulk: bulkSendLimits{
+			maxRecipients: cfg.BulkSendMaxRecipients,
+			concurrency:   cfg.BulkSendConcurrency,
+			timeout:       cfg.BulkSendTimeout,
+		},
+		media: mediaLimits{
+			maxBytes: cfg.MediaMaxBytes,
+			timeout:  cfg.MediaTimeout,
+			cacheTTL: cfg.MediaCacheTTL,
+		},
+
+		blockPrivateURLs: cfg.PrivateURLBlock,
+		fileProbe:        newFileProbe(cfg),
+		webhookToken:     cfg.WebhookAuthToken,
+	}
+	if cfg.PublicURL != "" {
+		g.ownWebhook = strings.TrimSuffix(cfg.PublicURL, "/") + "/webhook"
+	}
+	if cfg.GreenAPICacheTTL > 0 {
+		g.cache = newAPICache(cfg.GreenAPICacheTTL)
+	}
+	if cfg.CheckWhatsappCacheTTL > 0 {
+		g.whatsappCache = newAPICache(cfg.CheckWhatsappCacheTTL)
+	}
+	if cfg.MediaCacheTTL > 0 {
+		g.mediaCache = newAPICache(cfg.MediaCacheTTL)
+	}
+	if cfg.SessionKey != "" {
+		// validate has checked the key, and AES takes any 32-byte one.
+		key, _ := parseSessionKey(cfg.SessionKey)
+		g.sessions, _ = newSessionCodec(key, cfg.SessionTTL)
+	}
+	return g
+}
+
+// credentials returns the named instance of a route under /api/instances/,
+// or else the instance from the request headers, falling back to the
+// session cookie and then to the default one. The error is a 401 for
+// missing credentials or a session cookie that cannot be used.
+func (g *greenAPI) credentials(r *http.Request) (idInstance, apiToken string, err error) {
+	if instance, ok := instanceFromContext(r.Context()); ok {
+		return instance.IDInstance, instance.APIToken, nil
+	}
+	idInstance = r.Header.Get(idInstanceHeader)
+	apiToken = r.Header.Get(apiTokenHeader)
+	if idInstance == "" && apiToken == "" && g.sessions != nil {
+		session, ok, err := g.sessions.fromRequest(r)
+		if err != nil {
+			return "", "", invalidSession(err)
+		}
+		if ok {
+			return session.IDInstance, session.APIToken, nil
+		}
+	}
+	if idInstance == "" && apiToken == "" {
+		idInstance, apiToken = g.idInstance, g.apiToken
+	}
+	if idInstance == "" || apiToken == "" {
+		return "", "", errMissingCredentials
+	}
+	return idInstance, apiToken, nil
+}
+
+// client returns a GREEN-API client for the instance of r, or a 401 error
+// when there is none.
+func (g *greenAPI) client(r *http.Request) (*greenapi.Client, error) {
+	idInstance, apiToken, err := g.credentials(r)
+	if err != nil {
+		return nil, err
+	}
+	return g.newClient(r, idInstance, apiToken), nil
+}
+
+// newClient returns a GREEN-API client for the given instance.
+func (g *greenAPI) newClient(r *http.Request, idInstance, apiToken string) *greenapi.Client {
+	return g.clientWithLogger(LoggerFromContext(r.Context()), idInstance, apiToken)
+}
+
+// clientWithLogger is newClient for calls made outside of a request.
+func (g *greenAPI) clientWithLogger(logger *slog.Logger, idInstance, apiToken string) *greenapi.Client {
+	c := greenapi.NewClient(g.endpoints, idInstance, apiToken, g.http).
+		WithRetry(g.retry).
+		WithLogger(logger, g.logBodyBytes).
+		WithRecorder(g.recorder)
+	if g.breakers != nil {
+		c.WithBreakers(g.breakers)
+	}
+	if g.limiter != nil {
+		c.WithLimiter(g.limiter)
+	}
+	return c
+}
+
+var errMissingCredentials = &HTTPError{
+	Status:  http.StatusUnauthorized,
+	Code:    errCodeUnauthorized,
+	Message: "idInstance and apiTokenInstance are required",
+}
+
+func writeMissingCredentials(w http.ResponseWriter, r *http.Request) {
+	writeHTTPError(w, r, errMissingCredentials)
+}
+
+// callContext derives the context for a GREEN-API call from the request:
+// the call is canceled when the client goes away or after UPSTREAM_TIMEOUT,
+// and records its attempts and latency in the request log.
+func (g *greenAPI) callContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return upstreamContext(r, r.Context(), g.timeout)
+}
+
+// upstreamContext is callContext with parent in place of the request
+// context and its own timeout.
+func upstreamContext(r *http.Request, ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		ctx = greenapi.WithCallStats(ctx, &fields.upstream)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// authorizedClient is client for the sending endpoints, which are refused
+// while the instance is known not to be authorized.
+func (g *greenAPI) authorizedClient(r *http.Request) (*greenapi.Client, error) {
+	c, err := g.client(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.requireAuthorized(c.IDInstance()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// upstreamError maps a failed GREEN-API call: timeouts and client
+// cancellation become 504, an exhausted outbound budget becomes 429 and an
+// open circuit breaker 503, both with Retry-After, rejected credentials become 401,
+// rate limiting keeps 429 with Retry-After, other 4xx answers keep their
+// status with the upstream message attached, and 5xx answers and network
+// errors become 502. err is kept as the cause.
+func (g *greenAPI) upstreamError(r *http.Request, method string, err error) *HTTPError {
+	return g.upstreamFailure(r.Context(), method, err)
+}
+
+// upstreamFailure is upstreamError for a call made on behalf of ctx, which
+// may have outlived its request.
+func (g *greenAPI) upstreamFailure(ctx context.Context, method string, err error) *HTTPError {
+	apiMethod := slog.String("api_method", method)
+
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		return &HTTPError{Status: http.StatusGatewayTimeout, Code: errCodeClientCanceled, Message: "client canceled",
+			Attrs: []slog.Attr{apiMethod}, Err: err}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &HTTPError{Status: http.StatusGatewayTimeout, Code: errCodeUpstreamTimeout, Message: "upstream timed out",
+			Attrs: []slog.Attr{apiMethod, slog.Duration("timeout", g.timeout)}, Err: err}
+	}
+
+	var throttled *greenapi.ThrottledError
+	if errors.As(err, &throttled) {
+		retryAfter := max(int(throttled.RetryAfter.Round(time.Second).Seconds()), 1)
+		return &HTTPError{Status: http.StatusTooManyRequests, Code: errCodeOutboundRateLimited,
+			Message: "too many calls of this GREEN-API method, try again later",
+			Details: map[string]int{"retry_after": retryAfter},
+			Header:  http.Header{"Retry-After": {strconv.Itoa(retryAfter)}},
+			Attrs:   []slog.Attr{apiMethod, slog.Duration("retry_after", throttled.RetryAfter)},
+			Err:     err}
+	}
+
+	var open *greenapi.CircuitOpenError
+	if errors.As(err, &open) {
+		retryAfter := max(int(open.RetryAfter.Round(time.Second).Seconds()), 1)
+		return &HTTPError{Status: http.StatusServiceUnavailable, Code: errCodeUpstreamUnavailable,
+			Message: "GREEN-API is unavailable, try again later",
+			Details: map[string]int{"retry_after": retryAfter},
+			Header:  http.Header{"Retry-After": {strconv.Itoa(retryAfter)}},
+			Attrs:   []slog.Attr{apiMethod},
+			Err:     err}
+	}
+
+	var upstream *greenapi.Error
+	if !errors.As(err, &upstream) {
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamUnreachable, Message: "GREEN-API request failed",
+			Attrs: []slog.Attr{apiMethod}, Err: err}
+	}
+
+	attrs := []slog.Attr{apiMethod, slog.Int("upstream_status", upstream.StatusCode)}
+	switch {
+	case errors.Is(err, greenapi.ErrUnauthorized):
+		return &HTTPError{Status: http.StatusUnauthorized, Code: errCodeUpstreamUnauthorized,
+			Message: "GREEN-API rejected the instance credentials", Attrs: attrs, Err: err}
+	case errors.Is(err, greenapi.ErrRateLimited):
+		var header http.Header
+		if upstream.RetryAfter > 0 {
+			header = http.Header{"Retry-After": {strconv.Itoa(int(upstream.RetryAfter.Seconds()))}}
+		}
+		return &HTTPError{Status: http.StatusTooManyRequests, Code: errCodeUpstreamRateLimited,
+			Message: "GREEN-API rate limit exceeded", Header: header, Attrs: attrs, Err: err}
+	case upstream.StatusCode >= http.StatusBadRequest && upstream.StatusCode < http.StatusInternalServerError:
+		var details map[string]string
+		if upstream.Message != "" {
+			details = map[string]string{"upstream": upstream.Message}
+		}
+		return &HTTPError{Status: upstream.StatusCode, Code: errCodeUpstreamRejected,
+			Message: "GREEN-API rejected the request", Details: details, Attrs: attrs, Err: err}
+	default:
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError, Message: "GREEN-API error",
+			Details: map[string]int{"upstream_status": upstream.StatusCode}, Attrs: attrs, Err: err}
+	}
+}
+
+// cachedCall runs fetch through the response cache when it is enabled.
+// Concurrent requests share one fetch, so it must not depend on the
+// request context being alive.
+func (g *greenAPI) cachedCall(w http.ResponseWriter, r *http.Request, method string, fetch func(ctx context.Context) (any, error)) (any, error) {
+	idInstance, apiToken, _ := g.credentials(r)
+	return g.cachedFetch(w, r, g.cache, newAPICacheKey(method, idInstance, apiToken), fetch)
+}
+
+// cachedFetch is cachedCall with the cache and key given; a nil cache
+// calls fetch directly.
+func (g *greenAPI) cachedFetch(w http.ResponseWriter, r *http.Request, cache *apiCache, key apiCacheKey, fetch func(ctx context.Context) (any, error)) (any, error) {
+	if cache == nil {
+		ctx, cancel := g.callContext(r)
+		defer cancel()
+		return fetch(ctx)
+	}
+
+	value, age, hit, err := cache.get(key, wantsRevalidation(r), func() (any, error) {
+		ctx, cancel := upstreamContext(r, context.WithoutCancel(r.Context()), g.timeout)
+		defer cancel()
+		return fetch(ctx)
+	})
+	if hit {
+		setAgeHeader(w, age)
+		setLogCache(r, "hit")
+	} else {
+		setLogCache(r, "miss")
+	}
+	return value, err
+}
+
+func (g *greenAPI) GetSettings(w http.ResponseWriter, r *http.Request) error {
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	settings, err := g.cachedCall(w, r, "getSettings", func(ctx context.Context) (any, error) {
+		return c.GetSettings(ctx)
+	})
+	if err != nil {
+		return g.upstreamError(r, "getSettings", err)
+	}
+	writeJSON(w, http.StatusOK, settings)
+	return nil
+}
+
+// GetStateInstance refreshes the state remembered for the instance whenever
+// it actually asks GREEN-API.
+func (g *greenAPI) GetStateInstance(w http.ResponseWriter, r *http.Request) error {
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	state, err := g.cachedCall(w, r, "getStateInstance", func(ctx context.Context) (any, error) {
+		state, err := c.GetStateInstance(ctx)
+		if err == nil && state.StateInstance != "" {
+			g.states.observe(c.IDInstance(), state.StateInstance, time.Now())
+		}
+		return state, err
+	})
+	if err != nil {
+		return g.upstreamError(r, "getStateInstance", err)
+	}
+	writeJSON(w, http.StatusOK, state)
+	return nil
+}
+
+// requireAuthorized returns a 409 error while the last state seen for the
+// instance is anything but authorized. Unknown and expired states are let
+// through so that GREEN-API itself decides.
+func (g *greenAPI) requireAuthorized(idInstance string) error {
+	state, ok := g.states.lookup(idInstance, time.Now())
+	if !ok || state == greenapi.StateAuthorized {
+		return nil
+	}
+	return &HTTPError{
+		Status:  http.StatusConflict,
+		Code:    errCodeInstanceNotAuthorized,
+		Message: fmt.Sprintf("instance is not authorized (state %s); scan the QR code in the GREEN-API console and retry", state),
+		Details: map[string]string{"state": state},
+	}
+}
+
+// instanceStates remembers the last getStateInstance result per instance
+// for ttl.
+type instanceStates struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	states map[string]observedState
+}
+
+type observedState struct {
+	state string
+	at    time.Time
+}
+
+func newInstanceStates(ttl time.Duration) *instanceStates {
+	return &instanceStates{ttl: ttl, states: make(map[string]observedState)}
+}
+
+func (s *instanceStates) observe(idInstance, state string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired entries so instances that are no longer used do not pile up.
+	for id, o := range s.states {
+		if now.Sub(o.at) >= s.ttl {
+			delete(s.states, id)
+		}
+	}
+	s.states[idInstance] = observedState{state: state, at: now}
+}
+
+func (s *instanceStates) lookup(idInstance string, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.states[idInstance]
+	if !ok || now.Sub(o.at) >= s.ttl {
+		return "", false
+	}
+	return o.state, true
+}
+
+// maxMessageLength is the GREEN-API limit for a text message, in characters.
+const maxMessageLength = 20000
+
+type sendMessageRequest struct {
+	ChatID  string `json:"chatId"`
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+
+	// chatID is ChatID or Phone normalized by validate.
+	chatID string
+}
+
+func (req *sendMessageRequest) validate(_ context.Context, v *validation) {
+	field := "chatId"
+	if req.ChatID == "" && req.Phone != "" {
+		field = "phone"
+	}
+	var err error
+	req.chatID, err = normalizeChatID(req.ChatID, req.Phone)
+	v.check(field, err)
+
+	if v.required("message", req.Message) {
+		v.maxLength("message", req.Message, maxMessageLength)
+	}
+}
+
+// SendMessage serves POST /api/sendMessage. With async=true the message is
+// queued rather than sent before the answer.
+func (g *greenAPI) SendMessage(w http.ResponseWriter, r *http.Request) error {
+	async, err := g.asyncSend(r)
+	if err != nil {
+		return err
+	}
+	var req sendMessageRequest
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c, err := g.authorizedClient(r)
+	if err != nil {
+		return err
+	}
+	if async {
+		return g.enqueueMessage(w, r, &req)
+	}
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	result, err := c.SendMessage(ctx, greenapi.SendMessageRequest{ChatID: req.chatID, Message: req.Message})
+	if err != nil {
+		return g.upstreamError(r, "sendMessage", err)
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// normalizeChatID accepts a chat ID ending in @c.us or @g.us, or a phone
+// number in any common notation, and returns a GREEN-API chat ID. Russian
+// numbers written with a leading 8 get the country code 7.
+func normalizeChatID(chatID, phone string) (string, error) {
+	if chatID == "" {
+		chatID = phone
+	}
+	chatID = strings.TrimSpace(chatID)
+	if chatID == "" {
+		return "", newRuleError("required", "chatId or phone is required")
+	}
+
+	if id, ok := strings.CutSuffix(chatID, "@g.us"); ok {
+		if id == "" || strings.Trim(id, "0123456789-") != "" {
+			return "", newRuleError("group_chat_id", "invalid group chat ID %q", chatID)
+		}
+		return chatID, nil
+	}
+
+	number, _ := strings.CutSuffix(chatID, "@c.us")
+	number = strings.TrimPrefix(number, "+")
+	number = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')':
+			return -1
+		}
+		return r
+	}, number)
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return "", newRuleError("phone_numeric", "invalid phone number %q", chatID)
+	}
+	if len(number) == 11 && number[0] == '8' {
+		number = "7" + number[1:]
+	}
+	if len(number) < 10 || len(number) > 15 {
+		return "", newRuleError("phone_length", "phone number must have 10 to 15 digits, got %d", len(number))
+	}
+	return number + "@c.us", nil
+}
+
+type sendFileByURLRequest struct {
+	ChatID   string `json:"chatId"`
+	URLFile  string `json:"urlFile"`
+	FileName string `json:"fileName"`
+	Caption  string `json:"caption"`
+
+	// blockPrivateURLs is PRIVATE_URL_BLOCK, set before decoding.
+	blockPrivateURLs bool
+	// chatID is ChatID normalized by validate.
+	chatID string
+}
+
+func (req *sendFileByURLRequest) validate(ctx context.Context, v *validation) {
+	var err error
+	req.chatID, err = normalizeChatID(req.ChatID, "")
+	v.check("chatId", err)
+	v.check("urlFile", checkFileURL(ctx, req.URLFile, req.blockPrivateURLs))
+	v.check("fileName", checkFileName(req.FileName))
+	v.maxLength("caption", req.Caption, maxMessageLength)
+}
+
+// SendFileByURL serves POST /api/sendFileByUrl. Unless validate=false is
+// given, for hosts whose HEAD answers cannot be trusted, urlFile is checked
+// first.
+func (g *greenAPI) SendFileByURL(w http.ResponseWriter, r *http.Request) error {
+	var v validation
+	probe := v.queryBool(r, "validate", true)
+	if len(v.errs) > 0 {
+		return validationError(v.errs)
+	}
+	req := sendFileByURLRequest{blockPrivateURLs: g.blockPrivateURLs}
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c, err := g.authorizedClient(r)
+	if err != nil {
+		return err
+	}
+	if probe && g.fileProbe != nil {
+		if err := g.fileProbe.check(r.Context(), req.URLFile); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	result, err := c.SendFileByURL(ctx, greenapi.SendFileByURLRequest{
+		ChatID:   req.chatID,
+		URLFile:  req.URLFile,
+		FileName: req.FileName,
+		Caption:  req.Caption,
+	})
+	if err != nil {
+		return g.upstreamError(r, "sendFileByUrl", err)
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// checkFileName accepts a bare file name with an extension, which GREEN-API
+// uses to pick the message type.
+func checkFileName(name string) error {
+	if ext := path.Ext(name); len(ext) < 2 || strings.ContainsAny(name, `/\`) {
+		return newRuleError("file_name", "must be a file name with an extension")
+	}
+	return nil
+}
+
+// checkFileURL accepts absolute http and https URLs. With blockPrivate,
+// hosts that are or resolve to loopback, private or link-local addresses
+// are rejected as well.
+func checkFileURL(ctx context.Context, raw string, blockPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return newRuleError("absolute_url", "must be an absolute http or https URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return newRuleError("url_scheme", "scheme %q is not allowed, want http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return newRuleError("url_host", "must have a host")
+	}
+	if !blockPrivate {
+		return nil
+	}
+
+	host := u.Hostname()
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return newRuleError("resolvable_host", "could not resolve host %q", host)
+	}
+	for _, addr := range addrs {
+		if privateAddr(addr.Unmap()) {
+			return newRuleError("public_host", "host %q points to a private address", host)
+		}
+	}
+	return nil
+}
+
+func privateAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsUnspecified() ||
+		addr.IsInterfaceLocalMulticast()
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// apiError is the JSON error envelope of the /api/ endpoints.
+type apiError struct {
+	Error struct {
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Details json.RawMessage `json:"details"`
+	} `json:"error"`
+}
+
+// callAPI sends a request with body and header through the full handler
+// of s and decodes the error envelope when the answer is not 2xx.
+func callAPI(t *testing.T, s *Server, method, target, body string, header http.Header) (*httptest.ResponseRecorder, apiError) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	var envelope apiError
+	if rec.Code >= http.StatusBadRequest {
+		if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("error body %q: %v", rec.Body, err)
+		}
+	}
+	return rec, envelope
+}
+
+// singleAttempt turns off retries, the response cache and the outbound
+// budgets, so that every request reaches the fake upstream exactly once and
+// without waiting.
+func singleAttempt(cfg *Config) {
+	cfg.GreenAPIRetryAttempts = 1
+	cfg.GreenAPICacheTTL = 0
+	cfg.GreenAPIBreakerThreshold = 0
+	cfg.GreenAPILimits = nil
+}
+
+// withConfig applies mutators in order.
+func withConfig(mutators ...func(*Config)) func(*Config) {
+	return func(cfg *Config) {
+		for _, mutate := range mutators {
+			mutate(cfg)
+		}
+	}
+}
+
+func TestGetSettings(t *testing.T) {
+	const settings = `{"wid":"79001234567@c.us","webhookUrl":"https://example.com/hook","delaySendMessagesMilliseconds":1000}`
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		upstream   http.HandlerFunc
+		wantPath   string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "default instance",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, settings)
+			},
+			wantPath:   "/waInstance1101/getSettings/secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "instance from headers",
+			header: http.Header{idInstanceHeader: {"2202"}, apiTokenHeader: {"other-token"}},
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, settings)
+			},
+			wantPath:   "/waInstance2202/getSettings/other-token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "only one header",
+			header:     http.Header{idInstanceHeader: {"2202"}},
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeUnauthorized,
+		},
+		{
+			name: "upstream server error",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+			},
+			wantPath:   "/waInstance1101/getSettings/secret",
+			wantStatus: http.StatusBadGateway,
+			wantCode:   errCodeUpstreamError,
+		},
+		{
+			name: "upstream rejects the token",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			wantPath:   "/waInstance1101/getSettings/secret",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeUpstreamUnauthorized,
+		},
+		{
+			name: "upstream drops the connection",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				conn, _, _ := http.NewResponseController(w).Hijack()
+				conn.Close()
+			},
+			wantPath:   "/waInstance1101/getSettings/secret",
+			wantStatus: http.StatusBadGateway,
+			wantCode:   errCodeUpstreamUnreachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing orders the handler before the answer when the
+			// connection is dropped.
+			var mu sync.Mutex
+			var gotPath string
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				gotPath = r.URL.Path
+				mu.Unlock()
+				if tt.upstream == nil {
+					t.Error("GREEN-API was called")
+					return
+				}
+				tt.upstream(w, r)
+			})
+			s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, envelope := callAPI(t, s, http.MethodGet, "/api/getSettings", "", tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			mu.Lock()
+			path := gotPath
+			mu.Unlock()
+			if path != tt.wantPath {
+				t.Errorf("GREEN-API was called at %q, want %q", path, tt.wantPath)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+					t.Errorf("Content-Type = %q", ct)
+				}
+				var got, want map[string]any
+				json.Unmarshal(rec.Body.Bytes(), &got)
+				json.Unmarshal([]byte(settings), &want)
+				if got["wid"] != want["wid"] || got["webhookUrl"] != want["webhookUrl"] {
+					t.Errorf("body = %s, want the upstream settings", rec.Body)
+				}
+			} else if envelope.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", envelope.Error.Code, tt.wantCode)
+			}
+			for _, token := range []string{"secret", "other-token"} {
+				if strings.Contains(logs.String(), token) {
+					t.Errorf("the token %q reached the log:\n%s", token, logs)
+				}
+			}
+		})
+	}
+}
+
+func TestGetSettingsTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		cancel    bool
+		wantCode  string
+		wantLevel string
+	}{
+		{"upstream timed out", 50 * time.Millisecond, false, errCodeUpstreamTimeout, "ERROR"},
+		{"client canceled", time.Minute, true, errCodeClientCanceled, "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			upstreamDone := make(chan struct{})
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				defer close(upstreamDone)
+				if tt.cancel {
+					cancel()
+				}
+				select {
+				case <-time.After(5 * time.Second):
+				case <-r.Context().Done():
+				}
+			})
+			s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.UpstreamTimeout = tt.timeout
+			}))
+
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/getSettings", nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			s.Handler().ServeHTTP(rec, req)
+
+			var envelope apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if rec.Code != http.StatusGatewayTimeout || envelope.Error.Code != tt.wantCode {
+				t.Errorf("got %d %s, want 504 %s", rec.Code, envelope.Error.Code, tt.wantCode)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("the call took %s", elapsed)
+			}
+			select {
+			case <-upstreamDone:
+			case <-time.After(2 * time.Second):
+				t.Error("the upstream request was not canceled")
+			}
+			if want := `"level":"` + tt.wantLevel + `","msg":"API error"`; !strings.Contains(logs.String(), want) {
+				t.Errorf("the log lacks %s:\n%s", want, logs)
+			}
+		})
+	}
+}
+
+func TestGetSettingsUnreachable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+	rec, envelope := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil)
+	if rec.Code != http.StatusBadGateway || envelope.Error.Code != errCodeUpstreamUnreachable {
+		t.Errorf("got %d %s, want 502 %s", rec.Code, envelope.Error.Code, errCodeUpstreamUnreachable)
+	}
+}
+
+func TestGetStateInstanceGatesSending(t *testing.T) {
+	states := []struct {
+		state    string
+		wantSend int
+	}{
+		{greenapi.StateAuthorized, http.StatusOK},
+		{greenapi.StateNotAuthorized, http.StatusConflict},
+		{greenapi.StateBlocked, http.StatusConflict},
+		{greenapi.StateStarting, http.StatusConflict},
+		{greenapi.StateSleepMode, http.StatusConflict},
+		{greenapi.StateYellowCard, http.StatusConflict},
+	}
+	for _, tt := range states {
+		t.Run(tt.state, func(t *testing.T) {
+			sent := false
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasPrefix(r.URL.Path, "/waInstance1101/getStateInstance/"):
+					fmt.Fprintf(w, `{"stateInstance":%q}`, tt.state)
+				case strings.HasPrefix(r.URL.Path, "/waInstance1101/sendMessage/"):
+					sent = true
+					io.WriteString(w, `{"idMessage":"BAE5"}`)
+				default:
+					t.Errorf("unexpected call %s", r.URL.Path)
+				}
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, _ := callAPI(t, s, http.MethodGet, "/api/getStateInstance", "", nil)
+			var state struct {
+				StateInstance string `json:"stateInstance"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil || rec.Code != http.StatusOK || state.StateInstance != tt.state {
+				t.Fatalf("getStateInstance = %d %s", rec.Code, rec.Body)
+			}
+
+			rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"hi"}`, nil)
+			if rec.Code != tt.wantSend {
+				t.Fatalf("sendMessage = %d, want %d: %s", rec.Code, tt.wantSend, rec.Body)
+			}
+			if sent != (tt.wantSend == http.StatusOK) {
+				t.Errorf("reached GREEN-API sendMessage = %t", sent)
+			}
+			if tt.wantSend == http.StatusConflict {
+				if envelope.Error.Code != errCodeInstanceNotAuthorized || !strings.Contains(envelope.Error.Message, tt.state) {
+					t.Errorf("error = %s %q", envelope.Error.Code, envelope.Error.Message)
+				}
+				if string(envelope.Error.Details) != fmt.Sprintf(`{"state":%q}`, tt.state) {
+					t.Errorf("details = %s", envelope.Error.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestGetStateInstanceRefreshes(t *testing.T) {
+	var state atomic.Value
+	state.Store(greenapi.StateNotAuthorized)
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/getStateInstance/") {
+			fmt.Fprintf(w, `{"stateInstance":%q}`, state.Load())
+			return
+		}
+		io.WriteString(w, `{"idMessage":"BAE5"}`)
+	})
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+	send := func() int {
+		rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"hi"}`, nil)
+		return rec.Code
+	}
+
+	if code := send(); code != http.StatusOK {
+		t.Errorf("before any state was seen sendMessage = %d, want it let through", code)
+	}
+	callAPI(t, s, http.MethodGet, "/api/getStateInstance", "", nil)
+	if code := send(); code != http.StatusConflict {
+		t.Errorf("while notAuthorized sendMessage = %d, want 409", code)
+	}
+	state.Store(greenapi.StateAuthorized)
+	callAPI(t, s, http.MethodGet, "/api/getStateInstance", "", nil)
+	if code := send(); code != http.StatusOK {
+		t.Errorf("after the refresh sendMessage = %d, want 200", code)
+	}
+}
+
+func TestInstanceStatesExpire(t *testing.T) {
+	now := time.Now()
+	states := newInstanceStates(30 * time.Second)
+	states.observe("1101", greenapi.StateBlocked, now)
+
+	tests := []struct {
+		name      string
+		id        string
+		at        time.Time
+		wantState string
+		wantOK    bool
+	}{
+		{"fresh", "1101", now.Add(29 * time.Second), greenapi.StateBlocked, true},
+		{"expired", "1101", now.Add(30 * time.Second), "", false},
+		{"unknown instance", "2202", now, "", false},
+	}
+	for _, tt := range tests {
+		state, ok := states.lookup(tt.id, tt.at)
+		if state != tt.wantState || ok != tt.wantOK {
+			t.Errorf("%s: lookup = %q, %t; want %q, %t", tt.name, state, ok, tt.wantState, tt.wantOK)
+		}
+	}
+
+	// Observing another instance later drops the expired entry.
+	states.observe("2202", greenapi.StateAuthorized, now.Add(time.Minute))
+	if _, kept := states.states["1101"]; kept {
+		t.Error("the expired state was not dropped")
+	}
+}
+
+func TestNormalizeChatID(t *testing.T) {
+	tests := []struct {
+		chatID, phone string
+		want          string
+		wantRule      string
+	}{
+		{"79001234567@c.us", "", "79001234567@c.us", ""},
+		{"", "79001234567", "79001234567@c.us", ""},
+		{"", "+79001234567", "79001234567@c.us", ""},
+		{"", "89001234567", "79001234567@c.us", ""},
+		{"", "+7 (900) 123-45-67", "79001234567@c.us", ""},
+		{"", " 8 900 123 45 67 ", "79001234567@c.us", ""},
+		{"", "4915112345678", "4915112345678@c.us", ""},
+		{"", "8900123456", "8900123456@c.us", ""},
+		{"120363043968066561@g.us", "", "120363043968066561@g.us", ""},
+		{"79001234567-1581234048@g.us", "", "79001234567-1581234048@g.us", ""},
+		{"79001234567@c.us", "70000000000", "79001234567@c.us", ""},
+		{"", "", "", "required"},
+		{"  ", "", "", "required"},
+		{"@g.us", "", "", "group_chat_id"},
+		{"abc@g.us", "", "", "group_chat_id"},
+		{"", "+7900abc4567", "", "phone_numeric"},
+		{"", "++79001234567", "", "phone_numeric"},
+		{"", "123456789", "", "phone_length"},
+		{"", "1234567890123456", "", "phone_length"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeChatID(tt.chatID, tt.phone)
+		rule := ""
+		var re *ruleError
+		if errors.As(err, &re) {
+			rule = re.rule
+		} else if err != nil {
+			t.Errorf("normalizeChatID(%q, %q) = %v, not a rule error", tt.chatID, tt.phone, err)
+		}
+		if got != tt.want || rule != tt.wantRule {
+			t.Errorf("normalizeChatID(%q, %q) = %q, rule %q; want %q, rule %q", tt.chatID, tt.phone, got, rule, tt.want, tt.wantRule)
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		upstream      http.HandlerFunc
+		wantStatus    int
+		wantCode      string
+		wantFields    []string
+		wantChatID    string
+		wantBody      string
+		wantInDetails string
+	}{
+		{
+			name: "chat ID",
+			body: `{"chatId":"79001234567@c.us","message":"hi"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"idMessage":"BAE5F4886AD6"}`)
+			},
+			wantStatus: http.StatusOK, wantChatID: "79001234567@c.us", wantBody: `{"idMessage":"BAE5F4886AD6"}`,
+		},
+		{
+			name: "phone with 8",
+			body: `{"phone":"8 (900) 123-45-67","message":"hi"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"idMessage":"BAE5"}`)
+			},
+			wantStatus: http.StatusOK, wantChatID: "79001234567@c.us", wantBody: `{"idMessage":"BAE5"}`,
+		},
+		{
+			name: "group chat",
+			body: `{"chatId":"120363043968066561@g.us","message":"hi all"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"idMessage":"BAE6"}`)
+			},
+			wantStatus: http.StatusOK, wantChatID: "120363043968066561@g.us", wantBody: `{"idMessage":"BAE6"}`,
+		},
+		{
+			name:       "empty",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest, wantCode: errCodeValidation, wantFields: []string{"chatId", "message"},
+		},
+		{
+			name:       "bad phone and blank message",
+			body:       `{"phone":"+7900abc","message":"   "}`,
+			wantStatus: http.StatusBadRequest, wantCode: errCodeValidation, wantFields: []string{"phone", "message"},
+		},
+		{
+			name:       "message too long",
+			body:       `{"chatId":"79001234567@c.us","message":"` + strings.Repeat("я", maxMessageLength+1) + `"}`,
+			wantStatus: http.StatusBadRequest, wantCode: errCodeValidation, wantFields: []string{"message"},
+		},
+		{
+			name:       "not JSON",
+			body:       `chatId=1`,
+			wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidBody,
+		},
+		{
+			name: "upstream rejects",
+			body: `{"chatId":"79001234567@c.us","message":"hi"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"message":"Validation failed. Details: 'chatId' is not on WhatsApp"}`)
+			},
+			wantStatus: http.StatusBadRequest, wantCode: errCodeUpstreamRejected, wantChatID: "79001234567@c.us",
+			wantInDetails: "is not on WhatsApp",
+		},
+		{
+			name: "upstream rate limit",
+			body: `{"chatId":"79001234567@c.us","message":"hi"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			wantStatus: http.StatusTooManyRequests, wantCode: errCodeUpstreamRateLimited, wantChatID: "79001234567@c.us",
+		},
+		{
+			name: "upstream failure",
+			body: `{"chatId":"79001234567@c.us","message":"hi"}`,
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantStatus: http.StatusBadGateway, wantCode: errCodeUpstreamError, wantChatID: "79001234567@c.us",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent greenapi.SendMessageRequest
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/waInstance1101/sendMessage/secret" {
+					t.Errorf("GREEN-API called with %s %s", r.Method, r.URL.Path)
+				}
+				if tt.upstream == nil {
+					t.Error("GREEN-API was called for an invalid request")
+					return
+				}
+				json.NewDecoder(r.Body).Decode(&sent)
+				tt.upstream(w, r)
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage", tt.body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if sent.ChatID != tt.wantChatID {
+				t.Errorf("sent chatId %q, want %q", sent.ChatID, tt.wantChatID)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+			if envelope.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", envelope.Error.Code, tt.wantCode)
+			}
+			if tt.wantFields != nil {
+				var details struct {
+					Fields []fieldError `json:"fields"`
+				}
+				json.Unmarshal(envelope.Error.Details, &details)
+				var fields []string
+				for _, f := range details.Fields {
+					fields = append(fields, f.Field)
+				}
+				if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+					t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+				}
+			}
+			if !strings.Contains(string(envelope.Error.Details), tt.wantInDetails) {
+				t.Errorf("details = %s, want %q in them", envelope.Error.Details, tt.wantInDetails)
+			}
+		})
+	}
+}
+
+func TestCheckFileURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		blockPrivate bool
+		wantRule     string
+	}{
+		{"https://example.com/a.png", false, ""},
+		{"https://203.0.113.5/a.png", true, ""},
+		{"file:///etc/passwd", false, "url_scheme"},
+		{"data:image/png;base64,AAAA", false, "url_scheme"},
+		{"ftp://example.com/a.png", false, "url_scheme"},
+		{"/a.png", false, "absolute_url"},
+		{"https:///a.png", false, "url_host"},
+		{"http://127.0.0.1/a.png", false, ""},
+		{"http://127.0.0.1/a.png", true, "public_host"},
+		{"http://10.1.2.3/a.png", true, "public_host"},
+		{"http://192.168.0.1/a.png", true, "public_host"},
+		{"http://169.254.169.254/latest/meta-data", true, "public_host"},
+		{"http://[::1]/a.png", true, "public_host"},
+		{"http://[::ffff:10.0.0.1]/a.png", true, "public_host"},
+		{"http://0.0.0.0/a.png", true, "public_host"},
+		{"http://localhost/a.png", true, "public_host"},
+	}
+	for _, tt := range tests {
+		err := checkFileURL(t.Context(), tt.url, tt.blockPrivate)
+		rule := ""
+		var re *ruleError
+		if errors.As(err, &re) {
+			rule = re.rule
+		}
+		if rule != tt.wantRule {
+			t.Errorf("checkFileURL(%q, %t) = %v, want rule %q", tt.url, tt.blockPrivate, err, tt.wantRule)
+		}
+	}
+}
+
+func TestCheckFileName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"photo.jpg":     true,
+		"report.v2.pdf": true,
+		"photo":         false,
+		"photo.":        false,
+		"":              false,
+		"../photo.jpg":  false,
+		`dir\photo.jpg`: false,
+	} {
+		if err := checkFileName(name); (err == nil) != ok {
+			t.Errorf("checkFileName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestSendFileByURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		blockPrivate bool
+		wantStatus   int
+		wantFields   []string
+	}{
+		{
+			name:       "round trip",
+			body:       `{"chatId":"79001234567@c.us","urlFile":"https://example.com/a.png","fileName":"a.png","caption":"look"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "everything wrong",
+			body:       `{"chatId":"x","urlFile":"file:///etc/passwd","fileName":"passwd"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"chatId", "urlFile", "fileName"},
+		},
+		{
+			name:       "data URL",
+			body:       `{"chatId":"79001234567@c.us","urlFile":"data:text/plain,hi","fileName":"a.txt"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"urlFile"},
+		},
+		{
+			name:         "private address",
+			body:         `{"chatId":"79001234567@c.us","urlFile":"http://10.0.0.1/a.png","fileName":"a.png"}`,
+			blockPrivate: true,
+			wantStatus:   http.StatusBadRequest,
+			wantFields:   []string{"urlFile"},
+		},
+		{
+			name:       "caption too long",
+			body:       `{"chatId":"79001234567@c.us","urlFile":"https://example.com/a.png","fileName":"a.png","caption":"` + strings.Repeat("x", maxMessageLength+1) + `"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"caption"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent greenapi.SendFileByURLRequest
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/waInstance1101/sendFileByUrl/secret" {
+					t.Errorf("GREEN-API called at %s", r.URL.Path)
+				}
+				json.NewDecoder(r.Body).Decode(&sent)
+				io.WriteString(w, `{"idMessage":"BAE7"}`)
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.PrivateURLBlock = tt.blockPrivate
+			}))
+
+			rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendFileByUrl?validate=false", tt.body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				want := greenapi.SendFileByURLRequest{ChatID: "79001234567@c.us", URLFile: "https://example.com/a.png", FileName: "a.png", Caption: "look"}
+				if sent != want {
+					t.Errorf("sent %+v, want %+v", sent, want)
+				}
+				if strings.TrimSpace(rec.Body.String()) != `{"idMessage":"BAE7"}` {
+					t.Errorf("body = %s", rec.Body)
+				}
+				return
+			}
+			if sent.URLFile != "" {
+				t.Errorf("an invalid request reached GREEN-API: %+v", sent)
+			}
+			var details struct {
+				Fields []fieldError `json:"fields"`
+			}
+			json.Unmarshal(envelope.Error.Details, &details)
+			var fields []string
+			for _, f := range details.Fields {
+				fields = append(fields, f.Field)
+			}
+			if envelope.Error.Code != errCodeValidation || strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("error %s with fields %v, want %s with %v", envelope.Error.Code, fields, errCodeValidation, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultID     string
+		defaultToken  string
+		header        http.Header
+		wantPath      string
+		wantStatus    int
+		wantErrorCode string
+	}{
+		{"headers", "1101", "secret", http.Header{idInstanceHeader: {"2202"}, apiTokenHeader: {"header-token"}},
+			"/waInstance2202/getStateInstance/header-token", http.StatusOK, ""},
+		{"headers without defaults", "", "", http.Header{idInstanceHeader: {"2202"}, apiTokenHeader: {"header-token"}},
+			"/waInstance2202/getStateInstance/header-token", http.StatusOK, ""},
+		{"defaults", "1101", "secret", nil, "/waInstance1101/getStateInstance/secret", http.StatusOK, ""},
+		{"neither", "", "", nil, "", http.StatusUnauthorized, errCodeUnauthorized},
+		{"token header only", "1101", "secret", http.Header{apiTokenHeader: {"header-token"}}, "", http.StatusUnauthorized, errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath string
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				io.WriteString(w, `{"stateInstance":"authorized"}`)
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.GreenAPIIDInstance, cfg.GreenAPIToken = tt.defaultID, tt.defaultToken
+			}))
+			rec, envelope := callAPI(t, s, http.MethodGet, "/api/getStateInstance", "", tt.header)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantErrorCode {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantErrorCode)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("GREEN-API called at %q, want %q", gotPath, tt.wantPath)
+			}
+			if ct := rec.Header().Get("Content-Type"); tt.wantStatus != http.StatusOK && !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("401 Content-Type = %q, want JSON", ct)
+			}
+		})
+	}
+}
+
+// TestTokenNeverLogged captures the server log at debug level, with bodies,
+// and the default logger while requests fail in every way they can, and
+// checks that the token appears nowhere, nor in the answers.
+func TestTokenNeverLogged(t *testing.T) {
+	const token = "tok-9f8e7d6c5b4a"
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	upstreams := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"rejected with the token echoed", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"message":"unknown token %s in %s"}`, token, r.URL.Path)
+		}},
+		{"server error with the token echoed", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "failed at "+r.URL.String(), http.StatusInternalServerError)
+		}},
+		{"unauthorized", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}},
+		{"dropped connection", func(w http.ResponseWriter, r *http.Request) {
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		}},
+		{"unreachable", nil},
+	}
+	for _, tt := range upstreams {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultLogs := captureDefaultLog(t)
+			mutate := withConfig(func(cfg *Config) {
+				cfg.GreenAPIURL = unreachable.URL
+				cfg.GreenAPIMediaURL = unreachable.URL
+			}, singleAttempt, func(cfg *Config) {
+				cfg.GreenAPILogBodyBytes = 0
+			})
+			if tt.handler != nil {
+				mutate = withConfig(withUpstream(fakeGreenAPI(t, tt.handler)), singleAttempt, func(cfg *Config) {
+					cfg.GreenAPILogBodyBytes = 0
+				})
+			}
+			s, logs := newTestServer(t, mutate)
+			header := http.Header{idInstanceHeader: {"2202"}, apiTokenHeader: {token}}
+
+			var answers strings.Builder
+			for _, req := range []struct{ method, target, body string }{
+				{http.MethodGet, "/api/getSettings", ""},
+				{http.MethodGet, "/api/getStateInstance?apiTokenInstance=" + token, ""},
+				{http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"hi"}`},
+			} {
+				rec, _ := callAPI(t, s, req.method, req.target, req.body, header)
+				if rec.Code < http.StatusBadRequest {
+					t.Errorf("%s %s = %d, want it to fail", req.method, req.target, rec.Code)
+				}
+				answers.WriteString(rec.Body.String())
+			}
+
+			for what, out := range map[string]string{"server log": logs.String(), "default log": defaultLogs.String(), "answers": answers.String()} {
+				if strings.Contains(out, token) {
+					t.Errorf("the token appears in the %s:\n%s", what, out)
+				}
+			}
+			if !strings.Contains(logs.String(), "GREEN-API") {
+				t.Errorf("no upstream call was logged, the check proves nothing:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetriesInRequestLog(t *testing.T) {
+	var calls atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, `{"stateInstance":"authorized"}`)
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.GreenAPIRetryAttempts = 3
+		cfg.GreenAPIRetryDelay = time.Millisecond
+	}))
+
+	rec, _ := callAPI(t, s, http.MethodGet, "/api/getStateInstance", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	out := logs.String()
+	if !strings.Contains(out, `"upstream_attempts":3`) || !strings.Contains(out, `"upstream_duration":`) {
+		t.Errorf("the request log lacks the attempts and upstream latency:\n%s", out)
+	}
+}
+
+func TestCircuitBreakerAnswers503(t *testing.T) {
+	var calls atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.GreenAPIBreakerThreshold = 2
+		cfg.GreenAPIBreakerCooldown = time.Minute
+	}))
+
+	for i := range 2 {
+		if rec, _ := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil); rec.Code == http.StatusServiceUnavailable {
+			t.Fatalf("call %d: the breaker opened before the threshold", i+1)
+		}
+	}
+	rec, body := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil)
+	if rec.Code != http.StatusServiceUnavailable || body.Error.Code != errCodeUpstreamUnavailable {
+		t.Fatalf("status = %d, code = %q: %s", rec.Code, body.Error.Code, rec.Body)
+	}
+	if ra := rec.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Errorf("Retry-After = %q", ra)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream got %d calls, want 2", calls.Load())
+	}
+	if !strings.Contains(logs.String(), `"msg":"GREEN-API circuit breaker changed state"`) || !strings.Contains(logs.String(), `"to":"open"`) {
+		t.Errorf("the transition was not logged:\n%s", logs)
+	}
+
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	for _, want := range []string{"greenapi_circuit_state{", "} 2", `greenapi_circuit_transitions_total{`, `state="open"} 1`} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headBufferSize is how much of a body net/http buffers before it gives up
+// on Content-Length and switches to chunked encoding.
+const headBufferSize = 2048
+
+// HeadBody discards what handlers write to the body of HEAD responses, so
+// that the middleware in between never sees it, and holds the status back
+// until the handler returns. Content-Length is then set as net/http would
+// set it for GET, which keeps HEAD and GET headers the same. Other methods
+// pass through untouched.
+func HeadBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &headWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r)
+		hw.send(true)
+	})
+}
+
+type headWriter struct {
+	http.ResponseWriter
+	status    int
+	discarded int64
+	sent      bool
+}
+
+func (hw *headWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		hw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if hw.status == 0 {
+		hw.status = status
+	}
+}
+
+func (hw *headWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.discarded += int64(len(b))
+	return len(b), nil
+}
+
+// Flush sends the headers without Content-Length, as a flushed GET
+// response would be chunked.
+func (hw *headWriter) Flush() {
+	hw.send(false)
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+// send writes the held status once. complete is whether the handler has
+// returned, so that the discarded bytes are the whole body.
+func (hw *headWriter) send(complete bool) {
+	if hw.sent {
+		return
+	}
+	hw.sent = true
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+
+	header := hw.Header()
+	if complete && hw.discarded <= headBufferSize && bodyAllowedForStatus(hw.status) &&
+		header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", strconv.FormatInt(hw.discarded, 10))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
+
+// Committed reports whether the handler has started the response, so
+// an error can no longer replace it.
+func (hw *headWriter) Committed() bool {
+	return hw.status != 0
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (hw *headWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+func bodyAllowedForStatus(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
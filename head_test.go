@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHeadBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantLength string
+		wantBody   string
+	}{
+		{
+			"small body",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") },
+			http.StatusOK, "5", "",
+		},
+		{
+			"explicit length kept",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "42")
+				io.WriteString(w, "hello")
+			},
+			http.StatusOK, "42", "",
+		},
+		{
+			"status held until the handler returns",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, `{"id":1}`)
+			},
+			http.StatusCreated, "8", "",
+		},
+		{
+			"no body",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) {},
+			http.StatusOK, "0", "",
+		},
+		{
+			"large body is chunked",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, strings.Repeat("a", headBufferSize+1)) },
+			http.StatusOK, "", "",
+		},
+		{
+			"flushed body is chunked",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+				w.(http.Flusher).Flush()
+			},
+			http.StatusOK, "", "",
+		},
+		{
+			"no content",
+			http.MethodHead,
+			func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			http.StatusNoContent, "", "",
+		},
+		{
+			"GET untouched",
+			http.MethodGet,
+			func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") },
+			http.StatusOK, "", "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HeadBody(tt.handler).ServeHTTP(rec, httptest.NewRequest(tt.method, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerHeadMatchesGet(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		size int
+	}{
+		{"html", "page.html", 300},
+		{"script", "app.js", 20000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := startTestServer(t, func(cfg *Config) {
+				if err := os.WriteFile(filepath.Join(cfg.StaticDir, tt.file), []byte(strings.Repeat("x", tt.size)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			})
+			url := serverURL(t, s, "http", "/"+tt.file)
+			fetch := func(method string) (*http.Response, []byte) {
+				req, _ := http.NewRequest(method, url, nil)
+				// The transport asks for gzip on GET only.
+				req.Header.Set("Accept-Encoding", "identity")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				return resp, body
+			}
+			get, getBody := fetch(http.MethodGet)
+			head, headBody := fetch(http.MethodHead)
+
+			if get.StatusCode != http.StatusOK || head.StatusCode != http.StatusOK {
+				t.Fatalf("GET = %d, HEAD = %d", get.StatusCode, head.StatusCode)
+			}
+			if len(getBody) != tt.size || len(headBody) != 0 {
+				t.Errorf("GET body = %d bytes, HEAD body = %d bytes", len(getBody), len(headBody))
+			}
+			for _, name := range []string{"Content-Type", "Content-Length", "Last-Modified", "Accept-Ranges", "Cache-Control", "ETag"} {
+				if g, h := get.Header.Get(name), head.Header.Get(name); g != h {
+					t.Errorf("%s: GET %q, HEAD %q", name, g, h)
+				}
+			}
+			if head.Header.Get("Content-Length") != strconv.Itoa(tt.size) {
+				t.Errorf("HEAD Content-Length = %q, want %d", head.Header.Get("Content-Length"), tt.size)
+			}
+
+			type logged struct {
+				Method        string `json:"method"`
+				Status        int    `json:"status"`
+				Bytes         int64  `json:"bytes"`
+				ContentLength *int64 `json:"response_content_length"`
+			}
+			entries := map[string]logged{}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var e struct {
+					logged
+					Msg  string `json:"msg"`
+					Path string `json:"path"`
+				}
+				if json.Unmarshal([]byte(line), &e) == nil && e.Msg == "HTTP Request" && e.Path == "/"+tt.file {
+					entries[e.Method] = e.logged
+				}
+			}
+			if e := entries[http.MethodGet]; e.Status != http.StatusOK || e.Bytes != int64(tt.size) || e.ContentLength != nil {
+				t.Errorf("GET logged %+v, want %d bytes and no response_content_length", e, tt.size)
+			}
+			if e := entries[http.MethodHead]; e.Status != http.StatusOK || e.Bytes != 0 || e.ContentLength == nil || *e.ContentLength != int64(tt.size) {
+				t.Errorf("HEAD logged %+v, want 0 bytes and response_content_length %d", e, tt.size)
+			}
+		})
+	}
+}
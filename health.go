@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type health struct {
+	started time.Time
+	ready   atomic.Bool
+	addr    atomic.Pointer[string]
+	// maintenance, when set, fails /readyz while maintenance mode is on,
+	// so that load balancers drain the instance.
+	maintenance *maintenanceMode
+	// upstream, when set, adds the last GREEN-API checks to /readyz; with
+	// upstreamRequired, /readyz fails while no checked instance can reach
+	// GREEN-API.
+	upstream         *upstreamChecks
+	upstreamRequired bool
+}
+
+func newHealth() *health {
+	return &health{started: time.Now()}
+}
+
+func (h *health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// SetAddr records the address the main listener is bound to.
+func (h *health) SetAddr(addr string) {
+	h.addr.Store(&addr)
+}
+
+type healthResponse struct {
+	Status        string  `json:"status"`
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Addr          string  `json:"addr,omitempty"`
+
+	Upstream  *upstreamStatus           `json:"upstream,omitempty"`
+	Instances map[string]upstreamStatus `json:"instances,omitempty"`
+}
+
+func (h *health) response(status string) healthResponse {
+	uptime := time.Since(h.started)
+	resp := healthResponse{
+		Status:        status,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: uptime.Seconds(),
+	}
+	if addr := h.addr.Load(); addr != nil {
+		resp.Addr = *addr
+	}
+	return resp
+}
+
+func (h *health) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.response("ok"))
+}
+
+func (h *health) Readyz(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+	switch {
+	case !h.ready.Load():
+		status, code = "not_ready", http.StatusServiceUnavailable
+	case h.maintenance != nil && h.maintenance.get().Enabled:
+		status, code = "maintenance", http.StatusServiceUnavailable
+	case h.upstream != nil && h.upstreamRequired && !h.upstream.Reachable():
+		status, code = "upstream_unreachable", http.StatusServiceUnavailable
+	}
+
+	resp := h.response(status)
+	if h.upstream != nil {
+		resp.Upstream = h.upstream.Primary()
+		resp.Instances = h.upstream.Instances()
+	}
+	writeJSON(w, code, resp)
+}
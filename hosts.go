@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// hostExempt are the paths served whatever the Host header, as load
+// balancers probe them by IP address.
+var hostExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// hostPolicy is the set of host names requests may be addressed to: exact
+// names and wildcard subdomains such as *.example.com, which matches any
+// subdomain of example.com but not example.com itself.
+type hostPolicy struct {
+	exact    map[string]bool
+	suffixes []string
+	status   int
+}
+
+func newHostPolicy(cfg *Config) *hostPolicy {
+	p := &hostPolicy{exact: make(map[string]bool), status: cfg.HostRejectStatus}
+	for _, pattern := range cfg.AllowedHosts {
+		pattern = normalizeHost(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			p.suffixes = append(p.suffixes, "."+suffix)
+			continue
+		}
+		p.exact[pattern] = true
+	}
+	return p
+}
+
+// checkHostPattern reports why pattern cannot be matched against a Host
+// header.
+func checkHostPattern(pattern string) error {
+	host := strings.TrimPrefix(normalizeHost(pattern), "*.")
+	if host == "" || strings.ContainsAny(host, "*/ ") {
+		return fmt.Errorf("invalid host %q, want a name such as example.com or *.example.com", pattern)
+	}
+	return nil
+}
+
+// allowed reports whether the Host header host names an allowed host.
+func (p *hostPolicy) allowed(host string) bool {
+	host = normalizeHost(hostWithoutPort(host))
+	if host == "" {
+		return false
+	}
+	if p.exact[host] {
+		return true
+	}
+	for _, suffix := range p.suffixes {
+		if len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostWithoutPort strips the port from a Host header, which may be an IPv6
+// literal in brackets with or without a port.
+func hostWithoutPort(host string) string {
+	if rest, ok := strings.CutPrefix(host, "["); ok {
+		if end := strings.IndexByte(rest, ']'); end >= 0 {
+			return rest[:end]
+		}
+		return host
+	}
+	// More than one colon without brackets is a bare IPv6 address.
+	if i := strings.IndexByte(host, ':'); i >= 0 && strings.Count(host, ":") == 1 {
+		return host[:i]
+	}
+	return host
+}
+
+// normalizeHost lowercases host and drops the brackets of an IPv6 literal
+// and the trailing dot of a fully qualified name.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(host, ".")
+}
+
+// TrustedHosts rejects requests whose Host header names none of the allowed
+// hosts, so that a forged Host never reaches a handler that might build a
+// URL from it. Health checks pass with any host, and so does everything
+// while current returns nil.
+func TrustedHosts(current func(*http.Request) *hostPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := current(r)
+		if policy == nil || hostExempt[r.URL.Path] || policy.allowed(r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		WriteError(w, r, policy.status, errCodeInvalidHost, "host is not served here", nil,
+			slog.String("host", r.Host))
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostPolicyAllowed(t *testing.T) {
+	policy := newHostPolicy(testConfig(t, func(cfg *Config) {
+		cfg.AllowedHosts = []string{"example.com", "*.apps.example.com", "Admin.Example.ORG.", "::1", "[2001:db8::5]", "192.0.2.10"}
+	}))
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", false},
+		{"notexample.com", false},
+		{"api.apps.example.com", true},
+		{"a.b.apps.example.com", true},
+		{"apps.example.com", false},
+		{".apps.example.com", false},
+		{"evilapps.example.com", false},
+		{"example.com.", true},
+		{"api.apps.example.com.", true},
+		{"example.com:8080", true},
+		{"api.apps.example.com:443", true},
+		{"EXAMPLE.com", true},
+		{"API.Apps.Example.Com:8080", true},
+		{"admin.example.org", true},
+		{"admin.example.org.:80", true},
+		{"[::1]:8080", true},
+		{"[::1]", true},
+		{"::1", true},
+		{"2001:db8::5", true},
+		{"[2001:db8::5]:443", true},
+		{"[2001:db8::6]:443", false},
+		{"192.0.2.10:8080", true},
+		{"192.0.2.11", false},
+		{"", false},
+		{":8080", false},
+	}
+	for _, tt := range tests {
+		if got := policy.allowed(tt.host); got != tt.want {
+			t.Errorf("allowed(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestTrustedHosts(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		path       string
+		host       string
+		wantStatus int
+	}{
+		{"allowed host", http.StatusMisdirectedRequest, "/api/sendMessage", "example.com", http.StatusNoContent},
+		{"misdirected", http.StatusMisdirectedRequest, "/api/sendMessage", "evil.example.net", http.StatusMisdirectedRequest},
+		{"bad request", http.StatusBadRequest, "/api/sendMessage", "evil.example.net", http.StatusBadRequest},
+		{"healthz with any host", http.StatusMisdirectedRequest, "/healthz", "10.0.0.7:8080", http.StatusNoContent},
+		{"readyz with any host", http.StatusBadRequest, "/readyz", "evil.example.net", http.StatusNoContent},
+		{"below healthz", http.StatusMisdirectedRequest, "/healthz/x", "evil.example.net", http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := newHostPolicy(testConfig(t, func(cfg *Config) {
+				cfg.AllowedHosts = []string{"example.com"}
+				cfg.HostRejectStatus = tt.status
+			}))
+			h := TrustedHosts(func(*http.Request) *hostPolicy { return policy }, noContent)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusNoContent && !strings.Contains(rec.Body.String(), errCodeInvalidHost) {
+				t.Errorf("body = %s, want the %s error", rec.Body, errCodeInvalidHost)
+			}
+		})
+	}
+
+	t.Run("no policy", func(t *testing.T) {
+		h := TrustedHosts(func(*http.Request) *hostPolicy { return nil }, noContent)
+		req := httptest.NewRequest(http.MethodGet, "/api/sendMessage", nil)
+		req.Host = "evil.example.net"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+		}
+	})
+}
+
+func TestHostConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"reject status", map[string]string{"ALLOWED_HOSTS": "example.com", "HOST_REJECT_STATUS": "403"}, "HOST_REJECT_STATUS must be 421 or 400, got 403"},
+		{"wildcard in the middle", map[string]string{"ALLOWED_HOSTS": "api.*.example.com"}, `invalid host "api.*.example.com"`},
+		{"URL instead of a host", map[string]string{"ALLOWED_HOSTS": "https://example.com/"}, `invalid host "https://example.com/"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATIC_DIR", t.TempDir())
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := loadConfig(nil)
+			if err == nil {
+				t.Fatal("loadConfig accepted the configuration")
+			}
+			if got := strings.Join(configProblems(err), "\n"); !strings.Contains(got, tt.want) {
+				t.Errorf("problems lack %q:\n%s", tt.want, got)
+			}
+		})
+	}
+}
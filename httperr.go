@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// Error codes used in API error responses. Clients should branch on these
+// rather than on the message.
+const (
+	errCodeInvalidBody           = "invalid_body"
+	errCodeValidation            = "validation_failed"
+	errCodeBodyTooLarge          = "body_too_large"
+	errCodeUnauthorized          = "unauthorized"
+	errCodeForbidden             = "forbidden"
+	errCodeNotFound              = "not_found"
+	errCodeMethodNotAllowed      = "method_not_allowed"
+	errCodeInstanceNotAuthorized = "instance_not_authorized"
+	errCodeAlreadyAuthorized     = "instance_already_authorized"
+	errCodeQueueFull             = "queue_full"
+	errCodeInternal              = "internal_error"
+	errCodeOutboundRateLimited   = "outbound_rate_limited"
+	errCodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	errCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	errCodeIdempotencyInProgress = "idempotency_in_progress"
+	errCodeUpgradeRequired       = "upgrade_required"
+	errCodeInvalidHandshake      = "invalid_handshake"
+	errCodeShuttingDown          = "shutting_down"
+	errCodeMaintenance           = "maintenance"
+	errCodeInvalidHost           = "invalid_host"
+	errCodeRequestTimeout        = "request_timeout"
+	errCodeCSRFRejected          = "csrf_rejected"
+	errCodeInstanceNotFound      = "instance_not_found"
+	errCodeRateLimited           = "rate_limited"
+	errCodeOverloaded            = "overloaded"
+	errCodeURLFileRejected       = "url_file_rejected"
+
+	errCodeUpstreamUnauthorized = "upstream_unauthorized"
+	errCodeUpstreamRateLimited  = "upstream_rate_limited"
+	errCodeUpstreamRejected     = "upstream_rejected"
+	errCodeUpstreamError        = "upstream_error"
+	errCodeUpstreamUnreachable  = "upstream_unreachable"
+	errCodeUpstreamUnavailable  = "upstream_unavailable"
+	errCodeUpstreamTimeout      = "upstream_timeout"
+	errCodeClientCanceled       = "client_canceled"
+)
+
+// errorEnvelope is the body of every error response from the API endpoints.
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Details   any    `json:"details,omitempty"`
+}
+
+// WriteError answers with the error rendered by renderError, the JSON
+// envelope unless Accept asks for HTML or plain text, and logs it: 5xx at
+// error level, anything else at warn, and at info once the client has gone
+// away. attrs are added to the log entry only. Nothing is written if the
+// response has already started.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string, details any, attrs ...slog.Attr) {
+	level := slog.LevelWarn
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled):
+		level = slog.LevelInfo
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	}
+	attrs = append([]slog.Attr{
+		slog.Int("status", status),
+		slog.String("code", code),
+		slog.String("message", message),
+	}, attrs...)
+	LoggerFromContext(r.Context()).LogAttrs(r.Context(), level, "API error", attrs...)
+
+	renderError(w, r, status, code, message, details)
+}
+
+// HTTPError is an error that answers a request with an error response. A HandlerE returns it, as is or wrapped, to pick the status
+// and code of the response; any other error becomes 500.
+type HTTPError struct {
+	Status  int
+	Code    string
+	Message string
+	Details any
+	// Header is added to the response, such as Retry-After.
+	Header http.Header
+	// Attrs are added to the log entry only.
+	Attrs []slog.Attr
+	// Err is the cause, logged but never shown to the client.
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerE is a handler that returns its failure instead of answering it.
+// A nil error means the handler has written the response, or chose to
+// leave it to a middleware such as BodyLimit, exactly as an
+// http.HandlerFunc would. An error is answered by writeHTTPError.
+type HandlerE func(w http.ResponseWriter, r *http.Request) error
+
+func (h HandlerE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		writeHTTPError(w, r, err)
+	}
+}
+
+// writeHTTPError answers err with WriteError, using the first HTTPError in
+// its chain or 500 internal_error when there is none, and records it for
+// the "error" field of the access log. The cause, or err itself when it
+// wraps the HTTPError, goes to the log entry.
+func writeHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	var he *HTTPError
+	if !errors.As(err, &he) {
+		he = &HTTPError{Status: http.StatusInternalServerError, Code: errCodeInternal, Message: "internal error", Err: err}
+	}
+
+	attrs, cause := he.Attrs, he.Err
+	if err != error(he) {
+		cause = err
+	}
+	if cause != nil {
+		attrs = append(attrs[:len(attrs):len(attrs)], slog.Any("error", cause))
+	}
+	maps.Copy(w.Header(), he.Header)
+	setLogError(r, err)
+	WriteError(w, r, he.Status, he.Code, he.Message, he.Details, attrs...)
+}
+
+// isAPIPath reports whether urlPath is served by the JSON API, whose errors
+// use the envelope unless Accept asks for another format.
+func isAPIPath(urlPath string) bool {
+	return strings.HasPrefix(urlPath, "/api/") || strings.HasPrefix(urlPath, adminPrefix) || urlPath == "/webhook"
+}
+
+// apiNotFound answers requests under the catchAll pattern, such as /api/,
+// that no route matched. A path
+// that is routed for other methods gets 405 with Allow, as ServeMux would
+// answer without this catch-all.
+func apiNotFound(mux *http.ServeMux, catchAll string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allow []string
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := mux.Handler(probe); pattern != "" && pattern != catchAll {
+				allow = append(allow, method)
+			}
+		}
+
+		if len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			WriteError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed", nil)
+			return
+		}
+		WriteError(w, r, http.StatusNotFound, errCodeNotFound, "no such API endpoint", nil)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveErrors runs h behind RequestID, ContextLogger and RequestLogger,
+// which WriteError relies on, logging to the returned buffer.
+func serveErrors(ctx context.Context, target string, h http.Handler) (*httptest.ResponseRecorder, *logBuffer) {
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	handler := RequestID(ContextLogger(logger, RequestLogger(logger, defaultLogRules, h)))
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, logs
+}
+
+func TestWriteErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		code      string
+		details   any
+		canceled  bool
+		wantKeys  string
+		wantLevel string
+	}{
+		{"client error", http.StatusBadRequest, errCodeInvalidBody, nil, false, "code,message,request_id", "WARN"},
+		{"with details", http.StatusBadRequest, errCodeValidation, map[string]any{"fields": []string{"chatId"}}, false, "code,details,message,request_id", "WARN"},
+		{"not found", http.StatusNotFound, errCodeNotFound, nil, false, "code,message,request_id", "WARN"},
+		{"server error", http.StatusInternalServerError, errCodeInternal, nil, false, "code,message,request_id", "ERROR"},
+		{"upstream", http.StatusBadGateway, errCodeUpstreamError, nil, false, "code,message,request_id", "ERROR"},
+		{"client gone", http.StatusGatewayTimeout, errCodeClientCanceled, nil, true, "code,message,request_id", "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rec, logs := serveErrors(ctx, "/api/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.canceled {
+					cancel()
+				}
+				WriteError(w, r, tt.status, tt.code, "it failed", tt.details, slog.String("extra", "only logged"))
+			}))
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var envelope map[string]map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if len(envelope) != 1 || envelope["error"] == nil {
+				t.Fatalf("body = %s, want only an error object", rec.Body)
+			}
+			body := envelope["error"]
+			var keys []string
+			for _, key := range []string{"code", "details", "message", "request_id"} {
+				if _, ok := body[key]; ok {
+					keys = append(keys, key)
+				}
+			}
+			if strings.Join(keys, ",") != tt.wantKeys || len(body) != len(keys) {
+				t.Errorf("error keys = %v, want %s", body, tt.wantKeys)
+			}
+			id := rec.Header().Get(requestIDHeader)
+			if body["code"] != tt.code || body["message"] != "it failed" || body["request_id"] != id || id == "" {
+				t.Errorf("error = %v, want code %s and request_id %s", body, tt.code, id)
+			}
+
+			out := logs.String()
+			want := fmt.Sprintf(`"level":%q,"msg":"API error"`, tt.wantLevel)
+			if !strings.Contains(out, want) || !strings.Contains(out, `"request_id":"`+id+`"`) || !strings.Contains(out, `"extra":"only logged"`) {
+				t.Errorf("the log lacks %s with the request ID:\n%s", want, out)
+			}
+			if strings.Contains(rec.Body.String(), "only logged") {
+				t.Error("a log-only attribute reached the response")
+			}
+		})
+	}
+}
+
+func TestWriteErrorAfterHeadersSent(t *testing.T) {
+	rec, logs := serveErrors(context.Background(), "/api/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "partial")
+		WriteError(w, r, http.StatusInternalServerError, errCodeInternal, "too late", nil)
+	}))
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("got %d %q, want the response left as it was", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `"msg":"Error response dropped, response already started"`) {
+		t.Errorf("the dropped error was not logged:\n%s", logs)
+	}
+}
+
+func TestWriteHTTPError(t *testing.T) {
+	cause := errors.New("disk full")
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantHeader string
+		wantLogged string
+	}{
+		{"plain error", cause, http.StatusInternalServerError, errCodeInternal, "", `"error":"disk full"`},
+		{"HTTPError", &HTTPError{Status: http.StatusConflict, Code: errCodeIdempotencyKeyReused, Message: "reused", Err: cause},
+			http.StatusConflict, errCodeIdempotencyKeyReused, "", `"error":"disk full"`},
+		{"wrapped HTTPError", fmt.Errorf("save: %w", &HTTPError{Status: http.StatusServiceUnavailable, Code: errCodeQueueFull, Message: "full",
+			Header: http.Header{"Retry-After": {"3"}}}), http.StatusServiceUnavailable, errCodeQueueFull, "3", `"error":"save: full"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, logs := serveErrors(context.Background(), "/api/test", HandlerE(func(w http.ResponseWriter, r *http.Request) error {
+				return tt.err
+			}))
+			var envelope apiError
+			json.Unmarshal(rec.Body.Bytes(), &envelope)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantHeader {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantHeader)
+			}
+			if !strings.Contains(logs.String(), tt.wantLogged) {
+				t.Errorf("the log lacks %s:\n%s", tt.wantLogged, logs)
+			}
+			if strings.Contains(rec.Body.String(), "disk full") {
+				t.Error("the cause reached the client")
+			}
+		})
+	}
+}
+
+func TestServerErrorEnvelopes(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantCode   string
+	}{
+		{"unknown API path", http.MethodGet, "/api/nope", http.StatusNotFound, errCodeNotFound},
+		{"wrong method", http.MethodDelete, "/api/getSettings", http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{"bad JSON", http.MethodPost, "/api/sendMessage", http.StatusBadRequest, errCodeInvalidBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == http.MethodPost {
+				body = "{"
+			}
+			rec, envelope := callAPI(t, s, tt.method, tt.target, body, nil)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode)
+			}
+			if rec.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	// Static files keep the file server's own answers.
+	rec := serve(s, http.MethodGet, "/missing.css", nil)
+	if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("static 404 = %d %q, want no JSON envelope", rec.Code, rec.Body)
+	}
+}
+
+// accessLine returns the "HTTP Request" line of logs decoded.
+func accessLine(t *testing.T, logs *logBuffer) map[string]any {
+	t.Helper()
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `"msg":"HTTP Request"`) {
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatal(err)
+			}
+			return fields
+		}
+	}
+	t.Fatalf("no access log line:\n%s", logs)
+	return nil
+}
+
+func TestHandlerE(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    HandlerE
+		wantStatus int
+		wantBody   string
+		wantError  string // the "error" field of the access log, "" for none
+	}{
+		{"nil after writing", func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"id":1}`)
+			return nil
+		}, http.StatusCreated, `{"id":1}`, ""},
+		{"nil without writing", func(w http.ResponseWriter, r *http.Request) error {
+			return nil
+		}, http.StatusOK, "", ""},
+		{"typed", func(w http.ResponseWriter, r *http.Request) error {
+			return &HTTPError{Status: http.StatusNotFound, Code: errCodeInstanceNotFound, Message: "no such instance"}
+		}, http.StatusNotFound, errCodeInstanceNotFound, "no such instance"},
+		{"wrapped", func(w http.ResponseWriter, r *http.Request) error {
+			return fmt.Errorf("load: %w", &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError, Message: "upstream failed"})
+		}, http.StatusBadGateway, errCodeUpstreamError, "load: upstream failed"},
+		{"default 500", func(w http.ResponseWriter, r *http.Request) error {
+			return errors.New("disk full")
+		}, http.StatusInternalServerError, errCodeInternal, "disk full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, logs := serveErrors(context.Background(), "/api/test", tt.handler)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d with %q", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+			line := accessLine(t, logs)
+			if got, _ := line["error"].(string); got != tt.wantError {
+				t.Errorf("access log error = %q, want %q", got, tt.wantError)
+			}
+			if line["request_id"] != rec.Header().Get(requestIDHeader) {
+				t.Errorf("access log request_id = %v", line["request_id"])
+			}
+			want := 0
+			if tt.wantError != "" {
+				want = 1
+			}
+			if n := strings.Count(logs.String(), `"msg":"API error"`); n != want {
+				t.Errorf("API error logged %d times, want %d:\n%s", n, want, logs)
+			}
+		})
+	}
+}
+
+func TestHTTPErrorChain(t *testing.T) {
+	cause := errors.New("connection reset")
+	he := &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamUnreachable, Message: "upstream unreachable", Err: cause}
+	tests := []struct {
+		name string
+		err  error
+		text string
+	}{
+		{"direct", he, "upstream unreachable: connection reset"},
+		{"wrapped", fmt.Errorf("getSettings: %w", he), "getSettings: upstream unreachable: connection reset"},
+		{"joined", errors.Join(errors.New("first"), he), "first\nupstream unreachable: connection reset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *HTTPError
+			if !errors.As(tt.err, &got) || got != he {
+				t.Fatalf("errors.As found %v, want the HTTPError", got)
+			}
+			if !errors.Is(tt.err, cause) {
+				t.Error("the cause is not in the chain")
+			}
+			if tt.err.Error() != tt.text {
+				t.Errorf("Error() = %q, want %q", tt.err.Error(), tt.text)
+			}
+		})
+	}
+	if got := (&HTTPError{Message: "gone"}).Error(); got != "gone" {
+		t.Errorf("Error() without a cause = %q", got)
+	}
+}
+
+// TestServerHandlerErrors checks a migrated API handler reports its error
+// through the envelope and the access log.
+func TestServerHandlerErrors(t *testing.T) {
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+	rec, envelope := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil)
+	if rec.Code != http.StatusBadGateway || envelope.Error.Code != errCodeUpstreamError {
+		t.Fatalf("got %d %s: %s", rec.Code, envelope.Error.Code, rec.Body)
+	}
+	if line := accessLine(t, logs); line["error"] == nil || line["status"] != float64(http.StatusBadGateway) {
+		t.Errorf("access log = %v, want status 502 with the error", line)
+	}
+	if n := strings.Count(logs.String(), `"msg":"API error"`); n != 1 {
+		t.Errorf("API error logged %d times, want once", n)
+	}
+}
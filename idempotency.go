@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength keeps keys to what a UUID or a similar token
+	// needs.
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyRecord is what is kept for a key: the fingerprint of the
+// request that claimed it and, once it is done, its response.
+type idempotencyRecord struct {
+	fingerprint string
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyStore keeps idempotencyRecords for a while. It is in memory
+// for now; a shared store such as Redis implements claim with SET NX,
+// complete with SET and release with DEL.
+type idempotencyStore interface {
+	// claim stores rec for key unless key is taken, in which case it
+	// returns the record already there and stores nothing.
+	claim(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error)
+	// complete replaces the record of a claimed key.
+	complete(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error
+	// release drops a claimed key, so the request can be made again.
+	release(ctx context.Context, key string) error
+}
+
+// idempotencySweepInterval is how often expired keys are dropped from a
+// memoryIdempotencyStore.
+const idempotencySweepInterval = time.Minute
+
+type memoryIdempotencyStore struct {
+	// now may be replaced before the first call.
+	now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]*memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	rec     idempotencyRecord
+	expires time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		now:     time.Now,
+		records: make(map[string]*memoryIdempotencyEntry),
+	}
+}
+
+func (s *memoryIdempotencyStore) claim(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > idempotencySweepInterval {
+		s.sweep(now)
+	}
+	if entry, ok := s.records[key]; ok && now.Before(entry.expires) {
+		existing := entry.rec
+		return &existing, nil
+	}
+	s.records[key] = &memoryIdempotencyEntry{rec: rec, expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) complete(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = &memoryIdempotencyEntry{rec: rec, expires: s.now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) sweep(now time.Time) {
+	for key, entry := range s.records {
+		if !now.Before(entry.expires) {
+			delete(s.records, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// headerScope keys stored responses by the credentials in the request
+// headers: idInstance is no secret, so that alone would let anyone with the
+// same Idempotency-Key read what the owner of the token was answered.
+func headerScope(r *http.Request) string {
+	idInstance := r.Header.Get(idInstanceHeader)
+	if idInstance == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(idInstance + "\x00" + r.Header.Get(apiTokenHeader)))
+	return "headers:" + hex.EncodeToString(sum[:16])
+}
+
+// Idempotent makes retries of next safe for requests carrying an
+// Idempotency-Key header. The first request with a key is served and its
+// response kept for ttl; a repeat with the same body gets that response
+// again without next being called, one with a different body gets 422 and
+// one arriving while the first is still being served gets 409. Keys are
+// scoped to the instance of the request.
+//
+// Responses with 5xx or 429 are not kept, as the request may succeed when
+// sent again.
+func Idempotent(store idempotencyStore, ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength || !isPrintableASCII(key) {
+			WriteError(w, r, http.StatusBadRequest, errCodeInvalidIdempotencyKey, "Idempotency-Key must be at most 255 printable ASCII characters", nil)
+			return
+		}
+
+		// The body is needed for the fingerprint; a read error, such as
+		// one from BodyLimit, is left for next to run into.
+		body, readErr := io.ReadAll(r.Body)
+		r.Body.Close()
+		if readErr != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{readErr}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+		scope := headerScope(r)
+		if instance, ok := instanceFromContext(r.Context()); ok {
+			scope = "instance:" + instance.name
+		} else if scope == "" {
+			scope = sessionScope(r)
+		}
+		storeKey := scope + "\x00" + key
+		keyAttr := slog.String("idempotency_key", key)
+
+		existing, err := store.claim(r.Context(), storeKey, idempotencyRecord{fingerprint: fingerprint}, ttl)
+		if err != nil {
+			WriteError(w, r, http.StatusInternalServerError, errCodeInternal, "could not check the Idempotency-Key", nil,
+				keyAttr, slog.Any("error", err))
+			return
+		}
+		switch {
+		case existing == nil:
+		case existing.fingerprint != fingerprint:
+			WriteError(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request", nil, keyAttr)
+			return
+		case !existing.done:
+			w.Header().Set("Retry-After", "1")
+			WriteError(w, r, http.StatusConflict, errCodeIdempotencyInProgress, "a request with this Idempotency-Key is still in progress", nil, keyAttr)
+			return
+		default:
+			LoggerFromContext(r.Context()).Debug("Replaying response for Idempotency-Key", keyAttr)
+			if existing.contentType != "" {
+				w.Header().Set("Content-Type", existing.contentType)
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(existing.status)
+			w.Write(existing.body)
+			return
+		}
+
+		iw := &idempotencyWriter{responseWriter: responseWriter{ResponseWriter: w}}
+		completed := false
+		defer func() {
+			// A panic or a response not worth keeping frees the key.
+			if completed {
+				return
+			}
+			if err := store.release(context.WithoutCancel(r.Context()), storeKey); err != nil {
+				LoggerFromContext(r.Context()).Warn("Could not release Idempotency-Key", keyAttr, slog.Any("error", err))
+			}
+		}()
+		next.ServeHTTP(iw, r)
+
+		status := iw.statusCode()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return
+		}
+		err = store.complete(context.WithoutCancel(r.Context()), storeKey, idempotencyRecord{
+			fingerprint: fingerprint,
+			done:        true,
+			status:      status,
+			contentType: iw.Header().Get("Content-Type"),
+			body:        iw.body.Bytes(),
+		}, ttl)
+		if err != nil {
+			LoggerFromContext(r.Context()).Warn("Could not store response for Idempotency-Key", keyAttr, slog.Any("error", err))
+			return
+		}
+		completed = true
+	})
+}
+
+// idempotencyWriter keeps a copy of the response body.
+type idempotencyWriter struct {
+	responseWriter
+	body bytes.Buffer
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	n, err := iw.responseWriter.Write(b)
+	iw.body.Write(b[:n])
+	return n, err
+}
+
+func (iw *idempotencyWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(writerOnly{iw}, src)
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentHandler wraps a handler counting its calls in Idempotent with a
+// memory store whose clock the returned function moves.
+func idempotentHandler(status int) (http.Handler, *atomic.Int32, func(time.Duration)) {
+	now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	store := newMemoryIdempotencyStore()
+	store.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	var calls atomic.Int32
+	h := Idempotent(store, time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"idMessage":"BAE%d","echo":%q}`, n, body)
+	}))
+	return h, &calls, advance
+}
+
+// idempotentRequest sends body with key, and with idInstance when it is not
+// empty, to h.
+func idempotentRequest(h http.Handler, key, idInstance, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/sendMessage", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	if idInstance != "" {
+		req.Header.Set(idInstanceHeader, idInstance)
+		req.Header.Set(apiTokenHeader, "token-"+idInstance)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotent(t *testing.T) {
+	const body = `{"chatId":"79001234567@c.us","message":"hi"}`
+	type call struct {
+		advance    time.Duration
+		key        string
+		idInstance string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantReplay bool
+	}
+	tests := []struct {
+		name      string
+		status    int
+		calls     []call
+		wantCalls int32
+	}{
+		{"replay", http.StatusOK, []call{
+			{0, "k1", "", body, http.StatusOK, "", false},
+			{time.Minute, "k1", "", body, http.StatusOK, "", true},
+			{time.Minute, "k1", "", body, http.StatusOK, "", true},
+		}, 1},
+		{"different body", http.StatusOK, []call{
+			{0, "k1", "", body, http.StatusOK, "", false},
+			{0, "k1", "", `{"chatId":"79001234567@c.us","message":"bye"}`, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused, false},
+		}, 1},
+		{"expired", http.StatusOK, []call{
+			{0, "k1", "", body, http.StatusOK, "", false},
+			{time.Hour, "k1", "", body, http.StatusOK, "", false},
+		}, 2},
+		{"just before expiry", http.StatusOK, []call{
+			{0, "k1", "", body, http.StatusOK, "", false},
+			{time.Hour - time.Second, "k1", "", body, http.StatusOK, "", true},
+		}, 1},
+		{"other keys", http.StatusOK, []call{
+			{0, "k1", "", body, http.StatusOK, "", false},
+			{0, "k2", "", body, http.StatusOK, "", false},
+		}, 2},
+		{"other instances", http.StatusOK, []call{
+			{0, "k1", "1101", body, http.StatusOK, "", false},
+			{0, "k1", "2202", body, http.StatusOK, "", false},
+			{0, "k1", "1101", body, http.StatusOK, "", true},
+		}, 2},
+		{"no key", http.StatusOK, []call{
+			{0, "", "", body, http.StatusOK, "", false},
+			{0, "", "", body, http.StatusOK, "", false},
+		}, 2},
+		{"invalid key", http.StatusOK, []call{
+			{0, "k\x01", "", body, http.StatusBadRequest, errCodeInvalidIdempotencyKey, false},
+			{0, strings.Repeat("k", maxIdempotencyKeyLength+1), "", body, http.StatusBadRequest, errCodeInvalidIdempotencyKey, false},
+		}, 0},
+		{"5xx is not kept", http.StatusBadGateway, []call{
+			{0, "k1", "", body, http.StatusBadGateway, "", false},
+			{0, "k1", "", body, http.StatusBadGateway, "", false},
+		}, 2},
+		{"4xx is kept", http.StatusBadRequest, []call{
+			{0, "k1", "", body, http.StatusBadRequest, "", false},
+			{0, "k1", "", body, http.StatusBadRequest, "", true},
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, calls, advance := idempotentHandler(tt.status)
+			var first string
+			for i, c := range tt.calls {
+				advance(c.advance)
+				rec := idempotentRequest(h, c.key, c.idInstance, c.body)
+				if rec.Code != c.wantStatus {
+					t.Fatalf("call %d: status = %d, want %d: %s", i+1, rec.Code, c.wantStatus, rec.Body)
+				}
+				if c.wantCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+c.wantCode+`"`) {
+					t.Errorf("call %d: body = %s, want %s", i+1, rec.Body, c.wantCode)
+				}
+				replayed := rec.Header().Get(idempotencyReplayedHeader) == "true"
+				if replayed != c.wantReplay {
+					t.Errorf("call %d: replayed = %t, want %t", i+1, replayed, c.wantReplay)
+				}
+				if i == 0 {
+					first = rec.Body.String()
+				} else if replayed && (rec.Body.String() != first || rec.Header().Get("Content-Type") != "application/json") {
+					t.Errorf("call %d: replayed %q (%s), want %q", i+1, rec.Body, rec.Header().Get("Content-Type"), first)
+				}
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentConcurrentFirstRequests(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	var calls atomic.Int32
+	h := Idempotent(newMemoryIdempotencyStore(), time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(entered)
+		}
+		<-release
+		io.WriteString(w, `{"idMessage":"BAE5"}`)
+	}))
+	const body = `{"chatId":"79001234567@c.us","message":"hi"}`
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- idempotentRequest(h, "k1", "", body) }()
+	<-entered
+
+	const others = 8
+	var wg sync.WaitGroup
+	statuses := make([]int, others)
+	wg.Add(others)
+	for i := range others {
+		go func() {
+			defer wg.Done()
+			rec := idempotentRequest(h, "k1", "", body)
+			statuses[i] = rec.Code
+			if rec.Code == http.StatusConflict && rec.Header().Get("Retry-After") == "" {
+				t.Error("409 without Retry-After")
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Errorf("first request: %d %s", rec.Code, rec.Body)
+	}
+	for i, status := range statuses {
+		if status != http.StatusConflict {
+			t.Errorf("request %d: status = %d, want 409 while the first is in flight", i+2, status)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("handler called %d times, want 1", calls.Load())
+	}
+	if rec := idempotentRequest(h, "k1", "", body); rec.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("the response was not kept once the first request finished")
+	}
+}
+
+func TestIdempotentReleasesOnPanic(t *testing.T) {
+	var calls atomic.Int32
+	h := Recover(slog.New(slog.NewJSONHandler(io.Discard, nil)), Idempotent(newMemoryIdempotencyStore(), time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+		io.WriteString(w, `{"idMessage":"BAE5"}`)
+	})))
+
+	if rec := idempotentRequest(h, "k1", "", "{}"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	if rec := idempotentRequest(h, "k1", "", "{}"); rec.Code != http.StatusOK {
+		t.Errorf("after the panic the key is still taken: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestIdempotentSendMessage(t *testing.T) {
+	var calls atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"idMessage":"BAE%d"}`, calls.Add(1))
+	})
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+	header := http.Header{idempotencyKeyHeader: {"retry-1"}}
+	const body = `{"chatId":"79001234567@c.us","message":"hi"}`
+	first, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", body, header)
+	again, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", body, header)
+	if first.Code != http.StatusOK || again.Code != http.StatusOK || again.Body.String() != first.Body.String() {
+		t.Errorf("got %d %q, then %d %q", first.Code, first.Body, again.Code, again.Body)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("GREEN-API got %d messages, want 1", calls.Load())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TemplateVars are the values index.html is rendered with under
+// INDEX_TEMPLATE. In the environment they are a JSON object, e.g.
+// {"apiBase":"/api","features":{"chat":true}}.
+type TemplateVars map[string]any
+
+func (v *TemplateVars) UnmarshalText(text []byte) error {
+	// A plain map, as TemplateVars would have json call UnmarshalText again.
+	vars := make(map[string]any)
+	if len(bytes.TrimSpace(text)) > 0 {
+		if err := json.Unmarshal(text, &vars); err != nil {
+			return fmt.Errorf("invalid template vars, want a JSON object: %w", err)
+		}
+	}
+	*v = vars
+	return nil
+}
+
+func (v *TemplateVars) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]any
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	*v = raw
+	return nil
+}
+
+// MarshalJSON keeps html/template from quoting the vars as the string of
+// String in a script: {{.Vars}} there is the object itself.
+func (v TemplateVars) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any(v))
+}
+
+func (v TemplateVars) String() string {
+	if len(v) == 0 {
+		return ""
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(map[string]any(v))
+	}
+	return string(text)
+}
+
+// indexData is what index.html is rendered with: {{.Vars.apiBase}} and
+// {{.Version}}.
+type indexData struct {
+	Vars    TemplateVars
+	Version string
+}
+
+func newIndexData(cfg *Config) indexData {
+	return indexData{Vars: cfg.TemplateVars, Version: readBuildInfo(cfg.AppVersion).Version}
+}
+
+// indexPage is /index.html rendered with html/template. Neither the template
+// nor the data change while the server runs, so it is rendered once, at
+// startup, where a broken template or a missing variable stops the server
+// instead of failing the first request.
+type indexPage struct {
+	content []byte
+	etag    string
+	modTime time.Time
+}
+
+func newIndexPage(root http.FileSystem, data indexData) (*indexPage, error) {
+	f, err := root.Open("/index.html")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	src, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New("index.html").Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	etag, err := hashETag(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return &indexPage{content: buf.Bytes(), etag: etag, modTime: info.ModTime()}, nil
+}
+
+func (p *indexPage) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", p.etag)
+	http.ServeContent(w, r, "index.html", p.modTime, bytes.NewReader(p.content))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateVarsUnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{`{"apiBase":"/api"}`, `{"apiBase":"/api"}`, false},
+		{`{"features":{"chat":true},"max":3}`, `{"features":{"chat":true},"max":3}`, false},
+		{`["apiBase"]`, "", true},
+		{`{"apiBase":`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var vars TemplateVars
+			err := vars.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalText = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && vars.String() != tt.want {
+				t.Errorf("vars = %s, want %s", vars, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewIndexPage(t *testing.T) {
+	vars := TemplateVars{
+		"apiBase": "/api",
+		"title":   `<script>alert("x")</script>`,
+		"link":    "javascript:alert(1)",
+		"chat":    true,
+	}
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{"variable", `<base href="{{.Vars.apiBase}}">`, `<base href="/api">`, false},
+		{"version", `<meta name="version" content="{{.Version}}">`, `<meta name="version" content="1.2.3">`, false},
+		{"condition", `{{if .Vars.chat}}chat{{end}}`, "chat", false},
+		{"text is escaped", `<title>{{.Vars.title}}</title>`, `<title>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</title>`, false},
+		{"unsafe URL is replaced", `<a href="{{.Vars.link}}">`, `<a href="#ZgotmplZ">`, false},
+		{"script gets JSON", `<script>const cfg = {{.Vars}};</script>`, `<script>const cfg = {"apiBase":"/api",`, false},
+		{"string in a script is quoted", `<script>const base = {{.Vars.apiBase}};</script>`, `<script>const base = "/api";</script>`, false},
+		{"missing variable", `{{.Vars.nope}}`, "", true},
+		{"parse error", `{{.Vars.apiBase`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(tt.src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			page, err := newIndexPage(http.Dir(dir), indexData{Vars: vars, Version: "1.2.3"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newIndexPage = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(page.content), tt.want) {
+				t.Errorf("rendered %s, want %s", page.content, tt.want)
+			}
+			if page.etag == "" {
+				t.Error("the page has no ETag")
+			}
+		})
+	}
+}
+
+func TestServerIndexTemplate(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *Config) {
+		os.WriteFile(filepath.Join(cfg.StaticDir, "index.html"), []byte(`<p>{{.Vars.apiBase}}</p>`), 0o644)
+		os.WriteFile(filepath.Join(cfg.StaticDir, "app.js"), []byte(`const api = "{{.Vars.apiBase}}";`), 0o644)
+		cfg.IndexTemplate = true
+		cfg.SPAMode = true
+		cfg.TemplateVars = TemplateVars{"apiBase": "/v2"}
+	})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "<p>/v2</p>"},
+		{"/chats/42", "<p>/v2</p>"},
+		{"/app.js", `const api = "{{.Vars.apiBase}}";`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, tt.path, nil)
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("got %d %q, want %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+
+	// The rendered page is cached, so its ETag holds across requests.
+	etag := serve(s, http.MethodGet, "/", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("the rendered index has no ETag")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional GET = %d, want 304", rec.Code)
+	}
+}
+
+func TestServerIndexTemplateFailsStartup(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		os.WriteFile(filepath.Join(cfg.StaticDir, "index.html"), []byte(`<p>{{.Vars.apiBase</p>`), 0o644)
+		cfg.IndexTemplate = true
+	})
+	if _, err := NewServer(cfg, slog.New(slog.DiscardHandler), nil); err == nil || !strings.Contains(err.Error(), "render index.html") {
+		t.Errorf("NewServer = %v, want the template error", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// instancesPrefix is where the named instances are served: the rest of the
+// path after the name is an /api/ route.
+const instancesPrefix = "/api/instances/"
+
+// defaultInstanceName labels GREENAPI_ID_INSTANCE, which has no name of
+// its own.
+const defaultInstanceName = "default"
+
+// otherInstance labels metrics of instances that are not configured by
+// name, such as those of X-Id-Instance, so that they cannot grow the label
+// set without bound.
+const otherInstance = "other"
+
+var instanceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// GreenAPIInstance is one named instance of GREENAPI_INSTANCES.
+type GreenAPIInstance struct {
+	IDInstance string `yaml:"id_instance"`
+	APIToken   string `yaml:"api_token"`
+}
+
+// GreenAPIInstances are the named instances, in the environment written as
+// "name=idInstance:apiToken" pairs separated by ",". A token written as
+// $VAR or ${VAR} is read from that environment variable, so the token
+// itself need not be in the list or the config file.
+type GreenAPIInstances map[string]GreenAPIInstance
+
+func (g *GreenAPIInstances) UnmarshalText(text []byte) error {
+	instances := make(GreenAPIInstances)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, creds, ok := strings.Cut(item, "=")
+		idInstance, apiToken, ok2 := strings.Cut(creds, ":")
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid instance %q, want name=idInstance:apiToken", strings.TrimSpace(name))
+		}
+		if err := instances.add(name, GreenAPIInstance{IDInstance: idInstance, APIToken: apiToken}); err != nil {
+			return err
+		}
+	}
+	*g = instances
+	return nil
+}
+
+func (g *GreenAPIInstances) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]GreenAPIInstance
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	instances := make(GreenAPIInstances, len(raw))
+	for name, instance := range raw {
+		if err := instances.add(name, instance); err != nil {
+			return err
+		}
+	}
+	*g = instances
+	return nil
+}
+
+func (g GreenAPIInstances) add(name string, instance GreenAPIInstance) error {
+	name = strings.TrimSpace(name)
+	if !instanceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q, want lowercase letters, digits, - and _", name)
+	}
+	instance.IDInstance = strings.TrimSpace(instance.IDInstance)
+	token, err := expandSecret(strings.TrimSpace(instance.APIToken))
+	if err != nil {
+		return fmt.Errorf("instance %s: %w", name, err)
+	}
+	instance.APIToken = token
+	if instance.IDInstance == "" || instance.APIToken == "" {
+		return fmt.Errorf("instance %s needs both idInstance and apiToken", name)
+	}
+	g[name] = instance
+	return nil
+}
+
+// expandSecret reads a value written as $VAR or ${VAR} from the
+// environment; anything else is taken as it is.
+func expandSecret(value string) (string, error) {
+	name, ok := strings.CutPrefix(value, "$")
+	if !ok {
+		return value, nil
+	}
+	if inner, ok := strings.CutPrefix(name, "{"); ok {
+		name, ok = strings.CutSuffix(inner, "}")
+		if !ok {
+			return "", fmt.Errorf("unterminated %q", value)
+		}
+	}
+	secret, ok := os.LookupEnv(name)
+	if !ok || secret == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return secret, nil
+}
+
+// String lists the names and instance IDs only, so tokens never end up in
+// the logged configuration or usage output.
+func (g GreenAPIInstances) String() string {
+	names := g.names()
+	for i, name := range names {
+		names[i] = name + "=" + g[name].IDInstance
+	}
+	return strings.Join(names, ",")
+}
+
+func (g GreenAPIInstances) names() []string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instanceLabel returns the name of the instance with idInstance for
+// metrics and logs: its name in GREENAPI_INSTANCES, defaultInstanceName for
+// GREENAPI_ID_INSTANCE, or otherInstance.
+func (c *Config) instanceLabel(idInstance string) string {
+	for _, name := range c.GreenAPIInstances.names() {
+		if c.GreenAPIInstances[name].IDInstance == idInstance {
+			return name
+		}
+	}
+	if idInstance != "" && idInstance == c.GreenAPIIDInstance {
+		return defaultInstanceName
+	}
+	return otherInstance
+}
+
+// DefaultInstance returns the credentials of the unprefixed /api/ routes,
+// the poller and the fallback health check: GREENAPI_DEFAULT_INSTANCE, or
+// else GREENAPI_ID_INSTANCE and GREENAPI_API_TOKEN.
+func (c *Config) DefaultInstance() (idInstance, apiToken string) {
+	if instance, ok := c.GreenAPIInstances[c.GreenAPIDefaultInstance]; ok && c.GreenAPIDefaultInstance != "" {
+		return instance.IDInstance, instance.APIToken
+	}
+	return c.GreenAPIIDInstance, c.GreenAPIToken
+}
+
+// namedInstance is the instance a request under instancesPrefix selected.
+type namedInstance struct {
+	name string
+	// path is the request path before InstanceRoutes rewrote it.
+	path string
+	GreenAPIInstance
+}
+
+type instanceKey struct{}
+
+// instanceFromContext returns the instance selected by InstanceRoutes.
+func instanceFromContext(ctx context.Context) (namedInstance, bool) {
+	instance, ok := ctx.Value(instanceKey{}).(namedInstance)
+	return instance, ok
+}
+
+// matchRequestPath reports whether match holds for the path of r or, under
+// instancesPrefix, for the path before InstanceRoutes rewrote it, so that
+// access policies protect a request whichever form their prefixes name.
+func matchRequestPath(r *http.Request, match func(urlPath string) bool) bool {
+	if match(r.URL.Path) {
+		return true
+	}
+	instance, ok := instanceFromContext(r.Context())
+	return ok && match(instance.path)
+}
+
+// InstanceRoutes serves /api/instances/{name}/... as the /api/ route after
+// the name, with the credentials of that instance. The path is rewritten
+// before the rest of the middleware, so body limits, timeouts and the other
+// per-path settings of a route apply to it under every instance; IP
+// filtering, Basic auth, CSRF and client certificates match the original
+// path as well, through matchRequestPath. Unknown
+// names get 404. The name is added to the request log and to every line
+// logged while serving the request, the upstream calls included.
+func InstanceRoutes(instances GreenAPIInstances, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, instancesPrefix)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, route, _ := strings.Cut(rest, "/")
+		instance, ok := instances[name]
+		if !ok {
+			WriteError(w, r, http.StatusNotFound, errCodeInstanceNotFound, "no such instance",
+				map[string]string{"instance": name})
+			return
+		}
+		setLogInstance(r, name)
+
+		ctx := context.WithValue(r.Context(), instanceKey{}, namedInstance{name: name, path: r.URL.Path, GreenAPIInstance: instance})
+		ctx = context.WithValue(ctx, loggerKey{}, LoggerFromContext(ctx).With(slog.String("instance", name)))
+		r2 := r.WithContext(ctx)
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/api/" + route
+		if r.URL.RawPath != "" {
+			if rawRest, ok := strings.CutPrefix(r.URL.RawPath, instancesPrefix); ok {
+				_, rawRoute, _ := strings.Cut(rawRest, "/")
+				r2.URL.RawPath = "/api/" + rawRoute
+			} else {
+				r2.URL.RawPath = ""
+			}
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
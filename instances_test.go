@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGreenAPIInstancesUnmarshalText(t *testing.T) {
+	t.Setenv("SUPPORT_TOKEN", "support-token")
+	tests := []struct {
+		text    string
+		want    GreenAPIInstances
+		wantErr string
+	}{
+		{"", GreenAPIInstances{}, ""},
+		{"support=2202:tok, sales=3303:tok2", GreenAPIInstances{"support": {"2202", "tok"}, "sales": {"3303", "tok2"}}, ""},
+		{"support=2202:$SUPPORT_TOKEN", GreenAPIInstances{"support": {"2202", "support-token"}}, ""},
+		{"support=2202:${SUPPORT_TOKEN}", GreenAPIInstances{"support": {"2202", "support-token"}}, ""},
+		{"support=2202:${MISSING_TOKEN}", nil, "environment variable MISSING_TOKEN is not set"},
+		{"support=2202:${SUPPORT_TOKEN", nil, "unterminated"},
+		{"Support=2202:tok", nil, `invalid instance name "Support"`},
+		{"support=2202", nil, `invalid instance "support"`},
+		{"support=:tok", nil, "instance support needs both idInstance and apiToken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var got GreenAPIInstances
+			err := got.UnmarshalText([]byte(tt.text))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("UnmarshalText = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, instance := range tt.want {
+				if got[name] != instance {
+					t.Errorf("%s = %+v, want %+v", name, got[name], instance)
+				}
+			}
+			if s := got.String(); strings.Contains(s, "tok") {
+				t.Errorf("String() shows a token: %s", s)
+			}
+		})
+	}
+}
+
+func TestInstanceRoutes(t *testing.T) {
+	instances := GreenAPIInstances{"support": {IDInstance: "2202", APIToken: "support-token"}}
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantPath     string
+		wantRawPath  string
+		wantInstance string
+	}{
+		{"named instance", "/api/instances/support/sendMessage", http.StatusOK, "/api/sendMessage", "", "support"},
+		{"query kept", "/api/instances/support/chatHistory?count=5", http.StatusOK, "/api/chatHistory", "", "support"},
+		{"escaped segment", "/api/instances/support/queue/a%2Fb", http.StatusOK, "/api/queue/a/b", "/api/queue/a%2Fb", "support"},
+		{"unprefixed route", "/api/sendMessage", http.StatusOK, "/api/sendMessage", "", ""},
+		{"static file", "/app.js", http.StatusOK, "/app.js", "", ""},
+		{"unknown instance", "/api/instances/sales/sendMessage", http.StatusNotFound, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			h := InstanceRoutes(instances, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Accept", "application/json")
+			original := *req.URL
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusNotFound {
+				var envelope apiError
+				json.Unmarshal(rec.Body.Bytes(), &envelope)
+				if got != nil || envelope.Error.Code != errCodeInstanceNotFound {
+					t.Errorf("unknown instance: served %t, code %s", got != nil, envelope.Error.Code)
+				}
+				return
+			}
+			if got.URL.Path != tt.wantPath || got.URL.RawPath != tt.wantRawPath {
+				t.Errorf("path %q raw %q, want %q raw %q", got.URL.Path, got.URL.RawPath, tt.wantPath, tt.wantRawPath)
+			}
+			if *req.URL != original {
+				t.Errorf("the original request was changed to %s", req.URL)
+			}
+			if got.URL.RawQuery != req.URL.RawQuery {
+				t.Errorf("query %q, want %q", got.URL.RawQuery, req.URL.RawQuery)
+			}
+			instance, ok := instanceFromContext(got.Context())
+			if instance.name != tt.wantInstance || ok != (tt.wantInstance != "") {
+				t.Errorf("instance %q (%t), want %q", instance.name, ok, tt.wantInstance)
+			}
+			if ok && instance.IDInstance != "2202" {
+				t.Errorf("instance credentials = %+v", instance.GreenAPIInstance)
+			}
+		})
+	}
+}
+
+func TestServerInstanceRoutes(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		io.WriteString(w, `{"stateInstance":"authorized"}`)
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.GreenAPIInstances = GreenAPIInstances{
+			"support": {IDInstance: "2202", APIToken: "support-token"},
+			"sales":   {IDInstance: "3303", APIToken: "sales-token"},
+		}
+	}))
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantPath   string
+	}{
+		{"/api/instances/support/getStateInstance", http.StatusOK, "/waInstance2202/getStateInstance/support-token"},
+		{"/api/instances/sales/getStateInstance", http.StatusOK, "/waInstance3303/getStateInstance/sales-token"},
+		{"/api/getStateInstance", http.StatusOK, "/waInstance1101/getStateInstance/secret"},
+		{"/api/instances/nope/getStateInstance", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+			rec, envelope := callAPI(t, s, http.MethodGet, tt.target, "", nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			mu.Lock()
+			got := append([]string(nil), paths...)
+			mu.Unlock()
+			if tt.wantPath == "" {
+				if len(got) != 0 || envelope.Error.Code != errCodeInstanceNotFound {
+					t.Errorf("unknown instance reached GREEN-API %v, code %s", got, envelope.Error.Code)
+				}
+				return
+			}
+			if len(got) != 1 || got[0] != tt.wantPath {
+				t.Errorf("GREEN-API got %v, want %s", got, tt.wantPath)
+			}
+		})
+	}
+
+	// The instance is named in the request log and on the upstream call,
+	// and its token nowhere.
+	out := logs.String()
+	for _, token := range []string{"support-token", "sales-token", "secret"} {
+		if strings.Contains(out, token) {
+			t.Errorf("the log shows the token %q", token)
+		}
+	}
+	var request, call bool
+	for _, line := range strings.Split(out, "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) != nil || entry["instance"] != "support" {
+			continue
+		}
+		request = request || entry["msg"] == "HTTP Request" && entry["path"] == "/api/instances/support/getStateInstance"
+		call = call || entry["msg"] == "GREEN-API call"
+	}
+	if !request || !call {
+		t.Errorf("instance logged on the request %t, on the call %t:\n%s", request, call, out)
+	}
+	if strings.Contains(out, `"instance":"default"`) {
+		t.Error("the unprefixed route was logged with an instance")
+	}
+}
+
+// TestInstanceRoutesAccessPolicies puts the access policies after
+// InstanceRoutes, as the server does: a prefix naming either the instance
+// path or the route it stands for protects the request.
+func TestInstanceRoutesAccessPolicies(t *testing.T) {
+	instances := GreenAPIInstances{
+		"alerts":  {IDInstance: "2202", APIToken: "alerts-token"},
+		"support": {IDInstance: "3303", APIToken: "support-token"},
+	}
+	ipFilter := func(prefixes ...string) func(http.Handler) http.Handler {
+		policy := &ipFilterPolicy{deny: IPNets{netip.MustParsePrefix("192.0.2.0/24")}, prefixes: prefixes}
+		return func(next http.Handler) http.Handler { return IPFilter(slog.New(slog.DiscardHandler), policy, next) }
+	}
+	basicAuth := func(prefixes, exclude []string) func(http.Handler) http.Handler {
+		policy := &basicAuthPolicy{users: testBasicAuthUsers(t), prefixes: prefixes, exclude: exclude, realm: "test"}
+		return func(next http.Handler) http.Handler { return BasicAuth(policy, next) }
+	}
+	csrf := func(paths ...string) func(http.Handler) http.Handler {
+		policy := newCSRFPolicy(testConfig(t, func(cfg *Config) {
+			cfg.CSRFMode = csrfModeOrigin
+			cfg.CSRFPaths = paths
+			cfg.CSRFExemptPaths = nil
+		}), nil)
+		return func(next http.Handler) http.Handler { return CSRF(policy, next) }
+	}
+	clientCert := func(paths ...string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return ClientCertAuth(newPathMatcher(paths), next) }
+	}
+	tests := []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+		target     string
+		wantStatus int
+	}{
+		{"IP filter on the instance path", ipFilter("/api/instances/alerts/"), "/api/instances/alerts/sendMessage", http.StatusForbidden},
+		{"IP filter on another instance", ipFilter("/api/instances/alerts/"), "/api/instances/support/sendMessage", http.StatusOK},
+		{"IP filter on the route", ipFilter("/api/sendMessage"), "/api/instances/alerts/sendMessage", http.StatusForbidden},
+		{"Basic auth on the instance path", basicAuth([]string{"/api/instances/alerts/"}, nil), "/api/instances/alerts/sendMessage", http.StatusUnauthorized},
+		{"Basic auth on the unprefixed route", basicAuth([]string{"/api/instances/alerts/"}, nil), "/api/sendMessage", http.StatusOK},
+		{"Basic auth exclusion of the route only", basicAuth([]string{"/api/"}, []string{"/api/sendMessage"}), "/api/instances/alerts/sendMessage", http.StatusUnauthorized},
+		{"CSRF on the instance path", csrf("/api/instances/alerts/"), "/api/instances/alerts/sendMessage", http.StatusForbidden},
+		{"client certificate on the instance path", clientCert("/api/instances/alerts/"), "/api/instances/alerts/sendMessage", http.StatusForbidden},
+		{"client certificate on the route", clientCert("=/api/sendMessage"), "/api/instances/alerts/sendMessage", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := InstanceRoutes(instances, tt.middleware(noContent))
+			req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			req.Header.Set("Origin", "https://evil.example.com")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus && !(tt.wantStatus == http.StatusOK && rec.Code == http.StatusNoContent) {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package greenapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a Breaker.
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitHalfOpen
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// ErrCircuitOpen is matched by *CircuitOpenError.
+var ErrCircuitOpen = sentinel("circuit open")
+
+// CircuitOpenError is returned without calling GREEN-API while the breaker
+// for its host and instance is open.
+type CircuitOpenError struct {
+	Host string
+	// RetryAfter is how long until the breaker lets a probe through.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("greenapi: circuit open for %s, retry in %s", e.Host, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Breakers hold one circuit breaker per upstream host and instance, so that
+// an instance GREEN-API keeps failing does not cut the others off. After
+// threshold consecutive failed calls a breaker opens and rejects calls for
+// cooldown, then lets a single probe through: its success closes the
+// breaker again, its failure reopens it. Closed breakers without failures
+// are dropped, so instances that come and go do not pile up.
+type Breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	// Now and OnStateChange may be set before the first call; OnStateChange
+	// is called with the breaker's lock held and must not block.
+	Now           func() time.Time
+	OnStateChange func(host, idInstance string, from, to CircuitState)
+
+	mu       sync.Mutex
+	breakers map[breakerKey]*breaker
+}
+
+type breakerKey struct {
+	host       string
+	idInstance string
+}
+
+type breaker struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	return &Breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		Now:       time.Now,
+		breakers:  make(map[breakerKey]*breaker),
+	}
+}
+
+// allow reports whether a call to host for idInstance may go ahead.
+func (b *Breakers) allow(host, idInstance string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := breakerKey{host, idInstance}
+	br := b.get(key)
+	switch br.state {
+	case CircuitOpen:
+		elapsed := b.Now().Sub(br.openedAt)
+		if elapsed < b.cooldown {
+			return &CircuitOpenError{Host: host, RetryAfter: b.cooldown - elapsed}
+		}
+		b.transition(key, br, CircuitHalfOpen)
+		br.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if br.probing {
+			return &CircuitOpenError{Host: host, RetryAfter: time.Second}
+		}
+		br.probing = true
+	}
+	return nil
+}
+
+// record accounts for the outcome of an allowed call.
+func (b *Breakers) record(host, idInstance string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := breakerKey{host, idInstance}
+	br := b.get(key)
+	br.probing = false
+	if !failed {
+		br.failures = 0
+		if br.state != CircuitClosed {
+			b.transition(key, br, CircuitClosed)
+		}
+		b.prune(key, br)
+		return
+	}
+
+	br.failures++
+	if br.state == CircuitHalfOpen || br.failures >= b.threshold {
+		br.openedAt = b.Now()
+		if br.state != CircuitOpen {
+			b.transition(key, br, CircuitOpen)
+		}
+	}
+}
+
+// release gives up an allowed call without an outcome, letting another
+// probe through if it was one.
+func (b *Breakers) release(host, idInstance string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := breakerKey{host, idInstance}
+	br := b.get(key)
+	br.probing = false
+	b.prune(key, br)
+}
+
+// State returns the current state of the breaker for host and idInstance.
+func (b *Breakers) State(host, idInstance string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if br, ok := b.breakers[breakerKey{host, idInstance}]; ok {
+		return br.state
+	}
+	return CircuitClosed
+}
+
+func (b *Breakers) get(key breakerKey) *breaker {
+	br, ok := b.breakers[key]
+	if !ok {
+		br = &breaker{}
+		b.breakers[key] = br
+	}
+	return br
+}
+
+// prune drops br when it is no different from a new breaker.
+func (b *Breakers) prune(key breakerKey, br *breaker) {
+	if br.state == CircuitClosed && br.failures == 0 && !br.probing {
+		delete(b.breakers, key)
+	}
+}
+
+func (b *Breakers) transition(key breakerKey, br *breaker, to CircuitState) {
+	from := br.state
+	br.state = to
+	if b.OnStateChange != nil {
+		b.OnStateChange(key.host, key.idInstance, from, to)
+	}
+}
+
+// upstreamFailure reports whether err means GREEN-API itself is in trouble,
+// as opposed to a rejected request, a caller that went away or a file that
+// could not be read.
+func upstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	var uploadErr *UploadError
+	return !errors.As(err, &uploadErr)
+}
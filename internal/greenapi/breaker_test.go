@@ -0,0 +1,190 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Now that only moves when told to.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestBreakers(threshold int, cooldown time.Duration) (*Breakers, *fakeClock, *[]string) {
+	clock := &fakeClock{now: time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)}
+	b := NewBreakers(threshold, cooldown)
+	b.Now = clock.Now
+	var transitions []string
+	b.OnStateChange = func(host, idInstance string, from, to CircuitState) {
+		transitions = append(transitions, fmt.Sprintf("%s/%s %s->%s", host, idInstance, from, to))
+	}
+	return b, clock, &transitions
+}
+
+func TestBreakerLifecycle(t *testing.T) {
+	const host, id = "api.example.com", "1101"
+	b, clock, transitions := newTestBreakers(3, 30*time.Second)
+
+	// step is one call: whether it is allowed, and then its outcome.
+	type step struct {
+		advance   time.Duration
+		wantAllow bool
+		failed    bool
+		wantState CircuitState
+	}
+	steps := []step{
+		{0, true, true, CircuitClosed},
+		{0, true, true, CircuitClosed},
+		{0, true, false, CircuitClosed}, // a success resets the count
+		{0, true, true, CircuitClosed},
+		{0, true, true, CircuitClosed},
+		{0, true, true, CircuitOpen}, // third failure in a row
+		{10 * time.Second, false, false, CircuitOpen},
+		{19 * time.Second, false, false, CircuitOpen},
+		{time.Second, true, true, CircuitOpen}, // the probe fails and reopens
+		{29 * time.Second, false, false, CircuitOpen},
+		{time.Second, true, false, CircuitClosed}, // the probe succeeds
+		{0, true, false, CircuitClosed},
+	}
+	for i, s := range steps {
+		clock.advance(s.advance)
+		err := b.allow(host, id)
+		if (err == nil) != s.wantAllow {
+			t.Fatalf("step %d: allow = %v, want allowed %t", i+1, err, s.wantAllow)
+		}
+		if err == nil {
+			b.record(host, id, s.failed)
+		} else {
+			var open *CircuitOpenError
+			if !errors.As(err, &open) || !errors.Is(err, ErrCircuitOpen) || open.Host != host || open.RetryAfter <= 0 {
+				t.Fatalf("step %d: err = %#v", i+1, err)
+			}
+		}
+		if got := b.State(host, id); got != s.wantState {
+			t.Fatalf("step %d: state = %s, want %s", i+1, got, s.wantState)
+		}
+	}
+
+	want := []string{
+		"api.example.com/1101 closed->open",
+		"api.example.com/1101 open->half-open",
+		"api.example.com/1101 half-open->open",
+		"api.example.com/1101 open->half-open",
+		"api.example.com/1101 half-open->closed",
+	}
+	if fmt.Sprint(*transitions) != fmt.Sprint(want) {
+		t.Errorf("transitions = %v, want %v", *transitions, want)
+	}
+	if len(b.breakers) != 0 {
+		t.Errorf("%d closed breakers kept", len(b.breakers))
+	}
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	b, clock, _ := newTestBreakers(1, 30*time.Second)
+	b.allow("h", "1")
+	b.record("h", "1", true)
+	clock.advance(12 * time.Second)
+
+	var open *CircuitOpenError
+	if err := b.allow("h", "1"); !errors.As(err, &open) || open.RetryAfter != 18*time.Second {
+		t.Errorf("allow = %v, want RetryAfter 18s", err)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b, clock, _ := newTestBreakers(1, time.Second)
+	b.allow("h", "1")
+	b.record("h", "1", true)
+	clock.advance(time.Second)
+
+	if err := b.allow("h", "1"); err != nil {
+		t.Fatalf("the probe was refused: %v", err)
+	}
+	if err := b.allow("h", "1"); err == nil {
+		t.Fatal("a second call got through while the probe runs")
+	}
+	// A probe given up without an outcome lets another one through.
+	b.release("h", "1")
+	if err := b.allow("h", "1"); err != nil {
+		t.Errorf("after release the next probe was refused: %v", err)
+	}
+}
+
+func TestBreakersAreKeyed(t *testing.T) {
+	b, _, _ := newTestBreakers(1, time.Minute)
+	b.allow("api.example.com", "1101")
+	b.record("api.example.com", "1101", true)
+
+	tests := []struct {
+		host, id  string
+		wantAllow bool
+	}{
+		{"api.example.com", "1101", false},
+		{"media.example.com", "1101", true},
+		{"api.example.com", "2202", true},
+	}
+	for _, tt := range tests {
+		if err := b.allow(tt.host, tt.id); (err == nil) != tt.wantAllow {
+			t.Errorf("allow(%s, %s) = %v, want allowed %t", tt.host, tt.id, err, tt.wantAllow)
+		}
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"5xx", &Error{StatusCode: http.StatusBadGateway}, true},
+		{"4xx", &Error{StatusCode: http.StatusBadRequest}, false},
+		{"429", &Error{StatusCode: http.StatusTooManyRequests}, false},
+		{"network", errors.New("connection refused"), true},
+		{"upload read", &UploadError{Err: errors.New("disk")}, false},
+	}
+	for _, tt := range tests {
+		if got := upstreamFailure(tt.err); got != tt.want {
+			t.Errorf("%s: upstreamFailure = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientBreakerSkipsUpstream(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	b, _, _ := newTestBreakers(2, time.Minute)
+	c.WithBreakers(b)
+
+	for range 2 {
+		if _, err := c.GetSettings(context.Background()); !errors.Is(err, ErrUpstream) {
+			t.Fatalf("err = %v, want ErrUpstream", err)
+		}
+	}
+	if _, err := c.GetSettings(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream got %d calls, want 2", calls.Load())
+	}
+
+	// A canceled call neither counts as a failure nor keeps a probe slot.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c2 := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {}).WithBreakers(b)
+	c2.GetSettings(ctx)
+	if st := b.State(c2.endpoints.Host("getSettings"), "1101"); st != CircuitClosed {
+		t.Errorf("a canceled call left the breaker %s", st)
+	}
+}
@@ -0,0 +1,112 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// phoneNumber matches phone numbers and the chat IDs built from them, such
+// as 79001234567@c.us; all but the last two digits are masked in logs.
+var phoneNumber = regexp.MustCompile(`\+?\d{9,20}`)
+
+// webhookToken matches the webhookUrlToken field of setSettings and
+// getSettings bodies.
+var webhookToken = regexp.MustCompile(`("webhookUrlToken"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// logCall writes one entry per HTTP request sent to GREEN-API: at warn level
+// when it failed without an answer or with 5xx, at info otherwise. At debug
+// level the bodies are added, redacted and cut to the client's body limit;
+// reqBody is nil for streamed uploads.
+func (c *Client) logCall(ctx context.Context, method string, attempt int, start time.Time, status int, conn connInfo, err error, reqBody, respBody []byte) {
+	if c.logger == nil {
+		return
+	}
+
+	level := slog.LevelInfo
+	var apiErr *Error
+	if err != nil && !errors.As(err, &apiErr) || status >= http.StatusInternalServerError {
+		level = slog.LevelWarn
+	}
+	if !c.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("api_method", method),
+		slog.String("host", c.endpoints.Host(method)),
+		slog.Int("attempt", attempt),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if status != 0 {
+		attrs = append(attrs, slog.Int("upstream_status", status))
+	}
+	if conn.got {
+		attrs = append(attrs, slog.Bool("conn_reused", conn.reused))
+		if conn.reused {
+			attrs = append(attrs, slog.Duration("conn_idle", conn.idle))
+		}
+	}
+	if err != nil && apiErr == nil {
+		attrs = append(attrs, slog.String("error", c.redact(err.Error())))
+	}
+	if c.logger.Enabled(ctx, slog.LevelDebug) {
+		if reqBody != nil {
+			attrs = append(attrs, slog.String("request_body", c.logBody(reqBody)))
+		}
+		if respBody != nil {
+			attrs = append(attrs, slog.String("response_body", c.logBody(respBody)))
+		}
+	}
+	c.logger.LogAttrs(ctx, level, "GREEN-API call", attrs...)
+}
+
+// logBody redacts body and cuts it to the body limit, cutting after
+// redacting so a token is never left half-masked.
+func (c *Client) logBody(body []byte) string {
+	s := c.redact(string(body))
+	if c.logBodyBytes <= 0 || len(s) <= c.logBodyBytes {
+		return s
+	}
+	cut := s[:c.logBodyBytes]
+	for !utf8.ValidString(cut) {
+		cut = cut[:len(cut)-1]
+	}
+	return cut + "...(" + strconv.Itoa(len(s)) + " bytes)"
+}
+
+// redact masks the tokens and phone numbers in s.
+func (c *Client) redact(s string) string {
+	if c.apiToken != "" {
+		s = strings.ReplaceAll(s, c.apiToken, redacted)
+	}
+	s = webhookToken.ReplaceAllString(s, `$1"`+redacted+`"`)
+	return phoneNumber.ReplaceAllStringFunc(s, func(number string) string {
+		return strings.Repeat("*", len(number)-2) + number[len(number)-2:]
+	})
+}
+
+// connInfo is what httptrace tells about the connection a request went
+// out on, to show in the log whether connections are reused.
+type connInfo struct {
+	got    bool
+	reused bool
+	idle   time.Duration
+}
+
+func (c *connInfo) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.got = true
+			c.reused = info.Reused
+			c.idle = info.IdleTime
+		},
+	}
+}
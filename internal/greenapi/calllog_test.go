@@ -0,0 +1,125 @@
+package greenapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientLogBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		body  string
+		want  string
+	}{
+		{"chat ID", 0, `{"chatId":"79001234567@c.us"}`, `{"chatId":"*********67@c.us"}`},
+		{"phone with plus", 0, `call +79001234567`, `call **********67`},
+		{"short numbers kept", 0, `{"idMessage":"12345678","delay":1000}`, `{"idMessage":"12345678","delay":1000}`},
+		{"token", 0, `path /sendMessage/` + testToken, `path /sendMessage/[REDACTED]`},
+		{"webhook token", 0, `{"webhookUrlToken":"hook \"secret\"","x":1}`, `{"webhookUrlToken":"[REDACTED]","x":1}`},
+		{"truncated", 10, `{"message":"hello world"}`, `{"message"...(25 bytes)`},
+		{"truncated after redaction", 25, testToken + strings.Repeat("a", 30), `[REDACTED]aaaaaaaaaaaaaaa...(40 bytes)`},
+		{"cut on a rune boundary", 5, `"привет"`, `"пр...(14 bytes)`},
+		{"within the limit", 100, `{"ok":true}`, `{"ok":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(Endpoints{API: DefaultBaseURL}, "1101", testToken, nil).WithLogger(slog.Default(), tt.limit)
+			if got := c.logBody([]byte(tt.body)); got != tt.want {
+				t.Errorf("logBody = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// loggedCalls decodes the JSON log lines in buf.
+func loggedCalls(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestClientLogCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		level      slog.Level
+		status     int
+		wantLevel  string
+		wantBodies bool
+	}{
+		{"success at debug", slog.LevelDebug, http.StatusOK, "INFO", true},
+		{"success at info", slog.LevelInfo, http.StatusOK, "INFO", false},
+		{"client error", slog.LevelInfo, http.StatusBadRequest, "INFO", false},
+		{"server error", slog.LevelInfo, http.StatusBadGateway, "WARN", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: tt.level}))
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, `{"idMessage":"BAE5F4886AD6","chatId":"79001234567@c.us"}`)
+			}).WithLogger(logger, 1024)
+			c.SendMessage(context.Background(), SendMessageRequest{ChatID: "79001234567@c.us", Message: "hi"})
+
+			entries := loggedCalls(t, &buf)
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries:\n%s", len(entries), buf.String())
+			}
+			e := entries[0]
+			if e["msg"] != "GREEN-API call" || e["level"] != tt.wantLevel || e["api_method"] != "sendMessage" ||
+				e["attempt"] != float64(1) || e["upstream_status"] != float64(tt.status) || e["host"] != c.endpoints.Host("sendMessage") {
+				t.Errorf("entry = %v", e)
+			}
+			if d, ok := e["duration"].(float64); !ok || d <= 0 {
+				t.Errorf("duration = %v", e["duration"])
+			}
+			_, hasReq := e["request_body"]
+			_, hasResp := e["response_body"]
+			if hasReq != tt.wantBodies || hasResp != tt.wantBodies {
+				t.Errorf("bodies logged = %t, %t; want %t", hasReq, hasResp, tt.wantBodies)
+			}
+			if tt.wantBodies && e["request_body"] != `{"chatId":"*********67@c.us","message":"hi"}` {
+				t.Errorf("request_body = %v", e["request_body"])
+			}
+			if out := buf.String(); strings.Contains(out, testToken) || strings.Contains(out, "79001234567") {
+				t.Errorf("the token or a phone number was logged:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestClientLogCallNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	var buf bytes.Buffer
+	c := NewClient(Endpoints{API: srv.URL}, "1101", testToken, nil).
+		WithLogger(slog.New(slog.NewJSONHandler(&buf, nil)), 0)
+	c.GetSettings(context.Background())
+
+	entries := loggedCalls(t, &buf)
+	if len(entries) != 1 || entries[0]["level"] != "WARN" || entries[0]["error"] == nil || entries[0]["upstream_status"] != nil {
+		t.Errorf("entries = %v", entries)
+	}
+	if strings.Contains(buf.String(), testToken) {
+		t.Errorf("the token was logged:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,587 @@
+// Package greenapi is a small typed client for the GREEN-API WhatsApp
+// gateway. The instance token is only ever placed into the request path and
+// never appears in errors returned by the client.
+package greenapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the public GREEN-API endpoint.
+const DefaultBaseURL = "https://api.green-api.com"
+
+// DefaultMediaURL is the public GREEN-API endpoint for file uploads.
+const DefaultMediaURL = "https://media.green-api.com"
+
+// maxResponseSize bounds how much of a response body is read.
+const maxResponseSize = 1 << 20
+
+// Client calls GREEN-API methods for a single instance.
+type Client struct {
+	endpoints  Endpoints
+	idInstance string
+	apiToken   string
+	http       *http.Client
+	retry      RetryPolicy
+	breakers   *Breakers
+	limiter    *Limiter
+	recorder   Recorder
+
+	logger       *slog.Logger
+	logBodyBytes int
+}
+
+// NewClient returns a client for the instance. A nil httpClient means
+// http.DefaultClient; timeouts are expected to be set on it or on the
+// contexts passed to the methods.
+func NewClient(endpoints Endpoints, idInstance, apiToken string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		endpoints:  endpoints,
+		idInstance: idInstance,
+		apiToken:   apiToken,
+		http:       httpClient,
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, for calls that need a different
+// timeout.
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	c.http = httpClient
+	return c
+}
+
+// WithRetry sets how failed calls are retried; the zero policy, used by
+// default, makes a single attempt.
+func (c *Client) WithRetry(policy RetryPolicy) *Client {
+	c.retry = policy
+	return c
+}
+
+// WithBreakers makes calls go through the circuit breaker of the host
+// serving each method.
+func (c *Client) WithBreakers(breakers *Breakers) *Client {
+	c.breakers = breakers
+	return c
+}
+
+// WithLimiter makes calls wait for their turn in the outbound budget of
+// their method, or fail with *ThrottledError when it is too far off.
+func (c *Client) WithLimiter(limiter *Limiter) *Client {
+	c.limiter = limiter
+	return c
+}
+
+// WithLogger logs every request sent to GREEN-API through logger. At debug
+// level the request and response bodies are included, cut to maxBodyBytes
+// (0 means whole) with the token and phone numbers masked.
+func (c *Client) WithLogger(logger *slog.Logger, maxBodyBytes int) *Client {
+	c.logger = logger
+	c.logBodyBytes = maxBodyBytes
+	return c
+}
+
+// IDInstance returns the instance the client calls.
+func (c *Client) IDInstance() string {
+	return c.idInstance
+}
+
+// Settings is the result of getSettings. Yes/no flags are kept as GREEN-API
+// sends them.
+type Settings struct {
+	WID                               string `json:"wid"`
+	CountryInstance                   string `json:"countryInstance,omitempty"`
+	TypeAccount                       string `json:"typeAccount,omitempty"`
+	WebhookURL                        string `json:"webhookUrl"`
+	DelaySendMessagesMilliseconds     int    `json:"delaySendMessagesMilliseconds"`
+	MarkIncomingMessagesReaded        string `json:"markIncomingMessagesReaded"`
+	MarkIncomingMessagesReadedOnReply string `json:"markIncomingMessagesReadedOnReply"`
+	OutgoingWebhook                   string `json:"outgoingWebhook"`
+	OutgoingMessageWebhook            string `json:"outgoingMessageWebhook"`
+	OutgoingAPIMessageWebhook         string `json:"outgoingAPIMessageWebhook"`
+	IncomingWebhook                   string `json:"incomingWebhook"`
+	DeviceWebhook                     string `json:"deviceWebhook,omitempty"`
+	StateWebhook                      string `json:"stateWebhook"`
+	KeepOnlineStatus                  string `json:"keepOnlineStatus"`
+	PollMessageWebhook                string `json:"pollMessageWebhook,omitempty"`
+	IncomingBlockWebhook              string `json:"incomingBlockWebhook,omitempty"`
+	IncomingCallWebhook               string `json:"incomingCallWebhook,omitempty"`
+}
+
+// Instance states reported by getStateInstance.
+const (
+	StateAuthorized    = "authorized"
+	StateNotAuthorized = "notAuthorized"
+	StateBlocked       = "blocked"
+	StateSleepMode     = "sleepMode"
+	StateStarting      = "starting"
+	StateYellowCard    = "yellowCard"
+)
+
+// StateInstance is the result of getStateInstance.
+type StateInstance struct {
+	StateInstance string `json:"stateInstance"`
+}
+
+// SendMessageRequest is the body of sendMessage.
+type SendMessageRequest struct {
+	ChatID          string `json:"chatId"`
+	Message         string `json:"message"`
+	QuotedMessageID string `json:"quotedMessageId,omitempty"`
+}
+
+// SendFileByURLRequest is the body of sendFileByUrl.
+type SendFileByURLRequest struct {
+	ChatID   string `json:"chatId"`
+	URLFile  string `json:"urlFile"`
+	FileName string `json:"fileName"`
+	Caption  string `json:"caption,omitempty"`
+}
+
+// SendFileByUploadRequest is the form of sendFileByUpload. File is streamed
+// to GREEN-API as it is read and is not closed.
+type SendFileByUploadRequest struct {
+	ChatID   string
+	FileName string
+	// ContentType of the file; application/octet-stream when empty.
+	ContentType string
+	Caption     string
+	File        io.Reader
+}
+
+// SendResult is returned by the sending methods.
+type SendResult struct {
+	IDMessage string `json:"idMessage"`
+}
+
+func (c *Client) GetSettings(ctx context.Context) (*Settings, error) {
+	var settings Settings
+	if err := c.do(ctx, http.MethodGet, "getSettings", "", nil, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetSettingsRequest is the body of setSettings. Fields left nil or empty
+// keep their current value; WebhookURL set to "" turns webhooks off.
+type SetSettingsRequest struct {
+	WebhookURL                    *string `json:"webhookUrl,omitempty"`
+	WebhookURLToken               *string `json:"webhookUrlToken,omitempty"`
+	IncomingWebhook               string  `json:"incomingWebhook,omitempty"`
+	OutgoingWebhook               string  `json:"outgoingWebhook,omitempty"`
+	DelaySendMessagesMilliseconds int     `json:"delaySendMessagesMilliseconds,omitempty"`
+}
+
+// SetSettingsResult is the result of setSettings.
+type SetSettingsResult struct {
+	SaveSettings bool `json:"saveSettings"`
+}
+
+// SetSettings changes the settings of the instance. GREEN-API may take a
+// few minutes to apply them.
+func (c *Client) SetSettings(ctx context.Context, req SetSettingsRequest) (*SetSettingsResult, error) {
+	var result SetSettingsResult
+	if err := c.do(ctx, http.MethodPost, "setSettings", "", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) GetStateInstance(ctx context.Context) (*StateInstance, error) {
+	var state StateInstance
+	if err := c.do(ctx, http.MethodGet, "getStateInstance", "", nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Types of a QR result.
+const (
+	QRTypeCode          = "qrCode"
+	QRTypeAlreadyLogged = "alreadyLogged"
+	QRTypeError         = "error"
+)
+
+// QR is the result of qr. For QRTypeCode Message is the QR code as a
+// base64-encoded PNG; for the other types it explains why there is none.
+type QR struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// QR returns the QR code to scan to authorize the instance. The code
+// changes every few seconds.
+func (c *Client) QR(ctx context.Context) (*QR, error) {
+	var qr QR
+	if err := c.do(ctx, http.MethodGet, "qr", "", nil, &qr); err != nil {
+		return nil, err
+	}
+	return &qr, nil
+}
+
+func (c *Client) SendMessage(ctx context.Context, req SendMessageRequest) (*SendResult, error) {
+	var result SendResult
+	if err := c.do(ctx, http.MethodPost, "sendMessage", "", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) SendFileByURL(ctx context.Context, req SendFileByURLRequest) (*SendResult, error) {
+	var result SendResult
+	if err := c.do(ctx, http.MethodPost, "sendFileByUrl", "", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SendFileByUpload uploads a file as multipart/form-data without buffering
+// it. The call is not retried since the file cannot be read twice. If reading
+// File fails, the error is an *UploadError.
+func (c *Client) SendFileByUpload(ctx context.Context, req SendFileByUploadRequest) (*SendResult, error) {
+	var result SendResult
+	err := c.guard(ctx, "sendFileByUpload", func() error {
+		return c.upload(ctx, req, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CheckWhatsappResult is returned by checkWhatsapp.
+type CheckWhatsappResult struct {
+	ExistsWhatsapp bool `json:"existsWhatsapp"`
+}
+
+// CheckWhatsapp reports whether phoneNumber, digits only with the country
+// code, has a WhatsApp account.
+func (c *Client) CheckWhatsapp(ctx context.Context, phoneNumber int64) (*CheckWhatsappResult, error) {
+	var result CheckWhatsappResult
+	body := struct {
+		PhoneNumber int64 `json:"phoneNumber"`
+	}{phoneNumber}
+	if err := c.do(ctx, http.MethodPost, "checkWhatsapp", "", body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DownloadFileRequest is the body of downloadFile.
+type DownloadFileRequest struct {
+	ChatID    string `json:"chatId"`
+	IDMessage string `json:"idMessage"`
+}
+
+// DownloadFileResult is returned by downloadFile.
+type DownloadFileResult struct {
+	DownloadURL string `json:"downloadUrl"`
+}
+
+// DownloadFile returns a link to the file of an incoming or outgoing
+// message.
+func (c *Client) DownloadFile(ctx context.Context, req DownloadFileRequest) (*DownloadFileResult, error) {
+	var result DownloadFileResult
+	if err := c.do(ctx, http.MethodPost, "downloadFile", "", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetChatHistoryRequest is the body of getChatHistory. Count is how many of
+// the latest messages to return; GREEN-API returns 100 when it is 0.
+type GetChatHistoryRequest struct {
+	ChatID string `json:"chatId"`
+	Count  int    `json:"count,omitempty"`
+}
+
+// HistoryMessage is one message returned by getChatHistory, newest first.
+// Fields that only some message types carry are left empty for the others;
+// Raw holds the whole message.
+type HistoryMessage struct {
+	// Type is incoming or outgoing.
+	Type        string `json:"type"`
+	IDMessage   string `json:"idMessage"`
+	Timestamp   int64  `json:"timestamp"`
+	TypeMessage string `json:"typeMessage"`
+	ChatID      string `json:"chatId"`
+
+	TextMessage         string               `json:"textMessage,omitempty"`
+	ExtendedTextMessage *ExtendedTextMessage `json:"extendedTextMessage,omitempty"`
+
+	// Set for media messages.
+	DownloadURL string `json:"downloadUrl,omitempty"`
+	Caption     string `json:"caption,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+type ExtendedTextMessage struct {
+	Text string `json:"text"`
+}
+
+func (m *HistoryMessage) UnmarshalJSON(data []byte) error {
+	type plain HistoryMessage
+	if err := json.Unmarshal(data, (*plain)(m)); err != nil {
+		return err
+	}
+	m.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// GetChatHistory returns the latest messages of a chat.
+func (c *Client) GetChatHistory(ctx context.Context, req GetChatHistoryRequest) ([]HistoryMessage, error) {
+	var messages []HistoryMessage
+	if err := c.do(ctx, http.MethodPost, "getChatHistory", "", req, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ReceivedNotification is a notification taken from the instance queue by
+// ReceiveNotification; it stays queued until deleted by its ReceiptID.
+type ReceivedNotification struct {
+	ReceiptID int64           `json:"receiptId"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// ReceiveNotification waits up to timeout (5 to 60 seconds, rounded down to
+// whole seconds) for the next queued notification. It returns nil when the
+// queue stayed empty. The HTTP client timeout must be longer than timeout.
+func (c *Client) ReceiveNotification(ctx context.Context, timeout time.Duration) (*ReceivedNotification, error) {
+	var received *ReceivedNotification
+	query := "?receiveTimeout=" + strconv.Itoa(int(timeout/time.Second))
+	if err := c.do(ctx, http.MethodGet, "receiveNotification", query, nil, &received); err != nil {
+		return nil, err
+	}
+	return received, nil
+}
+
+// DeleteNotification removes a received notification from the queue.
+func (c *Client) DeleteNotification(ctx context.Context, receiptID int64) error {
+	var result struct {
+		Result bool `json:"result"`
+	}
+	suffix := "/" + strconv.FormatInt(receiptID, 10)
+	if err := c.do(ctx, http.MethodDelete, "deleteNotification", suffix, nil, &result); err != nil {
+		return err
+	}
+	if !result.Result {
+		return fmt.Errorf("greenapi: deleteNotification: receipt %d was not deleted", receiptID)
+	}
+	return nil
+}
+
+// do calls method with body encoded as JSON and decodes a successful
+// response into out. suffix is appended to the URL after the token, for
+// methods taking a path parameter or query.
+func (c *Client) do(ctx context.Context, httpMethod, method, suffix string, body, out any) error {
+	return c.guard(ctx, method, func() error {
+		return c.roundTrip(ctx, httpMethod, method, suffix, body, out)
+	})
+}
+
+// guard runs a call of method through the circuit breaker of its host and
+// instance and then the outbound limiter, and reports it to the recorder.
+// Whatever fails, the token is scrubbed from the error.
+func (c *Client) guard(ctx context.Context, method string, call func() error) (err error) {
+	if c.recorder != nil {
+		start := time.Now()
+		defer func() {
+			c.recorder.Call(method, c.idInstance, callOutcome(ctx, err), time.Since(start))
+		}()
+	}
+
+	host := c.endpoints.Host(method)
+	if c.breakers != nil {
+		if err := c.breakers.allow(host, c.idInstance); err != nil {
+			return err
+		}
+	}
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx, c.idInstance, method); err != nil {
+			if c.breakers != nil {
+				c.breakers.release(host, c.idInstance)
+			}
+			return err
+		}
+	}
+	err = call()
+	if c.breakers != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// A caller that gave up says nothing about the upstream; one
+			// whose deadline passed waited on a slow upstream.
+			c.breakers.release(host, c.idInstance)
+		} else {
+			c.breakers.record(host, c.idInstance, upstreamFailure(err))
+		}
+	}
+	if err == nil || c.apiToken == "" {
+		return err
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		apiErr.Message = strings.ReplaceAll(apiErr.Message, c.apiToken, redacted)
+		return err
+	}
+	return &redactedError{err: err, secret: c.apiToken}
+}
+
+func (c *Client) roundTrip(ctx context.Context, httpMethod, method, suffix string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("greenapi: %s: encode request: %w", method, err)
+		}
+	}
+
+	stats, _ := ctx.Value(callStatsKey{}).(*CallStats)
+	start := time.Now()
+	if stats != nil {
+		defer func() { stats.Latency += time.Since(start) }()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if stats != nil {
+			stats.Attempts++
+		}
+		data, err := c.attempt(ctx, httpMethod, method, suffix, payload, attempt)
+		if err == nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return fmt.Errorf("greenapi: %s: decode response: %w", method, err)
+			}
+			return nil
+		}
+
+		// A canceled or expired call context stops retrying at once; a
+		// per-attempt timeout of the HTTP client does not.
+		if ctx.Err() != nil {
+			return err
+		}
+		delay, ok := c.retry.next(attempt, httpMethod, err)
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("greenapi: %s: %w", method, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt performs the n-th request of a call and returns the body of a
+// successful response.
+func (c *Client) attempt(ctx context.Context, httpMethod, method, suffix string, payload []byte, n int) ([]byte, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, httpMethod, c.methodURL(method)+suffix, reader)
+	if err != nil {
+		return nil, fmt.Errorf("greenapi: %s: %w", method, scrubURLError(err))
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, method, n, payload)
+}
+
+func (c *Client) methodURL(method string) string {
+	return c.endpoints.MethodURL(method, c.idInstance, c.apiToken)
+}
+
+// send performs req as the given attempt of a call and returns the body of
+// a successful response. payload is the request body for the log, nil when
+// it is streamed.
+func (c *Client) send(req *http.Request, method string, attempt int, payload []byte) ([]byte, error) {
+	req.Header.Set("Accept", "application/json")
+	var conn connInfo
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), conn.trace()))
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if c.recorder != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		defer func() { c.recorder.Attempt(method, c.idInstance, attempt, status, time.Since(start)) }()
+	}
+	if err != nil {
+		err = fmt.Errorf("greenapi: %s: %w", method, scrubURLError(err))
+		c.logCall(req.Context(), method, attempt, start, 0, conn, err, payload, nil)
+		countFailure(req.Context())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		err = fmt.Errorf("greenapi: %s: read response: %w", method, err)
+		c.logCall(req.Context(), method, attempt, start, resp.StatusCode, conn, err, payload, nil)
+		countFailure(req.Context())
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = newError(method, resp, data)
+	}
+	c.logCall(req.Context(), method, attempt, start, resp.StatusCode, conn, err, payload, data)
+	if err != nil {
+		countFailure(req.Context())
+		return nil, err
+	}
+	return data, nil
+}
+
+func countFailure(ctx context.Context) {
+	if stats, ok := ctx.Value(callStatsKey{}).(*CallStats); ok {
+		stats.Failures++
+	}
+}
+
+// scrubURLError drops the request URL, which carries the token, from errors
+// returned by net/http.
+func scrubURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+const redacted = "[REDACTED]"
+
+// redactedError hides secret in the message of err while keeping it
+// available to errors.Is and errors.As.
+type redactedError struct {
+	err    error
+	secret string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.secret, redacted)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
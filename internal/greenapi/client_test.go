@@ -0,0 +1,229 @@
+package greenapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testToken = "s3cr3t-token"
+
+// newTestClient returns a client for instance 1101 calling the server
+// handler runs on.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewClient(Endpoints{API: srv.URL}, "1101", testToken, srv.Client())
+}
+
+func TestClientRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		call       func(context.Context, *Client) (any, error)
+		response   string
+		wantMethod string
+		wantPath   string
+		wantBody   string
+		want       any
+	}{
+		{
+			name:       "GetSettings",
+			call:       func(ctx context.Context, c *Client) (any, error) { return c.GetSettings(ctx) },
+			response:   `{"wid":"79001234567@c.us","webhookUrl":"https://example.com/hook","delaySendMessagesMilliseconds":500}`,
+			wantMethod: http.MethodGet,
+			wantPath:   "/waInstance1101/getSettings/" + testToken,
+			want:       &Settings{WID: "79001234567@c.us", WebhookURL: "https://example.com/hook", DelaySendMessagesMilliseconds: 500},
+		},
+		{
+			name:       "GetStateInstance",
+			call:       func(ctx context.Context, c *Client) (any, error) { return c.GetStateInstance(ctx) },
+			response:   `{"stateInstance":"authorized"}`,
+			wantMethod: http.MethodGet,
+			wantPath:   "/waInstance1101/getStateInstance/" + testToken,
+			want:       &StateInstance{StateInstance: StateAuthorized},
+		},
+		{
+			name: "SendMessage",
+			call: func(ctx context.Context, c *Client) (any, error) {
+				return c.SendMessage(ctx, SendMessageRequest{ChatID: "79001234567@c.us", Message: "hi"})
+			},
+			response:   `{"idMessage":"BAE5F4886AD6"}`,
+			wantMethod: http.MethodPost,
+			wantPath:   "/waInstance1101/sendMessage/" + testToken,
+			wantBody:   `{"chatId":"79001234567@c.us","message":"hi"}`,
+			want:       &SendResult{IDMessage: "BAE5F4886AD6"},
+		},
+		{
+			name: "SendFileByURL",
+			call: func(ctx context.Context, c *Client) (any, error) {
+				return c.SendFileByURL(ctx, SendFileByURLRequest{ChatID: "79001234567@c.us", URLFile: "https://example.com/a.png", FileName: "a.png"})
+			},
+			response:   `{"idMessage":"BAE6"}`,
+			wantMethod: http.MethodPost,
+			wantPath:   "/waInstance1101/sendFileByUrl/" + testToken,
+			wantBody:   `{"chatId":"79001234567@c.us","urlFile":"https://example.com/a.png","fileName":"a.png"}`,
+			want:       &SendResult{IDMessage: "BAE6"},
+		},
+		{
+			name: "SetSettings",
+			call: func(ctx context.Context, c *Client) (any, error) {
+				off := ""
+				return c.SetSettings(ctx, SetSettingsRequest{WebhookURL: &off, IncomingWebhook: "no", DelaySendMessagesMilliseconds: 1000})
+			},
+			response:   `{"saveSettings":true}`,
+			wantMethod: http.MethodPost,
+			wantPath:   "/waInstance1101/setSettings/" + testToken,
+			wantBody:   `{"webhookUrl":"","incomingWebhook":"no","delaySendMessagesMilliseconds":1000}`,
+			want:       &SetSettingsResult{SaveSettings: true},
+		},
+		{
+			name:       "DeleteNotification",
+			call:       func(ctx context.Context, c *Client) (any, error) { return nil, c.DeleteNotification(ctx, 42) },
+			response:   `{"result":true}`,
+			wantMethod: http.MethodDelete,
+			wantPath:   "/waInstance1101/deleteNotification/" + testToken + "/42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != tt.wantMethod || r.URL.Path != tt.wantPath {
+					t.Errorf("got %s %s, want %s %s", r.Method, r.URL.Path, tt.wantMethod, tt.wantPath)
+				}
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != tt.wantBody {
+					t.Errorf("body = %s, want %s", body, tt.wantBody)
+				}
+				if tt.wantBody != "" && r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+				}
+				io.WriteString(w, tt.response)
+			})
+			got, err := tt.call(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("result = %s, want %s", gotJSON, wantJSON)
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		retryAfter  string
+		wantIs      error
+		wantMessage string
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", "", ErrUnauthorized, ""},
+		{"forbidden", http.StatusForbidden, "", "", ErrUnauthorized, ""},
+		{"rate limited", http.StatusTooManyRequests, "", "7", ErrRateLimited, ""},
+		{"bad request", http.StatusBadRequest, `{"message":"chatId is invalid"}`, "", ErrBadRequest, "chatId is invalid"},
+		{"plain text", http.StatusBadRequest, "bad chat\n", "", ErrBadRequest, "bad chat"},
+		{"server error", http.StatusBadGateway, "", "", ErrUpstream, ""},
+		{"not found", http.StatusNotFound, "", "", ErrUpstream, ""},
+		{"token in the message", http.StatusBadRequest, `{"message":"token ` + testToken + ` is wrong"}`, "", ErrBadRequest, "token [REDACTED] is wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			_, err := c.GetSettings(context.Background())
+			if !errors.Is(err, tt.wantIs) {
+				t.Fatalf("err = %v, want %v", err, tt.wantIs)
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %T, want *Error", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Method != "getSettings" || apiErr.Message != tt.wantMessage {
+				t.Errorf("got %+v", apiErr)
+			}
+			if tt.retryAfter != "" && apiErr.RetryAfter.String() != tt.retryAfter+"s" {
+				t.Errorf("RetryAfter = %s", apiErr.RetryAfter)
+			}
+			if strings.Contains(err.Error(), testToken) {
+				t.Errorf("the token appears in %q", err)
+			}
+		})
+	}
+}
+
+func TestClientNeverLeaksToken(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	tests := []struct {
+		name string
+		call func(*Client) error
+	}{
+		{"connection refused", func(c *Client) error {
+			_, err := c.GetSettings(context.Background())
+			return err
+		}},
+		{"canceled", func(c *Client) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.SendMessage(ctx, SendMessageRequest{ChatID: "1@c.us", Message: "x"})
+			return err
+		}},
+		{"bad base URL", func(c *Client) error {
+			c.endpoints.API = "http://[::1"
+			_, err := c.GetStateInstance(context.Background())
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(Endpoints{API: srv.URL}, "1101", testToken, nil)
+			err := tt.call(c)
+			if err == nil {
+				t.Fatal("the call succeeded")
+			}
+			if strings.Contains(err.Error(), testToken) {
+				t.Errorf("the token appears in %q", err)
+			}
+		})
+	}
+}
+
+func TestClientContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	})
+	_, err := c.GetSettings(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestClientDecodeError(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>")
+	})
+	_, err := c.GetSettings(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "decode response") {
+		t.Errorf("err = %v, want a decode error", err)
+	}
+}
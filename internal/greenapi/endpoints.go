@@ -0,0 +1,47 @@
+package greenapi
+
+import (
+	"net/url"
+	"strings"
+)
+
+// mediaMethods are served by the media host instead of the API host.
+var mediaMethods = map[string]bool{
+	"sendFileByUpload": true,
+	"uploadFile":       true,
+	"downloadFile":     true,
+}
+
+// Endpoints are the GREEN-API base URLs. Everything that builds a method URL
+// goes through BaseURL, so callers never pick the host themselves.
+type Endpoints struct {
+	// API serves the regular methods, DefaultBaseURL in production.
+	API string
+	// Media serves file uploads and downloads, DefaultMediaURL in
+	// production. Empty means API.
+	Media string
+}
+
+// BaseURL returns the base URL serving method, without a trailing slash.
+func (e Endpoints) BaseURL(method string) string {
+	base := e.API
+	if mediaMethods[method] && e.Media != "" {
+		base = e.Media
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+// Host returns the host serving method, which circuit breakers are kept per.
+func (e Endpoints) Host(method string) string {
+	u, err := url.Parse(e.BaseURL(method))
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// MethodURL returns the URL of method for the instance. The token is part
+// of the path, so the result must never be logged.
+func (e Endpoints) MethodURL(method, idInstance, apiToken string) string {
+	return e.BaseURL(method) + "/waInstance" + url.PathEscape(idInstance) + "/" + method + "/" + url.PathEscape(apiToken)
+}
@@ -0,0 +1,90 @@
+package greenapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEndpoints(t *testing.T) {
+	both := Endpoints{API: "https://api.example.com/", Media: "https://media.example.com"}
+	apiOnly := Endpoints{API: "https://api.example.com"}
+	mediaOverridden := Endpoints{API: DefaultBaseURL, Media: "http://127.0.0.1:9000"}
+
+	tests := []struct {
+		endpoints Endpoints
+		method    string
+		wantURL   string
+		wantHost  string
+	}{
+		{both, "sendMessage", "https://api.example.com/waInstance1101/sendMessage/a%2Fb", "api.example.com"},
+		{both, "getSettings", "https://api.example.com/waInstance1101/getSettings/a%2Fb", "api.example.com"},
+		{both, "sendFileByUrl", "https://api.example.com/waInstance1101/sendFileByUrl/a%2Fb", "api.example.com"},
+		{both, "sendFileByUpload", "https://media.example.com/waInstance1101/sendFileByUpload/a%2Fb", "media.example.com"},
+		{both, "uploadFile", "https://media.example.com/waInstance1101/uploadFile/a%2Fb", "media.example.com"},
+		{both, "downloadFile", "https://media.example.com/waInstance1101/downloadFile/a%2Fb", "media.example.com"},
+		{apiOnly, "sendFileByUpload", "https://api.example.com/waInstance1101/sendFileByUpload/a%2Fb", "api.example.com"},
+		{mediaOverridden, "sendMessage", DefaultBaseURL + "/waInstance1101/sendMessage/a%2Fb", "api.green-api.com"},
+		{mediaOverridden, "uploadFile", "http://127.0.0.1:9000/waInstance1101/uploadFile/a%2Fb", "127.0.0.1:9000"},
+	}
+	for _, tt := range tests {
+		if got := tt.endpoints.MethodURL(tt.method, "1101", "a/b"); got != tt.wantURL {
+			t.Errorf("%+v: MethodURL(%s) = %s, want %s", tt.endpoints, tt.method, got, tt.wantURL)
+		}
+		if got := tt.endpoints.Host(tt.method); got != tt.wantHost {
+			t.Errorf("%+v: Host(%s) = %s, want %s", tt.endpoints, tt.method, got, tt.wantHost)
+		}
+	}
+}
+
+func TestClientRoutesByHost(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string][]string{}
+	host := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			mu.Lock()
+			hits[name] = append(hits[name], strings.Split(r.URL.Path, "/")[2])
+			mu.Unlock()
+			io.WriteString(w, `{"idMessage":"BAE5","urlFile":"https://example.com/f","downloadUrl":"https://example.com/d"}`)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	api, media := host("api"), host("media")
+	c := NewClient(Endpoints{API: api.URL, Media: media.URL}, "1101", testToken, nil)
+	ctx := context.Background()
+
+	calls := []func() error{
+		func() error { _, err := c.GetSettings(ctx); return err },
+		func() error {
+			_, err := c.SendMessage(ctx, SendMessageRequest{ChatID: "1@c.us", Message: "x"})
+			return err
+		},
+		func() error {
+			_, err := c.SendFileByUpload(ctx, SendFileByUploadRequest{ChatID: "1@c.us", FileName: "a.txt", File: strings.NewReader("x")})
+			return err
+		},
+		func() error { _, err := c.UploadFile(ctx, strings.NewReader("x"), "a.txt", "text/plain"); return err },
+		func() error {
+			_, err := c.DownloadFile(ctx, DownloadFileRequest{ChatID: "1@c.us", IDMessage: "BAE5"})
+			return err
+		},
+	}
+	for _, call := range calls {
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := strings.Join(hits["api"], ","); got != "getSettings,sendMessage" {
+		t.Errorf("the API host got %s", got)
+	}
+	if got := strings.Join(hits["media"], ","); got != "sendFileByUpload,uploadFile,downloadFile" {
+		t.Errorf("the media host got %s", got)
+	}
+}
@@ -0,0 +1,110 @@
+package greenapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sentinel errors matched by *Error with errors.Is.
+var (
+	// ErrUnauthorized means GREEN-API rejected the instance credentials.
+	ErrUnauthorized = sentinel("unauthorized")
+	// ErrRateLimited means the instance sent too many requests.
+	ErrRateLimited = sentinel("rate limited")
+	// ErrBadRequest means GREEN-API rejected the request; Error.Message
+	// carries its explanation.
+	ErrBadRequest = sentinel("bad request")
+	// ErrUpstream covers every other unsuccessful response.
+	ErrUpstream = sentinel("upstream error")
+)
+
+type sentinel string
+
+func (s sentinel) Error() string { return "greenapi: " + string(s) }
+
+// maxMessageSize bounds how much of a response body ends up in Message.
+const maxMessageSize = 512
+
+// Error is an unsuccessful GREEN-API response.
+type Error struct {
+	Method     string
+	StatusCode int
+	// Message is the explanation sent by GREEN-API, if any.
+	Message string
+	// RetryAfter is set from the Retry-After header of a 429 response.
+	RetryAfter time.Duration
+}
+
+func newError(method string, resp *http.Response, body []byte) *Error {
+	e := &Error{Method: method, StatusCode: resp.StatusCode, Message: upstreamMessage(body)}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("greenapi: %s: status %d", e.Method, e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == ErrUnauthorized
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	default:
+		return target == ErrUpstream
+	}
+}
+
+// upstreamMessage extracts the "message" field GREEN-API uses for errors,
+// falling back to the start of the body when it is plain text.
+func upstreamMessage(body []byte) string {
+	var payload struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		return truncate(payload.Message)
+	}
+	if !utf8.Valid(body) {
+		return ""
+	}
+	return truncate(strings.TrimSpace(string(body)))
+}
+
+func truncate(s string) string {
+	if len(s) <= maxMessageSize {
+		return s
+	}
+	s = s[:maxMessageSize]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "..."
+}
+
+// UploadError means reading the file for sendFileByUpload failed, so the
+// upload was abandoned before GREEN-API got all of it.
+type UploadError struct {
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return "greenapi: sendFileByUpload: read file: " + e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
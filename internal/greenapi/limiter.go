@@ -0,0 +1,208 @@
+package greenapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// AnyMethod is the Limits key whose budget applies to methods without one
+// of their own.
+const AnyMethod = "*"
+
+// limiterSweepInterval is how often buckets that have refilled are dropped.
+const limiterSweepInterval = time.Minute
+
+// Budget is how often one method may be called for an instance: Calls per
+// Per, and at least MinInterval apart. Calls of zero leaves the rate
+// unlimited; MinInterval of zero allows calls back to back.
+type Budget struct {
+	Calls       int
+	Per         time.Duration
+	MinInterval time.Duration
+}
+
+func (b Budget) String() string {
+	s := fmt.Sprintf("%d/%s", b.Calls, b.Per)
+	if b.MinInterval > 0 {
+		s += "/" + b.MinInterval.String()
+	}
+	return s
+}
+
+// Limits maps method names, or AnyMethod, to their budgets.
+type Limits map[string]Budget
+
+// ErrThrottled is matched by *ThrottledError.
+var ErrThrottled = sentinel("throttled")
+
+// ThrottledError is returned without calling GREEN-API when the budget of
+// the method would make the call wait longer than the limiter allows.
+type ThrottledError struct {
+	Method string
+	// RetryAfter is how long until the call would be let through.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("greenapi: %s: outbound limit reached, retry in %s", e.Method, e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// Limiter paces calls to GREEN-API per instance and method, so that a burst
+// from the frontend does not reach WhatsApp as one. A call whose turn comes
+// within maxWait waits for it; a later one is refused with *ThrottledError
+// and takes nothing from the budget.
+type Limiter struct {
+	limits  Limits
+	maxWait time.Duration
+
+	// Now, OnWait and OnReject may be set before the first call; the hooks
+	// are called with the limiter's lock held and must not block.
+	Now      func() time.Time
+	OnWait   func(method string, wait time.Duration)
+	OnReject func(method string, retryAfter time.Duration)
+
+	mu        sync.Mutex
+	buckets   map[limiterKey]*bucket
+	lastSweep time.Time
+}
+
+type limiterKey struct {
+	idInstance string
+	method     string
+}
+
+type bucket struct {
+	// rate is nil when the budget does not limit the rate.
+	rate *rate.Limiter
+	// next is the earliest time the following call may start.
+	next time.Time
+	// expires is when the bucket has refilled and can be dropped.
+	expires time.Time
+}
+
+func NewLimiter(limits Limits, maxWait time.Duration) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		maxWait: maxWait,
+		Now:     time.Now,
+		buckets: make(map[limiterKey]*bucket),
+	}
+}
+
+// Budget returns the budget that applies to method.
+func (l *Limiter) Budget(method string) (Budget, bool) {
+	if b, ok := l.limits[method]; ok {
+		return b, true
+	}
+	b, ok := l.limits[AnyMethod]
+	return b, ok
+}
+
+// Reserve takes the next slot for a call of method for idInstance and
+// returns how long the caller has to wait for it.
+func (l *Limiter) Reserve(idInstance, method string) (time.Duration, error) {
+	return l.reserve(idInstance, method, l.maxWait)
+}
+
+func (l *Limiter) reserve(idInstance, method string, maxWait time.Duration) (time.Duration, error) {
+	budget, ok := l.Budget(method)
+	if !ok || budget.Calls <= 0 && budget.MinInterval <= 0 {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	key := limiterKey{idInstance: idInstance, method: method}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{}
+		if budget.Calls > 0 {
+			b.rate = rate.NewLimiter(rate.Every(budget.Per/time.Duration(budget.Calls)), budget.Calls)
+		}
+		l.buckets[key] = b
+	}
+
+	var wait time.Duration
+	var reservation *rate.Reservation
+	if b.rate != nil {
+		reservation = b.rate.ReserveN(now, 1)
+		wait = reservation.DelayFrom(now)
+	}
+	wait = max(wait, b.next.Sub(now))
+
+	if wait > maxWait {
+		if reservation != nil {
+			reservation.CancelAt(now)
+		}
+		if l.OnReject != nil {
+			l.OnReject(method, wait)
+		}
+		return 0, &ThrottledError{Method: method, RetryAfter: wait}
+	}
+
+	slot := now.Add(wait)
+	b.next = slot.Add(budget.MinInterval)
+	b.expires = slot.Add(max(budget.Per, budget.MinInterval))
+	if wait > 0 && l.OnWait != nil {
+		l.OnWait(method, wait)
+	}
+	return wait, nil
+}
+
+// Wait is Reserve followed by waiting for the slot, which is added to the
+// CallStats of ctx. A context from WithLimiterWait replaces the limiter's
+// longest wait. A context that ends first returns its error; the slot is
+// not given back.
+func (l *Limiter) Wait(ctx context.Context, idInstance, method string) error {
+	maxWait := l.maxWait
+	if d, ok := ctx.Value(limiterWaitKey{}).(time.Duration); ok {
+		maxWait = d
+	}
+	wait, err := l.reserve(idInstance, method, maxWait)
+	if err != nil || wait <= 0 {
+		return err
+	}
+	if stats, ok := ctx.Value(callStatsKey{}).(*CallStats); ok {
+		stats.Throttled += wait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limiterWaitKey struct{}
+
+// WithLimiterWait returns a context that lets calls made with it wait up to
+// maxWait for their turn, for batches that would rather wait than be
+// refused.
+func WithLimiterWait(ctx context.Context, maxWait time.Duration) context.Context {
+	return context.WithValue(ctx, limiterWaitKey{}, maxWait)
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.After(b.expires) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,163 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limits Limits, maxWait time.Duration) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter(limits, maxWait)
+	l.Now = clock.Now
+	return l, clock
+}
+
+func TestLimiterPacing(t *testing.T) {
+	// Three messages a minute, three seconds apart; the rate refills one
+	// call every 20 seconds.
+	l, clock := newTestLimiter(Limits{"sendMessage": {Calls: 3, Per: time.Minute, MinInterval: 3 * time.Second}}, 5*time.Second)
+
+	steps := []struct {
+		advance        time.Duration
+		wantWait       time.Duration
+		wantRetryAfter time.Duration
+	}{
+		{0, 0, 0},
+		{0, 3 * time.Second, 0},               // the minimum interval
+		{0, 0, 6 * time.Second},               // a wait past maxWait is refused
+		{3 * time.Second, 3 * time.Second, 0}, // the refusal took no slot
+		{6 * time.Second, 0, 11 * time.Second},
+		{6 * time.Second, 5 * time.Second, 0}, // the rate, not the interval
+	}
+	for i, s := range steps {
+		clock.advance(s.advance)
+		wait, err := l.Reserve("1101", "sendMessage")
+		var throttled *ThrottledError
+		if s.wantRetryAfter > 0 {
+			if !errors.As(err, &throttled) || !errors.Is(err, ErrThrottled) || throttled.Method != "sendMessage" ||
+				throttled.RetryAfter.Round(time.Millisecond) != s.wantRetryAfter {
+				t.Fatalf("step %d: err = %v, want a retry in %s", i+1, err, s.wantRetryAfter)
+			}
+			continue
+		}
+		if err != nil || wait.Round(time.Millisecond) != s.wantWait {
+			t.Fatalf("step %d: Reserve = %s, %v; want %s", i+1, wait, err, s.wantWait)
+		}
+	}
+}
+
+func TestLimiterBudgets(t *testing.T) {
+	limits := Limits{
+		"sendMessage": {Calls: 1, Per: time.Minute},
+		"getSettings": {Calls: 0, Per: time.Minute},
+		AnyMethod:     {Calls: 2, Per: time.Minute},
+	}
+	tests := []struct {
+		name        string
+		idInstance  string
+		method      string
+		wantAllowed bool
+	}{
+		{"budget used up", "1101", "sendMessage", false},
+		{"another instance", "2202", "sendMessage", true},
+		{"zero calls is unlimited", "1101", "getSettings", true},
+		{"AnyMethod, second call", "1101", "getStateInstance", true},
+		{"AnyMethod is per method", "1101", "getQR", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := newTestLimiter(limits, 0)
+			for _, seed := range []string{"sendMessage", "getSettings", "getStateInstance"} {
+				if _, err := l.Reserve("1101", seed); err != nil {
+					t.Fatalf("first %s: %v", seed, err)
+				}
+			}
+			_, err := l.Reserve(tt.idInstance, tt.method)
+			if (err == nil) != tt.wantAllowed {
+				t.Errorf("Reserve = %v, want allowed %t", err, tt.wantAllowed)
+			}
+		})
+	}
+
+	if _, ok := NewLimiter(Limits{"sendMessage": {Calls: 1, Per: time.Minute}}, 0).Budget("getSettings"); ok {
+		t.Error("a method without a budget or AnyMethod got one")
+	}
+}
+
+func TestLimiterHooks(t *testing.T) {
+	l, _ := newTestLimiter(Limits{"sendMessage": {Calls: 10, Per: time.Minute, MinInterval: 2 * time.Second}}, 3*time.Second)
+	var waits, rejects []time.Duration
+	l.OnWait = func(method string, wait time.Duration) { waits = append(waits, wait) }
+	l.OnReject = func(method string, retryAfter time.Duration) { rejects = append(rejects, retryAfter) }
+
+	for range 3 {
+		l.Reserve("1101", "sendMessage")
+	}
+	if len(waits) != 1 || waits[0] != 2*time.Second {
+		t.Errorf("OnWait got %v, want one 2s wait", waits)
+	}
+	if len(rejects) != 1 || rejects[0] != 4*time.Second {
+		t.Errorf("OnReject got %v, want one 4s refusal", rejects)
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter(Limits{AnyMethod: {Calls: 1, Per: time.Second}}, 0)
+	l.Reserve("1101", "a")
+	l.Reserve("1101", "b")
+	clock.advance(limiterSweepInterval + time.Second)
+	l.Reserve("1101", "c")
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets kept, want only the new one", len(l.buckets))
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := NewLimiter(Limits{"sendMessage": {Calls: 10, Per: time.Minute, MinInterval: 50 * time.Millisecond}}, 0)
+
+	// The limiter refuses any wait, a batch allows some.
+	if err := l.Wait(context.Background(), "1101", "sendMessage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(context.Background(), "1101", "sendMessage"); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("err = %v, want ErrThrottled", err)
+	}
+	var stats CallStats
+	ctx := WithCallStats(WithLimiterWait(context.Background(), time.Second), &stats)
+	start := time.Now()
+	if err := l.Wait(ctx, "1101", "sendMessage"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || stats.Throttled <= 0 {
+		t.Errorf("waited %s, Throttled %s", elapsed, stats.Throttled)
+	}
+
+	canceled, cancel := context.WithCancel(WithLimiterWait(context.Background(), time.Second))
+	cancel()
+	if err := l.Wait(canceled, "1101", "sendMessage"); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestClientLimiterSkipsUpstream(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"idMessage":"BAE5"}`))
+	}).WithLimiter(NewLimiter(Limits{"sendMessage": {Calls: 1, Per: time.Minute}}, 0))
+
+	req := SendMessageRequest{ChatID: "1@c.us", Message: "x"}
+	if _, err := c.SendMessage(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SendMessage(context.Background(), req); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("err = %v, want ErrThrottled", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream got %d calls, want 1", calls.Load())
+	}
+}
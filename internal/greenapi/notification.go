@@ -0,0 +1,83 @@
+package greenapi
+
+import "encoding/json"
+
+// Webhook types sent by GREEN-API in Notification.TypeWebhook.
+const (
+	WebhookIncomingMessageReceived    = "incomingMessageReceived"
+	WebhookOutgoingMessageReceived    = "outgoingMessageReceived"
+	WebhookOutgoingAPIMessageReceived = "outgoingAPIMessageReceived"
+	WebhookOutgoingMessageStatus      = "outgoingMessageStatus"
+	WebhookStateInstanceChanged       = "stateInstanceChanged"
+	WebhookDeviceInfo                 = "deviceInfo"
+	WebhookIncomingCall               = "incomingCall"
+	WebhookIncomingBlock              = "incomingBlock"
+)
+
+// Notification is a webhook notification, either pushed to the webhook URL
+// or fetched with ReceiveNotification. Fields that only some types carry are
+// left empty for the others; Raw holds the whole payload.
+type Notification struct {
+	TypeWebhook  string       `json:"typeWebhook"`
+	InstanceData InstanceData `json:"instanceData"`
+	Timestamp    int64        `json:"timestamp"`
+
+	IDMessage   string          `json:"idMessage,omitempty"`
+	SenderData  *SenderData     `json:"senderData,omitempty"`
+	MessageData json.RawMessage `json:"messageData,omitempty"`
+
+	// Set for outgoingMessageStatus.
+	ChatID string `json:"chatId,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	// Set for stateInstanceChanged.
+	StateInstance string `json:"stateInstance,omitempty"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+type InstanceData struct {
+	IDInstance   int64  `json:"idInstance"`
+	WID          string `json:"wid"`
+	TypeInstance string `json:"typeInstance"`
+}
+
+type SenderData struct {
+	ChatID     string `json:"chatId"`
+	ChatName   string `json:"chatName,omitempty"`
+	Sender     string `json:"sender"`
+	SenderName string `json:"senderName,omitempty"`
+}
+
+// ParseNotification decodes and checks a notification payload.
+func ParseNotification(data []byte) (*Notification, error) {
+	var n Notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+	n.Raw = json.RawMessage(data)
+	return &n, nil
+}
+
+// FieldError is a problem with one field of a notification. Rule names the
+// check that failed.
+type FieldError struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+// Validate reports the fields every notification must carry.
+func (n *Notification) Validate() []FieldError {
+	var problems []FieldError
+	if n.TypeWebhook == "" {
+		problems = append(problems, FieldError{Field: "typeWebhook", Rule: "required", Message: "is required"})
+	}
+	if n.InstanceData.IDInstance == 0 {
+		problems = append(problems, FieldError{Field: "instanceData.idInstance", Rule: "required", Message: "is required"})
+	}
+	if n.Timestamp <= 0 {
+		problems = append(problems, FieldError{Field: "timestamp", Rule: "positive", Message: "must be a positive Unix time"})
+	}
+	return problems
+}
@@ -0,0 +1,66 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Outcomes of a call passed to Recorder.Call, besides the status class of
+// the answer ("2xx", "4xx", "5xx").
+const (
+	// OutcomeError is a call that got no answer, or one it could not read.
+	OutcomeError = "error"
+	// OutcomeTimeout is a call whose deadline passed, that of its context
+	// or the timeout of the HTTP client.
+	OutcomeTimeout = "timeout"
+	// OutcomeCanceled is a call given up on by its caller.
+	OutcomeCanceled = "canceled"
+	// OutcomeCircuitOpen is a call the circuit breaker refused.
+	OutcomeCircuitOpen = "circuit_open"
+	// OutcomeThrottled is a call the outbound limiter refused.
+	OutcomeThrottled = "throttled"
+)
+
+// Recorder is told about every GREEN-API call, for metrics. Its methods are
+// called on the goroutine making the call and must be safe for concurrent
+// use.
+type Recorder interface {
+	// Attempt is called after each HTTP request of a call; attempt counts
+	// from 1, so that every attempt above it is a retry. status is 0 when
+	// no answer came.
+	Attempt(method, idInstance string, attempt, status int, latency time.Duration)
+	// Call is called once a call is over, with its outcome and the time it
+	// took, retries and limiter waits included.
+	Call(method, idInstance, outcome string, latency time.Duration)
+}
+
+// WithRecorder makes the client report its calls to recorder.
+func (c *Client) WithRecorder(recorder Recorder) *Client {
+	c.recorder = recorder
+	return c
+}
+
+// callOutcome classifies err, the result of a call made with ctx, as one of
+// the outcomes passed to Recorder.Call.
+func callOutcome(ctx context.Context, err error) string {
+	var apiErr *Error
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "2xx"
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode/100) + "xx"
+	case errors.Is(err, ErrCircuitOpen):
+		return OutcomeCircuitOpen
+	case errors.Is(err, ErrThrottled):
+		return OutcomeThrottled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return OutcomeTimeout
+	case errors.Is(ctx.Err(), context.Canceled), errors.Is(err, context.Canceled):
+		return OutcomeCanceled
+	}
+	return OutcomeError
+}
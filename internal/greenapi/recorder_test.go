@@ -0,0 +1,170 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRecorder notes every report as a line.
+type fakeRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *fakeRecorder) Attempt(method, idInstance string, attempt, status int, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if latency <= 0 {
+		r.lines = append(r.lines, "attempt without latency")
+	}
+	r.lines = append(r.lines, fmt.Sprintf("attempt %s %s #%d %d", method, idInstance, attempt, status))
+}
+
+func (r *fakeRecorder) Call(method, idInstance, outcome string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf("call %s %s %s", method, idInstance, outcome))
+}
+
+func (r *fakeRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.lines, "; ")
+}
+
+func TestCallOutcome(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{"success", context.Background(), nil, "2xx"},
+		{"client error", context.Background(), &Error{StatusCode: http.StatusBadRequest}, "4xx"},
+		{"server error", context.Background(), fmt.Errorf("wrapped: %w", &Error{StatusCode: http.StatusBadGateway}), "5xx"},
+		{"circuit open", context.Background(), ErrCircuitOpen, OutcomeCircuitOpen},
+		{"throttled", context.Background(), &ThrottledError{Method: "sendMessage"}, OutcomeThrottled},
+		{"deadline", context.Background(), context.DeadlineExceeded, OutcomeTimeout},
+		{"client timeout", context.Background(), &net.OpError{Op: "dial", Err: timeoutError{}}, OutcomeTimeout},
+		{"canceled", canceled, errors.New("greenapi: request failed"), OutcomeCanceled},
+		{"canceled error", context.Background(), context.Canceled, OutcomeCanceled},
+		{"connection refused", context.Background(), errors.New("connection refused"), OutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callOutcome(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("callOutcome(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestClientRecorder drives a scripted flaky upstream and checks that the
+// attempts and the outcome reported match what it did.
+func TestClientRecorder(t *testing.T) {
+	tests := []struct {
+		name     string
+		post     bool
+		failures int32
+		status   int
+		want     string
+	}{
+		{"success", false, 0, 0,
+			"attempt getStateInstance 1101 #1 200; call getStateInstance 1101 2xx"},
+		{"retried 502s", false, 2, http.StatusBadGateway,
+			"attempt getStateInstance 1101 #1 502; attempt getStateInstance 1101 #2 502; attempt getStateInstance 1101 #3 200; call getStateInstance 1101 2xx"},
+		{"gives up", false, 10, http.StatusServiceUnavailable,
+			"attempt getStateInstance 1101 #1 503; attempt getStateInstance 1101 #2 503; attempt getStateInstance 1101 #3 503; attempt getStateInstance 1101 #4 503; call getStateInstance 1101 5xx"},
+		{"retried 429", false, 1, http.StatusTooManyRequests,
+			"attempt getStateInstance 1101 #1 429; attempt getStateInstance 1101 #2 200; call getStateInstance 1101 2xx"},
+		{"400 not retried", false, 1, http.StatusBadRequest,
+			"attempt getStateInstance 1101 #1 400; call getStateInstance 1101 4xx"},
+		{"POST not retried", true, 1, http.StatusBadGateway,
+			"attempt sendMessage 1101 #1 502; call sendMessage 1101 5xx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, calls := failingUpstream(tt.failures, tt.status, `{"stateInstance":"authorized","idMessage":"BAE5"}`)
+			rec := &fakeRecorder{}
+			c := newTestClient(t, handler).WithRetry(fastRetry).WithRecorder(rec)
+			if tt.post {
+				c.SendMessage(context.Background(), SendMessageRequest{ChatID: "1@c.us", Message: "x"})
+			} else {
+				c.GetStateInstance(context.Background())
+			}
+			if got := rec.String(); got != tt.want {
+				t.Errorf("recorded\n  %s\nwant\n  %s", got, tt.want)
+			}
+			if n := strings.Count(rec.String(), "attempt "); n != int(calls.Load()) {
+				t.Errorf("recorded %d attempts, upstream got %d", n, calls.Load())
+			}
+		})
+	}
+}
+
+func TestClientRecorderWithoutAnswer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + ln.Addr().String()
+	ln.Close()
+
+	hang := func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) (*Client, context.Context)
+		want  string
+	}{
+		{"connection refused", func(t *testing.T) (*Client, context.Context) {
+			return NewClient(Endpoints{API: refused}, "1101", testToken, http.DefaultClient), context.Background()
+		}, "attempt getSettings 1101 #1 0; call getSettings 1101 error"},
+		{"deadline", func(t *testing.T) (*Client, context.Context) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			t.Cleanup(cancel)
+			return newTestClient(t, hang), ctx
+		}, "attempt getSettings 1101 #1 0; call getSettings 1101 timeout"},
+		{"canceled", func(t *testing.T) (*Client, context.Context) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return newTestClient(t, hang), ctx
+		}, "attempt getSettings 1101 #1 0; call getSettings 1101 canceled"},
+		{"circuit open", func(t *testing.T) (*Client, context.Context) {
+			b, _, _ := newTestBreakers(1, time.Minute)
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }).WithBreakers(b)
+			c.GetSettings(context.Background())
+			return c, context.Background()
+		}, "call getSettings 1101 circuit_open"},
+		{"throttled", func(t *testing.T) (*Client, context.Context) {
+			l := NewLimiter(Limits{AnyMethod: {Calls: 1, Per: time.Hour}}, 0)
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {}).WithLimiter(l)
+			c.GetSettings(context.Background())
+			return c, context.Background()
+		}, "call getSettings 1101 throttled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ctx := tt.setup(t)
+			rec := &fakeRecorder{}
+			c.WithRecorder(rec).GetSettings(ctx)
+			if got := rec.String(); got != tt.want {
+				t.Errorf("recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy retries calls that failed with 429, 5xx or a network error.
+// GET calls are always safe to repeat; other calls are only retried when
+// the connection could not be established, so the request never reached
+// GREEN-API.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt; values below 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is doubled after every attempt, with jitter.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay, including one requested by Retry-After.
+	// Zero means no cap.
+	MaxDelay time.Duration
+}
+
+// next reports whether a call that failed with err on attempt should be
+// retried and after how long.
+func (p RetryPolicy) next(attempt int, httpMethod string, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !retryable(httpMethod, err) {
+		return 0, false
+	}
+
+	var delay time.Duration
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		delay = apiErr.RetryAfter
+	} else {
+		delay = p.BaseDelay << (attempt - 1)
+		// Full jitter over the upper half keeps clients from retrying in step.
+		if delay > 0 {
+			delay = delay/2 + rand.N(delay/2+1)
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay, true
+}
+
+func retryable(httpMethod string, err error) bool {
+	if httpMethod != http.MethodGet {
+		return notSent(err)
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// notSent reports whether err happened while connecting, before any part of
+// the request was written.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// CallStats accumulates the attempts and time spent on GREEN-API calls made
+// with a context from WithCallStats.
+type CallStats struct {
+	Attempts int
+	// Failures counts the attempts that got no answer or an error status.
+	Failures int
+	Latency  time.Duration
+	// Throttled is the time spent waiting for the outbound limiter.
+	Throttled time.Duration
+}
+
+type callStatsKey struct{}
+
+// WithCallStats returns a context that makes the client record its calls in
+// stats. stats must not be shared between concurrent calls.
+func WithCallStats(ctx context.Context, stats *CallStats) context.Context {
+	return context.WithValue(ctx, callStatsKey{}, stats)
+}
@@ -0,0 +1,174 @@
+package greenapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastRetry retries up to four times without noticeable delays.
+var fastRetry = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+// failingUpstream answers the first failures requests with status, and
+// then with body.
+func failingUpstream(failures int32, status int, body string) (http.HandlerFunc, *atomic.Int32) {
+	var calls atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, body)
+	}, &calls
+}
+
+func TestRetryScriptedFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		post      bool
+		failures  int32
+		status    int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"GET succeeds after 502s", false, 2, http.StatusBadGateway, false, 3},
+		{"GET succeeds after 429", false, 1, http.StatusTooManyRequests, false, 2},
+		{"GET gives up after MaxAttempts", false, 10, http.StatusServiceUnavailable, true, 4},
+		{"GET does not retry 400", false, 1, http.StatusBadRequest, true, 1},
+		{"GET does not retry 401", false, 1, http.StatusUnauthorized, true, 1},
+		{"POST does not retry a 502", true, 1, http.StatusBadGateway, true, 1},
+		{"POST does not retry a 429", true, 1, http.StatusTooManyRequests, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, calls := failingUpstream(tt.failures, tt.status, `{"stateInstance":"authorized","idMessage":"BAE5"}`)
+			c := newTestClient(t, handler).WithRetry(fastRetry)
+
+			var stats CallStats
+			ctx := WithCallStats(context.Background(), &stats)
+			var err error
+			if tt.post {
+				_, err = c.SendMessage(ctx, SendMessageRequest{ChatID: "1@c.us", Message: "x"})
+			} else {
+				_, err = c.GetStateInstance(ctx)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("upstream got %d requests, want %d", calls.Load(), tt.wantCalls)
+			}
+			wantFailures := min(int(tt.failures), int(tt.wantCalls))
+			if stats.Attempts != int(tt.wantCalls) || stats.Failures != wantFailures || stats.Latency <= 0 {
+				t.Errorf("stats = %+v, want %d attempts and %d failures", stats, tt.wantCalls, wantFailures)
+			}
+		})
+	}
+}
+
+func TestRetryPOSTWhenNeverSent(t *testing.T) {
+	// A port nothing listens on refuses the connection before any byte of
+	// the request is written.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := NewClient(Endpoints{API: "http://" + addr}, "1101", testToken, nil).WithRetry(fastRetry)
+	var stats CallStats
+	_, err = c.SendMessage(WithCallStats(context.Background(), &stats), SendMessageRequest{ChatID: "1@c.us", Message: "x"})
+	if err == nil {
+		t.Fatal("the call succeeded")
+	}
+	if stats.Attempts != fastRetry.MaxAttempts {
+		t.Errorf("attempts = %d, want %d for a refused connection", stats.Attempts, fastRetry.MaxAttempts)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"stateInstance":"authorized"}`)
+	}).WithRetry(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})
+
+	start := time.Now()
+	if _, err := c.GetStateInstance(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the 1s of Retry-After", elapsed)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		cancel()
+		w.WriteHeader(http.StatusBadGateway)
+	}).WithRetry(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour})
+
+	start := time.Now()
+	_, err := c.GetStateInstance(ctx)
+	if err == nil {
+		t.Fatal("the call succeeded")
+	}
+	if calls.Load() != 1 || time.Since(start) > time.Second {
+		t.Errorf("%d requests in %s, want the retries abandoned at once", calls.Load(), time.Since(start))
+	}
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	upstream := &Error{StatusCode: http.StatusBadGateway}
+	dial := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+
+	tests := []struct {
+		name       string
+		attempt    int
+		httpMethod string
+		err        error
+		wantOK     bool
+		min, max   time.Duration
+	}{
+		{"first retry", 1, http.MethodGet, upstream, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"second retry doubles", 2, http.MethodGet, upstream, true, 100 * time.Millisecond, 200 * time.Millisecond},
+		{"capped", 4, http.MethodGet, upstream, true, 300 * time.Millisecond, 300 * time.Millisecond},
+		{"Retry-After", 1, http.MethodGet, &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 200 * time.Millisecond}, true, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"Retry-After capped", 1, http.MethodGet, &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}, true, 300 * time.Millisecond, 300 * time.Millisecond},
+		{"out of attempts", 5, http.MethodGet, upstream, false, 0, 0},
+		{"GET network error", 1, http.MethodGet, read, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"POST dial error", 1, http.MethodPost, dial, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"POST read error", 1, http.MethodPost, read, false, 0, 0},
+		{"POST upstream error", 1, http.MethodPost, upstream, false, 0, 0},
+		{"GET 404", 1, http.MethodGet, &Error{StatusCode: http.StatusNotFound}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 20 {
+				delay, ok := p.next(tt.attempt, tt.httpMethod, tt.err)
+				if ok != tt.wantOK || ok && (delay < tt.min || delay > tt.max) {
+					t.Fatalf("next = %s, %t; want %t within [%s, %s]", delay, ok, tt.wantOK, tt.min, tt.max)
+				}
+			}
+		})
+	}
+
+	if _, ok := (RetryPolicy{}).next(1, http.MethodGet, upstream); ok {
+		t.Error("the zero policy retried")
+	}
+}
@@ -0,0 +1,148 @@
+package greenapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// upload streams req to sendFileByUpload through a pipe: the form is written
+// by a goroutine while the HTTP client sends what it has so far.
+func (c *Client) upload(ctx context.Context, req SendFileByUploadRequest, out *SendResult) error {
+	const method = "sendFileByUpload"
+
+	if stats, ok := ctx.Value(callStatsKey{}).(*CallStats); ok {
+		start := time.Now()
+		stats.Attempts++
+		defer func() { stats.Latency += time.Since(start) }()
+	}
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeUploadForm(form, req))
+	}()
+	// GREEN-API may answer before reading the whole form; closing the pipe
+	// stops the writer, which must be gone before the caller's File is.
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL(method), pr)
+	if err != nil {
+		return fmt.Errorf("greenapi: %s: %w", method, scrubURLError(err))
+	}
+	httpReq.Header.Set("Content-Type", form.FormDataContentType())
+
+	data, err := c.send(httpReq, method, 1, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("greenapi: %s: decode response: %w", method, err)
+	}
+	return nil
+}
+
+// UploadFileResult is returned by uploadFile.
+type UploadFileResult struct {
+	URLFile string `json:"urlFile"`
+}
+
+// UploadFile stores file in GREEN-API's storage and returns a URL for
+// sendFileByUrl. The body is streamed and the call is not retried; read
+// errors of file are *UploadError.
+func (c *Client) UploadFile(ctx context.Context, file io.Reader, fileName, contentType string) (*UploadFileResult, error) {
+	const method = "uploadFile"
+
+	var result UploadFileResult
+	err := c.guard(ctx, method, func() error {
+		if stats, ok := ctx.Value(callStatsKey{}).(*CallStats); ok {
+			start := time.Now()
+			stats.Attempts++
+			defer func() { stats.Latency += time.Since(start) }()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL(method), sourceReader{file})
+		if err != nil {
+			return fmt.Errorf("greenapi: %s: %w", method, scrubURLError(err))
+		}
+		if contentType == "" {
+			contentType = defaultContentType
+		}
+		req.Header.Set("Content-Type", contentType)
+		if fileName != "" {
+			req.Header.Set("GA-Filename", fileName)
+		}
+
+		data, err := c.send(req, method, 1, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return fmt.Errorf("greenapi: %s: decode response: %w", method, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func writeUploadForm(form *multipart.Writer, req SendFileByUploadRequest) error {
+	fields := [][2]string{{"chatId", req.ChatID}, {"fileName", req.FileName}}
+	if req.Caption != "" {
+		fields = append(fields, [2]string{"caption", req.Caption})
+	}
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+		"name":     "file",
+		"filename": req.FileName,
+	}))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(part, sourceReader{req.File}); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// sourceReader marks read errors of the file as *UploadError, telling them
+// apart from errors writing to GREEN-API once net/http hands them back.
+type sourceReader struct {
+	r io.Reader
+}
+
+func (s sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &UploadError{Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IPNets is a list of CIDR ranges; a bare address stands for a single host.
+// In the environment ranges are separated by ",".
+type IPNets []netip.Prefix
+
+func (n *IPNets) UnmarshalText(text []byte) error {
+	var items []string
+	for _, item := range strings.Split(string(text), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return n.parse(items)
+}
+
+func (n *IPNets) UnmarshalYAML(node *yaml.Node) error {
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+	return n.parse(items)
+}
+
+func (n *IPNets) parse(items []string) error {
+	nets := make(IPNets, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return fmt.Errorf("invalid IP or CIDR %q", item)
+			}
+			nets = append(nets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return fmt.Errorf("invalid IP or CIDR %q", item)
+		}
+		nets = append(nets, prefix.Masked())
+	}
+	*n = nets
+	return nil
+}
+
+func (n IPNets) String() string {
+	items := make([]string, len(n))
+	for i, prefix := range n {
+		items[i] = prefix.String()
+	}
+	return strings.Join(items, ",")
+}
+
+func (n IPNets) contains(addr netip.Addr) bool {
+	_, ok := n.match(addr)
+	return ok
+}
+
+// match returns the first range containing addr.
+func (n IPNets) match(addr netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+type ipFilterPolicy struct {
+	allow    IPNets
+	deny     IPNets
+	prefixes []string
+}
+
+func (p *ipFilterPolicy) applies(urlPath string) bool {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide reports whether addr may pass and the rule that decided it. Deny
+// rules win over allow rules; an empty allow list allows everyone who is not
+// denied. Clients without an IP address (unix socket) only pass an empty
+// allow list.
+func (p *ipFilterPolicy) decide(addr netip.Addr, ok bool) (bool, string) {
+	if ok {
+		if prefix, found := p.deny.match(addr); found {
+			return false, "deny " + prefix.String()
+		}
+	}
+	if len(p.allow) == 0 {
+		return true, "default"
+	}
+	if ok {
+		if prefix, found := p.allow.match(addr); found {
+			return true, "allow " + prefix.String()
+		}
+	}
+	return false, "not allowed"
+}
+
+// IPFilter answers 403 to clients rejected by the policy on paths it applies
+// to.
+func IPFilter(logger *slog.Logger, policy *ipFilterPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !matchRequestPath(r, policy.applies) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr, ok := clientIP(r)
+		allowed, rule := policy.decide(addr, ok)
+		if !allowed {
+			logger.Warn("Access denied",
+				slog.String("remote_addr", remoteAddr(r)),
+				slog.String("path", r.URL.Path),
+				slog.String("rule", rule),
+				slog.String("request_id", RequestIDFromContext(r.Context())),
+			)
+			renderError(w, r, http.StatusForbidden, errCodeForbidden, http.StatusText(http.StatusForbidden), nil)
+			return
+		}
+
+		logger.Debug("Access allowed",
+			slog.String("remote_addr", remoteAddr(r)),
+			slog.String("path", r.URL.Path),
+			slog.String("rule", rule),
+		)
+		next.ServeHTTP(w, r)
+	})
+}
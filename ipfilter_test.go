@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// mustIPNets parses a comma-separated list the way IP_ALLOW and IP_DENY are.
+func mustIPNets(t *testing.T, s string) IPNets {
+	t.Helper()
+	var nets IPNets
+	if err := nets.UnmarshalText([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestIPFilterDecide(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny string
+		remoteAddr  string
+		wantAllowed bool
+		wantRule    string
+	}{
+		{"no rules", "", "", "198.51.100.1:1234", true, "default"},
+		{"empty allow list", "", "203.0.113.0/24", "198.51.100.1:1234", true, "default"},
+		{"denied", "", "203.0.113.0/24", "203.0.113.9:1234", false, "deny 203.0.113.0/24"},
+		{"allowed", "10.0.0.0/8", "", "10.1.2.3:1234", true, "allow 10.0.0.0/8"},
+		{"not on the allow list", "10.0.0.0/8", "", "198.51.100.1:1234", false, "not allowed"},
+		{"deny wins over allow", "10.0.0.0/8", "10.0.0.5", "10.0.0.5:1234", false, "deny 10.0.0.5/32"},
+		{"allowed next to a denied host", "10.0.0.0/8", "10.0.0.5", "10.0.0.6:1234", true, "allow 10.0.0.0/8"},
+		{"bare address", "192.0.2.7", "", "192.0.2.7", true, "allow 192.0.2.7/32"},
+		{"bracketed IPv6 with port", "2001:db8::/32", "", "[2001:db8::1]:443", true, "allow 2001:db8::/32"},
+		{"bracketed IPv6", "", "2001:db8::/32", "[2001:db8::1]", false, "deny 2001:db8::/32"},
+		{"bare IPv6", "", "2001:db8::/32", "2001:db8::1", false, "deny 2001:db8::/32"},
+		{"mapped IPv4", "", "192.0.2.0/24", "[::ffff:192.0.2.1]:1234", false, "deny 192.0.2.0/24"},
+		{"unix socket with an empty allow list", "", "0.0.0.0/0", "@", true, "default"},
+		{"unix socket with an allow list", "0.0.0.0/0,::/0", "", "@", false, "not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &ipFilterPolicy{allow: mustIPNets(t, tt.allow), deny: mustIPNets(t, tt.deny)}
+			addr, ok := parseHostIP(tt.remoteAddr)
+			allowed, rule := policy.decide(addr, ok)
+			if allowed != tt.wantAllowed || rule != tt.wantRule {
+				t.Errorf("decide(%q) = %t, %q, want %t, %q", tt.remoteAddr, allowed, rule, tt.wantAllowed, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestIPNetsConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"prefix length out of range", map[string]string{"IP_DENY": "10.0.0.0/33"}, `IP_DENY: invalid IP or CIDR "10.0.0.0/33"`},
+		{"not an address", map[string]string{"IP_ALLOW": "10.0.0.0/8, office"}, `IP_ALLOW: invalid IP or CIDR "office"`},
+		{"zone in a range", map[string]string{"TRUSTED_PROXIES": "fe80::1%eth0/64"}, `TRUSTED_PROXIES: invalid IP or CIDR "fe80::1%eth0/64"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATIC_DIR", t.TempDir())
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := loadConfig(nil)
+			if err == nil {
+				t.Fatal("loadConfig accepted the configuration")
+			}
+			if got := strings.Join(configProblems(err), "\n"); !strings.Contains(got, tt.want) {
+				t.Errorf("problems lack %q:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestIPFilterBehindRealIP runs the filter behind RealIP, as the server
+// does: forwarded addresses count only when a trusted proxy sent them.
+func TestIPFilterBehindRealIP(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	policy := &ipFilterPolicy{deny: mustIPNets(t, "203.0.113.0/24"), prefixes: []string{"/api/"}}
+	h := RealIP(mustIPNets(t, "10.0.0.0/8"), IPFilter(logger, policy, noContent))
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		xff        string
+		wantStatus int
+	}{
+		{"denied client through the proxy", "/api/sendMessage", "10.0.0.1:1234", "203.0.113.9", http.StatusForbidden},
+		{"allowed client through the proxy", "/api/sendMessage", "10.0.0.1:1234", "198.51.100.1", http.StatusNoContent},
+		{"denied client hiding behind a forged header", "/api/sendMessage", "203.0.113.9:1234", "198.51.100.1", http.StatusForbidden},
+		{"forged header of an allowed peer", "/api/sendMessage", "198.51.100.1:1234", "203.0.113.9", http.StatusNoContent},
+		{"outside the filtered prefixes", "/healthz", "10.0.0.1:1234", "203.0.113.9", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusForbidden {
+				return
+			}
+			if !strings.Contains(rec.Body.String(), errCodeForbidden) {
+				t.Errorf("body = %s, want the %s error", rec.Body, errCodeForbidden)
+			}
+			for _, want := range []string{`"msg":"Access denied"`, `"rule":"deny 203.0.113.0/24"`} {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("the log lacks %s:\n%s", want, logs.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Could not write JSON response", slog.Any("error", err))
+	}
+}
+
+// decodeJSONBody decodes the request body into v, answering 400 when it is
+// not valid JSON. Oversized bodies are left to BodyLimit.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytes *http.MaxBytesError
+		if !errors.As(err, &maxBytes) {
+			WriteError(w, r, http.StatusBadRequest, errCodeInvalidBody, "invalid JSON body", nil)
+		}
+		return false
+	}
+	return true
+}
+
+// writeValidationError answers 400 listing every problem found.
+func writeValidationError(w http.ResponseWriter, r *http.Request, fields []fieldError) {
+	writeHTTPError(w, r, validationError(fields))
+}
+
+// validationError is writeValidationError for a HandlerE to return.
+func validationError(fields []fieldError) *HTTPError {
+	return &HTTPError{
+		Status:  http.StatusBadRequest,
+		Code:    errCodeValidation,
+		Message: "validation failed",
+		Details: map[string]any{"fields": fields},
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Shutdown phases, in the order they run. Notification streams are closed
+// before the HTTP server drains, as /events requests would otherwise keep
+// it waiting; notification workers drain after it, once /webhook takes no
+// more.
+const (
+	shutdownStopIntake   = 10
+	shutdownCloseStreams = 20
+	shutdownDrainHTTP    = 30
+	shutdownDrainQueues  = 40
+	shutdownStopServers  = 50
+	shutdownFlush        = 60
+)
+
+// lifecycle runs the shutdown hooks registered by background components.
+type lifecycle struct {
+	logger *slog.Logger
+	hooks  []shutdownHook
+}
+
+type shutdownHook struct {
+	name     string
+	priority int
+	fn       func(ctx context.Context) error
+}
+
+func newLifecycle(logger *slog.Logger) *lifecycle {
+	return &lifecycle{logger: logger}
+}
+
+// OnShutdown registers fn to run at shutdown. Hooks run one at a time by
+// priority, lowest first, and in the order they were registered within a
+// priority.
+func (l *lifecycle) OnShutdown(priority int, name string, fn func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, shutdownHook{name: name, priority: priority, fn: fn})
+}
+
+// Shutdown runs every hook with ctx and logs how each went. A hook still
+// running when ctx is done is left behind, so the rest get their turn
+// before the deadline rather than after it; they see ctx done and are
+// expected to give up quickly. The errors of all hooks are returned joined.
+func (l *lifecycle) Shutdown(ctx context.Context) error {
+	hooks := append([]shutdownHook(nil), l.hooks...)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].priority < hooks[j].priority
+	})
+
+	var errs []error
+	for _, hook := range hooks {
+		start := time.Now()
+		err := runHook(ctx, hook.fn)
+		attrs := []any{slog.String("hook", hook.name), slog.Duration("duration", time.Since(start))}
+		if err != nil {
+			l.logger.Error("Shutdown hook failed", append(attrs, slog.Any("error", err))...)
+			errs = append(errs, fmt.Errorf("%s: %w", hook.name, err))
+			continue
+		}
+		l.logger.Info("Shutdown hook finished", attrs...)
+	}
+	return errors.Join(errs...)
+}
+
+// runHook returns when fn does or ctx is done, whichever comes first.
+func runHook(ctx context.Context, fn func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// An answer that came in at the same moment still counts.
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		return fmt.Errorf("abandoned: %w", ctx.Err())
+	}
+}
+
+// preStopDelay keeps the server running as usual for delay once /readyz has
+// started failing, so load balancers take it out of rotation before it
+// refuses connections. A second SIGINT or SIGTERM on quit cuts the wait
+// short; other signals are ignored until it is over.
+func preStopDelay(logger *slog.Logger, delay time.Duration, quit <-chan os.Signal) {
+	if delay <= 0 {
+		return
+	}
+	logger.Info("Shutdown delay started, still serving", slog.Duration("delay", delay))
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			logger.Info("Shutdown delay finished", slog.Duration("duration", time.Since(start)))
+			return
+		case sig := <-quit:
+			if sig != os.Interrupt && sig != syscall.SIGTERM {
+				continue
+			}
+			logger.Info("Shutdown delay cut short", slog.String("signal", sig.String()),
+				slog.Duration("duration", time.Since(start)))
+			return
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// loggedHooks returns the hook of every shutdown log line in logs.
+func loggedHooks(t *testing.T, logs string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if _, ok := entry["hook"]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestLifecycleOrder(t *testing.T) {
+	logs := &logBuffer{}
+	lc := newLifecycle(slog.New(slog.NewJSONHandler(logs, nil)))
+	var mu sync.Mutex
+	var ran []string
+	hook := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	lc.OnShutdown(shutdownFlush, "access log", hook("access log"))
+	lc.OnShutdown(shutdownDrainQueues, "notification workers", hook("notification workers"))
+	lc.OnShutdown(shutdownStopIntake, "poller", hook("poller"))
+	lc.OnShutdown(shutdownDrainHTTP, "http servers", hook("http servers"))
+	lc.OnShutdown(shutdownDrainQueues, "send queue", hook("send queue"))
+	lc.OnShutdown(shutdownCloseStreams, "notification streams", hook("notification streams"))
+
+	if err := lc.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "poller,notification streams,http servers,notification workers,send queue,access log"
+	if got := strings.Join(ran, ","); got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+	var logged []string
+	for _, e := range loggedHooks(t, logs.String()) {
+		if e["msg"] != "Shutdown hook finished" || e["duration"] == nil {
+			t.Errorf("entry = %v", e)
+		}
+		logged = append(logged, e["hook"].(string))
+	}
+	if got := strings.Join(logged, ","); got != want {
+		t.Errorf("logged %s, want %s", got, want)
+	}
+}
+
+func TestLifecycleOutcomes(t *testing.T) {
+	errFlush := errors.New("disk full")
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		hooks     []func(ctx context.Context) error
+		wantErr   string
+		wantLevel []string
+	}{
+		{
+			"failure does not stop the rest",
+			time.Second,
+			[]func(ctx context.Context) error{
+				func(context.Context) error { return errFlush },
+				func(context.Context) error { return nil },
+			},
+			"hook 0: disk full",
+			[]string{"ERROR", "INFO"},
+		},
+		{
+			"deadline reaches the hooks",
+			50 * time.Millisecond,
+			[]func(ctx context.Context) error{
+				func(ctx context.Context) error {
+					if _, ok := ctx.Deadline(); !ok {
+						return errors.New("no deadline")
+					}
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+			"hook 0: ",
+			[]string{"ERROR"},
+		},
+		{
+			"hanging hook is abandoned",
+			50 * time.Millisecond,
+			[]func(ctx context.Context) error{
+				func(context.Context) error { select {} },
+				func(ctx context.Context) error { return ctx.Err() },
+			},
+			"hook 0: abandoned: context deadline exceeded",
+			[]string{"ERROR", "ERROR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			lc := newLifecycle(slog.New(slog.NewJSONHandler(logs, nil)))
+			called := make([]bool, len(tt.hooks))
+			var mu sync.Mutex
+			for i, fn := range tt.hooks {
+				lc.OnShutdown(shutdownFlush, "hook "+string(rune('0'+i)), func(ctx context.Context) error {
+					mu.Lock()
+					called[i] = true
+					mu.Unlock()
+					return fn(ctx)
+				})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			start := time.Now()
+			err := lc.Shutdown(ctx)
+			if elapsed := time.Since(start); elapsed > tt.timeout+time.Second {
+				t.Errorf("Shutdown took %s with a %s deadline", elapsed, tt.timeout)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Shutdown = %v, want %q", err, tt.wantErr)
+			}
+			// Hooks after the deadline still start, though nothing waits
+			// for them.
+			waitFor(t, "every hook to start", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return !slices.Contains(called, false)
+			})
+			var levels []string
+			for _, e := range loggedHooks(t, logs.String()) {
+				levels = append(levels, e["level"].(string))
+			}
+			if strings.Join(levels, ",") != strings.Join(tt.wantLevel, ",") {
+				t.Errorf("logged %v, want %v:\n%s", levels, tt.wantLevel, logs)
+			}
+		})
+	}
+}
+
+func TestServerShutdownRunsHooks(t *testing.T) {
+	s, logs := newTestServer(t, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	ready := func() bool { return serve(s, http.MethodGet, "/readyz", nil).Code == http.StatusOK }
+	waitFor(t, "the server to be ready", ready)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ready() {
+		t.Error("still ready once Run returned")
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	var hooks []string
+	for _, e := range loggedHooks(t, logs.String()) {
+		hooks = append(hooks, e["hook"].(string))
+	}
+	// The HTTP servers are one hook among the others, after the streams
+	// and before the notification workers.
+	streams, drain, workers := slices.Index(hooks, "notification streams"), slices.Index(hooks, "http servers"), slices.Index(hooks, "notification workers")
+	if streams < 0 || drain < streams || workers < drain {
+		t.Errorf("hooks ran as %v", hooks)
+	}
+	if !strings.Contains(logs.String(), `"msg":"Shutdown drain finished"`) {
+		t.Error("the drain was not logged")
+	}
+}
+
+func TestPreStopDelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		signals     []os.Signal
+		wantMin     time.Duration
+		wantMax     time.Duration
+		wantMessage string
+	}{
+		{"no delay", 0, nil, 0, 50 * time.Millisecond, ""},
+		{"full delay", 100 * time.Millisecond, nil, 100 * time.Millisecond, time.Second, "Shutdown delay finished"},
+		{"second SIGTERM", time.Minute, []os.Signal{syscall.SIGTERM}, 0, time.Second, "Shutdown delay cut short"},
+		{"SIGINT", time.Minute, []os.Signal{os.Interrupt}, 0, time.Second, "Shutdown delay cut short"},
+		{"other signals are ignored", 100 * time.Millisecond, []os.Signal{syscall.SIGHUP, syscall.SIGUSR1}, 100 * time.Millisecond, time.Second, "Shutdown delay finished"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			quit := make(chan os.Signal, len(tt.signals))
+			for _, sig := range tt.signals {
+				quit <- sig
+			}
+			start := time.Now()
+			preStopDelay(slog.New(slog.NewJSONHandler(logs, nil)), tt.delay, quit)
+			if elapsed := time.Since(start); elapsed < tt.wantMin || elapsed > tt.wantMax {
+				t.Errorf("waited %s, want %s to %s", elapsed, tt.wantMin, tt.wantMax)
+			}
+			if tt.wantMessage == "" {
+				if logs.String() != "" {
+					t.Errorf("logged %s", logs)
+				}
+				return
+			}
+			out := logs.String()
+			if !strings.Contains(out, `"msg":"Shutdown delay started, still serving"`) || !strings.Contains(out, `"msg":"`+tt.wantMessage+`"`) {
+				t.Errorf("logs lack %q:\n%s", tt.wantMessage, out)
+			}
+		})
+	}
+}
+
+func TestServerServesDuringShutdownDelay(t *testing.T) {
+	s, logs := newTestServer(t, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	get := func(path string) int {
+		resp, err := http.Get(serverURL(t, s, "http", path))
+		if err != nil {
+			t.Fatalf("GET %s during the delay: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitFor(t, "the server to be ready", func() bool { return get("/readyz") == http.StatusOK })
+
+	// SIGTERM stops Run, then the delay keeps serving.
+	cancel()
+	<-done
+	quit := make(chan os.Signal, 1)
+	delayed := make(chan struct{})
+	go func() {
+		preStopDelay(s.logger, time.Minute, quit)
+		close(delayed)
+	}()
+	for range 3 {
+		if status := get("/readyz"); status != http.StatusServiceUnavailable {
+			t.Errorf("/readyz = %d during the delay, want 503", status)
+		}
+		if status := get("/"); status != http.StatusOK {
+			t.Errorf("/ = %d during the delay, want 200", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	quit <- syscall.SIGTERM
+	select {
+	case <-delayed:
+	case <-time.After(time.Second):
+		t.Fatal("a second SIGTERM did not end the delay")
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(serverURL(t, s, "http", "/")); err == nil {
+		t.Error("still serving after Shutdown")
+	}
+	out := logs.String()
+	cut, drained := strings.Index(out, `"msg":"Shutdown delay cut short"`), strings.Index(out, `"msg":"Shutdown drain finished"`)
+	if cut < 0 || drained < cut {
+		t.Errorf("the delay and the drain were not logged in order:\n%s", out)
+	}
+}
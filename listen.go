@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// bindRetryInterval is how often a port in use is tried again.
+const bindRetryInterval = 250 * time.Millisecond
+
+// bindWithRetry calls listen until it succeeds, fails for another reason
+// than addr being in use, or retryFor has passed, so that a new instance
+// can start while the previous one is still draining during a deploy.
+func bindWithRetry(logger *slog.Logger, name, addr string, retryFor time.Duration, listen func() (net.Listener, error)) (net.Listener, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		ln, err := listen()
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return ln, err
+		}
+		if time.Since(start) >= retryFor {
+			return nil, newAddrInUseError(addr, retryFor, err)
+		}
+		if attempt == 1 {
+			logger.Warn("Port is in use, retrying",
+				slog.String("listener", name),
+				slog.String("addr", addr),
+				slog.Duration("retry_for", retryFor),
+			)
+		}
+		time.Sleep(bindRetryInterval)
+	}
+}
+
+// addrInUseError is a bind error for an address in use, explained with the
+// port rather than the raw syscall error, which it wraps.
+type addrInUseError struct {
+	port    string
+	retried time.Duration
+	err     error
+}
+
+func newAddrInUseError(addr string, retried time.Duration, err error) *addrInUseError {
+	_, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		port = addr
+	}
+	return &addrInUseError{port: port, retried: retried, err: err}
+}
+
+func (e *addrInUseError) Error() string {
+	if e.retried > 0 {
+		return fmt.Sprintf("port %s is already in use by another process, still after %s", e.port, e.retried)
+	}
+	return fmt.Sprintf("port %s is already in use by another process", e.port)
+}
+
+func (e *addrInUseError) Unwrap() error {
+	return e.err
+}
+
+// listenError adds the address to a bind error that does not already
+// explain itself.
+func listenError(addr string, err error) error {
+	var inUse *addrInUseError
+	if errors.As(err, &inUse) {
+		return err
+	}
+	return fmt.Errorf("listen on %s: %w", addr, err)
+}
+
+// writePortFile writes addr to path through a temporary file, so that a
+// reader polling for it never sees it half written.
+func writePortFile(path, addr string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(addr+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func listen(cfg *Config) (net.Listener, error) {
+	network, address := cfg.Listen()
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(address, fs.FileMode(cfg.SocketMode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod %s: %w", address, err)
+	}
+
+	return ln, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func removeSocket(cfg *Config) error {
+	network, address := cfg.Listen()
+	if network != "unix" {
+		return nil
+	}
+	if err := os.Remove(address); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// connCounter follows the state of every connection of a server through
+// its ConnState callback: how many are open, and of those how many are new,
+// active or idle, plus how many were accepted and closed overall.
+type connCounter struct {
+	open     atomic.Int64
+	new      atomic.Int64
+	active   atomic.Int64
+	idle     atomic.Int64
+	accepted atomic.Int64
+	closed   atomic.Int64
+
+	// states holds the last state of each open connection, so that it can
+	// be taken off its gauge on the next change.
+	states sync.Map
+}
+
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	if prev, ok := c.states.Load(conn); ok {
+		if g := c.gauge(prev.(http.ConnState)); g != nil {
+			g.Add(-1)
+		}
+	}
+
+	switch state {
+	case http.StateNew:
+		c.open.Add(1)
+		c.accepted.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		c.open.Add(-1)
+		c.closed.Add(1)
+		c.states.Delete(conn)
+		return
+	}
+	c.states.Store(conn, state)
+	c.gauge(state).Add(1)
+}
+
+func (c *connCounter) gauge(state http.ConnState) *atomic.Int64 {
+	switch state {
+	case http.StateNew:
+		return &c.new
+	case http.StateActive:
+		return &c.active
+	case http.StateIdle:
+		return &c.idle
+	}
+	return nil
+}
+
+func (c *connCounter) Open() int64 {
+	return c.open.Load()
+}
+
+// limitListener caps the connections open at once at max: Accept waits for
+// one to close before taking the next, so the excess queues in the kernel
+// backlog rather than reaching the handlers. Hijacked connections, such as
+// WebSockets, count until they are closed.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+	// waits counts the accepts that found every slot taken.
+	waits atomic.Int64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newLimitListener(ln net.Listener, max int) *limitListener {
+	return &limitListener{Listener: ln, slots: make(chan struct{}, max), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		l.waits.Add(1)
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Close also wakes an Accept waiting for a slot.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Max is the number of connections allowed at once.
+func (l *limitListener) Max() int {
+	return cap(l.slots)
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		dials int
+	}{
+		{"one at a time", 1, 4},
+		{"two at a time", 2, 6},
+		{"limit above the load", 8, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln := newLimitListener(inner, tt.max)
+			defer ln.Close()
+
+			// Every accepted connection is held open until release says so.
+			var mu sync.Mutex
+			open, peak := 0, 0
+			release := make(chan struct{})
+			accepted := make(chan struct{}, tt.dials)
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					open++
+					peak = max(peak, open)
+					mu.Unlock()
+					accepted <- struct{}{}
+					go func() {
+						<-release
+						mu.Lock()
+						open--
+						mu.Unlock()
+						conn.Close()
+					}()
+				}
+			}()
+
+			var wg sync.WaitGroup
+			for range tt.dials {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn, err := net.Dial("tcp", inner.Addr().String())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					t.Cleanup(func() { conn.Close() })
+				}()
+			}
+			wg.Wait()
+
+			want := min(tt.max, tt.dials)
+			for range want {
+				<-accepted
+			}
+			select {
+			case <-accepted:
+				t.Fatalf("accepted more than %d connections at once", want)
+			case <-time.After(50 * time.Millisecond):
+			}
+			// Each connection closed lets one queued connection in.
+			for range tt.dials - want {
+				release <- struct{}{}
+				select {
+				case <-accepted:
+				case <-time.After(time.Second):
+					t.Fatal("a queued connection was not accepted after one closed")
+				}
+			}
+			close(release)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if peak > tt.max {
+				t.Errorf("%d connections were open at once, want at most %d", peak, tt.max)
+			}
+			if wantWaits := tt.dials > tt.max; (ln.waits.Load() > 0) != wantWaits {
+				t.Errorf("waits = %d, want waits %t", ln.waits.Load(), wantWaits)
+			}
+		})
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 1)
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only slot is taken, so Accept waits until Close wakes it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wake the waiting Accept")
+	}
+}
+
+func TestConnCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []http.ConnState
+		want   [6]int64 // open, new, active, idle, accepted, closed
+	}{
+		{"new", []http.ConnState{http.StateNew}, [6]int64{1, 1, 0, 0, 1, 0}},
+		{"serving", []http.ConnState{http.StateNew, http.StateActive}, [6]int64{1, 0, 1, 0, 1, 0}},
+		{"keep-alive", []http.ConnState{http.StateNew, http.StateActive, http.StateIdle}, [6]int64{1, 0, 0, 1, 1, 0}},
+		{"reused", []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateActive}, [6]int64{1, 0, 1, 0, 1, 0}},
+		{"closed", []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateClosed}, [6]int64{0, 0, 0, 0, 1, 1}},
+		{"hijacked", []http.ConnState{http.StateNew, http.StateActive, http.StateHijacked}, [6]int64{0, 0, 0, 0, 1, 1}},
+		{"closed before a request", []http.ConnState{http.StateNew, http.StateClosed}, [6]int64{0, 0, 0, 0, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c connCounter
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			for _, state := range tt.states {
+				c.track(server, state)
+			}
+			got := [6]int64{c.open.Load(), c.new.Load(), c.active.Load(), c.idle.Load(), c.accepted.Load(), c.closed.Load()}
+			if got != tt.want {
+				t.Errorf("open, new, active, idle, accepted, closed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// keepAlive sends a keep-alive GET / on conn and reads the response.
+func keepAlive(conn net.Conn, br *bufio.Reader) error {
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s, _ := startTestServer(t, func(cfg *Config) { cfg.IdleTimeout = 100 * time.Millisecond })
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if err := keepAlive(conn, br); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the connection to be idle", func() bool {
+		return strings.Contains(serve(s, http.MethodGet, "/metrics", nil).Body.String(), "\nhttp_connections{state=\"idle\"} 1\n")
+	})
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("read = %v, want the server to close the idle connection", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("closed after %s, want about the idle timeout", elapsed)
+	}
+	waitFor(t, "the connection to be counted closed", func() bool {
+		metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+		return strings.Contains(metrics, "\nhttp_connections{state=\"idle\"} 0\n") &&
+			strings.Contains(metrics, "\nhttp_connections_closed_total 1\n")
+	})
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	s, _ := startTestServer(t, func(cfg *Config) { cfg.MaxConnections = 1 })
+	first, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keepAlive(first, bufio.NewReader(first)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle first connection holds the only slot.
+	second, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	answered := make(chan error, 1)
+	go func() { answered <- keepAlive(second, bufio.NewReader(second)) }()
+	select {
+	case <-answered:
+		t.Fatal("a second connection was served past MAX_CONNECTIONS=1")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case err := <-answered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second connection was not served once the first closed")
+	}
+	// The accept loop waits again after every connection it takes, so
+	// only whether it waited is certain.
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	if !strings.Contains(metrics, "\nhttp_connections_limit 1\n") || strings.Contains(metrics, "\nhttp_connections_limit_waits_total 0\n") {
+		t.Errorf("metrics show no wait for the limit:\n%s", metrics)
+	}
+}
+
+func TestBindWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retryFor time.Duration
+		release  time.Duration // when the holder lets go, 0 for never
+		wantErr  string
+	}{
+		{"no retry", 0, 0, "port %s is already in use by another process"},
+		{"gives up", 300 * time.Millisecond, 0, "port %s is already in use by another process, still after 300ms"},
+		{"freed while retrying", 5 * time.Second, 200 * time.Millisecond, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			held, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := held.Addr().String()
+			_, port, _ := net.SplitHostPort(addr)
+			if tt.release > 0 {
+				time.AfterFunc(tt.release, func() { held.Close() })
+			} else {
+				defer held.Close()
+			}
+
+			logs := &logBuffer{}
+			start := time.Now()
+			ln, err := bindWithRetry(slog.New(slog.NewJSONHandler(logs, nil)), "main", addr, tt.retryFor, func() (net.Listener, error) {
+				return net.Listen("tcp", addr)
+			})
+			elapsed := time.Since(start)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("bindWithRetry = %v, want the port once it is freed", err)
+				}
+				ln.Close()
+			} else {
+				want := fmt.Sprintf(tt.wantErr, port)
+				if err == nil || err.Error() != want {
+					t.Fatalf("bindWithRetry = %v, want %q", err, want)
+				}
+				if !errors.Is(err, syscall.EADDRINUSE) {
+					t.Errorf("%v does not wrap EADDRINUSE", err)
+				}
+			}
+			if elapsed < tt.retryFor && tt.release == 0 {
+				t.Errorf("gave up after %s, want %s", elapsed, tt.retryFor)
+			}
+			if retried := strings.Contains(logs.String(), `"msg":"Port is in use, retrying"`); retried != (tt.retryFor > 0) {
+				t.Errorf("retry logged %t, want %t:\n%s", retried, tt.retryFor > 0, logs)
+			}
+		})
+	}
+}
+
+func TestBindWithRetryOtherError(t *testing.T) {
+	calls := 0
+	refused := errors.New("permission denied")
+	_, err := bindWithRetry(slog.New(slog.DiscardHandler), "main", ":80", time.Minute, func() (net.Listener, error) {
+		calls++
+		return nil, refused
+	})
+	if !errors.Is(err, refused) || calls != 1 {
+		t.Errorf("bindWithRetry = %v after %d calls, want the error at once", err, calls)
+	}
+	if err := listenError(":80", err); err.Error() != "listen on :80: permission denied" {
+		t.Errorf("listenError = %q", err)
+	}
+}
+
+func TestServerPortInUse(t *testing.T) {
+	held, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	_, port, _ := net.SplitHostPort(held.Addr().String())
+
+	s, _ := newTestServer(t, func(cfg *Config) { cfg.Port = port })
+	err = s.Listen()
+	if want := "port " + port + " is already in use by another process"; err == nil || err.Error() != want {
+		t.Fatalf("Listen = %v, want %q", err, want)
+	}
+	// Run reports the same error rather than exiting.
+	s, _ = newTestServer(t, func(cfg *Config) { cfg.Port = port })
+	if err := s.Run(context.Background()); err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Run = %v, want the bind error", err)
+	}
+}
+
+func TestWritePortFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    func(dir string) string
+		wantErr bool
+	}{
+		{"new file", func(dir string) string { return filepath.Join(dir, "port") }, false},
+		{"replaces an old one", func(dir string) string {
+			path := filepath.Join(dir, "port")
+			os.WriteFile(path, []byte("127.0.0.1:1\n"), 0o644)
+			return path
+		}, false},
+		{"missing directory", func(dir string) string { return filepath.Join(dir, "missing", "port") }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := tt.path(dir)
+			err := writePortFile(path, "127.0.0.1:4242")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writePortFile = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _ := os.ReadFile(path); string(got) != "127.0.0.1:4242\n" {
+				t.Errorf("port file = %q", got)
+			}
+			if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("the temporary file was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerPortZero(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+	s, logs := newTestServer(t, func(cfg *Config) { cfg.PortFile = portFile })
+	if s.Addr() != "" {
+		t.Errorf("Addr = %q before Listen, want empty", s.Addr())
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	addr := s.Addr()
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "0" {
+		t.Fatalf("Addr = %q, want the port the system picked", addr)
+	}
+	if got, _ := os.ReadFile(portFile); string(got) != addr+"\n" {
+		t.Errorf("PORT_FILE = %q, want %q", got, addr)
+	}
+	resp, err := http.Get(serverURL(t, s, "http", "/healthz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var health struct {
+		Addr string `json:"addr"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil || health.Addr != addr {
+		t.Errorf("/healthz addr = %q (%v), want %q", health.Addr, err, addr)
+	}
+	waitFor(t, "the start to be logged", func() bool {
+		return strings.Contains(logs.String(), `"msg":"Starting server","addr":"`+addr+`"`)
+	})
+	http.DefaultClient.CloseIdleConnections()
+
+	cancel()
+	<-done
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := os.Stat(portFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("PORT_FILE is still there after Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+type loggerKey struct{}
+
+// ContextLogger stores a child of logger carrying the request ID, method,
+// path and client address in the request context, so that every line logged
+// while serving the request can be correlated. It must run inside RequestID
+// and RealIP.
+func ContextLogger(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := logger.With(requestLogAttrs(r)...)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
+
+// LoggerFromContext returns the logger stored by ContextLogger, or the
+// default logger outside of a request.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func requestLogAttrs(r *http.Request) []any {
+	return []any{
+		slog.String("request_id", RequestIDFromContext(r.Context())),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("remote_addr", remoteAddr(r)),
+	}
+}
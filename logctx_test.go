@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestContextLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		forIP    string
+	}{
+		{"generated ID", "", ""},
+		{"incoming ID", "req-42", ""},
+		{"forwarded client", "req-43", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			trusted := IPNets{netip.MustParsePrefix("10.0.0.0/8")}
+			h := RequestID(RealIP(trusted, ContextLogger(logger, RequestLogger(logger, defaultLogRules,
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					LoggerFromContext(r.Context()).Info("handler line", "chat", "1@c.us")
+				})))))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/lastIncomingMessages", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			if tt.forIP != "" {
+				req.Header.Set("X-Forwarded-For", tt.forIP)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(requestIDHeader)
+			wantIP := req.RemoteAddr
+			if tt.forIP != "" {
+				wantIP = tt.forIP
+			}
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("want the handler line and the access log line, got:\n%s", logs)
+			}
+			for _, line := range lines {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry["request_id"] != id || id == "" {
+					t.Errorf("%s: request_id = %v, want %q", entry["msg"], entry["request_id"], id)
+				}
+				if entry["method"] != http.MethodGet || entry["path"] != "/api/lastIncomingMessages" || entry["remote_addr"] != wantIP {
+					t.Errorf("%s: method, path, remote_addr = %v, %v, %v", entry["msg"], entry["method"], entry["path"], entry["remote_addr"])
+				}
+			}
+			// The fields are not repeated in the access log line.
+			if n := strings.Count(lines[1], `"request_id"`); n != 1 {
+				t.Errorf("request_id appears %d times:\n%s", n, lines[1])
+			}
+		})
+	}
+}
+
+func TestLoggerFromContextDefault(t *testing.T) {
+	if LoggerFromContext(context.Background()) != slog.Default() {
+		t.Error("outside of a request LoggerFromContext is not slog.Default()")
+	}
+}
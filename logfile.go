@@ -0,0 +1,241 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file that is rotated once it grows past maxSize.
+// Rotated files are renamed to name-<time>.ext, optionally gzipped, and
+// removed once there are more than maxBackups of them or they are older
+// than maxAge. If the file cannot be written or reopened, output falls back
+// to stderr until the next successful Reopen.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	cleaning sync.WaitGroup
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil && f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.fallback("could not rotate log file", err)
+		}
+	}
+	if f.file == nil {
+		return os.Stderr.Write(p)
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		f.fallback("could not write log file", err)
+		return os.Stderr.Write(p)
+	}
+	return n, nil
+}
+
+// Reopen closes and reopens the file at path, for use after an external
+// tool such as logrotate has moved it away.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := f.open(); err != nil {
+		f.fallback("could not reopen log file", err)
+		return err
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cleaning.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + time.Now().UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.cleaning.Add(1)
+	go func() {
+		defer f.cleaning.Done()
+		f.cleanup(backup)
+	}()
+	return nil
+}
+
+// cleanup compresses the fresh backup and removes backups beyond the limits.
+// Problems are reported on stderr since the log itself may be what fails.
+func (f *rotatingFile) cleanup(backup string) {
+	if f.compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation: could not compress %s: %v\n", backup, err)
+		}
+	}
+
+	ext := filepath.Ext(f.path)
+	pattern := strings.TrimSuffix(f.path, ext) + "-*" + ext + "*"
+	backups, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	// Timestamps in the names sort chronologically; newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, name := range backups {
+		expired := false
+		if f.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+		if (f.maxBackups > 0 && i >= f.maxBackups) || expired {
+			if err := os.Remove(name); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotation: could not remove %s: %v\n", name, err)
+			}
+		}
+	}
+}
+
+func (f *rotatingFile) fallback(msg string, err error) {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %s %s: %v; logging to stderr\n", msg, f.path, err)
+}
+
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// mirrorHandler passes every record to primary and errors also to mirror,
+// so fatal problems stay visible on stderr when logging to a file.
+type mirrorHandler struct {
+	primary slog.Handler
+	mirror  slog.Handler
+}
+
+func (h mirrorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.primary.Enabled(ctx, level) || level >= slog.LevelError
+}
+
+func (h mirrorHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		h.mirror.Handle(ctx, r.Clone())
+	}
+	if !h.primary.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.primary.Handle(ctx, r)
+}
+
+func (h mirrorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return mirrorHandler{primary: h.primary.WithAttrs(attrs), mirror: h.mirror.WithAttrs(attrs)}
+}
+
+func (h mirrorHandler) WithGroup(name string) slog.Handler {
+	return mirrorHandler{primary: h.primary.WithGroup(name), mirror: h.mirror.WithGroup(name)}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+	logFormatDev  = "dev"
+)
+
+// defaultLogFormat is text on a terminal and JSON otherwise.
+func defaultLogFormat(w io.Writer) string {
+	f, ok := w.(*os.File)
+	if !ok {
+		return logFormatJSON
+	}
+	info, err := f.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return logFormatText
+	}
+	return logFormatJSON
+}
+
+func newLogHandler(format string, w io.Writer, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case logFormatText:
+		return slog.NewTextHandler(w, opts)
+	case logFormatDev:
+		return &devHandler{mu: &sync.Mutex{}, w: w, level: level}
+	default:
+		return slog.NewJSONHandler(w, opts)
+	}
+}
+
+var devLevelColors = map[slog.Level]string{
+	slog.LevelDebug: "\x1b[90mDBG\x1b[0m",
+	slog.LevelInfo:  "\x1b[32mINF\x1b[0m",
+	slog.LevelWarn:  "\x1b[33mWRN\x1b[0m",
+	slog.LevelError: "\x1b[31mERR\x1b[0m",
+}
+
+// devHandler writes compact, colorized lines for local development:
+// "15:04:05.000 INF message key=value group.key=value".
+type devHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  []byte
+	prefix string
+}
+
+func (h *devHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *devHandler) Handle(_ context.Context, r slog.Record) error {
+	b := make([]byte, 0, 256)
+	if !r.Time.IsZero() {
+		b = r.Time.AppendFormat(b, time.TimeOnly+".000")
+		b = append(b, ' ')
+	}
+
+	if color, ok := devLevelColors[r.Level]; ok {
+		b = append(b, color...)
+	} else {
+		b = append(b, r.Level.String()...)
+	}
+	b = append(b, ' ')
+	b = append(b, r.Message...)
+	b = append(b, h.attrs...)
+
+	r.Attrs(func(a slog.Attr) bool {
+		b = appendDevAttr(b, h.prefix, a)
+		return true
+	})
+	b = append(b, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(b)
+	return err
+}
+
+func (h *devHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append([]byte(nil), h.attrs...)
+	for _, a := range attrs {
+		next.attrs = appendDevAttr(next.attrs, h.prefix, a)
+	}
+	return &next
+}
+
+func (h *devHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	next := *h
+	next.prefix = h.prefix + name + "."
+	return &next
+}
+
+func appendDevAttr(b []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return b
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			b = appendDevAttr(b, prefix, ga)
+		}
+		return b
+	}
+
+	b = append(b, ' ')
+	b = append(b, prefix...)
+	b = append(b, a.Key...)
+	b = append(b, '=')
+
+	s := a.Value.String()
+	if s == "" || needsQuoting(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+func needsQuoting(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == '=' || c > '~' {
+			return true
+		}
+	}
+	return false
+}
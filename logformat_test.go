@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormatsKeepRequestFields(t *testing.T) {
+	tests := []struct {
+		format string
+		// want are the fields as each format writes them.
+		want []string
+	}{
+		{logFormatJSON, []string{
+			`"msg":"HTTP Request"`, `"level":"INFO"`, `"method":"POST"`, `"path":"/api/sendMessage"`,
+			`"remote_addr":"192.0.2.1:1234"`, `"proto":"HTTP/1.1"`, `"status":201`, `"bytes":7`,
+			`"user_agent":"curl/8.0"`, `"query":"a=1"`, `"content_type":"application/json"`, `"duration":`,
+		}},
+		{logFormatText, []string{
+			`msg="HTTP Request"`, `level=INFO`, `method=POST`, `path=/api/sendMessage`,
+			`remote_addr=192.0.2.1:1234`, `proto=HTTP/1.1`, `status=201`, `bytes=7`,
+			`user_agent=curl/8.0`, `query="a=1"`, `content_type=application/json`, `duration=`,
+		}},
+		{logFormatDev, []string{
+			"HTTP Request", "\x1b[32mINF\x1b[0m", ` method=POST`, ` path=/api/sendMessage`,
+			` remote_addr=192.0.2.1:1234`, ` proto=HTTP/1.1`, ` status=201`, ` bytes=7`,
+			` user_agent=curl/8.0`, ` query="a=1"`, ` content_type=application/json`, ` duration=`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := slog.New(newLogHandler(tt.format, &out, slog.LevelInfo))
+			h := RequestLogger(logger, defaultLogRules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, `{"x":1}`)
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/api/sendMessage?a=1", strings.NewReader("{}"))
+			req.Header.Set("User-Agent", "curl/8.0")
+			req.Header.Set("Content-Type", "application/json")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			line := out.String()
+			for _, want := range tt.want {
+				if !strings.Contains(line, want) {
+					t.Errorf("missing %q in %q", want, line)
+				}
+			}
+		})
+	}
+}
+
+func TestDevHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(*slog.Logger)
+		want string
+	}{
+		{
+			name: "levels",
+			log:  func(l *slog.Logger) { l.Warn("careful") },
+			want: "\x1b[33mWRN\x1b[0m careful\n",
+		},
+		{
+			name: "quoting",
+			log:  func(l *slog.Logger) { l.Info("m", "empty", "", "space", "a b", "plain", "ab", "eq", "a=b") },
+			want: "\x1b[32mINF\x1b[0m m empty=\"\" space=\"a b\" plain=ab eq=\"a=b\"\n",
+		},
+		{
+			name: "groups and attrs",
+			log: func(l *slog.Logger) {
+				l.With("request_id", "r1").WithGroup("tls").Info("m", "version", "TLS 1.3", slog.Group("peer", "cn", "client"))
+			},
+			want: "\x1b[32mINF\x1b[0m m request_id=r1 tls.version=\"TLS 1.3\" tls.peer.cn=client\n",
+		},
+		{
+			name: "below the level",
+			log:  func(l *slog.Logger) { l.Debug("hidden") },
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			// Without the time attribute the line starts at the level.
+			h := newLogHandler(logFormatDev, &out, slog.LevelInfo)
+			tt.log(slog.New(noTimeHandler{h}))
+			if out.String() != tt.want {
+				t.Errorf("got  %q\nwant %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDevHandlerTime(t *testing.T) {
+	var out bytes.Buffer
+	h := newLogHandler(logFormatDev, &out, slog.LevelInfo)
+	r := slog.NewRecord(time.Date(2024, 3, 5, 14, 7, 9, 123e6, time.UTC), slog.LevelInfo, "m", 0)
+	if err := h.Handle(t.Context(), r); err != nil {
+		t.Fatal(err)
+	}
+	if want := "14:07:09.123 \x1b[32mINF\x1b[0m m\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestDefaultLogFormat(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tests := []struct {
+		name string
+		w    io.Writer
+		want string
+	}{
+		{"buffer", &bytes.Buffer{}, logFormatJSON},
+		{"regular file", file, logFormatJSON},
+	}
+	for _, tt := range tests {
+		if got := defaultLogFormat(tt.w); got != tt.want {
+			t.Errorf("%s: defaultLogFormat = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigLogFormat(t *testing.T) {
+	for _, format := range []string{"", logFormatJSON, logFormatText, logFormatDev, "yaml"} {
+		cfg := newTestConfig(t)
+		cfg.StaticDir = t.TempDir()
+		cfg.LogFormat = format
+		err := cfg.validate()
+		if wantErr := format == "yaml"; wantErr != (err != nil) {
+			t.Errorf("LOG_FORMAT=%q: validate = %v", format, err)
+		}
+	}
+}
+
+// noTimeHandler drops the time of records, so that lines can be compared
+// as a whole.
+type noTimeHandler struct{ slog.Handler }
+
+func (h noTimeHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.Time = time.Time{}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h noTimeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return noTimeHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h noTimeHandler) WithGroup(name string) slog.Handler {
+	return noTimeHandler{h.Handler.WithGroup(name)}
+}
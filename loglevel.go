@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// toggleLogLevel switches between debug and the configured level.
+func toggleLogLevel(logger *slog.Logger, level *slog.LevelVar, configured slog.Level) {
+	next := slog.LevelDebug
+	if level.Level() == slog.LevelDebug {
+		next = configured
+		if configured == slog.LevelDebug {
+			next = slog.LevelInfo
+		}
+	}
+	setLogLevel(logger, level, next)
+}
+
+// setLogLevel changes the level and logs the change at a level that still
+// gets through.
+func setLogLevel(logger *slog.Logger, level *slog.LevelVar, next slog.Level) {
+	previous := level.Level()
+	level.Set(next)
+
+	logger.Log(context.Background(), max(next, slog.LevelInfo), "Log level changed",
+		slog.String("level", next.String()),
+		slog.String("previous", previous.String()),
+	)
+}
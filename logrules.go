@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pathMatcher matches URL paths against prefixes and, for entries written as
+// "=/path", exact paths. A lookup costs one map access per distinct prefix
+// length, however many entries there are.
+type pathMatcher struct {
+	exact    map[string]bool
+	prefixes map[string]bool
+	lengths  []int
+}
+
+func newPathMatcher(entries []string) pathMatcher {
+	m := pathMatcher{exact: make(map[string]bool), prefixes: make(map[string]bool)}
+	seen := make(map[int]bool)
+	for _, entry := range entries {
+		if path, ok := strings.CutPrefix(entry, "="); ok {
+			m.exact[path] = true
+			continue
+		}
+		m.prefixes[entry] = true
+		if !seen[len(entry)] {
+			seen[len(entry)] = true
+			m.lengths = append(m.lengths, len(entry))
+		}
+	}
+	sort.Ints(m.lengths)
+	return m
+}
+
+func (m pathMatcher) match(urlPath string) bool {
+	if m.exact[urlPath] {
+		return true
+	}
+	for _, n := range m.lengths {
+		if n > len(urlPath) {
+			break
+		}
+		if m.prefixes[urlPath[:n]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ACCESS_LOG_MODE values.
+const (
+	accessLogModeAll    = "all"
+	accessLogModeErrors = "errors"
+	accessLogModeNone   = "none"
+)
+
+// accessLogModeVar is ACCESS_LOG_MODE as it is now. Like slog.LevelVar for
+// the log level, it is changed through /admin/ and SIGHUP while requests
+// read it; a nil one is accessLogModeAll.
+type accessLogModeVar struct {
+	v atomic.Pointer[string]
+}
+
+func newAccessLogModeVar(mode string) *accessLogModeVar {
+	m := new(accessLogModeVar)
+	m.Set(mode)
+	return m
+}
+
+func (m *accessLogModeVar) Load() string {
+	if m == nil {
+		return accessLogModeAll
+	}
+	return *m.v.Load()
+}
+
+func (m *accessLogModeVar) Set(mode string) {
+	m.v.Store(&mode)
+}
+
+// logRules decide whether and at which level a request is logged.
+type logRules struct {
+	skip         pathMatcher
+	debug        pathMatcher
+	alwaysErrors bool
+
+	// slowThreshold and writeTimeout escalate long requests to warn level;
+	// zero disables the check.
+	slowThreshold time.Duration
+	writeTimeout  time.Duration
+
+	// sampler thins out successful requests; nil logs all of them.
+	sampler *logSampler
+
+	// stats is fed every request, logged or not; nil collects nothing.
+	stats *requestStats
+
+	// mode leaves out all requests or those without problems; the request
+	// is still timed and reaches stats either way.
+	mode *accessLogModeVar
+
+	// redact holds the lower-cased query parameter names whose values are
+	// hidden in the log.
+	redact map[string]bool
+}
+
+// defaultLogRules logs health probes at debug level and everything else at
+// info; they are used for the auxiliary servers.
+var defaultLogRules = newLogRules(nil, []string{"=/healthz", "=/readyz"}, true)
+
+// defaultRedactParams matches the LOG_REDACT_PARAMS default.
+var defaultRedactParams = []string{"token", "apiTokenInstance", "password", "authorization"}
+
+func newLogRules(skip, debug []string, alwaysErrors bool) *logRules {
+	l := &logRules{
+		skip:         newPathMatcher(skip),
+		debug:        newPathMatcher(debug),
+		alwaysErrors: alwaysErrors,
+	}
+	l.setRedactParams(defaultRedactParams)
+	return l
+}
+
+func (l *logRules) setRedactParams(names []string) {
+	l.redact = make(map[string]bool, len(names))
+	for _, name := range names {
+		l.redact[strings.ToLower(name)] = true
+	}
+}
+
+const redacted = "[REDACTED]"
+
+// query returns rawQuery with the values of redacted parameters replaced.
+// Everything else is kept as sent, so the result stays a valid query string.
+func (l *logRules) query(rawQuery string) string {
+	if rawQuery == "" || len(l.redact) == 0 {
+		return rawQuery
+	}
+
+	var b strings.Builder
+	for i, pair := range strings.Split(rawQuery, "&") {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		key, _, hasValue := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if !l.redact[strings.ToLower(name)] {
+			b.WriteString(pair)
+			continue
+		}
+		b.WriteString(key)
+		if hasValue {
+			b.WriteString("=" + redacted)
+		}
+	}
+	return b.String()
+}
+
+// classify marks slow and timed out requests. A request its client gave up
+// on gets statusClientClosedRequest, unless it ran into its write deadline:
+// then the server cut it off, not the client. The deadline is WRITE_TIMEOUT
+// unless the handler moved it with setWriteDeadline; a moved one, which a
+// stream may leave behind between writes, only counts when a write failed
+// after it. A hijacked connection is out of its reach.
+func (l *logRules) classify(e *accessEntry) {
+	e.slow = l.slowThreshold > 0 && e.duration >= l.slowThreshold
+	switch {
+	case e.status == http.StatusSwitchingProtocols:
+		e.writeTimeout = false
+	case !e.writeDeadline.IsZero():
+		e.writeTimeout = e.writeFailed && !e.start.Add(e.duration).Before(e.writeDeadline)
+	default:
+		e.writeTimeout = l.writeTimeout > 0 && e.duration >= l.writeTimeout
+	}
+	if e.writeTimeout {
+		e.clientAborted, e.writtenStatus = false, 0
+	}
+	if e.clientAborted {
+		e.status = statusClientClosedRequest
+	}
+}
+
+// level reports the level for a request passed through classify, or false
+// when it is not logged. In the errors mode only the requests logged at warn
+// level and error responses are left. Slow, timed out and aborted requests,
+// and those with a response conflict, are logged at warn level, even on
+// debug paths. With alwaysErrors, they and
+// error responses are logged on skipped paths too. Only successful requests
+// without problems are sampled.
+func (l *logRules) level(urlPath string, e *accessEntry) (slog.Level, bool) {
+	problem := e.slow || e.writeTimeout || e.clientAborted || e.responseConflict || e.handlerAborted
+
+	switch l.mode.Load() {
+	case accessLogModeNone:
+		return 0, false
+	case accessLogModeErrors:
+		if !problem && e.status < http.StatusBadRequest {
+			return 0, false
+		}
+	}
+
+	level := slog.LevelInfo
+	if problem {
+		level = slog.LevelWarn
+	}
+	if l.alwaysErrors && (problem || e.status >= http.StatusBadRequest) {
+		return level, true
+	}
+	if l.skip.match(urlPath) {
+		return 0, false
+	}
+	if problem || e.status >= http.StatusBadRequest {
+		return level, true
+	}
+
+	if l.sampler != nil {
+		var keep bool
+		keep, e.sampleRate = l.sampler.sample(urlPath)
+		if !keep {
+			return 0, false
+		}
+	}
+	if l.debug.match(urlPath) {
+		return slog.LevelDebug, true
+	}
+	return level, true
+}
+
+// LogSampleRules log only one in N successful requests under a path prefix;
+// the longest matching prefix wins. In the environment pairs are written as
+// "prefix=N" separated by ",", e.g. "/assets/=100,/=10".
+type LogSampleRules map[string]int
+
+func (s *LogSampleRules) UnmarshalText(text []byte) error {
+	rules := make(LogSampleRules)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, rate, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid sample rule %q, want prefix=N", item)
+		}
+		if err := rules.add(prefix, rate); err != nil {
+			return err
+		}
+	}
+	*s = rules
+	return nil
+}
+
+func (s *LogSampleRules) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	rules := make(LogSampleRules, len(raw))
+	for prefix, rate := range raw {
+		if err := rules.add(prefix, rate); err != nil {
+			return err
+		}
+	}
+	*s = rules
+	return nil
+}
+
+func (s LogSampleRules) add(prefix, rate string) error {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid sample rule prefix %q, want /prefix", prefix)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(rate))
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid sample rate %q for %s, want a positive integer", rate, prefix)
+	}
+	s[prefix] = n
+	return nil
+}
+
+func (s LogSampleRules) String() string {
+	items := make([]string, 0, len(s))
+	for prefix, rate := range s {
+		items = append(items, prefix+"="+strconv.Itoa(rate))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+type sampleRule struct {
+	rate  int64
+	count atomic.Int64
+}
+
+// logSampler keeps a lock-free counter per rule; the first request and then
+// every rate-th one after it are logged.
+type logSampler struct {
+	rules   map[string]*sampleRule
+	lengths []int
+}
+
+func newLogSampler(rules LogSampleRules) *logSampler {
+	s := &logSampler{rules: make(map[string]*sampleRule, len(rules))}
+	seen := make(map[int]bool)
+	for prefix, rate := range rules {
+		if rate <= 1 {
+			continue
+		}
+		s.rules[prefix] = &sampleRule{rate: int64(rate)}
+		if !seen[len(prefix)] {
+			seen[len(prefix)] = true
+			s.lengths = append(s.lengths, len(prefix))
+		}
+	}
+	// Longest prefix first.
+	sort.Sort(sort.Reverse(sort.IntSlice(s.lengths)))
+	return s
+}
+
+// sample reports whether a request for urlPath is logged and the rate it
+// was sampled at, 1 when no rule applies.
+func (s *logSampler) sample(urlPath string) (bool, int) {
+	for _, n := range s.lengths {
+		if n > len(urlPath) {
+			continue
+		}
+		rule, ok := s.rules[urlPath[:n]]
+		if !ok {
+			continue
+		}
+		count := rule.count.Add(1)
+		return (count-1)%rule.rate == 0, int(rule.rate)
+	}
+	return true, 1
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPathMatcher(t *testing.T) {
+	m := newPathMatcher([]string{"/assets/", "/metrics", "=/healthz", "/api/v1/"})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/assets/app.js", true},
+		{"/assets/", true},
+		{"/assets", false},
+		{"/metrics", true},
+		{"/metrics/extra", true},
+		{"/healthz", true},
+		{"/healthz/deep", false},
+		{"/health", false},
+		{"/api/v1/sendMessage", true},
+		{"/api/v2/sendMessage", false},
+		{"/", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.path); got != tt.want {
+			t.Errorf("match(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathMatcherEmpty(t *testing.T) {
+	m := newPathMatcher(nil)
+	if m.match("/") || m.match("/anything") {
+		t.Error("an empty matcher matched")
+	}
+}
+
+func TestLogRulesLevel(t *testing.T) {
+	skip := []string{"/metrics", "=/healthz"}
+	debug := []string{"/assets/"}
+
+	tests := []struct {
+		name         string
+		alwaysErrors bool
+		path         string
+		entry        accessEntry
+		wantLevel    slog.Level
+		wantLogged   bool
+	}{
+		{"ordinary request", false, "/api/x", accessEntry{status: 200}, slog.LevelInfo, true},
+		{"skipped prefix", false, "/metrics", accessEntry{status: 200}, 0, false},
+		{"skipped exact", false, "/healthz", accessEntry{status: 200}, 0, false},
+		{"exact does not cover a subpath", false, "/healthz/x", accessEntry{status: 200}, slog.LevelInfo, true},
+		{"debug prefix", false, "/assets/app.js", accessEntry{status: 200}, slog.LevelDebug, true},
+		{"skipped error without alwaysErrors", false, "/metrics", accessEntry{status: 500}, 0, false},
+		{"skipped error with alwaysErrors", true, "/metrics", accessEntry{status: 500}, slog.LevelInfo, true},
+		{"skipped 404 with alwaysErrors", true, "/healthz", accessEntry{status: 404}, slog.LevelInfo, true},
+		{"skipped success with alwaysErrors", true, "/metrics", accessEntry{status: 204}, 0, false},
+		{"debug path error", false, "/assets/app.js", accessEntry{status: 404}, slog.LevelInfo, true},
+		{"redirect is not an error", true, "/metrics", accessEntry{status: 302}, 0, false},
+		{"slow on a debug path", false, "/assets/app.js", accessEntry{status: 200, slow: true}, slog.LevelWarn, true},
+		{"conflict on a skipped path with alwaysErrors", true, "/metrics", accessEntry{status: 200, responseConflict: true}, slog.LevelWarn, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := newLogRules(skip, debug, tt.alwaysErrors)
+			e := tt.entry
+			level, logged := rules.level(tt.path, &e)
+			if logged != tt.wantLogged || logged && level != tt.wantLevel {
+				t.Errorf("level = %v, %t; want %v, %t", level, logged, tt.wantLevel, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerExclusions(t *testing.T) {
+	rules := newLogRules([]string{"/metrics", "=/healthz"}, []string{"/assets/"}, true)
+
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		wantRecord string
+	}{
+		{"excluded health check", "/healthz", http.StatusOK, ""},
+		{"excluded metrics scrape", "/metrics", http.StatusOK, ""},
+		{"excluded path error", "/healthz", http.StatusServiceUnavailable, `"level":"INFO"`},
+		{"excluded prefix error", "/metrics/x", http.StatusInternalServerError, `"level":"INFO"`},
+		{"debug path", "/assets/app.js", http.StatusOK, `"level":"DEBUG"`},
+		{"ordinary path", "/", http.StatusOK, `"level":"INFO"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			h := RequestLogger(logger, rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			out := logs.String()
+			if tt.wantRecord == "" {
+				if out != "" {
+					t.Errorf("an excluded request was logged:\n%s", out)
+				}
+				return
+			}
+			if strings.Count(out, "\n") != 1 || !strings.Contains(out, tt.wantRecord) {
+				t.Errorf("want one record with %s, got:\n%s", tt.wantRecord, out)
+			}
+		})
+	}
+}
+
+func TestSlowRequestEscalation(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		sleep     time.Duration
+		path      string
+		wantLevel string
+		wantSlow  bool
+	}{
+		{"under the threshold", 200 * time.Millisecond, 0, "/api/x", `"level":"INFO"`, false},
+		{"over the threshold", 20 * time.Millisecond, 40 * time.Millisecond, "/api/x", `"level":"WARN"`, true},
+		{"over the threshold on a debug path", 20 * time.Millisecond, 40 * time.Millisecond, "/healthz", `"level":"WARN"`, true},
+		{"disabled", 0, 40 * time.Millisecond, "/api/x", `"level":"INFO"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := newLogRules(nil, []string{"=/healthz"}, true)
+			rules.slowThreshold = tt.threshold
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestLogger(logger, rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.sleep)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			out := logs.String()
+			if !strings.Contains(out, tt.wantLevel) {
+				t.Errorf("want %s, got:\n%s", tt.wantLevel, out)
+			}
+			if got := strings.Contains(out, `"slow":true`); got != tt.wantSlow {
+				t.Errorf("slow = %t, want %t:\n%s", got, tt.wantSlow, out)
+			}
+		})
+	}
+}
+
+func TestLogRulesClassify(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name             string
+		writeTimeout     time.Duration
+		entry            accessEntry
+		wantStatus       int
+		wantWriteTimeout bool
+		wantAborted      bool
+	}{
+		{
+			name:         "within WRITE_TIMEOUT",
+			writeTimeout: time.Second,
+			entry:        accessEntry{start: start, duration: 10 * time.Millisecond, status: 200},
+			wantStatus:   200,
+		},
+		{
+			name:             "past WRITE_TIMEOUT",
+			writeTimeout:     time.Second,
+			entry:            accessEntry{start: start, duration: 2 * time.Second, status: 200},
+			wantStatus:       200,
+			wantWriteTimeout: true,
+		},
+		{
+			name:         "client gone",
+			writeTimeout: time.Second,
+			entry:        accessEntry{start: start, duration: 10 * time.Millisecond, status: 200, clientAborted: true, writtenStatus: 200},
+			wantStatus:   statusClientClosedRequest,
+			wantAborted:  true,
+		},
+		{
+			name:             "cut off by WRITE_TIMEOUT, not the client",
+			writeTimeout:     time.Second,
+			entry:            accessEntry{start: start, duration: 2 * time.Second, status: 200, clientAborted: true, writtenStatus: 200},
+			wantStatus:       200,
+			wantWriteTimeout: true,
+		},
+		{
+			name:         "moved deadline, no failed write",
+			writeTimeout: time.Second,
+			entry:        accessEntry{start: start, duration: 3 * time.Second, status: 200, writeDeadline: start.Add(2 * time.Second)},
+			wantStatus:   200,
+		},
+		{
+			name:             "moved deadline, write failed after it",
+			writeTimeout:     time.Second,
+			entry:            accessEntry{start: start, duration: 3 * time.Second, status: 200, writeDeadline: start.Add(2 * time.Second), writeFailed: true},
+			wantStatus:       200,
+			wantWriteTimeout: true,
+		},
+		{
+			name:         "moved deadline, client gone before it",
+			writeTimeout: time.Second,
+			entry: accessEntry{start: start, duration: 3 * time.Second, status: 200, writeDeadline: start.Add(time.Minute),
+				writeFailed: true, clientAborted: true, writtenStatus: 200},
+			wantStatus:  statusClientClosedRequest,
+			wantAborted: true,
+		},
+		{
+			name:         "hijacked",
+			writeTimeout: time.Second,
+			entry:        accessEntry{start: start, duration: time.Minute, status: http.StatusSwitchingProtocols},
+			wantStatus:   http.StatusSwitchingProtocols,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := newLogRules(nil, nil, true)
+			rules.writeTimeout = tt.writeTimeout
+			e := tt.entry
+			rules.classify(&e)
+			if e.status != tt.wantStatus || e.writeTimeout != tt.wantWriteTimeout || e.clientAborted != tt.wantAborted {
+				t.Errorf("status = %d, write timeout = %t, client aborted = %t; want %d, %t, %t",
+					e.status, e.writeTimeout, e.clientAborted, tt.wantStatus, tt.wantWriteTimeout, tt.wantAborted)
+			}
+			if level, _ := rules.level("/", &e); (tt.wantWriteTimeout || tt.wantAborted) && level != slog.LevelWarn {
+				t.Errorf("level = %v, want WARN", level)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerCanceledContext(t *testing.T) {
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	h := RequestLogger(logger, defaultLogRules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/x", nil))
+
+	out := logs.String()
+	for _, want := range []string{`"level":"WARN"`, `"status":499`, `"client_aborted":true`, `"written_status":200`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	s := newLogSampler(LogSampleRules{"/assets/": 3, "/assets/img/": 2, "/": 1})
+
+	tests := []struct {
+		path     string
+		want     []bool
+		wantRate int
+	}{
+		{"/assets/app.js", []bool{true, false, false, true, false, false, true}, 3},
+		{"/assets/img/a.png", []bool{true, false, true, false}, 2},
+		{"/index.html", []bool{true, true, true}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for i, want := range tt.want {
+				keep, rate := s.sample(tt.path)
+				if keep != want || rate != tt.wantRate {
+					t.Errorf("request %d: sample = %t, %d; want %t, %d", i+1, keep, rate, want, tt.wantRate)
+				}
+			}
+		})
+	}
+}
+
+func TestLogSamplerConcurrent(t *testing.T) {
+	const rate, workers, perWorker = 10, 8, 125
+	s := newLogSampler(LogSampleRules{"/": rate})
+	var kept atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				if keep, _ := s.sample("/x"); keep {
+					kept.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if want := int64(workers * perWorker / rate); kept.Load() != want {
+		t.Errorf("kept %d requests, want exactly %d", kept.Load(), want)
+	}
+}
+
+func TestRequestLoggerSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		slow     bool
+		wantLogs int
+		wantRate bool
+	}{
+		{"successful requests are sampled", http.StatusOK, false, 2, true},
+		{"redirects are sampled", http.StatusNotModified, false, 2, true},
+		{"client errors are all logged", http.StatusNotFound, false, 5, false},
+		{"server errors are all logged", http.StatusBadGateway, false, 5, false},
+		{"slow requests are all logged", http.StatusOK, true, 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := newLogRules(nil, nil, true)
+			rules.sampler = newLogSampler(LogSampleRules{"/assets/": 4})
+			if tt.slow {
+				rules.slowThreshold = time.Nanosecond
+			}
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestLogger(logger, rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(time.Microsecond)
+				w.WriteHeader(tt.status)
+			}))
+			for range 5 {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/app.js", nil))
+			}
+
+			out := logs.String()
+			if n := strings.Count(out, "\n"); n != tt.wantLogs {
+				t.Errorf("logged %d of 5 requests, want %d:\n%s", n, tt.wantLogs, out)
+			}
+			if got := strings.Count(out, `"sample_rate":4`); tt.wantRate && got != tt.wantLogs || !tt.wantRate && got != 0 {
+				t.Errorf("sample_rate on %d records:\n%s", got, out)
+			}
+		})
+	}
+}
+
+func TestLogSampleRulesUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"/assets/=100,/=10", "/=10,/assets/=100", false},
+		{" /a/ = 5 , ", "/a/=5", false},
+		{"", "", false},
+		{"/a/", "", true},
+		{"a/=5", "", true},
+		{"/a/=0", "", true},
+		{"/a/=x", "", true},
+	}
+	for _, tt := range tests {
+		var rules LogSampleRules
+		err := rules.UnmarshalText([]byte(tt.in))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("UnmarshalText(%q) = %v", tt.in, err)
+			continue
+		}
+		if !tt.wantErr && rules.String() != tt.want {
+			t.Errorf("UnmarshalText(%q) = %s, want %s", tt.in, rules, tt.want)
+		}
+	}
+
+	var fromYAML struct {
+		Rules LogSampleRules `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal([]byte("rules:\n  /assets/: 100\n  /: \"10\"\n"), &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	if got := fromYAML.Rules.String(); got != "/=10,/assets/=100" {
+		t.Errorf("from YAML = %s", got)
+	}
+	if err := yaml.Unmarshal([]byte("rules:\n  /assets/: -1\n"), &fromYAML); err == nil {
+		t.Error("a negative rate from YAML was accepted")
+	}
+}
+
+func TestLogRulesQueryRedaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		query  string
+		want   string
+	}{
+		{"no query", nil, "", ""},
+		{"nothing sensitive", nil, "chatId=1&count=10", "chatId=1&count=10"},
+		{"default names", nil, "token=abc&apiTokenInstance=xyz&password=p&authorization=Bearer+t&a=1",
+			"token=[REDACTED]&apiTokenInstance=[REDACTED]&password=[REDACTED]&authorization=[REDACTED]&a=1"},
+		{"repeated", nil, "token=a&x=1&token=b", "token=[REDACTED]&x=1&token=[REDACTED]"},
+		{"case-insensitive", nil, "TOKEN=a&ApiTokenInstance=b", "TOKEN=[REDACTED]&ApiTokenInstance=[REDACTED]"},
+		{"escaped name", nil, "%74oken=a", "%74oken=[REDACTED]"},
+		{"empty value", nil, "token=&a=1", "token=[REDACTED]&a=1"},
+		{"no value", nil, "token&a=1", "token&a=1"},
+		{"custom names", []string{"Secret"}, "secret=s&token=t", "secret=[REDACTED]&token=t"},
+		{"redaction disabled", []string{}, "token=t", "token=t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := newLogRules(nil, nil, true)
+			if tt.params != nil {
+				rules.setRedactParams(tt.params)
+			}
+			if got := rules.query(tt.query); got != tt.want {
+				t.Errorf("query(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerRedactsQuery(t *testing.T) {
+	const rawQuery = "chatId=1&apiTokenInstance=secret&Token=hunter2"
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	var seen string
+	h := RequestLogger(logger, newLogRules(nil, nil, true), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.RawQuery
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/x?"+rawQuery, nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if seen != rawQuery || req.URL.RawQuery != rawQuery {
+		t.Errorf("the handler saw %q and the request keeps %q, want %q", seen, req.URL.RawQuery, rawQuery)
+	}
+	out := logs.String()
+	if !strings.Contains(out, `"query":"chatId=1&apiTokenInstance=[REDACTED]&Token=[REDACTED]"`) {
+		t.Errorf("query not redacted:\n%s", out)
+	}
+	if strings.Contains(out, "secret") || strings.Contains(out, "hunter2") {
+		t.Errorf("a credential reached the log:\n%s", out)
+	}
+}
+
+func TestRequestLoggerModes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			w.WriteHeader(http.StatusMovedPermanently)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(30 * time.Millisecond)
+		case "/abort":
+			io.WriteString(w, "partial")
+			panic(http.ErrAbortHandler)
+		}
+	})
+	paths := []string{"/ok", "/redirect", "/missing", "/fail", "/slow", "/abort"}
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{accessLogModeAll, paths},
+		{accessLogModeErrors, []string{"/missing", "/fail", "/slow", "/abort"}},
+		{accessLogModeNone, nil},
+	}
+	// One logger for every mode: the mode is switched while it runs.
+	mode := newAccessLogModeVar(accessLogModeAll)
+	rules := newLogRules(nil, nil, true)
+	rules.slowThreshold = 15 * time.Millisecond
+	rules.stats = newRequestStats()
+	rules.mode = mode
+	logs := &logBuffer{}
+	h := RequestLogger(slog.New(slog.NewJSONHandler(logs, nil)), rules, handler)
+
+	for i, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			mode.Set(tt.mode)
+			before := len(logs.String())
+			for _, path := range paths {
+				func() {
+					defer func() {
+						if v := recover(); v != nil && v != http.ErrAbortHandler {
+							panic(v)
+						}
+					}()
+					h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+				}()
+			}
+
+			var logged []string
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()[before:]), "\n") {
+				if line == "" {
+					continue
+				}
+				var entry struct{ Path string }
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				logged = append(logged, entry.Path)
+			}
+			if !slices.Equal(logged, tt.want) {
+				t.Errorf("logged %v, want %v", logged, tt.want)
+			}
+			// Every request is still timed and counted.
+			if n := rules.stats.totals().requests; n != int64((i+1)*len(paths)) {
+				t.Errorf("stats counted %d requests, want %d", n, (i+1)*len(paths))
+			}
+		})
+	}
+}
+
+func TestServerAccessLogModeAtRuntime(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	s, logs := newReloadServer(t, map[string]string{"ADMIN_TOKEN": adminToken})
+	// logged reports whether a request for a missing file and one for / were
+	// logged.
+	logged := func() (missing, ok bool) {
+		before := len(logs.String())
+		serve(s, http.MethodGet, "/missing.js", nil)
+		serve(s, http.MethodGet, "/", nil)
+		out := logs.String()[before:]
+		return strings.Contains(out, `"path":"/missing.js"`), strings.Contains(out, `"path":"/"`)
+	}
+	steps := []struct {
+		name   string
+		change func(t *testing.T)
+		want   [2]bool
+	}{
+		{"all at startup", func(t *testing.T) {}, [2]bool{true, true}},
+		{"errors through the admin endpoint", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/admin/accesslog", strings.NewReader(`{"mode":"errors"}`))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("PUT /admin/accesslog = %d %s", rec.Code, rec.Body)
+			}
+		}, [2]bool{true, false}},
+		{"none on reload", func(t *testing.T) {
+			t.Setenv("ACCESS_LOG_MODE", accessLogModeNone)
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+		}, [2]bool{false, false}},
+		{"all again on reload", func(t *testing.T) {
+			t.Setenv("ACCESS_LOG_MODE", accessLogModeAll)
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+		}, [2]bool{true, true}},
+	}
+	for _, step := range steps {
+		step.change(t)
+		if missing, ok := logged(); [2]bool{missing, ok} != step.want {
+			t.Errorf("%s: logged 404 %t, 200 %t; want %v", step.name, missing, ok, step.want)
+		}
+	}
+}
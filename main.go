@@ -3,119 +3,183 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"io"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-type Config struct {
-	Port           string
-	StaticDir      string
-	ReadTimeout    time.Duration
-	WriteTimeout   time.Duration
-	MaxHeaderBytes int
-}
-
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	var logLevel slog.LevelVar
+	logger := slog.New(newLogHandler(defaultLogFormat(os.Stdout), os.Stdout, &logLevel))
 	slog.SetDefault(logger)
 
-	cfg := loadConfig()
-
-	mux := http.NewServeMux()
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if cfg != nil && cfg.Validate != "" {
+		os.Exit(runValidate(context.Background(), os.Stdout, cfg, err))
+	}
+	if err != nil {
+		logger.Error("Invalid configuration", slog.Any("problems", configProblems(err)))
+		os.Exit(1)
+	}
+	logLevel.Set(cfg.LogLevel)
+
+	var logOutput io.Writer = os.Stdout
+	var logFile *rotatingFile
+	if cfg.LogFile != "" {
+		logFile, err = openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize),
+			time.Duration(cfg.LogMaxAgeDays)*24*time.Hour, cfg.LogMaxBackups, cfg.LogCompress)
+		if err != nil {
+			slog.New(newLogHandler(logFormatText, os.Stderr, &logLevel)).Error("Could not open log file",
+				slog.String("file", cfg.LogFile),
+				slog.Any("error", err),
+			)
+			os.Exit(1)
+		}
+		logOutput = logFile
+	}
 
-	fileServer := http.FileServer(http.Dir(cfg.StaticDir))
-	mux.Handle("/", fileServer)
+	logFormat := cfg.LogFormat
+	if logFormat == "" {
+		logFormat = defaultLogFormat(logOutput)
+	}
+	logHandler := newLogHandler(logFormat, logOutput, &logLevel)
+	if logFile != nil {
+		logHandler = mirrorHandler{primary: logHandler, mirror: newLogHandler(logFormatText, os.Stderr, &logLevel)}
+	}
+	if cfg.TracesExporter != tracesExporterNone {
+		logHandler = traceHandler{logHandler}
+	}
+	logger = slog.New(logHandler)
+	slog.SetDefault(logger)
+	logConfig(logger, cfg)
 
-	handler := RequestLogger(logger, mux)
+	srv, err := NewServer(cfg, logger, &logLevel)
+	if err != nil {
+		logger.Error("Could not set up the server", slog.Any("error", err))
+		os.Exit(1)
+	}
 
-	srv := &http.Server{
-		Addr:           ":" + cfg.Port,
-		Handler:        handler,
-		ReadTimeout:    cfg.ReadTimeout,
-		WriteTimeout:   cfg.WriteTimeout,
-		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	// Listeners are bound before anything is served, so that a port in use
+	// ends the process here rather than from a serving goroutine.
+	if err := srv.Listen(); err != nil {
+		logger.Error("Could not listen", slog.Any("error", err))
+		srv.Shutdown(context.Background())
+		os.Exit(1)
 	}
 
-	go func() {
-		logger.Info("Starting server",
-			slog.String("port", cfg.Port),
-			slog.String("dir", cfg.StaticDir),
-		)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("Could not listen on", slog.String("addr", cfg.Port), slog.Any("error", err))
-			os.Exit(1)
-		}
-	}()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- srv.Run(ctx) }()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	if restartSignal != nil {
+		signal.Notify(quit, restartSignal)
+	}
+	if logLevelSignal != nil {
+		signal.Notify(quit, logLevelSignal)
+	}
+	if reopenSignal != nil {
+		signal.Notify(quit, reopenSignal)
+	}
 
-	sig := <-quit
-	logger.Info("Server is shutting down...", slog.String("signal", sig.String()))
+	var sig os.Signal
+	var failed error
+	for {
+		select {
+		case sig = <-quit:
+		case failed = <-served:
+			if failed == nil {
+				failed = errors.New("server stopped serving")
+			}
+		}
+		if failed != nil {
+			break
+		}
+		if sig == logLevelSignal {
+			srv.ToggleLogLevel()
+			continue
+		}
+		if sig == reopenSignal {
+			if err := srv.Reload(); err != nil {
+				logger.Error("Configuration reload failed, keeping the running configuration",
+					slog.Any("problems", configProblems(err)))
+			}
+			if logFile != nil {
+				if err := logFile.Reopen(); err == nil {
+					logger.Info("Log file reopened", slog.String("file", cfg.LogFile))
+				}
+			}
+			continue
+		}
+		if sig != restartSignal {
+			break
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+		logger.Info("Restarting server", slog.String("signal", sig.String()))
+		pid, err := srv.Upgrade()
+		if err != nil {
+			logger.Error("Restart failed, keeping current process", slog.Any("error", err))
+			continue
+		}
+		logger.Info("Replacement process is ready", slog.Int("pid", pid))
+		break
+	}
+	if failed != nil {
+		logger.Error("Server is shutting down, a listener failed", slog.Any("error", failed))
+	} else {
+		stop()
+		<-served
+		logger.Info("Server is shutting down...", slog.String("signal", sig.String()))
+	}
 
-	if err := srv.Shutdown(ctx); err != nil {
-		logger.Error("Server forced to shutdown", slog.Any("error", err))
+	// There is nothing for load balancers to notice once a replacement
+	// process took over the listeners, and no use waiting for them when one
+	// of the listeners is gone already.
+	if failed == nil && !srv.HandedOff() {
+		preStopDelay(logger, cfg.ShutdownDelay, quit)
 	}
 
-	logger.Info("Server exited properly")
-}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
 
-func loadConfig() *Config {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if failed == nil {
+		logger.Info("Server exited properly")
 	}
 
-	staticDir := os.Getenv("STATIC_DIR")
-	if staticDir == "" {
-		staticDir = "./static"
+	if logFile != nil {
+		logFile.Close()
 	}
-
-	return &Config{
-		Port:           port,
-		StaticDir:      staticDir,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	if failed != nil {
+		os.Exit(1)
 	}
 }
 
-type responseWriter struct {
-	http.ResponseWriter
-	status int
-	size   int64
-}
-
-func RequestLogger(logger *slog.Logger, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		wrapper := &responseWriter{
-			ResponseWriter: w,
-			status:         0,
+// logConfig logs the configuration as resolved from every source, secrets
+// redacted, and where each value that was not a default came from.
+func logConfig(logger *slog.Logger, cfg *Config) {
+	fields := cfg.fields()
+	values := make([]any, 0, len(fields))
+	sources := make([]any, 0, len(cfg.sources))
+	for _, f := range fields {
+		values = append(values, slog.String(f.key, configValue(f)))
+		if src := cfg.Source(f.key); src != "" {
+			sources = append(sources, slog.String(f.key, src))
 		}
+	}
 
-		next.ServeHTTP(wrapper, r)
-
-		duration := time.Since(start)
-
-		logger.Info("HTTP Request",
-			slog.String("method", r.Method),
-			slog.String("path", r.URL.Path),
-			slog.Int("status", wrapper.status),
-			slog.String("remote_addr", r.RemoteAddr),
-			slog.String("user_agent", r.UserAgent()),
-			slog.Duration("duration", duration),
-			slog.Int64("bytes", wrapper.size),
-		)
-	})
+	logger.Info("Configuration loaded",
+		slog.String("file", cfg.File),
+		slog.Group("config", values...),
+		slog.Group("sources", sources...),
+	)
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceMessage is answered while maintenance mode is on
+// without a message of its own.
+const defaultMaintenanceMessage = "the service is under maintenance, try again later"
+
+// maintenanceFileCheckInterval is how long the presence of MAINTENANCE_FILE
+// is trusted before it is checked again, so that requests do not each stat
+// the file.
+const maintenanceFileCheckInterval = time.Second
+
+// maintenanceRetryAfter is the Retry-After of maintenance responses, in
+// seconds.
+const maintenanceRetryAfter = "60"
+
+// Sources of maintenance mode.
+const (
+	maintenanceFromAdmin = "admin"
+	maintenanceFromFile  = "file"
+)
+
+// maintenanceState is whether maintenance mode is on, since when and what
+// turned it on.
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Source  string     `json:"source,omitempty"`
+}
+
+// maintenanceMode is on while it is switched on through /admin/maintenance,
+// which lives in memory only and starts off, or while MAINTENANCE_FILE
+// exists. The switch wins over the file for the message.
+type maintenanceMode struct {
+	logger *slog.Logger
+	file   string
+	// loadPage reads the page answered to browsers, each time maintenance
+	// mode is entered.
+	loadPage func() ([]byte, error)
+
+	mu       sync.Mutex
+	admin    maintenanceState
+	fromFile maintenanceState
+	checked  time.Time
+	page     []byte
+}
+
+func newMaintenanceMode(logger *slog.Logger, file string, loadPage func() ([]byte, error)) *maintenanceMode {
+	return &maintenanceMode{logger: logger, file: file, loadPage: loadPage}
+}
+
+// get returns the state in effect.
+func (m *maintenanceMode) get() maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkFile(time.Now())
+	return m.current()
+}
+
+// set switches maintenance mode and returns the state it replaced.
+func (m *maintenanceMode) set(enabled bool, message string, now time.Time) maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkFile(now)
+	previous := m.current()
+
+	if !enabled {
+		m.admin = maintenanceState{}
+	} else {
+		since := &now
+		if m.admin.Enabled {
+			since = m.admin.Since
+		}
+		m.admin = maintenanceState{Enabled: true, Message: message, Since: since, Source: maintenanceFromAdmin}
+	}
+	m.transition(previous, now)
+	return previous
+}
+
+// answer returns the state in effect and the page for browsers, nil when
+// there is none.
+func (m *maintenanceMode) answer() (maintenanceState, []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkFile(time.Now())
+	return m.current(), m.page
+}
+
+// current must be called with mu held.
+func (m *maintenanceMode) current() maintenanceState {
+	if m.admin.Enabled {
+		return m.admin
+	}
+	return m.fromFile
+}
+
+// checkFile looks for MAINTENANCE_FILE once the last look is older than
+// maintenanceFileCheckInterval; its content is the message. It must be
+// called with mu held.
+func (m *maintenanceMode) checkFile(now time.Time) {
+	if m.file == "" || now.Sub(m.checked) < maintenanceFileCheckInterval {
+		return
+	}
+	m.checked = now
+	previous := m.current()
+
+	content, err := os.ReadFile(m.file)
+	switch {
+	case err == nil:
+		message := string(bytes.TrimSpace(content))
+		if len(message) > maxMaintenanceMessage {
+			message = message[:maxMaintenanceMessage]
+		}
+		since := &now
+		if m.fromFile.Enabled {
+			since = m.fromFile.Since
+		}
+		m.fromFile = maintenanceState{Enabled: true, Message: message, Since: since, Source: maintenanceFromFile}
+	case errors.Is(err, fs.ErrNotExist):
+		m.fromFile = maintenanceState{}
+	default:
+		// Keep the last state rather than flap on a transient error.
+		m.logger.Warn("Could not check the maintenance file", slog.String("file", m.file), slog.Any("error", err))
+	}
+	m.transition(previous, now)
+}
+
+// transition logs entering and leaving maintenance mode and loads the page
+// on the way in. It must be called with mu held.
+func (m *maintenanceMode) transition(previous maintenanceState, now time.Time) {
+	state := m.current()
+	switch {
+	case state.Enabled && !previous.Enabled:
+		m.page = nil
+		if m.loadPage != nil {
+			page, err := m.loadPage()
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				m.logger.Warn("Could not load the maintenance page, answering without it", slog.Any("error", err))
+			}
+			m.page = page
+		}
+		m.logger.Warn("Maintenance mode on",
+			slog.String("source", state.Source),
+			slog.String("message", state.Message),
+			slog.Bool("page", m.page != nil),
+		)
+	case !state.Enabled && previous.Enabled:
+		m.page = nil
+		m.logger.Info("Maintenance mode off",
+			slog.String("source", previous.Source),
+			slog.Duration("duration", now.Sub(*previous.Since)),
+		)
+	}
+}
+
+// maintenanceExempt reports whether urlPath keeps working in maintenance
+// mode: the probes, so that the process is not restarted, and /admin/, so
+// that the mode can be switched off again.
+func maintenanceExempt(urlPath string) bool {
+	return urlPath == "/healthz" || urlPath == "/readyz" || strings.HasPrefix(urlPath, adminPrefix)
+}
+
+// Maintenance answers 503 with Retry-After to every request but the
+// exempt ones while the mode is on: the maintenance page to clients that
+// want HTML, and the message rendered by renderError otherwise or when
+// there is no page.
+func Maintenance(mode *maintenanceMode, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		state, page := mode.answer()
+		if !state.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		message := state.Message
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		w.Header().Set("Cache-Control", "no-store")
+		switch {
+		case page != nil && errorFormat(r) == errorFormatHTML:
+			addVary(w.Header(), "Accept")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(page)
+		case isAPIPath(r.URL.Path):
+			WriteError(w, r, http.StatusServiceUnavailable, errCodeMaintenance, message, nil)
+		default:
+			renderError(w, r, http.StatusServiceUnavailable, errCodeMaintenance, message, nil)
+		}
+	})
+}
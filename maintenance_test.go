@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceExempt(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/healthz", true},
+		{"/readyz", true},
+		{"/admin/maintenance", true},
+		{"/admin/", true},
+		{"/", false},
+		{"/api/getSettings", false},
+		{"/healthz/extra", false},
+		{"/administrator", false},
+		{"/metrics", false},
+	}
+	for _, tt := range tests {
+		if got := maintenanceExempt(tt.path); got != tt.want {
+			t.Errorf("maintenanceExempt(%s) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
+
+// recheck makes the next look at the mode read MAINTENANCE_FILE again.
+func recheck(m *maintenanceMode) {
+	m.mu.Lock()
+	m.checked = time.Time{}
+	m.mu.Unlock()
+}
+
+func TestMaintenanceModeFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance")
+	logs := &logBuffer{}
+	m := newMaintenanceMode(slog.New(slog.NewJSONHandler(logs, nil)), file, nil)
+	if m.get().Enabled {
+		t.Fatal("on without the file")
+	}
+
+	if err := os.WriteFile(file, []byte("  migrating the database\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if m.get().Enabled {
+		t.Error("the file was read again within the check interval")
+	}
+	recheck(m)
+	state := m.get()
+	if !state.Enabled || state.Source != maintenanceFromFile || state.Message != "migrating the database" || state.Since == nil {
+		t.Errorf("state = %+v, want on from the file with its message", state)
+	}
+
+	os.Remove(file)
+	recheck(m)
+	if m.get().Enabled {
+		t.Error("still on after the file was removed")
+	}
+	out := logs.String()
+	if !strings.Contains(out, `"msg":"Maintenance mode on","source":"file"`) || !strings.Contains(out, `"msg":"Maintenance mode off","source":"file"`) {
+		t.Errorf("the transitions were not logged:\n%s", out)
+	}
+}
+
+func TestMaintenanceModeSet(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance")
+	os.WriteFile(file, []byte("from the file"), 0o644)
+	logs := &logBuffer{}
+	m := newMaintenanceMode(slog.New(slog.NewJSONHandler(logs, nil)), file, nil)
+	start := time.Now()
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		message     string
+		wantMessage string
+		wantSource  string
+	}{
+		{"switch wins over the file", true, "from admin", "from admin", maintenanceFromAdmin},
+		{"message changed", true, "still here", "still here", maintenanceFromAdmin},
+		{"switched off, the file remains", false, "", "from the file", maintenanceFromFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.set(tt.enabled, tt.message, start)
+			state := m.get()
+			if !state.Enabled || state.Message != tt.wantMessage || state.Source != tt.wantSource {
+				t.Errorf("state = %+v, want %q from %s", state, tt.wantMessage, tt.wantSource)
+			}
+		})
+	}
+	// The mode never left, so entering is logged once.
+	if n := strings.Count(logs.String(), `"msg":"Maintenance mode on"`); n != 1 {
+		t.Errorf("entering logged %d times, want once:\n%s", n, logs)
+	}
+}
+
+func TestServerMaintenance(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	request := func(s *Server, method, target, accept, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if strings.HasPrefix(target, adminPrefix) {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	toggles := []struct {
+		name  string
+		setup func(t *testing.T, cfg *Config)
+		on    func(t *testing.T, s *Server)
+		off   func(t *testing.T, s *Server)
+	}{
+		{
+			"admin endpoint",
+			nil,
+			func(t *testing.T, s *Server) {
+				if rec := request(s, http.MethodPut, "/admin/maintenance", "", `{"enabled":true,"message":"back soon"}`); rec.Code != http.StatusOK {
+					t.Fatalf("switching on = %d %s", rec.Code, rec.Body)
+				}
+			},
+			func(t *testing.T, s *Server) {
+				if rec := request(s, http.MethodPut, "/admin/maintenance", "", `{"enabled":false}`); rec.Code != http.StatusOK {
+					t.Fatalf("switching off = %d %s", rec.Code, rec.Body)
+				}
+			},
+		},
+		{
+			"maintenance file",
+			func(t *testing.T, cfg *Config) { cfg.MaintenanceFile = filepath.Join(t.TempDir(), "maintenance") },
+			func(t *testing.T, s *Server) {
+				os.WriteFile(s.cfg.MaintenanceFile, []byte("back soon"), 0o644)
+				recheck(s.hc.maintenance)
+			},
+			func(t *testing.T, s *Server) {
+				os.Remove(s.cfg.MaintenanceFile)
+				recheck(s.hc.maintenance)
+			},
+		},
+	}
+	routes := []struct {
+		target     string
+		accept     string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{"/", "text/html", http.StatusServiceUnavailable, "text/html", "<h1>maintenance</h1>"},
+		{"/app.js", "*/*", http.StatusServiceUnavailable, "text/plain", "back soon"},
+		{"/api/getSettings", "", http.StatusServiceUnavailable, "application/json", errCodeMaintenance},
+		{"/api/getSettings", "text/html", http.StatusServiceUnavailable, "text/html", "<h1>maintenance</h1>"},
+		{"/healthz", "", http.StatusOK, "application/json", `"status":"ok"`},
+		{"/readyz", "", http.StatusServiceUnavailable, "application/json", `"status":"maintenance"`},
+		{"/admin/config", "", http.StatusOK, "application/json", `"enabled":true`},
+	}
+	for _, toggle := range toggles {
+		t.Run(toggle.name, func(t *testing.T) {
+			s, logs := newTestServer(t, func(cfg *Config) {
+				cfg.AdminToken = adminToken
+				os.WriteFile(filepath.Join(cfg.StaticDir, "maintenance.html"), []byte("<h1>maintenance</h1>"), 0o644)
+				os.WriteFile(filepath.Join(cfg.StaticDir, "app.js"), []byte("app"), 0o644)
+				if toggle.setup != nil {
+					toggle.setup(t, cfg)
+				}
+			})
+			s.hc.SetReady(true)
+			if rec := request(s, http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusOK {
+				t.Fatalf("/readyz before = %d", rec.Code)
+			}
+
+			toggle.on(t, s)
+			for _, tt := range routes {
+				rec := request(s, http.MethodGet, tt.target, tt.accept, "")
+				if rec.Code != tt.wantStatus {
+					t.Errorf("%s (%s) = %d, want %d", tt.target, tt.accept, rec.Code, tt.wantStatus)
+				}
+				if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+					t.Errorf("%s (%s): Content-Type = %q, want %s", tt.target, tt.accept, ct, tt.wantType)
+				}
+				if !strings.Contains(rec.Body.String(), tt.wantBody) {
+					t.Errorf("%s (%s): body = %q, want %q", tt.target, tt.accept, rec.Body, tt.wantBody)
+				}
+				if maintenanceExempt(tt.target) {
+					continue
+				}
+				if rec.Header().Get("Retry-After") != maintenanceRetryAfter {
+					t.Errorf("%s: Retry-After = %q", tt.target, rec.Header().Get("Retry-After"))
+				}
+				if strings.HasPrefix(tt.target, "/api/") && tt.accept == "" {
+					var envelope apiError
+					if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil || envelope.Error.Message != "back soon" {
+						t.Errorf("%s: body = %s, want the message in the envelope", tt.target, rec.Body)
+					}
+				}
+			}
+
+			toggle.off(t, s)
+			for _, target := range []string{"/", "/readyz"} {
+				if rec := request(s, http.MethodGet, target, "text/html", ""); rec.Code != http.StatusOK {
+					t.Errorf("%s after leaving maintenance = %d", target, rec.Code)
+				}
+			}
+			out := logs.String()
+			if !strings.Contains(out, `"msg":"Maintenance mode on"`) || !strings.Contains(out, `"msg":"Maintenance mode off"`) {
+				t.Errorf("the transitions were not logged:\n%s", out)
+			}
+		})
+	}
+}
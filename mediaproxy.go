@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// mediaPath has no REQUEST_TIMEOUT unless REQUEST_TIMEOUT_ROUTES sets one:
+// MEDIA_TIMEOUT bounds it instead, as a large file takes as long as the
+// client needs to read it.
+const mediaPath = "/api/media"
+
+// mediaWriteGrace is added to the download deadline for writing the
+// response, in place of WRITE_TIMEOUT.
+const mediaWriteGrace = 10 * time.Second
+
+// Error codes of /api/media besides those of upstreamError.
+const (
+	errCodeMediaTooLarge        = "media_too_large"
+	errCodeRangeNotSatisfiable  = "range_not_satisfiable"
+	errCodeMediaHostUnreachable = "media_host_unreachable"
+)
+
+// mediaRequestHeaders are passed on to the file host, so that players can
+// seek.
+var mediaRequestHeaders = []string{"Range", "If-Range"}
+
+// mediaResponseHeaders are passed back from the file host.
+var mediaResponseHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"Content-Disposition",
+	"ETag",
+	"Last-Modified",
+}
+
+// mediaLimits are MEDIA_MAX_BYTES, MEDIA_TIMEOUT and MEDIA_CACHE_TTL.
+type mediaLimits struct {
+	maxBytes ByteSize
+	timeout  time.Duration
+	cacheTTL time.Duration
+}
+
+// Media serves GET /api/media: the file of the message messageId in chatId,
+// streamed from the link downloadFile gives without being held in memory.
+// Range is passed on, and the answer keeps the status, Content-Type and
+// Content-Length of the file host. A file over MEDIA_MAX_BYTES is refused
+// up front, or cut off once it gets there when the file host does not say
+// its size.
+func (g *greenAPI) Media(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	var v validation
+	chatID, err := normalizeChatID(query.Get("chatId"), "")
+	v.check("chatId", err)
+	messageID := query.Get("messageId")
+	v.required("messageId", messageID)
+	if len(v.errs) > 0 {
+		return validationError(v.errs)
+	}
+
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	link, err := g.downloadURL(w, r, c, chatID, messageID)
+	if err != nil {
+		return g.upstreamError(r, "downloadFile", err)
+	}
+
+	deadline := time.Now().Add(g.media.timeout)
+	_ = setWriteDeadline(w, r, deadline.Add(mediaWriteGrace))
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+
+	resp, err := g.openMedia(ctx, r, link)
+	if err == nil && mediaGone(resp.StatusCode) && g.mediaCache != nil {
+		// The link may expire before MEDIA_CACHE_TTL does, so a cached one
+		// that no longer works is replaced once.
+		g.mediaCache.invalidate("downloadFile", c.IDInstance())
+		w.Header().Del("Age")
+		if fresh, freshErr := g.downloadURL(w, r, c, chatID, messageID); freshErr == nil && fresh != link {
+			resp.Body.Close()
+			link = fresh
+			resp, err = g.openMedia(ctx, r, link)
+		}
+	}
+	if err != nil {
+		return g.mediaFailure(ctx, r, link, err)
+	}
+	defer resp.Body.Close()
+
+	if err := mediaStatus(resp); err != nil {
+		return err
+	}
+	size := responseSize(resp)
+	if limit := int64(g.media.maxBytes); size > limit {
+		return &HTTPError{Status: http.StatusUnprocessableEntity, Code: errCodeMediaTooLarge,
+			Message: fmt.Sprintf("file is %s, limit is %s", formatFileSize(size), formatFileSize(limit)),
+			Details: map[string]int64{"size": size, "limit": limit}}
+	}
+
+	h := w.Header()
+	for _, name := range mediaResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			h.Set(name, value)
+		}
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	// no-transform keeps COMPRESSION away, which would drop Content-Length.
+	if g.media.cacheTTL > 0 {
+		h.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(g.media.cacheTTL/time.Second))+", no-transform")
+	} else {
+		h.Set("Cache-Control", "no-store, no-transform")
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	g.streamMedia(w, r, resp, size)
+	return nil
+}
+
+// downloadURL returns the link downloadFile gives for the message, through
+// the cache of download links when it is enabled.
+func (g *greenAPI) downloadURL(w http.ResponseWriter, r *http.Request, c *greenapi.Client, chatID, messageID string) (string, error) {
+	idInstance, apiToken, _ := g.credentials(r)
+	key := newAPICacheKey("downloadFile", idInstance, apiToken)
+	key.arg = chatID + "/" + messageID
+	result, err := g.cachedFetch(w, r, g.mediaCache, key, func(ctx context.Context) (any, error) {
+		return c.DownloadFile(ctx, greenapi.DownloadFileRequest{ChatID: chatID, IDMessage: messageID})
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.(*greenapi.DownloadFileResult).DownloadURL, nil
+}
+
+// openMedia asks the file host for link, with the Range of r. The body is
+// asked for as it is stored, since a transparently decompressed one would
+// lose its Content-Length and ranges.
+func (g *greenAPI) openMedia(ctx context.Context, r *http.Request, link string) (*http.Response, error) {
+	if link == "" {
+		return nil, errNoDownloadURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range mediaRequestHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	return g.upload.Do(req)
+}
+
+var errNoDownloadURL = errors.New("downloadFile returned no link")
+
+// mediaGone reports whether the file host answered that the link no longer
+// leads to the file, as signed links do once they expire.
+func mediaGone(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// mediaStatus maps an answer of the file host other than 200 and 206 to
+// the error returned in its place.
+func mediaStatus(resp *http.Response) *HTTPError {
+	status := resp.StatusCode
+	switch {
+	case status == http.StatusOK || status == http.StatusPartialContent:
+		return nil
+	case status == http.StatusRequestedRangeNotSatisfiable:
+		var header http.Header
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+			header = http.Header{"Content-Range": {contentRange}}
+		}
+		return &HTTPError{Status: status, Code: errCodeRangeNotSatisfiable, Message: "Range is outside of the file", Header: header}
+	case mediaGone(status):
+		return &HTTPError{Status: http.StatusNotFound, Code: errCodeNotFound, Message: "the file of the message is no longer available",
+			Details: map[string]int{"upstream_status": status}, Attrs: []slog.Attr{slog.Int("upstream_status", status)}}
+	default:
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError, Message: "the file host answered with an error",
+			Details: map[string]int{"upstream_status": status}, Attrs: []slog.Attr{slog.Int("upstream_status", status)}}
+	}
+}
+
+// mediaFailure maps a request to the file host that got no answer.
+func (g *greenAPI) mediaFailure(ctx context.Context, r *http.Request, link string, err error) *HTTPError {
+	switch {
+	case errors.Is(err, errNoDownloadURL):
+		return &HTTPError{Status: http.StatusNotFound, Code: errCodeNotFound, Message: "the message has no file", Err: err}
+	case errors.Is(r.Context().Err(), context.Canceled):
+		return &HTTPError{Status: http.StatusGatewayTimeout, Code: errCodeClientCanceled, Message: "client canceled", Err: err}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &HTTPError{Status: http.StatusGatewayTimeout, Code: errCodeUpstreamTimeout, Message: "the file host timed out",
+			Attrs: []slog.Attr{slog.Duration("timeout", g.media.timeout)}, Err: err}
+	}
+	httpErr := &HTTPError{Status: http.StatusBadGateway, Code: errCodeMediaHostUnreachable, Message: "the file host cannot be reached", Err: err}
+	if u, parseErr := url.Parse(link); parseErr == nil {
+		httpErr.Attrs = append(httpErr.Attrs, slog.String("url_host", u.Host))
+	}
+	return httpErr
+}
+
+// streamMedia copies the body of resp, of size bytes or -1 when unknown, to
+// w. A stream that breaks off, or grows past MEDIA_MAX_BYTES, aborts the
+// response, so that the client does not take what it got for the whole
+// file; a client that goes away is left to the access log.
+func (g *greenAPI) streamMedia(w http.ResponseWriter, r *http.Request, resp *http.Response, size int64) {
+	body := &mediaBody{r: resp.Body}
+	limit := int64(g.media.maxBytes)
+	n, _ := io.Copy(w, io.LimitReader(body, limit))
+
+	reason := ""
+	switch {
+	case r.Context().Err() != nil:
+	case body.err != nil:
+		reason = "the file host stream broke off"
+	case size < 0 && n == limit:
+		var extra [1]byte
+		if m, _ := io.ReadFull(body, extra[:]); m > 0 {
+			reason = "the file is larger than MEDIA_MAX_BYTES"
+		}
+	}
+	if reason == "" {
+		return
+	}
+	LoggerFromContext(r.Context()).Warn("Media stream aborted",
+		slog.String("reason", reason),
+		slog.Int64("streamed_bytes", n),
+		slog.Int64("size", size),
+		slog.Any("error", body.err),
+	)
+	panic(http.ErrAbortHandler)
+}
+
+// mediaBody keeps the error reading the file host failed with apart from
+// those writing to the client.
+type mediaBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *mediaBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
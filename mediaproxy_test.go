@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMediaStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		wantStatus int
+		wantCode   string
+	}{
+		{http.StatusOK, 0, ""},
+		{http.StatusPartialContent, 0, ""},
+		{http.StatusRequestedRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable, errCodeRangeNotSatisfiable},
+		{http.StatusForbidden, http.StatusNotFound, errCodeNotFound},
+		{http.StatusNotFound, http.StatusNotFound, errCodeNotFound},
+		{http.StatusGone, http.StatusNotFound, errCodeNotFound},
+		{http.StatusInternalServerError, http.StatusBadGateway, errCodeUpstreamError},
+		{http.StatusNotModified, http.StatusBadGateway, errCodeUpstreamError},
+	}
+	for _, tt := range tests {
+		err := mediaStatus(&http.Response{StatusCode: tt.status, Header: http.Header{"Content-Range": {"bytes */100"}}})
+		if tt.wantCode == "" {
+			if err != nil {
+				t.Errorf("%d: %v, want it streamed", tt.status, err)
+			}
+			continue
+		}
+		if err == nil || err.Status != tt.wantStatus || err.Code != tt.wantCode {
+			t.Errorf("%d: got %+v, want %d %s", tt.status, err, tt.wantStatus, tt.wantCode)
+			continue
+		}
+		if tt.status == http.StatusRequestedRangeNotSatisfiable && err.Header.Get("Content-Range") != "bytes */100" {
+			t.Errorf("416 without the Content-Range of the file host: %v", err.Header)
+		}
+	}
+}
+
+// mediaFile is the 3MB file the fake media host serves.
+var mediaFile = func() []byte {
+	b := make([]byte, 3<<20)
+	for i := range b {
+		b[i] = byte(i * 7 % 251)
+	}
+	return b
+}()
+
+// mediaUpstream is GREEN-API with its file host. downloadFile gives the
+// link of the file host path links holds for the message, a message not
+// there has no file, and BAE-FAIL fails downloadFile itself.
+type mediaUpstream struct {
+	mu        sync.Mutex
+	links     map[string]string
+	downloads atomic.Int32
+	fetches   atomic.Int32
+	ranges    []string
+}
+
+func (u *mediaUpstream) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/downloadFile/") {
+			u.downloads.Add(1)
+			var req struct {
+				ChatID    string `json:"chatId"`
+				IDMessage string `json:"idMessage"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.ChatID != "79001234567@c.us" {
+				t.Errorf("downloadFile for chat %s", req.ChatID)
+			}
+			if req.IDMessage == "BAE-FAIL" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			u.mu.Lock()
+			path, ok := u.links[req.IDMessage]
+			u.mu.Unlock()
+			link := ""
+			if ok {
+				link = "http://" + r.Host + path
+			}
+			json.NewEncoder(w).Encode(map[string]string{"downloadUrl": link})
+			return
+		}
+
+		u.fetches.Add(1)
+		u.mu.Lock()
+		u.ranges = append(u.ranges, r.Header.Get("Range"))
+		u.mu.Unlock()
+		if r.Header.Get("Accept-Encoding") != "identity" {
+			t.Errorf("file asked for with Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+		}
+		switch r.URL.Path {
+		case "/files/voice.ogg":
+			w.Header().Set("Content-Type", "audio/ogg")
+			w.Header().Set("Content-Disposition", `attachment; filename="voice.ogg"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(mediaFile))
+		case "/files/unsized":
+			w.Header().Set("Content-Type", "video/mp4")
+			for rest := mediaFile; len(rest) > 0; rest = rest[min(len(rest), 64<<10):] {
+				w.Write(rest[:min(len(rest), 64<<10)])
+				w.(http.Flusher).Flush()
+			}
+		case "/files/broken":
+			w.Header().Set("Content-Length", fmt.Sprint(len(mediaFile)))
+			w.Write(mediaFile[:1<<20])
+			w.(http.Flusher).Flush()
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		case "/files/expired":
+			w.WriteHeader(http.StatusForbidden)
+		case "/files/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func (u *mediaUpstream) Ranges() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.ranges...)
+}
+
+// getMedia fetches /api/media of s for messageID with a client that takes
+// the body as it is sent.
+func getMedia(t *testing.T, s *Server, messageID string, header http.Header) (*http.Response, []byte, error) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, serverURL(t, s, "http", mediaPath+"?chatId=79001234567&messageId="+messageID), nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// accessBytes is the bytes field the access log gave the last /api/media
+// request in out.
+func accessBytes(t *testing.T, out string) (float64, map[string]any) {
+	t.Helper()
+	var entry map[string]any
+	for _, line := range strings.Split(out, "\n") {
+		var e map[string]any
+		if json.Unmarshal([]byte(line), &e) == nil && e["msg"] == "HTTP Request" && e["path"] == mediaPath {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("/api/media was not logged:\n%s", out)
+	}
+	bytes, _ := entry["bytes"].(float64)
+	return bytes, entry
+}
+
+func TestServerMedia(t *testing.T) {
+	links := map[string]string{
+		"BAE-VOICE":   "/files/voice.ogg",
+		"BAE-UNSIZED": "/files/unsized",
+		"BAE-GONE":    "/files/missing",
+		"BAE-ERROR":   "/files/error",
+	}
+	tests := []struct {
+		name       string
+		messageID  string
+		header     http.Header
+		maxBytes   ByteSize
+		wantStatus int
+		wantCode   string
+		wantBody   []byte
+		wantHeader map[string]string
+		wantRange  string
+	}{
+		{
+			name: "whole file", messageID: "BAE-VOICE", wantStatus: http.StatusOK, wantBody: mediaFile,
+			wantHeader: map[string]string{
+				"Content-Type":        "audio/ogg",
+				"Content-Length":      fmt.Sprint(len(mediaFile)),
+				"Accept-Ranges":       "bytes",
+				"Content-Disposition": `attachment; filename="voice.ogg"`,
+				"Cache-Control":       "private, max-age=300, no-transform",
+				"Content-Encoding":    "",
+			},
+		},
+		{
+			name: "range", messageID: "BAE-VOICE", header: http.Header{"Range": {"bytes=1048576-2097151"}},
+			wantStatus: http.StatusPartialContent, wantBody: mediaFile[1<<20 : 2<<20], wantRange: "bytes=1048576-2097151",
+			wantHeader: map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes 1048576-2097151/%d", len(mediaFile)),
+				"Content-Length": fmt.Sprint(1 << 20),
+			},
+		},
+		{
+			name: "open-ended range", messageID: "BAE-VOICE", header: http.Header{"Range": {"bytes=3145000-"}},
+			wantStatus: http.StatusPartialContent, wantBody: mediaFile[3145000:], wantRange: "bytes=3145000-",
+		},
+		{
+			name: "range of a file over the limit", messageID: "BAE-VOICE", header: http.Header{"Range": {"bytes=0-99"}}, maxBytes: 1 << 20,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeMediaTooLarge,
+		},
+		{
+			name: "range outside the file", messageID: "BAE-VOICE", header: http.Header{"Range": {"bytes=9999999-"}},
+			wantStatus: http.StatusRequestedRangeNotSatisfiable, wantCode: errCodeRangeNotSatisfiable,
+			wantHeader: map[string]string{"Content-Range": fmt.Sprintf("bytes */%d", len(mediaFile))},
+		},
+		{name: "unsized file", messageID: "BAE-UNSIZED", wantStatus: http.StatusOK, wantBody: mediaFile, wantHeader: map[string]string{"Content-Type": "video/mp4"}},
+		{name: "over the limit", messageID: "BAE-VOICE", maxBytes: 2 << 20, wantStatus: http.StatusUnprocessableEntity, wantCode: errCodeMediaTooLarge},
+		{name: "no file", messageID: "BAE-TEXT", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "file gone", messageID: "BAE-GONE", wantStatus: http.StatusNotFound, wantCode: errCodeNotFound},
+		{name: "file host error", messageID: "BAE-ERROR", wantStatus: http.StatusBadGateway, wantCode: errCodeUpstreamError},
+		{name: "downloadFile fails", messageID: "BAE-FAIL", wantStatus: http.StatusBadGateway},
+		{name: "no message ID", messageID: "", wantStatus: http.StatusBadRequest, wantCode: errCodeValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &mediaUpstream{links: links}
+			upstream := fakeGreenAPI(t, u.handler(t))
+			s, logs := startTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				if tt.maxBytes != 0 {
+					cfg.MediaMaxBytes = tt.maxBytes
+				}
+			}))
+
+			header := http.Header{"Accept": {"application/json"}}
+			for name, values := range tt.header {
+				header[name] = values
+			}
+			resp, body, err := getMedia(t, s, tt.messageID, header)
+			if err != nil {
+				t.Fatalf("reading the body: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", resp.StatusCode, tt.wantStatus, body)
+			}
+			for name, want := range tt.wantHeader {
+				if got := resp.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.wantRange != "" {
+				if got := u.Ranges(); len(got) != 1 || got[0] != tt.wantRange {
+					t.Errorf("file host got Range %q, want %q", got, tt.wantRange)
+				}
+			}
+			if tt.wantBody == nil {
+				var envelope apiError
+				if err := json.Unmarshal(body, &envelope); err != nil {
+					t.Fatalf("body = %.200s, want the JSON error envelope", body)
+				}
+				if tt.wantCode != "" && envelope.Error.Code != tt.wantCode {
+					t.Errorf("error code = %s, want %s", envelope.Error.Code, tt.wantCode)
+				}
+				return
+			}
+			if !bytes.Equal(body, tt.wantBody) {
+				t.Errorf("got %d bytes, want the %d of the file", len(body), len(tt.wantBody))
+			}
+			if n, _ := accessBytes(t, logs.String()); int(n) != len(tt.wantBody) {
+				t.Errorf("logged %v bytes, streamed %d", n, len(tt.wantBody))
+			}
+		})
+	}
+}
+
+// TestServerMediaAborted has the stream break off: the client must see it
+// cut short, and the log what was sent before.
+func TestServerMediaAborted(t *testing.T) {
+	tests := []struct {
+		name       string
+		messageID  string
+		maxBytes   ByteSize
+		wantReason string
+		wantBytes  int
+	}{
+		{"file host drops the connection", "BAE-BROKEN", 0, "the file host stream broke off", 1 << 20},
+		{"unsized file over the limit", "BAE-UNSIZED", 1 << 20, "the file is larger than MEDIA_MAX_BYTES", 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &mediaUpstream{links: map[string]string{"BAE-BROKEN": "/files/broken", "BAE-UNSIZED": "/files/unsized"}}
+			upstream := fakeGreenAPI(t, u.handler(t))
+			s, logs := startTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				if tt.maxBytes != 0 {
+					cfg.MediaMaxBytes = tt.maxBytes
+				}
+			}))
+
+			resp, body, err := getMedia(t, s, tt.messageID, nil)
+			if err == nil {
+				t.Errorf("read %d bytes without an error, want the response cut off", len(body))
+			}
+			if resp.StatusCode != http.StatusOK || len(body) > tt.wantBytes {
+				t.Errorf("status %d with %d bytes", resp.StatusCode, len(body))
+			}
+			waitFor(t, "the access log entry", func() bool {
+				return strings.Contains(logs.String(), `"msg":"HTTP Request"`)
+			})
+			n, entry := accessBytes(t, logs.String())
+			if int(n) != tt.wantBytes || entry["aborted"] != true || entry["level"] != "WARN" {
+				t.Errorf("logged %v bytes, aborted %v at %v; want %d bytes aborted at WARN", n, entry["aborted"], entry["level"], tt.wantBytes)
+			}
+			aborted := findLogEntry(t, logs.String(), "Media stream aborted")
+			if aborted["reason"] != tt.wantReason || aborted["streamed_bytes"] != float64(tt.wantBytes) {
+				t.Errorf("abort logged as %v", aborted)
+			}
+		})
+	}
+}
+
+func TestServerMediaCache(t *testing.T) {
+	tests := []struct {
+		name          string
+		ttl           time.Duration
+		wantDownloads int32
+		wantCache     string
+	}{
+		{"cached link", 5 * time.Minute, 1, "private, max-age=300, no-transform"},
+		{"cache off", 0, 2, "no-store, no-transform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &mediaUpstream{links: map[string]string{"BAE-VOICE": "/files/voice.ogg"}}
+			upstream := fakeGreenAPI(t, u.handler(t))
+			s, _ := startTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.MediaCacheTTL = tt.ttl
+			}))
+			for range 2 {
+				resp, body, err := getMedia(t, s, "BAE-VOICE", http.Header{"Range": {"bytes=0-9"}})
+				if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, mediaFile[:10]) {
+					t.Fatalf("got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+				}
+				if cc := resp.Header.Get("Cache-Control"); cc != tt.wantCache {
+					t.Errorf("Cache-Control = %q, want %q", cc, tt.wantCache)
+				}
+			}
+			if n := u.downloads.Load(); n != tt.wantDownloads {
+				t.Errorf("downloadFile called %d times, want %d", n, tt.wantDownloads)
+			}
+		})
+	}
+}
+
+// TestServerMediaExpiredLink has downloadFile give a link that no longer
+// works, then a fresh one: with the link cache the fresh one is asked for
+// once, and streamed in the same request.
+func TestServerMediaExpiredLink(t *testing.T) {
+	tests := []struct {
+		name          string
+		ttl           time.Duration
+		wantStatus    int
+		wantDownloads int32
+	}{
+		{"cached link replaced", 5 * time.Minute, http.StatusPartialContent, 2},
+		{"no cache to replace", 0, http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &mediaUpstream{links: map[string]string{"BAE-ROTATED": "/files/expired"}}
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				u.handler(t)(w, r)
+				if strings.Contains(r.URL.Path, "/downloadFile/") {
+					u.mu.Lock()
+					u.links["BAE-ROTATED"] = "/files/voice.ogg"
+					u.mu.Unlock()
+				}
+			})
+			s, _ := startTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.MediaCacheTTL = tt.ttl
+			}))
+			resp, body, _ := getMedia(t, s, "BAE-ROTATED", http.Header{"Range": {"bytes=0-9"}, "Accept": {"application/json"}})
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusPartialContent && !bytes.Equal(body, mediaFile[:10]) {
+				t.Errorf("body = %q", body)
+			}
+			if n := u.downloads.Load(); n != tt.wantDownloads {
+				t.Errorf("downloadFile called %d times, want %d", n, tt.wantDownloads)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// staticMethods are the methods static files are served for.
+var staticMethods = []string{http.MethodGet, http.MethodHead}
+
+// AllowMethods lets through requests whose method is one of methods. OPTIONS
+// is answered with the allowed set in Allow, and every other method gets 405
+// with the same header, rendered by WriteError.
+func AllowMethods(methods []string, next http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(methods, r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", allow)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		WriteError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed", nil)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAllowMethods(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	tests := []struct {
+		name      string
+		methods   []string
+		method    string
+		wantCode  int
+		wantAllow string
+	}{
+		{"GET allowed", staticMethods, http.MethodGet, http.StatusTeapot, ""},
+		{"HEAD allowed", staticMethods, http.MethodHead, http.StatusTeapot, ""},
+		{"POST refused", staticMethods, http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE refused", staticMethods, http.MethodDelete, http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"OPTIONS answered", staticMethods, http.MethodOptions, http.StatusNoContent, "GET, HEAD"},
+		{"custom set", []string{http.MethodPost, http.MethodPut}, http.MethodPut, http.StatusTeapot, ""},
+		{"custom set refuses GET", []string{http.MethodPost, http.MethodPut}, http.MethodGet, http.StatusMethodNotAllowed, "POST, PUT"},
+		{"OPTIONS passed through when listed", []string{http.MethodOptions}, http.MethodOptions, http.StatusTeapot, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			AllowMethods(tt.methods, ok).ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if tt.wantCode == http.StatusMethodNotAllowed {
+				var env apiError
+				if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil || env.Error.Code != errCodeMethodNotAllowed {
+					t.Errorf("body = %s, want a %s error", rec.Body, errCodeMethodNotAllowed)
+				}
+			}
+			if tt.wantCode == http.StatusNoContent && rec.Body.Len() != 0 {
+				t.Errorf("OPTIONS body = %q", rec.Body)
+			}
+		})
+	}
+}
+
+func TestServerMethods(t *testing.T) {
+	verbs := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions}
+	tests := []struct {
+		path      string
+		allowed   []string
+		wantAllow string
+		// wantOptions is what OPTIONS gets: static paths answer it, API
+		// routes define their own methods and refuse it.
+		wantOptions int
+	}{
+		{"/", staticMethods, "GET, HEAD", http.StatusNoContent},
+		{"/index.html", staticMethods, "GET, HEAD", http.StatusNoContent},
+		{"/missing.js", staticMethods, "GET, HEAD", http.StatusNoContent},
+		{"/healthz", staticMethods, "GET, HEAD", http.StatusNoContent},
+		{"/api/getSettings", staticMethods, "GET, HEAD", http.StatusMethodNotAllowed},
+		{"/api/sendMessage", []string{http.MethodPost}, "POST", http.StatusMethodNotAllowed},
+	}
+	s, _ := newTestServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for _, method := range verbs {
+				rec := serve(s, method, tt.path, nil)
+				switch {
+				case slices.Contains(tt.allowed, method):
+					if rec.Code == http.StatusMethodNotAllowed {
+						t.Errorf("%s = 405, want it let through", method)
+					}
+				case method == http.MethodOptions:
+					if rec.Code != tt.wantOptions || rec.Header().Get("Allow") != tt.wantAllow {
+						t.Errorf("OPTIONS = %d, Allow %q, want %d, %q", rec.Code, rec.Header().Get("Allow"), tt.wantOptions, tt.wantAllow)
+					}
+				default:
+					if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != tt.wantAllow {
+						t.Errorf("%s = %d, Allow %q, want 405, %q", method, rec.Code, rec.Header().Get("Allow"), tt.wantAllow)
+					}
+				}
+			}
+		})
+	}
+}
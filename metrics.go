@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+
+	upstreamRequests *prometheus.CounterVec
+	upstreamRetries  *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	upstreamCalls    *prometheus.CounterVec
+
+	circuitState       *prometheus.GaugeVec
+	circuitTransitions *prometheus.CounterVec
+
+	limiterWaits      *prometheus.CounterVec
+	limiterWaitTime   *prometheus.CounterVec
+	limiterRejections *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests by method, status class and route.",
+		}, []string{"method", "code", "route"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time spent serving HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of HTTP response bodies.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"method", "route"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served.",
+		}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_requests_total",
+			Help: "Number of HTTP requests sent to GREEN-API by method, instance and status class, \"error\" when no answer came.",
+		}, []string{"method", "instance", "code"}),
+		upstreamRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_retries_total",
+			Help: "Number of HTTP requests sent to GREEN-API as retries of a failed attempt by method and instance.",
+		}, []string{"method", "instance"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greenapi_request_duration_seconds",
+			Help:    "Time GREEN-API took to answer an HTTP request by method and instance.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "instance"}),
+		upstreamCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_calls_total",
+			Help: "Number of GREEN-API calls, retries included, by method, instance and outcome: a status class, error, timeout, canceled, circuit_open or throttled.",
+		}, []string{"method", "instance", "outcome"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "greenapi_circuit_state",
+			Help: "State of the GREEN-API circuit breaker by host and instance: 0 closed, 1 half-open, 2 open.",
+		}, []string{"host", "instance"}),
+		circuitTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_circuit_transitions_total",
+			Help: "Number of GREEN-API circuit breaker state changes by host, instance and new state.",
+		}, []string{"host", "instance", "state"}),
+		limiterWaits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_limiter_waits_total",
+			Help: "Number of GREEN-API calls delayed by the outbound limiter by method.",
+		}, []string{"method"}),
+		limiterWaitTime: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_limiter_wait_seconds_total",
+			Help: "Time GREEN-API calls were delayed by the outbound limiter by method.",
+		}, []string{"method"}),
+		limiterRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenapi_limiter_rejections_total",
+			Help: "Number of GREEN-API calls refused with 429 by the outbound limiter by method.",
+		}, []string{"method"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.size,
+		m.inFlight,
+		m.upstreamRequests,
+		m.upstreamRetries,
+		m.upstreamDuration,
+		m.upstreamCalls,
+		m.circuitState,
+		m.circuitTransitions,
+		m.limiterWaits,
+		m.limiterWaitTime,
+		m.limiterRejections,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+func (m *metrics) registerFileCache(c *fileCache) {
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "static_cache_hits_total",
+			Help: "Number of static files served from the memory cache.",
+		}, func() float64 { return float64(c.hits.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "static_cache_misses_total",
+			Help: "Number of cacheable static files read from disk.",
+		}, func() float64 { return float64(c.misses.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "static_cache_entries",
+			Help: "Number of static files held in the memory cache.",
+		}, func() float64 {
+			entries, _ := c.Usage()
+			return float64(entries)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "static_cache_bytes",
+			Help: "Total size of static files held in the memory cache.",
+		}, func() float64 {
+			_, size := c.Usage()
+			return float64(size)
+		}),
+	)
+}
+
+func (m *metrics) registerConcurrencyLimiter(l *concurrencyLimiter) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "http_requests_queued",
+			Help: "Number of requests waiting for a concurrency slot.",
+		}, func() float64 { return float64(l.queued.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Number of requests rejected with 503 by the concurrency limit.",
+		}, func() float64 { return float64(l.shed.Load()) }),
+	)
+}
+
+func (m *metrics) registerConnections(c *connCounter) {
+	for state, gauge := range map[string]*atomic.Int64{"new": &c.new, "active": &c.active, "idle": &c.idle} {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "http_connections",
+			Help:        "Number of open connections of the main server by state.",
+			ConstLabels: prometheus.Labels{"state": state},
+		}, func() float64 { return float64(gauge.Load()) }))
+	}
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "http_connections_accepted_total",
+			Help: "Number of connections accepted by the main server.",
+		}, func() float64 { return float64(c.accepted.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "http_connections_closed_total",
+			Help: "Number of connections of the main server closed or hijacked.",
+		}, func() float64 { return float64(c.closed.Load()) }),
+	)
+}
+
+func (m *metrics) registerConnectionLimit(l *limitListener) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "http_connections_limit",
+			Help: "Number of connections the main listener keeps open at once.",
+		}, func() float64 { return float64(l.Max()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "http_connections_limit_waits_total",
+			Help: "Number of connections accepted only after waiting for MAX_CONNECTIONS.",
+		}, func() float64 { return float64(l.waits.Load()) }),
+	)
+}
+
+func (m *metrics) registerSendQueue(q *sendQueue) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "send_queue_depth",
+			Help: "Number of async messages queued or being sent.",
+		}, func() float64 { return float64(q.pending.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "send_queue_capacity",
+			Help: "Number of async messages the send queue holds before it answers 429.",
+		}, func() float64 { return float64(cap(q.jobs)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_queue_enqueued_total",
+			Help: "Number of async messages queued.",
+		}, func() float64 { return float64(q.enqueued.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_queue_sent_total",
+			Help: "Number of queued messages sent.",
+		}, func() float64 { return float64(q.sent.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_queue_failed_total",
+			Help: "Number of queued messages given up on.",
+		}, func() float64 { return float64(q.failed.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_queue_rejected_total",
+			Help: "Number of async messages refused with 429 as the queue was full.",
+		}, func() float64 { return float64(q.rejected.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_queue_retries_total",
+			Help: "Number of queued messages sent again after a failure that may pass.",
+		}, func() float64 { return float64(q.retries.Load()) }),
+	)
+}
+
+func (m *metrics) registerNotificationHub(h *notificationHub) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ws_connections",
+			Help: "Number of clients connected to the notification stream.",
+		}, func() float64 { return float64(h.Connections()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ws_slow_disconnects_total",
+			Help: "Number of notification stream clients disconnected for falling behind.",
+		}, func() float64 { return float64(h.dropped.Load()) }),
+	)
+}
+
+// observeCircuit records a breaker change; instance is a label from
+// Config.instanceLabel, so instances without a name share "other" and the
+// gauge holds the last change among them.
+func (m *metrics) observeCircuit(host, instance string, state greenapi.CircuitState) {
+	m.circuitState.WithLabelValues(host, instance).Set(float64(state))
+	m.circuitTransitions.WithLabelValues(host, instance, state.String()).Inc()
+}
+
+func (m *metrics) observeLimiterWait(method string, wait time.Duration) {
+	m.limiterWaits.WithLabelValues(method).Inc()
+	m.limiterWaitTime.WithLabelValues(method).Add(wait.Seconds())
+}
+
+func (m *metrics) observeLimiterRejection(method string) {
+	m.limiterRejections.WithLabelValues(method).Inc()
+}
+
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Metrics instruments next, which must be the mux itself: the route label is
+// the mux pattern that matched the request, which keeps cardinality bounded
+// by the number of registered routes.
+func Metrics(m *metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		wrapper := &responseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(wrapper, r)
+
+		method := metricMethod(r.Method)
+		route := r.Pattern
+		if route == "" {
+			route = "other"
+		} else {
+			nameSpan(r, route)
+		}
+
+		status := wrapper.statusCode()
+		if clientAborted(r, wrapper.writeErr) {
+			status = statusClientClosedRequest
+		}
+		m.requests.WithLabelValues(method, statusClass(status), route).Inc()
+		m.duration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		m.size.WithLabelValues(method, route).Observe(float64(wrapper.size))
+	})
+}
+
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve runs one request through the whole middleware stack of s.
+func serve(s *Server, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(method, target, body))
+	return rec
+}
+
+func TestMetricsAfterRequests(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	for _, req := range []struct{ method, target string }{
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/missing.js"},
+		{http.MethodGet, "/api/nothing/here"},
+		{http.MethodGet, "/healthz"},
+		{"BREW", "/healthz"},
+	} {
+		serve(s, req.method, req.target, nil)
+	}
+
+	rec := serve(s, http.MethodGet, "/metrics", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	scrape := rec.Body.String()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"static hits", `http_requests_total{code="2xx",method="GET",route="/"} 2`},
+		{"static miss", `http_requests_total{code="4xx",method="GET",route="/"} 1`},
+		{"api fallback route", `http_requests_total{code="4xx",method="GET",route="/api/"} 1`},
+		{"route pattern", `http_requests_total{code="2xx",method="GET",route="GET /healthz"} 1`},
+		{"unknown method", `method="OTHER"`},
+		{"duration histogram", `http_request_duration_seconds_count{method="GET",route="/"} 3`},
+		{"size histogram", `http_response_size_bytes_count{method="GET",route="GET /healthz"} 1`},
+		{"in-flight gauge", `http_requests_in_flight 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(scrape, tt.want) {
+				t.Errorf("scrape does not contain %s", tt.want)
+			}
+		})
+	}
+	if strings.Contains(scrape, "/missing.js") || strings.Contains(scrape, "/api/nothing") {
+		t.Error("a raw request path is used as a label")
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{101, "1xx"},
+		{200, "2xx"},
+		{304, "3xx"},
+		{404, "4xx"},
+		{statusClientClosedRequest, "4xx"},
+		{503, "5xx"},
+	}
+	for _, tt := range tests {
+		if got := statusClass(tt.status); got != tt.want {
+			t.Errorf("statusClass(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestMetricMethod(t *testing.T) {
+	tests := []struct{ method, want string }{
+		{http.MethodGet, http.MethodGet},
+		{http.MethodDelete, http.MethodDelete},
+		{"PROPFIND", "OTHER"},
+		{"get", "OTHER"},
+	}
+	for _, tt := range tests {
+		if got := metricMethod(tt.method); got != tt.want {
+			t.Errorf("metricMethod(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	// head leaves out of size what is written to a HEAD response, which
+	// net/http accepts but never sends.
+	head bool
+	// writeErr is the first error writing the response failed with.
+	writeErr error
+	// closed is set once an error response has been written in full, so
+	// that what a handler writes after it is dropped rather than appended.
+	closed bool
+	// conflict is set when a write was dropped, here or by a wrapper further
+	// in.
+	conflict bool
+}
+
+// errResponseClosed is returned for writes dropped after an error response.
+var errResponseClosed = errors.New("response already complete")
+
+// WriteHeader records the first final status. Informational 1xx responses
+// are passed through; later calls are dropped with a warning instead of
+// reaching net/http.
+func (rw *responseWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		rw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if rw.status != 0 {
+		reportResponseConflict(rw, "Superfluous WriteHeader call",
+			slog.Int("status", status),
+			slog.Int("sent_status", rw.status),
+		)
+		return
+	}
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.closed {
+		reportResponseConflict(rw, "Write after the response was complete", slog.Int("bytes", len(b)))
+		return 0, errResponseClosed
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	if !rw.head {
+		rw.size += int64(n)
+	}
+	if err != nil && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy reach the underlying writer's ReadFrom, so static
+// files keep using sendfile, while still counting the bytes.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rw.closed {
+		reportResponseConflict(rw, "Write after the response was complete")
+		return 0, errResponseClosed
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	var n int64
+	var err error
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{rw.ResponseWriter}, src)
+	}
+	if !rw.head {
+		rw.size += n
+	}
+	if err != nil && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil && rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// writerOnly hides every method but Write, so io.Copy cannot recurse into
+// ReadFrom.
+type writerOnly struct {
+	io.Writer
+}
+
+// Committed reports whether the response has started, so an error can no
+// longer replace it.
+func (rw *responseWriter) Committed() bool {
+	return rw.status != 0
+}
+
+func (rw *responseWriter) setConflict() {
+	rw.conflict = true
+}
+
+func (rw *responseWriter) close() {
+	rw.closed = true
+}
+
+// conflictHelpers write responses on behalf of their callers, so a conflict
+// is reported at the caller instead. They are matched without the package
+// path, which is not "main" in a test binary.
+var conflictHelpers = []string{"writeJSON", "renderError", "writeErrorBody", "WriteError", "writeHTTPError"}
+
+// conflictCaller returns the file:line of the code behind a dropped write,
+// past the writer wrappers, net/http and io helpers such as http.Error and
+// io.WriteString, and the error helpers.
+func conflictCaller() string {
+	for skip := 2; ; skip++ {
+		pc, file, line, ok := runtime.Caller(skip)
+		if !ok {
+			return "unknown"
+		}
+		name := ""
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			name = fn.Name()
+		}
+		local := name[strings.LastIndexByte(name, '/')+1:]
+		local = local[strings.IndexByte(local, '.')+1:]
+		if strings.HasPrefix(name, "net/http.") || strings.HasPrefix(name, "io.") ||
+			strings.Contains(name, "Writer).") || slices.Contains(conflictHelpers, local) {
+			continue
+		}
+		return filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+}
+
+// eachResponseWriter calls f with w and every writer it wraps, out to the
+// one from net/http, following Unwrap.
+func eachResponseWriter(w http.ResponseWriter, f func(http.ResponseWriter)) {
+	for w != nil {
+		f(w)
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// responseCommitted reports whether w, or any writer it wraps, has started
+// the response.
+func responseCommitted(w http.ResponseWriter) bool {
+	committed := false
+	eachResponseWriter(w, func(w http.ResponseWriter) {
+		if c, ok := w.(interface{ Committed() bool }); ok && c.Committed() {
+			committed = true
+		}
+	})
+	return committed
+}
+
+// reportResponseConflict logs a write dropped by w with the code that made
+// it and flags the request for the access log.
+func reportResponseConflict(w http.ResponseWriter, msg string, attrs ...any) {
+	attrs = append(attrs, slog.String("caller", conflictCaller()))
+	slog.Warn(msg, attrs...)
+	markResponseConflict(w)
+}
+
+// markResponseConflict flags a conflict on every responseWriter from w out,
+// so that the access log sees it whichever wrapper dropped the write.
+func markResponseConflict(w http.ResponseWriter) {
+	eachResponseWriter(w, func(w http.ResponseWriter) {
+		if c, ok := w.(interface{ setConflict() }); ok {
+			c.setConflict()
+		}
+	})
+}
+
+// closeResponse marks the response complete on the first writer from w out
+// that can drop later writes. Only that one: writers further out must still
+// take what a buffering wrapper such as compressWriter flushes at the end.
+func closeResponse(w http.ResponseWriter) {
+	for w != nil {
+		if c, ok := w.(interface{ close() }); ok {
+			c.close()
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// statusCode is the status sent to the client: a handler that writes
+// nothing gets an implicit 200 from net/http.
+func (rw *responseWriter) statusCode() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// statusClientClosedRequest is the status, borrowed from nginx, that
+// requests the client gave up on are logged and counted with instead of
+// whatever status had been sent before.
+const statusClientClosedRequest = 499
+
+// clientAborted reports whether the client went away before the response
+// was complete: the request context was canceled, which a server-side
+// timeout never does as it expires a context instead, or writing the
+// response hit a reset or closed connection.
+func clientAborted(r *http.Request, writeErr error) bool {
+	return errors.Is(r.Context().Err(), context.Canceled) ||
+		errors.Is(writeErr, syscall.ECONNRESET) || errors.Is(writeErr, syscall.EPIPE)
+}
+
+// RequestLogger writes a structured "HTTP Request" entry per request through
+// logger, at the level chosen by rules.
+func RequestLogger(logger *slog.Logger, rules *logRules, next http.Handler) http.Handler {
+	return requestLogger(logger, rules, true, next)
+}
+
+// SeparateRequestLogger is RequestLogger for a logger of its own, such as
+// one writing to ACCESS_LOG_FILE: entries never go through the context
+// logger, which writes to the application log.
+func SeparateRequestLogger(logger *slog.Logger, rules *logRules, next http.Handler) http.Handler {
+	return requestLogger(logger, rules, false, next)
+}
+
+func requestLogger(logger *slog.Logger, rules *logRules, fromContext bool, next http.Handler) http.Handler {
+	return AccessLog(rules, func(r *http.Request, level slog.Level, e accessEntry) {
+		// The context logger, when there is one, already carries the
+		// request ID, method, path and client address.
+		l, ok := r.Context().Value(loggerKey{}).(*slog.Logger)
+		if !ok || !fromContext {
+			l = logger.With(requestLogAttrs(r)...)
+		}
+
+		attrs := []any{
+			slog.String("proto", r.Proto),
+			slog.Int("status", e.status),
+			slog.String("user_agent", r.UserAgent()),
+			slog.Duration("duration", e.duration),
+			slog.Int64("bytes", e.size),
+		}
+		attrs = appendNonEmpty(attrs, "query", e.query)
+		attrs = appendNonEmpty(attrs, "host", r.Host)
+		attrs = appendNonEmpty(attrs, "referer", r.Referer())
+		attrs = appendNonEmpty(attrs, "content_type", r.Header.Get("Content-Type"))
+		attrs = appendNonEmpty(attrs, "response_content_type", e.contentType)
+		attrs = appendNonEmpty(attrs, "range", r.Header.Get("Range"))
+		attrs = appendNonEmpty(attrs, "api_method", e.apiMethod)
+		attrs = appendNonEmpty(attrs, "cache", e.cache)
+		attrs = appendNonEmpty(attrs, "error", e.err)
+		attrs = appendNonEmpty(attrs, "client_cn", e.clientCN)
+		attrs = appendNonEmpty(attrs, "instance", e.instance)
+		if r.ContentLength > 0 {
+			attrs = append(attrs, slog.Int64("content_length", r.ContentLength))
+		}
+		if r.TLS != nil {
+			attrs = append(attrs, slog.Group("tls",
+				slog.String("version", tls.VersionName(r.TLS.Version)),
+				slog.String("cipher", tls.CipherSuiteName(r.TLS.CipherSuite)),
+			))
+		}
+		if e.user != "" {
+			attrs = append(attrs, slog.String("user", e.user))
+		}
+		if cr := e.contentRange; cr != nil {
+			switch {
+			case cr.multipart:
+				attrs = append(attrs, slog.Bool("range_multipart", true))
+			case cr.unsatisfiable:
+				attrs = append(attrs, slog.Bool("range_unsatisfiable", true))
+			default:
+				attrs = append(attrs, slog.Int64("range_start", cr.start), slog.Int64("range_end", cr.end))
+			}
+			if cr.total >= 0 {
+				attrs = append(attrs, slog.Int64("range_total", cr.total))
+			}
+		}
+		if e.headLength >= 0 {
+			attrs = append(attrs, slog.Int64("response_content_length", e.headLength))
+		}
+		if e.bodyBytes >= 0 {
+			attrs = append(attrs, slog.Int64("body_bytes", e.bodyBytes))
+		}
+		if e.upstream.Attempts > 0 {
+			attrs = append(attrs,
+				slog.Int("upstream_attempts", e.upstream.Attempts),
+				slog.Duration("upstream_duration", e.upstream.Latency),
+			)
+		}
+		if e.upstream.Throttled > 0 {
+			attrs = append(attrs, slog.Duration("upstream_throttled", e.upstream.Throttled))
+		}
+		if e.slow {
+			attrs = append(attrs, slog.Bool("slow", true))
+		}
+		if e.writeTimeout {
+			attrs = append(attrs, slog.Bool("write_timeout", true))
+		}
+		if e.clientAborted {
+			attrs = append(attrs, slog.Bool("client_aborted", true))
+			if e.writtenStatus != 0 {
+				attrs = append(attrs, slog.Int("written_status", e.writtenStatus))
+			}
+		}
+		if e.responseConflict {
+			attrs = append(attrs, slog.Bool("response_conflict", true))
+		}
+		if e.handlerAborted {
+			attrs = append(attrs, slog.Bool("aborted", true))
+		}
+		if e.sampleRate > 1 {
+			attrs = append(attrs, slog.Int("sample_rate", e.sampleRate))
+		}
+
+		l.Log(r.Context(), level, "HTTP Request", attrs...)
+	}, next)
+}
+
+func appendNonEmpty(attrs []any, key, value string) []any {
+	if value == "" {
+		return attrs
+	}
+	return append(attrs, slog.String(key, value))
+}
+
+// accessEntry is what AccessLog knows about a finished request.
+type accessEntry struct {
+	start     time.Time
+	duration  time.Duration
+	status    int
+	size      int64
+	user      string
+	bodyBytes int64
+	upstream  greenapi.CallStats
+	apiMethod string
+	cache     string
+	// err is the error a HandlerE returned.
+	err string
+	// clientCN is the subject CN of the client certificate on paths under
+	// MTLS_PATHS.
+	clientCN string
+	// instance is the name of the instance of a request under
+	// /api/instances/.
+	instance string
+	// writeDeadline is the write deadline set with setWriteDeadline, zero
+	// for WRITE_TIMEOUT, and writeFailed whether writing the response
+	// failed.
+	writeDeadline time.Time
+	writeFailed   bool
+	// query is the raw query string with sensitive values redacted.
+	query       string
+	contentType string
+	// headLength is the Content-Length of a HEAD response, the size the
+	// body would have had for GET, or -1.
+	headLength   int64
+	contentRange *contentRange
+
+	// slow, writeTimeout and clientAborted are set by logRules.classify,
+	// and sampleRate by logRules.level.
+	slow          bool
+	writeTimeout  bool
+	clientAborted bool
+	// writtenStatus is the status sent before the client went away, 0 when
+	// none was.
+	writtenStatus int
+	sampleRate    int
+	// responseConflict is set when a second WriteHeader, a write after an
+	// error response or an error after the response had started was dropped.
+	responseConflict bool
+	// handlerAborted is set when the handler cut the response off with
+	// http.ErrAbortHandler.
+	handlerAborted bool
+}
+
+// serveAbortable runs next and reports whether it panicked with
+// http.ErrAbortHandler, which the caller re-panics once it is done. Other
+// panics go on as they are.
+func serveAbortable(next http.Handler, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if err, ok := rec.(error); !ok || !errors.Is(err, http.ErrAbortHandler) {
+				panic(rec)
+			}
+			aborted = true
+		}
+	}()
+	next.ServeHTTP(w, r)
+	return false
+}
+
+// AccessLog records every request served by next and, unless rules skip it,
+// passes it to log once the handler has returned. A handler that aborts the
+// response with http.ErrAbortHandler, as a broken stream does, is logged
+// too, with what it sent, before the panic goes on to net/http.
+func AccessLog(rules *logRules, log func(r *http.Request, level slog.Level, e accessEntry), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		wrapper := &responseWriter{
+			ResponseWriter: w,
+			status:         0,
+			head:           r.Method == http.MethodHead,
+		}
+		fields := &logFields{bodyBytes: -1}
+
+		aborted := serveAbortable(next, wrapper, r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, fields)))
+		if aborted {
+			defer panic(http.ErrAbortHandler)
+		}
+
+		e := accessEntry{
+			start:     start,
+			duration:  time.Since(start),
+			status:    wrapper.statusCode(),
+			size:      wrapper.size,
+			user:      fields.user,
+			bodyBytes: fields.bodyBytes,
+			upstream:  fields.upstream,
+			apiMethod: fields.apiMethod,
+			cache:     fields.cache,
+			err:       fields.err,
+			clientCN:  fields.clientCN,
+			instance:  fields.instance,
+
+			writeDeadline: fields.writeDeadline,
+
+			contentType: wrapper.Header().Get("Content-Type"),
+			headLength:  -1,
+		}
+		e.responseConflict = wrapper.conflict
+		e.handlerAborted = aborted
+		e.writeFailed = wrapper.writeErr != nil
+		if clientAborted(r, wrapper.writeErr) {
+			e.clientAborted = true
+			e.writtenStatus = wrapper.status
+		}
+		if wrapper.head {
+			if n, err := strconv.ParseInt(wrapper.Header().Get("Content-Length"), 10, 64); err == nil {
+				e.headLength = n
+			}
+		}
+		e.contentRange = newContentRange(e.status, wrapper.Header())
+		rules.classify(&e)
+		if rules.stats != nil {
+			rules.stats.observe(r.URL.Path, &e)
+		}
+		level, ok := rules.level(r.URL.Path, &e)
+		if !ok {
+			return
+		}
+		e.query = rules.query(r.URL.RawQuery)
+
+		log(r, level, e)
+	})
+}
+
+// logFields carries values that inner handlers add to the request log line.
+type logFields struct {
+	user      string
+	bodyBytes int64
+	upstream  greenapi.CallStats
+	apiMethod string
+	cache     string
+	err       string
+	clientCN  string
+	instance  string
+	// writeDeadline is the write deadline a handler moved WRITE_TIMEOUT to,
+	// zero when it did not.
+	writeDeadline time.Time
+}
+
+type logFieldsKey struct{}
+
+func setLogUser(r *http.Request, user string) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.user = user
+	}
+}
+
+// setLogAPIMethod records the GREEN-API method a proxied request went to.
+func setLogAPIMethod(r *http.Request, method string) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.apiMethod = method
+	}
+}
+
+// setLogCache records whether the response came from the GREEN-API response
+// cache: "hit" or "miss".
+func setLogCache(r *http.Request, result string) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.cache = result
+	}
+}
+
+// setLogClientCN records the subject CN of the verified client certificate.
+func setLogClientCN(r *http.Request, cn string) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.clientCN = cn
+	}
+}
+
+// setLogInstance records the name of the instance a request selected.
+func setLogInstance(r *http.Request, name string) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.instance = name
+	}
+}
+
+// setWriteDeadline is http.ResponseController.SetWriteDeadline for handlers
+// that move WRITE_TIMEOUT out of their way. The deadline is recorded, so
+// that the access log reports a write timeout only when this one passed.
+func setWriteDeadline(w http.ResponseWriter, r *http.Request, deadline time.Time) error {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.writeDeadline = deadline
+	}
+	return http.NewResponseController(w).SetWriteDeadline(deadline)
+}
+
+// setLogError records the error a HandlerE answered the request with.
+func setLogError(r *http.Request, err error) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.err = err.Error()
+	}
+}
+
+// setLogBodyBytes records how much of the request body was received; it is
+// only logged for requests rejected because of their body size.
+func setLogBodyBytes(r *http.Request, n int64) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(*logFields); ok {
+		fields.bodyBytes = n
+	}
+}
+
+func remoteAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr.String()
+	}
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "unix"
+	}
+	return r.RemoteAddr
+}
+
+// clientIP returns the client address resolved by RealIP, or the address of
+// the peer from RemoteAddr. ok is false for unix socket peers.
+func clientIP(r *http.Request) (addr netip.Addr, ok bool) {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr, true
+	}
+	return parseHostIP(r.RemoteAddr)
+}
+
+func InFlight(counter *atomic.Int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter.Add(1)
+		defer counter.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contentRange is what a 206 or 416 response says about the range served.
+type contentRange struct {
+	start, end int64
+	// total is the size of the whole file, or -1 when it is unknown.
+	total         int64
+	multipart     bool
+	unsatisfiable bool
+}
+
+// newContentRange reads the Content-Range header of a 206 or 416 response,
+// or reports a multipart/byteranges body, whose ranges are in the body
+// instead. Other responses, and headers it cannot parse, give nil.
+func newContentRange(status int, header http.Header) *contentRange {
+	switch status {
+	case http.StatusPartialContent:
+		if strings.HasPrefix(header.Get("Content-Type"), "multipart/byteranges") {
+			return &contentRange{total: -1, multipart: true}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+	default:
+		return nil
+	}
+
+	spec, ok := strings.CutPrefix(header.Get("Content-Range"), "bytes ")
+	if !ok {
+		if status == http.StatusRequestedRangeNotSatisfiable {
+			return &contentRange{total: -1, unsatisfiable: true}
+		}
+		return nil
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return nil
+	}
+	cr := &contentRange{total: -1, unsatisfiable: status == http.StatusRequestedRangeNotSatisfiable}
+	if size != "*" {
+		total, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil
+		}
+		cr.total = total
+	}
+	if cr.unsatisfiable {
+		return cr
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return nil
+	}
+	var err1, err2 error
+	cr.start, err1 = strconv.ParseInt(first, 10, 64)
+	cr.end, err2 = strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return cr
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveLogged serves a request for method and target through AccessLog and
+// returns what it would log.
+func serveLogged(t *testing.T, method, target string, h http.HandlerFunc) (*httptest.ResponseRecorder, accessEntry) {
+	t.Helper()
+	var entry accessEntry
+	logged := false
+	handler := AccessLog(newLogRules(nil, nil, false), func(r *http.Request, level slog.Level, e accessEntry) {
+		entry, logged = e, true
+	}, h)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if !logged {
+		t.Fatal("the request was not logged")
+	}
+	return rec, entry
+}
+
+// captureDefaultLog sends what goes to the default logger into the returned
+// buffer until the test ends.
+func captureDefaultLog(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return logs
+}
+
+func TestResponseWriterAccounting(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		handler        http.HandlerFunc
+		wantStatus     int
+		wantBytes      int64
+		wantHeadLength int64
+	}{
+		{
+			name:   "implicit 200 on write",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			},
+			wantStatus: http.StatusOK, wantBytes: 5, wantHeadLength: -1,
+		},
+		{
+			name:           "implicit 200 without a write",
+			method:         http.MethodGet,
+			handler:        func(w http.ResponseWriter, r *http.Request) {},
+			wantStatus:     http.StatusOK,
+			wantHeadLength: -1,
+		},
+		{
+			name:   "explicit status",
+			method: http.MethodPost,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, `{"id":1}`)
+			},
+			wantStatus: http.StatusCreated, wantBytes: 8, wantHeadLength: -1,
+		},
+		{
+			name:   "client error",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "missing", http.StatusNotFound)
+			},
+			wantStatus: http.StatusNotFound, wantBytes: int64(len("missing\n")), wantHeadLength: -1,
+		},
+		{
+			name:   "server error",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantStatus: http.StatusServiceUnavailable, wantHeadLength: -1,
+		},
+		{
+			name:   "no content",
+			method: http.MethodDelete,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			wantStatus: http.StatusNoContent, wantHeadLength: -1,
+		},
+		{
+			name:   "empty write",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(nil)
+			},
+			wantStatus: http.StatusOK, wantHeadLength: -1,
+		},
+		{
+			name:   "HEAD",
+			method: http.MethodHead,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				io.WriteString(w, "hello")
+			},
+			wantStatus: http.StatusOK, wantBytes: 0, wantHeadLength: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, e := serveLogged(t, tt.method, "/", tt.handler)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("sent status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if e.status != tt.wantStatus {
+				t.Errorf("logged status = %d, want %d", e.status, tt.wantStatus)
+			}
+			if e.size != tt.wantBytes {
+				t.Errorf("logged bytes = %d, want %d", e.size, tt.wantBytes)
+			}
+			if e.headLength != tt.wantHeadLength {
+				t.Errorf("logged HEAD length = %d, want %d", e.headLength, tt.wantHeadLength)
+			}
+			if e.responseConflict {
+				t.Error("response_conflict logged without a conflict")
+			}
+		})
+	}
+}
+
+func TestResponseWriterSuperfluousWriteHeader(t *testing.T) {
+	logs := captureDefaultLog(t)
+	rec, e := serveLogged(t, http.MethodGet, "/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "ok")
+	})
+
+	if rec.Code != http.StatusAccepted || e.status != http.StatusAccepted {
+		t.Errorf("sent %d, logged %d; want the first status %d", rec.Code, e.status, http.StatusAccepted)
+	}
+	if e.size != 2 {
+		t.Errorf("logged bytes = %d, want 2", e.size)
+	}
+	if !e.responseConflict {
+		t.Error("response_conflict not logged")
+	}
+	out := logs.String()
+	for _, want := range []string{`"msg":"Superfluous WriteHeader call"`, `"status":500`, `"sent_status":202`, `"caller":"middleware_test.go:`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("warning lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestResponseWriterInformational(t *testing.T) {
+	_, e := serveLogged(t, http.MethodGet, "/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.js>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusOK)
+	})
+	if e.status != http.StatusOK {
+		t.Errorf("logged status = %d, want 200 after 103", e.status)
+	}
+	if e.responseConflict {
+		t.Error("a 1xx response counted as a conflict")
+	}
+}
+
+func TestResponseConflicts(t *testing.T) {
+	discard := slog.New(slog.DiscardHandler)
+	tests := []struct {
+		name         string
+		handler      http.Handler
+		wantStatus   int
+		wantBody     string
+		wantConflict bool
+		wantWarning  string
+		wantCaller   string
+	}{
+		{
+			name: "handler writes after an error",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				WriteError(w, r, http.StatusBadRequest, errCodeValidation, "bad", nil)
+				if _, err := io.WriteString(w, "trailing"); err != errResponseClosed {
+					t.Errorf("write after the error = %v, want errResponseClosed", err)
+				}
+			}),
+			wantStatus: http.StatusBadRequest, wantBody: `"code":"` + errCodeValidation + `"`,
+			wantConflict: true, wantWarning: "Write after the response was complete", wantCaller: "middleware_test.go:",
+		},
+		{
+			name: "error after the handler wrote",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"ok":true}`)
+				WriteError(w, r, http.StatusInternalServerError, errCodeInternal, "late", nil)
+			}),
+			wantStatus: http.StatusOK, wantBody: `{"ok":true}`,
+			wantConflict: true, wantWarning: "Error response dropped, response already started", wantCaller: "middleware_test.go:",
+		},
+		{
+			name: "HandlerE writes and then fails",
+			handler: HandlerE(func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, "partial")
+				return errors.New("failed after writing")
+			}),
+			wantStatus: http.StatusAccepted, wantBody: "partial",
+			wantConflict: true, wantWarning: "Error response dropped, response already started",
+		},
+		{
+			name: "Recover after the handler wrote",
+			handler: Recover(discard, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "partial")
+				panic("boom")
+			})),
+			wantStatus: http.StatusOK, wantBody: "partial",
+		},
+		{
+			name: "Recover before the handler wrote",
+			handler: Recover(discard, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			})),
+			wantStatus: http.StatusInternalServerError, wantBody: `"code":"` + errCodeInternal + `"`,
+		},
+		{
+			name: "Compress drops writes after an error",
+			handler: Compress(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				WriteError(w, r, http.StatusNotFound, errCodeNotFound, "gone", nil)
+				io.WriteString(w, "trailing")
+			})),
+			wantStatus: http.StatusNotFound, wantBody: `"code":"` + errCodeNotFound + `"`,
+			wantConflict: true, wantWarning: "Write after the response was complete", wantCaller: "middleware_test.go:",
+		},
+		{
+			name: "WriteHeader after a Timeout answer",
+			handler: Timeout(time.Millisecond, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+			})),
+			wantStatus: http.StatusServiceUnavailable, wantBody: `"code":"` + errCodeRequestTimeout + `"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureDefaultLog(t)
+			rec, e := serveLogged(t, http.MethodGet, "/api/test", tt.handler.ServeHTTP)
+			if rec.Code != tt.wantStatus || e.status != tt.wantStatus {
+				t.Errorf("sent %d, logged %d; want %d", rec.Code, e.status, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %s", rec.Body, tt.wantBody)
+			}
+			if strings.Contains(rec.Body.String(), "trailing") || strings.Count(rec.Body.String(), `"error"`) > 1 {
+				t.Errorf("the body was appended to: %q", rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "partial") && strings.Contains(rec.Body.String(), `"error"`) {
+				t.Errorf("an error envelope followed the response: %q", rec.Body)
+			}
+			if e.responseConflict != tt.wantConflict {
+				t.Errorf("response_conflict = %t, want %t", e.responseConflict, tt.wantConflict)
+			}
+			out := logs.String()
+			if tt.wantWarning != "" && !strings.Contains(out, `"msg":"`+tt.wantWarning+`"`) {
+				t.Errorf("%q not logged:\n%s", tt.wantWarning, out)
+			}
+			if tt.wantCaller != "" && !strings.Contains(out, `"caller":"`+tt.wantCaller) {
+				t.Errorf("the warning does not point at %s:\n%s", tt.wantCaller, out)
+			}
+		})
+	}
+}
+
+func TestResponseCommitted(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  bool
+	}{
+		{"nothing written", func(w http.ResponseWriter) {}, false},
+		{"header only set", func(w http.ResponseWriter) { w.Header().Set("X-Test", "1") }, false},
+		{"informational", func(w http.ResponseWriter) { w.WriteHeader(http.StatusEarlyHints) }, false},
+		{"status", func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) }, true},
+		{"body", func(w http.ResponseWriter) { io.WriteString(w, "x") }, true},
+		{"flush", func(w http.ResponseWriter) { http.NewResponseController(w).Flush() }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &responseWriter{ResponseWriter: httptest.NewRecorder()}
+			// Compress buffers, so only rw sees a flush; responseCommitted
+			// has to look through it.
+			Compress(1<<20, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if responseCommitted(w) {
+					t.Error("committed before the handler wrote")
+				}
+				tt.write(w)
+				if got := responseCommitted(w); got != tt.want {
+					t.Errorf("responseCommitted through Compress = %t, want %t", got, tt.want)
+				}
+			})).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	}
+}
+
+func TestResponseWriterPassThroughRecorder(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responseWriter{ResponseWriter: rec}
+	var w http.ResponseWriter = rw
+
+	if _, ok := w.(http.Flusher); !ok {
+		t.Error("responseWriter is not an http.Flusher")
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil || !rec.Flushed {
+		t.Errorf("Flush = %v, flushed = %t", err, rec.Flushed)
+	}
+	if rw.status != http.StatusOK {
+		t.Errorf("status after Flush = %d, want 200", rw.status)
+	}
+	if _, _, err := http.NewResponseController(w).Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack on a recorder = %v, want ErrNotSupported", err)
+	}
+	if err := w.(http.Pusher).Push("/app.js", nil); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Push on a recorder = %v, want ErrNotSupported", err)
+	}
+	n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("streamed"))
+	if err != nil || n != 8 || rw.size != 8 || rec.Body.String() != "streamed" {
+		t.Errorf("ReadFrom = %d, %v; size = %d, body %q", n, err, rw.size, rec.Body)
+	}
+}
+
+func TestResponseWriterPassThroughServer(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 1<<16) // 1 MiB
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), []byte(large), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(chan accessEntry, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+		io.WriteString(w, "second")
+	})
+	mux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("responseWriter is not an http.Hijacker")
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("responseWriter is not an io.ReaderFrom")
+		}
+		f, err := os.Open(filepath.Join(dir, "large.bin"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		io.Copy(w, f)
+	})
+	mux.Handle("/static/", http.StripPrefix("/static", http.FileServer(http.Dir(dir))))
+	srv := httptest.NewServer(AccessLog(newLogRules(nil, nil, false), func(r *http.Request, level slog.Level, e accessEntry) {
+		entries <- e
+	}, mux))
+	defer srv.Close()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/flush", http.StatusOK, "firstsecond"},
+		{"/hijack", http.StatusSwitchingProtocols, "hijacked"},
+		{"/large", http.StatusOK, large},
+		{"/static/large.bin", http.StatusOK, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.wantBody {
+				t.Errorf("body is %d bytes, want %d", len(body), len(tt.wantBody))
+			}
+			e := <-entries
+			if e.status != tt.wantStatus {
+				t.Errorf("logged status = %d, want %d", e.status, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && e.size != int64(len(tt.wantBody)) {
+				t.Errorf("logged bytes = %d, want %d", e.size, len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestRequestLoggerFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		handler http.HandlerFunc
+		want    []string
+		absent  []string
+	}{
+		{
+			name: "plain GET",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Host = ""
+				return r
+			},
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			want:    []string{`"proto":"HTTP/1.1"`},
+			absent:  []string{`"host"`, `"referer"`, `"content_type"`, `"response_content_type"`, `"content_length"`, `"tls"`, `"range"`},
+		},
+		{
+			name: "request with a body",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "http://app.example.com/api/sendMessage", strings.NewReader(`{"message":"hi"}`))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Referer", "https://app.example.com/chat")
+				return r
+			},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{}`)
+			},
+			want: []string{`"host":"app.example.com"`, `"referer":"https://app.example.com/chat"`,
+				`"content_type":"application/json"`, `"response_content_type":"application/json"`, `"content_length":16`},
+			absent: []string{`"tls"`, `"range"`},
+		},
+		{
+			name: "TLS",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+				r.TLS.Version = tls.VersionTLS13
+				r.TLS.CipherSuite = tls.TLS_AES_128_GCM_SHA256
+				return r
+			},
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			want:    []string{`"tls":{"version":"TLS 1.3","cipher":"TLS_AES_128_GCM_SHA256"}`},
+		},
+		{
+			name: "partial content",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+				r.Header.Set("Range", "bytes=0-99")
+				return r
+			},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 0-99/1000")
+				w.WriteHeader(http.StatusPartialContent)
+				io.WriteString(w, strings.Repeat("x", 100))
+			},
+			want: []string{`"range":"bytes=0-99"`, `"range_start":0`, `"range_end":99`, `"range_total":1000`, `"status":206`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			RequestLogger(logger, defaultLogRules, tt.handler).ServeHTTP(httptest.NewRecorder(), tt.req())
+
+			out := logs.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %s:\n%s", want, out)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(out, absent) {
+					t.Errorf("empty field %s was logged:\n%s", absent, out)
+				}
+			}
+		})
+	}
+}
+
+func TestNewContentRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		contentType  string
+		contentRange string
+		want         *contentRange
+	}{
+		{"single range", http.StatusPartialContent, "video/mp4", "bytes 0-99/1000", &contentRange{start: 0, end: 99, total: 1000}},
+		{"unknown total", http.StatusPartialContent, "video/mp4", "bytes 100-199/*", &contentRange{start: 100, end: 199, total: -1}},
+		{"multipart", http.StatusPartialContent, "multipart/byteranges; boundary=x", "", &contentRange{total: -1, multipart: true}},
+		{"unsatisfiable", http.StatusRequestedRangeNotSatisfiable, "", "bytes */1000", &contentRange{total: 1000, unsatisfiable: true}},
+		{"unsatisfiable without header", http.StatusRequestedRangeNotSatisfiable, "", "", &contentRange{total: -1, unsatisfiable: true}},
+		{"full response", http.StatusOK, "video/mp4", "bytes 0-99/1000", nil},
+		{"missing header", http.StatusPartialContent, "video/mp4", "", nil},
+		{"not bytes", http.StatusPartialContent, "video/mp4", "items 0-9/100", nil},
+		{"bad numbers", http.StatusPartialContent, "video/mp4", "bytes a-b/1000", nil},
+		{"bad total", http.StatusPartialContent, "video/mp4", "bytes 0-99/lots", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			if tt.contentRange != "" {
+				header.Set("Content-Range", tt.contentRange)
+			}
+			got := newContentRange(tt.status, header)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerRangeRequests(t *testing.T) {
+	media := strings.Repeat("0123456789", 1000)
+	tests := []struct {
+		name       string
+		rangeSpec  string
+		wantStatus int
+		wantBytes  int
+		want       []string
+		absent     []string
+	}{
+		{"whole file", "", http.StatusOK, len(media), nil, []string{`"range_start"`, `"range_multipart"`, `"range_unsatisfiable"`}},
+		{"first bytes", "bytes=0-99", http.StatusPartialContent, 100,
+			[]string{`"range_start":0`, `"range_end":99`, `"range_total":10000`}, nil},
+		{"resumed download", "bytes=9000-", http.StatusPartialContent, 1000,
+			[]string{`"range_start":9000`, `"range_end":9999`, `"range_total":10000`}, nil},
+		{"suffix", "bytes=-10", http.StatusPartialContent, 10,
+			[]string{`"range_start":9990`, `"range_end":9999`}, nil},
+		{"multipart", "bytes=0-9,100-109", http.StatusPartialContent, -1,
+			[]string{`"range_multipart":true`}, []string{`"range_start"`}},
+		{"unsatisfiable", "bytes=20000-", http.StatusRequestedRangeNotSatisfiable, -1,
+			[]string{`"range_unsatisfiable":true`, `"range_total":10000`}, []string{`"range_start"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := startTestServer(t, func(cfg *Config) {
+				if err := os.WriteFile(filepath.Join(cfg.StaticDir, "video.mp4"), []byte(media), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			})
+			req, _ := http.NewRequest(http.MethodGet, serverURL(t, s, "http", "/video.mp4"), nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			if tt.rangeSpec != "" {
+				req.Header.Set("Range", tt.rangeSpec)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBytes >= 0 && len(body) != tt.wantBytes {
+				t.Errorf("body = %d bytes, want %d", len(body), tt.wantBytes)
+			}
+
+			var entry string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, `"msg":"HTTP Request"`) && strings.Contains(line, `"path":"/video.mp4"`) {
+					entry = line
+				}
+			}
+			// The logged bytes are what was written, not the size of the file.
+			for _, want := range append(tt.want, `"bytes":`+strconv.Itoa(len(body))) {
+				if !strings.Contains(entry, want) {
+					t.Errorf("missing %s:\n%s", want, entry)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(entry, absent) {
+					t.Errorf("unexpected %s:\n%s", absent, entry)
+				}
+			}
+		})
+	}
+}
+
+func TestClientAborted(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	<-expired.Done()
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		writeErr error
+		want     bool
+	}{
+		{"served", context.Background(), nil, false},
+		{"client canceled", canceled, nil, true},
+		{"server timeout", expired, nil, false},
+		{"connection reset", context.Background(), &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{"broken pipe", context.Background(), fmt.Errorf("copy: %w", syscall.EPIPE), true},
+		{"handler timeout", expired, http.ErrHandlerTimeout, false},
+		{"other write error", context.Background(), errors.New("disk full"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(tt.ctx, http.MethodGet, "/", nil)
+			if got := clientAborted(r, tt.writeErr); got != tt.want {
+				t.Errorf("clientAborted = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAccessLogAbortedHandler has the handler abort the response: the
+// request is logged with what it sent before the panic goes on, as the bare
+// http.ErrAbortHandler net/http keeps quiet about, and other panics pass
+// through unlogged.
+func TestAccessLogAbortedHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       any
+		wantLogged  bool
+		wantAborted bool
+	}{
+		{"ErrAbortHandler", http.ErrAbortHandler, true, true},
+		{"wrapped ErrAbortHandler", fmt.Errorf("stream: %w", http.ErrAbortHandler), true, true},
+		{"other panic", "boom", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entry accessEntry
+			logged := false
+			h := AccessLog(newLogRules(nil, nil, false), func(r *http.Request, level slog.Level, e accessEntry) {
+				entry, logged = e, true
+			}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "partial")
+				panic(tt.value)
+			}))
+			func() {
+				defer func() {
+					want := tt.value
+					if tt.wantAborted {
+						want = http.ErrAbortHandler
+					}
+					if got := recover(); got != want {
+						t.Errorf("panicked with %v, want %v", got, want)
+					}
+				}()
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, mediaPath, nil))
+			}()
+			if logged != tt.wantLogged || entry.handlerAborted != tt.wantAborted {
+				t.Fatalf("logged %t aborted %t, want %t %t", logged, entry.handlerAborted, tt.wantLogged, tt.wantAborted)
+			}
+			if logged && entry.size != int64(len("partial")) {
+				t.Errorf("logged %d bytes, want %d", entry.size, len("partial"))
+			}
+		})
+	}
+}
+
+// TestServerClientAbortedStream has a client hang up partway through a large
+// download: it is logged and counted as 499, not as a server error.
+func TestServerClientAbortedStream(t *testing.T) {
+	s, logs := startTestServer(t, func(cfg *Config) {
+		big := make([]byte, 64<<20)
+		if err := os.WriteFile(filepath.Join(cfg.StaticDir, "big.bin"), big, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, serverURL(t, s, "http", "/big.bin"), nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	var line map[string]any
+	waitFor(t, "the aborted download to be logged", func() bool {
+		for _, l := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(l, `"msg":"HTTP Request"`) && strings.Contains(l, `"path":"/big.bin"`) {
+				return json.Unmarshal([]byte(l), &line) == nil
+			}
+		}
+		return false
+	})
+	if line["client_aborted"] != true || line["status"] != float64(statusClientClosedRequest) || line["level"] != "WARN" {
+		t.Errorf("logged %v, want a 499 with client_aborted", line)
+	}
+	if written, _ := line["bytes"].(float64); written <= 0 || written >= 64<<20 {
+		t.Errorf("bytes = %v, want part of the file", line["bytes"])
+	}
+
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	var requests []string
+	for _, l := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(l, "http_requests_total{") && strings.Contains(l, `method="GET"`) && strings.Contains(l, `route="/"`) {
+			requests = append(requests, l)
+		}
+	}
+	if !slices.ContainsFunc(requests, func(l string) bool { return strings.Contains(l, `code="4xx"`) }) ||
+		slices.ContainsFunc(requests, func(l string) bool { return strings.Contains(l, `code="5xx"`) }) {
+		t.Errorf("the abort was not counted as 4xx only:\n%s", strings.Join(requests, "\n"))
+	}
+}
+
+// TestServerTimeoutNotClientAborted checks a server-side timeout keeps its
+// own status.
+func TestServerTimeoutNotClientAborted(t *testing.T) {
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.RequestTimeout = 30 * time.Millisecond
+	}))
+	if rec, _ := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	out := logs.String()
+	if strings.Contains(out, `"client_aborted":true`) || strings.Contains(out, `"status":499`) {
+		t.Errorf("a server timeout was logged as a client abort:\n%s", out)
+	}
+	if !strings.Contains(out, `"status":503`) {
+		t.Errorf("the 503 was not logged:\n%s", out)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMIMETypes are served regardless of the host's mime database, which
+// differs between distributions and is often missing entirely in containers.
+var defaultMIMETypes = MIMETypes{
+	".js":   "text/javascript; charset=utf-8",
+	".mjs":  "text/javascript; charset=utf-8",
+	".wasm": "application/wasm",
+	".json": "application/json",
+	".svg":  "image/svg+xml",
+}
+
+// MIMETypes maps file extensions to the Content-Type they are served with.
+// In the environment pairs are written as "ext=type" separated by ",", e.g.
+// ".webmanifest=application/manifest+json,.glb=model/gltf-binary".
+type MIMETypes map[string]string
+
+func (m *MIMETypes) UnmarshalText(text []byte) error {
+	types := make(MIMETypes)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ext, ctype, _ := strings.Cut(item, "=")
+		if err := types.add(ext, ctype); err != nil {
+			return err
+		}
+	}
+	*m = types
+	return nil
+}
+
+func (m *MIMETypes) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	types := make(MIMETypes, len(raw))
+	for ext, ctype := range raw {
+		if err := types.add(ext, ctype); err != nil {
+			return err
+		}
+	}
+	*m = types
+	return nil
+}
+
+func (m MIMETypes) add(ext, ctype string) error {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	ctype = strings.TrimSpace(ctype)
+	if ext == "" || ctype == "" {
+		return fmt.Errorf("invalid MIME type mapping %q, want ext=type", ext+"="+ctype)
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if _, _, err := mime.ParseMediaType(ctype); err != nil {
+		return fmt.Errorf("invalid MIME type %q for %s: %w", ctype, ext, err)
+	}
+	m[ext] = ctype
+	return nil
+}
+
+func (m MIMETypes) String() string {
+	items := make([]string, 0, len(m))
+	for ext, ctype := range m {
+		items = append(items, ext+"="+ctype)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// withDefaults returns the default types overridden by m.
+func (m MIMETypes) withDefaults() MIMETypes {
+	types := make(MIMETypes, len(defaultMIMETypes)+len(m))
+	for ext, ctype := range defaultMIMETypes {
+		types[ext] = ctype
+	}
+	for ext, ctype := range m {
+		types[ext] = ctype
+	}
+	return types
+}
+
+// Lookup returns the configured Content-Type for name, or "" to leave the
+// decision to mime.TypeByExtension and content sniffing.
+func (m MIMETypes) Lookup(name string) string {
+	return m[strings.ToLower(path.Ext(name))]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStaticMIMETypes(t *testing.T) {
+	var overrides MIMETypes
+	if err := overrides.UnmarshalText([]byte(".webmanifest=application/manifest+json, glb=model/gltf-binary,.json=application/vnd.api+json")); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"app.js":           "export {}",
+		"mod.mjs":          "export {}",
+		"app.wasm":         "\x00asm\x01\x00\x00\x00",
+		"data.json":        "{}",
+		"logo.svg":         "<svg/>",
+		"site.webmanifest": "{}",
+		"model.GLB":        "glTF",
+		"notes.unknownext": "plain words",
+		"page.unknownext2": "<!DOCTYPE html><html></html>",
+		"index.html":       "<h1>app</h1>",
+	}
+	h := newStaticHandler(http.Dir(writeStaticTree(t, files)), staticOptions{CacheRules: noCacheRules, MIMETypes: overrides.withDefaults()})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/app.js", "text/javascript; charset=utf-8"},
+		{"/mod.mjs", "text/javascript; charset=utf-8"},
+		{"/app.wasm", "application/wasm"},
+		{"/logo.svg", "image/svg+xml"},
+		{"/data.json", "application/vnd.api+json"},
+		{"/site.webmanifest", "application/manifest+json"},
+		{"/model.GLB", "model/gltf-binary"},
+		{"/notes.unknownext", "text/plain; charset=utf-8"},
+		{"/page.unknownext2", "text/html; charset=utf-8"},
+		{"/", "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := get(h, tt.target)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMIMETypesUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{"pairs", ".webmanifest=application/manifest+json,wasm=application/wasm", ".wasm=application/wasm,.webmanifest=application/manifest+json", ""},
+		{"lowercased", ".GLB=model/gltf-binary", ".glb=model/gltf-binary", ""},
+		{"empty items", ",, .a=text/plain ,", ".a=text/plain", ""},
+		{"missing type", ".a=", "", "want ext=type"},
+		{"missing extension", "=text/plain", "", "want ext=type"},
+		{"invalid type", ".a=text/", "", `invalid MIME type "text/"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m MIMETypes
+			err := m.UnmarshalText([]byte(tt.raw))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("UnmarshalText = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMIMETypesDefaultsOverridden(t *testing.T) {
+	types := MIMETypes{".js": "application/javascript"}.withDefaults()
+	if got := types.Lookup("/a/app.JS"); got != "application/javascript" {
+		t.Errorf("Lookup(.JS) = %q, want the override", got)
+	}
+	if got := types.Lookup("/a/app.wasm"); got != "application/wasm" {
+		t.Errorf("Lookup(.wasm) = %q, want the default", got)
+	}
+	if got := types.Lookup("/a/app.txt"); got != "" {
+		t.Errorf("Lookup(.txt) = %q, want it left to detection", got)
+	}
+}
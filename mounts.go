@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticMount serves Dir under the URL prefix Prefix. CacheControl, when set,
+// applies to every file of the mount instead of the global cache rules.
+type StaticMount struct {
+	Prefix       string `yaml:"prefix"`
+	Dir          string `yaml:"dir"`
+	CacheControl string `yaml:"cache_control"`
+}
+
+// StaticMounts is written as "prefix=dir" pairs separated by commas in the
+// environment, e.g. "/assets=./assets,/docs=./docs". The config file accepts
+// the same strings or mappings with prefix, dir and cache_control keys.
+type StaticMounts []StaticMount
+
+func (m *StaticMounts) UnmarshalText(text []byte) error {
+	var mounts StaticMounts
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, dir, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid static mount %q, want prefix=dir", item)
+		}
+		mount, err := newStaticMount(prefix, dir, "")
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	*m = mounts
+	return nil
+}
+
+func (m *StaticMounts) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("static mounts must be a list")
+	}
+
+	mounts := make(StaticMounts, 0, len(node.Content))
+	for _, item := range node.Content {
+		var raw StaticMount
+		if item.Kind == yaml.ScalarNode {
+			prefix, dir, ok := strings.Cut(item.Value, "=")
+			if !ok {
+				return fmt.Errorf("invalid static mount %q, want prefix=dir", item.Value)
+			}
+			raw = StaticMount{Prefix: prefix, Dir: dir}
+		} else if err := item.Decode(&raw); err != nil {
+			return err
+		}
+
+		mount, err := newStaticMount(raw.Prefix, raw.Dir, raw.CacheControl)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	*m = mounts
+	return nil
+}
+
+func (m StaticMounts) String() string {
+	items := make([]string, len(m))
+	for i, mount := range m {
+		items[i] = mount.Prefix + "=" + mount.Dir
+	}
+	return strings.Join(items, ",")
+}
+
+func newStaticMount(prefix, dir, cacheControl string) (StaticMount, error) {
+	prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+	dir = strings.TrimSpace(dir)
+
+	if !strings.HasPrefix(prefix, "/") {
+		return StaticMount{}, fmt.Errorf("static mount prefix %q must start with / and must not be the root", prefix)
+	}
+	if dir == "" {
+		return StaticMount{}, fmt.Errorf("static mount %s has no directory", prefix)
+	}
+	return StaticMount{Prefix: prefix, Dir: dir, CacheControl: strings.TrimSpace(cacheControl)}, nil
+}
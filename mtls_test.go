@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the certificate of ca into dir for MTLS_CLIENT_CA.
+func (ca *testCA) writePEM(t *testing.T, dir string) string {
+	t.Helper()
+	file := filepath.Join(dir, "client-ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue returns a client certificate for cn signed by ca.
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	ca := newTestCA(t, "internal CA")
+	tests := []struct {
+		name    string
+		file    func(t *testing.T) string
+		wantErr string
+	}{
+		{"CA certificate", func(t *testing.T) string { return ca.writePEM(t, t.TempDir()) }, ""},
+		{"missing file", func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing.pem") }, "no such file"},
+		{"not PEM", func(t *testing.T) string { return writeFile(t, "ca.pem", "not a certificate") }, "no PEM certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := loadClientCAs(tt.file(t))
+			if tt.wantErr == "" {
+				if err != nil || pool == nil {
+					t.Errorf("loadClientCAs = %v, %v", pool, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadClientCAs = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigMTLSNeedsTLS(t *testing.T) {
+	file := newTestCA(t, "internal CA").writePEM(t, t.TempDir())
+	cfg := newTestConfig(t)
+	cfg.StaticDir = t.TempDir()
+	cfg.MTLSClientCA = file
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "MTLS_CLIENT_CA needs TLS") {
+		t.Errorf("validate = %v, want MTLS_CLIENT_CA to need TLS", err)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t, "internal CA")
+	leaf, err := x509.ParseCertificate(ca.issue(t, "ops-laptop").Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}
+	unverified := &tls.ConnectionState{}
+	tests := []struct {
+		name       string
+		path       string
+		tls        *tls.ConnectionState
+		wantStatus int
+		wantCN     bool
+	}{
+		{"open path without TLS", "/", nil, http.StatusOK, false},
+		{"open path without a certificate", "/app.js", unverified, http.StatusOK, false},
+		{"protected without TLS", "/admin/config", nil, http.StatusForbidden, false},
+		{"protected without a certificate", "/admin/config", unverified, http.StatusForbidden, false},
+		{"protected exact path", "/webhook", unverified, http.StatusForbidden, false},
+		{"protected with a certificate", "/admin/config", verified, http.StatusOK, true},
+		{"webhook with a certificate", "/webhook", verified, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := ClientCertAuth(newPathMatcher([]string{"/admin/", "=/webhook"}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			rec, logs := serveErrors(context.Background(), tt.path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.TLS = tt.tls
+				h.ServeHTTP(w, r)
+			}))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := strings.Contains(logs.String(), `"client_cn":"ops-laptop"`); got != tt.wantCN {
+				t.Errorf("client_cn logged %t, want %t:\n%s", got, tt.wantCN, logs)
+			}
+			if tt.wantStatus == http.StatusForbidden && !strings.Contains(rec.Body.String(), errCodeForbidden) {
+				t.Errorf("body = %s, want the forbidden envelope", rec.Body)
+			}
+		})
+	}
+}
+
+func TestServerMTLS(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeSelfSigned(t, dir)
+	ca := newTestCA(t, "internal CA")
+	trusted := ca.issue(t, "ops-laptop")
+	untrusted := newTestCA(t, "someone else").issue(t, "intruder")
+
+	s, logs := startTestServer(t, func(cfg *Config) {
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+		cfg.MTLSClientCA = ca.writePEM(t, dir)
+		cfg.AdminToken = adminToken
+	})
+
+	tests := []struct {
+		name string
+		cert *tls.Certificate
+		// force sends cert even though the server does not ask for its CA.
+		force      bool
+		path       string
+		wantStatus int // 0 for a failed handshake
+	}{
+		{"static site without a certificate", nil, false, "/", http.StatusOK},
+		{"admin without a certificate", nil, false, "/admin/config", http.StatusForbidden},
+		{"webhook without a certificate", nil, false, "/webhook", http.StatusForbidden},
+		{"static site with a certificate", &trusted, false, "/", http.StatusOK},
+		{"admin with a certificate", &trusted, false, "/admin/config", http.StatusOK},
+		// The client keeps back a certificate from a CA the server did not
+		// list, and goes on without one.
+		{"untrusted certificate kept back, static site", &untrusted, false, "/", http.StatusOK},
+		{"untrusted certificate kept back, admin", &untrusted, false, "/admin/config", http.StatusForbidden},
+		{"untrusted certificate sent", &untrusted, true, "/", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{RootCAs: pool}
+			switch {
+			case tt.force:
+				tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return tt.cert, nil }
+			case tt.cert != nil:
+				tlsConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			defer client.CloseIdleConnections()
+
+			method := http.MethodGet
+			if tt.path == "/webhook" {
+				method = http.MethodPost
+			}
+			req, _ := http.NewRequest(method, serverURL(t, s, "https", tt.path), strings.NewReader("{}"))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			resp, err := client.Do(req)
+			if err == nil && tt.wantStatus == 0 {
+				// Under TLS 1.3 the server rejects the certificate after
+				// the client has finished its side of the handshake.
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if tt.wantStatus == 0 {
+				if err == nil {
+					t.Fatalf("got %d, want the handshake to fail", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, `"path":"/admin/config"`) || !strings.Contains(out, `"client_cn":"ops-laptop"`) {
+		t.Errorf("the client CN was not logged for the admin request:\n%s", out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, `"msg":"HTTP Request"`) && strings.Contains(line, `"path":"/"`) && strings.Contains(line, "client_cn") {
+			t.Errorf("client_cn logged on an open route: %s", line)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// wsWriteTimeout bounds a single write to a stream client.
+const wsWriteTimeout = 10 * time.Second
+
+// notificationHub pushes every notification dispatched by the webhook or
+// the poller to the browsers connected to /ws or /events. Each client has a
+// bounded buffer; one that falls behind by more than that is disconnected
+// rather than slowing down the others or the notification workers. The
+// latest events are kept for /events clients that reconnect.
+type notificationHub struct {
+	bufferSize   int
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	checkOrigin  func(*http.Request) bool
+	heartbeat    time.Duration
+
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+	// lastID is the ID of the latest event; event id is kept in
+	// replay[id%len(replay)] until it is overwritten.
+	lastID uint64
+	replay []streamEvent
+
+	dropped atomic.Int64
+}
+
+// streamEvent is a notification as it is streamed, numbered in the order
+// it was published.
+type streamEvent struct {
+	id     uint64
+	chatID string
+	data   []byte
+}
+
+// streamClient is one /ws or /events connection. send is only closed by
+// the hub, under its lock, when the client is removed.
+type streamClient struct {
+	chatID string
+	send   chan streamEvent
+	// closeCode is why the hub removed the client, sent in the close frame
+	// of a WebSocket.
+	closeCode   int
+	closeReason string
+}
+
+// hubOptions configure a notificationHub.
+type hubOptions struct {
+	BufferSize   int
+	ReplaySize   int
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	Heartbeat    time.Duration
+	CheckOrigin  func(*http.Request) bool
+}
+
+func newNotificationHub(opts hubOptions) *notificationHub {
+	return &notificationHub{
+		bufferSize:   opts.BufferSize,
+		pingInterval: opts.PingInterval,
+		pongTimeout:  opts.PongTimeout,
+		heartbeat:    opts.Heartbeat,
+		checkOrigin:  opts.CheckOrigin,
+		clients:      make(map[*streamClient]struct{}),
+		replay:       make([]streamEvent, opts.ReplaySize),
+	}
+}
+
+// notificationChatID is the chat a notification is about, if any.
+func notificationChatID(n *greenapi.Notification) string {
+	if n.SenderData != nil {
+		return n.SenderData.ChatID
+	}
+	return n.ChatID
+}
+
+// publish queues n for every client whose filter matches. It never blocks.
+func (h *notificationHub) publish(n *greenapi.Notification) {
+	// A message or a data line of an event has to be one line.
+	var data bytes.Buffer
+	if err := json.Compact(&data, n.Raw); err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	ev := streamEvent{id: h.lastID, chatID: notificationChatID(n), data: data.Bytes()}
+	if len(h.replay) > 0 {
+		h.replay[ev.id%uint64(len(h.replay))] = ev
+	}
+
+	for c := range h.clients {
+		if !c.wants(ev) {
+			continue
+		}
+		select {
+		case c.send <- ev:
+		default:
+			h.dropped.Add(1)
+			h.remove(c, wsClosePolicy, "client too slow")
+		}
+	}
+}
+
+// Connections returns the number of connected clients.
+func (h *notificationHub) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+func (c *streamClient) wants(ev streamEvent) bool {
+	return c.chatID == "" || c.chatID == ev.chatID
+}
+
+// subscribe adds a client for chatID, or for every chat when it is empty.
+// With replay set it also returns the kept events after lastID that the
+// client wants, so nothing published in between is missed or repeated. It
+// reports false once the hub is closed.
+func (h *notificationHub) subscribe(chatID string, lastID uint64, replay bool) (*streamClient, []streamEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false
+	}
+
+	c := &streamClient{chatID: chatID, send: make(chan streamEvent, h.bufferSize)}
+	var missed []streamEvent
+	if replay && lastID < h.lastID {
+		first := lastID + 1
+		if kept := uint64(len(h.replay)); h.lastID-lastID > kept {
+			first = h.lastID - kept + 1
+		}
+		for id := first; id <= h.lastID; id++ {
+			if ev := h.replay[id%uint64(len(h.replay))]; c.wants(ev) {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	h.clients[c] = struct{}{}
+	h.wg.Add(1)
+	return c, missed, true
+}
+
+// unsubscribe removes c once its connection has ended.
+func (h *notificationHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c, wsCloseNormal, "")
+	h.wg.Done()
+}
+
+// remove must be called with h.mu held.
+func (h *notificationHub) remove(c *streamClient, code int, reason string) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// Close sends a close frame to every client and waits for the connections
+// to end, or for ctx to expire. Clients connecting afterwards are refused.
+func (h *notificationHub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	for c := range h.clients {
+		h.remove(c, wsCloseGoingAway, "server shutting down")
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and streams notifications
+// to it as JSON text messages until either side closes. The chatId query
+// parameter limits the stream to notifications about that chat. The
+// connection is served after ServeHTTP returns, so it holds no concurrency
+// slot and is not counted as a request in flight.
+func (h *notificationHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var chatID string
+	if raw := r.URL.Query().Get("chatId"); raw != "" {
+		var err error
+		if chatID, err = normalizeChatID(raw, ""); err != nil {
+			var v validation
+			v.check("chatId", err)
+			writeValidationError(w, r, v.errs)
+			return
+		}
+	}
+
+	conn, ok := acceptWebSocket(w, r, h.checkOrigin)
+	if !ok {
+		return
+	}
+	c, _, ok := h.subscribe(chatID, 0, false)
+	if !ok {
+		conn.writeClose(wsCloseGoingAway, "server shutting down", wsWriteTimeout)
+		conn.Close()
+		return
+	}
+
+	logger := LoggerFromContext(r.Context()).With(slog.String("chat_id", chatID))
+	logger.Debug("Notification stream opened")
+	go h.serve(conn, c, logger)
+}
+
+func (h *notificationHub) serve(conn *wsConn, c *streamClient, logger *slog.Logger) {
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- h.read(conn)
+	}()
+	err := h.write(conn, c, readDone)
+
+	conn.Close()
+	h.unsubscribe(c)
+
+	if c.closeCode == wsClosePolicy {
+		logger.Warn("Notification stream client too slow, disconnected", slog.Int("buffer", h.bufferSize))
+	}
+	if err != nil && !isStreamClosed(err) {
+		logger.Debug("Notification stream closed", slog.Any("error", err))
+		return
+	}
+	logger.Debug("Notification stream closed")
+}
+
+// read handles frames from the client; a client that stops answering pings
+// for pongTimeout is given up.
+func (h *notificationHub) read(conn *wsConn) error {
+	extend := func() {
+		conn.setReadDeadline(time.Now().Add(h.pingInterval + h.pongTimeout))
+	}
+	extend()
+	return conn.readControl(extend, wsWriteTimeout)
+}
+
+// write sends queued notifications and pings until the hub removes the
+// client or the reader ends. After a close frame it waits up to pongTimeout
+// for the client's answer, which ends the reader.
+func (h *notificationHub) write(conn *wsConn, c *streamClient, readDone <-chan error) error {
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-c.send:
+			if !ok {
+				conn.writeClose(c.closeCode, c.closeReason, wsWriteTimeout)
+				select {
+				case <-readDone:
+				case <-time.After(h.pongTimeout):
+				}
+				return nil
+			}
+			if err := conn.writeText(ev.data, wsWriteTimeout); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := conn.ping(wsWriteTimeout); err != nil {
+				return err
+			}
+		case err := <-readDone:
+			return err
+		}
+	}
+}
+
+// isStreamClosed reports whether err is an ordinary end of a stream
+// connection rather than a failure worth logging.
+func isStreamClosed(err error) bool {
+	var closeErr *wsCloseError
+	return errors.As(err, &closeErr) && closeErr.remote ||
+		errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, errWSClosed)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// wsTestConn is the client side of a WebSocket connection opened by wsDial.
+type wsTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// wsDial opens a WebSocket to rawURL with header added to the handshake.
+// When the server does not switch protocols the connection is nil and the
+// response tells why.
+func wsDial(t *testing.T, rawURL string, header http.Header) (*wsTestConn, *http.Response) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+u.Host+u.RequestURI(), nil)
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Accept", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	return &wsTestConn{t: t, conn: conn, br: br}, resp
+}
+
+// read returns the next frame from the server, waiting up to timeout.
+func (c *wsTestConn) read(timeout time.Duration) (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 != 0 {
+		c.t.Error("the server masked a frame")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return head[0] & 0x0F, payload, nil
+}
+
+// readData returns the next text message, skipping pings.
+func (c *wsTestConn) readData(timeout time.Duration) (string, error) {
+	for {
+		opcode, payload, err := c.read(timeout)
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case wsOpPing:
+			continue
+		case wsOpText:
+			return string(payload), nil
+		default:
+			return "", fmt.Errorf("got opcode %#x %q, want a text message", opcode, payload)
+		}
+	}
+}
+
+// readClose skips messages up to the close frame and returns its code and
+// reason.
+func (c *wsTestConn) readClose(timeout time.Duration) (int, string) {
+	c.t.Helper()
+	for {
+		opcode, payload, err := c.read(timeout)
+		if err != nil {
+			c.t.Fatalf("no close frame: %v", err)
+		}
+		if opcode == wsOpClose {
+			if len(payload) < 2 {
+				c.t.Fatalf("close frame %q without a code", payload)
+			}
+			return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		}
+	}
+}
+
+// write sends one masked frame.
+func (c *wsTestConn) write(opcode byte, payload []byte) {
+	c.t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// newTestHub serves /ws and /events of a hub on a test server.
+func newTestHub(t *testing.T, mutate func(*hubOptions)) (*notificationHub, *httptest.Server) {
+	t.Helper()
+	opts := hubOptions{BufferSize: 8, PingInterval: time.Minute, PongTimeout: time.Second, Heartbeat: time.Minute, CheckOrigin: sameOrigin}
+	if mutate != nil {
+		mutate(&opts)
+	}
+	hub := newNotificationHub(opts)
+	mux := http.NewServeMux()
+	mux.Handle("GET /ws", hub)
+	mux.HandleFunc("GET "+eventsPath, hub.Events)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Close(ctx)
+		srv.Close()
+	})
+	return hub, srv
+}
+
+// waitConnections waits until hub has n clients.
+func waitConnections(t *testing.T, hub *notificationHub, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d stream connections", n), func() bool { return hub.Connections() == n })
+}
+
+// chatNotification is an incoming message from chatID, its JSON spread
+// over lines as a webhook may post it.
+func chatNotification(chatID, idMessage string) *greenapi.Notification {
+	raw := fmt.Sprintf("{\"typeWebhook\":\"incomingMessageReceived\",\n  \"idMessage\":%q,\n  \"senderData\":{\"chatId\":%q}}", idMessage, chatID)
+	return &greenapi.Notification{
+		TypeWebhook: "incomingMessageReceived",
+		IDMessage:   idMessage,
+		SenderData:  &greenapi.SenderData{ChatID: chatID},
+		Raw:         json.RawMessage(raw),
+	}
+}
+
+func TestNotificationStream(t *testing.T) {
+	const alice, bob = "79001234567@c.us", "79007654321@c.us"
+	published := []*greenapi.Notification{
+		chatNotification(alice, "A1"),
+		chatNotification(bob, "B1"),
+		{TypeWebhook: "outgoingMessageStatus", ChatID: bob, Raw: json.RawMessage(`{"typeWebhook":"outgoingMessageStatus","chatId":"79007654321@c.us","idMessage":"B2"}`)},
+		{TypeWebhook: "stateInstanceChanged", Raw: json.RawMessage(`{"typeWebhook":"stateInstanceChanged","idMessage":"S1"}`)},
+		chatNotification(alice, "A2"),
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"every chat", "", []string{"A1", "B1", "B2", "S1", "A2"}},
+		{"one chat", "?chatId=" + alice, []string{"A1", "A2"}},
+		{"status of an outgoing message", "?chatId=" + bob, []string{"B1", "B2"}},
+		{"phone number", "?chatId=79007654321", []string{"B1", "B2"}},
+		{"chat without notifications", "?chatId=79000000000@c.us", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, srv := newTestHub(t, nil)
+			c, resp := wsDial(t, srv.URL+"/ws"+tt.query, nil)
+			if c == nil {
+				t.Fatalf("handshake: %s", resp.Status)
+			}
+			waitConnections(t, hub, 1)
+			for _, n := range published {
+				hub.publish(n)
+			}
+			// A marker in every chat ends each stream.
+			for _, chatID := range []string{alice, bob, "79000000000@c.us"} {
+				hub.publish(chatNotification(chatID, "END"))
+			}
+
+			var got []string
+			for {
+				data, err := c.readData(5 * time.Second)
+				if err != nil {
+					t.Fatalf("after %v: %v", got, err)
+				}
+				if strings.Contains(data, "\n") {
+					t.Errorf("message spans lines: %q", data)
+				}
+				var msg struct {
+					IDMessage string `json:"idMessage"`
+				}
+				if err := json.Unmarshal([]byte(data), &msg); err != nil {
+					t.Fatalf("message %q: %v", data, err)
+				}
+				if msg.IDMessage == "END" {
+					break
+				}
+				got = append(got, msg.IDMessage)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationStreamHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+		wantCode   string
+	}{
+		{"same origin", "/ws", http.Header{"Origin": {"http://HOST"}}, http.StatusSwitchingProtocols, ""},
+		{"other origin", "/ws", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden, errCodeForbidden},
+		{"old version", "/ws", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusBadRequest, errCodeInvalidHandshake},
+		{"invalid key", "/ws", http.Header{"Sec-Websocket-Key": {"c2hvcnQ="}}, http.StatusBadRequest, errCodeInvalidHandshake},
+		{"no upgrade", "/ws", http.Header{"Upgrade": {"h2c"}}, http.StatusUpgradeRequired, errCodeUpgradeRequired},
+		{"invalid chatId", "/ws?chatId=abc", nil, http.StatusBadRequest, errCodeValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, srv := newTestHub(t, nil)
+			if origin := tt.header.Get("Origin"); origin != "" {
+				tt.header.Set("Origin", strings.Replace(origin, "HOST", strings.TrimPrefix(srv.URL, "http://"), 1))
+			}
+			c, resp := wsDial(t, srv.URL+tt.path, tt.header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if c != nil {
+				waitConnections(t, hub, 1)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("body = %s, want %s", body, tt.wantCode)
+			}
+			if hub.Connections() != 0 {
+				t.Errorf("%d clients after a refused handshake", hub.Connections())
+			}
+		})
+	}
+}
+
+func TestNotificationStreamKeepalive(t *testing.T) {
+	tests := []struct {
+		name      string
+		answer    bool
+		wantAlive bool
+	}{
+		{"answers pings", true, true},
+		{"stops answering", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, srv := newTestHub(t, func(o *hubOptions) {
+				o.PingInterval = 50 * time.Millisecond
+				o.PongTimeout = 100 * time.Millisecond
+			})
+			c, _ := wsDial(t, srv.URL+"/ws", nil)
+			waitConnections(t, hub, 1)
+
+			pings := 0
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				opcode, payload, err := c.read(time.Until(deadline))
+				if err != nil {
+					if tt.wantAlive && !errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Fatalf("after %d pings: %v", pings, err)
+					}
+					break
+				}
+				if opcode != wsOpPing {
+					t.Fatalf("got opcode %#x, want pings", opcode)
+				}
+				pings++
+				if tt.answer {
+					c.write(wsOpPong, payload)
+				}
+			}
+			if pings < 2 {
+				t.Errorf("got %d pings in 500ms with a 50ms interval", pings)
+			}
+			if tt.wantAlive {
+				if hub.Connections() != 1 {
+					t.Fatal("a client answering pings was disconnected")
+				}
+				// The server answers pings from the client too.
+				c.write(wsOpPing, []byte("hi"))
+				for {
+					opcode, payload, err := c.read(time.Second)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if opcode == wsOpPong {
+						if string(payload) != "hi" {
+							t.Errorf("pong %q, want the ping's payload", payload)
+						}
+						break
+					}
+				}
+				return
+			}
+			if _, _, err := c.read(time.Second); !errors.Is(err, io.EOF) {
+				t.Errorf("read = %v, want the connection closed", err)
+			}
+			waitConnections(t, hub, 0)
+		})
+	}
+}
+
+func TestNotificationStreamSlowConsumer(t *testing.T) {
+	hub, srv := newTestHub(t, func(o *hubOptions) { o.BufferSize = 1 })
+	slow, _ := wsDial(t, srv.URL+"/ws", nil)
+	fast, _ := wsDial(t, srv.URL+"/ws?chatId=79007654321@c.us", nil)
+	waitConnections(t, hub, 2)
+
+	// The writer of the slow client blocks on a message the socket buffers
+	// cannot hold while it reads nothing, so the next ones overflow its
+	// buffer.
+	big := strings.Repeat("x", 1<<20)
+	for i := 0; i < 256 && hub.dropped.Load() == 0; i++ {
+		hub.publish(chatNotification("79001234567@c.us", fmt.Sprintf("%d%s", i, big)))
+	}
+	waitConnections(t, hub, 1)
+	if hub.dropped.Load() != 1 {
+		t.Errorf("dropped = %d, want 1", hub.dropped.Load())
+	}
+
+	code, reason := slow.readClose(10 * time.Second)
+	if code != wsClosePolicy || reason != "client too slow" {
+		t.Errorf("close %d %q, want %d client too slow", code, reason, wsClosePolicy)
+	}
+
+	// The other client is not held up.
+	hub.publish(chatNotification("79007654321@c.us", "B1"))
+	if data, err := fast.readData(5 * time.Second); err != nil || !strings.Contains(data, `"B1"`) {
+		t.Errorf("fast client got %q, %v", data, err)
+	}
+}
+
+func TestNotificationStreamClose(t *testing.T) {
+	hub, srv := newTestHub(t, nil)
+	clients := make([]*wsTestConn, 3)
+	for i := range clients {
+		clients[i], _ = wsDial(t, srv.URL+"/ws", nil)
+	}
+	waitConnections(t, hub, len(clients))
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- hub.Close(ctx)
+	}()
+	for i, c := range clients {
+		code, reason := c.readClose(5 * time.Second)
+		if code != wsCloseGoingAway || reason != "server shutting down" {
+			t.Errorf("client %d: close %d %q, want %d server shutting down", i, code, reason, wsCloseGoingAway)
+		}
+		// Answering the close frame ends the connection without waiting
+		// for the pong timeout.
+		c.write(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway))
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	if hub.Connections() != 0 {
+		t.Errorf("%d clients after Close", hub.Connections())
+	}
+
+	late, resp := wsDial(t, srv.URL+"/ws", nil)
+	if late == nil {
+		t.Fatalf("handshake after Close: %s", resp.Status)
+	}
+	if code, _ := late.readClose(5 * time.Second); code != wsCloseGoingAway {
+		t.Errorf("a client connecting after Close got close %d", code)
+	}
+}
+
+func TestNotificationStreamThroughServer(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c, resp := wsDial(t, serverURL(t, s, "ws", "/ws?chatId=79007654321@c.us"), nil)
+	if c == nil {
+		t.Fatalf("handshake through the middleware: %s", resp.Status)
+	}
+	// Ending the connection first keeps the shutdown from waiting for it.
+	t.Cleanup(func() { c.conn.Close() })
+	waitFor(t, "the stream connection", func() bool {
+		return strings.Contains(serve(s, http.MethodGet, "/metrics", nil).Body.String(), "\nws_connections 1\n")
+	})
+
+	body := `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":1700000000,"idMessage":"BAE5","senderData":{"chatId":"79007654321@c.us","sender":"79007654321@c.us"}}`
+	post, err := http.Post(serverURL(t, s, "http", "/webhook"), "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusOK {
+		t.Fatalf("webhook: %s", post.Status)
+	}
+	if data, err := c.readData(5 * time.Second); err != nil || !strings.Contains(data, `"idMessage":"BAE5"`) {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// outboundKeepAlive is the TCP keep-alive period of connections to
+// GREEN-API, as in http.DefaultTransport.
+const outboundKeepAlive = 30 * time.Second
+
+// proxyEnvVars are read by http.ProxyFromEnvironment when OUTBOUND_PROXY_URL
+// is not set.
+var proxyEnvVars = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
+
+// newOutboundTransport builds the transport every GREEN-API client shares,
+// so that they share its connection pool too.
+func newOutboundTransport(cfg *Config) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.OutboundProxyURL != "" {
+		u, err := parseProxyURL(cfg.OutboundProxyURL, false)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.OutboundDialTimeout, KeepAlive: outboundKeepAlive}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	t.DialContext = dialer.DialContext
+	t.MaxIdleConnsPerHost = cfg.OutboundMaxIdleConnsPerHost
+	t.MaxIdleConns = max(t.MaxIdleConns, cfg.OutboundMaxIdleConnsPerHost)
+	t.IdleConnTimeout = cfg.OutboundIdleConnTimeout
+	t.TLSHandshakeTimeout = cfg.OutboundTLSHandshakeTimeout
+	if cfg.OutboundHTTP1 {
+		// A non-nil empty TLSNextProto is how net/http is told not to
+		// negotiate HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t, nil
+}
+
+// parseProxyURL parses a proxy URL the way the transport will use it. With
+// bare, as for HTTPS_PROXY, "host:port" is taken for an http proxy.
+func parseProxyURL(raw string, bare bool) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if bare && (err != nil || u.Scheme == "" || u.Host == "") {
+		if withScheme, err2 := url.Parse("http://" + raw); err2 == nil {
+			u, err = withScheme, nil
+		}
+	}
+	if err != nil {
+		// Not the url.Error itself: its message repeats the URL, password
+		// included.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy URL must be http, https, socks5 or socks5h, got %q", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL has no host: %q", u.Redacted())
+	}
+	return u, nil
+}
+
+// checkProxyEnv reports the first proxy environment variable that would
+// make every GREEN-API call fail.
+func checkProxyEnv() error {
+	for _, name := range proxyEnvVars {
+		if value := os.Getenv(name); value != "" {
+			if _, err := parseProxyURL(value, true); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
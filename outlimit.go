@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+	"gopkg.in/yaml.v3"
+)
+
+// MethodLimits are the outbound budgets of GREEN-API methods. In the
+// environment they are written as "method=calls/period[/interval]" separated
+// by ",", e.g. "sendMessage=20/1m/3s,*=300/1m": at most calls per period,
+// and at least interval between two calls. "*" covers the other methods.
+type MethodLimits map[string]greenapi.Budget
+
+func (l *MethodLimits) UnmarshalText(text []byte) error {
+	limits := make(MethodLimits)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		method, budget, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid method limit %q, want method=calls/period", item)
+		}
+		if err := limits.add(method, budget); err != nil {
+			return err
+		}
+	}
+	*l = limits
+	return nil
+}
+
+func (l *MethodLimits) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	limits := make(MethodLimits, len(raw))
+	for method, budget := range raw {
+		if err := limits.add(method, budget); err != nil {
+			return err
+		}
+	}
+	*l = limits
+	return nil
+}
+
+func (l MethodLimits) add(method, budget string) error {
+	method = strings.TrimSpace(method)
+	if method == "" {
+		return fmt.Errorf("invalid method limit %q, the method is empty", budget)
+	}
+	parts := strings.Split(strings.TrimSpace(budget), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("invalid limit %q for %s, want calls/period or calls/period/interval", budget, method)
+	}
+
+	var b greenapi.Budget
+	var err error
+	if b.Calls, err = strconv.Atoi(parts[0]); err != nil || b.Calls < 0 {
+		return fmt.Errorf("invalid call count %q for %s, want a non-negative integer", parts[0], method)
+	}
+	if b.Per, err = parseLimitPeriod(parts[1]); err != nil || b.Per <= 0 {
+		return fmt.Errorf("invalid period %q for %s, want a positive duration such as 1m", parts[1], method)
+	}
+	if len(parts) == 3 {
+		if b.MinInterval, err = time.ParseDuration(parts[2]); err != nil || b.MinInterval < 0 {
+			return fmt.Errorf("invalid interval %q for %s, want a duration such as 3s", parts[2], method)
+		}
+	}
+	l[method] = b
+	return nil
+}
+
+// parseLimitPeriod accepts a bare unit as one of it, so "20/m" reads as
+// twenty a minute.
+func parseLimitPeriod(s string) (time.Duration, error) {
+	switch s {
+	case "s", "m", "h":
+		s = "1" + s
+	}
+	return time.ParseDuration(s)
+}
+
+func (l MethodLimits) String() string {
+	items := make([]string, 0, len(l))
+	for method, budget := range l {
+		items = append(items, method+"="+budget.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestMethodLimitsUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"sendMessage=20/1m/3s,*=300/1m", "*=300/1m0s,sendMessage=20/1m0s/3s", ""},
+		{" sendMessage = 20/m , ", "sendMessage=20/1m0s", ""},
+		{"getSettings=0/1s", "getSettings=0/1s", ""},
+		{"", "", ""},
+		{"sendMessage", "", "want method=calls/period"},
+		{"=1/1m", "", "the method is empty"},
+		{"sendMessage=20", "", "want calls/period or calls/period/interval"},
+		{"sendMessage=-1/1m", "", "invalid call count"},
+		{"sendMessage=1/0s", "", "invalid period"},
+		{"sendMessage=1/1m/-3s", "", "invalid interval"},
+	}
+	for _, tt := range tests {
+		var l MethodLimits
+		err := l.UnmarshalText([]byte(tt.in))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: err = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || l.String() != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.in, l, err, tt.want)
+		}
+	}
+}
+
+func TestOutboundLimitAnswers429(t *testing.T) {
+	var calls atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.WriteString(w, `{"idMessage":"BAE5"}`)
+	})
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.GreenAPILimits = MethodLimits{"sendMessage": greenapi.Budget{Calls: 1, Per: time.Minute}}
+		cfg.GreenAPILimitMaxWait = 0
+	}))
+
+	const body = `{"chatId":"79001234567@c.us","message":"hi"}`
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", body, nil); rec.Code != http.StatusOK {
+		t.Fatalf("first message: %d %s", rec.Code, rec.Body)
+	}
+	rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage", body, nil)
+	if rec.Code != http.StatusTooManyRequests || envelope.Error.Code != errCodeOutboundRateLimited {
+		t.Fatalf("got %d %s, want 429 %s", rec.Code, envelope.Error.Code, errCodeOutboundRateLimited)
+	}
+	if ra := rec.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Errorf("Retry-After = %q", ra)
+	}
+	if !strings.Contains(string(envelope.Error.Details), `"retry_after":`) {
+		t.Errorf("details = %s", envelope.Error.Details)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream got %d calls, want 1", calls.Load())
+	}
+
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	if !strings.Contains(metrics, `greenapi_limiter_rejections_total{method="sendMessage"} 1`) {
+		t.Errorf("/metrics lacks the rejection:\n%s", metrics)
+	}
+}
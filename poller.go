@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+const (
+	// pollDedupWindow is how long a processed receipt is remembered, in case
+	// deleting it failed and GREEN-API delivers it again.
+	pollDedupWindow = 10 * time.Minute
+
+	pollMinBackoff = time.Second
+	pollMaxBackoff = time.Minute
+
+	// pollFinishTimeout bounds processing a notification received just
+	// before shutdown.
+	pollFinishTimeout = 5 * time.Second
+)
+
+// notificationPoller fetches notifications with ReceiveNotification for
+// deployments that cannot expose /webhook, and feeds them to the same
+// dispatcher.
+type notificationPoller struct {
+	client  *greenapi.Client
+	notifs  *notifications
+	logger  *slog.Logger
+	timeout time.Duration
+
+	// seen maps processed receipt IDs to when they were processed. Only the
+	// polling goroutine touches it.
+	seen map[int64]time.Time
+	now  func() time.Time
+}
+
+func newNotificationPoller(client *greenapi.Client, notifs *notifications, logger *slog.Logger, timeout time.Duration) *notificationPoller {
+	return &notificationPoller{
+		client:  client,
+		notifs:  notifs,
+		logger:  logger,
+		timeout: timeout,
+		seen:    make(map[int64]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Run polls until ctx is canceled. A notification received before that is
+// still dispatched and deleted; Run returns once it has been.
+func (p *notificationPoller) Run(ctx context.Context) {
+	p.logger.Info("Polling GREEN-API notifications", slog.Duration("receive_timeout", p.timeout))
+
+	backoff := pollMinBackoff
+	for ctx.Err() == nil {
+		received, err := p.client.ReceiveNotification(ctx, p.timeout)
+		if err == nil && received != nil {
+			// Finish the notification even if shutdown starts meanwhile.
+			finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pollFinishTimeout)
+			err = p.process(finishCtx, received)
+			cancel()
+		}
+		if err == nil {
+			backoff = pollMinBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		delay := backoff
+		var open *greenapi.CircuitOpenError
+		if errors.As(err, &open) {
+			delay = max(open.RetryAfter, delay)
+		} else {
+			backoff = min(backoff*2, pollMaxBackoff)
+		}
+		p.logger.Warn("Could not poll GREEN-API notifications",
+			slog.Duration("retry_in", delay),
+			slog.Any("error", err),
+		)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+	p.logger.Info("Stopped polling GREEN-API notifications")
+}
+
+// process dispatches a received notification, unless it was already
+// processed, and deletes it from the queue.
+func (p *notificationPoller) process(ctx context.Context, received *greenapi.ReceivedNotification) error {
+	now := p.now()
+	for id, at := range p.seen {
+		if now.Sub(at) >= pollDedupWindow {
+			delete(p.seen, id)
+		}
+	}
+
+	logger := p.logger.With(slog.Int64("receipt_id", received.ReceiptID))
+	if _, dup := p.seen[received.ReceiptID]; dup {
+		logger.Debug("Skipping duplicate notification")
+	} else if n, err := greenapi.ParseNotification(received.Body); err != nil || len(n.Validate()) > 0 {
+		// Redelivering a broken notification would not fix it.
+		logger.Warn("Dropping malformed notification", slog.Any("error", err))
+	} else {
+		dispatchCtx := context.WithValue(ctx, loggerKey{}, logger)
+		for !p.notifs.dispatch(dispatchCtx, n) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	p.seen[received.ReceiptID] = now
+
+	return p.client.DeleteNotification(ctx, received.ReceiptID)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// scriptedQueue is a fake GREEN-API notification queue. receiveNotification
+// answers with the next scripted response, and with null once they run out;
+// deleteNotification records the receipt IDs.
+type scriptedQueue struct {
+	mu        sync.Mutex
+	responses []scriptedResponse
+	receives  []time.Time
+	deleted   []string
+
+	// onDelete, when set, runs before a deletion is answered.
+	onDelete func()
+}
+
+type scriptedResponse struct {
+	status int
+	body   string
+}
+
+func (q *scriptedQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case strings.Contains(r.URL.Path, "/receiveNotification/"):
+		q.receives = append(q.receives, time.Now())
+		if len(q.responses) == 0 {
+			io.WriteString(w, "null")
+			return
+		}
+		resp := q.responses[0]
+		q.responses = q.responses[1:]
+		w.WriteHeader(resp.status)
+		io.WriteString(w, resp.body)
+	case strings.Contains(r.URL.Path, "/deleteNotification/"):
+		q.deleted = append(q.deleted, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		if q.onDelete != nil {
+			q.onDelete()
+		}
+		io.WriteString(w, `{"result":true}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (q *scriptedQueue) deletedIDs() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.deleted...)
+}
+
+// received is a receiveNotification answer with receipt id for a
+// notification of typeWebhook.
+func received(id int, typeWebhook string) scriptedResponse {
+	return scriptedResponse{http.StatusOK, fmt.Sprintf(
+		`{"receiptId":%d,"body":{"typeWebhook":%q,"instanceData":{"idInstance":1101},"timestamp":1700000000,"idMessage":"M%d"}}`,
+		id, typeWebhook, id)}
+}
+
+// startPoller runs a poller against q until the test ends, and returns the
+// notifications it dispatches and a function stopping it that reports once
+// Run has returned.
+func startPoller(t *testing.T, q *scriptedQueue) (<-chan *greenapi.Notification, func()) {
+	t.Helper()
+	upstream := httptest.NewServer(q)
+	t.Cleanup(upstream.Close)
+
+	notifs := newNotifications(slog.Default(), 1, 10)
+	got := recordNotifications(notifs, greenapi.WebhookIncomingMessageReceived)
+	client := greenapi.NewClient(greenapi.Endpoints{API: upstream.URL}, "1101", "secret", upstream.Client())
+	p := newNotificationPoller(client, notifs, slog.Default(), 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	stop := func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after cancel")
+		}
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		notifs.Close(context.Background())
+	})
+	return got, stop
+}
+
+// waitFor polls cond for up to 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPollerDispatchesAndDeletes(t *testing.T) {
+	q := &scriptedQueue{responses: []scriptedResponse{
+		received(1, greenapi.WebhookIncomingMessageReceived),
+		received(1, greenapi.WebhookIncomingMessageReceived), // delivered again
+		{http.StatusOK, `{"receiptId":2,"body":{"typeWebhook":"incomingMessageReceived"}}`},
+		{http.StatusOK, `{"receiptId":3,"body":"not an object"}`},
+		received(4, "somethingNew"),
+		received(5, greenapi.WebhookIncomingMessageReceived),
+	}}
+	got, stop := startPoller(t, q)
+
+	// Every receipt is deleted, the broken and unknown ones too, so that
+	// they do not come back.
+	want := "1,1,2,3,4,5"
+	waitFor(t, "the deletions", func() bool { return len(q.deletedIDs()) >= 6 })
+	// M5 comes after any second dispatch of M1.
+	waitFor(t, "the dispatches", func() bool { return len(got) >= 2 })
+	stop()
+	if deleted := strings.Join(q.deletedIDs(), ","); deleted != want {
+		t.Errorf("deleted %s, want %s", deleted, want)
+	}
+
+	var ids []string
+	for len(got) > 0 {
+		ids = append(ids, (<-got).IDMessage)
+	}
+	if strings.Join(ids, ",") != "M1,M5" {
+		t.Errorf("dispatched %v, want M1 once and M5", ids)
+	}
+}
+
+func TestPollerBacksOffOnErrors(t *testing.T) {
+	q := &scriptedQueue{responses: []scriptedResponse{
+		{http.StatusInternalServerError, ""},
+		received(1, greenapi.WebhookIncomingMessageReceived),
+	}}
+	got, _ := startPoller(t, q)
+
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notification after the error was not dispatched")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if gap := q.receives[1].Sub(q.receives[0]); gap < pollMinBackoff {
+		t.Errorf("polled again %s after an error, want at least %s", gap, pollMinBackoff)
+	}
+}
+
+func TestPollerFinishesInFlightOnShutdown(t *testing.T) {
+	q := &scriptedQueue{responses: []scriptedResponse{received(1, greenapi.WebhookIncomingMessageReceived)}}
+	stopping := make(chan struct{})
+	q.onDelete = func() {
+		// Shutdown starts while the notification is being deleted.
+		close(stopping)
+	}
+	_, stop := startPoller(t, q)
+
+	<-stopping
+	stop()
+	q.mu.Lock()
+	receives := len(q.receives)
+	q.mu.Unlock()
+	if deleted := q.deletedIDs(); len(deleted) != 1 {
+		t.Errorf("deleted %v, want receipt 1", deleted)
+	}
+	time.Sleep(20 * time.Millisecond)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.receives) != receives {
+		t.Error("the poller fetched more notifications after it returned")
+	}
+}
+
+func TestPollerDedupWindow(t *testing.T) {
+	tests := []struct {
+		name         string
+		redelivered  time.Duration
+		wantDispatch bool
+	}{
+		{"at once", 0, false},
+		{"within the window", pollDedupWindow - time.Second, false},
+		{"after the window", pollDedupWindow, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &scriptedQueue{}
+			upstream := httptest.NewServer(q)
+			defer upstream.Close()
+			notifs := newNotifications(slog.Default(), 1, 10)
+			got := recordNotifications(notifs, greenapi.WebhookIncomingMessageReceived)
+			client := greenapi.NewClient(greenapi.Endpoints{API: upstream.URL}, "1101", "secret", upstream.Client())
+			p := newNotificationPoller(client, notifs, slog.Default(), 5*time.Second)
+			now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+			p.now = func() time.Time { return now }
+
+			n := &greenapi.ReceivedNotification{ReceiptID: 7, Body: []byte(`{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":1700000000}`)}
+			if err := p.process(context.Background(), n); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(tt.redelivered)
+			if err := p.process(context.Background(), n); err != nil {
+				t.Fatal(err)
+			}
+			notifs.Close(context.Background())
+
+			wantDispatched := 1
+			if tt.wantDispatch {
+				wantDispatched = 2
+			}
+			if len(got) != wantDispatched {
+				t.Errorf("dispatched %d times, want %d", len(got), wantDispatched)
+			}
+			if len(q.deletedIDs()) != 2 {
+				t.Errorf("deleted %v, want both deliveries", q.deletedIDs())
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// QR returns the QR code that authorizes the instance, as the JSON of
+// GREEN-API or, with ?format=image, as the PNG itself. The code rotates
+// every few seconds, so neither may be cached. An instance that is already
+// authorized gets 409.
+func (g *greenAPI) QR(w http.ResponseWriter, r *http.Request) error {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "image" {
+		var v validation
+		v.add("format", "one_of", "must be json or image")
+		return validationError(v.errs)
+	}
+
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	qr, err := c.QR(ctx)
+	if err != nil {
+		return g.upstreamError(r, "qr", err)
+	}
+
+	switch qr.Type {
+	case greenapi.QRTypeCode:
+	case greenapi.QRTypeAlreadyLogged:
+		g.states.observe(c.IDInstance(), greenapi.StateAuthorized, time.Now())
+		return &HTTPError{Status: http.StatusConflict, Code: errCodeAlreadyAuthorized,
+			Message: "instance is already authorized, there is no QR code to scan"}
+	default:
+		var details map[string]string
+		if qr.Message != "" {
+			details = map[string]string{"upstream": qr.Message}
+		}
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError,
+			Message: "GREEN-API did not return a QR code", Details: details}
+	}
+
+	if format != "image" {
+		writeJSON(w, http.StatusOK, qr)
+		return nil
+	}
+	png, err := base64.StdEncoding.DecodeString(qr.Message)
+	if err != nil {
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError,
+			Message: "GREEN-API returned a QR code that is not base64", Err: err}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQR(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nqr-code")
+	code := `{"type":"qrCode","message":"` + base64.StdEncoding.EncodeToString(png) + `"}`
+	tests := []struct {
+		name       string
+		query      string
+		upstream   string
+		wantStatus int
+		wantType   string
+		wantBody   []byte
+		wantCode   string
+	}{
+		{"json", "", code, http.StatusOK, "application/json", []byte(code), ""},
+		{"json by name", "?format=json", code, http.StatusOK, "application/json", []byte(code), ""},
+		{"image", "?format=image", code, http.StatusOK, "image/png", png, ""},
+		{"already authorized", "", `{"type":"alreadyLogged","message":"instance is already authorized"}`, http.StatusConflict, "", nil, errCodeAlreadyAuthorized},
+		{"already authorized, image", "?format=image", `{"type":"alreadyLogged","message":"instance is already authorized"}`, http.StatusConflict, "", nil, errCodeAlreadyAuthorized},
+		{"upstream error", "", `{"type":"error","message":"instance is starting"}`, http.StatusBadGateway, "", nil, errCodeUpstreamError},
+		{"not base64", "?format=image", `{"type":"qrCode","message":"not base64!"}`, http.StatusBadGateway, "", nil, errCodeUpstreamError},
+		{"unknown format", "?format=svg", code, http.StatusBadRequest, "", nil, errCodeValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/qr/secret") {
+					t.Errorf("upstream got %s %s", r.Method, r.URL.Path)
+				}
+				io.WriteString(w, tt.upstream)
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			rec, envelope := callAPI(t, s, http.MethodGet, "/api/qr"+tt.query, "", nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				if envelope.Error.Code != tt.wantCode {
+					t.Errorf("code = %s, want %s", envelope.Error.Code, tt.wantCode)
+				}
+				if tt.wantStatus == http.StatusConflict && strings.Contains(rec.Body.String(), "alreadyLogged") {
+					t.Errorf("the upstream answer leaked into the error: %s", rec.Body)
+				}
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+			if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "no-store") {
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			}
+			if got := bytes.TrimSpace(rec.Body.Bytes()); !bytes.Equal(got, tt.wantBody) {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a client's bucket is kept after its last
+// request. A bucket idle for that long has refilled anyway.
+const rateLimitIdle = 5 * time.Minute
+
+type rateLimiter struct {
+	limit  rate.Limit
+	burst  int
+	exempt []string
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int, exempt []string) *rateLimiter {
+	return &rateLimiter{
+		limit:     rate.Limit(rps),
+		burst:     burst,
+		exempt:    exempt,
+		clients:   make(map[netip.Addr]*rateClient),
+		lastSweep: time.Now(),
+	}
+}
+
+// sameLimits reports whether l and other allow the same rate, burst and
+// exempt paths. A nil limiter has no limits.
+func (l *rateLimiter) sameLimits(other *rateLimiter) bool {
+	if l == nil || other == nil {
+		return l == other
+	}
+	return l.limit == other.limit && l.burst == other.burst && slices.Equal(l.exempt, other.exempt)
+}
+
+// allow takes a token from the bucket of addr. When the bucket is empty it
+// returns how long the client should wait before retrying.
+func (l *rateLimiter) allow(addr netip.Addr, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		l.sweep(now)
+	}
+
+	client, ok := l.clients[addr]
+	if !ok {
+		client = &rateClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[addr] = client
+	}
+	client.lastSeen = now
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for addr, client := range l.clients {
+		if now.Sub(client.lastSeen) > rateLimitIdle {
+			delete(l.clients, addr)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *rateLimiter) exempted(urlPath string) bool {
+	for _, prefix := range l.exempt {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit answers 429 with Retry-After once a client exceeds its token
+// bucket. Clients are keyed by IP; all unix socket peers share one bucket.
+// The limiter is the one current returns; requests pass unlimited while it
+// returns nil.
+func RateLimit(current func(*http.Request) *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := current(r)
+		if limiter == nil || limiter.exempted(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr, _ := clientIP(r)
+		if ok, retryAfter := limiter.allow(addr, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			renderError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "too many requests, slow down", nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("2001:db8::1")
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		name      string
+		addr      netip.Addr
+		at        time.Duration
+		wantOK    bool
+		wantRetry time.Duration
+	}{
+		{"first of the burst", client, 0, true, 0},
+		{"second of the burst", client, 0, true, 0},
+		{"burst spent", client, 0, false, 100 * time.Millisecond},
+		{"another client", other, 0, true, 0},
+		{"partly refilled", client, 50 * time.Millisecond, false, 50 * time.Millisecond},
+		{"refilled", client, 100 * time.Millisecond, true, 0},
+	}
+	l := newRateLimiter(10, 2, nil)
+	for _, tt := range tests {
+		ok, retry := l.allow(tt.addr, start.Add(tt.at))
+		if ok != tt.wantOK || retry != tt.wantRetry {
+			t.Errorf("%s: allow = %t, %s; want %t, %s", tt.name, ok, retry, tt.wantOK, tt.wantRetry)
+		}
+	}
+}
+
+func TestRateLimiterSweepsIdleClients(t *testing.T) {
+	l := newRateLimiter(1, 1, nil)
+	now := l.lastSweep
+	l.allow(netip.MustParseAddr("192.0.2.1"), now)
+	l.allow(netip.MustParseAddr("192.0.2.2"), now.Add(rateLimitIdle-time.Minute))
+	if len(l.clients) != 2 {
+		t.Fatalf("%d clients, want 2 before the sweep", len(l.clients))
+	}
+	l.allow(netip.MustParseAddr("192.0.2.3"), now.Add(rateLimitIdle+30*time.Second))
+	if _, ok := l.clients[netip.MustParseAddr("192.0.2.1")]; ok || len(l.clients) != 2 {
+		t.Errorf("clients after the sweep: %v, want only the idle one removed", l.clients)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	const (
+		burst      = 50
+		goroutines = 20
+		perWorker  = 25
+	)
+	// The rate is low enough that no token comes back during the test.
+	l := newRateLimiter(0.001, burst, []string{"/healthz"})
+	var accepted, limited atomic.Int64
+	h := RateLimit(func(*http.Request) *rateLimiter { return l }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted.Add(1)
+	}))
+
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				req := httptest.NewRequest(http.MethodGet, "/api/getSettings", nil)
+				req.RemoteAddr = "192.0.2.10:4321"
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code == http.StatusTooManyRequests {
+					if rec.Header().Get("Retry-After") == "" {
+						t.Error("429 without Retry-After")
+					}
+					limited.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted.Load() != burst || limited.Load() != goroutines*perWorker-burst {
+		t.Errorf("accepted %d and limited %d of %d, want exactly the burst of %d accepted",
+			accepted.Load(), limited.Load(), goroutines*perWorker, burst)
+	}
+}
+
+func TestRateLimitExemptAndDisabled(t *testing.T) {
+	l := newRateLimiter(0.001, 1, []string{"/healthz"})
+	tests := []struct {
+		name    string
+		limiter *rateLimiter
+		path    string
+		want    int
+	}{
+		{"exempt path", l, "/healthz", http.StatusNoContent},
+		{"disabled", nil, "/api/getSettings", http.StatusNoContent},
+		{"limited", l, "/api/getSettings", http.StatusTooManyRequests},
+	}
+	// The only token of the bucket is spent up front.
+	l.allow(netip.MustParseAddr("192.0.2.1"), time.Now())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := RateLimit(func(*http.Request) *rateLimiter { return tt.limiter }, noContent)
+			for range 3 {
+				rec := get(h, tt.path)
+				if rec.Code != tt.want {
+					t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+				}
+			}
+		})
+	}
+}
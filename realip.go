@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// RealIP resolves the client address for requests arriving through one of
+// the trusted proxies and stores it in the context for clientIP and the
+// request log. X-Forwarded-For is walked from the right, skipping trusted
+// hops; X-Real-IP is used when there is no X-Forwarded-For. Headers sent by
+// any other peer are ignored.
+func RealIP(trusted IPNets, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := parseHostIP(r.RemoteAddr)
+		if !ok || !trusted.contains(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if client, ok := forwardedClientIP(r.Header, trusted, peer); ok && client != peer {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, client))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func forwardedClientIP(h http.Header, trusted IPNets, peer netip.Addr) (netip.Addr, bool) {
+	if values := h.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseHostIP(strings.TrimSpace(hops[i]))
+			if !ok {
+				// Anything left of a malformed entry cannot be trusted.
+				break
+			}
+			client = hop
+			if !trusted.contains(hop) {
+				break
+			}
+		}
+		return client, true
+	}
+
+	if addr, ok := parseHostIP(strings.TrimSpace(h.Get("X-Real-IP"))); ok {
+		return addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// parseHostIP parses an address that may carry a port and brackets:
+// "10.0.0.1", "10.0.0.1:80", "::1", "[::1]" or "[::1]:80".
+func parseHostIP(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Zone() == "" {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
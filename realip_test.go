@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	var trusted IPNets
+	if err := trusted.UnmarshalText([]byte("10.0.0.0/8, 2001:db8:1::/48, 192.0.2.7")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xRealIP    string
+		want       string
+	}{
+		{"untrusted peer ignored", "203.0.113.5:1234", []string{"198.51.100.1"}, "", "203.0.113.5"},
+		{"untrusted peer X-Real-IP ignored", "203.0.113.5:1234", nil, "198.51.100.1", "203.0.113.5"},
+		{"single hop", "10.0.0.1:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"rightmost untrusted hop", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"spoofed leftmost entry", "10.0.0.1:1234", []string{"127.0.0.1, 198.51.100.1"}, "", "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.3"}, "", "198.51.100.1"},
+		{"single trusted address", "192.0.2.7:1234", []string{"198.51.100.9"}, "", "198.51.100.9"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.0.0.5, 10.0.0.4"}, "", "10.0.0.5"},
+		{"IPv6 client", "10.0.0.1:1234", []string{"2001:db8:ffff::1"}, "", "2001:db8:ffff::1"},
+		{"IPv6 proxy", "[2001:db8:1::5]:443", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"bracketed IPv6 with port", "10.0.0.1:1234", []string{"[2001:db8:ffff::1]:5000"}, "", "2001:db8:ffff::1"},
+		{"IPv4 with port", "10.0.0.1:1234", []string{"198.51.100.1:5000"}, "", "198.51.100.1"},
+		{"mapped IPv4", "10.0.0.1:1234", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1"},
+		{"malformed rightmost", "10.0.0.1:1234", []string{"198.51.100.1, garbage"}, "", "10.0.0.1"},
+		{"malformed in the middle", "10.0.0.1:1234", []string{"198.51.100.1, nope, 10.0.0.2"}, "", "10.0.0.2"},
+		{"empty entry", "10.0.0.1:1234", []string{"198.51.100.1, "}, "", "10.0.0.1"},
+		{"X-Real-IP", "10.0.0.1:1234", nil, "198.51.100.1", "198.51.100.1"},
+		{"X-Forwarded-For wins", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.2", "198.51.100.1"},
+		{"malformed X-Real-IP", "10.0.0.1:1234", nil, "not an ip", "10.0.0.1"},
+		{"zone in X-Real-IP", "10.0.0.1:1234", nil, "fe80::1%eth0", "10.0.0.1"},
+		{"no headers", "10.0.0.1:1234", nil, "", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got netip.Addr
+			h := RealIP(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = clientIP(r)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got.String() != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1:80", "10.0.0.1", true},
+		{"::1", "::1", true},
+		{"[::1]", "::1", true},
+		{"[::1]:80", "::1", true},
+		{"::ffff:10.0.0.1", "10.0.0.1", true},
+		{"", "", false},
+		{"example.com:80", "", false},
+		{"10.0.0.256", "", false},
+		{"@", "", false},
+	}
+	for _, tt := range tests {
+		addr, ok := parseHostIP(tt.in)
+		if ok != tt.ok || ok && addr.String() != tt.want {
+			t.Errorf("parseHostIP(%q) = %s, %t; want %s, %t", tt.in, addr, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRealIPInRequestLog(t *testing.T) {
+	trusted := IPNets{netip.MustParsePrefix("10.0.0.0/8")}
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	h := RealIP(trusted, RequestLogger(logger, defaultLogRules, noContent))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(logs.String(), `"remote_addr":"198.51.100.1"`) {
+		t.Errorf("the access log does not show the client address:\n%s", logs)
+	}
+}
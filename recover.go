@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+const maxStackLines = 40
+
+// Recover turns a panicking handler into a 500 response, rendered by
+// renderError, and an error log entry. http.ErrAbortHandler is re-panicked
+// so net/http can abort the connection silently, as documented.
+func Recover(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapper := &responseWriter{ResponseWriter: w}
+
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(rec)
+			}
+
+			logger.Error("Panic recovered",
+				slog.String("panic", fmt.Sprint(rec)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("request_id", RequestIDFromContext(r.Context())),
+				slog.Bool("headers_sent", wrapper.Committed()),
+				slog.String("stack", trimStack(debug.Stack())),
+			)
+
+			if !wrapper.Committed() {
+				renderError(wrapper, r, http.StatusInternalServerError, errCodeInternal, http.StatusText(http.StatusInternalServerError), nil)
+			}
+		}()
+
+		next.ServeHTTP(wrapper, r)
+	})
+}
+
+// trimStack drops the frames belonging to debug.Stack and the deferred
+// recover function so the trace starts at the panicking code.
+func trimStack(stack []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+
+	start := 1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "panic(") {
+			start = i + 2
+			break
+		}
+	}
+	if start >= len(lines) {
+		start = 1
+	}
+
+	lines = lines[start:]
+	if len(lines) > maxStackLines {
+		lines = append(lines[:maxStackLines], "...")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name            string
+		handler         http.HandlerFunc
+		wantStatus      int
+		wantBody        string
+		wantHeadersSent bool
+	}{
+		{
+			name: "before WriteHeader",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   errCodeInternal,
+		},
+		{
+			name: "after WriteHeader",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, "partial")
+				panic(fmt.Errorf("boom after %d", http.StatusAccepted))
+			},
+			wantStatus:      http.StatusAccepted,
+			wantBody:        "partial",
+			wantHeadersSent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestID(Recover(logger, tt.handler))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/sendMessage", nil)
+			req.Header.Set(requestIDHeader, "panic-1")
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+
+			var entry struct {
+				Level       string `json:"level"`
+				Msg         string `json:"msg"`
+				Panic       string `json:"panic"`
+				Method      string `json:"method"`
+				Path        string `json:"path"`
+				RequestID   string `json:"request_id"`
+				HeadersSent bool   `json:"headers_sent"`
+				Stack       string `json:"stack"`
+			}
+			if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+				t.Fatalf("log %q: %v", logs, err)
+			}
+			if entry.Level != "ERROR" || entry.Msg != "Panic recovered" || !strings.HasPrefix(entry.Panic, "boom") {
+				t.Errorf("logged %+v", entry)
+			}
+			if entry.Method != http.MethodPost || entry.Path != "/api/sendMessage" || entry.RequestID != "panic-1" {
+				t.Errorf("logged method %q, path %q, request_id %q", entry.Method, entry.Path, entry.RequestID)
+			}
+			if entry.HeadersSent != tt.wantHeadersSent {
+				t.Errorf("headers_sent = %t, want %t", entry.HeadersSent, tt.wantHeadersSent)
+			}
+			if !strings.Contains(entry.Stack, "TestRecover") || strings.Contains(entry.Stack, "runtime/debug.Stack") {
+				t.Errorf("stack does not start at the panicking code:\n%s", entry.Stack)
+			}
+		})
+	}
+}
+
+func TestRecoverRepanicsAbortHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{"ErrAbortHandler", http.ErrAbortHandler},
+		{"wrapped", fmt.Errorf("stream: %w", http.ErrAbortHandler)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			h := Recover(slog.New(slog.NewJSONHandler(logs, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic(tt.value)
+			}))
+			defer func() {
+				rec := recover()
+				err, ok := rec.(error)
+				if !ok || !errors.Is(err, http.ErrAbortHandler) {
+					t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+				}
+				if logs.String() != "" {
+					t.Errorf("an aborted handler is logged: %s", logs)
+				}
+			}()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	}
+}
+
+func TestTrimStack(t *testing.T) {
+	long := "goroutine 1 [running]:\nruntime/debug.Stack()\n\tstack.go:1\npanic({0x0})\n\tpanic.go:1\n" +
+		strings.Repeat("main.f()\n\tmain.go:1\n", maxStackLines)
+	tests := []struct {
+		name      string
+		stack     string
+		wantFirst string
+		wantLines int
+	}{
+		{"from the panic", "goroutine 1 [running]:\nruntime/debug.Stack()\n\tstack.go:1\npanic({0x0})\n\tpanic.go:1\nmain.handler()\n\tmain.go:10", "main.handler()", 2},
+		{"no panic frame", "goroutine 1 [running]:\nmain.handler()\n\tmain.go:10", "main.handler()", 2},
+		{"cut at the limit", long, "main.f()", maxStackLines + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := strings.Split(trimStack([]byte(tt.stack)), "\n")
+			if lines[0] != tt.wantFirst || len(lines) != tt.wantLines {
+				t.Errorf("got %d lines starting with %q", len(lines), lines[0])
+			}
+		})
+	}
+}
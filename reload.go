@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync/atomic"
+)
+
+// reloadableKeys are the config keys a reload applies to the running
+// server. Any other change, such as the port, TLS files or the static dir,
+// needs a restart and is logged and left as it was.
+var reloadableKeys = map[string]bool{
+	"log_level":                 true,
+	"access_log_mode":           true,
+	"x_content_type_options":    true,
+	"x_frame_options":           true,
+	"referrer_policy":           true,
+	"content_security_policy":   true,
+	"strict_transport_security": true,
+	"cache_control":             true,
+	"rate_limit_rps":            true,
+	"rate_limit_burst":          true,
+	"rate_limit_exempt":         true,
+	"allowed_hosts":             true,
+	"host_reject_status":        true,
+}
+
+// liveSettings is the part of the configuration the request path reads on
+// every request. It is never changed in place: a reload builds a new one
+// and swaps it in, so a request sees either the old settings or the new
+// ones and never a mix.
+type liveSettings struct {
+	headers    securityHeaders
+	cacheRules CacheRules
+	// rateLimit and hosts are nil when RATE_LIMIT_RPS and ALLOWED_HOSTS
+	// are not set.
+	rateLimit *rateLimiter
+	hosts     *hostPolicy
+}
+
+// newLiveSettings builds the settings for cfg. The rate limiter of previous
+// is kept when its limits did not change, so that a reload does not hand
+// every client a full bucket.
+func newLiveSettings(cfg *Config, previous *liveSettings) *liveSettings {
+	s := &liveSettings{
+		headers:    newSecurityHeaders(cfg),
+		cacheRules: cfg.CacheControl,
+	}
+	if cfg.RateLimitRPS > 0 {
+		s.rateLimit = newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.RateLimitExempt)
+		if previous != nil && previous.rateLimit.sameLimits(s.rateLimit) {
+			s.rateLimit = previous.rateLimit
+		}
+	}
+	if len(cfg.AllowedHosts) > 0 {
+		s.hosts = newHostPolicy(cfg)
+	}
+	return s
+}
+
+// reloader re-reads the configuration on SIGHUP and applies what can change
+// without a restart.
+type reloader struct {
+	logger   *slog.Logger
+	args     []string
+	logLevel *slog.LevelVar
+	// accessLogMode is the ACCESS_LOG_MODE the request logger reads.
+	accessLogMode *accessLogModeVar
+
+	// running is the configuration in effect: the one the server started
+	// with plus the changes applied since. Only the signal loop touches it.
+	running *Config
+	live    atomic.Pointer[liveSettings]
+}
+
+func newReloader(logger *slog.Logger, args []string, logLevel *slog.LevelVar, accessLogMode *accessLogModeVar, cfg *Config) *reloader {
+	r := &reloader{logger: logger, args: args, logLevel: logLevel, accessLogMode: accessLogMode, running: cfg}
+	r.live.Store(newLiveSettings(cfg, nil))
+	return r
+}
+
+type liveSettingsKey struct{}
+
+// Pin gives the request the settings live when it arrives, so that
+// everything down the stack reads the same ones even if a reload swaps them
+// meanwhile. It goes ahead of every middleware reading them.
+func (r *reloader) Pin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), liveSettingsKey{}, r.live.Load())))
+	})
+}
+
+// settings returns the settings Pin gave req, or the live ones for a
+// request that did not go through Pin.
+func (r *reloader) settings(req *http.Request) *liveSettings {
+	if s, ok := req.Context().Value(liveSettingsKey{}).(*liveSettings); ok {
+		return s
+	}
+	return r.live.Load()
+}
+
+func (r *reloader) securityHeaders(req *http.Request) securityHeaders { return r.settings(req).headers }
+func (r *reloader) cacheRules(req *http.Request) CacheRules           { return r.settings(req).cacheRules }
+func (r *reloader) rateLimiter(req *http.Request) *rateLimiter        { return r.settings(req).rateLimit }
+func (r *reloader) hostPolicy(req *http.Request) *hostPolicy          { return r.settings(req).hosts }
+
+// Reload loads the configuration from all sources again and applies the
+// reloadable changes. An invalid configuration changes nothing.
+func (r *reloader) Reload() error {
+	next, err := loadConfig(r.args)
+	if err != nil {
+		return err
+	}
+
+	applied := *r.running
+	applied.sources = maps.Clone(r.running.sources)
+	changed := []string{}
+	var refused []string
+	nextFields := next.fields()
+	for i, f := range applied.fields() {
+		value := nextFields[i].value
+		if reflect.DeepEqual(f.value.Interface(), value.Interface()) {
+			continue
+		}
+		if !reloadableKeys[f.key] {
+			refused = append(refused, f.key)
+			continue
+		}
+		f.value.Set(value)
+		applied.sources[f.key] = next.sources[f.key]
+		changed = append(changed, f.key)
+	}
+
+	if len(refused) > 0 {
+		r.logger.Warn("Configuration changes need a restart, not applied", slog.Any("keys", refused))
+	}
+	if slices.Contains(changed, "log_level") {
+		r.logLevel.Set(applied.LogLevel)
+	}
+	if slices.Contains(changed, "access_log_mode") {
+		r.accessLogMode.Set(applied.AccessLogMode)
+	}
+	r.live.Store(newLiveSettings(&applied, r.live.Load()))
+	r.running = &applied
+	r.logger.Info("Configuration reloaded", slog.Any("changed", changed))
+	return nil
+}
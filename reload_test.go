@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newReloadServer builds a server from the environment, as main does, so
+// that Reload reads the same sources again.
+func newReloadServer(t *testing.T, env map[string]string) (*Server, *logBuffer) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>index</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STATIC_DIR", dir)
+	t.Setenv("PORT", "0")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &logBuffer{}
+	s, err := NewServer(cfg, slog.New(slog.NewJSONHandler(logs, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, logs
+}
+
+func TestReload(t *testing.T) {
+	get := func(s *Server, host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if host != "" {
+			req.Host = host
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	tests := []struct {
+		name   string
+		before map[string]string
+		after  map[string]string
+		check  func(t *testing.T, s *Server)
+	}{
+		{
+			"security headers",
+			map[string]string{"CONTENT_SECURITY_POLICY": "default-src 'self'"},
+			map[string]string{"CONTENT_SECURITY_POLICY": "default-src 'none'"},
+			func(t *testing.T, s *Server) {
+				if csp := get(s, "").Header().Get("Content-Security-Policy"); csp != "default-src 'none'" {
+					t.Errorf("Content-Security-Policy = %q", csp)
+				}
+			},
+		},
+		{
+			"cache rules",
+			nil,
+			map[string]string{"CACHE_CONTROL_RULES": "*.html=private"},
+			func(t *testing.T, s *Server) {
+				if cc := get(s, "").Header().Get("Cache-Control"); cc != "private" {
+					t.Errorf("Cache-Control = %q", cc)
+				}
+			},
+		},
+		{
+			"log level",
+			nil,
+			map[string]string{"LOG_LEVEL": "debug"},
+			func(t *testing.T, s *Server) {
+				if level := s.logLevel.Level(); level != slog.LevelDebug {
+					t.Errorf("level = %s", level)
+				}
+			},
+		},
+		{
+			"rate limit turned on",
+			nil,
+			map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "1"},
+			func(t *testing.T, s *Server) {
+				get(s, "")
+				if rec := get(s, ""); rec.Code != http.StatusTooManyRequests {
+					t.Errorf("second request = %d, want 429", rec.Code)
+				}
+			},
+		},
+		{
+			"allowed hosts",
+			nil,
+			map[string]string{"ALLOWED_HOSTS": "app.example.com"},
+			func(t *testing.T, s *Server) {
+				if rec := get(s, "app.example.com"); rec.Code != http.StatusOK {
+					t.Errorf("allowed host = %d", rec.Code)
+				}
+				if rec := get(s, "evil.example.com"); rec.Code != http.StatusMisdirectedRequest {
+					t.Errorf("other host = %d, want 421", rec.Code)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := newReloadServer(t, tt.before)
+			if rec := get(s, ""); rec.Code != http.StatusOK {
+				t.Fatalf("before the reload: %d", rec.Code)
+			}
+			for key, value := range tt.after {
+				t.Setenv(key, value)
+			}
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s)
+			if !strings.Contains(logs.String(), `"msg":"Configuration reloaded"`) {
+				t.Errorf("the reload was not logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestReloadRefusesRestartSettings(t *testing.T) {
+	s, logs := newReloadServer(t, nil)
+	other := t.TempDir()
+	t.Setenv("STATIC_DIR", other)
+	t.Setenv("PORT", "7002")
+	t.Setenv("CONTENT_SECURITY_POLICY", "default-src 'none'")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The static dir stays, while the header still changes.
+	rec := serve(s, http.MethodGet, "/", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "index") {
+		t.Errorf("/ = %d %q, want the original static dir", rec.Code, rec.Body)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "default-src 'none'" {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	if s.reload.running.Port != "0" || s.reload.running.StaticDir == other {
+		t.Errorf("running config took port %s and static dir %s", s.reload.running.Port, s.reload.running.StaticDir)
+	}
+	out := logs.String()
+	if !strings.Contains(out, `"msg":"Configuration changes need a restart, not applied"`) ||
+		!strings.Contains(out, `"port"`) || !strings.Contains(out, `"static_dir"`) {
+		t.Errorf("the refused keys were not logged:\n%s", out)
+	}
+}
+
+func TestReloadInvalidChangesNothing(t *testing.T) {
+	s, _ := newReloadServer(t, map[string]string{"CONTENT_SECURITY_POLICY": "default-src 'self'"})
+	t.Setenv("CONTENT_SECURITY_POLICY", "default-src 'none'")
+	t.Setenv("RATE_LIMIT_BURST", "-1")
+	if err := s.Reload(); err == nil {
+		t.Fatal("Reload accepted an invalid configuration")
+	}
+	if csp := serve(s, http.MethodGet, "/", nil).Header().Get("Content-Security-Policy"); csp != "default-src 'self'" {
+		t.Errorf("Content-Security-Policy = %q, want the old one", csp)
+	}
+}
+
+// TestReloadDuringRequests reloads while requests are served: each sees the
+// old settings or the new ones, never a mix.
+func TestReloadDuringRequests(t *testing.T) {
+	policies := []string{"default-src 'self'", "default-src 'none'"}
+	s, _ := newReloadServer(t, map[string]string{
+		"CONTENT_SECURITY_POLICY": policies[0],
+		"CACHE_CONTROL_RULES":     "*.html=no-cache",
+	})
+	caches := map[string]string{policies[0]: "no-cache", policies[1]: "private"}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				h := serve(s, http.MethodGet, "/", nil).Header()
+				csp := h.Get("Content-Security-Policy")
+				if want, ok := caches[csp]; !ok || h.Get("Cache-Control") != want {
+					t.Errorf("got Content-Security-Policy %q with Cache-Control %q", csp, h.Get("Cache-Control"))
+					return
+				}
+			}
+		}()
+	}
+	for i := range 20 {
+		policy := policies[(i+1)%2]
+		t.Setenv("CONTENT_SECURITY_POLICY", policy)
+		t.Setenv("CACHE_CONTROL_RULES", "*.html="+caches[policy])
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name     string
+		incoming string
+		wantKeep bool
+	}{
+		{"passthrough", "req-42_a.b:c", true},
+		{"uuid", "0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"absent", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"longest kept", strings.Repeat("a", maxRequestIDLength), true},
+		{"bad charset", "id with spaces", false},
+		{"header injection", "id\r\nX-Evil: 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			logs := &logBuffer{}
+			logger := slog.New(slog.NewJSONHandler(logs, nil))
+			h := RequestID(RequestLogger(logger, defaultLogRules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFromContext(r.Context())
+			})))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(requestIDHeader)
+			if tt.wantKeep && echoed != tt.incoming {
+				t.Errorf("echoed %q, want %q passed through", echoed, tt.incoming)
+			}
+			if !tt.wantKeep && !generated.MatchString(echoed) {
+				t.Errorf("echoed %q, want a generated ID", echoed)
+			}
+			if seen != echoed {
+				t.Errorf("RequestIDFromContext = %q, header = %q", seen, echoed)
+			}
+
+			var entry struct {
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+				t.Fatalf("access log %q: %v", logs, err)
+			}
+			if entry.RequestID != echoed {
+				t.Errorf("logged request_id %q, want %q", entry.RequestID, echoed)
+			}
+		})
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 1000 {
+		id := newRequestID()
+		if seen[id] {
+			t.Fatalf("newRequestID repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRequestIDFromContextWithoutMiddleware(t *testing.T) {
+	if id := RequestIDFromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()); id != "" {
+		t.Errorf("RequestIDFromContext = %q, want empty", id)
+	}
+}
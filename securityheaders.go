@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type securityHeader struct {
+	name  string
+	value string
+}
+
+// securityHeaders are the headers added to every response. HSTS is kept
+// apart because it is only meaningful on HTTPS.
+type securityHeaders struct {
+	always []securityHeader
+	hsts   string
+}
+
+func newSecurityHeaders(cfg *Config) securityHeaders {
+	var h securityHeaders
+	for _, header := range []securityHeader{
+		{"X-Content-Type-Options", cfg.ContentTypeOptions},
+		{"X-Frame-Options", cfg.FrameOptions},
+		{"Referrer-Policy", cfg.ReferrerPolicy},
+		{"Content-Security-Policy", cfg.ContentSecurityPolicy},
+	} {
+		if headerEnabled(header.value) {
+			h.always = append(h.always, header)
+		}
+	}
+	if headerEnabled(cfg.StrictTransportSecurity) {
+		h.hsts = cfg.StrictTransportSecurity
+	}
+	return h
+}
+
+// headerEnabled reports whether a configured header value should be sent;
+// "off" disables a header that has a default.
+func headerEnabled(value string) bool {
+	return value != "" && !strings.EqualFold(value, "off")
+}
+
+// SecurityHeaders sets the security headers current returns before calling
+// next, so a handler that sets one of them itself takes precedence.
+func SecurityHeaders(current func(*http.Request) securityHeaders, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := current(r)
+		header := w.Header()
+		for _, h := range headers.always {
+			header.Set(h.name, h.value)
+		}
+		if headers.hsts != "" && isHTTPS(r) {
+			header.Set("Strict-Transport-Security", headers.hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// noContent answers without setting any header, unlike http.Error, which
+// adds X-Content-Type-Options itself.
+var noContent = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func TestSecurityHeadersHSTS(t *testing.T) {
+	const hsts = "max-age=63072000; includeSubDomains"
+	tests := []struct {
+		name     string
+		tls      bool
+		proto    string
+		wantHSTS bool
+	}{
+		{"plain HTTP", false, "", false},
+		{"TLS", true, "", true},
+		{"forwarded https", false, "https", true},
+		{"forwarded HTTPS list", false, "HTTPS, http", true},
+		{"forwarded http", false, "http", false},
+		{"forwarded http first", false, "http, https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			headers := newSecurityHeaders(cfg)
+			h := SecurityHeaders(func(*http.Request) securityHeaders { return headers }, noContent)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("Strict-Transport-Security")
+			if tt.wantHSTS && got != hsts || !tt.wantHSTS && got != "" {
+				t.Errorf("Strict-Transport-Security = %q, want sent: %t", got, tt.wantHSTS)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+		want   map[string]string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           "strict-origin-when-cross-origin",
+				"Content-Security-Policy":   "",
+				"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+			},
+		},
+		{
+			name: "overridden",
+			mutate: func(cfg *Config) {
+				cfg.FrameOptions = "SAMEORIGIN"
+				cfg.ContentSecurityPolicy = "default-src 'self'"
+				cfg.StrictTransportSecurity = "max-age=60"
+			},
+			want: map[string]string{
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Content-Security-Policy":   "default-src 'self'",
+				"Strict-Transport-Security": "max-age=60",
+			},
+		},
+		{
+			name: "disabled",
+			mutate: func(cfg *Config) {
+				cfg.ContentTypeOptions = "off"
+				cfg.FrameOptions = "OFF"
+				cfg.ReferrerPolicy = ""
+				cfg.StrictTransportSecurity = "off"
+			},
+			want: map[string]string{
+				"X-Content-Type-Options":    "",
+				"X-Frame-Options":           "",
+				"Referrer-Policy":           "",
+				"Strict-Transport-Security": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			if tt.mutate != nil {
+				tt.mutate(cfg)
+			}
+			headers := newSecurityHeaders(cfg)
+			h := SecurityHeaders(func(*http.Request) securityHeaders { return headers }, noContent)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = &tls.ConnectionState{}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersKeepInnerValues(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ContentSecurityPolicy = "default-src 'self'"
+	headers := newSecurityHeaders(cfg)
+	h := SecurityHeaders(func(*http.Request) securityHeaders { return headers }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
+	}))
+	rec := get(h, "/")
+	if got := rec.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want the handler's", got)
+	}
+	if got := rec.Header().Get("Content-Security-Policy"); got != "frame-ancestors 'self'" {
+		t.Errorf("Content-Security-Policy = %q, want the handler's", got)
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want the default", got)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// Statuses of a queued message.
+const (
+	queueStatusQueued  = "queued"
+	queueStatusSending = "sending"
+	queueStatusSent    = "sent"
+	queueStatusFailed  = "failed"
+)
+
+// sendQueueMaxBackoff bounds the pause before a queued message is sent
+// again.
+const sendQueueMaxBackoff = time.Minute
+
+// sendQueueSweepInterval is how often the statuses older than
+// SEND_QUEUE_STATUS_TTL are dropped.
+const sendQueueSweepInterval = time.Minute
+
+// sendQueueDumpGrace is the part of the shutdown deadline kept for dumping
+// the messages the drain did not get to, as the process may exit as soon as
+// the deadline passes.
+const sendQueueDumpGrace = time.Second
+
+// queuedMessage is a message of /api/sendMessage?async=true and, as JSON,
+// its status.
+type queuedMessage struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	ChatID    string `json:"chatId"`
+	IDMessage string `json:"idMessage,omitempty"`
+	// Error is why the message was not sent, once it has failed.
+	Error      *sendError `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	EnqueuedAt time.Time  `json:"enqueuedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+
+	// ctx is that of the request, without its cancellation, so that the
+	// send keeps the logger and trace of the request that queued it.
+	ctx        context.Context
+	idInstance string
+	apiToken   string
+	message    string
+}
+
+// queueDumpEntry is a line of SEND_QUEUE_DUMP_FILE. The token is left out:
+// a message is sent again with the credentials of its instance.
+type queueDumpEntry struct {
+	ID         string    `json:"id"`
+	IDInstance string    `json:"idInstance"`
+	ChatID     string    `json:"chatId"`
+	Message    string    `json:"message"`
+	Attempts   int       `json:"attempts"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	// InFlight is a message whose last send was cut short, which GREEN-API
+	// may have delivered.
+	InFlight bool `json:"inFlight,omitempty"`
+}
+
+var (
+	errSendQueueFull   = errors.New("send queue full")
+	errSendQueueClosed = errors.New("send queue closed")
+)
+
+// sendQueue sends the messages of /api/sendMessage?async=true one at a
+// time, SEND_QUEUE_INTERVAL apart, on behalf of the requests that queued
+// them. A send that fails in a way that may pass is made again with a
+// growing pause, up to SEND_QUEUE_ATTEMPTS times; meanwhile the messages
+// behind it wait, as they would most likely fail the same way. The status
+// of every message is kept for SEND_QUEUE_STATUS_TTL once it is sent or
+// has failed.
+type sendQueue struct {
+	api      *greenAPI
+	logger   *slog.Logger
+	interval time.Duration
+	attempts int
+	ttl      time.Duration
+	dumpFile string
+	// now and after may be replaced before the first message is queued.
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+
+	jobs chan *queuedMessage
+	// stop cancels the send in progress, once Close gives up on the drain.
+	stop     context.Context
+	stopWork context.CancelFunc
+	done     chan struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	messages  map[string]*queuedMessage
+	lastSweep time.Time
+	// unsent are the messages the worker took but stopped before sending.
+	unsent []queueDumpEntry
+
+	pending  atomic.Int64
+	enqueued atomic.Int64
+	sent     atomic.Int64
+	failed   atomic.Int64
+	rejected atomic.Int64
+	retries  atomic.Int64
+}
+
+func newSendQueue(api *greenAPI, logger *slog.Logger, cfg *Config) *sendQueue {
+	stop, stopWork := context.WithCancel(context.Background())
+	q := &sendQueue{
+		api:       api,
+		logger:    logger,
+		interval:  cfg.SendQueueInterval,
+		attempts:  cfg.SendQueueAttempts,
+		ttl:       cfg.SendQueueStatusTTL,
+		dumpFile:  cfg.SendQueueDumpFile,
+		now:       time.Now,
+		after:     time.After,
+		jobs:      make(chan *queuedMessage, cfg.SendQueueSize),
+		stop:      stop,
+		stopWork:  stopWork,
+		done:      make(chan struct{}),
+		messages:  make(map[string]*queuedMessage),
+		lastSweep: time.Now(),
+	}
+	go q.work()
+	return q
+}
+
+// enqueue queues m and returns its status. It fails with errSendQueueFull
+// or, once Close has been called, errSendQueueClosed.
+func (q *sendQueue) enqueue(m *queuedMessage) (queuedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return queuedMessage{}, errSendQueueClosed
+	}
+
+	now := q.now()
+	if now.Sub(q.lastSweep) > sendQueueSweepInterval {
+		q.sweep(now)
+	}
+	m.ID = newRequestID()
+	m.Status = queueStatusQueued
+	m.EnqueuedAt, m.UpdatedAt = now, now
+	select {
+	case q.jobs <- m:
+	default:
+		q.rejected.Add(1)
+		return queuedMessage{}, errSendQueueFull
+	}
+	q.messages[m.ID] = m
+	q.pending.Add(1)
+	q.enqueued.Add(1)
+	return *m, nil
+}
+
+// sweep must be called with mu held.
+func (q *sendQueue) sweep(now time.Time) {
+	for id, m := range q.messages {
+		if (m.Status == queueStatusSent || m.Status == queueStatusFailed) && now.Sub(m.UpdatedAt) > q.ttl {
+			delete(q.messages, id)
+		}
+	}
+	q.lastSweep = now
+}
+
+// lookup returns the status of message id of instance idInstance; the
+// messages of other instances are not found.
+func (q *sendQueue) lookup(id, idInstance string) (queuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.messages[id]
+	if !ok || m.idInstance != idInstance {
+		return queuedMessage{}, false
+	}
+	if (m.Status == queueStatusSent || m.Status == queueStatusFailed) && q.now().Sub(m.UpdatedAt) > q.ttl {
+		return queuedMessage{}, false
+	}
+	return *m, true
+}
+
+// update changes m under mu, where lookup reads it.
+func (q *sendQueue) update(m *queuedMessage, change func(m *queuedMessage)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(m)
+	m.UpdatedAt = q.now()
+}
+
+func (q *sendQueue) work() {
+	defer close(q.done)
+	var last time.Time
+	for m := range q.jobs {
+		if !q.deliver(m, &last) {
+			return
+		}
+	}
+}
+
+// deliver sends m, SEND_QUEUE_INTERVAL after the send that ended at last,
+// and keeps at it while the failures may pass. It reports false when the
+// queue was stopped first; m is then left for Close to dump.
+func (q *sendQueue) deliver(m *queuedMessage, last *time.Time) bool {
+	logger := LoggerFromContext(m.ctx)
+	wait := q.interval - q.now().Sub(*last)
+	for {
+		if !q.sleep(wait) {
+			q.leave(m, false)
+			return false
+		}
+		q.update(m, func(m *queuedMessage) {
+			m.Status = queueStatusSending
+			m.Attempts++
+		})
+		idMessage, err := q.send(m)
+		*last = q.now()
+		if err == nil {
+			q.finish(m, func(m *queuedMessage) {
+				m.Status = queueStatusSent
+				m.IDMessage = idMessage
+			})
+			q.sent.Add(1)
+			logger.Info("Queued message sent",
+				slog.String("queue_id", m.ID),
+				slog.String("id_message", idMessage),
+				slog.Int("attempts", m.Attempts),
+			)
+			return true
+		}
+		if q.stop.Err() != nil {
+			q.leave(m, true)
+			return false
+		}
+
+		failure := q.api.upstreamFailure(m.ctx, "sendMessage", err)
+		if !retryableSend(err) || m.Attempts >= q.attempts {
+			q.finish(m, func(m *queuedMessage) {
+				m.Status = queueStatusFailed
+				m.Error = &sendError{Code: failure.Code, Message: failure.Message, Details: failure.Details}
+			})
+			q.failed.Add(1)
+			logger.Warn("Queued message failed",
+				slog.String("queue_id", m.ID),
+				slog.Int("attempts", m.Attempts),
+				slog.String("code", failure.Code),
+				slog.Any("error", err),
+			)
+			return true
+		}
+
+		wait = min(max(q.interval, time.Second)<<(m.Attempts-1), sendQueueMaxBackoff)
+		q.retries.Add(1)
+		q.update(m, func(m *queuedMessage) { m.Status = queueStatusQueued })
+		logger.Info("Queued message will be sent again",
+			slog.String("queue_id", m.ID),
+			slog.Int("attempts", m.Attempts),
+			slog.String("code", failure.Code),
+			slog.Duration("backoff", wait),
+		)
+	}
+}
+
+// send makes one sendMessage call for m. It is cut short when the queue is
+// stopped.
+func (q *sendQueue) send(m *queuedMessage) (string, error) {
+	c := q.api.clientWithLogger(LoggerFromContext(m.ctx), m.idInstance, m.apiToken)
+	ctx, cancel := context.WithTimeout(m.ctx, q.api.timeout)
+	defer cancel()
+	defer context.AfterFunc(q.stop, cancel)()
+	result, err := c.SendMessage(ctx, greenapi.SendMessageRequest{ChatID: m.ChatID, Message: m.message})
+	if err != nil {
+		return "", err
+	}
+	return result.IDMessage, nil
+}
+
+// retryableSend reports whether a send that failed with err may succeed
+// when made again: GREEN-API answered 5xx or 429, did not answer in time or
+// at all, or the circuit breaker or the outbound limiter held the call back.
+func retryableSend(err error) bool {
+	var upstream *greenapi.Error
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode >= http.StatusInternalServerError || errors.Is(err, greenapi.ErrRateLimited)
+	}
+	return true
+}
+
+// sleep waits for d, or reports false if the queue is stopped first.
+func (q *sendQueue) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return q.stop.Err() == nil
+	}
+	select {
+	case <-q.after(d):
+		return true
+	case <-q.stop.Done():
+		return false
+	}
+}
+
+// finish records the final status of m.
+func (q *sendQueue) finish(m *queuedMessage, change func(m *queuedMessage)) {
+	q.update(m, change)
+	q.pending.Add(-1)
+}
+
+// leave keeps m for Close to dump; inFlight is a message whose send was cut
+// short.
+func (q *sendQueue) leave(m *queuedMessage, inFlight bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry := dumpEntry(m)
+	entry.InFlight = inFlight
+	q.unsent = append(q.unsent, entry)
+}
+
+func dumpEntry(m *queuedMessage) queueDumpEntry {
+	return queueDumpEntry{
+		ID:         m.ID,
+		IDInstance: m.idInstance,
+		ChatID:     m.ChatID,
+		Message:    m.message,
+		Attempts:   m.Attempts,
+		EnqueuedAt: m.EnqueuedAt,
+	}
+}
+
+// Close stops taking messages and sends the queued ones until shortly
+// before ctx expires. What is left then, the message being sent included,
+// is appended to SEND_QUEUE_DUMP_FILE or, without one or when it cannot be
+// written, logged without its text, so that it is not lost without a trace.
+func (q *sendQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	drain := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		drain, cancel = context.WithDeadline(ctx, deadline.Add(-sendQueueDumpGrace))
+		defer cancel()
+	}
+	select {
+	case <-q.done:
+		return nil
+	case <-drain.Done():
+	}
+	q.stopWork()
+	<-q.done
+
+	left := q.unsent
+	for m := range q.jobs {
+		left = append(left, dumpEntry(m))
+	}
+	if len(left) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d messages not sent: %w", len(left), drain.Err())
+	if q.dumpFile != "" {
+		dumpErr := q.dump(left)
+		if dumpErr == nil {
+			q.logger.Warn("Queued messages not sent before shutdown were dumped",
+				slog.Int("messages", len(left)),
+				slog.String("file", q.dumpFile),
+			)
+			return err
+		}
+		err = errors.Join(err, dumpErr)
+	}
+	for _, e := range left {
+		q.logger.Warn("Queued message not sent before shutdown",
+			slog.String("queue_id", e.ID),
+			slog.String("id_instance", e.IDInstance),
+			slog.Int("message_length", len(e.Message)),
+			slog.Int("attempts", e.Attempts),
+			slog.Bool("in_flight", e.InFlight),
+		)
+	}
+	return err
+}
+
+// dump appends the messages left at shutdown to SEND_QUEUE_DUMP_FILE.
+func (q *sendQueue) dump(left []queueDumpEntry) error {
+	f, err := os.OpenFile(q.dumpFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("dump the send queue: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range left {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("dump the send queue: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("dump the send queue: %w", err)
+	}
+	return nil
+}
+
+type sendQueueReport struct {
+	Depth    int64 `json:"depth"`
+	Capacity int   `json:"capacity"`
+	Enqueued int64 `json:"enqueued"`
+	Sent     int64 `json:"sent"`
+	Failed   int64 `json:"failed"`
+	Rejected int64 `json:"rejected"`
+	Retries  int64 `json:"retries"`
+}
+
+func (q *sendQueue) report() sendQueueReport {
+	return sendQueueReport{
+		Depth:    q.pending.Load(),
+		Capacity: cap(q.jobs),
+		Enqueued: q.enqueued.Load(),
+		Sent:     q.sent.Load(),
+		Failed:   q.failed.Load(),
+		Rejected: q.rejected.Load(),
+		Retries:  q.retries.Load(),
+	}
+}
+
+// asyncSend reads the async query parameter of /api/sendMessage.
+func (g *greenAPI) asyncSend(r *http.Request) (bool, error) {
+	var v validation
+	async := v.queryBool(r, "async", false)
+	if async && g.queue == nil {
+		v.add("async", "disabled", "async sending is disabled")
+	}
+	if len(v.errs) > 0 {
+		return false, validationError(v.errs)
+	}
+	return async, nil
+}
+
+// enqueueMessage answers /api/sendMessage?async=true: 202 with the status
+// of the queued message, which /api/queue/{id} tells from then on.
+func (g *greenAPI) enqueueMessage(w http.ResponseWriter, r *http.Request, req *sendMessageRequest) error {
+	idInstance, apiToken, err := g.credentials(r)
+	if err != nil {
+		return err
+	}
+	queued, err := g.queue.enqueue(&queuedMessage{
+		ChatID:     req.chatID,
+		ctx:        context.WithoutCancel(r.Context()),
+		idInstance: idInstance,
+		apiToken:   apiToken,
+		message:    req.Message,
+	})
+	switch {
+	case errors.Is(err, errSendQueueFull):
+		retryAfter := strconv.Itoa(max(int(g.queue.interval.Round(time.Second).Seconds()), 1))
+		return &HTTPError{Status: http.StatusTooManyRequests, Code: errCodeQueueFull,
+			Message: "send queue full, try again later",
+			Header:  http.Header{"Retry-After": {retryAfter}}}
+	case errors.Is(err, errSendQueueClosed):
+		return &HTTPError{Status: http.StatusServiceUnavailable, Code: errCodeShuttingDown, Message: "server is shutting down"}
+	}
+
+	location := "/api/queue/" + queued.ID
+	if instance, ok := instanceFromContext(r.Context()); ok {
+		location = instancesPrefix + instance.name + "/queue/" + queued.ID
+	}
+	LoggerFromContext(r.Context()).Info("Message queued", slog.String("queue_id", queued.ID))
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusAccepted, queued)
+	return nil
+}
+
+// QueuedMessage serves GET /api/queue/{id}: the status of a message queued
+// with the credentials of the request.
+func (g *greenAPI) QueuedMessage(w http.ResponseWriter, r *http.Request) error {
+	idInstance, _, err := g.credentials(r)
+	if err != nil {
+		return err
+	}
+	m, ok := g.queue.lookup(r.PathValue("id"), idInstance)
+	if !ok {
+		return &HTTPError{Status: http.StatusNotFound, Code: errCodeNotFound, Message: "no queued message with this ID"}
+	}
+	writeJSON(w, http.StatusOK, m)
+	return nil
+}
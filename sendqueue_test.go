@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestRetryableSend(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &greenapi.Error{StatusCode: http.StatusBadGateway}, true},
+		{"rate limited", fmt.Errorf("greenapi: %w", &greenapi.Error{StatusCode: http.StatusTooManyRequests}), true},
+		{"rejected", &greenapi.Error{StatusCode: http.StatusBadRequest}, false},
+		{"unauthorized", &greenapi.Error{StatusCode: http.StatusUnauthorized}, false},
+		{"timeout", context.DeadlineExceeded, true},
+		{"circuit open", greenapi.ErrCircuitOpen, true},
+		{"network", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		if got := retryableSend(tt.err); got != tt.want {
+			t.Errorf("%s: retryableSend = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// queueClock is a fake clock for sendQueue: waiting moves it forward at
+// once, and every wait is noted.
+type queueClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *queueClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *queueClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *queueClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *queueClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.waits)
+}
+
+// queueUpstream answers sendMessage with the statuses of script in turn,
+// and 200 once they run out; 0 does not answer until the request ends.
+// Sent messages get idMessage "id-<n>" for the nth call.
+type queueUpstream struct {
+	mu     sync.Mutex
+	script []int
+	chats  []string
+	calls  atomic.Int32
+}
+
+func (u *queueUpstream) handler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChatID string `json:"chatId"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	n := u.calls.Add(1)
+	u.mu.Lock()
+	u.chats = append(u.chats, req.ChatID)
+	status := http.StatusOK
+	if len(u.script) > 0 {
+		status, u.script = u.script[0], u.script[1:]
+	}
+	u.mu.Unlock()
+
+	switch status {
+	case 0:
+		<-r.Context().Done()
+	case http.StatusOK:
+		fmt.Fprintf(w, `{"idMessage":"id-%d"}`, n)
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+func (u *queueUpstream) Chats() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return slices.Clone(u.chats)
+}
+
+// newTestQueue returns a send queue for instance 1101 on a fake clock,
+// sending one message a second and up to three times, which is closed when
+// the test ends unless the test closed it.
+func newTestQueue(t *testing.T, u *queueUpstream, mutate func(*Config)) (*sendQueue, *queueClock, *logBuffer) {
+	t.Helper()
+	if mutate == nil {
+		mutate = func(*Config) {}
+	}
+	captureDefaultLog(t)
+	upstream := fakeGreenAPI(t, u.handler)
+	cfg := testConfig(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.SendQueueSize = 10
+		cfg.SendQueueInterval = time.Second
+		cfg.SendQueueAttempts = 3
+		cfg.SendQueueStatusTTL = time.Hour
+		cfg.UpstreamTimeout = 5 * time.Second
+	}, mutate))
+	logs := &logBuffer{}
+	q := newSendQueue(newGreenAPI(cfg, http.DefaultTransport, nil, nil, nil), slog.New(slog.NewJSONHandler(logs, nil)), cfg)
+	clock := &queueClock{now: time.Now()}
+	q.now, q.after = clock.Now, clock.After
+	t.Cleanup(func() {
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		q.Close(ctx)
+	})
+	return q, clock, logs
+}
+
+func queueMessage(t *testing.T, q *sendQueue, chatID string) queuedMessage {
+	t.Helper()
+	m, err := q.enqueue(&queuedMessage{
+		ChatID:     chatID,
+		ctx:        context.Background(),
+		idInstance: "1101",
+		apiToken:   "secret",
+		message:    "confidential text",
+	})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if m.Status != queueStatusQueued || m.ID == "" {
+		t.Fatalf("queued %+v", m)
+	}
+	return m
+}
+
+// waitQueued waits for message id to be sent or to fail.
+func waitQueued(t *testing.T, q *sendQueue, id string) queuedMessage {
+	t.Helper()
+	var m queuedMessage
+	waitFor(t, "message "+id, func() bool {
+		m, _ = q.lookup(id, "1101")
+		return m.Status == queueStatusSent || m.Status == queueStatusFailed
+	})
+	return m
+}
+
+func TestSendQueuePacing(t *testing.T) {
+	u := &queueUpstream{}
+	q, clock, _ := newTestQueue(t, u, nil)
+	chats := []string{"79000000001@c.us", "79000000002@c.us", "79000000003@c.us"}
+	var ids []string
+	for _, chat := range chats {
+		ids = append(ids, queueMessage(t, q, chat).ID)
+	}
+	for i, id := range ids {
+		m := waitQueued(t, q, id)
+		if m.Status != queueStatusSent || m.IDMessage != fmt.Sprintf("id-%d", i+1) || m.Attempts != 1 {
+			t.Errorf("message %d = %+v", i, m)
+		}
+	}
+	if got := u.Chats(); !slices.Equal(got, chats) {
+		t.Errorf("sent to %v, want %v in queue order", got, chats)
+	}
+	// The first message goes at once, each next one an interval later.
+	if got, want := clock.Waits(), []time.Duration{time.Second, time.Second}; !slices.Equal(got, want) {
+		t.Errorf("waited %v, want %v", got, want)
+	}
+	if r := q.report(); r.Depth != 0 || r.Enqueued != 3 || r.Sent != 3 || r.Failed != 0 || r.Retries != 0 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestSendQueueRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		script       []int
+		wantStatus   string
+		wantAttempts int
+		wantCode     string
+		wantWaits    []time.Duration
+	}{
+		{"sent at once", nil, queueStatusSent, 1, "", nil},
+		{"sent after 5xx", []int{500, 502}, queueStatusSent, 3, "", []time.Duration{time.Second, 2 * time.Second}},
+		{"sent after 429", []int{429}, queueStatusSent, 2, "", []time.Duration{time.Second}},
+		{"sent after a timeout", []int{0}, queueStatusSent, 2, "", []time.Duration{time.Second}},
+		{"rejected is not retried", []int{400}, queueStatusFailed, 1, errCodeUpstreamRejected, nil},
+		{"gives up after the attempts", []int{500, 500, 500, 500}, queueStatusFailed, 3, errCodeUpstreamError, []time.Duration{time.Second, 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &queueUpstream{script: tt.script}
+			q, clock, _ := newTestQueue(t, u, func(cfg *Config) { cfg.UpstreamTimeout = 50 * time.Millisecond })
+			m := waitQueued(t, q, queueMessage(t, q, "79000000001@c.us").ID)
+			if m.Status != tt.wantStatus || m.Attempts != tt.wantAttempts {
+				t.Errorf("status %s after %d attempts, want %s after %d", m.Status, m.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if tt.wantCode == "" && (m.Error != nil || m.IDMessage == "") {
+				t.Errorf("sent message = %+v", m)
+			}
+			if tt.wantCode != "" && (m.Error == nil || m.Error.Code != tt.wantCode) {
+				t.Errorf("error = %+v, want %s", m.Error, tt.wantCode)
+			}
+			if int(u.calls.Load()) != tt.wantAttempts {
+				t.Errorf("upstream got %d calls, want %d", u.calls.Load(), tt.wantAttempts)
+			}
+			if got := clock.Waits(); !slices.Equal(got, tt.wantWaits) {
+				t.Errorf("waited %v, want %v", got, tt.wantWaits)
+			}
+			if r := q.report(); r.Retries != int64(tt.wantAttempts-1) || r.Depth != 0 {
+				t.Errorf("report = %+v", r)
+			}
+		})
+	}
+}
+
+func TestSendQueueLookup(t *testing.T) {
+	q, clock, _ := newTestQueue(t, &queueUpstream{}, nil)
+	id := queueMessage(t, q, "79000000001@c.us").ID
+	waitQueued(t, q, id)
+
+	if _, ok := q.lookup(id, "2202"); ok {
+		t.Error("another instance found the message")
+	}
+	if _, ok := q.lookup("no-such-id", "1101"); ok {
+		t.Error("an unknown ID was found")
+	}
+	clock.Advance(59 * time.Minute)
+	if _, ok := q.lookup(id, "1101"); !ok {
+		t.Error("the status went before SEND_QUEUE_STATUS_TTL")
+	}
+	clock.Advance(2 * time.Minute)
+	if _, ok := q.lookup(id, "1101"); ok {
+		t.Error("the status outlived SEND_QUEUE_STATUS_TTL")
+	}
+
+	// The next message sweeps the expired status away.
+	waitQueued(t, q, queueMessage(t, q, "79000000002@c.us").ID)
+	q.mu.Lock()
+	_, kept := q.messages[id]
+	q.mu.Unlock()
+	if kept {
+		t.Error("the expired status was not swept")
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	u := &queueUpstream{script: []int{0}}
+	q, _, _ := newTestQueue(t, u, func(cfg *Config) { cfg.SendQueueSize = 2 })
+	first := queueMessage(t, q, "79000000001@c.us")
+	waitFor(t, "the first send", func() bool { return u.calls.Load() == 1 })
+	queueMessage(t, q, "79000000002@c.us")
+	queueMessage(t, q, "79000000003@c.us")
+	if _, err := q.enqueue(&queuedMessage{ChatID: "79000000004@c.us", ctx: context.Background()}); !errors.Is(err, errSendQueueFull) {
+		t.Fatalf("enqueue into a full queue = %v, want errSendQueueFull", err)
+	}
+	if r := q.report(); r.Depth != 3 || r.Capacity != 2 || r.Rejected != 1 || r.Enqueued != 3 {
+		t.Errorf("report = %+v", r)
+	}
+	if m, _ := q.lookup(first.ID, "1101"); m.Status != queueStatusSending {
+		t.Errorf("first message %s, want %s", m.Status, queueStatusSending)
+	}
+}
+
+func TestSendQueueCloseDrains(t *testing.T) {
+	q, _, _ := newTestQueue(t, &queueUpstream{}, nil)
+	a := queueMessage(t, q, "79000000001@c.us")
+	b := queueMessage(t, q, "79000000002@c.us")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	for _, id := range []string{a.ID, b.ID} {
+		if m, _ := q.lookup(id, "1101"); m.Status != queueStatusSent {
+			t.Errorf("message %s is %s after the drain", id, m.Status)
+		}
+	}
+	if _, err := q.enqueue(&queuedMessage{ctx: context.Background()}); !errors.Is(err, errSendQueueClosed) {
+		t.Errorf("enqueue after Close = %v, want errSendQueueClosed", err)
+	}
+}
+
+func TestSendQueueCloseLeavesUnsent(t *testing.T) {
+	for _, dump := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dump file %t", dump), func(t *testing.T) {
+			dumpFile := ""
+			if dump {
+				dumpFile = filepath.Join(t.TempDir(), "queue.jsonl")
+			}
+			u := &queueUpstream{script: []int{0}}
+			q, _, logs := newTestQueue(t, u, func(cfg *Config) {
+				cfg.SendQueueDumpFile = dumpFile
+				cfg.UpstreamTimeout = time.Minute
+			})
+			ids := []string{
+				queueMessage(t, q, "79000000001@c.us").ID,
+				queueMessage(t, q, "79000000002@c.us").ID,
+				queueMessage(t, q, "79000000003@c.us").ID,
+			}
+			waitFor(t, "the first send", func() bool { return u.calls.Load() == 1 })
+
+			ctx, cancel := context.WithTimeout(context.Background(), sendQueueDumpGrace+100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := q.Close(ctx)
+			if err == nil || !strings.Contains(err.Error(), "3 messages not sent") {
+				t.Fatalf("Close = %v, want 3 messages not sent", err)
+			}
+			if elapsed := time.Since(start); elapsed > sendQueueDumpGrace {
+				t.Errorf("Close took %s, into the dump grace", elapsed)
+			}
+
+			out := logs.String()
+			if strings.Contains(out, "confidential text") || strings.Contains(out, "secret") {
+				t.Errorf("the log shows a message or the token:\n%s", out)
+			}
+			if !dump {
+				if n := strings.Count(out, `"msg":"Queued message not sent before shutdown"`); n != 3 {
+					t.Errorf("logged %d unsent messages, want 3:\n%s", n, out)
+				}
+				if !strings.Contains(out, `"queue_id":"`+ids[0]+`"`) || !strings.Contains(out, `"in_flight":true`) {
+					t.Errorf("the interrupted send was not logged as in flight:\n%s", out)
+				}
+				return
+			}
+
+			info, err := os.Stat(dumpFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0o600 {
+				t.Errorf("dump file mode = %s, want 0600", info.Mode().Perm())
+			}
+			f, _ := os.Open(dumpFile)
+			defer f.Close()
+			var entries []queueDumpEntry
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				if strings.Contains(sc.Text(), "secret") {
+					t.Errorf("the dump shows the token: %s", sc.Text())
+				}
+				var e queueDumpEntry
+				if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, e)
+			}
+			if len(entries) != 3 {
+				t.Fatalf("dumped %d messages, want 3", len(entries))
+			}
+			// The interrupted send comes first, having used its one attempt.
+			for i, e := range entries {
+				inFlight, attempts := i == 0, 0
+				if inFlight {
+					attempts = 1
+				}
+				if e.ID != ids[i] || e.IDInstance != "1101" || e.Message != "confidential text" || e.InFlight != inFlight || e.Attempts != attempts {
+					t.Errorf("entry %d = %+v", i, e)
+				}
+			}
+			if !strings.Contains(out, `"msg":"Queued messages not sent before shutdown were dumped"`) {
+				t.Errorf("the dump was not logged:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestServerSendQueue(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	u := &queueUpstream{}
+	upstream := fakeGreenAPI(t, u.handler)
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.AdminToken = adminToken
+		cfg.SendQueueInterval = time.Millisecond
+	}))
+	const body = `{"chatId":"79000000001@c.us","message":"hi"}`
+
+	rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=true", body, nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("async sendMessage = %d: %s", rec.Code, rec.Body)
+	}
+	var queued queuedMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued.Status != queueStatusQueued || queued.ChatID != "79000000001@c.us" || rec.Header().Get("Location") != "/api/queue/"+queued.ID {
+		t.Errorf("queued %+v at %s", queued, rec.Header().Get("Location"))
+	}
+
+	var status queuedMessage
+	waitFor(t, "the queued message to be sent", func() bool {
+		rec, _ := callAPI(t, s, http.MethodGet, "/api/queue/"+queued.ID, "", nil)
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		return status.Status == queueStatusSent
+	})
+	if status.IDMessage != "id-1" || status.Attempts != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	other := http.Header{"X-Id-Instance": {"2202"}, "X-Api-Token": {"other"}}
+	if rec, envelope := callAPI(t, s, http.MethodGet, "/api/queue/"+queued.ID, "", other); rec.Code != http.StatusNotFound || envelope.Error.Code != errCodeNotFound {
+		t.Errorf("another instance got %d %s", rec.Code, rec.Body)
+	}
+	if rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=maybe", body, nil); rec.Code != http.StatusBadRequest || envelope.Error.Code != errCodeValidation {
+		t.Errorf("async=maybe = %d %s", rec.Code, rec.Body)
+	}
+	if rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=true", `{"chatId":"79000000001@c.us"}`, nil); rec.Code != http.StatusBadRequest || envelope.Error.Code != errCodeValidation {
+		t.Errorf("an invalid message was queued: %d %s", rec.Code, rec.Body)
+	}
+
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	for _, want := range []string{"send_queue_depth 0", "send_queue_enqueued_total 1", "send_queue_sent_total 1"} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	var report struct {
+		SendQueue sendQueueReport `json:"send_queue"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report.SendQueue.Enqueued != 1 || report.SendQueue.Sent != 1 || report.SendQueue.Capacity != 100 {
+		t.Errorf("/stats send_queue = %+v", report.SendQueue)
+	}
+}
+
+func TestServerSendQueueFull(t *testing.T) {
+	u := &queueUpstream{script: []int{0, 0}}
+	upstream := fakeGreenAPI(t, u.handler)
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.SendQueueSize = 1
+		cfg.SendQueueInterval = 2 * time.Second
+		cfg.UpstreamTimeout = time.Minute
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	const body = `{"chatId":"79000000001@c.us","message":"hi"}`
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=true", body, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("first = %d", rec.Code)
+	}
+	waitFor(t, "the first send", func() bool { return u.calls.Load() == 1 })
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=true", body, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("second = %d", rec.Code)
+	}
+	rec, envelope := callAPI(t, s, http.MethodPost, "/api/sendMessage?async=true", body, nil)
+	if rec.Code != http.StatusTooManyRequests || envelope.Error.Code != errCodeQueueFull || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("full queue = %d %s, Retry-After %q", rec.Code, rec.Body, rec.Header().Get("Retry-After"))
+	}
+}
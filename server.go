@@ -0,0 +1,872 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server is the whole service: the routes, the middleware in front of them,
+// the background workers and the listeners. NewServer assembles it and
+// starts the workers but opens no socket, so Handler can be driven on its
+// own; Run binds and serves, and Shutdown drains.
+type Server struct {
+	cfg      *Config
+	logger   *slog.Logger
+	logLevel *slog.LevelVar
+	lc       *lifecycle
+	hc       *health
+	m        *metrics
+	reload   *reloader
+	build    buildInfo
+
+	handler    http.Handler
+	srv        *http.Server
+	plainSrv   *http.Server
+	debugSrv   *http.Server
+	acme       func(fallback http.Handler) http.Handler
+	accessFile *rotatingFile
+	cached     bool
+
+	inFlight atomic.Int64
+	conns    connCounter
+
+	up      *upgrader
+	addr    string
+	servers *serverGroup
+	debug   *serverGroup
+}
+
+// NewServer assembles the server for cfg, logging to logger. logLevel is the
+// level of logger's handler, which the admin endpoints, SIGUSR1 and reloads
+// change; with nil it starts at LOG_LEVEL and only affects what the server
+// reports.
+func NewServer(cfg *Config, logger *slog.Logger, logLevel *slog.LevelVar) (*Server, error) {
+	if logLevel == nil {
+		logLevel = new(slog.LevelVar)
+		logLevel.Set(cfg.LogLevel)
+	}
+	s := &Server{cfg: cfg, logger: logger, logLevel: logLevel}
+	lc := newLifecycle(logger)
+	s.lc = lc
+	accessLogMode := newAccessLogModeVar(cfg.AccessLogMode)
+	reload := newReloader(logger, cfg.args, logLevel, accessLogMode, cfg)
+	s.reload = reload
+
+	build := readBuildInfo(cfg.AppVersion)
+	s.build = build
+
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.TracesExporter != tracesExporterNone {
+		var err error
+		tracerProvider, err = newTracerProvider(context.Background(), build.Version)
+		if err != nil {
+			return nil, fmt.Errorf("set up tracing: %w", err)
+		}
+		lc.OnShutdown(shutdownFlush, "traces", tracerProvider.Shutdown)
+	}
+	hc := newHealth()
+	s.hc = hc
+	m := newMetrics()
+	s.m = m
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", hc.Healthz)
+	mux.HandleFunc("GET /readyz", hc.Readyz)
+	mux.Handle("GET /metrics", m.Handler())
+	mux.HandleFunc("GET /version", build.Handler)
+	frontend := newFrontendConfig(cfg, build.Version)
+	mux.HandleFunc("GET /config.js", frontend.Script)
+	mux.HandleFunc("GET /api/config", frontend.JSON)
+	if cfg.CSRFMode == csrfModeToken {
+		mux.HandleFunc("GET /api/csrf", CSRFToken)
+	}
+
+	transport, err := newOutboundTransport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("set up the GREEN-API transport: %w", err)
+	}
+	var breakers *greenapi.Breakers
+	if cfg.GreenAPIBreakerThreshold > 0 {
+		breakers = greenapi.NewBreakers(cfg.GreenAPIBreakerThreshold, cfg.GreenAPIBreakerCooldown)
+		breakers.OnStateChange = func(host, idInstance string, from, to greenapi.CircuitState) {
+			instance := cfg.instanceLabel(idInstance)
+			m.observeCircuit(host, instance, to)
+			level := slog.LevelInfo
+			if to == greenapi.CircuitOpen {
+				level = slog.LevelWarn
+			}
+			logger.Log(context.Background(), level, "GREEN-API circuit breaker changed state",
+				slog.String("host", host),
+				slog.String("instance", instance),
+				slog.String("from", from.String()),
+				slog.String("to", to.String()),
+			)
+		}
+	}
+	var limiter *greenapi.Limiter
+	if len(cfg.GreenAPILimits) > 0 {
+		limiter = greenapi.NewLimiter(greenapi.Limits(cfg.GreenAPILimits), cfg.GreenAPILimitMaxWait)
+		limiter.OnWait = m.observeLimiterWait
+		limiter.OnReject = func(method string, _ time.Duration) {
+			m.observeLimiterRejection(method)
+		}
+	}
+	recorder := newUpstreamRecorder(m, cfg)
+	api := newGreenAPI(cfg, transport, breakers, limiter, recorder)
+	mux.Handle("GET /api/getSettings", HandlerE(api.GetSettings))
+	mux.Handle("GET /api/getStateInstance", HandlerE(api.GetStateInstance))
+	mux.Handle("GET /api/chatHistory", HandlerE(api.ChatHistory))
+	mux.Handle("GET "+mediaPath, HandlerE(api.Media))
+	mux.Handle("GET /api/qr", HandlerE(api.QR))
+	var sendMessage http.Handler = HandlerE(api.SendMessage)
+	if cfg.IdempotencyTTL > 0 {
+		sendMessage = Idempotent(newMemoryIdempotencyStore(), cfg.IdempotencyTTL, sendMessage)
+	}
+	mux.Handle("POST /api/sendMessage", sendMessage)
+	mux.Handle("POST "+bulkSendPath, HandlerE(api.SendMessages))
+	if cfg.SendQueueSize > 0 {
+		api.queue = newSendQueue(api, logger, cfg)
+		mux.Handle("GET /api/queue/{id}", HandlerE(api.QueuedMessage))
+		m.registerSendQueue(api.queue)
+		lc.OnShutdown(shutdownDrainQueues, "send queue", api.queue.Close)
+	}
+	mux.Handle("POST /api/sendFileByUrl", HandlerE(api.SendFileByURL))
+	if api.sessions != nil {
+		mux.Handle("POST /api/session", HandlerE(api.CreateSession))
+		mux.HandleFunc("DELETE /api/session", api.DeleteSession)
+	}
+	mux.Handle("POST /api/checkWhatsapp", HandlerE(api.CheckWhatsapp))
+	if cfg.AdminToken != "" {
+		mux.Handle("POST /api/settings", AdminAuth(cfg.AdminToken, HandlerE(api.SetSettings)))
+	}
+	mux.Handle("POST "+uploadPath, HandlerE(api.SendFileByUpload))
+	if len(cfg.GreenAPIProxyMethods) > 0 {
+		proxy, err := newAPIProxy(api, cfg.GreenAPIProxyMethods)
+		if err != nil {
+			return nil, fmt.Errorf("set up the GREEN-API proxy: %w", err)
+		}
+		mux.Handle("/api/proxy/{method}", proxy)
+	}
+	mux.HandleFunc("/api/", apiNotFound(mux, "/api/"))
+
+	maintenance := newMaintenanceMode(logger, cfg.MaintenanceFile, func() ([]byte, error) {
+		root, err := staticFileSystem(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return readStaticPage(root, cfg.MaintenancePage)
+	})
+	hc.maintenance = maintenance
+	capture := newDebugCapture(logger, cfg)
+	if cfg.UnsafeFullBodies {
+		logger.Warn("UNSAFE_FULL_BODIES is set, debug capture logs bodies with tokens, phone numbers and message text")
+	}
+	var stats *requestStats
+	if cfg.AdminToken != "" || cfg.EnablePprof {
+		stats = newRequestStats()
+		stats.calls = recorder.calls
+		stats.sendQueue = api.queue
+	}
+	if cfg.AdminToken != "" {
+		admin := &adminAPI{cfg: cfg, logLevel: logLevel, accessLogMode: accessLogMode, maintenance: maintenance, capture: capture}
+		mux.Handle(adminPrefix, admin.Handler(cfg.AdminToken))
+		mux.Handle("GET /stats", AdminAuth(cfg.AdminToken, http.HandlerFunc(stats.Handler)))
+	}
+
+	notifs := newNotifications(logger, cfg.WebhookWorkers, cfg.WebhookQueueSize)
+	registerNotificationHandlers(notifs, api)
+	cors := newCORSPolicy(cfg)
+	hub := newNotificationHub(hubOptions{
+		BufferSize:   cfg.WSSendBuffer,
+		ReplaySize:   cfg.EventsReplaySize,
+		PingInterval: cfg.WSPingInterval,
+		PongTimeout:  cfg.WSPongTimeout,
+		Heartbeat:    cfg.EventsHeartbeat,
+		CheckOrigin: func(r *http.Request) bool {
+			return sameOrigin(r) || cors.allowed(r.Header.Get("Origin"))
+		},
+	})
+	notifs.hub = hub
+	m.registerNotificationHub(hub)
+	lc.OnShutdown(shutdownCloseStreams, "notification streams", hub.Close)
+	mux.Handle("GET /ws", hub)
+	mux.HandleFunc("GET "+eventsPath, hub.Events)
+	if cfg.WebhookAuthToken == "" {
+		logger.Warn("WEBHOOK_AUTH_TOKEN is not set, anyone who knows the URL can post notifications to /webhook")
+	}
+	mux.Handle("POST /webhook", WebhookAuth(cfg.WebhookAuthToken, cfg.WebhookAllow, http.HandlerFunc(notifs.Webhook)))
+	lc.OnShutdown(shutdownDrainQueues, "notification workers", notifs.Close)
+
+	if cfg.GreenAPIPoll {
+		idInstance, apiToken := cfg.DefaultInstance()
+		pollClient := greenapi.NewClient(greenapi.Endpoints{API: cfg.GreenAPIURL, Media: cfg.GreenAPIMediaURL}, idInstance, apiToken, &http.Client{
+			// Long-polling holds the request for up to the receive timeout.
+			Timeout:   cfg.GreenAPIPollTimeout + cfg.GreenAPITimeout,
+			Transport: tracingTransport{base: transport},
+		}).WithRecorder(recorder)
+		if breakers != nil {
+			pollClient.WithBreakers(breakers)
+		}
+		poller := newNotificationPoller(pollClient, notifs, logger, cfg.GreenAPIPollTimeout)
+
+		pollCtx, cancelPoll := context.WithCancel(context.Background())
+		pollDone := make(chan struct{})
+		go func() {
+			defer close(pollDone)
+			poller.Run(pollCtx)
+		}()
+		lc.OnShutdown(shutdownStopIntake, "notification poller", func(ctx context.Context) error {
+			cancelPoll()
+			select {
+			case <-pollDone:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+
+	if cfg.GreenAPIHealthInterval > 0 {
+		healthHTTP := &http.Client{
+			Timeout:   cfg.GreenAPITimeout,
+			Transport: tracingTransport{base: transport},
+		}
+		newChecker := func(name, idInstance, apiToken string) *upstreamChecker {
+			healthClient := greenapi.NewClient(greenapi.Endpoints{API: cfg.GreenAPIURL, Media: cfg.GreenAPIMediaURL}, idInstance, apiToken, healthHTTP).
+				WithRecorder(recorder)
+			if breakers != nil {
+				healthClient.WithBreakers(breakers)
+			}
+			return newUpstreamChecker(name, healthClient, logger, cfg.GreenAPIHealthInterval, cfg.GreenAPITimeout)
+		}
+		checks := &upstreamChecks{named: len(cfg.GreenAPIInstances) > 0}
+		if cfg.GreenAPIIDInstance != "" {
+			checks.primary = newChecker(defaultInstanceName, cfg.GreenAPIIDInstance, cfg.GreenAPIToken)
+			checks.checkers = append(checks.checkers, checks.primary)
+		}
+		for _, name := range cfg.GreenAPIInstances.names() {
+			instance := cfg.GreenAPIInstances[name]
+			checker := newChecker(name, instance.IDInstance, instance.APIToken)
+			if name == cfg.GreenAPIDefaultInstance {
+				checks.primary = checker
+			}
+			checks.checkers = append(checks.checkers, checker)
+		}
+		hc.upstream = checks
+		hc.upstreamRequired = cfg.GreenAPIHealthRequired
+		if stats != nil {
+			stats.upstream = checks
+		}
+
+		checkCtx, cancelCheck := context.WithCancel(context.Background())
+		var checkers sync.WaitGroup
+		for _, checker := range checks.checkers {
+			checkers.Add(1)
+			go func() {
+				defer checkers.Done()
+				checker.Run(checkCtx)
+			}()
+		}
+		checkDone := make(chan struct{})
+		go func() {
+			checkers.Wait()
+			close(checkDone)
+		}()
+		lc.OnShutdown(shutdownStopIntake, "upstream health check", func(ctx context.Context) error {
+			cancelCheck()
+			select {
+			case <-checkDone:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+
+	var vars *debugVars
+	if cfg.EnablePprof {
+		vars = newDebugVars(stats, &s.inFlight)
+		if cfg.DebugPort != "" {
+			// No WriteTimeout: CPU profiles and traces stream for as long as requested.
+			s.debugSrv = &http.Server{
+				Addr:              ":" + cfg.DebugPort,
+				Handler:           RequestLogger(logger, defaultLogRules, newDebugMux(vars)),
+				ReadTimeout:       cfg.ReadTimeout,
+				ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+				IdleTimeout:       cfg.IdleTimeout,
+				MaxHeaderBytes:    int(cfg.MaxHeaderBytes),
+			}
+			// The debug server is drained last, so that the drain of the
+			// others can still be profiled.
+			s.debug = newServerGroup(logger)
+			lc.OnShutdown(shutdownStopServers, "debug server", s.debug.Shutdown)
+		} else {
+			debugMux := RequireDebugToken(cfg.DebugToken, newDebugMux(vars))
+			mux.Handle("/debug/pprof/", debugMux)
+			mux.Handle("/debug/vars", debugMux)
+		}
+	}
+
+	staticFS, err := staticFileSystem(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("open static files: %w", err)
+	}
+
+	// Assets are hashed from the files themselves, not through the memory
+	// cache, so that hashing does not push out what is actually requested.
+	assetFS := staticFS
+
+	var cache *fileCache
+	if cfg.StaticCacheMaxBytes > 0 {
+		cache, err = newFileCache(int64(cfg.StaticCacheMaxBytes), int64(cfg.StaticCacheMaxFileSize), logger)
+		if err != nil {
+			return nil, fmt.Errorf("set up static file cache: %w", err)
+		}
+		m.registerFileCache(cache)
+		if vars != nil {
+			vars.fileCache = cache
+		}
+		lc.OnShutdown(shutdownFlush, "static file watcher", func(context.Context) error {
+			return cache.Close()
+		})
+
+		watchDir := cfg.StaticDir
+		if cfg.EmbedStatic {
+			watchDir = ""
+		}
+		staticFS, err = cache.FileSystem(staticFS, watchDir)
+		if err != nil {
+			return nil, fmt.Errorf("open static files: %w", err)
+		}
+	}
+
+	mimeTypes := cfg.MIMETypes.withDefaults()
+
+	assetDirs := normalizeAssetDirs(cfg.AssetDirs)
+	staticRules := reload.cacheRules
+	if len(assetDirs) > 0 {
+		staticRules = assetCacheRules(assetDirs, reload.cacheRules)
+	}
+
+	var index *indexPage
+	if cfg.IndexTemplate {
+		index, err = newIndexPage(staticFS, newIndexData(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("render index.html: %w", err)
+		}
+	}
+
+	static := newStaticHandler(staticFS, staticOptions{
+		Precompressed:     cfg.StaticPrecompressed,
+		CacheRules:        staticRules,
+		MIMETypes:         mimeTypes,
+		SPA:               cfg.SPAMode,
+		DisableDirListing: cfg.DisableDirListing,
+		Index:             index,
+	})
+	if cfg.NotFoundPage != "" {
+		if err := static.LoadNotFoundPage(cfg.NotFoundPage); err != nil {
+			logger.Warn("Could not load not found page, using plain text",
+				slog.String("page", cfg.NotFoundPage),
+				slog.Any("error", err),
+			)
+		}
+	}
+	staticGroup := Chain(
+		func(next http.Handler) http.Handler { return AllowMethods(staticMethods, next) },
+		func(next http.Handler) http.Handler { return StaticGuard(cfg.HiddenAllowlist, next) },
+	).Group(mux)
+	staticGroup.Handle("/", static)
+
+	if len(assetDirs) > 0 {
+		immutable := CacheRules{{Pattern: "/", Value: immutableCacheControl}}
+		hashed := newStaticHandler(staticFS, staticOptions{
+			Precompressed: cfg.StaticPrecompressed,
+			CacheRules:    func(*http.Request) CacheRules { return immutable },
+			MIMETypes:     mimeTypes,
+		})
+		diskDir := cfg.StaticDir
+		if cfg.EmbedStatic {
+			diskDir = ""
+		}
+		assets, err := newAssetPipeline(assetFS, diskDir, assetDirs, hashed, static, logger)
+		if err != nil {
+			return nil, fmt.Errorf("fingerprint assets: %w", err)
+		}
+		lc.OnShutdown(shutdownFlush, "asset watcher", func(context.Context) error {
+			return assets.Close()
+		})
+		staticGroup.Handle(assetsPrefix+"/", assets)
+		logger.Info("Assets fingerprinted", slog.Any("dirs", assetDirs), slog.Int("files", assets.Len()))
+	}
+
+	for _, mount := range cfg.StaticMounts {
+		rules := reload.cacheRules
+		if mount.CacheControl != "" {
+			mountRules := CacheRules{{Pattern: mount.Prefix + "/", Value: mount.CacheControl}}
+			rules = func(*http.Request) CacheRules { return mountRules }
+		}
+
+		var mountFS http.FileSystem = http.Dir(mount.Dir)
+		if cache != nil {
+			mountFS, err = cache.FileSystem(mountFS, mount.Dir)
+			if err != nil {
+				return nil, fmt.Errorf("open static files for %s: %w", mount.Prefix, err)
+			}
+		}
+
+		mountHandler := newStaticHandler(mountFS, staticOptions{
+			Precompressed:     cfg.StaticPrecompressed,
+			CacheRules:        rules,
+			MIMETypes:         mimeTypes,
+			Prefix:            mount.Prefix,
+			DisableDirListing: cfg.DisableDirListing,
+		})
+		staticGroup.Handle(mount.Prefix+"/", http.StripPrefix(mount.Prefix, mountHandler))
+	}
+
+	s.cached = cache != nil
+	m.registerConnections(&s.conns)
+
+	routeTimeouts := cfg.RequestTimeoutRoutes
+	if routeTimeouts == nil {
+		routeTimeouts = make(RouteTimeouts)
+	}
+	// Uploads have GREENAPI_UPLOAD_TIMEOUT for all of it, and answer only
+	// once the file is sent.
+	if _, ok := routeTimeouts[uploadPath]; !ok {
+		routeTimeouts[uploadPath] = cfg.GreenAPIUploadTimeout
+	}
+	// Batches have BULK_SEND_TIMEOUT of their own.
+	if _, ok := routeTimeouts[bulkSendPath]; !ok {
+		routeTimeouts[bulkSendPath] = 0
+	}
+	// So do media downloads, with MEDIA_TIMEOUT.
+	if _, ok := routeTimeouts[mediaPath]; !ok {
+		routeTimeouts[mediaPath] = 0
+	}
+	var errPages *errorPages
+	if cfg.ErrorPagesDir != "" {
+		errPages, err = loadErrorPages(cfg.ErrorPagesDir)
+		if err != nil {
+			return nil, fmt.Errorf("load error pages: %w", err)
+		}
+	}
+	bodyLimits := maps.Clone(cfg.MaxBodyRoutes)
+	if bodyLimits == nil {
+		bodyLimits = make(BodyLimits)
+	}
+	if _, ok := bodyLimits[uploadPath]; !ok {
+		bodyLimits[uploadPath] = cfg.GreenAPIUploadMaxBytes
+	}
+	var concurrency *concurrencyLimiter
+	if cfg.MaxConcurrentRequests > 0 {
+		concurrency = newConcurrencyLimiter(cfg.MaxConcurrentRequests, cfg.QueueTimeout)
+		m.registerConcurrencyLimiter(concurrency)
+	}
+	logRules := newLogRules(cfg.LogSkipPaths, cfg.LogDebugPaths, cfg.LogAlwaysErrors)
+	logRules.slowThreshold = cfg.SlowRequestThreshold
+	logRules.writeTimeout = cfg.WriteTimeout
+	logRules.setRedactParams(cfg.LogRedactParams)
+	if len(cfg.LogSampleRules) > 0 {
+		logRules.sampler = newLogSampler(cfg.LogSampleRules)
+	}
+	logRules.stats = stats
+	logRules.mode = accessLogMode
+	requestLog := func(next http.Handler) http.Handler { return RequestLogger(logger, logRules, next) }
+	var accessLog io.WriteCloser
+	if cfg.AccessLogFormat != accessLogJSON || cfg.AccessLogFile != "" {
+		accessLog, err = openAccessLog(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("open access log %s: %w", cfg.AccessLogFile, err)
+		}
+		lc.OnShutdown(shutdownFlush, "access log", func(context.Context) error {
+			return accessLog.Close()
+		})
+		if cfg.AccessLogFormat == accessLogJSON {
+			format := cfg.LogFormat
+			if format == "" {
+				var out io.Writer = accessLog
+				if std, ok := accessLog.(nopWriteCloser); ok {
+					out = std.Writer
+				}
+				format = defaultLogFormat(out)
+			}
+			accessHandler := newLogHandler(format, accessLog, logLevel)
+			if cfg.TracesExporter != tracesExporterNone {
+				accessHandler = traceHandler{accessHandler}
+			}
+			requestLog = func(next http.Handler) http.Handler {
+				return SeparateRequestLogger(slog.New(accessHandler), logRules, next)
+			}
+		} else {
+			clf := newCLFLogger(accessLog, cfg.AccessLogFormat)
+			requestLog = func(next http.Handler) http.Handler { return AccessLog(logRules, clf.Log, next) }
+		}
+	}
+	s.accessFile, _ = accessLog.(*rotatingFile)
+
+	// The middleware of the main listener, from the outermost in: each one
+	// sees the request before, and the response after, the ones below it.
+	var stack Stack
+	if cfg.EnableH2C && !cfg.HTTPSEnabled() {
+		stack = stack.Use(func(next http.Handler) http.Handler { return h2c.NewHandler(next, &http2.Server{}) })
+	}
+	stack = stack.Use(
+		reload.Pin,
+		func(next http.Handler) http.Handler { return InFlight(&s.inFlight, next) },
+		RequestID,
+	)
+	if tracerProvider != nil {
+		stack = stack.Use(func(next http.Handler) http.Handler { return Tracing(tracerProvider, next) })
+	}
+	if errPages != nil {
+		stack = stack.Use(func(next http.Handler) http.Handler { return WithErrorPages(errPages, next) })
+	}
+	stack = stack.Use(
+		func(next http.Handler) http.Handler { return SecurityHeaders(reload.securityHeaders, next) },
+		func(next http.Handler) http.Handler { return Recover(logger, next) },
+	)
+	if len(cfg.TrustedProxies) > 0 {
+		stack = stack.Use(func(next http.Handler) http.Handler { return RealIP(cfg.TrustedProxies, next) })
+	}
+	stack = stack.Use(
+		func(next http.Handler) http.Handler { return ContextLogger(logger, next) },
+		requestLog,
+		// Allowed hosts and rate limits can be turned on by a reload, so
+		// their middleware is always there and passes everything while they
+		// are off.
+		func(next http.Handler) http.Handler { return TrustedHosts(reload.hostPolicy, next) },
+	)
+	if len(cfg.GreenAPIInstances) > 0 {
+		stack = stack.Use(func(next http.Handler) http.Handler { return InstanceRoutes(cfg.GreenAPIInstances, next) })
+	}
+	if len(cfg.IPAllow) > 0 || len(cfg.IPDeny) > 0 {
+		policy := &ipFilterPolicy{allow: cfg.IPAllow, deny: cfg.IPDeny, prefixes: cfg.IPFilterPrefixes}
+		stack = stack.Use(func(next http.Handler) http.Handler { return IPFilter(logger, policy, next) })
+	}
+	stack = stack.Use(func(next http.Handler) http.Handler { return RateLimit(reload.rateLimiter, next) })
+	if concurrency != nil {
+		stack = stack.Use(func(next http.Handler) http.Handler { return ConcurrencyLimit(logger, concurrency, next) })
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		stack = stack.Use(func(next http.Handler) http.Handler { return CORS(cors, next) })
+	}
+	if cfg.CSRFMode != csrfModeOff {
+		policy := newCSRFPolicy(cfg, cors)
+		stack = stack.Use(func(next http.Handler) http.Handler { return CSRF(policy, next) })
+	}
+	if cfg.MTLSClientCA != "" {
+		paths := newPathMatcher(cfg.MTLSPaths)
+		stack = stack.Use(func(next http.Handler) http.Handler { return ClientCertAuth(paths, next) })
+	}
+	if len(cfg.BasicAuthUsers) > 0 {
+		policy := &basicAuthPolicy{
+			users:    cfg.BasicAuthUsers,
+			prefixes: cfg.BasicAuthPrefixes,
+			exclude:  cfg.BasicAuthExclude,
+			realm:    cfg.BasicAuthRealm,
+		}
+		stack = stack.Use(func(next http.Handler) http.Handler { return BasicAuth(policy, next) })
+	}
+	stack = stack.Use(func(next http.Handler) http.Handler { return BodyLimit(int64(cfg.MaxBodyBytes), bodyLimits, next) })
+	if cfg.Compression {
+		stack = stack.Use(func(next http.Handler) http.Handler { return Compress(int(cfg.CompressionMinSize), next) })
+	}
+	stack = stack.Use(
+		ErrorPages,
+		// Debug capture can be turned on through /admin/capture, so it is
+		// always there and passes everything while it is off.
+		func(next http.Handler) http.Handler { return DebugCapture(capture, next) },
+		func(next http.Handler) http.Handler { return Metrics(m, next) },
+		func(next http.Handler) http.Handler { return Timeout(cfg.RequestTimeout, routeTimeouts, next) },
+		func(next http.Handler) http.Handler { return Maintenance(maintenance, next) },
+		HeadBody,
+	)
+	s.handler = stack.Then(mux)
+
+	_, address := cfg.Listen()
+	s.srv = &http.Server{
+		Addr:              address,
+		Handler:           s.handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    int(cfg.MaxHeaderBytes),
+		ConnState:         s.conns.track,
+	}
+	s.servers = newServerGroup(logger)
+	lc.OnShutdown(shutdownDrainHTTP, "http servers", func(ctx context.Context) error {
+		if err := s.servers.Shutdown(ctx); err != nil {
+			logger.Error("Server forced to shutdown",
+				slog.Any("error", err),
+				slog.Int64("in_flight", s.inFlight.Load()),
+				slog.Int64("terminated_connections", s.conns.Open()),
+			)
+			return err
+		}
+		logger.Info("Server drained", slog.Int64("in_flight", s.inFlight.Load()))
+		return nil
+	})
+
+	switch {
+	case cfg.TLSEnabled():
+		if len(cfg.AutocertDomains) > 0 {
+			logger.Warn("TLS certificate files are configured, ignoring AUTOCERT_DOMAINS")
+		}
+		s.srv.TLSConfig = newTLSConfig()
+	case cfg.AutocertEnabled():
+		certManager, err := newAutocertManager(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("set up autocert: %w", err)
+		}
+		s.srv.TLSConfig = newAutocertTLSConfig(certManager)
+		s.acme = certManager.HTTPHandler
+	}
+	if cfg.MTLSClientCA != "" && s.srv.TLSConfig != nil {
+		pool, err := loadClientCAs(cfg.MTLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("load MTLS_CLIENT_CA: %w", err)
+		}
+		// Certificates stay optional in the handshake, so that the paths
+		// outside MTLS_PATHS stay open to clients without one.
+		s.srv.TLSConfig.ClientCAs = pool
+		s.srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if port := cfg.PlainHTTPPort(); port != "" {
+		_, httpsPort, _ := net.SplitHostPort(address)
+		s.plainSrv = &http.Server{
+			Addr:              ":" + port,
+			Handler:           RequestLogger(logger, defaultLogRules, plainHandler(hc, cfg.RedirectHTTP || s.acme != nil, httpsPort, s.acme)),
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			MaxHeaderBytes:    int(cfg.MaxHeaderBytes),
+		}
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the main listener is bound to, with the port
+// the system picked for PORT=0, or the socket path. It is empty until the
+// server listens.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Handler returns the routes of the main listener behind the whole
+// middleware stack, as Run serves them.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Listen binds the listeners, or takes them over from the parent process
+// after a restart, without serving on them yet. A port still in use is
+// tried again for RETRY_BIND_FOR. Run calls Listen when it has not been
+// called, but calling it first keeps bind errors apart from errors while
+// serving.
+func (s *Server) Listen() error {
+	cfg, logger := s.cfg, s.logger
+
+	up, err := newUpgrader()
+	if err != nil {
+		return fmt.Errorf("inherit listeners: %w", err)
+	}
+	s.up = up
+
+	_, address := cfg.Listen()
+	ln, err := up.Listen("main", func() (net.Listener, error) {
+		return bindWithRetry(logger, "main", address, cfg.RetryBindFor, func() (net.Listener, error) { return listen(cfg) })
+	})
+	if err != nil {
+		return listenError(address, err)
+	}
+	s.addr = ln.Addr().String()
+	s.hc.SetAddr(s.addr)
+	if cfg.PortFile != "" {
+		if err := writePortFile(cfg.PortFile, s.addr); err != nil {
+			ln.Close()
+			return fmt.Errorf("write PORT_FILE: %w", err)
+		}
+	}
+	if cfg.MaxConnections > 0 {
+		limited := newLimitListener(ln, cfg.MaxConnections)
+		s.m.registerConnectionLimit(limited)
+		ln = limited
+	}
+	if cfg.HTTPSEnabled() {
+		s.servers.Add("https", s.srv, ln, func(ln net.Listener) error {
+			return s.srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+		})
+	} else {
+		s.servers.Add("http", s.srv, ln, s.srv.Serve)
+	}
+
+	if s.plainSrv != nil {
+		plainLn, err := up.Listen("http", func() (net.Listener, error) {
+			return bindWithRetry(logger, "http", s.plainSrv.Addr, cfg.RetryBindFor, func() (net.Listener, error) {
+				return net.Listen("tcp", s.plainSrv.Addr)
+			})
+		})
+		if err != nil {
+			return listenError(s.plainSrv.Addr, err)
+		}
+		s.servers.Add("http", s.plainSrv, plainLn, s.plainSrv.Serve)
+		if s.acme != nil {
+			logger.Info("Serving ACME challenges", slog.String("port", cfg.PlainHTTPPort()), slog.Any("domains", cfg.AutocertDomains))
+		}
+	}
+
+	if s.debugSrv != nil {
+		debugLn, err := up.Listen("debug", func() (net.Listener, error) {
+			return bindWithRetry(logger, "debug", s.debugSrv.Addr, cfg.RetryBindFor, func() (net.Listener, error) {
+				return net.Listen("tcp", s.debugSrv.Addr)
+			})
+		})
+		if err != nil {
+			return listenError(s.debugSrv.Addr, err)
+		}
+		s.debug.Add("debug", s.debugSrv, debugLn, s.debugSrv.Serve)
+	}
+	return nil
+}
+
+// Run serves on the listeners, binding them first unless Listen already
+// did, until ctx is done or one of them fails. The server is ready from the
+// moment it serves until Run returns; it is left running for Shutdown to
+// drain, and the error of a failed listener is returned.
+func (s *Server) Run(ctx context.Context) error {
+	if s.up == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
+	cfg, logger, up := s.cfg, s.logger, s.up
+
+	if s.debug != nil {
+		s.debug.Start()
+	}
+
+	network, _ := cfg.Listen()
+	address := s.Addr()
+	scheme := "http"
+	if cfg.HTTPSEnabled() {
+		scheme = "https"
+	}
+	addrAttr := slog.String("addr", address)
+	if network == "unix" {
+		addrAttr = slog.String("socket", address)
+	}
+	logger.Info("Starting server",
+		addrAttr,
+		slog.String("dir", cfg.StaticDir),
+		slog.String("static_mode", cfg.StaticMode()),
+		slog.Bool("static_cache", s.cached),
+		slog.String("scheme", scheme),
+		slog.Bool("h2c", cfg.EnableH2C && !cfg.HTTPSEnabled()),
+		slog.Bool("inherited", up.Inherited()),
+		s.build.LogAttr(),
+	)
+	s.servers.Start()
+
+	s.hc.SetReady(true)
+	defer s.hc.SetReady(false)
+
+	if err := up.Ready(); err != nil {
+		logger.Error("Could not notify parent process", slog.Any("error", err))
+	}
+
+	var debugFailed <-chan error
+	if s.debug != nil {
+		debugFailed = s.debug.Failed()
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-s.servers.Failed():
+		return err
+	case err := <-debugFailed:
+		return err
+	}
+}
+
+// Shutdown drains the listeners and stops the background workers within
+// the deadline of ctx, then removes the unix socket unless the listeners
+// were handed off to a replacement process.
+func (s *Server) Shutdown(ctx context.Context) error {
+	start := time.Now()
+	err := s.lc.Shutdown(ctx)
+	s.logger.Info("Shutdown drain finished", slog.Duration("duration", time.Since(start)),
+		slog.Duration("timeout", s.cfg.ShutdownTimeout))
+
+	if s.HandedOff() {
+		// The replacement process serves on the same address and has
+		// written PORT_FILE itself.
+		s.logger.Info("Listeners handed off to the replacement process")
+		return err
+	}
+	if rmErr := removeSocket(s.cfg); rmErr != nil {
+		_, address := s.cfg.Listen()
+		s.logger.Error("Could not remove socket", slog.String("socket", address), slog.Any("error", rmErr))
+		err = errors.Join(err, rmErr)
+	}
+	if s.cfg.PortFile != "" && s.addr != "" {
+		if rmErr := os.Remove(s.cfg.PortFile); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			s.logger.Error("Could not remove port file", slog.String("file", s.cfg.PortFile), slog.Any("error", rmErr))
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
+
+// Reload applies the reloadable changes to the configuration and reopens
+// the access log file.
+func (s *Server) Reload() error {
+	err := s.reload.Reload()
+	if s.accessFile != nil {
+		if err := s.accessFile.Reopen(); err == nil {
+			s.logger.Info("Access log file reopened", slog.String("file", s.cfg.AccessLogFile))
+		}
+	}
+	return err
+}
+
+// ToggleLogLevel switches between debug and the configured level.
+func (s *Server) ToggleLogLevel() {
+	toggleLogLevel(s.logger, s.logLevel, s.reload.running.LogLevel)
+}
+
+// Upgrade starts a replacement process that takes over the listeners and
+// returns its pid once it is ready.
+func (s *Server) Upgrade() (int, error) {
+	if s.up == nil {
+		return 0, errors.New("server is not running")
+	}
+	return s.up.Upgrade()
+}
+
+// HandedOff reports whether a replacement process took over the listeners.
+func (s *Server) HandedOff() bool {
+	return s.up != nil && s.up.HandedOff()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// testConfig returns the defaults with a free port and the static files in
+// a temporary directory holding index.html, after mutate has adjusted it.
+func testConfig(t *testing.T, mutate func(*Config)) *Config {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.Port = "0"
+	cfg.StaticDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.StaticDir, "index.html"), []byte("<h1>index</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if mutate != nil {
+		mutate(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	return cfg
+}
+
+// logBuffer collects JSON log lines and is safe to write from the handlers
+// while the test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestServer builds the server for testConfig(t, mutate), logging JSON
+// at debug level into the returned buffer.
+func newTestServer(t *testing.T, mutate func(*Config)) (*Server, *logBuffer) {
+	t.Helper()
+	cfg := testConfig(t, mutate)
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, err := NewServer(cfg, logger, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s, logs
+}
+
+// startTestServer runs newTestServer(t, mutate) on its listener and shuts
+// it down when the test ends.
+func startTestServer(t *testing.T, mutate func(*Config)) (*Server, *logBuffer) {
+	t.Helper()
+	s, logs := newTestServer(t, mutate)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return s, logs
+}
+
+// fakeGreenAPI serves handler in place of GREEN-API until the test ends.
+func fakeGreenAPI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// withUpstream points the default instance, 1101 with token "secret", at
+// upstream.
+func withUpstream(upstream *httptest.Server) func(*Config) {
+	return func(cfg *Config) {
+		cfg.GreenAPIURL = upstream.URL
+		cfg.GreenAPIMediaURL = upstream.URL
+		cfg.GreenAPIIDInstance = "1101"
+		cfg.GreenAPIToken = "secret"
+	}
+}
+
+// serverURL returns the URL of path on the loopback address of s.
+func serverURL(t *testing.T, s *Server, scheme, path string) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scheme + "://" + net.JoinHostPort("127.0.0.1", port) + path
+}
+
+func TestServerServesStaticAndHealth(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/", http.StatusOK, "<h1>index</h1>"},
+		{"/healthz", http.StatusOK, ""},
+		{"/api/unknown", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(serverURL(t, s, "http", tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge over plain TCP.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestServerH2C(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		wantProto string
+	}{
+		{"enabled", true, "HTTP/2.0"},
+		{"disabled", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := startTestServer(t, func(cfg *Config) { cfg.EnableH2C = tt.enabled })
+			client := h2cClient()
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get(serverURL(t, s, "http", "/"))
+			if tt.wantProto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("prior-knowledge HTTP/2 succeeded without ENABLE_H2C")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.Proto != tt.wantProto || string(body) != "<h1>index</h1>" {
+				t.Errorf("got %s %d %q", resp.Proto, resp.StatusCode, body)
+			}
+			if !strings.Contains(logs.String(), `"proto":"HTTP/2.0"`) {
+				t.Errorf("the request is not logged with proto HTTP/2.0:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestServerH2CKeepsHTTP1(t *testing.T) {
+	s, _ := startTestServer(t, func(cfg *Config) { cfg.EnableH2C = true })
+	resp, err := http.Get(serverURL(t, s, "http", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Proto != "HTTP/1.1" || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s %d, want HTTP/1.1 200", resp.Proto, resp.StatusCode)
+	}
+}
+
+// TestServerHandler drives the assembled stack without a socket.
+func TestServerHandler(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantType   string
+	}{
+		{"/", http.StatusOK, "text/html"},
+		{"/index.html", http.StatusMovedPermanently, ""},
+		{"/missing.js", http.StatusNotFound, "text/plain"},
+		{"/.env", http.StatusNotFound, "text/plain"},
+		{"/healthz", http.StatusOK, "application/json"},
+		{"/readyz", http.StatusServiceUnavailable, "application/json"},
+		{"/version", http.StatusOK, "application/json"},
+		{"/metrics", http.StatusOK, "text/plain"},
+		{"/api/getSettings", http.StatusUnauthorized, "application/json"},
+		{"/api/nothing/here", http.StatusNotFound, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, tt.path, nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestServerLogFields(t *testing.T) {
+	s, logs := newTestServer(t, nil)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "req-91")
+	req.Header.Set("User-Agent", "server-test")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "req-91" {
+		t.Errorf("X-Request-ID = %q, want it echoed", got)
+	}
+
+	var line map[string]any
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, `"msg":"HTTP Request"`) {
+			if err := json.Unmarshal([]byte(l), &line); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if line == nil {
+		t.Fatalf("no access log line:\n%s", logs)
+	}
+	want := map[string]any{
+		"request_id": "req-91",
+		"method":     "GET",
+		"path":       "/",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(len("<h1>index</h1>")),
+		"user_agent": "server-test",
+		"level":      "INFO",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+	if _, ok := line["duration"]; !ok {
+		t.Error("the line has no duration")
+	}
+}
+
+// TestServerRunAndShutdown checks the server is ready while Run serves and
+// takes no connections once Shutdown returns.
+func TestServerRunAndShutdown(t *testing.T) {
+	s, logs := newTestServer(t, nil)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	url := serverURL(t, s, "http", "/readyz")
+	waitFor(t, "the server to be ready", func() bool {
+		resp, err := http.Get(url)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	http.DefaultClient.CloseIdleConnections()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rec := serve(s, http.MethodGet, "/readyz", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after Run = %d, want 503", rec.Code)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if conn, err := net.DialTimeout("tcp", s.Addr(), time.Second); err == nil {
+		conn.Close()
+		t.Error("a connection was accepted after Shutdown")
+	}
+	out := logs.String()
+	for _, msg := range []string{"Starting server", "Shutdown drain finished"} {
+		if !strings.Contains(out, `"msg":"`+msg+`"`) {
+			t.Errorf("%q was not logged:\n%s", msg, out)
+		}
+	}
+}
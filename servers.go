@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// serverGroup runs the HTTP servers of the service, each on its own
+// listener, and keeps them together: when one of them stops serving on its
+// own, Failed reports it so the others are shut down too, and Shutdown
+// drains all of them at once within one deadline.
+type serverGroup struct {
+	logger  *slog.Logger
+	servers []groupServer
+	failed  chan error
+}
+
+type groupServer struct {
+	name  string
+	srv   *http.Server
+	ln    net.Listener
+	serve func(ln net.Listener) error
+}
+
+func newServerGroup(logger *slog.Logger) *serverGroup {
+	return &serverGroup{logger: logger, failed: make(chan error, 1)}
+}
+
+// Add registers srv to be served on ln by serve, which is srv.Serve or
+// srv.ServeTLS with the certificate files.
+func (g *serverGroup) Add(name string, srv *http.Server, ln net.Listener, serve func(ln net.Listener) error) {
+	g.servers = append(g.servers, groupServer{name: name, srv: srv, ln: ln, serve: serve})
+}
+
+// Start serves every listener in a goroutine of its own and logs the
+// address each one is bound to.
+func (g *serverGroup) Start() {
+	for _, s := range g.servers {
+		g.logger.Info("Listening", slog.String("listener", s.name), slog.String("addr", s.ln.Addr().String()))
+		go func() {
+			err := s.serve(s.ln)
+			if err == nil || errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			select {
+			case g.failed <- fmt.Errorf("%s listener on %s: %w", s.name, s.ln.Addr(), err):
+			default:
+			}
+		}()
+	}
+}
+
+// Failed receives the error of the first server that stopped serving
+// before Shutdown.
+func (g *serverGroup) Failed() <-chan error {
+	return g.failed
+}
+
+// Shutdown drains every server at the same time, so that they share the
+// deadline of ctx, and closes those that do not make it.
+func (g *serverGroup) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(g.servers))
+	var wg sync.WaitGroup
+	for i, s := range g.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.srv.Shutdown(ctx); err != nil {
+				s.srv.Close()
+				errs[i] = fmt.Errorf("%s listener: %w", s.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// plainHandler serves the plain HTTP listener that runs next to HTTPS:
+// health checks for load balancers that probe without TLS, the ACME
+// challenge when acme is set and, with redirect, a redirect to HTTPS for
+// everything else; without it everything else is not found.
+func plainHandler(hc *health, redirect bool, httpsPort string, acme func(fallback http.Handler) http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", hc.Healthz)
+	mux.HandleFunc("GET /readyz", hc.Readyz)
+	if redirect {
+		mux.Handle("/", redirectHTTPS(httpsPort))
+	}
+	if acme != nil {
+		return acme(mux)
+	}
+	return mux
+}
+
+// redirectHTTPS sends requests to the same host, path and query over HTTPS
+// on port, which is left out of the URL when it is empty or 443.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerShutdownDrainsSlowRequest(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			io.WriteString(w, `{"stateInstance":"authorized"}`)
+		case <-r.Context().Done():
+		}
+	})
+
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantStatus int
+		wantLog    string
+	}{
+		{"generous timeout", 5 * time.Second, http.StatusOK, `"msg":"Server drained"`},
+		{"short timeout", 50 * time.Millisecond, 0, `"msg":"Server forced to shutdown"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := newTestServer(t, withUpstream(upstream))
+			if err := s.Listen(); err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.Run(ctx) }()
+
+			type result struct {
+				status int
+				err    error
+			}
+			url := serverURL(t, s, "http", "/api/getStateInstance")
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get(url)
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				results <- result{status: resp.StatusCode, err: err}
+			}()
+			for s.inFlight.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancelShutdown()
+			err := s.Shutdown(shutdownCtx)
+
+			got := <-results
+			if tt.wantStatus != 0 {
+				if err != nil || got.err != nil || got.status != tt.wantStatus {
+					t.Errorf("Shutdown = %v, request got %d, %v; want it to finish with %d", err, got.status, got.err, tt.wantStatus)
+				}
+			} else if err == nil || got.err == nil {
+				t.Errorf("Shutdown = %v, request got %d, %v; want both cut off", err, got.status, got.err)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logs do not contain %s:\n%s", tt.wantLog, logs)
+			}
+			if tt.wantStatus == 0 && !strings.Contains(logs.String(), `"terminated_connections":1`) {
+				t.Errorf("the forced shutdown does not log the terminated connection:\n%s", logs)
+			}
+		})
+	}
+}
+
+// freePort returns a port that was free a moment ago.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// groupListener adds a server answering with its name on a listener of its
+// own to g; block holds requests to /slow until it is closed.
+func groupListener(t *testing.T, g *serverGroup, name string, block <-chan struct{}) (string, net.Listener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-block
+		}
+		io.WriteString(w, name)
+	})}
+	g.Add(name, srv, ln, srv.Serve)
+	return "http://" + ln.Addr().String(), ln
+}
+
+func TestServerGroup(t *testing.T) {
+	logs := &logBuffer{}
+	g := newServerGroup(slog.New(slog.NewJSONHandler(logs, nil)))
+	block := make(chan struct{})
+	defer close(block)
+	urls := map[string]string{}
+	lns := map[string]net.Listener{}
+	for _, name := range []string{"https", "http"} {
+		urls[name], lns[name] = groupListener(t, g, name, block)
+	}
+	g.Start()
+
+	for name, url := range urls {
+		resp, err := http.Get(url + "/")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != name {
+			t.Errorf("%s listener answered %q", name, body)
+		}
+		if !strings.Contains(logs.String(), `"listener":"`+name+`","addr":"`+lns[name].Addr().String()+`"`) {
+			t.Errorf("the %s address is not logged:\n%s", name, logs)
+		}
+	}
+
+	// Both servers hold a request, so the drain takes the whole deadline
+	// they share rather than one deadline each.
+	for _, url := range urls {
+		go func() {
+			if resp, err := http.Get(url + "/slow"); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := g.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 180*time.Millisecond {
+		t.Errorf("Shutdown took %s with a 100ms deadline", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "https listener") || !strings.Contains(err.Error(), "http listener") {
+		t.Errorf("Shutdown = %v, want both listeners cut off", err)
+	}
+	for name, url := range urls {
+		if resp, err := http.Get(url + "/"); err == nil {
+			resp.Body.Close()
+			t.Errorf("the %s listener still serves after Shutdown", name)
+		}
+	}
+	select {
+	case err := <-g.Failed():
+		t.Errorf("Shutdown reported as a failure: %v", err)
+	default:
+	}
+}
+
+func TestServerGroupFailure(t *testing.T) {
+	g := newServerGroup(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	_, main := groupListener(t, g, "https", nil)
+	plainURL, _ := groupListener(t, g, "http", nil)
+	g.Start()
+
+	// A listener that goes away is a failure of the whole group.
+	main.Close()
+	select {
+	case err := <-g.Failed():
+		if !strings.Contains(err.Error(), "https listener on "+main.Addr().String()) {
+			t.Errorf("Failed = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closed listener was not reported")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	g.Shutdown(ctx)
+	if resp, err := http.Get(plainURL + "/"); err == nil {
+		resp.Body.Close()
+		t.Error("the other listener still serves after Shutdown")
+	}
+}
+
+func TestServerDualListeners(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSigned(t, t.TempDir())
+	tests := []struct {
+		name         string
+		redirect     bool
+		wantRootCode int
+	}{
+		{"health checks only", false, http.StatusNotFound},
+		{"redirect", true, http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			s, logs := newTestServer(t, func(cfg *Config) {
+				cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+				cfg.HTTPPort = port
+				cfg.RedirectHTTP = tt.redirect
+			})
+			if err := s.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.Run(ctx) }()
+
+			client := &http.Client{
+				Transport:     &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+			defer client.CloseIdleConnections()
+			get := func(url string) (int, error) {
+				resp, err := client.Get(url)
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			}
+			plain := "http://127.0.0.1:" + port
+			waitFor(t, "the plain listener", func() bool {
+				code, _ := get(plain + "/readyz")
+				return code == http.StatusOK
+			})
+
+			checks := []struct {
+				url  string
+				want int
+			}{
+				{serverURL(t, s, "https", "/"), http.StatusOK},
+				{serverURL(t, s, "https", "/healthz"), http.StatusOK},
+				{plain + "/healthz", http.StatusOK},
+				{plain + "/", tt.wantRootCode},
+			}
+			for _, c := range checks {
+				if code, err := get(c.url); err != nil || code != c.want {
+					t.Errorf("GET %s = %d, %v; want %d", c.url, code, err, c.want)
+				}
+			}
+			out := logs.String()
+			for _, listener := range []string{`"listener":"https","addr":"` + s.Addr() + `"`, `"listener":"http","addr":"[::]:` + port + `"`} {
+				if !strings.Contains(out, listener) {
+					t.Errorf("logs lack %s:\n%s", listener, out)
+				}
+			}
+
+			// A connection the client dialed but never used has not been
+			// idle yet and would hold up the drain.
+			client.CloseIdleConnections()
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelShutdown()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				t.Fatal(err)
+			}
+			for _, url := range []string{serverURL(t, s, "https", "/healthz"), plain + "/healthz"} {
+				if _, err := get(url); err == nil {
+					t.Errorf("%s still answers after Shutdown", url)
+				}
+			}
+		})
+	}
+}
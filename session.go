@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionCookie holds the credentials stored by POST /api/session. It is
+// only sent to /api/, where they are used.
+const (
+	sessionCookie     = "greenapi_session"
+	sessionCookiePath = "/api/"
+	sessionKeyBytes   = 32
+)
+
+// Reasons a session cookie is refused; they are logged, the cookie never is.
+var (
+	errSessionMalformed = errors.New("session cookie is malformed")
+	errSessionTampered  = errors.New("session cookie failed authentication")
+	errSessionExpired   = errors.New("session cookie has expired")
+)
+
+// parseSessionKey decodes SESSION_KEY: 32 bytes, hex or base64 encoded.
+func parseSessionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == sessionKeyBytes {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil && len(key) == sessionKeyBytes {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("must be %d bytes, hex or base64 encoded", sessionKeyBytes)
+}
+
+// sessionPayload is what the cookie carries, sealed.
+type sessionPayload struct {
+	IDInstance string `json:"i"`
+	APIToken   string `json:"t"`
+	Expires    int64  `json:"e"`
+}
+
+// sessionCodec seals credentials into a cookie value with AES-GCM, which
+// both hides them and makes any change to the cookie detectable. The cookie
+// name is authenticated along with them.
+type sessionCodec struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+func newSessionCodec(key []byte, ttl time.Duration) (*sessionCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCodec{aead: aead, ttl: ttl}, nil
+}
+
+// seal returns the cookie value for p.
+func (c *sessionCodec) seal(p sessionPayload) string {
+	plain, _ := json.Marshal(p)
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plain, []byte(sessionCookie)))
+}
+
+// open returns the payload of a cookie value sealed by seal, as long as it
+// has not expired by now.
+func (c *sessionCodec) open(value string, now time.Time) (sessionPayload, error) {
+	var p sessionPayload
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < c.aead.NonceSize()+c.aead.Overhead() {
+		return p, errSessionMalformed
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, []byte(sessionCookie))
+	if err != nil {
+		return p, errSessionTampered
+	}
+	if err := json.Unmarshal(plain, &p); err != nil || p.IDInstance == "" || p.APIToken == "" {
+		return sessionPayload{}, errSessionMalformed
+	}
+	if now.Unix() >= p.Expires {
+		return sessionPayload{}, errSessionExpired
+	}
+	return p, nil
+}
+
+func (c *sessionCodec) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     sessionCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// fromRequest returns the credentials of the session cookie of r; ok is
+// false when there is none.
+func (c *sessionCodec) fromRequest(r *http.Request) (p sessionPayload, ok bool, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return p, false, nil
+	}
+	p, err = c.open(cookie.Value, time.Now())
+	return p, true, err
+}
+
+// sessionScope identifies the session of r for Idempotency-Key without the
+// credentials; it is empty without a session cookie.
+func sessionScope(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(sum[:8])
+}
+
+func invalidSession(reason error) *HTTPError {
+	return &HTTPError{
+		Status:  http.StatusUnauthorized,
+		Code:    errCodeUnauthorized,
+		Message: "the session is invalid or has expired, sign in again",
+		Err:     reason,
+	}
+}
+
+type sessionRequest struct {
+	IDInstance string `json:"idInstance"`
+	APIToken   string `json:"apiTokenInstance"`
+}
+
+func (req *sessionRequest) validate(_ context.Context, v *validation) {
+	v.required("idInstance", req.IDInstance)
+	v.required("apiTokenInstance", req.APIToken)
+}
+
+type sessionResponse struct {
+	IDInstance    string    `json:"idInstance"`
+	StateInstance string    `json:"stateInstance"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// CreateSession serves POST /api/session: it checks the credentials with a
+// getStateInstance call and stores them in the session cookie for SESSION_TTL,
+// so that the browser need not keep them. Credentials GREEN-API rejects get
+// 401 like any other call.
+func (g *greenAPI) CreateSession(w http.ResponseWriter, r *http.Request) error {
+	var req sessionRequest
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c := g.newClient(r, req.IDInstance, req.APIToken)
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	state, err := c.GetStateInstance(ctx)
+	if err != nil {
+		return g.upstreamError(r, "getStateInstance", err)
+	}
+	if state.StateInstance != "" {
+		g.states.observe(req.IDInstance, state.StateInstance, time.Now())
+	}
+
+	expires := time.Now().Add(g.sessions.ttl).Truncate(time.Second)
+	value := g.sessions.seal(sessionPayload{IDInstance: req.IDInstance, APIToken: req.APIToken, Expires: expires.Unix()})
+	http.SetCookie(w, g.sessions.cookie(value, int(g.sessions.ttl/time.Second)))
+	writeJSON(w, http.StatusOK, sessionResponse{
+		IDInstance:    req.IDInstance,
+		StateInstance: state.StateInstance,
+		ExpiresAt:     expires.UTC(),
+	})
+	return nil
+}
+
+// DeleteSession serves DELETE /api/session by clearing the cookie.
+func (g *greenAPI) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, g.sessions.cookie("", -1))
+	w.WriteHeader(http.StatusNoContent)
+}
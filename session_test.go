@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSessionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestParseSessionKey(t *testing.T) {
+	key, _ := hex.DecodeString(testSessionKey)
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{"hex", testSessionKey, false},
+		{"hex with spaces", " " + testSessionKey + "\n", false},
+		{"base64", base64.StdEncoding.EncodeToString(key), false},
+		{"raw URL base64", base64.RawURLEncoding.EncodeToString(key), false},
+		{"too short", testSessionKey[:32], true},
+		{"too long", testSessionKey + "00", true},
+		{"not encoded", "correct horse battery staple", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSessionKey(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSessionKey = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, key) {
+				t.Errorf("key = %x, want %x", got, key)
+			}
+		})
+	}
+}
+
+func newTestSessionCodec(t *testing.T, hexKey string) *sessionCodec {
+	t.Helper()
+	key, err := parseSessionKey(hexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newSessionCodec(key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSessionCodec(t *testing.T) {
+	codec := newTestSessionCodec(t, testSessionKey)
+	other := newTestSessionCodec(t, strings.Repeat("ff", sessionKeyBytes))
+	now := time.Unix(1_700_000_000, 0)
+	payload := sessionPayload{IDInstance: "2202", APIToken: "browser-token", Expires: now.Add(time.Hour).Unix()}
+	value := codec.seal(payload)
+
+	flip := func(value string, i int) string {
+		b, _ := base64.RawURLEncoding.DecodeString(value)
+		b[i] ^= 1
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		codec   *sessionCodec
+		now     time.Time
+		wantErr error
+	}{
+		{"round trip", value, codec, now, nil},
+		{"just before expiry", value, codec, now.Add(time.Hour - time.Second), nil},
+		{"at expiry", value, codec, now.Add(time.Hour), errSessionExpired},
+		{"long expired", value, codec, now.Add(48 * time.Hour), errSessionExpired},
+		{"nonce changed", flip(value, 0), codec, now, errSessionTampered},
+		{"ciphertext changed", flip(value, 20), codec, now, errSessionTampered},
+		{"tag changed", flip(value, len(value)*3/4-1), codec, now, errSessionTampered},
+		{"other key", value, other, now, errSessionTampered},
+		{"truncated", value[:20], codec, now, errSessionMalformed},
+		{"not base64", "not*base64", codec, now, errSessionMalformed},
+		{"empty", "", codec, now, errSessionMalformed},
+		{"no credentials inside", codec.seal(sessionPayload{Expires: now.Add(time.Hour).Unix()}), codec, now, errSessionMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.codec.open(tt.value, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("open = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != payload {
+				t.Errorf("payload = %+v, want %+v", got, payload)
+			}
+			if err != nil && got != (sessionPayload{}) {
+				t.Errorf("a refused cookie gave %+v", got)
+			}
+		})
+	}
+
+	if again := codec.seal(payload); again == value {
+		t.Error("sealing twice gave the same value; the nonce is not random")
+	}
+	if strings.Contains(value, "browser-token") || strings.Contains(value, "2202") {
+		t.Errorf("the cookie shows the credentials: %s", value)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/wrong-token") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/getStateInstance/") {
+			w.Write([]byte(`{"stateInstance":"authorized"}`))
+			return
+		}
+		w.Write([]byte(`{"wid":"79001234567@c.us"}`))
+	})
+	lastPath := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(paths) == 0 {
+			return ""
+		}
+		return paths[len(paths)-1]
+	}
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.SessionKey = testSessionKey
+		cfg.SessionTTL = time.Hour
+	}))
+
+	signIn := func(body string) (*httptest.ResponseRecorder, *http.Cookie) {
+		t.Helper()
+		rec, _ := callAPI(t, s, http.MethodPost, "/api/session", body, nil)
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie {
+				return rec, c
+			}
+		}
+		return rec, nil
+	}
+
+	if rec, cookie := signIn(`{"idInstance":"2202","apiTokenInstance":"wrong-token"}`); rec.Code != http.StatusUnauthorized || cookie != nil {
+		t.Errorf("rejected credentials: %d, cookie %v", rec.Code, cookie)
+	}
+	if rec, _ := signIn(`{"idInstance":"2202"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without a token: %d, want 400", rec.Code)
+	}
+
+	rec, cookie := signIn(`{"idInstance":"2202","apiTokenInstance":"browser-token"}`)
+	if rec.Code != http.StatusOK || cookie == nil {
+		t.Fatalf("sign in = %d %s", rec.Code, rec.Body)
+	}
+	if lastPath() != "/waInstance2202/getStateInstance/browser-token" {
+		t.Errorf("sign in checked %s", lastPath())
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != sessionCookiePath || cookie.MaxAge != 3600 {
+		t.Errorf("cookie = %s", cookie)
+	}
+	if !strings.Contains(rec.Body.String(), `"stateInstance":"authorized"`) || strings.Contains(rec.Body.String(), "browser-token") {
+		t.Errorf("sign in body = %s", rec.Body)
+	}
+
+	codec := newTestSessionCodec(t, testSessionKey)
+	expired := codec.seal(sessionPayload{IDInstance: "2202", APIToken: "browser-token", Expires: time.Now().Add(-time.Minute).Unix()})
+	b, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	b[len(b)-1] ^= 1
+	tampered := base64.RawURLEncoding.EncodeToString(b)
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantPath   string
+		wantReason string
+	}{
+		{"cookie", http.Header{"Cookie": {sessionCookie + "=" + cookie.Value}}, http.StatusOK, "/waInstance2202/getSettings/browser-token", ""},
+		{"headers win over the cookie", http.Header{
+			"Cookie": {sessionCookie + "=" + cookie.Value},
+			http.CanonicalHeaderKey(idInstanceHeader): {"3303"},
+			http.CanonicalHeaderKey(apiTokenHeader):   {"header-token"},
+		}, http.StatusOK, "/waInstance3303/getSettings/header-token", ""},
+		{"no cookie uses the configured instance", nil, http.StatusOK, "/waInstance1101/getSettings/secret", ""},
+		{"tampered", http.Header{"Cookie": {sessionCookie + "=" + tampered}}, http.StatusUnauthorized, "", errSessionTampered.Error()},
+		{"expired", http.Header{"Cookie": {sessionCookie + "=" + expired}}, http.StatusUnauthorized, "", errSessionExpired.Error()},
+		{"garbage", http.Header{"Cookie": {sessionCookie + "=garbage"}}, http.StatusUnauthorized, "", errSessionMalformed.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := lastPath()
+			seen := len(logs.String())
+			rec, envelope := callAPI(t, s, http.MethodGet, "/api/getSettings", "", tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("getSettings = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantReason == "" {
+				if got := lastPath(); got != tt.wantPath {
+					t.Errorf("called %s, want %s", got, tt.wantPath)
+				}
+				return
+			}
+			if lastPath() != before {
+				t.Errorf("a refused cookie reached GREEN-API: %s", lastPath())
+			}
+			if envelope.Error.Code != errCodeUnauthorized {
+				t.Errorf("code = %q, want %s", envelope.Error.Code, errCodeUnauthorized)
+			}
+			out := logs.String()[seen:]
+			if !strings.Contains(out, tt.wantReason) {
+				t.Errorf("the reason %q was not logged:\n%s", tt.wantReason, out)
+			}
+			if value := strings.TrimPrefix(tt.header.Get("Cookie"), sessionCookie+"="); strings.Contains(out, value) {
+				t.Errorf("the cookie was logged:\n%s", out)
+			}
+		})
+	}
+
+	rec, _ = callAPI(t, s, http.MethodDelete, "/api/session", "", http.Header{"Cookie": {sessionCookie + "=" + cookie.Value}})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("sign out = %d", rec.Code)
+	}
+	cleared := rec.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != sessionCookie || cleared[0].Value != "" || cleared[0].MaxAge >= 0 || cleared[0].Path != sessionCookiePath {
+		t.Errorf("sign out set %v, want the cookie cleared", cleared)
+	}
+}
+
+func TestServerSessionDisabled(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/session", `{"idInstance":"2202","apiTokenInstance":"t"}`, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /api/session without SESSION_KEY = %d, want 404", rec.Code)
+	}
+}
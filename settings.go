@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// Bounds of delaySendMessagesMilliseconds: GREEN-API does not go below
+// 500ms, and a longer pause than 10 minutes is almost surely a typo.
+const (
+	minSendDelayMilliseconds = 500
+	maxSendDelayMilliseconds = 10 * 60 * 1000
+)
+
+// maxWebhookTokenLength bounds webhookUrlToken.
+const maxWebhookTokenLength = 256
+
+// webhookSettings are the settings POST /api/settings changes, as
+// getSettings reports them. webhookUrlToken is never among them.
+type webhookSettings struct {
+	WebhookURL                    string `json:"webhookUrl"`
+	IncomingWebhook               bool   `json:"incomingWebhook"`
+	OutgoingWebhook               bool   `json:"outgoingWebhook"`
+	DelaySendMessagesMilliseconds int    `json:"delaySendMessagesMilliseconds"`
+}
+
+func newWebhookSettings(s *greenapi.Settings) webhookSettings {
+	return webhookSettings{
+		WebhookURL:                    s.WebhookURL,
+		IncomingWebhook:               s.IncomingWebhook == "yes",
+		OutgoingWebhook:               s.OutgoingWebhook == "yes",
+		DelaySendMessagesMilliseconds: s.DelaySendMessagesMilliseconds,
+	}
+}
+
+type setSettingsRequest struct {
+	// Absent fields keep their value, but for WebhookURL, which is the
+	// /webhook of PUBLIC_URL when that is set. "" turns webhooks off.
+	WebhookURL                    *string `json:"webhookUrl"`
+	WebhookURLToken               *string `json:"webhookUrlToken"`
+	IncomingWebhook               *bool   `json:"incomingWebhook"`
+	OutgoingWebhook               *bool   `json:"outgoingWebhook"`
+	DelaySendMessagesMilliseconds *int    `json:"delaySendMessagesMilliseconds"`
+
+	// ownWebhook is the /webhook of PUBLIC_URL, and ownToken
+	// WEBHOOK_AUTH_TOKEN, both set before decoding.
+	ownWebhook string
+	ownToken   string
+	// upstream is the setSettings body built by validate.
+	upstream greenapi.SetSettingsRequest
+	// want is what getSettings should report once the change is applied.
+	want map[string]any
+}
+
+func (req *setSettingsRequest) validate(_ context.Context, v *validation) {
+	req.want = map[string]any{}
+	webhookURL := req.WebhookURL
+	if webhookURL == nil && req.ownWebhook != "" {
+		webhookURL = &req.ownWebhook
+	}
+	if webhookURL != nil {
+		if *webhookURL != "" {
+			u, err := url.Parse(*webhookURL)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				v.add("webhookUrl", "https_url", "must be an absolute https URL, or empty to turn webhooks off")
+			}
+		}
+		req.upstream.WebhookURL = webhookURL
+		req.want["webhookUrl"] = *webhookURL
+	}
+
+	token := req.WebhookURLToken
+	// GREEN-API has to send WEBHOOK_AUTH_TOKEN for /webhook to take its
+	// calls.
+	if token == nil && webhookURL != nil && *webhookURL == req.ownWebhook && req.ownToken != "" {
+		token = &req.ownToken
+	}
+	if token != nil {
+		if len(*token) > maxWebhookTokenLength || !isPrintableASCII(*token) {
+			v.add("webhookUrlToken", "token", fmt.Sprintf("must be at most %d printable ASCII characters", maxWebhookTokenLength))
+		}
+		req.upstream.WebhookURLToken = token
+	}
+
+	if req.IncomingWebhook != nil {
+		req.upstream.IncomingWebhook = yesNo(*req.IncomingWebhook)
+		req.want["incomingWebhook"] = *req.IncomingWebhook
+	}
+	if req.OutgoingWebhook != nil {
+		req.upstream.OutgoingWebhook = yesNo(*req.OutgoingWebhook)
+		req.want["outgoingWebhook"] = *req.OutgoingWebhook
+	}
+	if d := req.DelaySendMessagesMilliseconds; d != nil {
+		if *d < minSendDelayMilliseconds || *d > maxSendDelayMilliseconds {
+			v.add("delaySendMessagesMilliseconds", "range", fmt.Sprintf("must be from %d to %d", minSendDelayMilliseconds, maxSendDelayMilliseconds))
+		}
+		req.upstream.DelaySendMessagesMilliseconds = *d
+		req.want["delaySendMessagesMilliseconds"] = *d
+	}
+
+	if len(req.want) == 0 && token == nil {
+		v.add("webhookUrl", "required", "at least one setting must be given when PUBLIC_URL is not set")
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+type setSettingsResponse struct {
+	Settings webhookSettings `json:"settings"`
+	// Pending are the fields getSettings does not report with their new
+	// value yet, as GREEN-API may take a few minutes to apply them.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// settingChange is a field of webhookSettings changed by POST /api/settings.
+type settingChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// SetSettings serves POST /api/settings: it changes the webhook settings of
+// the instance with setSettings, then reads them back with getSettings and
+// answers with what is in effect. The change is logged field by field,
+// without the token.
+func (g *greenAPI) SetSettings(w http.ResponseWriter, r *http.Request) error {
+	req := setSettingsRequest{ownWebhook: g.ownWebhook, ownToken: g.webhookToken}
+	if !decodeRequest(w, r, &req) {
+		return nil
+	}
+
+	c, err := g.client(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+	before, err := c.GetSettings(ctx)
+	if err != nil {
+		return g.upstreamError(r, "getSettings", err)
+	}
+	saved, err := c.SetSettings(ctx, req.upstream)
+	if err != nil {
+		return g.upstreamError(r, "setSettings", err)
+	}
+	if !saved.SaveSettings {
+		return &HTTPError{Status: http.StatusBadGateway, Code: errCodeUpstreamError, Message: "GREEN-API did not save the settings"}
+	}
+	if g.cache != nil {
+		g.cache.invalidate("getSettings", c.IDInstance())
+	}
+	after, err := c.GetSettings(ctx)
+	if err != nil {
+		return g.upstreamError(r, "getSettings", err)
+	}
+
+	resp := setSettingsResponse{Settings: newWebhookSettings(after)}
+	effective := resp.Settings.fields()
+	for _, field := range webhookSettingFields {
+		if want, ok := req.want[field]; ok && effective[field] != want {
+			resp.Pending = append(resp.Pending, field)
+		}
+	}
+	LoggerFromContext(r.Context()).Info("Instance settings changed",
+		slog.String("id_instance", c.IDInstance()),
+		slog.Any("changes", settingChanges(newWebhookSettings(before), resp.Settings)),
+		slog.Bool("webhook_url_token_set", req.upstream.WebhookURLToken != nil),
+		slog.Any("pending", resp.Pending),
+	)
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// webhookSettingFields are the JSON names of webhookSettings, in order.
+var webhookSettingFields = []string{"webhookUrl", "incomingWebhook", "outgoingWebhook", "delaySendMessagesMilliseconds"}
+
+func (s webhookSettings) fields() map[string]any {
+	return map[string]any{
+		"webhookUrl":                    s.WebhookURL,
+		"incomingWebhook":               s.IncomingWebhook,
+		"outgoingWebhook":               s.OutgoingWebhook,
+		"delaySendMessagesMilliseconds": s.DelaySendMessagesMilliseconds,
+	}
+}
+
+// settingChanges lists the fields that differ between before and after.
+// The query of a webhook URL, where a token may hide, is not logged.
+func settingChanges(before, after webhookSettings) []settingChange {
+	from, to := before.fields(), after.fields()
+	changes := []settingChange{}
+	for _, field := range webhookSettingFields {
+		if from[field] == to[field] {
+			continue
+		}
+		change := settingChange{Field: field, From: from[field], To: to[field]}
+		if field == "webhookUrl" {
+			change.From, change.To = redactURLQuery(before.WebhookURL), redactURLQuery(after.WebhookURL)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func redactURLQuery(raw string) string {
+	if base, _, ok := strings.Cut(raw, "?"); ok {
+		return base + "?" + redacted
+	}
+	return raw
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestSetSettingsRequestValidate(t *testing.T) {
+	const own = "https://wa.example.com/webhook"
+	tests := []struct {
+		name       string
+		body       string
+		ownWebhook string
+		ownToken   string
+		wantFields []string
+		wantBody   string
+	}{
+		{"all fields", `{"webhookUrl":"https://hooks.example.com/in","webhookUrlToken":"t0k","incomingWebhook":true,"outgoingWebhook":false,"delaySendMessagesMilliseconds":1000}`, "", "",
+			nil, `{"webhookUrl":"https://hooks.example.com/in","webhookUrlToken":"t0k","incomingWebhook":"yes","outgoingWebhook":"no","delaySendMessagesMilliseconds":1000}`},
+		{"turn webhooks off", `{"webhookUrl":""}`, own, "", nil, `{"webhookUrl":""}`},
+		{"PUBLIC_URL by default", `{"incomingWebhook":true}`, own, "hook-token", nil, `{"webhookUrl":"` + own + `","webhookUrlToken":"hook-token","incomingWebhook":"yes"}`},
+		{"own token only for the own URL", `{"webhookUrl":"https://hooks.example.com/in"}`, own, "hook-token", nil, `{"webhookUrl":"https://hooks.example.com/in"}`},
+		{"token given wins", `{"webhookUrlToken":"mine"}`, own, "hook-token", nil, `{"webhookUrl":"` + own + `","webhookUrlToken":"mine"}`},
+		{"lowest delay", `{"delaySendMessagesMilliseconds":500}`, "", "", nil, `{"delaySendMessagesMilliseconds":500}`},
+		{"nothing to change", `{}`, "", "", []string{"webhookUrl"}, ""},
+		{"http webhook", `{"webhookUrl":"http://hooks.example.com/in"}`, "", "", []string{"webhookUrl"}, ""},
+		{"relative webhook", `{"webhookUrl":"/webhook"}`, "", "", []string{"webhookUrl"}, ""},
+		{"delay too short", `{"delaySendMessagesMilliseconds":100}`, "", "", []string{"delaySendMessagesMilliseconds"}, ""},
+		{"delay too long", `{"delaySendMessagesMilliseconds":600001}`, "", "", []string{"delaySendMessagesMilliseconds"}, ""},
+		{"token too long", `{"webhookUrlToken":"` + strings.Repeat("a", maxWebhookTokenLength+1) + `"}`, "", "", []string{"webhookUrlToken"}, ""},
+		{"token with a newline", `{"webhookUrlToken":"a\nb"}`, "", "", []string{"webhookUrlToken"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := setSettingsRequest{ownWebhook: tt.ownWebhook, ownToken: tt.ownToken}
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			var v validation
+			req.validate(t.Context(), &v)
+			var fields []string
+			for _, e := range v.errs {
+				fields = append(fields, e.Field)
+			}
+			if !slices.Equal(fields, tt.wantFields) {
+				t.Fatalf("invalid fields %v, want %v", fields, tt.wantFields)
+			}
+			if tt.wantBody == "" {
+				return
+			}
+			if body, _ := json.Marshal(req.upstream); string(body) != tt.wantBody {
+				t.Errorf("setSettings body = %s, want %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSettingChanges(t *testing.T) {
+	before := webhookSettings{WebhookURL: "https://old.example.com/hook?key=s3cret", DelaySendMessagesMilliseconds: 5000}
+	after := webhookSettings{WebhookURL: "https://new.example.com/hook", IncomingWebhook: true, DelaySendMessagesMilliseconds: 5000}
+	got, _ := json.Marshal(settingChanges(before, after))
+	want := `[{"field":"webhookUrl","from":"https://old.example.com/hook?[REDACTED]","to":"https://new.example.com/hook"},{"field":"incomingWebhook","from":false,"to":true}]`
+	if string(got) != want {
+		t.Errorf("changes = %s, want %s", got, want)
+	}
+	if got, _ := json.Marshal(settingChanges(after, after)); string(got) != "[]" {
+		t.Errorf("no change = %s, want []", got)
+	}
+}
+
+// settingsUpstream is a GREEN-API that keeps the settings setSettings is
+// given and reports them in getSettings. With lag it saves them without
+// applying them yet; with refuse it does not save them.
+type settingsUpstream struct {
+	mu       sync.Mutex
+	settings greenapi.Settings
+	token    string
+	lag      bool
+	refuse   bool
+	sets     []string
+}
+
+func (u *settingsUpstream) handler(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case strings.Contains(r.URL.Path, "/getSettings/"):
+		json.NewEncoder(w).Encode(u.settings)
+	case strings.Contains(r.URL.Path, "/setSettings/"):
+		body, _ := io.ReadAll(r.Body)
+		u.sets = append(u.sets, string(body))
+		if u.refuse {
+			io.WriteString(w, `{"saveSettings":false}`)
+			return
+		}
+		var req greenapi.SetSettingsRequest
+		json.Unmarshal(body, &req)
+		if !u.lag {
+			if req.WebhookURL != nil {
+				u.settings.WebhookURL = *req.WebhookURL
+			}
+			if req.WebhookURLToken != nil {
+				u.token = *req.WebhookURLToken
+			}
+			if req.IncomingWebhook != "" {
+				u.settings.IncomingWebhook = req.IncomingWebhook
+			}
+			if req.OutgoingWebhook != "" {
+				u.settings.OutgoingWebhook = req.OutgoingWebhook
+			}
+			if req.DelaySendMessagesMilliseconds != 0 {
+				u.settings.DelaySendMessagesMilliseconds = req.DelaySendMessagesMilliseconds
+			}
+		}
+		io.WriteString(w, `{"saveSettings":true}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestServerSetSettings(t *testing.T) {
+	const (
+		adminToken = "0123456789abcdef0123456789abcdef"
+		hookToken  = "hook-token-7f3a"
+	)
+	admin := http.Header{"Authorization": {"Bearer " + adminToken}}
+	initial := greenapi.Settings{WebhookURL: "https://old.example.com/hook?key=s3cret", IncomingWebhook: "no", OutgoingWebhook: "yes", DelaySendMessagesMilliseconds: 5000}
+	tests := []struct {
+		name         string
+		publicURL    string
+		lag, refuse  bool
+		header       http.Header
+		body         string
+		wantStatus   int
+		wantCode     string
+		wantSettings webhookSettings
+		wantPending  []string
+		wantToken    string
+		wantChanges  string
+	}{
+		{
+			name:         "change everything",
+			header:       admin,
+			body:         `{"webhookUrl":"https://hooks.example.com/in","webhookUrlToken":"` + hookToken + `","incomingWebhook":true,"outgoingWebhook":false,"delaySendMessagesMilliseconds":1000}`,
+			wantStatus:   http.StatusOK,
+			wantSettings: webhookSettings{WebhookURL: "https://hooks.example.com/in", IncomingWebhook: true, DelaySendMessagesMilliseconds: 1000},
+			wantToken:    hookToken,
+			wantChanges:  `[{"field":"webhookUrl","from":"https://old.example.com/hook?[REDACTED]","to":"https://hooks.example.com/in"},{"field":"incomingWebhook","from":false,"to":true},{"field":"outgoingWebhook","from":true,"to":false},{"field":"delaySendMessagesMilliseconds","from":5000,"to":1000}]`,
+		},
+		{
+			name:         "own webhook from PUBLIC_URL",
+			publicURL:    "https://wa.example.com/",
+			header:       admin,
+			body:         `{"incomingWebhook":true}`,
+			wantStatus:   http.StatusOK,
+			wantSettings: webhookSettings{WebhookURL: "https://wa.example.com/webhook", IncomingWebhook: true, OutgoingWebhook: true, DelaySendMessagesMilliseconds: 5000},
+			wantToken:    hookToken,
+			wantChanges:  `[{"field":"webhookUrl","from":"https://old.example.com/hook?[REDACTED]","to":"https://wa.example.com/webhook"},{"field":"incomingWebhook","from":false,"to":true}]`,
+		},
+		{
+			name:         "not applied yet",
+			lag:          true,
+			header:       admin,
+			body:         `{"incomingWebhook":true,"delaySendMessagesMilliseconds":5000}`,
+			wantStatus:   http.StatusOK,
+			wantSettings: newWebhookSettings(&initial),
+			wantPending:  []string{"incomingWebhook"},
+			wantChanges:  `[]`,
+		},
+		{name: "not saved", refuse: true, header: admin, body: `{"incomingWebhook":true}`, wantStatus: http.StatusBadGateway, wantCode: errCodeUpstreamError},
+		{name: "invalid", header: admin, body: `{"webhookUrl":"http://hooks.example.com/in"}`, wantStatus: http.StatusBadRequest, wantCode: errCodeValidation},
+		{name: "no admin token", body: `{"incomingWebhook":true}`, wantStatus: http.StatusUnauthorized, wantCode: errCodeUnauthorized},
+		{name: "wrong admin token", header: http.Header{"Authorization": {"Bearer " + strings.Repeat("0", 32)}}, body: `{"incomingWebhook":true}`, wantStatus: http.StatusUnauthorized, wantCode: errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &settingsUpstream{settings: initial, lag: tt.lag, refuse: tt.refuse}
+			upstream := fakeGreenAPI(t, u.handler)
+			s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.AdminToken = adminToken
+				cfg.PublicURL = tt.publicURL
+				cfg.WebhookAuthToken = hookToken
+			}))
+
+			rec, envelope := callAPI(t, s, http.MethodPost, "/api/settings", tt.body, tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if strings.Contains(logs.String(), hookToken) {
+				t.Errorf("the log shows the webhook token:\n%s", logs)
+			}
+			if tt.wantCode != "" {
+				if envelope.Error.Code != tt.wantCode {
+					t.Errorf("error code = %s, want %s", envelope.Error.Code, tt.wantCode)
+				}
+				if tt.wantStatus != http.StatusBadGateway && len(u.sets) != 0 {
+					t.Errorf("setSettings was called: %v", u.sets)
+				}
+				return
+			}
+			if strings.Contains(rec.Body.String(), hookToken) {
+				t.Errorf("the answer shows the webhook token: %s", rec.Body)
+			}
+			var resp setSettingsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Settings != tt.wantSettings || !slices.Equal(resp.Pending, tt.wantPending) {
+				t.Errorf("answer = %+v, want %+v pending %v", resp, tt.wantSettings, tt.wantPending)
+			}
+			if u.token != tt.wantToken {
+				t.Errorf("upstream token = %q, want %q", u.token, tt.wantToken)
+			}
+
+			entry := findLogEntry(t, logs.String(), "Instance settings changed")
+			if changes, _ := json.Marshal(entry["changes"]); string(changes) != tt.wantChanges {
+				t.Errorf("logged changes %s, want %s", changes, tt.wantChanges)
+			}
+			if entry["webhook_url_token_set"] != (tt.wantToken != "") {
+				t.Errorf("webhook_url_token_set = %v", entry["webhook_url_token_set"])
+			}
+		})
+	}
+}
+
+// findLogEntry decodes the JSON log line of out with message msg.
+func findLogEntry(t *testing.T, out, msg string) map[string]any {
+	t.Helper()
+	for _, line := range strings.Split(out, "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == msg {
+			return entry
+		}
+	}
+	t.Fatalf("no %q in the log:\n%s", msg, out)
+	return nil
+}
+
+func TestServerSetSettingsNeedsAdminToken(t *testing.T) {
+	u := &settingsUpstream{}
+	s, _ := newTestServer(t, withConfig(withUpstream(fakeGreenAPI(t, u.handler)), singleAttempt))
+	rec, _ := callAPI(t, s, http.MethodPost, "/api/settings", `{"incomingWebhook":true}`, nil)
+	if rec.Code == http.StatusOK || len(u.sets) != 0 {
+		t.Errorf("without ADMIN_TOKEN POST /api/settings = %d, setSettings calls %v", rec.Code, u.sets)
+	}
+}
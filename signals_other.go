@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// The signals are nil where SIGUSR1, SIGUSR2 and SIGHUP do not exist, which
+// disables restarts, log level toggling, and configuration reloads and log
+// file reopening.
+var (
+	restartSignal  os.Signal
+	logLevelSignal os.Signal
+	reopenSignal   os.Signal
+)
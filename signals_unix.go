@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	restartSignal  os.Signal = syscall.SIGUSR2
+	logLevelSignal os.Signal = syscall.SIGUSR1
+	reopenSignal   os.Signal = syscall.SIGHUP
+)
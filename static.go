@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var sidecarEncodings = []struct {
+	coding string
+	ext    string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticHandler serves files from root with content-hash ETags and
+// Cache-Control headers from the configured rules. Regular files get
+// precompressed sidecars (app.js.br, app.js.gz) when the client accepts them.
+// Directory redirects, listings and missing files are left to http.FileServer.
+type staticHandler struct {
+	root         http.FileSystem
+	fileServer   http.Handler
+	opts         staticOptions
+	etags        *etagCache
+	notFoundPage []byte
+}
+
+type staticOptions struct {
+	Precompressed bool
+	// CacheRules returns the rules in effect for the request, which a
+	// reload may change.
+	CacheRules func(*http.Request) CacheRules
+	// MIMETypes override the Content-Type derived from the file extension.
+	MIMETypes MIMETypes
+	// Prefix is the URL prefix stripped before the request reached the
+	// handler; cache rules are matched against the full URL path.
+	Prefix string
+	// SPA serves /index.html for missing paths without an extension so
+	// client-side routes survive a page reload.
+	SPA bool
+	// DisableDirListing answers 404 for directories without an index.html
+	// instead of rendering http.FileServer's listing.
+	DisableDirListing bool
+	// Index, when set, is served for /index.html, the SPA fallback
+	// included, in place of the file.
+	Index *indexPage
+}
+
+func newStaticHandler(root http.FileSystem, opts staticOptions) *staticHandler {
+	return &staticHandler{
+		root:       root,
+		fileServer: http.FileServer(root),
+		opts:       opts,
+		etags:      newETagCache(),
+	}
+}
+
+// LoadNotFoundPage reads the page served for missing paths. On error the
+// handler keeps answering with a plain-text 404.
+func (h *staticHandler) LoadNotFoundPage(name string) error {
+	page, err := readStaticPage(h.root, name)
+	if err != nil {
+		return err
+	}
+	h.notFoundPage = page
+	return nil
+}
+
+// readStaticPage reads the page name, relative to the root of root.
+func readStaticPage(root http.FileSystem, name string) ([]byte, error) {
+	f, err := root.Open(path.Clean("/" + name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/index.html") {
+		h.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	f, info, err := h.open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		h.serveMissing(w, r, name)
+		return
+	}
+	if err != nil {
+		h.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		f.Close()
+
+		index := cacheName(name + "/")
+		f, info, err = h.open(index)
+		if err != nil || info.IsDir() || !strings.HasSuffix(r.URL.Path, "/") {
+			if f != nil {
+				f.Close()
+			}
+			if err != nil && h.opts.DisableDirListing {
+				h.serveNotFound(w, r)
+				return
+			}
+			h.fileServer.ServeHTTP(w, r)
+			return
+		}
+		name = index
+	}
+	defer f.Close()
+
+	h.serveFile(w, r, name, f, info)
+}
+
+func (h *staticHandler) open(name string) (http.File, fs.FileInfo, error) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, f http.File, info fs.FileInfo) {
+	if cc := h.opts.CacheRules(r).Lookup(h.opts.Prefix + name); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	h.setContentType(w, name)
+
+	// Sidecars of index.html are compressed from the template, not from
+	// the rendered page.
+	if name == "/index.html" && h.opts.Index != nil {
+		h.opts.Index.serve(w, r)
+		return
+	}
+	if h.opts.Precompressed && h.serveSidecar(w, r, name, f) {
+		return
+	}
+
+	h.serveContent(w, r, name, name, f, info)
+}
+
+func (h *staticHandler) serveMissing(w http.ResponseWriter, r *http.Request, name string) {
+	if h.opts.SPA && path.Ext(name) == "" {
+		h.serveSPAIndex(w, r)
+		return
+	}
+	h.serveNotFound(w, r)
+}
+
+func (h *staticHandler) serveSPAIndex(w http.ResponseWriter, r *http.Request) {
+	const name = "/index.html"
+
+	if h.opts.Index != nil {
+		w.Header().Set("Cache-Control", "no-cache")
+		h.setContentType(w, name)
+		h.opts.Index.serve(w, r)
+		return
+	}
+
+	f, info, err := h.open(name)
+	if err != nil {
+		h.serveNotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if info.IsDir() {
+		h.serveNotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	h.setContentType(w, name)
+	h.serveContent(w, r, name, name, f, info)
+}
+
+// serveNotFound answers 404 with the 404 page of the static dir to clients
+// that want HTML, and with renderError otherwise.
+func (h *staticHandler) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	if h.notFoundPage == nil || errorFormat(r) != errorFormatHTML {
+		renderError(w, r, http.StatusNotFound, errCodeNotFound, http.StatusText(http.StatusNotFound), nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		w.Write(h.notFoundPage)
+	}
+}
+
+// serveContent serves f under name with an ETag computed from the bytes of
+// the file actually sent, which is cached under key. Files from the
+// in-memory cache carry their ETag already.
+func (h *staticHandler) serveContent(w http.ResponseWriter, r *http.Request, name, key string, f http.File, info fs.FileInfo) {
+	if cached, ok := f.(*cachedFile); ok {
+		w.Header().Set("ETag", cached.entry.etag)
+	} else if tag, err := h.etags.get(key, f, info.ModTime(), info.Size()); err == nil {
+		w.Header().Set("ETag", tag)
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// serveSidecar serves the best precompressed variant of name the client
+// accepts. It reports false when there is none, after setting Vary if any
+// variant exists at all so caches do not mix representations.
+func (h *staticHandler) serveSidecar(w http.ResponseWriter, r *http.Request, name string, original http.File) bool {
+	found := false
+
+	for _, enc := range sidecarEncodings {
+		sidecar, err := h.root.Open(name + enc.ext)
+		if err != nil {
+			continue
+		}
+
+		info, err := sidecar.Stat()
+		if err != nil || info.IsDir() {
+			sidecar.Close()
+			continue
+		}
+		found = true
+
+		if !acceptsEncoding(r, enc.coding) {
+			sidecar.Close()
+			continue
+		}
+		defer sidecar.Close()
+
+		header := w.Header()
+		header.Set("Content-Encoding", enc.coding)
+		addVary(header, "Accept-Encoding")
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", contentTypeOf(name, original))
+		}
+
+		h.serveContent(w, r, name, name+enc.ext, sidecar, info)
+		return true
+	}
+
+	if found {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	return false
+}
+
+// setContentType applies a configured override for name. Without one the
+// type is left to http.ServeContent, or to contentTypeOf for sidecars.
+func (h *staticHandler) setContentType(w http.ResponseWriter, name string) {
+	if ctype := h.opts.MIMETypes.Lookup(name); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+}
+
+// contentTypeOf determines the type of the uncompressed file, by extension
+// first and by sniffing its content otherwise.
+func contentTypeOf(name string, f http.File) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(buf[:n])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// staticFiles is the tree the static handler tests serve.
+var staticFiles = map[string]string{
+	"index.html":      "<h1>app</h1>",
+	"app.js":          "console.log('app');",
+	"css/site.css":    "body{}",
+	"docs/index.html": "<h1>docs</h1>",
+}
+
+// writeStaticTree writes files under a new directory and returns it.
+func writeStaticTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func noCacheRules(*http.Request) CacheRules { return nil }
+
+// get serves a GET of target by h.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestStaticSPAFallback(t *testing.T) {
+	// The secret lies next to the root, where traversal would reach it.
+	files := map[string]string{"secret": "top secret"}
+	for name, content := range staticFiles {
+		files["public/"+name] = content
+	}
+	root := filepath.Join(writeStaticTree(t, files), "public")
+
+	tests := []struct {
+		name        string
+		spa         bool
+		target      string
+		wantStatus  int
+		wantBody    string
+		wantNoCache bool
+	}{
+		{"root", true, "/", http.StatusOK, "<h1>app</h1>", false},
+		{"deep link", true, "/chat/12345", http.StatusOK, "<h1>app</h1>", true},
+		{"deep link with trailing slash", true, "/settings/", http.StatusOK, "<h1>app</h1>", true},
+		{"existing asset", true, "/app.js", http.StatusOK, "console.log('app');", false},
+		{"missing asset", true, "/missing.js", http.StatusNotFound, "", false},
+		{"missing nested asset", true, "/chat/12345/app.css", http.StatusNotFound, "", false},
+		{"existing directory index", true, "/docs/", http.StatusOK, "<h1>docs</h1>", false},
+		{"traversal", true, "/../secret", http.StatusOK, "<h1>app</h1>", true},
+		{"encoded traversal", true, "/%2e%2e/secret", http.StatusOK, "<h1>app</h1>", true},
+		{"deep link without SPA_MODE", false, "/chat/12345", http.StatusNotFound, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newStaticHandler(http.Dir(root), staticOptions{CacheRules: noCacheRules, SPA: tt.spa})
+			rec := get(h, tt.target)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if strings.Contains(rec.Body.String(), "top secret") {
+				t.Error("served a file outside of the root")
+			}
+			if got := rec.Header().Get("Cache-Control") == "no-cache"; got != tt.wantNoCache {
+				t.Errorf("Cache-Control = %q, want no-cache: %t", rec.Header().Get("Cache-Control"), tt.wantNoCache)
+			}
+			if tt.wantBody == "<h1>app</h1>" && !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestStaticSPAFallbackWithoutIndex(t *testing.T) {
+	h := newStaticHandler(http.Dir(writeStaticTree(t, map[string]string{"app.js": "x"})), staticOptions{CacheRules: noCacheRules, SPA: true})
+	if rec := get(h, "/chat/1"); rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 without index.html", rec.Code)
+	}
+}
+
+func TestStaticSPAFallbackHEAD(t *testing.T) {
+	h := newStaticHandler(http.Dir(writeStaticTree(t, staticFiles)), staticOptions{CacheRules: noCacheRules, SPA: true})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/chat/1", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || len(body) != 0 {
+		t.Errorf("HEAD got %d with %d bytes", rec.Code, len(body))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// StaticGuard rejects requests for hidden files, traversal sequences and
+// suspicious bytes before they reach the file server. Rejections are 404s so
+// they do not reveal whether the file exists. Paths under one of the
+// allowedHidden prefixes (e.g. "/.well-known/") may contain dot segments.
+func StaticGuard(allowedHidden []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !safeStaticPath(r.URL.Path, allowedHidden) {
+			renderError(w, r, http.StatusNotFound, errCodeNotFound, http.StatusText(http.StatusNotFound), nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func safeStaticPath(p string, allowedHidden []string) bool {
+	if strings.ContainsAny(p, "\x00\\") || !strings.HasPrefix(p, "/") {
+		return false
+	}
+
+	if cleaned := path.Clean(p); cleaned != "/" && !strings.HasPrefix(cleaned, "/") {
+		return false
+	}
+
+	hidden := false
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return false
+		}
+		if strings.HasPrefix(segment, ".") {
+			hidden = true
+		}
+	}
+
+	return !hidden || hiddenAllowed(p, allowedHidden)
+}
+
+func hiddenAllowed(p string, allowed []string) bool {
+	for _, prefix := range allowed {
+		if strings.HasPrefix(p, prefix) {
+			rest := strings.TrimPrefix(p, prefix)
+			for _, segment := range strings.Split(rest, "/") {
+				if strings.HasPrefix(segment, ".") {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticGuardPayloads(t *testing.T) {
+	files := map[string]string{
+		"secret.txt":                      "top secret",
+		"public/index.html":               "<h1>app</h1>",
+		"public/app.js":                   "app",
+		"public/.env":                     "TOKEN=top secret",
+		"public/.git/config":              "[core] top secret",
+		"public/assets/.hidden":           "top secret",
+		"public/.well-known/security.txt": "Contact: security@example.com",
+		"public/.well-known/.private":     "top secret",
+	}
+	root := filepath.Join(writeStaticTree(t, files), "public")
+	h := StaticGuard([]string{"/.well-known/"}, newStaticHandler(http.Dir(root), staticOptions{CacheRules: noCacheRules}))
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{"index", "/", http.StatusOK},
+		{"asset", "/app.js", http.StatusOK},
+		{"allowlisted", "/.well-known/security.txt", http.StatusOK},
+		{"dotfile", "/.env", http.StatusNotFound},
+		{"dot directory", "/.git/config", http.StatusNotFound},
+		{"nested dotfile", "/assets/.hidden", http.StatusNotFound},
+		{"dotfile under the allowlist", "/.well-known/.private", http.StatusNotFound},
+		{"encoded dotfile", "/%2eenv", http.StatusNotFound},
+		{"traversal", "/../secret.txt", http.StatusNotFound},
+		{"deep traversal", "/assets/../../secret.txt", http.StatusNotFound},
+		{"encoded traversal", "/%2e%2e/secret.txt", http.StatusNotFound},
+		{"encoded slash traversal", "/%2e%2e%2fsecret.txt", http.StatusNotFound},
+		{"uppercase encoding", "/%2E%2E%2Fsecret.txt", http.StatusNotFound},
+		{"mixed encoding", "/.%2e/secret.txt", http.StatusNotFound},
+		{"traversal out of the allowlist", "/.well-known/../.env", http.StatusNotFound},
+		{"backslash", "/..\\secret.txt", http.StatusNotFound},
+		{"encoded backslash", "/%5c..%5csecret.txt", http.StatusNotFound},
+		{"NUL byte", "/app.js%00.html", http.StatusNotFound},
+		{"dot segment", "/./app.js", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(h, tt.target)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("GET %s = %d, want %d", tt.target, rec.Code, tt.wantStatus)
+			}
+			if strings.Contains(rec.Body.String(), "top secret") {
+				t.Errorf("GET %s leaked a protected file", tt.target)
+			}
+		})
+	}
+}
+
+func TestStaticGuardNotForbidden(t *testing.T) {
+	dir := writeStaticTree(t, map[string]string{"index.html": "<h1>app</h1>", ".env": "TOKEN=1", ".git/config": "[core]"})
+	s, _ := newTestServer(t, func(cfg *Config) { cfg.StaticDir = dir })
+	for _, target := range []string{"/.env", "/.git/config", "/%2e%2e%2f.env"} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want a 404 that does not reveal the file", target, rec.Code)
+		}
+	}
+}
+
+func TestSafeStaticPath(t *testing.T) {
+	allowed := []string{"/.well-known/"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/a/b.js", true},
+		{"/file.with.dots.js", true},
+		{"/.well-known/acme-challenge/token", true},
+		{"", false},
+		{"relative", false},
+		{"/..", false},
+		{"/a/../b", false},
+		{"/.env", false},
+		{"/a\\b", false},
+		{"/a\x00b", false},
+		{"/.well-knownx/a", false},
+	}
+	for _, tt := range tests {
+		if got := safeStaticPath(tt.path, allowed); got != tt.want {
+			t.Errorf("safeStaticPath(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsWindow is the rolling window of /stats, kept as statsSlots
+	// slots of statsSlotWidth: a slot is reset when the window comes round
+	// to it again, so the window moves in steps of statsSlotWidth.
+	statsWindow    = 5 * time.Minute
+	statsSlotWidth = 10 * time.Second
+	statsSlots     = int(statsWindow / statsSlotWidth)
+
+	// maxStatsPaths caps the number of paths counted one by one; requests
+	// to any further path are counted under statsOtherPath.
+	maxStatsPaths  = 1000
+	statsOtherPath = "(other)"
+	statsTopPaths  = 10
+)
+
+// statsLatencyBounds are the upper bounds of the latency histogram; a last
+// bucket takes everything slower.
+var statsLatencyBounds = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// statsCounters are the totals of a set of requests. Every field is updated
+// with atomics, so recording a request takes no lock.
+type statsCounters struct {
+	requests atomic.Int64
+	// status counts 1xx to 5xx at 0 to 4; anything else is not counted.
+	status  [5]atomic.Int64
+	latency [len(statsLatencyBounds) + 1]atomic.Int64
+	// latencySum is in nanoseconds.
+	latencySum atomic.Int64
+	bytes      atomic.Int64
+
+	// upstreamCalls and upstreamErrors count the GREEN-API attempts made
+	// for the requests, and apiCacheHits and apiCacheMisses the lookups in
+	// the GREEN-API response cache.
+	upstreamCalls  atomic.Int64
+	upstreamErrors atomic.Int64
+	apiCacheHits   atomic.Int64
+	apiCacheMisses atomic.Int64
+	// clientAborted counts the requests given up on by their client, which
+	// are in 4xx as statusClientClosedRequest.
+	clientAborted atomic.Int64
+}
+
+func (c *statsCounters) add(e *accessEntry) {
+	c.requests.Add(1)
+	if class := e.status/100 - 1; class >= 0 && class < len(c.status) {
+		c.status[class].Add(1)
+	}
+	bucket, _ := slices.BinarySearch(statsLatencyBounds[:], e.duration)
+	c.latency[bucket].Add(1)
+	c.latencySum.Add(int64(e.duration))
+	c.bytes.Add(e.size)
+
+	if e.upstream.Attempts > 0 {
+		c.upstreamCalls.Add(int64(e.upstream.Attempts))
+		c.upstreamErrors.Add(int64(e.upstream.Failures))
+	}
+	if e.clientAborted {
+		c.clientAborted.Add(1)
+	}
+	switch e.cache {
+	case "hit":
+		c.apiCacheHits.Add(1)
+	case "miss":
+		c.apiCacheMisses.Add(1)
+	}
+}
+
+func (c *statsCounters) reset() {
+	c.requests.Store(0)
+	for i := range c.status {
+		c.status[i].Store(0)
+	}
+	for i := range c.latency {
+		c.latency[i].Store(0)
+	}
+	c.latencySum.Store(0)
+	c.bytes.Store(0)
+	c.upstreamCalls.Store(0)
+	c.upstreamErrors.Store(0)
+	c.apiCacheHits.Store(0)
+	c.apiCacheMisses.Store(0)
+	c.clientAborted.Store(0)
+}
+
+// statsSlot is one statsSlotWidth of the window. epoch is the number of the
+// slot since the Unix epoch, telling which turn of the window the counters
+// belong to.
+type statsSlot struct {
+	epoch atomic.Int64
+	// mu is only taken to reset the slot for a new turn of the window.
+	mu       sync.Mutex
+	counters statsCounters
+}
+
+// statsPath counts the requests to one path, over the lifetime and per slot
+// of the window.
+type statsPath struct {
+	total atomic.Int64
+	slots [statsSlots]struct {
+		epoch atomic.Int64
+		count atomic.Int64
+	}
+}
+
+func (p *statsPath) add(epoch int64) {
+	p.total.Add(1)
+	slot := &p.slots[epoch%int64(statsSlots)]
+	if old := slot.epoch.Load(); old != epoch && slot.epoch.CompareAndSwap(old, epoch) {
+		slot.count.Store(0)
+	}
+	slot.count.Add(1)
+}
+
+func (p *statsPath) window(epoch int64) int64 {
+	var n int64
+	for i := range p.slots {
+		slot := &p.slots[i]
+		if e := slot.epoch.Load(); e > epoch-int64(statsSlots) && e <= epoch {
+			n += slot.count.Load()
+		}
+	}
+	return n
+}
+
+// requestStats collects what /stats reports about the requests the logging
+// middleware sees. Recording is lock-free but for resetting a slot once per
+// statsSlotWidth, and for the first request to a new path. A request that
+// races a slot reset may be lost from the window; the lifetime totals are
+// exact.
+type requestStats struct {
+	started  time.Time
+	lifetime statsCounters
+	slots    [statsSlots]statsSlot
+
+	paths     sync.Map // string to *statsPath
+	pathCount atomic.Int64
+
+	// upstream, when set, adds the last GREEN-API checks to the report.
+	upstream *upstreamChecks
+	// calls, when set, adds the GREEN-API calls by method.
+	calls *upstreamCallStats
+	// sendQueue, when set, adds the queue of async sends.
+	sendQueue *sendQueue
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{started: time.Now()}
+}
+
+func statsEpoch(t time.Time) int64 {
+	return t.UnixNano() / int64(statsSlotWidth)
+}
+
+// observe records a finished request.
+func (s *requestStats) observe(urlPath string, e *accessEntry) {
+	epoch := statsEpoch(time.Now())
+	s.lifetime.add(e)
+	s.slot(epoch).counters.add(e)
+
+	// Paths that were not found are counted as one, so that a scan does not
+	// use up maxStatsPaths.
+	if e.status == http.StatusNotFound {
+		urlPath = statsOtherPath
+	}
+	s.path(urlPath).add(epoch)
+}
+
+// slot returns the slot of epoch, reset first when it still holds an
+// earlier turn of the window.
+func (s *requestStats) slot(epoch int64) *statsSlot {
+	slot := &s.slots[epoch%int64(statsSlots)]
+	if slot.epoch.Load() == epoch {
+		return slot
+	}
+	slot.mu.Lock()
+	if slot.epoch.Load() != epoch {
+		slot.counters.reset()
+		slot.epoch.Store(epoch)
+	}
+	slot.mu.Unlock()
+	return slot
+}
+
+func (s *requestStats) path(urlPath string) *statsPath {
+	if p, ok := s.paths.Load(urlPath); ok {
+		return p.(*statsPath)
+	}
+	if urlPath != statsOtherPath && s.pathCount.Load() >= maxStatsPaths {
+		return s.path(statsOtherPath)
+	}
+	p, loaded := s.paths.LoadOrStore(urlPath, new(statsPath))
+	if !loaded {
+		s.pathCount.Add(1)
+	}
+	return p.(*statsPath)
+}
+
+type statsLatencyBucket struct {
+	// LE is the upper bound, empty for the last bucket.
+	LE    string `json:"le,omitempty"`
+	Count int64  `json:"count"`
+}
+
+type statsPathCount struct {
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+}
+
+type statsReport struct {
+	Requests      int64                `json:"requests"`
+	Status        map[string]int64     `json:"status"`
+	Bytes         int64                `json:"bytes"`
+	LatencyMeanMs float64              `json:"latency_mean_ms"`
+	Latency       []statsLatencyBucket `json:"latency"`
+	TopPaths      []statsPathCount     `json:"top_paths"`
+
+	UpstreamCalls  int64 `json:"upstream_calls"`
+	UpstreamErrors int64 `json:"upstream_errors"`
+	APICacheHits   int64 `json:"api_cache_hits"`
+	APICacheMisses int64 `json:"api_cache_misses"`
+	ClientAborted  int64 `json:"client_aborted"`
+}
+
+// statsTotals is a plain copy of statsCounters to add slots up in.
+type statsTotals struct {
+	requests   int64
+	status     [5]int64
+	latency    [len(statsLatencyBounds) + 1]int64
+	latencySum int64
+	bytes      int64
+
+	upstreamCalls  int64
+	upstreamErrors int64
+	apiCacheHits   int64
+	apiCacheMisses int64
+	clientAborted  int64
+}
+
+func (t *statsTotals) add(c *statsCounters) {
+	t.requests += c.requests.Load()
+	for i := range c.status {
+		t.status[i] += c.status[i].Load()
+	}
+	for i := range c.latency {
+		t.latency[i] += c.latency[i].Load()
+	}
+	t.latencySum += c.latencySum.Load()
+	t.bytes += c.bytes.Load()
+	t.upstreamCalls += c.upstreamCalls.Load()
+	t.upstreamErrors += c.upstreamErrors.Load()
+	t.apiCacheHits += c.apiCacheHits.Load()
+	t.apiCacheMisses += c.apiCacheMisses.Load()
+	t.clientAborted += c.clientAborted.Load()
+}
+
+func (t *statsTotals) report(top []statsPathCount) statsReport {
+	r := statsReport{
+		Requests: t.requests,
+		Status:   make(map[string]int64, len(t.status)),
+		Bytes:    t.bytes,
+		Latency:  make([]statsLatencyBucket, len(t.latency)),
+		TopPaths: top,
+
+		UpstreamCalls:  t.upstreamCalls,
+		UpstreamErrors: t.upstreamErrors,
+		APICacheHits:   t.apiCacheHits,
+		APICacheMisses: t.apiCacheMisses,
+		ClientAborted:  t.clientAborted,
+	}
+	for i, n := range t.status {
+		r.Status[string(rune('1'+i))+"xx"] = n
+	}
+	for i, n := range t.latency {
+		r.Latency[i].Count = n
+		if i < len(statsLatencyBounds) {
+			r.Latency[i].LE = statsLatencyBounds[i].String()
+		}
+	}
+	if t.requests > 0 {
+		r.LatencyMeanMs = float64(t.latencySum) / float64(t.requests) / float64(time.Millisecond)
+	}
+	return r
+}
+
+// topPaths returns the statsTopPaths paths with the most requests, counted
+// by count.
+func (s *requestStats) topPaths(count func(*statsPath) int64) []statsPathCount {
+	all := []statsPathCount{}
+	s.paths.Range(func(key, value any) bool {
+		if n := count(value.(*statsPath)); n > 0 {
+			all = append(all, statsPathCount{Path: key.(string), Requests: n})
+		}
+		return true
+	})
+	slices.SortFunc(all, func(a, b statsPathCount) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Path, b.Path))
+	})
+	if len(all) > statsTopPaths {
+		all = all[:statsTopPaths]
+	}
+	return slices.Clip(all)
+}
+
+// totals returns the lifetime totals.
+func (s *requestStats) totals() statsTotals {
+	var t statsTotals
+	t.add(&s.lifetime)
+	return t
+}
+
+// window adds up the slots of the last statsWindow up to now.
+func (s *requestStats) window(now time.Time) (statsTotals, int64) {
+	epoch := statsEpoch(now)
+	var t statsTotals
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if e := slot.epoch.Load(); e > epoch-int64(statsSlots) && e <= epoch {
+			t.add(&slot.counters)
+		}
+	}
+	return t, epoch
+}
+
+// Handler serves the statistics as JSON.
+func (s *requestStats) Handler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	lifetime := s.totals()
+	window, epoch := s.window(now)
+
+	report := map[string]any{
+		"since":          s.started.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(now.Sub(s.started).Seconds()),
+		"window_seconds": int64(statsWindow.Seconds()),
+		"paths":          s.pathCount.Load(),
+		"max_paths":      maxStatsPaths,
+		"lifetime":       lifetime.report(s.topPaths(func(p *statsPath) int64 { return p.total.Load() })),
+		"window":         window.report(s.topPaths(func(p *statsPath) int64 { return p.window(epoch) })),
+	}
+	if s.calls != nil {
+		report["greenapi_methods"] = s.calls.report()
+	}
+	if s.sendQueue != nil {
+		report["send_queue"] = s.sendQueue.report()
+	}
+	if s.upstream != nil {
+		if primary := s.upstream.Primary(); primary != nil {
+			report["upstream"] = primary
+		}
+		if instances := s.upstream.Instances(); instances != nil {
+			report["instances"] = instances
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// observeAt records a request as observe does, at epoch instead of now.
+func observeAt(s *requestStats, epoch int64, urlPath string, e *accessEntry) {
+	s.lifetime.add(e)
+	s.slot(epoch).counters.add(e)
+	s.path(urlPath).add(epoch)
+}
+
+// epochTime returns a time inside the slot of epoch.
+func epochTime(epoch int64) time.Time {
+	return time.Unix(0, epoch*int64(statsSlotWidth)+int64(time.Second))
+}
+
+func TestStatsCountersAdd(t *testing.T) {
+	tests := []struct {
+		name        string
+		entry       accessEntry
+		wantStatus  int // index into status, -1 for none
+		wantLatency int
+	}{
+		{"2xx, fast", accessEntry{status: 200, duration: time.Millisecond, size: 10}, 1, 0},
+		{"on a bound", accessEntry{status: 204, duration: 5 * time.Millisecond}, 1, 0},
+		{"just over a bound", accessEntry{status: 301, duration: 6 * time.Millisecond}, 2, 1},
+		{"4xx", accessEntry{status: 404, duration: 300 * time.Millisecond}, 3, 6},
+		{"5xx, slowest", accessEntry{status: 503, duration: time.Minute}, 4, len(statsLatencyBounds)},
+		{"1xx", accessEntry{status: 101}, 0, 0},
+		{"no status class", accessEntry{status: 600}, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c statsCounters
+			c.add(&tt.entry)
+			var totals statsTotals
+			totals.add(&c)
+			var wantStatus [5]int64
+			if tt.wantStatus >= 0 {
+				wantStatus[tt.wantStatus] = 1
+			}
+			if totals.status != wantStatus {
+				t.Errorf("status = %v, want %v", totals.status, wantStatus)
+			}
+			if totals.latency[tt.wantLatency] != 1 {
+				t.Errorf("latency = %v, want bucket %d", totals.latency, tt.wantLatency)
+			}
+			if totals.requests != 1 || totals.bytes != tt.entry.size || totals.latencySum != int64(tt.entry.duration) {
+				t.Errorf("totals = %+v", totals)
+			}
+		})
+	}
+}
+
+func TestStatsWindowRollover(t *testing.T) {
+	base := statsEpoch(time.Now())
+	last := int64(statsSlots - 1)
+	tests := []struct {
+		name string
+		// at are the slots, after base, requests to /a are recorded in.
+		at []int64
+		// now is the slot, after base, the window is read at.
+		now        int64
+		wantWindow int64
+	}{
+		{"same slot", []int64{0, 0, 0}, 0, 3},
+		{"spread over the window", []int64{0, 1, last}, last, 3},
+		{"oldest slot leaves the window", []int64{0, 1, last}, last + 1, 2},
+		{"all slots have left", []int64{0, 1}, last + 2, 0},
+		{"a slot reused a turn later starts over", []int64{0, 0, int64(statsSlots)}, int64(statsSlots), 1},
+		{"reused twice", []int64{0, int64(statsSlots), 2 * int64(statsSlots)}, 2 * int64(statsSlots), 1},
+		{"future slots are not counted", []int64{0, 5}, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRequestStats()
+			for _, at := range tt.at {
+				observeAt(s, base+at, "/a", &accessEntry{status: http.StatusOK, size: 100})
+			}
+			window, epoch := s.window(epochTime(base + tt.now))
+			if epoch != base+tt.now {
+				t.Fatalf("epoch = %d, want %d", epoch, base+tt.now)
+			}
+			if window.requests != tt.wantWindow || window.bytes != 100*tt.wantWindow || window.status[1] != tt.wantWindow {
+				t.Errorf("window = %d requests, %d bytes; want %d", window.requests, window.bytes, tt.wantWindow)
+			}
+			p := s.path("/a")
+			if got := p.window(epoch); got != tt.wantWindow {
+				t.Errorf("path window = %d, want %d", got, tt.wantWindow)
+			}
+			if lifetime := s.totals(); lifetime.requests != int64(len(tt.at)) || p.total.Load() != int64(len(tt.at)) {
+				t.Errorf("lifetime = %d, path total = %d, want %d", lifetime.requests, p.total.Load(), len(tt.at))
+			}
+		})
+	}
+}
+
+func TestStatsTopPaths(t *testing.T) {
+	s := newRequestStats()
+	epoch := statsEpoch(time.Now())
+	for i := range statsTopPaths + 5 {
+		for range i + 1 {
+			observeAt(s, epoch, fmt.Sprintf("/p%02d", i), &accessEntry{status: http.StatusOK})
+		}
+	}
+	top := s.topPaths(func(p *statsPath) int64 { return p.total.Load() })
+	if len(top) != statsTopPaths {
+		t.Fatalf("%d top paths, want %d", len(top), statsTopPaths)
+	}
+	if top[0].Path != fmt.Sprintf("/p%02d", statsTopPaths+4) || top[0].Requests != int64(statsTopPaths+5) {
+		t.Errorf("top path = %+v", top[0])
+	}
+	for i := 1; i < len(top); i++ {
+		if top[i].Requests > top[i-1].Requests {
+			t.Errorf("top paths are not in order: %v", top)
+		}
+	}
+}
+
+func TestStatsPathCap(t *testing.T) {
+	s := newRequestStats()
+	for i := range maxStatsPaths + 10 {
+		s.observe(fmt.Sprintf("/p%d", i), &accessEntry{status: http.StatusOK})
+	}
+	for i := range 5 {
+		s.observe(fmt.Sprintf("/missing%d", i), &accessEntry{status: http.StatusNotFound})
+	}
+	if n := s.pathCount.Load(); n != maxStatsPaths+1 {
+		t.Errorf("%d paths counted, want %d and %s", n, maxStatsPaths, statsOtherPath)
+	}
+	if other := s.path(statsOtherPath).total.Load(); other != 15 {
+		t.Errorf("%s = %d, want the 10 over the cap and the 5 not found", statsOtherPath, other)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	s, _ := newTestServer(t, func(cfg *Config) { cfg.AdminToken = adminToken })
+	for range 3 {
+		serve(s, http.MethodGet, "/", nil)
+	}
+	serve(s, http.MethodGet, "/missing.js", nil)
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	for _, token := range []string{"", "wrong"} {
+		if rec := get(token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("/stats with token %q = %d, want 401", token, rec.Code)
+		}
+	}
+
+	rec := get(adminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/stats = %d %s", rec.Code, rec.Body)
+	}
+	var report struct {
+		WindowSeconds int64       `json:"window_seconds"`
+		Lifetime      statsReport `json:"lifetime"`
+		Window        statsReport `json:"window"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.WindowSeconds != int64(statsWindow.Seconds()) {
+		t.Errorf("window_seconds = %d", report.WindowSeconds)
+	}
+	// The 401 answers to /stats are counted too.
+	for name, r := range map[string]statsReport{"lifetime": report.Lifetime, "window": report.Window} {
+		if r.Requests != 6 || r.Status["2xx"] != 3 || r.Status["4xx"] != 3 {
+			t.Errorf("%s = %d requests, status %v", name, r.Requests, r.Status)
+		}
+		if len(r.TopPaths) == 0 || r.TopPaths[0] != (statsPathCount{Path: "/", Requests: 3}) {
+			t.Errorf("%s top paths = %v", name, r.TopPaths)
+		}
+		if r.Bytes < 3*int64(len("<h1>index</h1>")) || len(r.Latency) != len(statsLatencyBounds)+1 {
+			t.Errorf("%s bytes = %d, latency = %v", name, r.Bytes, r.Latency)
+		}
+	}
+	if strings.Contains(rec.Body.String(), adminToken) {
+		t.Error("/stats shows the admin token")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// timeoutExempt are the streams that stay open for as long as the client
+// wants, and so never time out.
+var timeoutExempt = map[string]bool{
+	"/ws":      true,
+	eventsPath: true,
+}
+
+// RouteTimeouts overrides REQUEST_TIMEOUT per path prefix; the longest
+// matching prefix wins and 0 turns the timeout off. In the environment
+// pairs are written as "prefix=duration" separated by ",", e.g.
+// "/upload/=2m,/api/=5s".
+type RouteTimeouts map[string]time.Duration
+
+func (t *RouteTimeouts) UnmarshalText(text []byte) error {
+	timeouts := make(RouteTimeouts)
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, timeout, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid route timeout %q, want prefix=duration", item)
+		}
+		if err := timeouts.add(prefix, timeout); err != nil {
+			return err
+		}
+	}
+	*t = timeouts
+	return nil
+}
+
+func (t *RouteTimeouts) UnmarshalYAML(node *yaml.Node) error {
+	var raw map[string]string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	timeouts := make(RouteTimeouts, len(raw))
+	for prefix, timeout := range raw {
+		if err := timeouts.add(prefix, timeout); err != nil {
+			return err
+		}
+	}
+	*t = timeouts
+	return nil
+}
+
+func (t RouteTimeouts) add(prefix, timeout string) error {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid route timeout prefix %q, want /prefix", prefix)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(timeout))
+	if err != nil || d < 0 {
+		return fmt.Errorf("timeout for %s: invalid duration %q", prefix, timeout)
+	}
+	t[prefix] = d
+	return nil
+}
+
+func (t RouteTimeouts) String() string {
+	items := make([]string, 0, len(t))
+	for prefix, timeout := range t {
+		items = append(items, prefix+"="+timeout.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// lookup returns the timeout for urlPath, falling back to def.
+func (t RouteTimeouts) lookup(urlPath string, def time.Duration) time.Duration {
+	best, timeout := -1, def
+	for prefix, d := range t {
+		if len(prefix) > best && strings.HasPrefix(urlPath, prefix) {
+			best, timeout = len(prefix), d
+		}
+	}
+	return timeout
+}
+
+// Timeout gives the handler until the timeout for the path to answer; 0
+// means no timeout. The request context is canceled at the deadline so that
+// upstream calls stop, and a handler that has not started its response by
+// then is answered 503 in its place: the JSON error envelope on API paths,
+// a plain page elsewhere. What the handler writes afterwards is dropped.
+// Unlike http.TimeoutHandler the response is not buffered, so a handler
+// that has started streaming keeps its response and is waited for.
+func Timeout(def time.Duration, overrides RouteTimeouts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := overrides.lookup(r.URL.Path, def)
+		if timeout <= 0 || timeoutExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					panicked <- rec
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			// A handler that only set headers still has them sent.
+			tw.mu.Lock()
+			tw.start()
+			tw.mu.Unlock()
+			return
+		case rec := <-panicked:
+			panic(rec)
+		case <-ctx.Done():
+		}
+
+		// The handler and the deadline race for the response under mu:
+		// whichever gets there first is what the client, and the access
+		// log, sees.
+		tw.mu.Lock()
+		if tw.started {
+			tw.mu.Unlock()
+			select {
+			case <-done:
+			case rec := <-panicked:
+				panic(rec)
+			}
+			return
+		}
+		tw.timedOut = true
+		tw.mu.Unlock()
+
+		LoggerFromContext(ctx).Warn("Request timed out", slog.Duration("timeout", timeout))
+		renderError(w, r, http.StatusServiceUnavailable, errCodeRequestTimeout, "request timed out", nil)
+	})
+}
+
+// timeoutWriter passes a response through until Timeout answers in its
+// place, after which every write fails with http.ErrHandlerTimeout. The
+// handler gets a header map of its own, copied over when the response
+// starts, so that it never touches the one Timeout answers with.
+type timeoutWriter struct {
+	http.ResponseWriter
+	header http.Header
+
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// start sends the handler's headers along with the first write. It must be
+// called with mu held.
+func (tw *timeoutWriter) start() {
+	if tw.started {
+		return
+	}
+	tw.started = true
+	dst := tw.ResponseWriter.Header()
+	clear(dst)
+	maps.Copy(dst, tw.header)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		tw.start()
+	} else {
+		maps.Copy(tw.ResponseWriter.Header(), tw.header)
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.start()
+	return tw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile for static files.
+func (tw *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.start()
+	if rf, ok := tw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{tw.ResponseWriter}, src)
+}
+
+func (tw *timeoutWriter) Flush() {
+	_ = tw.FlushError()
+}
+
+// FlushError is what http.ResponseController.Flush calls.
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	tw.start()
+	return http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// SetReadDeadline, SetWriteDeadline and EnableFullDuplex are found by
+// http.ResponseController before Unwrap, so that they too go through mu
+// and stop once Timeout has answered.
+func (tw *timeoutWriter) SetReadDeadline(deadline time.Time) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	return http.NewResponseController(tw.ResponseWriter).SetReadDeadline(deadline)
+}
+
+func (tw *timeoutWriter) SetWriteDeadline(deadline time.Time) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	return http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(deadline)
+}
+
+func (tw *timeoutWriter) EnableFullDuplex() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	return http.NewResponseController(tw.ResponseWriter).EnableFullDuplex()
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	tw.start()
+	return http.NewResponseController(tw.ResponseWriter).Hijack()
+}
+
+// Committed reports whether the response has started, or Timeout has
+// answered, so an error can no longer replace it.
+func (tw *timeoutWriter) Committed() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.started || tw.timedOut
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, but only
+// until Timeout answers: after that nothing the handler does may reach the
+// connection.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil
+	}
+	return tw.ResponseWriter
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+		path    string
+		want    time.Duration
+	}{
+		{"default", "", false, "/api/sendMessage", time.Second},
+		{"prefix", "/api/=5s", false, "/api/sendMessage", 5 * time.Second},
+		{"other prefix", "/api/=5s", false, "/index.html", time.Second},
+		{"longest prefix wins", "/api/=5s, /api/upload=2m", false, "/api/uploadFile", 2 * time.Minute},
+		{"zero disables", "/api/=0s", false, "/api/sendMessage", 0},
+		{"no equals sign", "/api/5s", true, "", 0},
+		{"relative prefix", "api/=5s", true, "", 0},
+		{"bad duration", "/api/=soon", true, "", 0},
+		{"negative duration", "/api/=-1s", true, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var timeouts RouteTimeouts
+			err := timeouts.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalText = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := timeouts.lookup(tt.path, time.Second); got != tt.want {
+				t.Errorf("lookup(%s) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	captureDefaultLog(t)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("the context was not canceled at the deadline")
+		}
+		// Give Timeout the answer; right at the deadline either side may win.
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("X-Late", "1")
+		if _, err := io.WriteString(w, "late"); err != http.ErrHandlerTimeout {
+			t.Errorf("late write = %v, want ErrHandlerTimeout", err)
+		}
+	}
+	tests := []struct {
+		name       string
+		path       string
+		overrides  RouteTimeouts
+		handler    http.HandlerFunc
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{
+			"fast handler",
+			"/api/getSettings",
+			nil,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{}`)
+			},
+			http.StatusOK, "application/json", `{}`,
+		},
+		{"slow API handler", "/api/getSettings", nil, slow, http.StatusServiceUnavailable, "application/json", errCodeRequestTimeout},
+		{"slow static handler", "/app.js", nil, slow, http.StatusServiceUnavailable, "text/plain", "request timed out"},
+		{
+			"started response is kept",
+			"/api/export",
+			nil,
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "first ")
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				io.WriteString(w, "second")
+			},
+			http.StatusOK, "", "first second",
+		},
+		{
+			"WebSocket stream exempt",
+			"/ws",
+			nil,
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(2 * timeout)
+				if r.Context().Err() != nil {
+					t.Error("the stream was given a deadline")
+				}
+				io.WriteString(w, "open")
+			},
+			http.StatusOK, "", "open",
+		},
+		{
+			"event stream exempt",
+			eventsPath,
+			nil,
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(2 * timeout)
+				io.WriteString(w, "open")
+			},
+			http.StatusOK, "", "open",
+		},
+		{
+			"override disables",
+			"/api/uploadFile",
+			RouteTimeouts{"/api/uploadFile": 0},
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(2 * timeout)
+				io.WriteString(w, "uploaded")
+			},
+			http.StatusOK, "", "uploaded",
+		},
+		{
+			"override shortens",
+			"/api/getSettings",
+			RouteTimeouts{"/api/": timeout},
+			slow,
+			http.StatusServiceUnavailable, "application/json", errCodeRequestTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def := timeout
+			if tt.overrides != nil {
+				def = time.Minute
+			}
+			rec := httptest.NewRecorder()
+			Timeout(def, tt.overrides, tt.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if rec.Header().Get("X-Late") != "" {
+				t.Error("a header set after the deadline was sent")
+			}
+			if tt.wantType == "application/json" && tt.wantStatus != http.StatusOK {
+				var env apiError
+				if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil || env.Error.Code != errCodeRequestTimeout {
+					t.Errorf("body = %s, want the %s envelope", rec.Body, errCodeRequestTimeout)
+				}
+			}
+		})
+	}
+}
+
+// TestTimeoutRace has the handler answer right as the deadline passes: the
+// logged status has to be the one the client got, whoever won.
+func TestTimeoutRace(t *testing.T) {
+	const timeout = 2 * time.Millisecond
+	captureDefaultLog(t)
+	results := map[int]int{}
+	for i := range 200 {
+		delay := time.Duration(i%5) * time.Millisecond
+		var logged int
+		h := AccessLog(defaultLogRules, func(r *http.Request, level slog.Level, e accessEntry) {
+			logged = e.status
+		}, Timeout(timeout, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"id":1}`)
+		})))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/sendMessage", nil))
+		if logged != rec.Code {
+			t.Fatalf("logged %d, the client got %d", logged, rec.Code)
+		}
+		switch rec.Code {
+		case http.StatusCreated:
+			if rec.Body.String() != `{"id":1}` {
+				t.Fatalf("201 with body %q", rec.Body)
+			}
+		case http.StatusServiceUnavailable:
+			if strings.Contains(rec.Body.String(), `{"id":1}`) {
+				t.Fatalf("the handler wrote into the 503: %q", rec.Body)
+			}
+		default:
+			t.Fatalf("status = %d", rec.Code)
+		}
+		results[rec.Code]++
+	}
+	if results[http.StatusCreated] == 0 || results[http.StatusServiceUnavailable] == 0 {
+		t.Logf("only one side won the race: %v", results)
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	s, logs := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.RequestTimeout = 50 * time.Millisecond
+	}))
+
+	start := time.Now()
+	rec, envelope := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("answered after %s", elapsed)
+	}
+	if rec.Code != http.StatusServiceUnavailable || envelope.Error.Code != errCodeRequestTimeout {
+		t.Errorf("got %d %s: %s", rec.Code, envelope.Error.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `"msg":"Request timed out"`) {
+		t.Error("the timeout was not logged")
+	}
+	if rec := serve(s, http.MethodGet, "/", nil); rec.Code != http.StatusOK {
+		t.Errorf("/ = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for localhost and
+// 127.0.0.1 with its key into dir and returns their paths and the pool
+// trusting it.
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServerHTTPS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSigned(t, t.TempDir())
+	s, logs := startTestServer(t, func(cfg *Config) {
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+	})
+
+	tests := []struct {
+		name             string
+		maxVersion       uint16
+		wantHandshakeErr bool
+	}{
+		{"TLS 1.3", tls.VersionTLS13, false},
+		{"TLS 1.2", tls.VersionTLS12, false},
+		{"TLS 1.1 refused", tls.VersionTLS11, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:    pool,
+				MinVersion: tls.VersionTLS10,
+				MaxVersion: tt.maxVersion,
+			}}}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get(serverURL(t, s, "https", "/"))
+			if tt.wantHandshakeErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded, want a handshake error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "<h1>index</h1>" {
+				t.Errorf("got %d %q", resp.StatusCode, body)
+			}
+			if resp.TLS == nil || resp.TLS.Version != tt.maxVersion {
+				t.Errorf("negotiated %v, want version %x", resp.TLS, tt.maxVersion)
+			}
+		})
+	}
+
+	if !strings.Contains(logs.String(), `"scheme":"https"`) {
+		t.Errorf("the start is not logged with scheme https:\n%s", logs)
+	}
+}
+
+func TestServerPlainRequestToHTTPS(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSigned(t, t.TempDir())
+	s, _ := startTestServer(t, func(cfg *Config) {
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+	})
+
+	resp, err := http.Get(serverURL(t, s, "http", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain HTTP to the TLS port = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestConfigTLSFilesTogether(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSigned(t, t.TempDir())
+	tests := []struct {
+		name    string
+		cert    string
+		key     string
+		wantErr bool
+	}{
+		{"both", certFile, keyFile, false},
+		{"neither", "", "", false},
+		{"only cert", certFile, "", true},
+		{"only key", "", keyFile, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.StaticDir = t.TempDir()
+			cfg.TLSCertFile, cfg.TLSKeyFile = tt.cert, tt.key
+			err := cfg.validate()
+			if tt.wantErr != (err != nil && strings.Contains(err.Error(), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")) {
+				t.Errorf("validate = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	cfg := newTLSConfig()
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want TLS 1.2", cfg.MinVersion)
+	}
+	for _, id := range cfg.CipherSuites {
+		for _, insecure := range tls.InsecureCipherSuites() {
+			if id == insecure.ID {
+				t.Errorf("cipher suite %s is insecure", insecure.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envUpgradeListeners = "UPGRADE_LISTENERS"
+	envUpgradeReadyFD   = "UPGRADE_READY_FD"
+
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+type namedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// upgrader hands the listening sockets over to a freshly started copy of the
+// binary so that a restart never leaves the port unbound. Inherited listeners
+// are passed as extra files starting at fd 3 in the order given by
+// UPGRADE_LISTENERS; the child reports readiness by writing to the pipe at
+// UPGRADE_READY_FD.
+type upgrader struct {
+	inherited map[string]*os.File
+	ready     *os.File
+	active    []namedListener
+	upgraded  bool
+	handedOff bool
+}
+
+func newUpgrader() (*upgrader, error) {
+	u := &upgrader{inherited: make(map[string]*os.File)}
+
+	names := os.Getenv(envUpgradeListeners)
+	if names == "" {
+		return u, nil
+	}
+	u.upgraded = true
+	for i, name := range strings.Split(names, ",") {
+		u.inherited[name] = os.NewFile(uintptr(3+i), name)
+	}
+
+	if raw := os.Getenv(envUpgradeReadyFD); raw != "" {
+		fd, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid fd %q", envUpgradeReadyFD, raw)
+		}
+		u.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+
+	os.Unsetenv(envUpgradeListeners)
+	os.Unsetenv(envUpgradeReadyFD)
+
+	return u, nil
+}
+
+// Listen returns the listener inherited from the parent process under name,
+// or creates a new one when there is none.
+func (u *upgrader) Listen(name string, create func() (net.Listener, error)) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+
+	if f, ok := u.inherited[name]; ok {
+		ln, err = net.FileListener(f)
+		f.Close()
+		delete(u.inherited, name)
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+	} else {
+		ln, err = create()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.active = append(u.active, namedListener{name: name, ln: ln})
+	return ln, nil
+}
+
+// Inherited reports whether the process was started by an upgrade.
+func (u *upgrader) Inherited() bool {
+	return u.upgraded
+}
+
+// Ready tells the parent process that this one is serving, so it can shut
+// down. It is a no-op when the process was not started by an upgrade.
+func (u *upgrader) Ready() error {
+	for name, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, name)
+	}
+
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+
+	_, err := u.ready.Write([]byte{1})
+	return err
+}
+
+// HandedOff reports whether the listeners now belong to a replacement process.
+func (u *upgrader) HandedOff() bool {
+	return u.handedOff
+}
+
+// Upgrade starts a new copy of the running binary with the active listeners
+// and waits until it reports readiness. It returns the pid of the new process.
+func (u *upgrader) Upgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(u.active))
+	files := make([]*os.File, 0, len(u.active)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range u.active {
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s cannot be passed to a child process", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, fmt.Errorf("listener %s: %w", l.name, err)
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envUpgradeListeners+"="+strings.Join(names, ","),
+		envUpgradeReadyFD+"="+strconv.Itoa(3+len(names)),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	if err := readyR.SetReadDeadline(time.Now().Add(upgradeReadyTimeout)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1)
+	if _, err := readyR.Read(buf); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("new process did not become ready within %s", upgradeReadyTimeout)
+		}
+		return 0, fmt.Errorf("new process exited before becoming ready: %w", err)
+	}
+
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	for _, l := range u.active {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	u.handedOff = true
+
+	return pid, nil
+}
@@ -0,0 +1,135 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// upgradeChildBody is what the replacement process answers with.
+const upgradeChildBody = "child"
+
+// TestUpgradeHandsOffListener runs twice: as the parent, which serves on a
+// listener and upgrades to a copy of the test binary, and as that copy,
+// which finds the listener in UPGRADE_LISTENERS and serves on it.
+func TestUpgradeHandsOffListener(t *testing.T) {
+	if os.Getenv(envUpgradeListeners) != "" {
+		runUpgradeChild()
+		return
+	}
+
+	// The copy runs this test alone, with the arguments Upgrade passes on.
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestUpgradeHandsOffListener$"}
+	t.Cleanup(func() { os.Args = args })
+
+	u, err := newUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := false
+	ln, err := u.Listen("main", func() (net.Listener, error) {
+		created = true
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || u.Inherited() {
+		t.Fatalf("created = %t, inherited = %t; want a new listener", created, u.Inherited())
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "parent")
+	})}
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/"
+	if body := getBody(t, url); body != "parent" {
+		t.Fatalf("before the upgrade got %q", body)
+	}
+
+	pid, err := u.Upgrade()
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	t.Cleanup(func() {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+			p.Wait()
+		}
+	})
+	if !u.HandedOff() {
+		t.Error("HandedOff = false after Upgrade")
+	}
+
+	// The parent stops serving; the port stays bound by the child.
+	srv.Close()
+	http.DefaultClient.CloseIdleConnections()
+	if body := getBody(t, url); body != upgradeChildBody {
+		t.Errorf("after the upgrade got %q, want %q from the child", body, upgradeChildBody)
+	}
+}
+
+// runUpgradeChild is the replacement process of
+// TestUpgradeHandsOffListener. It serves until the parent kills it, or
+// gives up after a while so that a failed test leaves nothing behind.
+func runUpgradeChild() {
+	u, err := newUpgrader()
+	if err != nil {
+		os.Exit(2)
+	}
+	ln, err := u.Listen("main", func() (net.Listener, error) {
+		return nil, errors.New("listener was not inherited")
+	})
+	if err != nil {
+		os.Exit(3)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, upgradeChildBody)
+	}))
+	if err := u.Ready(); err != nil {
+		os.Exit(4)
+	}
+	time.Sleep(30 * time.Second)
+	os.Exit(0)
+}
+
+func TestUpgradeRequiresFileListener(t *testing.T) {
+	u, err := newUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	if _, err := u.Listen("main", func() (net.Listener, error) { return newLimitListener(inner, 1), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Upgrade(); err == nil {
+		t.Fatal("Upgrade succeeded with a listener that has no file")
+	}
+	if u.HandedOff() {
+		t.Error("HandedOff = true after a failed Upgrade")
+	}
+}
+
+func getBody(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
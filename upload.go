@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// uploadPath gets GREENAPI_UPLOAD_MAX_BYTES as its body limit unless
+// MAX_BODY_ROUTES sets one.
+const uploadPath = "/api/sendFileByUpload"
+
+// maxFormFieldBytes bounds the text fields of an upload form; the caption
+// may be maxMessageLength characters of up to four bytes each.
+const maxFormFieldBytes = 4*maxMessageLength + 1024
+
+var errFieldsAfterFile = errors.New("form fields after the file part are not supported")
+
+// uploadForm is the multipart body of sendFileByUpload. The file is read
+// straight from the request while it is uploaded, unless it came before
+// chatId: then it is spooled to a temporary file first, since the chat has
+// to be checked before anything is sent.
+type uploadForm struct {
+	ChatID      string
+	Caption     string
+	FileName    string
+	contentType string
+	file        io.Reader
+	spool       *os.File
+
+	// chatID is ChatID normalized by validate.
+	chatID string
+}
+
+func (f *uploadForm) validate(_ context.Context, v *validation) {
+	var err error
+	f.chatID, err = normalizeChatID(f.ChatID, "")
+	v.check("chatId", err)
+	if f.file == nil {
+		v.add("file", "required", "must not be empty")
+	} else {
+		v.check("fileName", checkFileName(f.FileName))
+	}
+	v.maxLength("caption", f.Caption, maxMessageLength)
+}
+
+// read takes the form fields up to the file part and, when the file was not
+// spooled, leaves the rest of the body to be streamed.
+func (f *uploadForm) read(mr *multipart.Reader) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FormName() == "file" {
+			if f.file != nil {
+				return errors.New("more than one file part")
+			}
+			if f.FileName == "" {
+				f.FileName = part.FileName()
+			}
+			f.contentType = part.Header.Get("Content-Type")
+			if f.ChatID != "" {
+				f.file = &lastPartReader{part: part, mr: mr}
+				return nil
+			}
+			if err := f.spoolFile(part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldBytes+1))
+		if err != nil {
+			return err
+		}
+		if len(value) > maxFormFieldBytes {
+			return fmt.Errorf("form field %q is too long", part.FormName())
+		}
+		switch part.FormName() {
+		case "chatId":
+			f.ChatID = string(value)
+		case "caption":
+			f.Caption = string(value)
+		case "fileName":
+			f.FileName = string(value)
+		}
+	}
+}
+
+func (f *uploadForm) spoolFile(part *multipart.Part) error {
+	spool, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return err
+	}
+	f.spool = spool
+	if _, err := io.Copy(spool, part); err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.file = spool
+	return nil
+}
+
+// close removes the spooled file, if there is one.
+func (f *uploadForm) close() {
+	if f.spool == nil {
+		return
+	}
+	f.spool.Close()
+	if err := os.Remove(f.spool.Name()); err != nil {
+		slog.Warn("Could not remove spooled upload", slog.String("file", f.spool.Name()), slog.Any("error", err))
+	}
+}
+
+// lastPartReader reads the file part and fails at its end if the form goes
+// on, since later fields could no longer be sent.
+type lastPartReader struct {
+	part *multipart.Part
+	mr   *multipart.Reader
+}
+
+func (l *lastPartReader) Read(p []byte) (int, error) {
+	n, err := l.part.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	switch _, next := l.mr.NextPart(); next {
+	case io.EOF:
+		return n, io.EOF
+	case nil:
+		return n, errFieldsAfterFile
+	default:
+		return n, next
+	}
+}
+
+// SendFileByUpload sends a file uploaded as multipart/form-data with the
+// fields chatId, caption, fileName (defaulting to the file's own name) and
+// file. The file is passed on to GREEN-API while it is being received.
+func (g *greenAPI) SendFileByUpload(w http.ResponseWriter, r *http.Request) error {
+	c, err := g.authorizedClient(r)
+	if err != nil {
+		return err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return &HTTPError{Status: http.StatusBadRequest, Code: errCodeInvalidBody, Message: "expected a multipart/form-data body"}
+	}
+
+	// READ_TIMEOUT and WRITE_TIMEOUT are meant for ordinary requests.
+	deadline := time.Now().Add(g.uploadTimeout)
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(deadline)
+	_ = setWriteDeadline(w, r, deadline)
+
+	var form uploadForm
+	defer form.close()
+	if err := form.read(mr); err != nil {
+		return g.uploadError(r, err)
+	}
+	var v validation
+	form.validate(r.Context(), &v)
+	if len(v.errs) > 0 {
+		return validationError(v.errs)
+	}
+
+	ctx, cancel := upstreamContext(r, r.Context(), g.uploadTimeout)
+	defer cancel()
+	result, err := c.WithHTTPClient(g.upload).SendFileByUpload(ctx, greenapi.SendFileByUploadRequest{
+		ChatID:      form.chatID,
+		FileName:    form.FileName,
+		ContentType: form.contentType,
+		Caption:     form.Caption,
+		File:        form.file,
+	})
+	if err != nil {
+		var uploadErr *greenapi.UploadError
+		if errors.As(err, &uploadErr) {
+			return g.uploadError(r, uploadErr.Err)
+		}
+		return g.upstreamError(r, "sendFileByUpload", err)
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// uploadError maps a failure to read the upload from the client. A body
+// over the limit is left to BodyLimit, which answers 413, so it maps to
+// nil.
+func (g *greenAPI) uploadError(r *http.Request, err error) error {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		return nil
+	case r.Context().Err() != nil:
+		return g.upstreamError(r, "sendFileByUpload", context.Cause(r.Context()))
+	case errors.Is(err, errFieldsAfterFile):
+		return &HTTPError{Status: http.StatusBadRequest, Code: errCodeInvalidBody, Message: "chatId, caption and fileName must come before the file"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &HTTPError{Status: http.StatusBadRequest, Code: errCodeInvalidBody, Message: "upload ended before the form was complete"}
+	default:
+		return &HTTPError{Status: http.StatusBadRequest, Code: errCodeInvalidBody, Message: "could not read the upload", Err: err}
+	}
+}
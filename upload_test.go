@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+// formPart is one part of an upload form; a part with a file name is the
+// file.
+type formPart struct {
+	name, value string
+	fileName    string
+	contentType string
+	data        []byte
+}
+
+// uploadBody encodes parts as a multipart form and returns it with its
+// Content-Type header.
+func uploadBody(t *testing.T, parts ...formPart) (string, http.Header) {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		if p.fileName == "" {
+			form.WriteField(p.name, p.value)
+			continue
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="`+p.name+`"; filename="`+p.fileName+`"`)
+		header.Set("Content-Type", p.contentType)
+		w, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(p.data)
+	}
+	form.Close()
+	return buf.String(), http.Header{"Content-Type": {form.FormDataContentType()}}
+}
+
+// receivedUpload is what the fake GREEN-API got in a sendFileByUpload call.
+type receivedUpload struct {
+	chatID, caption, fileName string
+	partFileName, contentType string
+	sum                       [sha256.Size]byte
+	size                      int
+}
+
+func uploadUpstream(t *testing.T, got *receivedUpload) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/waInstance1101/sendFileByUpload/secret" {
+			t.Errorf("GREEN-API called at %s", r.URL.Path)
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("upstream body: %v", err)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			switch part.FormName() {
+			case "chatId":
+				got.chatID = string(data)
+			case "caption":
+				got.caption = string(data)
+			case "fileName":
+				got.fileName = string(data)
+			case "file":
+				got.partFileName = part.FileName()
+				got.contentType = part.Header.Get("Content-Type")
+				got.sum = sha256.Sum256(data)
+				got.size = len(data)
+			}
+		}
+		io.WriteString(w, `{"idMessage":"BAE7"}`)
+	}
+}
+
+func TestSendFileByUpload(t *testing.T) {
+	file := make([]byte, 5<<20)
+	rand.Read(file)
+	chat := formPart{name: "chatId", value: "79001234567@c.us"}
+	caption := formPart{name: "caption", value: "the report"}
+	png := formPart{name: "file", fileName: "report.png", contentType: "image/png", data: file}
+
+	tests := []struct {
+		name       string
+		parts      []formPart
+		wantStatus int
+		wantCode   string
+		wantFields string
+	}{
+		{"streamed", []formPart{chat, caption, png}, http.StatusOK, "", ""},
+		{"file before chatId is spooled", []formPart{caption, png, chat}, http.StatusOK, "", ""},
+		{"fields after the file", []formPart{chat, png, caption}, http.StatusBadRequest, errCodeInvalidBody, ""},
+		{"no file", []formPart{chat, caption}, http.StatusBadRequest, errCodeValidation, "file:required"},
+		{"bad chat", []formPart{{name: "chatId", value: "nope@g.us"}, png}, http.StatusBadRequest, errCodeValidation, "chatId:group_chat_id"},
+		{"two files", []formPart{chat, png, png}, http.StatusBadRequest, errCodeInvalidBody, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			var got receivedUpload
+			upstream := fakeGreenAPI(t, uploadUpstream(t, &got))
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt))
+
+			body, header := uploadBody(t, tt.parts...)
+			rec, envelope := callAPI(t, s, http.MethodPost, uploadPath, body, header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if leftovers, _ := os.ReadDir(tmp); len(leftovers) > 0 {
+				t.Errorf("%d temporary files left behind", len(leftovers))
+			}
+			if tt.wantStatus != http.StatusOK {
+				fields := ""
+				var details struct{ Fields []fieldError }
+				if envelope.Error.Details != nil {
+					json.Unmarshal(envelope.Error.Details, &details)
+					fields = problems(details.Fields)
+				}
+				if envelope.Error.Code != tt.wantCode || fields != tt.wantFields {
+					t.Errorf("got %s %q, want %s %q", envelope.Error.Code, fields, tt.wantCode, tt.wantFields)
+				}
+				return
+			}
+
+			if !strings.Contains(rec.Body.String(), `"idMessage":"BAE7"`) {
+				t.Errorf("body = %s", rec.Body)
+			}
+			if got.sum != sha256.Sum256(file) || got.size != len(file) {
+				t.Errorf("upstream got %d bytes that differ from the %d uploaded", got.size, len(file))
+			}
+			if got.chatID != chat.value || got.caption != caption.value || got.fileName != "report.png" ||
+				got.partFileName != "report.png" || got.contentType != "image/png" {
+				t.Errorf("upstream got %+v", got)
+			}
+		})
+	}
+}
+
+func TestSendFileByUploadLimits(t *testing.T) {
+	chat := formPart{name: "chatId", value: "79001234567@c.us"}
+	small := formPart{name: "file", fileName: "a.txt", contentType: "text/plain", data: []byte("hello")}
+	big := formPart{name: "file", fileName: "a.bin", contentType: "application/octet-stream", data: make([]byte, 64<<10)}
+
+	tests := []struct {
+		name       string
+		parts      []formPart
+		json       string
+		cut        int
+		upstream   int
+		wantStatus int
+		wantCode   string
+	}{
+		{"over the limit", []formPart{chat, big}, "", 0, http.StatusOK, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge},
+		{"truncated", []formPart{chat, small}, "", 20, http.StatusOK, http.StatusBadRequest, errCodeInvalidBody},
+		{"not multipart", nil, `{"chatId":"79001234567@c.us"}`, 0, http.StatusOK, http.StatusBadRequest, errCodeInvalidBody},
+		{"upstream fails", []formPart{chat, small}, "", 0, http.StatusInternalServerError, http.StatusBadGateway, errCodeUpstreamError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(tt.upstream)
+				io.WriteString(w, `{"idMessage":"BAE8"}`)
+			})
+			s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+				cfg.GreenAPIUploadMaxBytes = 16 << 10
+			}))
+
+			body, header := tt.json, http.Header(nil)
+			if tt.parts != nil {
+				body, header = uploadBody(t, tt.parts...)
+				body = body[:len(body)-tt.cut]
+			}
+			rec, envelope := callAPI(t, s, http.MethodPost, uploadPath, body, header)
+			if rec.Code != tt.wantStatus || envelope.Error.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s: %s", rec.Code, envelope.Error.Code, tt.wantStatus, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// upstreamOutcomes are the outcomes of greenapi.Recorder that /stats keeps
+// apart; any other, such as 1xx, is counted only in the call total.
+var upstreamOutcomes = [...]string{
+	"2xx",
+	"4xx",
+	"5xx",
+	greenapi.OutcomeError,
+	greenapi.OutcomeTimeout,
+	greenapi.OutcomeCanceled,
+	greenapi.OutcomeCircuitOpen,
+	greenapi.OutcomeThrottled,
+}
+
+// upstreamRecorder is the greenapi.Recorder of every client: it feeds
+// /metrics and the GREEN-API part of /stats. Instances are labelled by
+// Config.instanceLabel, and methods are those the client knows or
+// GREENAPI_PROXY_METHODS lets through, so the label sets stay bounded.
+type upstreamRecorder struct {
+	metrics *metrics
+	label   func(idInstance string) string
+	calls   *upstreamCallStats
+}
+
+func newUpstreamRecorder(m *metrics, cfg *Config) *upstreamRecorder {
+	return &upstreamRecorder{metrics: m, label: cfg.instanceLabel, calls: new(upstreamCallStats)}
+}
+
+func (u *upstreamRecorder) Attempt(method, idInstance string, attempt, status int, latency time.Duration) {
+	instance := u.label(idInstance)
+	code := greenapi.OutcomeError
+	if status != 0 {
+		code = statusClass(status)
+	}
+	u.metrics.upstreamRequests.WithLabelValues(method, instance, code).Inc()
+	u.metrics.upstreamDuration.WithLabelValues(method, instance).Observe(latency.Seconds())
+	if attempt > 1 {
+		u.metrics.upstreamRetries.WithLabelValues(method, instance).Inc()
+	}
+	u.calls.method(method).attempt(attempt, status, latency)
+}
+
+func (u *upstreamRecorder) Call(method, idInstance, outcome string, _ time.Duration) {
+	u.metrics.upstreamCalls.WithLabelValues(method, u.label(idInstance), outcome).Inc()
+	u.calls.method(method).call(outcome)
+}
+
+// upstreamMethodCounters are the lifetime totals of one GREEN-API method.
+type upstreamMethodCounters struct {
+	calls    atomic.Int64
+	outcomes [len(upstreamOutcomes)]atomic.Int64
+	attempts atomic.Int64
+	retries  atomic.Int64
+	// failed counts the attempts that got no answer or an error status.
+	failed atomic.Int64
+	// latencySum is in nanoseconds, over all attempts.
+	latencySum atomic.Int64
+}
+
+func (c *upstreamMethodCounters) attempt(attempt, status int, latency time.Duration) {
+	c.attempts.Add(1)
+	if attempt > 1 {
+		c.retries.Add(1)
+	}
+	if status < 200 || status > 299 {
+		c.failed.Add(1)
+	}
+	c.latencySum.Add(int64(latency))
+}
+
+func (c *upstreamMethodCounters) call(outcome string) {
+	c.calls.Add(1)
+	if i := slices.Index(upstreamOutcomes[:], outcome); i >= 0 {
+		c.outcomes[i].Add(1)
+	}
+}
+
+// upstreamCallStats counts GREEN-API calls by method for /stats.
+type upstreamCallStats struct {
+	methods sync.Map // string to *upstreamMethodCounters
+}
+
+func (s *upstreamCallStats) method(method string) *upstreamMethodCounters {
+	if c, ok := s.methods.Load(method); ok {
+		return c.(*upstreamMethodCounters)
+	}
+	c, _ := s.methods.LoadOrStore(method, new(upstreamMethodCounters))
+	return c.(*upstreamMethodCounters)
+}
+
+type upstreamMethodReport struct {
+	Calls          int64            `json:"calls"`
+	Outcomes       map[string]int64 `json:"outcomes"`
+	Attempts       int64            `json:"attempts"`
+	Retries        int64            `json:"retries"`
+	FailedAttempts int64            `json:"failed_attempts"`
+	LatencyMeanMs  float64          `json:"latency_mean_ms"`
+}
+
+// report returns the totals by method; outcomes that never happened are
+// left out.
+func (s *upstreamCallStats) report() map[string]upstreamMethodReport {
+	report := map[string]upstreamMethodReport{}
+	s.methods.Range(func(key, value any) bool {
+		c := value.(*upstreamMethodCounters)
+		r := upstreamMethodReport{
+			Calls:          c.calls.Load(),
+			Outcomes:       map[string]int64{},
+			Attempts:       c.attempts.Load(),
+			Retries:        c.retries.Load(),
+			FailedAttempts: c.failed.Load(),
+		}
+		for i, outcome := range upstreamOutcomes {
+			if n := c.outcomes[i].Load(); n > 0 {
+				r.Outcomes[outcome] = n
+			}
+		}
+		if r.Attempts > 0 {
+			r.LatencyMeanMs = float64(c.latencySum.Load()) / float64(r.Attempts) / float64(time.Millisecond)
+		}
+		report[key.(string)] = r
+		return true
+	})
+	return report
+}
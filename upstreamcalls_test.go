@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+func TestUpstreamCallStats(t *testing.T) {
+	var s upstreamCallStats
+	getSettings := s.method("getSettings")
+	getSettings.attempt(1, http.StatusBadGateway, 30*time.Millisecond)
+	getSettings.attempt(2, 0, 10*time.Millisecond)
+	getSettings.attempt(3, http.StatusOK, 20*time.Millisecond)
+	getSettings.call("2xx")
+	getSettings.call(greenapi.OutcomeCircuitOpen)
+	getSettings.call("1xx")
+	s.method("sendMessage").attempt(1, http.StatusCreated, time.Millisecond)
+	s.method("sendMessage").call("2xx")
+
+	want := map[string]upstreamMethodReport{
+		"getSettings": {
+			Calls:          3,
+			Outcomes:       map[string]int64{"2xx": 1, greenapi.OutcomeCircuitOpen: 1},
+			Attempts:       3,
+			Retries:        2,
+			FailedAttempts: 2,
+			LatencyMeanMs:  20,
+		},
+		"sendMessage": {Calls: 1, Outcomes: map[string]int64{"2xx": 1}, Attempts: 1, LatencyMeanMs: 1},
+	}
+	got := s.report()
+	if len(got) != len(want) {
+		t.Fatalf("report = %v", got)
+	}
+	for method, w := range want {
+		g := got[method]
+		if g.Calls != w.Calls || g.Attempts != w.Attempts || g.Retries != w.Retries ||
+			g.FailedAttempts != w.FailedAttempts || g.LatencyMeanMs != w.LatencyMeanMs || len(g.Outcomes) != len(w.Outcomes) {
+			t.Errorf("%s = %+v, want %+v", method, g, w)
+		}
+		for outcome, n := range w.Outcomes {
+			if g.Outcomes[outcome] != n {
+				t.Errorf("%s outcome %s = %d, want %d", method, outcome, g.Outcomes[outcome], n)
+			}
+		}
+	}
+}
+
+// TestServerUpstreamCallMetrics drives a flaky upstream, failing two of
+// every three getSettings requests and every sendMessage, and checks the
+// counters on /metrics and /stats against the script.
+func TestServerUpstreamCallMetrics(t *testing.T) {
+	const adminToken = "0123456789abcdef0123456789abcdef"
+	var settings atomic.Int32
+	upstream := fakeGreenAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/getSettings/") && settings.Add(1)%3 == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"wid":"79001234567@c.us"}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	s, _ := newTestServer(t, withConfig(withUpstream(upstream), singleAttempt, func(cfg *Config) {
+		cfg.AdminToken = adminToken
+		cfg.GreenAPIRetryAttempts = 3
+		cfg.GreenAPIRetryDelay = time.Millisecond
+		cfg.GreenAPIRetryMaxDelay = time.Millisecond
+	}))
+
+	for range 2 {
+		if rec, _ := callAPI(t, s, http.MethodGet, "/api/getSettings", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("getSettings = %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if rec, _ := callAPI(t, s, http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"hi"}`, nil); rec.Code != http.StatusBadGateway {
+		t.Fatalf("sendMessage = %d, want 502: %s", rec.Code, rec.Body)
+	}
+	other := http.Header{"X-Id-Instance": {"9909"}, "X-Api-Token": {"other-token"}}
+	callAPI(t, s, http.MethodPost, "/api/sendMessage", `{"chatId":"79001234567@c.us","message":"hi"}`, other)
+
+	metrics := serve(s, http.MethodGet, "/metrics", nil).Body.String()
+	for _, want := range []string{
+		`greenapi_requests_total{code="2xx",instance="default",method="getSettings"} 2`,
+		`greenapi_requests_total{code="5xx",instance="default",method="getSettings"} 4`,
+		`greenapi_retries_total{instance="default",method="getSettings"} 4`,
+		`greenapi_request_duration_seconds_count{instance="default",method="getSettings"} 6`,
+		`greenapi_calls_total{instance="default",method="getSettings",outcome="2xx"} 2`,
+		`greenapi_requests_total{code="5xx",instance="default",method="sendMessage"} 1`,
+		`greenapi_calls_total{instance="default",method="sendMessage",outcome="5xx"} 1`,
+		`greenapi_calls_total{instance="` + otherInstance + `",method="sendMessage",outcome="5xx"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+	if strings.Contains(metrics, `greenapi_retries_total{instance="default",method="sendMessage"}`) {
+		t.Error("a POST was counted as retried")
+	}
+	if strings.Contains(metrics, "9909") || strings.Contains(metrics, "other-token") {
+		t.Error("/metrics is labelled with an instance ID or token")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	var report struct {
+		Methods map[string]upstreamMethodReport `json:"greenapi_methods"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("/stats %q: %v", rec.Body, err)
+	}
+	tests := []struct {
+		method                           string
+		calls, attempts, retries, failed int64
+		ok, upstreamError                int64
+	}{
+		{"getSettings", 2, 6, 4, 4, 2, 0},
+		{"sendMessage", 2, 2, 0, 2, 0, 2},
+	}
+	for _, tt := range tests {
+		got := report.Methods[tt.method]
+		if got.Calls != tt.calls || got.Attempts != tt.attempts || got.Retries != tt.retries || got.FailedAttempts != tt.failed ||
+			got.Outcomes["2xx"] != tt.ok || got.Outcomes["5xx"] != tt.upstreamError {
+			t.Errorf("%s = %+v", tt.method, got)
+		}
+		if got.LatencyMeanMs <= 0 {
+			t.Errorf("%s latency_mean_ms = %g", tt.method, got.LatencyMeanMs)
+		}
+	}
+}
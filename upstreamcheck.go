@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// upstreamCheckMaxBackoff bounds how far checks are spread out while
+// GREEN-API keeps failing.
+const upstreamCheckMaxBackoff = 5 * time.Minute
+
+// upstreamUnreachable stands in for the instance state while
+// getStateInstance fails.
+const upstreamUnreachable = "unreachable"
+
+// upstreamStatus is what the last check of an instance found.
+type upstreamStatus struct {
+	State     string     `json:"state"`
+	LatencyMs float64    `json:"latency_ms"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// Since is when the instance entered State.
+	Since    *time.Time `json:"since,omitempty"`
+	Failures int        `json:"consecutive_failures,omitempty"`
+}
+
+// upstreamChecker asks GREEN-API for the state of one instance every
+// interval, so that wrong credentials or a blocked instance show up in
+// /readyz and /stats before a user action fails. Only changes of the state
+// are logged.
+type upstreamChecker struct {
+	// name is the instance label from Config.instanceLabel.
+	name     string
+	client   *greenapi.Client
+	logger   *slog.Logger
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	status upstreamStatus
+}
+
+func newUpstreamChecker(name string, client *greenapi.Client, logger *slog.Logger, interval, timeout time.Duration) *upstreamChecker {
+	return &upstreamChecker{
+		name:     name,
+		client:   client,
+		logger:   logger.With(slog.String("instance", name)),
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+// upstreamChecks are the checkers of every configured instance.
+type upstreamChecks struct {
+	// primary checks the instance of the unprefixed /api/ routes; it is
+	// nil when there is none.
+	primary  *upstreamChecker
+	checkers []*upstreamChecker
+	// named is set when GREENAPI_INSTANCES is, and adds the status of each
+	// instance to the reports.
+	named bool
+}
+
+// Reachable reports whether any checked instance got an answer: GREEN-API
+// is only taken to be down when none of them can reach it.
+func (u *upstreamChecks) Reachable() bool {
+	for _, c := range u.checkers {
+		if c.Reachable() {
+			return true
+		}
+	}
+	return len(u.checkers) == 0
+}
+
+// Primary returns the status of the primary checker, or nil.
+func (u *upstreamChecks) Primary() *upstreamStatus {
+	if u.primary == nil {
+		return nil
+	}
+	status := u.primary.Status()
+	return &status
+}
+
+// Instances returns the status of every checker by instance name, or nil
+// without named instances.
+func (u *upstreamChecks) Instances() map[string]upstreamStatus {
+	if !u.named {
+		return nil
+	}
+	statuses := make(map[string]upstreamStatus, len(u.checkers))
+	for _, c := range u.checkers {
+		statuses[c.name] = c.Status()
+	}
+	return statuses
+}
+
+// Status returns the result of the last check; State is empty before the
+// first one.
+func (c *upstreamChecker) Status() upstreamStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Reachable reports whether the last check got an answer. It is true before
+// the first check, so that a slow first answer does not fail readiness.
+func (c *upstreamChecker) Reachable() bool {
+	return c.Status().State != upstreamUnreachable
+}
+
+// Run checks until ctx is canceled. While checks fail, the delay doubles up
+// to upstreamCheckMaxBackoff, or to the interval when that is longer, and
+// an open circuit is waited out.
+func (c *upstreamChecker) Run(ctx context.Context) {
+	c.logger.Info("Checking GREEN-API instance state", slog.Duration("interval", c.interval))
+
+	for ctx.Err() == nil {
+		err := c.check(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		delay := c.interval
+		if err != nil {
+			failures := c.Status().Failures
+			delay = c.interval << min(failures-1, 16)
+			delay = min(delay, max(upstreamCheckMaxBackoff, c.interval))
+			var open *greenapi.CircuitOpenError
+			if errors.As(err, &open) {
+				delay = max(open.RetryAfter, delay)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *upstreamChecker) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	state, err := c.client.GetStateInstance(ctx)
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		// Shutdown, not an answer.
+		return err
+	}
+	c.record(state, time.Since(start), err, time.Now())
+	return err
+}
+
+// record stores the result of a check and logs it when the state changed.
+func (c *upstreamChecker) record(state *greenapi.StateInstance, latency time.Duration, err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.status
+	next := upstreamStatus{
+		State:     upstreamUnreachable,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+		CheckedAt: &now,
+		Since:     &now,
+	}
+	if err != nil {
+		next.Error = err.Error()
+		next.Failures = previous.Failures + 1
+	} else {
+		next.State = state.StateInstance
+	}
+	if next.State == previous.State {
+		next.Since = previous.Since
+	}
+	c.status = next
+
+	if next.State == previous.State {
+		return
+	}
+	attrs := []any{
+		slog.String("state", next.State),
+		slog.Duration("latency", latency),
+	}
+	if previous.State != "" {
+		attrs = append(attrs, slog.String("previous", previous.State),
+			slog.Duration("previous_for", now.Sub(*previous.Since)))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	level := slog.LevelWarn
+	if next.State == greenapi.StateAuthorized {
+		level = slog.LevelInfo
+	}
+	c.logger.Log(context.Background(), level, "GREEN-API instance state changed", attrs...)
+}
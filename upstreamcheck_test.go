@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// stateUpstream is a fake GREEN-API whose getStateInstance answers the
+// state set last, or 500 for upstreamUnreachable.
+type stateUpstream struct {
+	mu    sync.Mutex
+	state string
+	calls atomic.Int32
+}
+
+func (u *stateUpstream) set(state string) {
+	u.mu.Lock()
+	u.state = state
+	u.mu.Unlock()
+}
+
+func (u *stateUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.calls.Add(1)
+	u.mu.Lock()
+	state := u.state
+	u.mu.Unlock()
+	if state == upstreamUnreachable {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, `{"stateInstance":"`+state+`"}`)
+}
+
+func TestUpstreamCheckerRecord(t *testing.T) {
+	failed := errors.New("connection refused")
+	type check struct {
+		state string // "" for a failed check
+		err   error
+	}
+	tests := []struct {
+		name         string
+		checks       []check
+		want         upstreamStatus
+		wantLogged   []string
+		wantSinceIdx int // the check that entered the final state
+	}{
+		{"first check", []check{{state: "authorized"}}, upstreamStatus{State: "authorized"}, []string{`"state":"authorized"`}, 0},
+		{"unchanged is not logged", []check{{state: "authorized"}, {state: "authorized"}, {state: "authorized"}},
+			upstreamStatus{State: "authorized"}, []string{`"state":"authorized"`}, 0},
+		{"authorized, blocked, authorized", []check{{state: "authorized"}, {state: "blocked"}, {state: "blocked"}, {state: "authorized"}},
+			upstreamStatus{State: "authorized"}, []string{
+				`"level":"INFO","msg":"GREEN-API instance state changed","instance":"default","state":"authorized"`,
+				`"level":"WARN","msg":"GREEN-API instance state changed","instance":"default","state":"blocked","latency":1000000,"previous":"authorized"`,
+				`"level":"INFO","msg":"GREEN-API instance state changed","instance":"default","state":"authorized","latency":1000000,"previous":"blocked"`,
+			}, 3},
+		{"failures count up", []check{{state: "authorized"}, {err: failed}, {err: failed}},
+			upstreamStatus{State: upstreamUnreachable, Error: "connection refused", Failures: 2},
+			[]string{`"state":"authorized"`, `"state":"unreachable","latency":1000000,"previous":"authorized","previous_for":1000000000,"error":"connection refused"`}, 1},
+		{"recovery resets failures", []check{{err: failed}, {err: failed}, {state: "authorized"}},
+			upstreamStatus{State: "authorized"}, []string{`"state":"unreachable"`, `"state":"authorized","latency":1000000,"previous":"unreachable"`}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			c := newUpstreamChecker(defaultInstanceName, nil, slog.New(slog.NewJSONHandler(logs, nil)), time.Second, time.Second)
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, check := range tt.checks {
+				var state *greenapi.StateInstance
+				if check.err == nil {
+					state = &greenapi.StateInstance{StateInstance: check.state}
+				}
+				c.record(state, time.Millisecond, check.err, start.Add(time.Duration(i)*time.Second))
+			}
+
+			got := c.Status()
+			if got.State != tt.want.State || got.Error != tt.want.Error || got.Failures != tt.want.Failures {
+				t.Errorf("status = %+v, want %+v", got, tt.want)
+			}
+			if want := start.Add(time.Duration(tt.wantSinceIdx) * time.Second); !got.Since.Equal(want) {
+				t.Errorf("since = %s, want %s", got.Since, want)
+			}
+			if want := start.Add(time.Duration(len(tt.checks)-1) * time.Second); !got.CheckedAt.Equal(want) {
+				t.Errorf("checked at = %s, want %s", got.CheckedAt, want)
+			}
+			if c.Reachable() != (tt.want.State != upstreamUnreachable) {
+				t.Errorf("Reachable = %t", c.Reachable())
+			}
+			out := logs.String()
+			if n := strings.Count(out, `"msg":"GREEN-API instance state changed"`); n != len(tt.wantLogged) {
+				t.Errorf("logged %d changes, want %d:\n%s", n, len(tt.wantLogged), out)
+			}
+			for _, want := range tt.wantLogged {
+				if !strings.Contains(out, want) {
+					t.Errorf("the log lacks %s:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamCheckerBacksOff(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	tests := []struct {
+		state    string
+		minCalls int32
+		maxCalls int32
+	}{
+		{"authorized", 15, 1000},
+		// 10, 20, 40, 80 and 160ms apart: at most 6 calls in 400ms.
+		{upstreamUnreachable, 2, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			upstream := &stateUpstream{state: tt.state}
+			server := fakeGreenAPI(t, upstream.ServeHTTP)
+			client := greenapi.NewClient(greenapi.Endpoints{API: server.URL, Media: server.URL}, "1101", "secret", nil)
+			c := newUpstreamChecker(defaultInstanceName, client, slog.New(slog.DiscardHandler), interval, time.Second)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				c.Run(ctx)
+				close(done)
+			}()
+			time.Sleep(400 * time.Millisecond)
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Run did not stop when ctx was canceled")
+			}
+
+			time.Sleep(interval)
+			calls := upstream.calls.Load()
+			if calls < tt.minCalls || calls > tt.maxCalls {
+				t.Errorf("%d calls in 400ms, want %d to %d", calls, tt.minCalls, tt.maxCalls)
+			}
+			time.Sleep(3 * interval)
+			if after := upstream.calls.Load(); after != calls {
+				t.Errorf("%d calls after Run returned", after-calls)
+			}
+		})
+	}
+}
+
+func TestUpstreamChecks(t *testing.T) {
+	checker := func(name, state string) *upstreamChecker {
+		c := newUpstreamChecker(name, nil, slog.New(slog.DiscardHandler), time.Second, time.Second)
+		if state != "" {
+			var err error
+			var s *greenapi.StateInstance
+			if state == upstreamUnreachable {
+				err = errors.New("timeout")
+			} else {
+				s = &greenapi.StateInstance{StateInstance: state}
+			}
+			c.record(s, 0, err, time.Now())
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		checkers []*upstreamChecker
+		want     bool
+	}{
+		{"none", nil, true},
+		{"not checked yet", []*upstreamChecker{checker("a", "")}, true},
+		{"blocked answers", []*upstreamChecker{checker("a", "blocked")}, true},
+		{"one unreachable", []*upstreamChecker{checker("a", upstreamUnreachable), checker("b", "authorized")}, true},
+		{"all unreachable", []*upstreamChecker{checker("a", upstreamUnreachable), checker("b", upstreamUnreachable)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := &upstreamChecks{checkers: tt.checkers}
+			if got := checks.Reachable(); got != tt.want {
+				t.Errorf("Reachable = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerUpstreamCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		required  bool
+		wantReady []int // /readyz after authorized, blocked, unreachable, authorized
+	}{
+		{"readiness kept", false, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"GREENAPI_HEALTH_REQUIRED", true, []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable, http.StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &stateUpstream{state: "authorized"}
+			server := fakeGreenAPI(t, upstream.ServeHTTP)
+			s, logs := newTestServer(t, withConfig(withUpstream(server), func(cfg *Config) {
+				cfg.GreenAPIHealthInterval = 5 * time.Millisecond
+				cfg.GreenAPIHealthRequired = tt.required
+			}))
+			s.hc.SetReady(true)
+
+			for i, state := range []string{"authorized", "blocked", upstreamUnreachable, "authorized"} {
+				upstream.set(state)
+				var readyz struct {
+					Status   string         `json:"status"`
+					Upstream upstreamStatus `json:"upstream"`
+				}
+				var code int
+				waitFor(t, "/readyz to show "+state, func() bool {
+					rec := serve(s, http.MethodGet, "/readyz", nil)
+					code = rec.Code
+					return json.Unmarshal(rec.Body.Bytes(), &readyz) == nil && readyz.Upstream.State == state
+				})
+				if code != tt.wantReady[i] {
+					t.Errorf("/readyz while %s = %d (%s), want %d", state, code, readyz.Status, tt.wantReady[i])
+				}
+				// Let a few checks pass in the same state.
+				time.Sleep(30 * time.Millisecond)
+			}
+
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+			// A check canceled by Shutdown may still reach the fake upstream.
+			time.Sleep(10 * time.Millisecond)
+			calls := upstream.calls.Load()
+			time.Sleep(30 * time.Millisecond)
+			if after := upstream.calls.Load(); after != calls {
+				t.Errorf("%d checks after Shutdown", after-calls)
+			}
+
+			out := logs.String()
+			if n := strings.Count(out, `"msg":"GREEN-API instance state changed"`); n != 4 {
+				t.Errorf("logged %d state changes over %d checks, want 4:\n%s", n, calls, out)
+			}
+			for _, want := range []string{`"state":"blocked","latency"`, `"previous":"blocked"`, `"previous":"unreachable"`} {
+				if !strings.Contains(out, want) {
+					t.Errorf("the log lacks %s", want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// fieldError is one problem with a field of an API request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ruleError is a validation failure that knows which rule it broke, so
+// checks shared between request types report it the same way.
+type ruleError struct {
+	rule    string
+	message string
+}
+
+func (e *ruleError) Error() string {
+	return e.message
+}
+
+func newRuleError(rule, format string, args ...any) error {
+	return &ruleError{rule: rule, message: fmt.Sprintf(format, args...)}
+}
+
+// validation collects every problem with a request rather than stopping at
+// the first one.
+type validation struct {
+	errs []fieldError
+}
+
+func (v *validation) add(field, rule, message string) {
+	v.errs = append(v.errs, fieldError{Field: field, Rule: rule, Message: message})
+}
+
+// check records err, when it is not nil, as a problem with field.
+func (v *validation) check(field string, err error) {
+	if err == nil {
+		return
+	}
+	var re *ruleError
+	if errors.As(err, &re) {
+		v.add(field, re.rule, re.message)
+		return
+	}
+	v.add(field, "invalid", err.Error())
+}
+
+func (v *validation) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "required", "must not be empty")
+		return false
+	}
+	return true
+}
+
+func (v *validation) maxLength(field, value string, limit int) {
+	if n := utf8.RuneCountInString(value); n > limit {
+		v.add(field, "max_length", fmt.Sprintf("must be at most %d characters, got %d", limit, n))
+	}
+}
+
+// queryBool reads the boolean query parameter name of r, which is fallback
+// when absent.
+func (v *validation) queryBool(r *http.Request, name string, fallback bool) bool {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		v.add(name, "boolean", "must be true or false")
+		return fallback
+	}
+	return b
+}
+
+// apiRequest is implemented by the JSON bodies of the API endpoints. validate
+// reports every problem to v and may fill in unexported fields with
+// normalized values for the handler.
+type apiRequest interface {
+	validate(ctx context.Context, v *validation)
+}
+
+// decodeRequest decodes the body into req and validates it, answering 400
+// with all problems when it is not valid.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req apiRequest) bool {
+	if !decodeJSONBody(w, r, req) {
+		return false
+	}
+	var v validation
+	req.validate(r.Context(), &v)
+	if len(v.errs) > 0 {
+		writeValidationError(w, r, v.errs)
+		return false
+	}
+	return true
+}
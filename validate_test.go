@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// problems renders errs as field:rule pairs.
+func problems(errs []fieldError) string {
+	var parts []string
+	for _, e := range errs {
+		parts = append(parts, e.Field+":"+e.Rule)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestRequestValidation(t *testing.T) {
+	long := strings.Repeat("x", maxMessageLength+1)
+	tests := []struct {
+		name string
+		req  apiRequest
+		want string
+	}{
+		{"valid message", &sendMessageRequest{ChatID: "79001234567@c.us", Message: "hi"}, ""},
+		{"valid by phone", &sendMessageRequest{Phone: "+7 900 123-45-67", Message: "hi"}, ""},
+		{"empty message body", &sendMessageRequest{}, "chatId:required message:required"},
+		{"bad phone, long message", &sendMessageRequest{Phone: "79OO1234567", Message: long}, "phone:phone_numeric message:max_length"},
+		{"blank message", &sendMessageRequest{ChatID: "79001234567@c.us", Message: "  "}, "message:required"},
+		{"valid file", &sendFileByURLRequest{ChatID: "79001234567@c.us", URLFile: "https://example.com/a.png", FileName: "a.png"}, ""},
+		{"every file field wrong", &sendFileByURLRequest{ChatID: "abc@g.us", URLFile: "/a.png", FileName: "a", Caption: long},
+			"chatId:group_chat_id urlFile:absolute_url fileName:file_name caption:max_length"},
+		{"file URL scheme", &sendFileByURLRequest{ChatID: "79001234567@c.us", URLFile: "ftp://example.com/a.png", FileName: "a.png"}, "urlFile:url_scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v validation
+			tt.req.validate(context.Background(), &v)
+			if got := problems(v.errs); got != tt.want {
+				t.Errorf("problems = %q, want %q", got, tt.want)
+			}
+			for _, e := range v.errs {
+				if e.Message == "" {
+					t.Errorf("%s:%s has no message", e.Field, e.Rule)
+				}
+			}
+		})
+	}
+}
+
+func TestValidationCheck(t *testing.T) {
+	var v validation
+	v.check("a", nil)
+	v.check("b", newRuleError("phone_length", "must have %d to %d digits", 10, 15))
+	v.check("c", fmt.Errorf("wrapped: %w", newRuleError("url_host", "must have a host")))
+	v.check("d", errors.New("something else"))
+
+	want := []fieldError{
+		{"b", "phone_length", "must have 10 to 15 digits"},
+		{"c", "url_host", "must have a host"},
+		{"d", "invalid", "something else"},
+	}
+	if fmt.Sprint(v.errs) != fmt.Sprint(want) {
+		t.Errorf("errs = %v, want %v", v.errs, want)
+	}
+}
+
+func TestValidationQueryBool(t *testing.T) {
+	tests := []struct {
+		query    string
+		fallback bool
+		want     bool
+		wantErr  bool
+	}{
+		{"", true, true, false},
+		{"?async=true", false, true, false},
+		{"?async=0", true, false, false},
+		{"?async=maybe", true, true, true},
+	}
+	for _, tt := range tests {
+		var v validation
+		got := v.queryBool(httptest.NewRequest(http.MethodPost, "/api/sendMessage"+tt.query, nil), "async", tt.fallback)
+		if got != tt.want || (len(v.errs) > 0) != tt.wantErr {
+			t.Errorf("%q: got %t with %v, want %t", tt.query, got, v.errs, tt.want)
+		}
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantFields string
+		wantChatID string
+	}{
+		{"valid", `{"phone":"89001234567","message":"hi"}`, http.StatusOK, "", "79001234567@c.us"},
+		{"every problem", `{"phone":"12","message":""}`, http.StatusBadRequest, "phone:phone_length message:required", ""},
+		{"not JSON", `{"phone":`, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed *sendMessageRequest
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req sendMessageRequest
+				if !decodeRequest(w, r, &req) {
+					return
+				}
+				passed = &req
+				w.WriteHeader(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/api/sendMessage", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if passed == nil || passed.chatID != tt.wantChatID || passed.Message != "hi" {
+					t.Errorf("the handler got %+v", passed)
+				}
+				return
+			}
+			if passed != nil {
+				t.Error("an invalid request reached the handler")
+			}
+			if tt.wantFields == "" {
+				return
+			}
+			var envelope struct {
+				Error struct {
+					Code    string `json:"code"`
+					Details struct {
+						Fields []fieldError `json:"fields"`
+					} `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Error.Code != errCodeValidation || problems(envelope.Error.Details.Fields) != tt.wantFields {
+				t.Errorf("got %s %q, want %s %q", envelope.Error.Code, problems(envelope.Error.Details.Fields), errCodeValidation, tt.wantFields)
+			}
+		})
+	}
+}
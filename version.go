@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func readBuildInfo(appVersion string) buildInfo {
+	info := buildInfo{Version: "unknown"}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.GoVersion = bi.GoVersion
+		if bi.Main.Version != "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.BuildTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	if appVersion != "" {
+		info.Version = appVersion
+	}
+
+	return info
+}
+
+func (b buildInfo) LogAttr() slog.Attr {
+	return slog.Group("build",
+		slog.String("version", b.Version),
+		slog.String("revision", b.Revision),
+		slog.String("build_time", b.BuildTime),
+		slog.String("go_version", b.GoVersion),
+	)
+}
+
+func (b buildInfo) Handler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, b)
+}
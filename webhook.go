@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// NotificationHandler processes one GREEN-API notification. It runs on a
+// worker after the notification has been acknowledged, so it may be slow.
+type NotificationHandler interface {
+	HandleNotification(ctx context.Context, n *greenapi.Notification) error
+}
+
+// NotificationHandlerFunc adapts a function to NotificationHandler.
+type NotificationHandlerFunc func(ctx context.Context, n *greenapi.Notification) error
+
+func (f NotificationHandlerFunc) HandleNotification(ctx context.Context, n *greenapi.Notification) error {
+	return f(ctx, n)
+}
+
+type notificationJob struct {
+	ctx context.Context
+	n   *greenapi.Notification
+}
+
+// notifications dispatches notifications by typeWebhook to registered
+// handlers on a bounded pool of workers.
+type notifications struct {
+	logger   *slog.Logger
+	handlers map[string]NotificationHandler
+
+	// hub, when set, gets every notification that is accepted.
+	hub *notificationHub
+
+	jobs chan notificationJob
+	wg   sync.WaitGroup
+
+	// mu guards closed, so that dispatch never sends on jobs after Close.
+	mu     sync.Mutex
+	closed bool
+}
+
+func newNotifications(logger *slog.Logger, workers, queueSize int) *notifications {
+	d := &notifications{
+		logger:   logger,
+		handlers: make(map[string]NotificationHandler),
+		jobs:     make(chan notificationJob, queueSize),
+	}
+	d.wg.Add(workers)
+	for range workers {
+		go d.work()
+	}
+	return d
+}
+
+// Handle registers h for typeWebhook. It must be called before the first
+// notification is dispatched.
+func (d *notifications) Handle(typeWebhook string, h NotificationHandler) {
+	d.handlers[typeWebhook] = h
+}
+
+// dispatch queues n for its handler. Unknown types are acknowledged and only
+// logged. It reports false when the queue is full or closed; n is then not
+// streamed either, as GREEN-API will deliver it again.
+func (d *notifications) dispatch(ctx context.Context, n *greenapi.Notification) bool {
+	if _, ok := d.handlers[n.TypeWebhook]; !ok {
+		LoggerFromContext(ctx).Debug("Unhandled notification type",
+			slog.String("type_webhook", n.TypeWebhook),
+			slog.Int64("id_instance", n.InstanceData.IDInstance),
+		)
+		d.stream(n)
+		return true
+	}
+
+	// The work outlives the request but keeps its logger and trace.
+	job := notificationJob{ctx: context.WithoutCancel(ctx), n: n}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.jobs <- job:
+		d.stream(n)
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *notifications) stream(n *greenapi.Notification) {
+	if d.hub != nil {
+		d.hub.publish(n)
+	}
+}
+
+func (d *notifications) work() {
+	defer d.wg.Done()
+	for job := range d.jobs {
+		d.run(job)
+	}
+}
+
+func (d *notifications) run(job notificationJob) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			LoggerFromContext(job.ctx).Error("Notification handler panicked",
+				slog.String("type_webhook", job.n.TypeWebhook),
+				slog.Any("panic", rec),
+			)
+		}
+	}()
+
+	if err := d.handlers[job.n.TypeWebhook].HandleNotification(job.ctx, job.n); err != nil {
+		LoggerFromContext(job.ctx).Error("Could not process notification",
+			slog.String("type_webhook", job.n.TypeWebhook),
+			slog.Int64("id_instance", job.n.InstanceData.IDInstance),
+			slog.Any("error", err),
+		)
+	}
+}
+
+// Close stops accepting notifications, so later dispatches report false,
+// and waits for the queued ones to be processed, or for ctx to expire.
+func (d *notifications) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.jobs)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Webhook receives notifications pushed by GREEN-API. It answers as soon as
+// the notification is queued; 503 when the queue is full makes GREEN-API
+// deliver it again later.
+func (d *notifications) Webhook(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if !errors.As(err, &maxBytes) {
+			WriteError(w, r, http.StatusBadRequest, errCodeInvalidBody, "could not read body", nil, slog.Any("error", err))
+		}
+		return
+	}
+
+	n, err := greenapi.ParseNotification(data)
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, errCodeInvalidBody, "invalid JSON body", nil)
+		return
+	}
+	if problems := n.Validate(); len(problems) > 0 {
+		var v validation
+		for _, p := range problems {
+			v.add(p.Field, p.Rule, p.Message)
+		}
+		writeValidationError(w, r, v.errs)
+		return
+	}
+
+	if !d.dispatch(r.Context(), n) {
+		w.Header().Set("Retry-After", "1")
+		WriteError(w, r, http.StatusServiceUnavailable, errCodeQueueFull, "notification queue full", nil,
+			slog.String("type_webhook", n.TypeWebhook))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// registerNotificationHandlers installs the built-in handlers: messages and
+// statuses are logged, state changes update the state used to refuse
+// sending while the instance is not authorized.
+func registerNotificationHandlers(d *notifications, api *greenAPI) {
+	d.Handle(greenapi.WebhookIncomingMessageReceived, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		attrs := []any{
+			slog.Int64("id_instance", n.InstanceData.IDInstance),
+			slog.String("id_message", n.IDMessage),
+		}
+		if n.SenderData != nil {
+			attrs = append(attrs, slog.String("chat_id", n.SenderData.ChatID), slog.String("sender", n.SenderData.Sender))
+		}
+		LoggerFromContext(ctx).Info("Incoming message received", attrs...)
+		return nil
+	}))
+	d.Handle(greenapi.WebhookOutgoingMessageStatus, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		LoggerFromContext(ctx).Info("Outgoing message status",
+			slog.Int64("id_instance", n.InstanceData.IDInstance),
+			slog.String("id_message", n.IDMessage),
+			slog.String("status", n.Status),
+		)
+		return nil
+	}))
+	d.Handle(greenapi.WebhookStateInstanceChanged, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		if n.StateInstance == "" {
+			return errors.New("stateInstanceChanged without stateInstance")
+		}
+		idInstance := strconv.FormatInt(n.InstanceData.IDInstance, 10)
+		api.states.observe(idInstance, n.StateInstance, time.Now())
+		if api.cache != nil {
+			api.cache.invalidate("getStateInstance", idInstance)
+		}
+		LoggerFromContext(ctx).Info("Instance state changed",
+			slog.Int64("id_instance", n.InstanceData.IDInstance),
+			slog.String("state", n.StateInstance),
+		)
+		return nil
+	}))
+}
+
+// WebhookAuth rejects webhook calls that do not carry the configured bearer
+// token (GREEN-API's webhookUrlToken) or, with a non-empty allow list, come
+// from other addresses. An empty token leaves the check to allow alone.
+func WebhookAuth(token string, allow IPNets, next http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(allow) > 0 {
+			if addr, ok := clientIP(r); !ok || !allow.contains(addr) {
+				WriteError(w, r, http.StatusForbidden, errCodeForbidden, "address not allowed", nil)
+				return
+			}
+		}
+
+		if token != "" {
+			if ok, present := checkBearerToken(r, want); !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="webhook"`)
+				WriteError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "invalid webhook token", nil,
+					slog.Bool("token_present", present))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkBearerToken reports whether the bearer token of r has the digest
+// want, and whether r has a token at all. Comparing digests keeps the token
+// length from leaking too.
+func checkBearerToken(r *http.Request, want [sha256.Size]byte) (ok, present bool) {
+	header := r.Header.Get("Authorization")
+	got, bearer := strings.CutPrefix(header, "Bearer ")
+	digest := sha256.Sum256([]byte(got))
+	return bearer && subtle.ConstantTimeCompare(digest[:], want[:]) == 1, header != ""
+}
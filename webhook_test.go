@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AZRV17/test-green-api/internal/greenapi"
+)
+
+// postWebhook posts body to the webhook handler of d, logging at debug to
+// the returned buffer.
+func postWebhook(d *notifications, body string) (*httptest.ResponseRecorder, *logBuffer) {
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	h := ContextLogger(logger, http.HandlerFunc(d.Webhook))
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, logs
+}
+
+// recordNotifications registers a handler for each of types that sends what
+// it gets to the returned channel, which buffers up to 16 notifications.
+func recordNotifications(d *notifications, types ...string) <-chan *greenapi.Notification {
+	got := make(chan *greenapi.Notification, 16)
+	for _, typ := range types {
+		d.Handle(typ, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+			got <- n
+			return nil
+		}))
+	}
+	return got
+}
+
+func TestWebhookDispatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		check func(*greenapi.Notification) bool
+	}{
+		{
+			name: greenapi.WebhookIncomingMessageReceived,
+			body: `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101,"wid":"79001234567@c.us"},"timestamp":1700000000,"idMessage":"BAE5","senderData":{"chatId":"79007654321@c.us","sender":"79007654321@c.us"},"messageData":{"typeMessage":"textMessage"}}`,
+			check: func(n *greenapi.Notification) bool {
+				return n.IDMessage == "BAE5" && n.SenderData != nil && n.SenderData.ChatID == "79007654321@c.us" && len(n.MessageData) > 0
+			},
+		},
+		{
+			name: greenapi.WebhookOutgoingMessageStatus,
+			body: `{"typeWebhook":"outgoingMessageStatus","instanceData":{"idInstance":1101},"timestamp":1700000000,"idMessage":"BAE6","chatId":"79007654321@c.us","status":"delivered"}`,
+			check: func(n *greenapi.Notification) bool {
+				return n.IDMessage == "BAE6" && n.ChatID == "79007654321@c.us" && n.Status == "delivered"
+			},
+		},
+		{
+			name: greenapi.WebhookStateInstanceChanged,
+			body: `{"typeWebhook":"stateInstanceChanged","instanceData":{"idInstance":1101},"timestamp":1700000000,"stateInstance":"notAuthorized"}`,
+			check: func(n *greenapi.Notification) bool {
+				return n.StateInstance == greenapi.StateNotAuthorized
+			},
+		},
+		{
+			name:  greenapi.WebhookDeviceInfo,
+			body:  `{"typeWebhook":"deviceInfo","instanceData":{"idInstance":1101},"timestamp":1700000000}`,
+			check: func(n *greenapi.Notification) bool { return len(n.Raw) > 0 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newNotifications(slog.Default(), 1, 1)
+			got := recordNotifications(d, tt.name)
+
+			rec, _ := postWebhook(d, tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			select {
+			case n := <-got:
+				if n.TypeWebhook != tt.name || n.InstanceData.IDInstance != 1101 || !tt.check(n) {
+					t.Errorf("handler got %+v", n)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the handler was not called")
+			}
+			if err := d.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWebhookUnknownType(t *testing.T) {
+	d := newNotifications(slog.Default(), 1, 1)
+	got := recordNotifications(d, greenapi.WebhookIncomingMessageReceived)
+
+	rec, logs := postWebhook(d, `{"typeWebhook":"somethingNew","instanceData":{"idInstance":1101},"timestamp":1700000000}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `"level":"DEBUG","msg":"Unhandled notification type"`) || !strings.Contains(logs.String(), `"type_webhook":"somethingNew"`) {
+		t.Errorf("want a debug line for the unknown type:\n%s", logs)
+	}
+	d.Close(context.Background())
+	if len(got) != 0 {
+		t.Error("the unknown type reached another handler")
+	}
+}
+
+func TestWebhookRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   string
+		wantFields []string
+	}{
+		{"malformed JSON", `{"typeWebhook":`, errCodeInvalidBody, nil},
+		{"not an object", `[1,2]`, errCodeInvalidBody, nil},
+		{"empty object", `{}`, errCodeValidation, []string{"typeWebhook", "instanceData.idInstance", "timestamp"}},
+		{"no instance", `{"typeWebhook":"incomingMessageReceived","timestamp":1700000000}`, errCodeValidation, []string{"instanceData.idInstance"}},
+		{"negative timestamp", `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":-1}`, errCodeValidation, []string{"timestamp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newNotifications(slog.Default(), 1, 1)
+			defer d.Close(context.Background())
+
+			rec, _ := postWebhook(d, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+			var body struct {
+				Error struct {
+					Code    string `json:"code"`
+					Details struct {
+						Fields []fieldError `json:"fields"`
+					} `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if body.Error.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Error.Code, tt.wantCode)
+			}
+			var fields []string
+			for _, f := range body.Error.Details.Fields {
+				fields = append(fields, f.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestWebhookAnswersBeforeProcessing(t *testing.T) {
+	d := newNotifications(slog.Default(), 1, 1)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var processed atomic.Int32
+	d.Handle(greenapi.WebhookIncomingMessageReceived, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		started <- struct{}{}
+		<-release
+		processed.Add(1)
+		return nil
+	}))
+	const body = `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":1700000000}`
+
+	// The first notification keeps the only worker busy, the second waits in
+	// the queue; neither holds up its answer.
+	tests := []struct {
+		name       string
+		wantStatus int
+	}{
+		{"processing", http.StatusOK},
+		{"queued", http.StatusOK},
+		{"queue full", http.StatusServiceUnavailable},
+	}
+	for i, tt := range tests {
+		start := time.Now()
+		rec, _ := postWebhook(d, body)
+		if rec.Code != tt.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: answered after %s", tt.name, elapsed)
+		}
+		if tt.wantStatus == http.StatusServiceUnavailable && (rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), errCodeQueueFull)) {
+			t.Errorf("%s: got %q, Retry-After %q", tt.name, rec.Body, rec.Header().Get("Retry-After"))
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+
+	close(release)
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if processed.Load() != 2 {
+		t.Errorf("Close returned with %d of the 2 accepted notifications processed", processed.Load())
+	}
+}
+
+func TestWebhookHandlerFailures(t *testing.T) {
+	logs := captureDefaultLog(t)
+	d := newNotifications(slog.Default(), 1, 2)
+	d.Handle("failing", NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		return errors.New("store down")
+	}))
+	d.Handle("panicking", NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		panic("boom")
+	}))
+
+	for _, typ := range []string{"failing", "panicking"} {
+		n := &greenapi.Notification{TypeWebhook: typ, InstanceData: greenapi.InstanceData{IDInstance: 1101}, Timestamp: 1}
+		if !d.dispatch(context.Background(), n) {
+			t.Fatalf("%s was not queued", typ)
+		}
+	}
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	out := logs.String()
+	for _, want := range []string{`"msg":"Could not process notification"`, `"error":"store down"`, `"msg":"Notification handler panicked"`, `"panic":"boom"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the log lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestWebhookAfterClose(t *testing.T) {
+	d := newNotifications(slog.Default(), 2, 4)
+	var processed atomic.Int32
+	d.Handle(greenapi.WebhookIncomingMessageReceived, NotificationHandlerFunc(func(ctx context.Context, n *greenapi.Notification) error {
+		processed.Add(1)
+		return nil
+	}))
+	const body = `{"typeWebhook":"incomingMessageReceived","instanceData":{"idInstance":1101},"timestamp":1700000000}`
+
+	// Deliveries racing Close are either queued or refused, never a panic.
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec, _ := postWebhook(d, body); rec.Code == http.StatusOK {
+				accepted.Add(1)
+			}
+		}()
+	}
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	rec, _ := postWebhook(d, body)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("after Close: status = %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if processed.Load() != accepted.Load() {
+		t.Errorf("%d notifications processed, %d accepted", processed.Load(), accepted.Load())
+	}
+}
+
+func TestWebhookThroughServer(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	rec, _ := callAPI(t, s, http.MethodPost, "/webhook",
+		`{"typeWebhook":"stateInstanceChanged","instanceData":{"idInstance":1101},"timestamp":1700000000,"stateInstance":"authorized"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWebhookAuth(t *testing.T) {
+	const body = `{"typeWebhook":"deviceInfo","instanceData":{"idInstance":1101},"timestamp":1700000000}`
+	tests := []struct {
+		name          string
+		token         string
+		allow         string
+		authorization string
+		remoteAddr    string
+		wantStatus    int
+		wantPresent   string
+	}{
+		{"valid token", "hook-secret", "", "Bearer hook-secret", "203.0.113.7:4000", http.StatusOK, ""},
+		{"missing token", "hook-secret", "", "", "203.0.113.7:4000", http.StatusUnauthorized, `"token_present":false`},
+		{"wrong token", "hook-secret", "", "Bearer guess", "203.0.113.7:4000", http.StatusUnauthorized, `"token_present":true`},
+		{"token prefix", "hook-secret", "", "Bearer hook-secre", "203.0.113.7:4000", http.StatusUnauthorized, `"token_present":true`},
+		{"no scheme", "hook-secret", "", "hook-secret", "203.0.113.7:4000", http.StatusUnauthorized, `"token_present":true`},
+		{"allowed address", "", "203.0.113.0/24", "", "203.0.113.7:4000", http.StatusOK, ""},
+		{"other address", "", "203.0.113.0/24", "", "198.51.100.1:4000", http.StatusForbidden, ""},
+		{"allowed address, wrong token", "hook-secret", "203.0.113.0/24", "Bearer guess", "203.0.113.7:4000", http.StatusUnauthorized, `"token_present":true`},
+		{"no checks", "", "", "", "198.51.100.1:4000", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, logs := newTestServer(t, func(cfg *Config) {
+				cfg.WebhookAuthToken = tt.token
+				cfg.WebhookAllow = nil
+				if tt.allow != "" {
+					if err := cfg.WebhookAllow.UnmarshalText([]byte(tt.allow)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/json")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if got := rec.Header().Get("WWW-Authenticate"); got != `Bearer realm="webhook"` {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				out := logs.String()
+				if !strings.Contains(out, `"msg":"API error"`) || !strings.Contains(out, tt.wantPresent) || !strings.Contains(out, `"remote_addr":"`+tt.remoteAddr+`"`) {
+					t.Errorf("the rejection is not logged with the source address:\n%s", out)
+				}
+				if strings.Contains(out, tt.token) {
+					t.Errorf("the configured token was logged:\n%s", out)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookWarnsWithoutToken(t *testing.T) {
+	for _, token := range []string{"", "hook-secret"} {
+		_, logs := newTestServer(t, func(cfg *Config) { cfg.WebhookAuthToken = token })
+		warned := strings.Contains(logs.String(), "WEBHOOK_AUTH_TOKEN is not set")
+		if warned != (token == "") {
+			t.Errorf("token %q: warned = %t", token, warned)
+		}
+	}
+}
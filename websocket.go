@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes and close codes from RFC 6455.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+)
+
+// wsAcceptGUID is appended to Sec-WebSocket-Key to compute the accept key.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxClientMessage bounds what is read of a message from the client; the
+// stream endpoints do not expect any, so larger ones end the connection.
+const wsMaxClientMessage = 4 << 10
+
+var errWSClosed = errors.New("websocket: connection closed")
+
+// wsConn is the server side of a WebSocket connection, as much of RFC 6455
+// as pushing text messages needs: no extensions, and messages from the
+// client are read only to be discarded. Writes may come from any goroutine;
+// reads from one.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu sync.Mutex
+	// closeSent is set once a close frame went out; nothing else may
+	// follow it.
+	closeSent bool
+}
+
+// acceptWebSocket completes the opening handshake of r and takes over its
+// connection. It answers 426 or 400 itself when r is not a valid WebSocket
+// request and 403 when checkOrigin rejects its Origin.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool) (*wsConn, bool) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		WriteError(w, r, http.StatusUpgradeRequired, errCodeUpgradeRequired, "this endpoint only speaks WebSocket", nil)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		WriteError(w, r, http.StatusBadRequest, errCodeInvalidHandshake, "unsupported WebSocket version", nil)
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		WriteError(w, r, http.StatusBadRequest, errCodeInvalidHandshake, "invalid Sec-WebSocket-Key", nil)
+		return nil, false
+	}
+	if !checkOrigin(r) {
+		WriteError(w, r, http.StatusForbidden, errCodeForbidden, "origin not allowed", nil,
+			slog.String("origin", r.Header.Get("Origin")))
+		return nil, false
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, errCodeInternal, "could not take over the connection", nil, slog.Any("error", err))
+		return nil, false
+	}
+	// READ_TIMEOUT and WRITE_TIMEOUT were set for the HTTP request; the
+	// connection keeps its own deadlines from here on.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, true
+}
+
+// headerHasToken reports whether the comma-separated header key lists token,
+// ignoring case.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the Origin of r, if any, names its own host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	_, host, ok := strings.Cut(origin, "://")
+	return ok && strings.EqualFold(host, r.Host)
+}
+
+// writeText sends payload as one text message.
+func (c *wsConn) writeText(payload []byte, timeout time.Duration) error {
+	return c.writeFrame(wsOpText, payload, timeout)
+}
+
+// ping sends a ping; the client answers with a pong to the reader.
+func (c *wsConn) ping(timeout time.Duration) error {
+	return c.writeFrame(wsOpPing, nil, timeout)
+}
+
+// writeClose starts or answers the closing handshake.
+func (c *wsConn) writeClose(code int, reason string, timeout time.Duration) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(wsOpClose, payload, timeout)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return errWSClosed
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := (&net.Buffers{header, payload}).WriteTo(c.conn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// wsCloseError ends a connection: the client closed it, or sent something
+// that makes the server close it with code.
+type wsCloseError struct {
+	code   int
+	remote bool
+}
+
+func (e *wsCloseError) Error() string {
+	if e.remote {
+		return fmt.Sprintf("websocket: closed by client with code %d", e.code)
+	}
+	return fmt.Sprintf("websocket: closing with code %d", e.code)
+}
+
+// readControl reads frames until the connection ends: it answers pings
+// itself, reports pongs to onPong and discards data messages. The close
+// frame of the client is answered, and one is sent when the client breaks
+// the protocol; both end with *wsCloseError.
+func (c *wsConn) readControl(onPong func(), timeout time.Duration) error {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.writeClose(closeErr.code, "", timeout)
+			}
+			return err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload, timeout); err != nil {
+				return err
+			}
+		case wsOpPong:
+			onPong()
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeClose(code, "", timeout)
+			return &wsCloseError{code: code, remote: true}
+		}
+	}
+}
+
+// readFrame reads one frame from the client, unmasked.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	final := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	if head[0]&0x70 != 0 || !masked {
+		return 0, nil, &wsCloseError{code: wsCloseProtocolError}
+	}
+	control := opcode >= wsOpClose
+	if control && (!final || length > 125) {
+		return 0, nil, &wsCloseError{code: wsCloseProtocolError}
+	}
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary, wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return 0, nil, &wsCloseError{code: wsCloseProtocolError}
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxClientMessage {
+		return 0, nil, &wsCloseError{code: wsCloseTooBig}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// setReadDeadline bounds the wait for the next frame from the client.
+func (c *wsConn) setReadDeadline(t time.Time) {
+	c.conn.SetReadDeadline(t)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}